@@ -3,6 +3,10 @@ package main
 import (
 	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 )
 
 func parseAuthBackend(authBackend string) (*url.URL, error) {
@@ -18,8 +22,8 @@ func parseAuthBackend(authBackend string) (*url.URL, error) {
 		}
 	}
 
-	if backendURL.Scheme != "http" {
-		return nil, fmt.Errorf("invalid scheme, only 'http' is allowed: %q", authBackend)
+	if backendURL.Scheme != "http" && backendURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme, only 'http' and 'https' are allowed: %q", authBackend)
 	}
 
 	if backendURL.Host == "" {
@@ -28,3 +32,36 @@ func parseAuthBackend(authBackend string) (*url.URL, error) {
 
 	return backendURL, nil
 }
+
+// parseAuthBackends parses a comma separated list of backends, each
+// optionally followed by =weight, e.g. "http://puma1:8080=3,http://puma2:8080"
+func parseAuthBackends(authBackends string) ([]config.BackendTarget, error) {
+	var targets []config.BackendTarget
+
+	for _, entry := range strings.Split(authBackends, ",") {
+		entry = strings.TrimSpace(entry)
+		weight := 1
+
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			w, err := strconv.Atoi(entry[i+1:])
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", entry)
+			}
+			entry, weight = entry[:i], w
+		}
+
+		backendURL, err := parseAuthBackend(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// Relative URL support needs the same path on every backend
+		if len(targets) > 0 && backendURL.Path != targets[0].URL.Path {
+			return nil, fmt.Errorf("all backends must have the same path: %q and %q", targets[0].URL, backendURL)
+		}
+
+		targets = append(targets, config.BackendTarget{URL: backendURL, Weight: weight})
+	}
+
+	return targets, nil
+}
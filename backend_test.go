@@ -8,7 +8,6 @@ func TestParseAuthBackend(t *testing.T) {
 	failures := []string{
 		"",
 		"ftp://localhost",
-		"https://example.com",
 	}
 
 	for _, example := range failures {
@@ -22,6 +21,7 @@ func TestParseAuthBackend(t *testing.T) {
 		{"localhost:3000", "localhost:3000", "http"},
 		{"http://localhost", "localhost", "http"},
 		{"localhost", "localhost", "http"},
+		{"https://example.com", "example.com", "https"},
 	}
 
 	for _, example := range successes {
@@ -40,3 +40,36 @@ func TestParseAuthBackend(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAuthBackends(t *testing.T) {
+	failures := []string{
+		"",
+		"http://puma1:8080,ftp://puma2",
+		"http://puma1:8080=0",
+		"http://puma1:8080=heavy",
+		"http://puma1/gitlab,http://puma2/",
+	}
+
+	for _, example := range failures {
+		if _, err := parseAuthBackends(example); err == nil {
+			t.Errorf("error expected for %q", example)
+		}
+	}
+
+	targets, err := parseAuthBackends("http://puma1:8080=3, puma2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(targets))
+	}
+
+	if targets[0].URL.Host != "puma1:8080" || targets[0].Weight != 3 {
+		t.Errorf("unexpected first target %v weight %d", targets[0].URL, targets[0].Weight)
+	}
+
+	if targets[1].URL.Host != "puma2:8080" || targets[1].Weight != 1 {
+		t.Errorf("unexpected second target %v weight %d", targets[1].URL, targets[1].Weight)
+	}
+}
@@ -103,7 +103,7 @@ func TestChannelSessionTimeout(t *testing.T) {
 	client.SetReadDeadline(time.Now().Add(time.Duration(2) * time.Second))
 	_, _, err = client.ReadMessage()
 
-	if !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
 		t.Fatalf("Client connection was not closed, got %v", err)
 	}
 }
@@ -0,0 +1,60 @@
+/*
+Package client uploads files the way Workhorse does, for the other Go
+services of GitLab, like gitlab-shell, that receive files GitLab Rails
+authorized.
+
+Rails answers the authorization request of an upload with the temporary
+path to write the file to and, when direct upload is enabled, presigned
+object storage URLs. UploadFile sends the file to all of them, with a
+single PUT or a multipart upload, and returns what Rails needs to
+finalize the upload.
+*/
+package client
+
+import (
+	"context"
+	"io"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+)
+
+// RemoteObject holds the presigned object storage URLs of an upload
+type RemoteObject = api.RemoteObject
+
+// MultipartUploadParams holds the presigned URLs of a multipart upload
+type MultipartUploadParams = api.MultipartUploadParams
+
+// UploadedFile is a file saved by UploadFile. GitLabFinalizeFields
+// returns the fields to send to Rails to finalize the upload.
+type UploadedFile = filestore.FileHandler
+
+// ErrEntityTooLarge means that the file is bigger than the MaximumSize of
+// the authorization
+var ErrEntityTooLarge = filestore.ErrEntityTooLarge
+
+// PreauthResponse is the part of the authorization response of Rails that
+// tells where to upload a file. It decodes from the JSON Rails sends.
+type PreauthResponse struct {
+	// TempPath is the directory where to write a local copy of the file
+	TempPath string
+	// RemoteObject holds the presigned URLs of direct uploads
+	RemoteObject RemoteObject
+	// MaximumSize is the size in bytes above which the upload fails with
+	// ErrEntityTooLarge. Zero means no limit.
+	MaximumSize int64
+}
+
+// UploadFile saves size bytes of reader where preauth says. A size of -1
+// means that it is unknown. The local copy and the uploaded object are
+// removed once ctx is done, so ctx must last until Rails finalized the
+// upload.
+func UploadFile(ctx context.Context, preauth *PreauthResponse, reader io.Reader, size int64) (*UploadedFile, error) {
+	opts := filestore.GetOpts(&api.Response{
+		TempPath:     preauth.TempPath,
+		RemoteObject: preauth.RemoteObject,
+		MaximumSize:  preauth.MaximumSize,
+	})
+
+	return filestore.SaveFileFromReader(ctx, reader, size, opts)
+}
@@ -0,0 +1,91 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/client"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+)
+
+func TestUploadFileDecodedFromRails(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	tmpFolder, err := ioutil.TempDir("", "workhorse-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	objectURL := ts.URL + test.ObjectPath
+	body := fmt.Sprintf(`{"TempPath":%q,"MaximumSize":100,"RemoteObject":{"ID":"id","GetURL":%q,"StoreURL":%q,"DeleteURL":%q}}`, tmpFolder, objectURL, objectURL, objectURL)
+	var preauth client.PreauthResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &preauth))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := client.UploadFile(ctx, &preauth, strings.NewReader(test.ObjectContent), test.ObjectSize)
+	require.NoError(t, err)
+
+	require.Equal(t, test.ObjectSize, fh.Size)
+	require.Equal(t, test.ObjectMD5, fh.MD5())
+	require.Equal(t, 1, osStub.PutsCnt())
+	require.Equal(t, test.ObjectMD5, osStub.GetObjectMD5(test.ObjectPath))
+
+	fields := fh.GitLabFinalizeFields("file")
+	require.Equal(t, "id", fields["file.remote_id"])
+	require.Equal(t, objectURL, fields["file.remote_url"])
+	require.Equal(t, test.ObjectMD5, fields["file.etag"])
+
+	content, err := ioutil.ReadFile(fh.LocalPath)
+	require.NoError(t, err)
+	require.Equal(t, test.ObjectContent, string(content))
+}
+
+func TestUploadFileMultipart(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+	require.NoError(t, osStub.InitiateMultipartUpload(test.ObjectPath))
+
+	objectURL := ts.URL + test.ObjectPath
+	preauth := &client.PreauthResponse{
+		RemoteObject: client.RemoteObject{
+			ID:     "id",
+			GetURL: objectURL,
+			MultipartUpload: &client.MultipartUploadParams{
+				PartSize:    test.ObjectSize,
+				PartURLs:    []string{objectURL + "?partNumber=1"},
+				CompleteURL: objectURL,
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := client.UploadFile(ctx, preauth, strings.NewReader(test.ObjectContent), -1)
+	require.NoError(t, err)
+
+	require.Equal(t, test.ObjectSize, fh.Size)
+	require.Empty(t, fh.LocalPath)
+	require.Equal(t, test.ObjectMD5, fh.MD5())
+	require.False(t, osStub.IsMultipartUpload(test.ObjectPath), "the multipart upload wasn't completed")
+}
+
+func TestUploadFileTooLarge(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-client")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	preauth := &client.PreauthResponse{TempPath: tmpFolder, MaximumSize: test.ObjectSize - 1}
+
+	_, err = client.UploadFile(context.Background(), preauth, strings.NewReader(test.ObjectContent), test.ObjectSize)
+	require.Equal(t, client.ErrEntityTooLarge, err)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"archive/tar"
 	"context"
 	"flag"
 	"fmt"
@@ -25,7 +26,7 @@ func main() {
 	}
 
 	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s FILE.ZIP\n", progName)
+		fmt.Fprintf(os.Stderr, "Usage: %s FILE.ZIP|FILE.TAR.ZST\n", progName)
 		os.Exit(1)
 	}
 
@@ -33,6 +34,13 @@ func main() {
 	defer cancel()
 
 	archive, err := zipartifacts.OpenArchive(ctx, os.Args[1])
+	if err == zipartifacts.ErrNotAZip {
+		// Runners may compress artifacts with zstd instead
+		if err := generateZstdMetadata(ctx, os.Args[1]); err != nil {
+			fatalError(err)
+		}
+		return
+	}
 	if err != nil {
 		fatalError(err)
 	}
@@ -42,6 +50,20 @@ func main() {
 	}
 }
 
+func generateZstdMetadata(ctx context.Context, archivePath string) error {
+	archive, err := zipartifacts.OpenZstdArchive(ctx, archivePath)
+	if err != nil {
+		return err
+	}
+
+	if err := zipartifacts.GenerateTarMetadata(os.Stdout, tar.NewReader(archive)); err != nil {
+		archive.Close()
+		return err
+	}
+
+	return archive.Close()
+}
+
 func fatalError(err error) {
 	fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
 	if err == zipartifacts.ErrNotAZip {
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// effectiveConfig holds the config.Config in effect, the flags merged
+// with the config file. It changes on SIGHUP.
+var effectiveConfig atomic.Value
+
+// configDump is logged as a JSON object by the JSON formatter, and as a
+// string by the text formatter
+type configDump []byte
+
+func (d configDump) MarshalJSON() ([]byte, error) { return d, nil }
+func (d configDump) String() string               { return string(d) }
+
+// setEffectiveConfig records cfg as the config in effect and logs it, so
+// that support can see what an instance runs with
+func setEffectiveConfig(cfg config.Config) {
+	effectiveConfig.Store(cfg)
+	logEffectiveConfig()
+}
+
+func logEffectiveConfig() {
+	cfg, ok := effectiveConfig.Load().(config.Config)
+	if !ok {
+		return
+	}
+
+	dump, err := config.DumpConfig(cfg)
+	if err != nil {
+		log.WithError(err).Error("Unable to dump the configuration")
+		return
+	}
+
+	log.WithField("config", configDump(dump)).Info("Effective configuration")
+}
+
+// dumpConfigOnSIGUSR1 logs the effective config on SIGUSR1
+func dumpConfigOnSIGUSR1() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	for range usr1 {
+		logEffectiveConfig()
+	}
+}
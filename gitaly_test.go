@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -218,6 +219,42 @@ func TestPostReceivePackProxiedToGitalySuccessfully(t *testing.T) {
 	testhelper.AssertResponseHeader(t, resp, "Content-Type", "application/x-git-receive-pack-result")
 }
 
+func TestPostUploadArchiveProxiedToGitalySuccessfully(t *testing.T) {
+	apiResponse := gitOkBody(t)
+
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	apiResponse.GitalyServer.Address = "unix:" + socketPath
+	ts := testAuthServer(nil, nil, 200, apiResponse)
+	defer ts.Close()
+
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	requestBody := "0016argument --format=zip001aargument refs/heads/master0000"
+	resource := "/gitlab-org/gitlab-test.git/git-upload-archive"
+	resp, body := httpPost(
+		t,
+		ws.URL+resource,
+		map[string]string{"Content-Type": "application/x-git-upload-archive-request"},
+		[]byte(requestBody),
+	)
+
+	split := strings.SplitN(body, "\000", 2)
+	require.Len(t, split, 2)
+
+	gitalyRequest := &gitalypb.SSHUploadArchiveRequest{}
+	require.NoError(t, jsonpb.UnmarshalString(split[0], gitalyRequest))
+
+	require.Equal(t, apiResponse.Repository.StorageName, gitalyRequest.Repository.StorageName)
+	require.Equal(t, apiResponse.Repository.RelativePath, gitalyRequest.Repository.RelativePath)
+
+	require.Equal(t, 200, resp.StatusCode, "POST %q", resource)
+	require.Equal(t, requestBody, split[1])
+	testhelper.AssertResponseHeader(t, resp, "Content-Type", "application/x-git-upload-archive-result")
+}
+
 func TestPostReceivePackProxiedToGitalyInterrupted(t *testing.T) {
 	apiResponse := gitOkBody(t)
 
@@ -396,6 +433,52 @@ func TestGetPatchProxiedToGitalySuccessfully(t *testing.T) {
 	assert.Equal(t, expectedBody, string(body), "GET %q: response body", resp.Request.URL)
 }
 
+func TestGetPatchInvalidRequest(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	// The fake Gitaly server fails before sending any data if the
+	// repository is incomplete
+	gitalyAddress := "unix:" + socketPath
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"RawPatchRequest":"{\"repository\":{\"storageName\":\"default\"},\"rightCommitId\":\"e395f646b1499e8e0279445fc99a0596a65fab7e\",\"leftCommitId\":\"8a0f2ee90d940bfb0ba1e14e8214b0649056e4ab\"}"}`,
+		gitalyAddress)
+
+	resp, _, err := doSendDataRequest("/something", "git-format-patch", jsonParams)
+	require.NoError(t, err)
+
+	require.Equal(t, 500, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+}
+
+func TestGetBlobProxiedToGitalySuccessfully(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	gitalyAddress := "unix:" + socketPath
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"GetBlobRequest":{"repository":{"storage_name":"default","relative_path":"foo/bar.git"},"oid":"54fcc214b94e78d7a41a9a8fe6d87a5e59500e51","limit":-1}}`,
+		gitalyAddress)
+
+	resp, body, err := doSendDataRequest("/something", "git-blob", jsonParams)
+	require.NoError(t, err)
+
+	require.Equal(t, 200, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+	require.Equal(t, testhelper.GitalyGetBlobResponseMock, string(body), "GET %q: response body", resp.Request.URL)
+	testhelper.AssertResponseHeader(t, resp, "Content-Length", strconv.Itoa(len(testhelper.GitalyGetBlobResponseMock)))
+}
+
+func TestGetBlobNotFound(t *testing.T) {
+	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
+	defer gitalyServer.Stop()
+
+	gitalyAddress := "unix:" + socketPath
+	jsonParams := fmt.Sprintf(`{"GitalyServer":{"Address":"%s","Token":""},"GetBlobRequest":{"repository":{"storage_name":"default","relative_path":"foo/bar.git"},"oid":"%s","limit":-1}}`,
+		gitalyAddress, testhelper.GitalyMissingBlobOid)
+
+	resp, _, err := doSendDataRequest("/something", "git-blob", jsonParams)
+	require.NoError(t, err)
+
+	require.Equal(t, 404, resp.StatusCode, "GET %q: status code", resp.Request.URL)
+}
+
 func TestGetBlobProxiedToGitalyInterruptedStream(t *testing.T) {
 	gitalyServer, socketPath := startGitalyServer(t, codes.OK)
 	defer gitalyServer.Stop()
@@ -694,6 +777,7 @@ func startGitalyServer(t *testing.T, finalMessageCode codes.Code) (*combinedServ
 	gitalypb.RegisterBlobServiceServer(server, gitalyServer)
 	gitalypb.RegisterRepositoryServiceServer(server, gitalyServer)
 	gitalypb.RegisterDiffServiceServer(server, gitalyServer)
+	gitalypb.RegisterSSHServiceServer(server, gitalyServer)
 
 	go server.Serve(listener)
 
@@ -1,12 +1,13 @@
 module gitlab.com/gitlab-org/gitlab-workhorse
 
-go 1.12
+go 1.20
 
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/FZambia/sentinel v1.0.0
+	github.com/andybalholm/brotli v1.0.6
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
-	github.com/getsentry/raven-go v0.1.2
+	github.com/getsentry/sentry-go v0.3.0
 	github.com/golang/gddo v0.0.0-20190419222130-af0f2af80721
 	github.com/golang/protobuf v1.3.2
 	github.com/gomodule/redigo v2.0.0+incompatible
@@ -15,7 +16,10 @@ require (
 	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0
 	github.com/jfbus/httprs v0.0.0-20190827093123-b0af8319bb15
 	github.com/jpillora/backoff v0.0.0-20170918002102-8eab2debe79d
+	github.com/opentracing/opentracing-go v1.0.2
+	github.com/oschwald/maxminddb-golang v1.3.1
 	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/rafaeljusto/redigomock v0.0.0-20190202135759-257e089e14a1
 	github.com/sebest/xff v0.0.0-20160910043805-6c115e0ffa35
 	github.com/sirupsen/logrus v1.3.0
@@ -24,8 +28,24 @@ require (
 	gitlab.com/gitlab-org/labkit v0.0.0-20200327153541-fac94cb428e6
 	golang.org/x/lint v0.0.0-20191125180803-fdd1cda4f05f
 	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa
-	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
+	golang.org/x/text v0.3.2
 	golang.org/x/tools v0.0.0-20200117161641-43d50277825c
 	google.golang.org/grpc v1.24.0
 	honnef.co/go/tools v0.0.1-2019.2.3
 )
+
+require (
+	github.com/beorn7/perks v1.0.0 // indirect
+	github.com/client9/reopen v1.0.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/mitchellh/copystructure v1.0.0 // indirect
+	github.com/mitchellh/reflectwalk v1.0.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/common v0.4.1 // indirect
+	github.com/prometheus/procfs v0.0.2 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
+	google.golang.org/genproto v0.0.0-20200115191322-ca5a22157cba // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
+)
@@ -0,0 +1,110 @@
+/*
+Package accesslog drops or samples access log entries for noisy requests
+such as health checks and metrics scrapes
+*/
+package accesslog
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// Fields set by the labkit access logger
+const (
+	uriField      = "uri"
+	statusField   = "status"
+	durationField = "duration_ms"
+)
+
+type rule struct {
+	path       *regexp.Regexp
+	sampleRate float64
+}
+
+// filter is a logrus.Formatter that formats nothing for the entries it
+// drops. This is the only hook labkit's access logger gives us.
+type filter struct {
+	next          logrus.Formatter
+	rules         []rule
+	sampleRate    float64
+	slowThreshold time.Duration
+	random        func() float64
+}
+
+// NewFilter returns a formatter that passes entries kept according to cfg
+// on to next. Server errors and slow requests are always kept.
+func NewFilter(cfg config.AccessLogConfig, next logrus.Formatter) (logrus.Formatter, error) {
+	f := &filter{
+		next:       next,
+		sampleRate: 1,
+		random:     rand.Float64,
+	}
+
+	if cfg.SampleRate != nil {
+		f.sampleRate = *cfg.SampleRate
+	}
+	if f.sampleRate < 0 || f.sampleRate > 1 {
+		return nil, fmt.Errorf("access log: SampleRate must be between 0 and 1")
+	}
+
+	if cfg.SlowRequestThreshold != nil {
+		f.slowThreshold = cfg.SlowRequestThreshold.Duration
+	}
+
+	for i, r := range cfg.Rules {
+		path, err := regexp.Compile(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("access log rule %d: Path: %v", i, err)
+		}
+		if r.SampleRate < 0 || r.SampleRate > 1 {
+			return nil, fmt.Errorf("access log rule %d: SampleRate must be between 0 and 1", i)
+		}
+		f.rules = append(f.rules, rule{path: path, sampleRate: r.SampleRate})
+	}
+
+	return f, nil
+}
+
+func (f *filter) Format(entry *logrus.Entry) ([]byte, error) {
+	if !f.keep(entry.Data) {
+		return nil, nil
+	}
+
+	return f.next.Format(entry)
+}
+
+func (f *filter) keep(data logrus.Fields) bool {
+	if status, ok := data[statusField].(int); ok && status >= 500 {
+		return true
+	}
+
+	if duration, ok := data[durationField].(int64); ok && f.slowThreshold > 0 && time.Duration(duration)*time.Millisecond >= f.slowThreshold {
+		return true
+	}
+
+	sampleRate := f.sampleRate
+	uri, _ := data[uriField].(string)
+	path := strings.SplitN(uri, "?", 2)[0]
+	for _, r := range f.rules {
+		if r.path.MatchString(path) {
+			sampleRate = r.sampleRate
+			break
+		}
+	}
+
+	switch sampleRate {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+
+	return f.random() < sampleRate
+}
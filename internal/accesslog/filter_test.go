@@ -0,0 +1,100 @@
+package accesslog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func newTestLogger(t *testing.T, cfg config.AccessLogConfig) (*logrus.Logger, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.Out = buf
+
+	formatter, err := NewFilter(cfg, &logrus.JSONFormatter{})
+	require.NoError(t, err)
+	logger.Formatter = formatter
+
+	return logger, buf
+}
+
+func logAccess(logger *logrus.Logger, uri string, status int, duration time.Duration) {
+	logger.WithFields(logrus.Fields{
+		uriField:      uri,
+		statusField:   status,
+		durationField: int64(duration / time.Millisecond),
+	}).Info("access")
+}
+
+func TestFilter(t *testing.T) {
+	sampleRate := 1.0
+	logger, buf := newTestLogger(t, config.AccessLogConfig{
+		Rules: []config.AccessLogRule{
+			{Path: `^/-/(health|readiness|liveness)\z`, SampleRate: 0},
+		},
+		SampleRate:           &sampleRate,
+		SlowRequestThreshold: &config.TomlDuration{Duration: time.Second},
+	})
+
+	testCases := []struct {
+		desc     string
+		uri      string
+		status   int
+		duration time.Duration
+		logged   bool
+	}{
+		{desc: "excluded path", uri: "/-/health", status: 200, logged: false},
+		{desc: "excluded path with query", uri: "/-/readiness?all=1", status: 200, logged: false},
+		{desc: "other path", uri: "/api/v4/projects", status: 200, logged: true},
+		{desc: "excluded path with server error", uri: "/-/health", status: 503, logged: true},
+		{desc: "slow excluded path", uri: "/-/liveness", status: 200, duration: 2 * time.Second, logged: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buf.Reset()
+			logAccess(logger, tc.uri, tc.status, tc.duration)
+			require.Equal(t, tc.logged, buf.Len() > 0)
+		})
+	}
+}
+
+func TestFilterSampling(t *testing.T) {
+	sampleRate := 0.25
+	logger, buf := newTestLogger(t, config.AccessLogConfig{
+		Rules:      []config.AccessLogRule{{Path: "^/api/", SampleRate: 1}},
+		SampleRate: &sampleRate,
+	})
+
+	random := 0.0
+	logger.Formatter.(*filter).random = func() float64 { return random }
+
+	random = 0.2
+	logAccess(logger, "/group/project", 200, 0)
+	require.NotZero(t, buf.Len(), "sampled in")
+
+	buf.Reset()
+	random = 0.3
+	logAccess(logger, "/group/project", 200, 0)
+	require.Zero(t, buf.Len(), "sampled out")
+
+	logAccess(logger, "/api/v4/projects", 200, 0)
+	require.NotZero(t, buf.Len(), "rule overrides the default sample rate")
+}
+
+func TestNewFilterInvalidConfig(t *testing.T) {
+	invalidRate := 2.0
+	for _, cfg := range []config.AccessLogConfig{
+		{SampleRate: &invalidRate},
+		{Rules: []config.AccessLogRule{{Path: "(", SampleRate: 0}}},
+		{Rules: []config.AccessLogRule{{Path: "^/", SampleRate: -1}}},
+	} {
+		_, err := NewFilter(cfg, &logrus.JSONFormatter{})
+		require.Error(t, err)
+	}
+}
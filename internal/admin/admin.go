@@ -0,0 +1,209 @@
+/*
+Package admin serves an API for routine runtime operations, so that they
+don't need a restart: changing the log level, toggling maintenance mode,
+flushing caches and listing long requests in flight.
+
+The API is only served on a Unix socket or a loopback address, and needs
+the bearer token of the admin configuration.
+*/
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/builds"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/listener"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/staticpages"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
+)
+
+const (
+	defaultMinDuration = 10 * time.Second
+	// The socket is only accessible to the user of Workhorse
+	socketUmask = 0077
+)
+
+// Enabled tells if cfg configures the admin API
+func Enabled(cfg config.AdminConfig) bool {
+	return cfg.Socket != "" || cfg.Addr != ""
+}
+
+// Validate checks cfg without listening
+func Validate(cfg config.AdminConfig) error {
+	_, err := NewHandler(cfg)
+	return err
+}
+
+// Listen opens the listener of the admin API
+func Listen(cfg config.AdminConfig) (net.Listener, error) {
+	if cfg.Socket != "" {
+		return listener.New(config.ListenerConfig{Network: "unix", Addr: cfg.Socket, Umask: socketUmask})
+	}
+	return listener.New(config.ListenerConfig{Addr: cfg.Addr})
+}
+
+// NewHandler returns the admin API
+func NewHandler(cfg config.AdminConfig) (http.Handler, error) {
+	if cfg.Socket != "" && cfg.Addr != "" {
+		return nil, fmt.Errorf("Socket and Addr are exclusive")
+	}
+	if cfg.Addr != "" {
+		if err := checkLoopback(cfg.Addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.TokenFile == "" {
+		return nil, fmt.Errorf("TokenFile is required")
+	}
+	data, err := ioutil.ReadFile(cfg.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return nil, fmt.Errorf("%s is empty", cfg.TokenFile)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/log_level", handleLogLevel)
+	mux.HandleFunc("/maintenance", handleMaintenance)
+	mux.HandleFunc("/caches/flush", handleFlushCaches)
+	mux.HandleFunc("/requests", handleRequests)
+
+	return helper.RequireBearerToken(token, mux), nil
+}
+
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("Addr: %v", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("Addr must be a loopback address, got %q", addr)
+}
+
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var body struct {
+			Level string `json:"level"`
+		}
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		level, err := logrus.ParseLevel(body.Level)
+		if err != nil {
+			helper.HTTPError(w, r, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		logrus.SetLevel(level)
+		log.WithField("level", level.String()).Info("admin: changed log level")
+	default:
+		methodNotAllowed(w, r, "GET, PUT")
+		return
+	}
+
+	writeJSON(w, map[string]string{"level": logrus.GetLevel().String()})
+}
+
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT":
+		var body struct {
+			Enabled bool `json:"enabled"`
+		}
+		if !decodeBody(w, r, &body) {
+			return
+		}
+
+		upstream.SetMaintenance(body.Enabled)
+		log.WithField("enabled", body.Enabled).Info("admin: changed maintenance mode")
+	default:
+		methodNotAllowed(w, r, "GET, PUT")
+		return
+	}
+
+	writeJSON(w, map[string]bool{"enabled": upstream.InMaintenance()})
+}
+
+func handleFlushCaches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, r, "POST")
+		return
+	}
+
+	flushed := map[string]int{
+		"assets":         staticpages.FlushAssetCaches(),
+		"ci_job_request": builds.FlushJobRequestCache(),
+	}
+	log.WithField("flushed", flushed).Info("admin: flushed caches")
+
+	writeJSON(w, map[string]interface{}{"flushed": flushed})
+}
+
+type inFlightRequest struct {
+	upstream.InFlightRequest
+	DurationSeconds float64 `json:"duration_s"`
+}
+
+func handleRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, r, "GET")
+		return
+	}
+
+	minDuration := defaultMinDuration
+	if value := r.URL.Query().Get("min_duration"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			helper.HTTPError(w, r, fmt.Sprintf("Bad Request: min_duration: %v", err), http.StatusBadRequest)
+			return
+		}
+		minDuration = d
+	}
+
+	requests := []inFlightRequest{}
+	for _, req := range upstream.LongRequests(minDuration) {
+		requests = append(requests, inFlightRequest{InFlightRequest: req, DurationSeconds: req.Duration.Seconds()})
+	}
+
+	writeJSON(w, map[string]interface{}{"requests": requests})
+}
+
+func decodeBody(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		helper.HTTPError(w, r, fmt.Sprintf("Bad Request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	helper.HTTPError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,130 @@
+package admin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
+)
+
+const testToken = "admin-token"
+
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	tokenFile, err := ioutil.TempFile("", "admin-token")
+	require.NoError(t, err)
+	_, err = tokenFile.WriteString(testToken + "\n")
+	require.NoError(t, err)
+	require.NoError(t, tokenFile.Close())
+
+	h, err := NewHandler(config.AdminConfig{Addr: "127.0.0.1:0", TokenFile: tokenFile.Name()})
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(h)
+	return ts, func() {
+		ts.Close()
+		os.Remove(tokenFile.Name())
+	}
+}
+
+func do(t *testing.T, ts *httptest.Server, method, path, body, token string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestRequiresToken(t *testing.T) {
+	ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	code, _ := do(t, ts, "GET", "/log_level", "", "")
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = do(t, ts, "GET", "/log_level", "", "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestLogLevel(t *testing.T) {
+	ts, cleanup := newTestServer(t)
+	defer cleanup()
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	code, body := do(t, ts, "PUT", "/log_level", `{"level":"debug"}`, testToken)
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"level":"debug"}`, body)
+	require.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+
+	code, _ = do(t, ts, "PUT", "/log_level", `{"level":"loud"}`, testToken)
+	require.Equal(t, http.StatusBadRequest, code)
+	require.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+}
+
+func TestMaintenance(t *testing.T) {
+	ts, cleanup := newTestServer(t)
+	defer cleanup()
+	defer upstream.SetMaintenance(false)
+
+	code, body := do(t, ts, "PUT", "/maintenance", `{"enabled":true}`, testToken)
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"enabled":true}`, body)
+	require.True(t, upstream.InMaintenance())
+
+	code, body = do(t, ts, "GET", "/maintenance", "", testToken)
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"enabled":true}`, body)
+
+	code, _ = do(t, ts, "DELETE", "/maintenance", "", testToken)
+	require.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestFlushCaches(t *testing.T) {
+	ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	code, body := do(t, ts, "POST", "/caches/flush", "", testToken)
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"flushed":{"assets":0,"ci_job_request":0}}`, body)
+}
+
+func TestRequests(t *testing.T) {
+	ts, cleanup := newTestServer(t)
+	defer cleanup()
+
+	code, body := do(t, ts, "GET", "/requests?min_duration=1m", "", testToken)
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"requests":[]}`, body)
+
+	code, _ = do(t, ts, "GET", "/requests?min_duration=soon", "", testToken)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestNewHandlerInvalid(t *testing.T) {
+	_, err := NewHandler(config.AdminConfig{Addr: "0.0.0.0:9230", TokenFile: "/dev/null"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "loopback")
+
+	_, err = NewHandler(config.AdminConfig{Socket: "/tmp/admin.sock"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TokenFile is required")
+
+	_, err = NewHandler(config.AdminConfig{Socket: "/tmp/admin.sock", TokenFile: "/dev/null"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is empty")
+}
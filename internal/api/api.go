@@ -10,6 +10,8 @@ import (
 	"strconv"
 	"strings"
 
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
@@ -30,6 +32,8 @@ type API struct {
 	Client  *http.Client
 	URL     *url.URL
 	Version string
+	// Retry is nil unless pre-authorization requests are retried
+	Retry *RetryPolicy
 }
 
 var (
@@ -81,6 +85,10 @@ type RemoteObject struct {
 	DeleteURL string
 	// StoreURL is the temporary presigned S3 PutObject URL to which upload the first found file
 	StoreURL string
+	// HeadURL is an optional presigned S3 HeadObject URL of the object
+	// StoreURL uploads to. With it, the upload fails rather than
+	// overwriting an existing object.
+	HeadURL string
 	// Boolean to indicate whether to use headers included in PutHeaders
 	CustomPutHeaders bool
 	// PutHeaders are HTTP headers (e.g. Content-Type) to be sent with StoreURL
@@ -119,6 +127,15 @@ type Response struct {
 	// RemoteObject is provided by the GitLab Rails application
 	// and defines a way to store object on remote storage
 	RemoteObject RemoteObject
+	// MaximumSize is the size in bytes above which Rails rejects the
+	// uploaded file. Zero means no limit.
+	MaximumSize int64
+	// MetadataRemoteObject, if set, is where the metadata generated for
+	// an artifacts archive is direct-uploaded to
+	MetadataRemoteObject *RemoteObject
+	// FilenamePolicy restricts the names of the uploaded files of the
+	// route. The defaults apply if it is not set.
+	FilenamePolicy *FilenamePolicy
 	// Archive is the path where the artifacts archive is stored
 	Archive string `json:"archive"`
 	// Entry is a filename inside the archive point to file that needs to be extracted
@@ -131,6 +148,31 @@ type Response struct {
 	Repository gitalypb.Repository
 	// For git-http, does the requestor have the right to view all refs?
 	ShowAllRefs bool
+	// GeoProxy is set on a Geo secondary for git push. The request is then
+	// streamed to the primary instead of being handled locally.
+	GeoProxy *GeoProxySettings
+}
+
+// FilenamePolicy is how the names of uploaded files are checked before
+// they are stored
+type FilenamePolicy struct {
+	// MaxLength is the length in bytes of the longest name. Defaults to
+	// 255.
+	MaxLength int
+	// Pattern, if set, is a regular expression the names must match
+	Pattern string
+	// Normalization is the Unicode normalization form the names are put
+	// in: "NFC", "NFKC" or "none". Defaults to "NFC".
+	Normalization string
+}
+
+type GeoProxySettings struct {
+	// Url of the repository on the primary, e.g.
+	// https://primary.example.com/group/project.git
+	Url string
+	// Header holds the headers to send to the primary, e.g. an
+	// Authorization header with a JWT signed for the primary
+	Header http.Header
 }
 
 // singleJoiningSlash is taken from reverseproxy.go:NewSingleHostReverseProxy
@@ -204,12 +246,29 @@ func (api *API) newRequest(r *http.Request, suffix string) (*http.Request, error
 //
 // authResponse will only be present if the authorization check was successful
 func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http.Response, authResponse *Response, outErr error) {
+	span, ctx := opentracing.StartSpanFromContext(r.Context(), "preauthorize")
+	defer func() {
+		data := map[string]interface{}{"suffix": suffix}
+		if httpResponse != nil {
+			ext.HTTPStatusCode.Set(span, uint16(httpResponse.StatusCode))
+			data["status_code"] = httpResponse.StatusCode
+		}
+		if outErr != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("error", outErr.Error())
+			data["error"] = outErr.Error()
+		}
+		span.Finish()
+		helper.AddBreadcrumb(r.Context(), "preauthorize", r.URL.Path, outErr != nil, data)
+	}()
+
 	authReq, err := api.newRequest(r, suffix)
 	if err != nil {
 		return nil, nil, fmt.Errorf("preAuthorizeHandler newUpstreamRequest: %v", err)
 	}
+	authReq = authReq.WithContext(ctx)
 
-	httpResponse, err = api.doRequestWithoutRedirects(authReq)
+	httpResponse, err = api.Retry.do(authReq, api.doRequestWithoutRedirects)
 	if err != nil {
 		return nil, nil, fmt.Errorf("preAuthorizeHandler: do request: %v", err)
 	}
@@ -234,6 +293,7 @@ func (api *API) PreAuthorize(suffix string, r *http.Request) (httpResponse *http
 	if err := json.NewDecoder(httpResponse.Body).Decode(authResponse); err != nil {
 		return httpResponse, nil, fmt.Errorf("preAuthorizeHandler: decode authorization response: %v", err)
 	}
+	helper.SetGLID(r.Context(), authResponse.GL_ID)
 
 	return httpResponse, authResponse, nil
 }
@@ -304,7 +364,7 @@ func passResponseBack(httpResponse *http.Response, w http.ResponseWriter, r *htt
 		}
 	}
 	w.WriteHeader(httpResponse.StatusCode)
-	if _, err := io.Copy(w, responseBody); err != nil {
+	if _, err := helper.Copy(w, responseBody); err != nil {
 		helper.LogError(r, err)
 	}
 }
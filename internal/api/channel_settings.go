@@ -30,6 +30,11 @@ type ChannelSettings struct {
 	// The value is specified in seconds. It is converted to time.Duration
 	// later.
 	MaxSessionTime int
+
+	// If set, the session is recorded. This is a JWT signed with the
+	// Workhorse secret that tells where to upload the recording. It is not
+	// compared by IsEqual because Rails signs a new one on every request.
+	RecordingToken string
 }
 
 func (t *ChannelSettings) URL() (*url.URL, error) {
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	defaultRetryBackoff = 100 * time.Millisecond
+	defaultRetryBudget  = 5 * time.Second
+)
+
+var preAuthorizeAttempts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_internal_api_preauthorize_extra_attempts",
+		Help: "How many pre-authorization requests were retried after a failure (retry) or sent again because the previous attempt was slow (hedge)",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(preAuthorizeAttempts)
+}
+
+// RetryPolicy retries pre-authorization requests that failed because Rails
+// is unavailable. Pre-authorization requests have no body and no side
+// effects, so they can be sent more than once.
+type RetryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	budget      time.Duration
+	hedgeDelay  time.Duration
+}
+
+// NewRetryPolicy returns nil if cfg allows no more than one attempt
+func NewRetryPolicy(cfg config.PreAuthorizeRetryConfig) *RetryPolicy {
+	if cfg.MaxAttempts < 2 {
+		return nil
+	}
+
+	p := &RetryPolicy{
+		maxAttempts: cfg.MaxAttempts,
+		backoff:     defaultRetryBackoff,
+		budget:      defaultRetryBudget,
+	}
+	if cfg.Backoff != nil {
+		p.backoff = cfg.Backoff.Duration
+	}
+	if cfg.Budget != nil {
+		p.budget = cfg.Budget.Duration
+	}
+	if cfg.HedgeDelay != nil {
+		p.hedgeDelay = cfg.HedgeDelay.Duration
+	}
+
+	return p
+}
+
+// Errors of the backend round tripper come back as 502 responses
+func retryable(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+type attempt struct {
+	resp   *http.Response
+	err    error
+	cancel context.CancelFunc
+}
+
+func (a *attempt) discard() {
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+	a.cancel()
+}
+
+// do sends req until it gets a response that can't be retried, or the
+// attempts or the time budget are used up. It returns the last response.
+func (p *RetryPolicy) do(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if p == nil {
+		return send(req)
+	}
+
+	deadline := time.Now().Add(p.budget)
+	delay := backoff.Backoff{Min: p.backoff, Max: p.budget, Factor: 2, Jitter: true}
+	results := make(chan *attempt, p.maxAttempts)
+	pending := make(map[*attempt]bool)
+	started := 0
+
+	var hedge, retry <-chan time.Time
+	start := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		a := &attempt{cancel: cancel}
+		pending[a] = true
+		started++
+
+		// Every attempt gets its own headers, they are modified by send
+		attemptReq := req.Clone(ctx)
+		go func() {
+			a.resp, a.err = send(attemptReq)
+			results <- a
+		}()
+
+		hedge = nil
+		if p.hedgeDelay > 0 && started < p.maxAttempts && time.Now().Add(p.hedgeDelay).Before(deadline) {
+			hedge = time.After(p.hedgeDelay)
+		}
+	}
+
+	start()
+
+	var last *attempt
+	for {
+		select {
+		case <-hedge:
+			preAuthorizeAttempts.WithLabelValues("hedge").Inc()
+			start()
+
+		case <-retry:
+			retry = nil
+			preAuthorizeAttempts.WithLabelValues("retry").Inc()
+			start()
+
+		case a := <-results:
+			delete(pending, a)
+			if last != nil {
+				last.discard()
+				last = nil
+			}
+
+			if !retryable(a.resp, a.err) {
+				abandon(pending, results)
+				return a.withCancel()
+			}
+
+			if len(pending) > 0 {
+				last = a
+				continue
+			}
+
+			// Nothing in flight: back off instead of hedging
+			hedge = nil
+			wait := delay.Duration()
+			if started >= p.maxAttempts || time.Now().Add(wait).After(deadline) {
+				return a.withCancel()
+			}
+			last = a
+			retry = time.After(wait)
+		}
+	}
+}
+
+// abandon cancels the attempts still in flight and discards their results
+func abandon(pending map[*attempt]bool, results chan *attempt) {
+	for a := range pending {
+		a.cancel()
+	}
+
+	go func(n int) {
+		for ; n > 0; n-- {
+			(<-results).discard()
+		}
+	}(len(pending))
+}
+
+// withCancel returns the result of the attempt, its context is canceled
+// once the response body is closed
+func (a *attempt) withCancel() (*http.Response, error) {
+	if a.err != nil {
+		a.cancel()
+		return nil, a.err
+	}
+
+	a.resp.Body = &cancelOnClose{ReadCloser: a.resp.Body, cancel: a.cancel}
+	return a.resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
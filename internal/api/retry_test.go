@@ -0,0 +1,115 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func newTestRetryPolicy(maxAttempts int, hedgeDelay time.Duration) *RetryPolicy {
+	return NewRetryPolicy(config.PreAuthorizeRetryConfig{
+		MaxAttempts: maxAttempts,
+		Backoff:     &config.TomlDuration{Duration: time.Millisecond},
+		Budget:      &config.TomlDuration{Duration: 5 * time.Second},
+		HedgeDelay:  &config.TomlDuration{Duration: hedgeDelay},
+	})
+}
+
+func doRetryRequest(t *testing.T, p *RetryPolicy, handler http.HandlerFunc) *http.Response {
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := p.do(req, http.DefaultTransport.RoundTrip)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	var requests int32
+	resp := doRetryRequest(t, newTestRetryPolicy(5, 0), func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var requests int32
+	resp := doRetryRequest(t, newTestRetryPolicy(3, 0), func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestRetryOnlyRetriesUnavailable(t *testing.T) {
+	var requests int32
+	resp := doRetryRequest(t, newTestRetryPolicy(3, 0), func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestRetryHedge(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	defer close(release)
+
+	resp := doRetryRequest(t, newTestRetryPolicy(2, 10*time.Millisecond), func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The first attempt is stuck until the hedge has won
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		w.Write([]byte("hedge"))
+	})
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hedge", string(body))
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestNoRetryPolicy(t *testing.T) {
+	require.Nil(t, NewRetryPolicy(config.PreAuthorizeRetryConfig{MaxAttempts: 1}))
+
+	var requests int32
+	resp := doRetryRequest(t, nil, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
@@ -167,7 +167,7 @@ func TestUploadHandlerSendingToExternalStorageAndStorageServerUnreachable(t *tes
 	defer ts.Close()
 
 	response := testUploadArtifactsFromTestZip(t, ts)
-	testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
+	testhelper.AssertResponseCode(t, response, http.StatusBadGateway)
 }
 
 func TestUploadHandlerSendingToExternalStorageAndInvalidURLIsUsed(t *testing.T) {
@@ -231,7 +231,7 @@ func TestUploadHandlerSendingToExternalStorageAndItReturnsAnError(t *testing.T)
 	defer ts.Close()
 
 	response := testUploadArtifactsFromTestZip(t, ts)
-	testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
+	testhelper.AssertResponseCode(t, response, http.StatusBadGateway)
 	assert.Equal(t, 1, putCalledTimes, "upload should be called only once")
 }
 
@@ -272,7 +272,7 @@ func TestUploadHandlerSendingToExternalStorageAndSupportRequestTimeout(t *testin
 	defer ts.Close()
 
 	response := testUploadArtifactsFromTestZip(t, ts)
-	testhelper.AssertResponseCode(t, response, http.StatusInternalServerError)
+	testhelper.AssertResponseCode(t, response, http.StatusGatewayTimeout)
 	assert.Equal(t, 1, putCalledTimes, "upload should be called only once")
 }
 
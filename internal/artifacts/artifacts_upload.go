@@ -18,7 +18,7 @@ import (
 )
 
 type artifactsUploadProcessor struct {
-	opts *filestore.SaveFileOpts
+	preauth *api.Response
 
 	upload.SavedFileTracker
 }
@@ -27,13 +27,7 @@ func (a *artifactsUploadProcessor) generateMetadataFromZip(ctx context.Context,
 	metaReader, metaWriter := io.Pipe()
 	defer metaWriter.Close()
 
-	metaOpts := &filestore.SaveFileOpts{
-		LocalTempPath:  a.opts.LocalTempPath,
-		TempFilePrefix: "metadata.gz",
-	}
-	if metaOpts.LocalTempPath == "" {
-		metaOpts.LocalTempPath = os.TempDir()
-	}
+	metaOpts := a.metadataOpts()
 
 	fileName := file.LocalPath
 	if fileName == "" {
@@ -74,6 +68,27 @@ func (a *artifactsUploadProcessor) generateMetadataFromZip(ctx context.Context,
 	return result.FileHandler, result.error
 }
 
+// metadataOpts streams the metadata to object storage if Rails asked for
+// it, and to the temporary path otherwise
+func (a *artifactsUploadProcessor) metadataOpts() *filestore.SaveFileOpts {
+	if a.preauth.MetadataRemoteObject != nil {
+		opts := filestore.GetOpts(&api.Response{RemoteObject: *a.preauth.MetadataRemoteObject})
+		opts.TempFilePrefix = "metadata.gz"
+		// The metadata comes from gitlab-zip-metadata, not the client
+		opts.ClientTimeout = 0
+		return opts
+	}
+
+	opts := &filestore.SaveFileOpts{
+		LocalTempPath:  a.preauth.TempPath,
+		TempFilePrefix: "metadata.gz",
+	}
+	if opts.LocalTempPath == "" {
+		opts.LocalTempPath = os.TempDir()
+	}
+	return opts
+}
+
 func (a *artifactsUploadProcessor) ProcessFile(ctx context.Context, formName string, file *filestore.FileHandler, writer *multipart.Writer) error {
 	//  ProcessFile for artifacts requires file form-data field name to eq `file`
 
@@ -83,14 +98,15 @@ func (a *artifactsUploadProcessor) ProcessFile(ctx context.Context, formName str
 	if a.Count() > 0 {
 		return fmt.Errorf("artifacts request contains more than one file")
 	}
-	a.Track(formName, file.LocalPath)
+	a.TrackFile(formName, file)
 
 	select {
 	case <-ctx.Done():
 		return fmt.Errorf("ProcessFile: context done")
 
 	default:
-		// TODO: can we rely on disk for shipping metadata? Not if we split workhorse and rails in 2 different PODs
+		// The metadata only goes to disk if Rails didn't give it a remote
+		// object, which it must when Workhorse and Rails don't share one
 		metadata, err := a.generateMetadataFromZip(ctx, file)
 		if err != nil {
 			return fmt.Errorf("generateMetadataFromZip: %v", err)
@@ -101,7 +117,7 @@ func (a *artifactsUploadProcessor) ProcessFile(ctx context.Context, formName str
 				writer.WriteField(k, v)
 			}
 
-			a.Track("metadata", metadata.LocalPath)
+			a.TrackFile("metadata", metadata)
 		}
 	}
 	return nil
@@ -113,7 +129,7 @@ func (a *artifactsUploadProcessor) Name() string {
 
 func UploadArtifacts(myAPI *api.API, h http.Handler) http.Handler {
 	return myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
-		mg := &artifactsUploadProcessor{opts: filestore.GetOpts(a), SavedFileTracker: upload.SavedFileTracker{Request: r}}
+		mg := &artifactsUploadProcessor{preauth: a, SavedFileTracker: upload.SavedFileTracker{Request: r}}
 
 		upload.HandleFileUploads(w, r, h, a, mg)
 	}, "/authorize")
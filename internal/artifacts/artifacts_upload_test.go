@@ -1,6 +1,7 @@
 package artifacts
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"testing"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -19,6 +21,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/proxy"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
@@ -169,6 +172,95 @@ func TestUploadHandlerAddingMetadata(t *testing.T) {
 	testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, MetadataHeaderPresent)
 }
 
+func TestUploadHandlerAddingMetadataForZstdArchive(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	ts := testArtifactsUploadServer(t, api.Response{TempPath: tempPath}, nil)
+	defer ts.Close()
+
+	var archive bytes.Buffer
+	tarWriter := tar.NewWriter(&archive)
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: "test.file", Typeflag: tar.TypeReg, Mode: 0644, Size: 4}))
+	fmt.Fprint(tarWriter, "test")
+	require.NoError(t, tarWriter.Close())
+
+	zstd := exec.Command("zstd", "--stdout", "--quiet")
+	zstd.Stdin = &archive
+	compressed, err := zstd.Output()
+	require.NoError(t, err)
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "artifacts.tar.zst")
+	require.NoError(t, err)
+	file.Write(compressed)
+	writer.Close()
+
+	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+	testhelper.AssertResponseHeader(t, response, MetadataHeaderKey, MetadataHeaderPresent)
+}
+
+func TestUploadHandlerUploadingMetadataToObjectStorage(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	osStub, storeServer := test.StartObjectStore()
+	defer storeServer.Close()
+
+	authResponse := api.Response{
+		TempPath: tempPath,
+		MetadataRemoteObject: &api.RemoteObject{
+			ID:       "metadata-id",
+			StoreURL: storeServer.URL + test.ObjectPath,
+		},
+	}
+	ts := testArtifactsUploadServer(t, authResponse,
+		func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "metadata-id", r.FormValue("metadata.remote_id"))
+
+			jwtToken, err := jwt.Parse(r.Header.Get(upload.RewrittenFieldsHeader), testhelper.ParseJWT)
+			require.NoError(t, err)
+
+			finalizeFields := jwtToken.Claims.(jwt.MapClaims)["finalize_fields"].(map[string]interface{})
+			require.Equal(t, r.FormValue("file.path"), finalizeFields["file.path"])
+			require.Equal(t, "metadata-id", finalizeFields["metadata.remote_id"])
+			require.Equal(t, r.FormValue("metadata.md5"), finalizeFields["metadata.md5"])
+		},
+	)
+	defer ts.Close()
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	file, err := writer.CreateFormFile("file", "my.file")
+	require.NoError(t, err)
+	archive := zip.NewWriter(file)
+	fileInArchive, err := archive.Create("test.file")
+	require.NoError(t, err)
+	fmt.Fprint(fileInArchive, "test")
+	archive.Close()
+	writer.Close()
+
+	response := testUploadArtifacts(writer.FormDataContentType(), &buffer, t, ts)
+	testhelper.AssertResponseCode(t, response, http.StatusOK)
+
+	require.Equal(t, 1, osStub.PutsCnt(), "the metadata must be uploaded")
+	require.NotEmpty(t, osStub.GetObjectMD5(test.ObjectPath))
+
+	files, err := ioutil.ReadDir(tempPath)
+	require.NoError(t, err)
+	for _, f := range files {
+		require.NotContains(t, f.Name(), "metadata", "the metadata must not be buffered on disk")
+	}
+}
+
 func TestUploadHandlerForUnsupportedArchive(t *testing.T) {
 	tempPath, err := ioutil.TempDir("", "uploads")
 	if err != nil {
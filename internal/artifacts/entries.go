@@ -0,0 +1,125 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+const (
+	defaultEntriesPerPage = 20
+	maxEntriesPerPage     = 100
+)
+
+type entries struct{ senddata.Prefix }
+type entriesParams struct{ Archive string }
+
+// archiveEntry is the JSON representation of a single file or directory
+// found in the central directory of an artifacts archive.
+type archiveEntry struct {
+	Name           string `json:"name"`
+	Size           uint64 `json:"size"`
+	CompressedSize uint64 `json:"compressed_size"`
+}
+
+// SendEntries returns a paginated JSON listing of the entries of an
+// artifacts archive. Only the zip central directory is read, so this is
+// cheap even for remote archives.
+var SendEntries = &entries{"artifacts-entries:"}
+
+func (e *entries) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params entriesParams
+	if err := e.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendEntries: unpack sendData: %v", err))
+		return
+	}
+
+	log.WithContextFields(r.Context(), log.Fields{
+		"archive": params.Archive,
+		"path":    r.URL.Path,
+	}).Print("SendEntries: sending")
+
+	if params.Archive == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendEntries: Archive is empty"))
+		return
+	}
+
+	page, perPage := paginationParams(r)
+
+	archive, err := zipartifacts.OpenArchive(r.Context(), params.Archive)
+	if err == zipartifacts.ErrArchiveNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendEntries: OpenArchive: %v", err))
+		return
+	}
+
+	total := len(archive.File)
+	totalPages := (total + perPage - 1) / perPage
+
+	// Pages past the end are empty. Compare before multiplying: a huge
+	// page would overflow the index of its first entry.
+	list := []archiveEntry{}
+	start, end := 0, 0
+	if page <= totalPages {
+		start = (page - 1) * perPage
+		end = start + perPage
+		if end > total {
+			end = total
+		}
+	}
+	for i := start; i < end; i++ {
+		file := archive.File[i]
+		list = append(list, archiveEntry{
+			Name:           file.Name,
+			Size:           file.UncompressedSize64,
+			CompressedSize: file.CompressedSize64,
+		})
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Page", strconv.Itoa(page))
+	h.Set("X-Per-Page", strconv.Itoa(perPage))
+	h.Set("X-Total", strconv.Itoa(total))
+	h.Set("X-Total-Pages", strconv.Itoa(totalPages))
+	if page > 1 {
+		h.Set("X-Prev-Page", strconv.Itoa(page-1))
+	}
+	if page < totalPages {
+		h.Set("X-Next-Page", strconv.Itoa(page+1))
+	}
+
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		helper.LogError(r, fmt.Errorf("SendEntries: write response: %v", err))
+	}
+}
+
+// paginationParams follows the conventions of the GitLab API: pages start
+// at 1 and invalid values fall back to the defaults.
+func paginationParams(r *http.Request) (page int, perPage int) {
+	query := r.URL.Query()
+
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err = strconv.Atoi(query.Get("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = defaultEntriesPerPage
+	}
+	if perPage > maxEntriesPerPage {
+		perPage = maxEntriesPerPage
+	}
+
+	return page, perPage
+}
@@ -0,0 +1,115 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func testEntriesServer(t *testing.T, archive string, query string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/url/path", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "GET", r.Method)
+
+		jsonParams := fmt.Sprintf(`{"Archive":"%s"}`, archive)
+		data := base64.URLEncoding.EncodeToString([]byte(jsonParams))
+
+		SendEntries.Inject(w, r, data)
+	})
+
+	httpRequest, err := http.NewRequest("GET", "/url/path?"+query, nil)
+	require.NoError(t, err)
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, httpRequest)
+	return response
+}
+
+func createTestArchive(t *testing.T, names ...string) string {
+	tempFile, err := ioutil.TempFile("", "uploads")
+	require.NoError(t, err)
+	defer tempFile.Close()
+
+	archive := zip.NewWriter(tempFile)
+	for _, name := range names {
+		fileInArchive, err := archive.Create(name)
+		require.NoError(t, err)
+		fmt.Fprint(fileInArchive, name)
+	}
+	require.NoError(t, archive.Close())
+
+	return tempFile.Name()
+}
+
+func TestListingEntries(t *testing.T) {
+	archive := createTestArchive(t, "a.txt", "dir/", "dir/b.txt")
+	defer os.Remove(archive)
+
+	response := testEntriesServer(t, archive, "")
+	testhelper.AssertResponseCode(t, response, 200)
+	testhelper.AssertResponseWriterHeader(t, response, "Content-Type", "application/json")
+	testhelper.AssertResponseWriterHeader(t, response, "X-Total", "3")
+	testhelper.AssertResponseWriterHeader(t, response, "X-Total-Pages", "1")
+	testhelper.AssertAbsentResponseWriterHeader(t, response, "X-Next-Page")
+
+	var list []archiveEntry
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &list))
+	require.Len(t, list, 3)
+	require.Equal(t, "a.txt", list[0].Name)
+	require.Equal(t, uint64(len("a.txt")), list[0].Size)
+	require.Equal(t, "dir/", list[1].Name)
+	require.Equal(t, "dir/b.txt", list[2].Name)
+}
+
+func TestListingEntriesPagination(t *testing.T) {
+	archive := createTestArchive(t, "1", "2", "3", "4", "5")
+	defer os.Remove(archive)
+
+	response := testEntriesServer(t, archive, "page=2&per_page=2")
+	testhelper.AssertResponseCode(t, response, 200)
+	testhelper.AssertResponseWriterHeader(t, response, "X-Page", "2")
+	testhelper.AssertResponseWriterHeader(t, response, "X-Per-Page", "2")
+	testhelper.AssertResponseWriterHeader(t, response, "X-Total-Pages", "3")
+	testhelper.AssertResponseWriterHeader(t, response, "X-Prev-Page", "1")
+	testhelper.AssertResponseWriterHeader(t, response, "X-Next-Page", "3")
+
+	var list []archiveEntry
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &list))
+	require.Len(t, list, 2)
+	require.Equal(t, "3", list[0].Name)
+	require.Equal(t, "4", list[1].Name)
+
+	response = testEntriesServer(t, archive, "page=10")
+	testhelper.AssertResponseCode(t, response, 200)
+	testhelper.AssertResponseBody(t, response, "[]\n")
+}
+
+func TestListingEntriesHugePage(t *testing.T) {
+	archive := createTestArchive(t, "1", "2", "3")
+	defer os.Remove(archive)
+
+	response := testEntriesServer(t, archive, "page=4611686018427387905&per_page=2")
+	testhelper.AssertResponseCode(t, response, 200)
+	testhelper.AssertResponseWriterHeader(t, response, "X-Page", "4611686018427387905")
+	testhelper.AssertAbsentResponseWriterHeader(t, response, "X-Next-Page")
+	testhelper.AssertResponseBody(t, response, "[]\n")
+}
+
+func TestListingEntriesFromNonExistingArchive(t *testing.T) {
+	response := testEntriesServer(t, "path/to/non/existing/file", "")
+	testhelper.AssertResponseCode(t, response, 404)
+}
+
+func TestListingEntriesIncompleteApiResponse(t *testing.T) {
+	response := testEntriesServer(t, "", "")
+	testhelper.AssertResponseCode(t, response, 500)
+}
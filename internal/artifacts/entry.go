@@ -99,7 +99,7 @@ func unpackFileFromZip(archivePath, encodedFilename string, headers http.Header,
 	headers.Set("Content-Type", detectFileContentType(fileName))
 	headers.Set("Content-Disposition", "attachment; filename=\""+escapeQuotes(basename)+"\"")
 	// Copy file body to client
-	if _, err := io.Copy(output, reader); err != nil {
+	if _, err := helper.Copy(output, reader); err != nil {
 		return fmt.Errorf("copy stdout of %v: %v", catFile.Args, err)
 	}
 
@@ -0,0 +1,191 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+const (
+	// siteRoot is the directory of the archive the site is served from,
+	// like with GitLab Pages
+	siteRoot = "public/"
+	// siteCookie holds the token Rails signed for a site, so that its other
+	// files are served without asking Rails again
+	siteCookie = "_gitlab_artifacts_site"
+	// The site can't act as GitLab: it runs in an opaque origin
+	siteContentSecurityPolicy = "sandbox allow-scripts allow-forms allow-popups allow-modals"
+)
+
+type site struct{ senddata.Prefix }
+
+type siteParams struct {
+	// Archive is the path or URL of the artifacts archive
+	Archive string
+	// Prefix is the path the site is served under, e.g.
+	// /group/project/-/jobs/1/artifacts/preview/
+	Prefix string
+	// Token, if set, is a JWT of siteClaims signed by Rails with the
+	// Workhorse secret
+	Token string
+}
+
+type siteClaims struct {
+	Archive string `json:"archive"`
+	Prefix  string `json:"prefix"`
+	jwt.StandardClaims
+}
+
+// SendSite serves the public/ directory of an artifacts archive as a
+// static website, streaming the files out of the archive on demand
+var SendSite = &site{"artifacts-site:"}
+
+func (s *site) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params siteParams
+	if err := s.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: unpack sendData: %v", err))
+		return
+	}
+
+	if params.Archive == "" || params.Prefix == "" {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: Archive or Prefix is empty"))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, params.Prefix) {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: %q is not under %q", r.URL.Path, params.Prefix))
+		return
+	}
+
+	if params.Token != "" {
+		claims, err := parseSiteToken(params.Token)
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("SendSite: %v", err))
+			return
+		}
+		if claims.Archive != params.Archive || claims.Prefix != params.Prefix {
+			helper.Fail500(w, r, fmt.Errorf("SendSite: the token is for another site"))
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     siteCookie,
+			Value:    params.Token,
+			Path:     params.Prefix,
+			Expires:  time.Unix(claims.ExpiresAt, 0),
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	serveSiteFile(w, r, params.Archive, params.Prefix)
+}
+
+// SiteHandler serves the files of an artifacts site to the clients that
+// have a valid token for it. Other requests go to next, which is Rails.
+func SiteHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(siteCookie)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := parseSiteToken(cookie.Value)
+		if err != nil || !strings.HasPrefix(r.URL.Path, claims.Prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		serveSiteFile(w, r, claims.Archive, claims.Prefix)
+	})
+}
+
+func parseSiteToken(token string) (*siteClaims, error) {
+	claims := &siteClaims{}
+	if err := secret.ParseJWT(token, claims); err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("the token doesn't expire")
+	}
+	if claims.Archive == "" || claims.Prefix == "" {
+		return nil, fmt.Errorf("the token has no archive or prefix")
+	}
+
+	return claims, nil
+}
+
+func serveSiteFile(w http.ResponseWriter, r *http.Request, archivePath string, prefix string) {
+	name := strings.TrimPrefix(r.URL.Path, prefix)
+	if name == "" || strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	// Entries are looked up by name, so this only keeps the lookup tidy
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	log.WithContextFields(r.Context(), log.Fields{
+		"archive": archivePath,
+		"entry":   name,
+		"path":    r.URL.Path,
+	}).Print("SendSite: sending")
+
+	archive, err := zipartifacts.OpenArchive(r.Context(), archivePath)
+	if err == zipartifacts.ErrArchiveNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: %v", err))
+		return
+	}
+
+	file := findSiteFile(archive, siteRoot+name)
+	if file == nil {
+		// Like a web server, send directories to their index
+		if findSiteFile(archive, siteRoot+name+"/index.html") != nil {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendSite: open %q: %v", file.Name, err))
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", detectFileContentType(name))
+	w.Header().Set("Content-Length", strconv.FormatUint(file.UncompressedSize64, 10))
+	w.Header().Set("Content-Security-Policy", siteContentSecurityPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := helper.Copy(w, content); err != nil {
+		helper.LogError(r, fmt.Errorf("SendSite: copy %q: %v", file.Name, err))
+	}
+}
+
+func findSiteFile(archive *zip.Reader, name string) *zip.File {
+	for _, file := range archive.File {
+		if file.Name == name && !file.FileInfo().IsDir() {
+			return file
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package artifacts
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const sitePrefix = "/group/project/-/jobs/1/artifacts/preview/"
+
+func siteToken(t *testing.T, archive string, prefix string, expiresAt time.Time) string {
+	token, err := secret.JWTTokenString(&siteClaims{
+		Archive:        archive,
+		Prefix:         prefix,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt.Unix()},
+	})
+	require.NoError(t, err)
+	return token
+}
+
+func injectSite(t *testing.T, params siteParams, path string) *httptest.ResponseRecorder {
+	data, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	SendSite.Inject(w, httptest.NewRequest("GET", path, nil), base64.URLEncoding.EncodeToString(data))
+	return w
+}
+
+func TestSendSite(t *testing.T) {
+	archive := createTestArchive(t, "public/index.html", "public/css/site.css", "public/docs/index.html", "README.md")
+	defer os.Remove(archive)
+
+	tests := []struct {
+		path        string
+		code        int
+		body        string
+		contentType string
+		location    string
+	}{
+		{path: sitePrefix, code: 200, body: "public/index.html", contentType: "text/html; charset=utf-8"},
+		{path: sitePrefix + "css/site.css", code: 200, body: "public/css/site.css", contentType: "text/css; charset=utf-8"},
+		{path: sitePrefix + "docs/", code: 200, body: "public/docs/index.html"},
+		{path: sitePrefix + "docs", code: 302, location: sitePrefix + "docs/"},
+		{path: sitePrefix + "missing.html", code: 404},
+		{path: sitePrefix + "../README.md", code: 404},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			w := injectSite(t, siteParams{Archive: archive, Prefix: sitePrefix}, tc.path)
+
+			testhelper.AssertResponseCode(t, w, tc.code)
+			if tc.code != 200 {
+				if tc.location != "" {
+					require.Equal(t, tc.location, w.Header().Get("Location"))
+				}
+				return
+			}
+
+			require.Equal(t, tc.body, w.Body.String())
+			require.Contains(t, w.Header().Get("Content-Security-Policy"), "sandbox")
+			if tc.contentType != "" {
+				require.Equal(t, tc.contentType, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestSendSiteInvalidParams(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	archive := createTestArchive(t, "public/index.html")
+	defer os.Remove(archive)
+
+	tests := []struct {
+		name   string
+		params siteParams
+		path   string
+	}{
+		{name: "no archive", params: siteParams{Prefix: sitePrefix}, path: sitePrefix},
+		{name: "path outside of the prefix", params: siteParams{Archive: archive, Prefix: sitePrefix}, path: "/other/"},
+		{name: "invalid token", params: siteParams{Archive: archive, Prefix: sitePrefix, Token: "garbage"}, path: sitePrefix},
+		{
+			name:   "token of another site",
+			params: siteParams{Archive: archive, Prefix: sitePrefix, Token: siteToken(t, archive, "/other/", time.Now().Add(time.Hour))},
+			path:   sitePrefix,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := injectSite(t, tc.params, tc.path)
+			testhelper.AssertResponseCode(t, w, 500)
+		})
+	}
+}
+
+func TestSiteHandler(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	archive := createTestArchive(t, "public/index.html", "public/app.js")
+	defer os.Remove(archive)
+
+	// Rails hands out the token with the first file
+	token := siteToken(t, archive, sitePrefix, time.Now().Add(time.Hour))
+	w := injectSite(t, siteParams{Archive: archive, Prefix: sitePrefix, Token: token}, sitePrefix)
+	testhelper.AssertResponseCode(t, w, 200)
+
+	cookies := (&http.Response{Header: w.Header()}).Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, siteCookie, cookies[0].Name)
+	require.Equal(t, sitePrefix, cookies[0].Path)
+	require.True(t, cookies[0].HttpOnly)
+
+	tests := []struct {
+		name     string
+		path     string
+		cookie   *http.Cookie
+		toRails  bool
+		response string
+	}{
+		{name: "valid cookie", path: sitePrefix + "app.js", cookie: cookies[0], response: "public/app.js"},
+		{name: "no cookie", path: sitePrefix + "app.js", toRails: true},
+		{name: "cookie of another site", path: "/group/other/-/jobs/2/artifacts/preview/app.js", cookie: cookies[0], toRails: true},
+		{
+			name:    "expired cookie",
+			path:    sitePrefix + "app.js",
+			cookie:  &http.Cookie{Name: siteCookie, Value: siteToken(t, archive, sitePrefix, time.Now().Add(-time.Hour))},
+			toRails: true,
+		},
+		{name: "forged cookie", path: sitePrefix + "app.js", cookie: &http.Cookie{Name: siteCookie, Value: "garbage"}, toRails: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rails := false
+			handler := SiteHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rails = true
+			}))
+
+			r := httptest.NewRequest("GET", tc.path, nil)
+			if tc.cookie != nil {
+				r.AddCookie(tc.cookie)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			require.Equal(t, tc.toRails, rails)
+			if !tc.toRails {
+				testhelper.AssertResponseCode(t, w, 200)
+				require.Equal(t, tc.response, w.Body.String())
+			}
+		})
+	}
+}
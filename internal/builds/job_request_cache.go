@@ -0,0 +1,235 @@
+package builds
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// When a runner gets no job, Rails answers 204 with the current state of
+// the build queue of the runner in the X-GitLab-Last-Update header. A
+// runner that polls again with its old state, or without any state, would
+// be forwarded to Rails every time. The cache remembers the state Rails
+// returned so that such polls can wait for a notification instead.
+
+const (
+	lastUpdateHeaderKey            = "X-GitLab-Last-Update"
+	defaultJobRequestCacheEntries  = 100000
+	jobRequestCacheResultHit       = "hit"
+	jobRequestCacheResultMiss      = "miss"
+	jobRequestCacheResultStored    = "stored"
+	jobRequestCacheResultEvicted   = "evicted"
+	jobRequestCacheResultDiscarded = "discarded"
+)
+
+var (
+	jobRequestCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_builds_register_handler_cache",
+			Help: "How job requests used the cache of queue states returned by Rails",
+		},
+		[]string{"result"},
+	)
+
+	jobRequestCacheMutex sync.Mutex
+	jobRequestCacheCfg   *jobRequestCache
+)
+
+func init() {
+	prometheus.MustRegister(jobRequestCacheRequests)
+}
+
+type cachedJobResponse struct {
+	// lastUpdate is the state the runner sent
+	lastUpdate string
+	// currentUpdate is the state Rails returned
+	currentUpdate string
+	expires       time.Time
+}
+
+type jobRequestCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedJobResponse
+}
+
+// ConfigureJobRequestCache enables the cache of job request responses
+func ConfigureJobRequestCache(cfg config.CIJobRequestCacheConfig) error {
+	cache, err := newJobRequestCache(cfg)
+	if err != nil {
+		return err
+	}
+
+	jobRequestCacheMutex.Lock()
+	defer jobRequestCacheMutex.Unlock()
+	jobRequestCacheCfg = cache
+
+	return nil
+}
+
+func newJobRequestCache(cfg config.CIJobRequestCacheConfig) (*jobRequestCache, error) {
+	if cfg.TTL == nil {
+		return nil, nil
+	}
+	if cfg.TTL.Duration <= 0 {
+		return nil, errors.New("ci_job_request_cache: TTL must be positive")
+	}
+
+	c := &jobRequestCache{
+		ttl:        cfg.TTL.Duration,
+		maxEntries: cfg.MaxEntries,
+		entries:    make(map[[sha256.Size]byte]cachedJobResponse),
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultJobRequestCacheEntries
+	}
+
+	return c, nil
+}
+
+func currentJobRequestCache() *jobRequestCache {
+	jobRequestCacheMutex.Lock()
+	defer jobRequestCacheMutex.Unlock()
+	return jobRequestCacheCfg
+}
+
+// FlushJobRequestCache forgets the queue states of all runners, so that
+// their next job requests go to Rails. It returns the number of runners
+// forgotten.
+func FlushJobRequestCache() int {
+	c := currentJobRequestCache()
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushed := len(c.entries)
+	c.entries = make(map[[sha256.Size]byte]cachedJobResponse)
+	return flushed
+}
+
+// lookup returns the queue state Rails returned to a runner that polled
+// with lastUpdate before. It returns false if the runner never polled with
+// lastUpdate, or not recently.
+func (c *jobRequestCache) lookup(token, lastUpdate string, now time.Time) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := runnerKey(token)
+	entry, ok := c.entries[key]
+	if ok && now.After(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok || entry.lastUpdate != lastUpdate {
+		jobRequestCacheRequests.WithLabelValues(jobRequestCacheResultMiss).Inc()
+		return "", false
+	}
+
+	jobRequestCacheRequests.WithLabelValues(jobRequestCacheResultHit).Inc()
+	return entry.currentUpdate, true
+}
+
+func (c *jobRequestCache) store(token, lastUpdate, currentUpdate string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= c.maxEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		jobRequestCacheRequests.WithLabelValues(jobRequestCacheResultDiscarded).Inc()
+		return
+	}
+
+	c.entries[runnerKey(token)] = cachedJobResponse{
+		lastUpdate:    lastUpdate,
+		currentUpdate: currentUpdate,
+		expires:       now.Add(c.ttl),
+	}
+	jobRequestCacheRequests.WithLabelValues(jobRequestCacheResultStored).Inc()
+}
+
+func (c *jobRequestCache) evict(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := runnerKey(token)
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		jobRequestCacheRequests.WithLabelValues(jobRequestCacheResultEvicted).Inc()
+	}
+}
+
+// responseWriter returns a writer that caches the response of Rails to a
+// job request of the runner
+func (c *jobRequestCache) responseWriter(w http.ResponseWriter, token, lastUpdate string) http.ResponseWriter {
+	if c == nil || token == "" {
+		return w
+	}
+
+	return &jobResponseWriter{ResponseWriter: w, cache: c, token: token, lastUpdate: lastUpdate}
+}
+
+type jobResponseWriter struct {
+	http.ResponseWriter
+	cache       *jobRequestCache
+	token       string
+	lastUpdate  string
+	wroteHeader bool
+}
+
+func (j *jobResponseWriter) WriteHeader(status int) {
+	if !j.wroteHeader {
+		j.wroteHeader = true
+
+		currentUpdate := j.Header().Get(lastUpdateHeaderKey)
+		if status == http.StatusNoContent && currentUpdate != "" {
+			j.cache.store(j.token, j.lastUpdate, currentUpdate, time.Now())
+		} else {
+			// The runner got a job, or Rails could not tell the state of
+			// the queue: the next request must be forwarded
+			j.cache.evict(j.token)
+		}
+	}
+
+	j.ResponseWriter.WriteHeader(status)
+}
+
+func (j *jobResponseWriter) Write(data []byte) (int, error) {
+	if !j.wroteHeader {
+		j.WriteHeader(http.StatusOK)
+	}
+	return j.ResponseWriter.Write(data)
+}
+
+func (j *jobResponseWriter) Flush() {
+	if !j.wroteHeader {
+		j.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := j.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (j *jobResponseWriter) Unwrap() http.ResponseWriter {
+	return j.ResponseWriter
+}
@@ -0,0 +1,127 @@
+package builds
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+func TestJobRequestCacheValidation(t *testing.T) {
+	_, err := newJobRequestCache(config.CIJobRequestCacheConfig{TTL: &config.TomlDuration{}})
+	require.Error(t, err)
+
+	c, err := newJobRequestCache(config.CIJobRequestCacheConfig{})
+	require.NoError(t, err)
+	require.Nil(t, c, "disabled without TTL")
+}
+
+func TestJobRequestCacheLookup(t *testing.T) {
+	c, err := newJobRequestCache(config.CIJobRequestCacheConfig{TTL: &config.TomlDuration{Duration: time.Minute}})
+	require.NoError(t, err)
+
+	now := time.Now()
+	c.store("token", "old", "new", now)
+
+	update, ok := c.lookup("token", "old", now)
+	require.True(t, ok)
+	require.Equal(t, "new", update)
+
+	_, ok = c.lookup("token", "other", now)
+	require.False(t, ok, "runner sent a different state")
+
+	_, ok = c.lookup("other-token", "old", now)
+	require.False(t, ok, "unknown runner")
+
+	_, ok = c.lookup("token", "old", now.Add(2*time.Minute))
+	require.False(t, ok, "expired")
+	require.Empty(t, c.entries)
+}
+
+func TestJobRequestCacheMaxEntries(t *testing.T) {
+	c, err := newJobRequestCache(config.CIJobRequestCacheConfig{TTL: &config.TomlDuration{Duration: time.Minute}, MaxEntries: 1})
+	require.NoError(t, err)
+
+	now := time.Now()
+	c.store("first", "", "1", now)
+	c.store("second", "", "1", now)
+	require.Len(t, c.entries, 1)
+
+	c.store("third", "", "1", now.Add(2*time.Minute))
+	_, ok := c.lookup("third", "", now.Add(2*time.Minute))
+	require.True(t, ok, "expired entries make room")
+}
+
+func TestRegisterHandlerCachesRailsState(t *testing.T) {
+	require.NoError(t, ConfigureJobRequestCache(config.CIJobRequestCacheConfig{TTL: &config.TomlDuration{Duration: time.Minute}}))
+	defer ConfigureJobRequestCache(config.CIJobRequestCacheConfig{})
+
+	railsRequests := 0
+	rails := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		railsRequests++
+		w.Header().Set(lastUpdateHeaderKey, "current")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	var watchedValue string
+	watchHandler := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+		watchedValue = value
+		if value == "current" {
+			return redis.WatchKeyStatusTimeout, nil
+		}
+		return redis.WatchKeyStatusAlreadyChanged, nil
+	}
+
+	h := RegisterHandler(rails, WatchKeyHandler(watchHandler), time.Second)
+	poll := func(body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for _, body := range []string{`{"token":"a","last_update":"stale"}`, `{"token":"b"}`} {
+		railsRequests = 0
+
+		rw := poll(body)
+		require.Equal(t, http.StatusNoContent, rw.Code)
+		require.Equal(t, 1, railsRequests, "first poll is forwarded: %s", body)
+
+		rw = poll(body)
+		require.Equal(t, http.StatusNoContent, rw.Code)
+		require.Equal(t, 1, railsRequests, "unchanged poll is answered by Workhorse: %s", body)
+		require.Equal(t, "current", watchedValue, "watches the state Rails returned")
+		require.Equal(t, "current", rw.Header().Get(lastUpdateHeaderKey))
+	}
+}
+
+func TestRegisterHandlerEvictsOnJob(t *testing.T) {
+	require.NoError(t, ConfigureJobRequestCache(config.CIJobRequestCacheConfig{TTL: &config.TomlDuration{Duration: time.Minute}}))
+	defer ConfigureJobRequestCache(config.CIJobRequestCacheConfig{})
+
+	cache := currentJobRequestCache()
+	cache.store("token", "", "current", time.Now())
+
+	rails := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	watchHandler := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+		return redis.WatchKeyStatusAlreadyChanged, nil
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"token":"token"}`))
+	req.Header.Set("Content-Type", "application/json")
+	RegisterHandler(rails, WatchKeyHandler(watchHandler), time.Second).ServeHTTP(rw, req)
+
+	require.Equal(t, http.StatusCreated, rw.Code)
+	require.Empty(t, rw.Header().Get(lastUpdateHeaderKey))
+	require.Empty(t, cache.entries)
+}
@@ -0,0 +1,228 @@
+package builds
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// Runners send no tags in their job requests, so suggestions can only be
+// based on the history of each runner token and on the load of the API.
+
+const (
+	pollIntervalHeaderKey   = "X-GitLab-Poll-Interval"
+	defaultPollIdleStep     = 5 * time.Minute
+	defaultPollMaxFactor    = 10
+	maxTrackedRunners       = 100000
+	trackedRunnerSweepRatio = 2
+)
+
+var (
+	pollIntervals = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_builds_register_handler_poll_interval_seconds",
+			Help:    "Poll intervals suggested to runners that got no job",
+			Buckets: []float64{1, 3, 5, 10, 30, 60, 120, 300, 600},
+		},
+	)
+	queueDepthAtWakeup = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_builds_register_handler_queue_depth_at_wakeup",
+			Help:    "How many job requests were waiting for a change when a runner was woken up",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		},
+	)
+	trackedRunners = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_builds_register_handler_tracked_runners",
+			Help: "How many runners are tracked to suggest poll intervals",
+		},
+	)
+
+	// Counted next to the registerHandlerOpen gauges, which can't be read
+	proxyingRequests int64
+	watchingRequests int64
+
+	pollIntervalsMutex sync.Mutex
+	pollIntervalsCfg   *pollIntervalSettings
+)
+
+func init() {
+	prometheus.MustRegister(pollIntervals, queueDepthAtWakeup, trackedRunners)
+}
+
+type pollIntervalSettings struct {
+	min      time.Duration
+	max      time.Duration
+	idleStep time.Duration
+	apiLimit uint
+
+	mu         sync.Mutex
+	lastChange map[[sha256.Size]byte]time.Time
+}
+
+// ConfigurePollIntervals enables poll interval suggestions. apiLimit is the
+// number of job requests proxied to Rails at once, it is used to measure the
+// pressure on the API.
+func ConfigurePollIntervals(cfg config.CIPollIntervalConfig, apiLimit uint) error {
+	settings, err := newPollIntervalSettings(cfg, apiLimit)
+	if err != nil {
+		return err
+	}
+
+	pollIntervalsMutex.Lock()
+	defer pollIntervalsMutex.Unlock()
+	pollIntervalsCfg = settings
+	trackedRunners.Set(0)
+
+	return nil
+}
+
+func newPollIntervalSettings(cfg config.CIPollIntervalConfig, apiLimit uint) (*pollIntervalSettings, error) {
+	if cfg.Min == nil {
+		return nil, nil
+	}
+
+	s := &pollIntervalSettings{
+		min:        cfg.Min.Duration,
+		max:        defaultPollMaxFactor * cfg.Min.Duration,
+		idleStep:   defaultPollIdleStep,
+		apiLimit:   apiLimit,
+		lastChange: make(map[[sha256.Size]byte]time.Time),
+	}
+	if cfg.Max != nil {
+		s.max = cfg.Max.Duration
+	}
+	if cfg.IdleStep != nil {
+		s.idleStep = cfg.IdleStep.Duration
+	}
+
+	if s.min <= 0 {
+		return nil, errors.New("ci_poll_interval: Min must be positive")
+	}
+	if s.max < s.min {
+		return nil, errors.New("ci_poll_interval: Max must not be less than Min")
+	}
+	if s.idleStep <= 0 {
+		return nil, errors.New("ci_poll_interval: IdleStep must be positive")
+	}
+
+	return s, nil
+}
+
+func currentPollIntervals() *pollIntervalSettings {
+	pollIntervalsMutex.Lock()
+	defer pollIntervalsMutex.Unlock()
+	return pollIntervalsCfg
+}
+
+// Tokens are secrets, only their digests are kept in memory
+func runnerKey(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// recordChange notes that the build queue of a runner changed, so that it
+// is asked to poll quickly again
+func (s *pollIntervalSettings) recordChange(token string, now time.Time) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastChange[runnerKey(token)] = now
+	if len(s.lastChange) > maxTrackedRunners {
+		s.sweep(now)
+	}
+	trackedRunners.Set(float64(len(s.lastChange)))
+}
+
+// sweep forgets the runners that are idle long enough to get the maximum
+// interval anyway. If that isn't enough, runners idle for longer than
+// average are dropped too.
+func (s *pollIntervalSettings) sweep(now time.Time) {
+	for key, t := range s.lastChange {
+		if s.idleInterval(now.Sub(t)) >= s.max {
+			delete(s.lastChange, key)
+		}
+	}
+
+	if len(s.lastChange) <= maxTrackedRunners/trackedRunnerSweepRatio {
+		return
+	}
+
+	var average time.Duration
+	for _, t := range s.lastChange {
+		average += now.Sub(t) / time.Duration(len(s.lastChange))
+	}
+	for key, t := range s.lastChange {
+		if now.Sub(t) > average {
+			delete(s.lastChange, key)
+		}
+	}
+}
+
+// idleInterval doubles min for every idleStep spent without a change
+func (s *pollIntervalSettings) idleInterval(idle time.Duration) time.Duration {
+	interval := s.min
+	for steps := idle / s.idleStep; steps > 0 && interval < s.max; steps-- {
+		interval *= 2
+	}
+	return interval
+}
+
+// suggest returns the interval a runner that got no job should wait. Unknown
+// runners are treated as if their queue just changed, so that a restart of
+// Workhorse does not slow down all runners at once.
+func (s *pollIntervalSettings) suggest(token string, now time.Time) time.Duration {
+	s.mu.Lock()
+	lastChange, ok := s.lastChange[runnerKey(token)]
+	s.mu.Unlock()
+
+	if !ok {
+		s.recordChange(token, now)
+		lastChange = now
+	}
+
+	interval := s.idleInterval(now.Sub(lastChange))
+
+	// Back off further while job requests are queueing for the API
+	if s.apiLimit > 0 {
+		pressure := math.Min(float64(atomic.LoadInt64(&proxyingRequests))/float64(s.apiLimit), 1)
+		interval += time.Duration(pressure * float64(interval))
+	}
+
+	if interval > s.max {
+		interval = s.max
+	}
+	return interval
+}
+
+func setPollInterval(w http.ResponseWriter, token string) {
+	s := currentPollIntervals()
+	if s == nil {
+		return
+	}
+
+	interval := s.suggest(token, time.Now())
+	pollIntervals.Observe(interval.Seconds())
+
+	seconds := strconv.Itoa(int(math.Ceil(interval.Seconds())))
+	w.Header().Set(pollIntervalHeaderKey, seconds)
+	w.Header().Set("Retry-After", seconds)
+}
+
+func recordWakeup(token string) {
+	queueDepthAtWakeup.Observe(float64(atomic.LoadInt64(&watchingRequests)))
+	currentPollIntervals().recordChange(token, time.Now())
+}
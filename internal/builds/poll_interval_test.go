@@ -0,0 +1,104 @@
+package builds
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+func pollIntervalConfig(min, max, idleStep time.Duration) config.CIPollIntervalConfig {
+	return config.CIPollIntervalConfig{
+		Min:      &config.TomlDuration{Duration: min},
+		Max:      &config.TomlDuration{Duration: max},
+		IdleStep: &config.TomlDuration{Duration: idleStep},
+	}
+}
+
+func TestPollIntervalValidation(t *testing.T) {
+	_, err := newPollIntervalSettings(pollIntervalConfig(time.Minute, time.Second, time.Minute), 0)
+	require.Error(t, err, "Max less than Min")
+
+	_, err = newPollIntervalSettings(pollIntervalConfig(0, time.Second, time.Minute), 0)
+	require.Error(t, err, "zero Min")
+
+	s, err := newPollIntervalSettings(config.CIPollIntervalConfig{}, 0)
+	require.NoError(t, err)
+	require.Nil(t, s, "disabled without Min")
+}
+
+func TestPollIntervalGrowsWhileIdle(t *testing.T) {
+	s, err := newPollIntervalSettings(pollIntervalConfig(3*time.Second, 20*time.Second, time.Minute), 0)
+	require.NoError(t, err)
+
+	now := time.Now()
+	require.Equal(t, 3*time.Second, s.suggest("token", now), "unknown runner")
+	require.Equal(t, 3*time.Second, s.suggest("token", now.Add(59*time.Second)))
+	require.Equal(t, 6*time.Second, s.suggest("token", now.Add(time.Minute)))
+	require.Equal(t, 12*time.Second, s.suggest("token", now.Add(2*time.Minute)))
+	require.Equal(t, 20*time.Second, s.suggest("token", now.Add(time.Hour)), "capped by Max")
+
+	s.recordChange("token", now.Add(time.Hour))
+	require.Equal(t, 3*time.Second, s.suggest("token", now.Add(time.Hour)), "reset by a change")
+	require.Equal(t, 3*time.Second, s.suggest("other", now.Add(time.Hour)), "runners are tracked separately")
+}
+
+func TestPollIntervalAPIPressure(t *testing.T) {
+	s, err := newPollIntervalSettings(pollIntervalConfig(4*time.Second, time.Minute, time.Minute), 4)
+	require.NoError(t, err)
+
+	atomic.AddInt64(&proxyingRequests, 2)
+	defer atomic.AddInt64(&proxyingRequests, -2)
+
+	require.Equal(t, 6*time.Second, s.suggest("token", time.Now()))
+}
+
+func TestPollIntervalSweep(t *testing.T) {
+	s, err := newPollIntervalSettings(pollIntervalConfig(time.Second, 4*time.Second, time.Minute), 0)
+	require.NoError(t, err)
+
+	now := time.Now()
+	s.lastChange[runnerKey("idle")] = now.Add(-time.Hour)
+	s.lastChange[runnerKey("active")] = now
+	s.sweep(now)
+
+	require.NotContains(t, s.lastChange, runnerKey("idle"))
+	require.Contains(t, s.lastChange, runnerKey("active"))
+}
+
+func TestRegisterHandlerSuggestsPollInterval(t *testing.T) {
+	require.NoError(t, ConfigurePollIntervals(pollIntervalConfig(3*time.Second, time.Minute, time.Minute), 0))
+	defer ConfigurePollIntervals(config.CIPollIntervalConfig{}, 0)
+
+	testCases := []struct {
+		status   redis.WatchKeyStatus
+		interval string
+	}{
+		{redis.WatchKeyStatusTimeout, "3"},
+		{redis.WatchKeyStatusNoChange, "3"},
+		{redis.WatchKeyStatusSeenChange, ""},
+		{redis.WatchKeyStatusAlreadyChanged, ""},
+	}
+
+	for _, tc := range testCases {
+		watchHandler := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+			return tc.status, nil
+		}
+		h := RegisterHandler(echoRequestFunc, WatchKeyHandler(watchHandler), time.Second)
+
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"token":"token","last_update":"last_update"}`))
+		req.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rw, req)
+
+		require.Equal(t, tc.interval, rw.Header().Get("X-GitLab-Poll-Interval"), "status %v", tc.status)
+		require.Equal(t, tc.interval, rw.Header().Get("Retry-After"), "status %v", tc.status)
+	}
+}
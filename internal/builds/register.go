@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -51,8 +52,20 @@ var (
 
 type largeBodyError struct{ error }
 
+// KeyWatcher waits for a key to change from value. It is implemented by the
+// Redis and the NATS backends.
+type KeyWatcher interface {
+	WatchKey(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error)
+}
+
+// WatchKeyHandler adapts a function to the KeyWatcher interface
 type WatchKeyHandler func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error)
 
+// WatchKey calls f(key, value, timeout)
+func (f WatchKeyHandler) WatchKey(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+	return f(key, value, timeout)
+}
+
 func init() {
 	prometheus.MustRegister(
 		registerHandlerRequests,
@@ -89,18 +102,22 @@ func readRunnerRequest(r *http.Request, body []byte) (*runnerRequest, error) {
 func proxyRegisterRequest(h http.Handler, w http.ResponseWriter, r *http.Request) {
 	registerHandlerOpenAtProxying.Inc()
 	defer registerHandlerOpenAtProxying.Dec()
+	atomic.AddInt64(&proxyingRequests, 1)
+	defer atomic.AddInt64(&proxyingRequests, -1)
 
 	h.ServeHTTP(w, r)
 }
 
-func watchForRunnerChange(watchHandler WatchKeyHandler, token, lastUpdate string, duration time.Duration) (redis.WatchKeyStatus, error) {
+func watchForRunnerChange(keyWatcher KeyWatcher, token, lastUpdate string, duration time.Duration) (redis.WatchKeyStatus, error) {
 	registerHandlerOpenAtWatching.Inc()
 	defer registerHandlerOpenAtWatching.Dec()
+	atomic.AddInt64(&watchingRequests, 1)
+	defer atomic.AddInt64(&watchingRequests, -1)
 
-	return watchHandler(runnerBuildQueue+token, lastUpdate, duration)
+	return keyWatcher.WatchKey(runnerBuildQueue+token, lastUpdate, duration)
 }
 
-func RegisterHandler(h http.Handler, watchHandler WatchKeyHandler, pollingDuration time.Duration) http.Handler {
+func RegisterHandler(h http.Handler, keyWatcher KeyWatcher, pollingDuration time.Duration) http.Handler {
 	if pollingDuration == 0 {
 		return h
 	}
@@ -124,26 +141,49 @@ func RegisterHandler(h http.Handler, watchHandler WatchKeyHandler, pollingDurati
 			return
 		}
 
-		if runnerRequest.Token == "" || runnerRequest.LastUpdate == "" {
+		if runnerRequest.Token == "" {
 			registerHandlerMissingValues.Inc()
 			proxyRegisterRequest(h, w, newRequest)
 			return
 		}
 
-		result, err := watchForRunnerChange(watchHandler, runnerRequest.Token,
-			runnerRequest.LastUpdate, pollingDuration)
+		// Rails' answers are cached under the state the runner sent
+		cache := currentJobRequestCache()
+		cachingWriter := cache.responseWriter(w, runnerRequest.Token, runnerRequest.LastUpdate)
+
+		lastUpdate := runnerRequest.LastUpdate
+		cachedUpdate, cached := cache.lookup(runnerRequest.Token, lastUpdate, time.Now())
+		if cached {
+			lastUpdate = cachedUpdate
+		}
+
+		if lastUpdate == "" {
+			registerHandlerMissingValues.Inc()
+			proxyRegisterRequest(h, cachingWriter, newRequest)
+			return
+		}
+
+		result, err := watchForRunnerChange(keyWatcher, runnerRequest.Token,
+			lastUpdate, pollingDuration)
 		if err != nil {
 			registerHandlerWatchErrors.Inc()
-			proxyRegisterRequest(h, w, newRequest)
+			proxyRegisterRequest(h, cachingWriter, newRequest)
 			return
 		}
 
+		// Tell the runner which state Rails returned to it before, unless
+		// Rails is asked again
+		if cached && result != redis.WatchKeyStatusAlreadyChanged {
+			w.Header().Set(lastUpdateHeaderKey, cachedUpdate)
+		}
+
 		switch result {
 		// It means that we detected a change before starting watching on change,
 		// We proxy request to Rails, to see whether we have a build to receive
 		case redis.WatchKeyStatusAlreadyChanged:
 			registerHandlerAlreadyChangedRequests.Inc()
-			proxyRegisterRequest(h, w, newRequest)
+			currentPollIntervals().recordChange(runnerRequest.Token, time.Now())
+			proxyRegisterRequest(h, cachingWriter, newRequest)
 
 		// It means that we detected a change after watching.
 		// We could potentially proxy request to Rails, but...
@@ -152,17 +192,21 @@ func RegisterHandler(h http.Handler, watchHandler WatchKeyHandler, pollingDurati
 		// for example the connection is dead
 		case redis.WatchKeyStatusSeenChange:
 			registerHandlerSeenChangeRequests.Inc()
+			recordWakeup(runnerRequest.Token)
 			w.WriteHeader(http.StatusNoContent)
 
 		// When we receive one of these statuses, it means that we detected no change,
 		// so we return to runner 204, which means nothing got changed,
-		// and there's no new builds to process
+		// and there's no new builds to process. Quiet runners are asked to
+		// wait longer before their next request.
 		case redis.WatchKeyStatusTimeout:
 			registerHandlerTimeoutRequests.Inc()
+			setPollInterval(w, runnerRequest.Token)
 			w.WriteHeader(http.StatusNoContent)
 
 		case redis.WatchKeyStatusNoChange:
 			registerHandlerNoChangeRequests.Inc()
+			setPollInterval(w, runnerRequest.Token)
 			w.WriteHeader(http.StatusNoContent)
 		}
 	})
@@ -24,8 +24,8 @@ func echoRequest(rw http.ResponseWriter, req *http.Request) {
 
 var echoRequestFunc = http.HandlerFunc(echoRequest)
 
-func expectHandlerWithWatcher(t *testing.T, watchHandler WatchKeyHandler, data string, contentType string, expectedHttpStatus int, msgAndArgs ...interface{}) {
-	h := RegisterHandler(echoRequestFunc, watchHandler, time.Second)
+func expectHandlerWithWatcher(t *testing.T, keyWatcher KeyWatcher, data string, contentType string, expectedHttpStatus int, msgAndArgs ...interface{}) {
+	h := RegisterHandler(echoRequestFunc, keyWatcher, time.Second)
 
 	rw := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(data))
@@ -78,7 +78,7 @@ func expectWatcherToBeExecuted(t *testing.T, watchKeyStatus redis.WatchKeyStatus
 
 	parsableData := `{"token":"token","last_update":"last_update"}`
 
-	expectHandlerWithWatcher(t, watchKeyHandler, parsableData, "application/json", httpStatus, msgAndArgs...)
+	expectHandlerWithWatcher(t, WatchKeyHandler(watchKeyHandler), parsableData, "application/json", httpStatus, msgAndArgs...)
 	assert.True(t, executed, msgAndArgs...)
 }
 
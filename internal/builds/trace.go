@@ -0,0 +1,541 @@
+package builds
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// A running job sends its trace to Rails in PATCH requests of a few lines
+// each. Rails appends every one of them to the trace chunks of the job and
+// answers with the new length of the trace, so chatty jobs cost Rails a
+// write per line. Once Rails accepted an append of a job, the trace buffer
+// acknowledges the following appends itself and sends them on in batches
+// of MaxSize bytes or MaxAge, whichever comes first. The state of each job
+// is kept in Redis, so that all Workhorse processes behind a load balancer
+// share it.
+//
+// The runner keeps its whole trace until the job is over. When Rails
+// rejects a batch sent with an append of the runner, the runner gets the
+// answer of Rails, with the length Rails has, and sends the rest again.
+// Batches sent after MaxAge or before a job update have no runner to tell:
+// while Rails fails them they stay buffered and are sent again, and the job
+// update waits for them.
+
+const (
+	jobTokenHeader            = "Job-Token"
+	jobStatusHeader           = "Job-Status"
+	traceUpdateIntervalHeader = "X-GitLab-Trace-Update-Interval"
+	jobStatusRunning          = "running"
+
+	traceBufferKeyPrefix      = "workhorse:ci_trace:"
+	traceBufferStateTTL       = time.Hour
+	defaultTraceBufferMaxSize = 64 * 1024
+	defaultTraceBufferMaxAge  = 5 * time.Second
+	maxJobUpdateBodySize      = 1024 * 1024
+)
+
+var (
+	traceBufferAppends = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_builds_trace_buffer_appends",
+			Help: "How many job trace appends were buffered, sent to Rails in a batch, or sent to Rails as they are",
+		},
+		[]string{"result"},
+	)
+	traceBufferFlushes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_builds_trace_buffer_flushes",
+			Help: "How many batches of job trace were sent to Rails, by result",
+		},
+		[]string{"result"},
+	)
+	traceBufferFlushedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_builds_trace_buffer_flushed_bytes",
+			Help: "How many bytes of job trace were sent to Rails in batches",
+		},
+	)
+
+	traceBufferMutex sync.Mutex
+	traceBufferCfg   *traceBuffer
+
+	jobPathRegex = regexp.MustCompile(`/jobs/([0-9]+)(/trace)?\z`)
+)
+
+func init() {
+	prometheus.MustRegister(
+		traceBufferAppends,
+		traceBufferFlushes,
+		traceBufferFlushedBytes,
+	)
+}
+
+type traceBuffer struct {
+	maxSize int
+	maxAge  time.Duration
+	store   traceStore
+}
+
+// traceState is what Rails last said about the trace of a job
+type traceState struct {
+	tokenHash string
+	// length is the length of the trace sent to Rails
+	length   int64
+	status   string
+	interval string
+}
+
+// appendResult tells what became of an append
+type appendResult struct {
+	// action is one of the append constants
+	action string
+	// length is the length of the trace acknowledged to the runner, or
+	// where data starts if the buffer is flushed
+	length   int64
+	data     []byte
+	status   string
+	interval string
+	// started is set if the append started a new batch
+	started bool
+}
+
+const (
+	// appendUnknown means that Rails did not accept an append with the
+	// token of the request yet
+	appendUnknown = "unknown"
+	// appendMismatch means that the append does not start where the trace
+	// ends
+	appendMismatch = "mismatch"
+	appendBuffered = "buffered"
+	appendFlush    = "flush"
+)
+
+// traceStore keeps the buffered trace of the jobs. The operations on a job
+// are atomic.
+type traceStore interface {
+	// append adds chunk to the buffer of the job if it starts where the
+	// trace ends. When the buffer is large or old enough it is taken out
+	// for flushing.
+	append(key, tokenHash string, start int64, chunk []byte, now time.Time, maxSize int, maxAge time.Duration) (appendResult, error)
+	// take takes the buffer of the job out for flushing. ok is false if
+	// nothing is buffered.
+	take(key, tokenHash string) (start int64, data []byte, ok bool, err error)
+	// restore puts a batch taken out for flushing back in front of the
+	// buffer, unless the job changed since. ok is false if it did.
+	restore(key, tokenHash string, start int64, data []byte, now time.Time) (ok bool, err error)
+	// remember replaces the state of the job and drops its buffer
+	remember(key string, state traceState) error
+	// update stores the job status Rails returned for a batch
+	update(key, tokenHash, status, interval string) error
+	forget(key string) error
+}
+
+// ConfigureTraceBuffer enables the buffer of job trace appends. It needs
+// Redis.
+func ConfigureTraceBuffer(cfg config.CITraceBufferConfig, redisCfg *config.RedisConfig) error {
+	b, err := newTraceBuffer(cfg, redisCfg)
+	if err != nil {
+		return err
+	}
+
+	traceBufferMutex.Lock()
+	defer traceBufferMutex.Unlock()
+	traceBufferCfg = b
+
+	return nil
+}
+
+func newTraceBuffer(cfg config.CITraceBufferConfig, redisCfg *config.RedisConfig) (*traceBuffer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if redisCfg == nil {
+		return nil, errors.New("ci_trace_buffer: Enabled needs [redis]")
+	}
+	if cfg.MaxSize < 0 {
+		return nil, errors.New("ci_trace_buffer: MaxSize must not be negative")
+	}
+
+	b := &traceBuffer{
+		maxSize: cfg.MaxSize,
+		maxAge:  defaultTraceBufferMaxAge,
+		store:   redisTraceStore{},
+	}
+	if b.maxSize == 0 {
+		b.maxSize = defaultTraceBufferMaxSize
+	}
+	if cfg.MaxAge != nil {
+		if cfg.MaxAge.Duration <= 0 {
+			return nil, errors.New("ci_trace_buffer: MaxAge must be positive")
+		}
+		b.maxAge = cfg.MaxAge.Duration
+	}
+
+	return b, nil
+}
+
+func currentTraceBuffer() *traceBuffer {
+	traceBufferMutex.Lock()
+	defer traceBufferMutex.Unlock()
+	return traceBufferCfg
+}
+
+// TraceHandler buffers the trace appends of running jobs, and passes all
+// other requests on to h
+func TraceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := currentTraceBuffer()
+		if b == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		b.serveAppend(h, w, r)
+	})
+}
+
+// JobUpdateHandler sends the buffered trace of a job to Rails before the
+// runner updates the state of the job, so that Rails has the whole trace
+// when the job is over
+func JobUpdateHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := currentTraceBuffer()
+		if b == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := helper.ReadRequestBody(w, r, maxJobUpdateBodySize)
+		if err != nil {
+			helper.RequestEntityTooLarge(w, r, &largeBodyError{err})
+			return
+		}
+		r = helper.CloneRequestWithNewBody(r, body)
+
+		var update struct {
+			Token string `json:"token"`
+			State string `json:"state"`
+		}
+		json.Unmarshal(body, &update)
+		if update.Token == "" {
+			update.Token = r.Header.Get(jobTokenHeader)
+		}
+
+		if key, ok := traceKey(r.URL.Path); ok && update.Token != "" {
+			target := newTraceTarget(h, r, r.URL.Path+"/trace", update.Token)
+			if err := b.flush(r.Context(), key, target); err != nil {
+				// The runner tries the update again later, and the
+				// buffered trace with it
+				helper.CaptureAndFail(w, r, fmt.Errorf("trace buffer: %v", err), "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			if update.State != "" && update.State != jobStatusRunning {
+				if err := b.store.forget(key); err != nil {
+					helper.LogError(r, fmt.Errorf("trace buffer: %v", err))
+				}
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (b *traceBuffer) serveAppend(h http.Handler, w http.ResponseWriter, r *http.Request) {
+	key, ok := traceKey(r.URL.Path)
+	token := r.Header.Get(jobTokenHeader)
+	start, end, rangeOK := parseContentRange(r.Header.Get("Content-Range"))
+	if !ok || token == "" || !rangeOK || end-start+1 > int64(b.maxSize) {
+		traceBufferAppends.WithLabelValues("proxied").Inc()
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	chunk, err := helper.ReadRequestBody(w, r, end-start+1)
+	if err != nil || int64(len(chunk)) != end-start+1 {
+		helper.CaptureAndFail(w, r, fmt.Errorf("trace buffer: body does not match Content-Range"), "Bad Request", http.StatusBadRequest)
+		return
+	}
+	r = helper.CloneRequestWithNewBody(r, chunk)
+
+	target := newTraceTarget(h, r, r.URL.Path, token)
+	result, err := b.store.append(key, target.tokenHash, start, chunk, time.Now(), b.maxSize, b.maxAge)
+	if err != nil {
+		helper.LogError(r, fmt.Errorf("trace buffer: %v", err))
+		result.action = appendUnknown
+	}
+
+	switch result.action {
+	case appendBuffered:
+		traceBufferAppends.WithLabelValues("buffered").Inc()
+		if result.started {
+			b.flushLater(key, target)
+		}
+		writeTraceAccepted(w, result.length, result.status, result.interval)
+
+	case appendFlush:
+		traceBufferAppends.WithLabelValues("flushed").Inc()
+		response, ok := b.send(r.Context(), key, target, result.length, result.data)
+		if !ok {
+			// The runner learns from the response of Rails what to
+			// send again
+			b.forget(target.request, key)
+		}
+		response.writeTo(w)
+
+	case appendMismatch:
+		// The runner went back to the length Rails told it, or
+		// something went wrong. Rails has to sort it out.
+		traceBufferAppends.WithLabelValues("proxied").Inc()
+		if err := b.flush(r.Context(), key, target); err != nil {
+			helper.LogError(r, fmt.Errorf("trace buffer: %v", err))
+		}
+		b.proxyAndRemember(h, w, r, key, target.tokenHash)
+
+	default:
+		traceBufferAppends.WithLabelValues("proxied").Inc()
+		b.proxyAndRemember(h, w, r, key, target.tokenHash)
+	}
+}
+
+// proxyAndRemember sends the append to Rails and, if Rails accepted it,
+// buffers the next appends of the job
+func (b *traceBuffer) proxyAndRemember(h http.Handler, w http.ResponseWriter, r *http.Request, key, tokenHash string) {
+	response := newTraceResponse()
+	h.ServeHTTP(response, r)
+
+	if err := b.remember(key, tokenHash, response); err != nil {
+		helper.LogError(r, fmt.Errorf("trace buffer: %v", err))
+	}
+	response.writeTo(w)
+}
+
+func (b *traceBuffer) remember(key, tokenHash string, response *traceResponse) error {
+	length, ok := parseRange(response.header.Get("Range"))
+	status := response.header.Get(jobStatusHeader)
+	if response.status != http.StatusAccepted || !ok || status != jobStatusRunning {
+		return b.store.forget(key)
+	}
+
+	return b.store.remember(key, traceState{
+		tokenHash: tokenHash,
+		length:    length,
+		status:    status,
+		interval:  response.header.Get(traceUpdateIntervalHeader),
+	})
+}
+
+// flush sends what is buffered for the job to Rails. If Rails fails, the
+// batch is put back into the buffer and flush returns an error. Other
+// rejections make the buffer forget the job, so that the next append of
+// the runner goes to Rails.
+func (b *traceBuffer) flush(ctx context.Context, key string, target *traceTarget) error {
+	start, data, ok, err := b.store.take(key, target.tokenHash)
+	if err != nil || !ok {
+		return err
+	}
+
+	response, ok := b.send(ctx, key, target, start, data)
+	if ok {
+		return nil
+	}
+
+	err = fmt.Errorf("Rails rejected %d bytes of trace at %d: %d", len(data), start, response.status)
+	if response.status < http.StatusInternalServerError {
+		helper.LogError(target.request, fmt.Errorf("trace buffer: %v", err))
+		b.forget(target.request, key)
+		return nil
+	}
+
+	restored, restoreErr := b.store.restore(key, target.tokenHash, start, data, time.Now())
+	if restoreErr != nil {
+		return fmt.Errorf("%v, restore: %v", err, restoreErr)
+	}
+	if !restored {
+		helper.LogError(target.request, fmt.Errorf("trace buffer: %v, the job changed since", err))
+		return nil
+	}
+	return err
+}
+
+// flushLater flushes the buffer of the job after MaxAge, and again as long
+// as Rails fails
+func (b *traceBuffer) flushLater(key string, target *traceTarget) {
+	time.AfterFunc(b.maxAge, func() {
+		if err := b.flush(context.Background(), key, target); err != nil {
+			helper.LogError(target.request, fmt.Errorf("trace buffer: %v", err))
+			b.flushLater(key, target)
+		}
+	})
+}
+
+// send sends a batch of trace to Rails and tells if Rails accepted it. A
+// job Rails stopped is forgotten.
+func (b *traceBuffer) send(ctx context.Context, key string, target *traceTarget, start int64, data []byte) (*traceResponse, bool) {
+	response := newTraceResponse()
+	target.handler.ServeHTTP(response, target.newRequest(ctx, start, data))
+
+	length, ok := parseRange(response.header.Get("Range"))
+	if response.status != http.StatusAccepted || !ok || length != start+int64(len(data)) {
+		traceBufferFlushes.WithLabelValues("rejected").Inc()
+		return response, false
+	}
+
+	traceBufferFlushes.WithLabelValues("ok").Inc()
+	traceBufferFlushedBytes.Add(float64(len(data)))
+
+	status := response.header.Get(jobStatusHeader)
+	if status != jobStatusRunning {
+		b.forget(target.request, key)
+		return response, true
+	}
+	if err := b.store.update(key, target.tokenHash, status, response.header.Get(traceUpdateIntervalHeader)); err != nil {
+		helper.LogError(target.request, fmt.Errorf("trace buffer: %v", err))
+	}
+	return response, true
+}
+
+func (b *traceBuffer) forget(r *http.Request, key string) {
+	if err := b.store.forget(key); err != nil {
+		helper.LogError(r, fmt.Errorf("trace buffer: %v", err))
+	}
+}
+
+func writeTraceAccepted(w http.ResponseWriter, length int64, status, interval string) {
+	w.Header().Set("Range", fmt.Sprintf("0-%d", length))
+	w.Header().Set(jobStatusHeader, status)
+	if interval != "" {
+		w.Header().Set(traceUpdateIntervalHeader, interval)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// traceTarget has what is needed to send trace of a job to Rails after
+// the request of the runner is done
+type traceTarget struct {
+	handler   http.Handler
+	request   *http.Request
+	path      string
+	token     string
+	tokenHash string
+}
+
+func newTraceTarget(h http.Handler, r *http.Request, path, token string) *traceTarget {
+	sum := sha256.Sum256([]byte(token))
+
+	return &traceTarget{
+		handler:   h,
+		request:   helper.CloneRequestWithNewBody(r, nil),
+		path:      path,
+		token:     token,
+		tokenHash: hex.EncodeToString(sum[:]),
+	}
+}
+
+func (t *traceTarget) newRequest(ctx context.Context, start int64, data []byte) *http.Request {
+	req := helper.CloneRequestWithNewBody(t.request, data).WithContext(ctx)
+	req.Method = "PATCH"
+
+	u := *t.request.URL
+	u.Path, u.RawPath, u.RawQuery = t.path, "", ""
+	req.URL = &u
+	req.RequestURI = ""
+
+	req.Header.Del("Content-Encoding")
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, start+int64(len(data))-1))
+	req.Header.Set(jobTokenHeader, t.token)
+
+	return req
+}
+
+// traceResponse keeps the response of Rails to pass it on to the runner
+type traceResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newTraceResponse() *traceResponse {
+	return &traceResponse{header: make(http.Header)}
+}
+
+func (t *traceResponse) Header() http.Header {
+	return t.header
+}
+
+func (t *traceResponse) Write(data []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.body.Write(data)
+}
+
+func (t *traceResponse) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+}
+
+func (t *traceResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range t.header {
+		w.Header()[k] = v
+	}
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	w.WriteHeader(t.status)
+	w.Write(t.body.Bytes())
+}
+
+func traceKey(path string) (string, bool) {
+	m := jobPathRegex.FindStringSubmatch(path)
+	if m == nil {
+		return "", false
+	}
+	return traceBufferKeyPrefix + m[1], true
+}
+
+// parseContentRange parses the "start-end" Content-Range of the runner
+func parseContentRange(value string) (int64, int64, bool) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// parseRange parses the "0-length" Range of Rails
+func parseRange(value string) (int64, bool) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 || parts[0] != "0" {
+		return 0, false
+	}
+	length, err := strconv.ParseInt(parts[1], 10, 64)
+	return length, err == nil && length >= 0
+}
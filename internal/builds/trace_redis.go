@@ -0,0 +1,181 @@
+package builds
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+// The state of a job is a hash with the hash of the job token, the length
+// of the trace sent to Rails ("length"), what Rails last said about the
+// job ("status", "interval"), and the trace buffered since ("data",
+// "since" in milliseconds).
+
+var appendTraceScript = redigo.NewScript(1, `
+local state = redis.call("HMGET", KEYS[1], "token", "length", "data", "since", "status", "interval")
+if state[1] ~= ARGV[1] or not state[2] then
+  return {"unknown"}
+end
+local data = state[3] or ""
+local sent = tonumber(state[2])
+if tonumber(ARGV[2]) ~= sent + string.len(data) then
+  return {"mismatch"}
+end
+data = data .. ARGV[3]
+local now = tonumber(ARGV[4])
+local since = tonumber(state[4]) or now
+if string.len(data) >= tonumber(ARGV[5]) or now - since >= tonumber(ARGV[6]) then
+  redis.call("HSET", KEYS[1], "length", sent + string.len(data))
+  redis.call("HDEL", KEYS[1], "data", "since")
+  redis.call("PEXPIRE", KEYS[1], ARGV[7])
+  return {"flush", tostring(sent), data}
+end
+redis.call("HMSET", KEYS[1], "data", data, "since", since)
+redis.call("PEXPIRE", KEYS[1], ARGV[7])
+local started = 0
+if not state[4] then
+  started = 1
+end
+return {"buffered", tostring(sent + string.len(data)), state[5] or "", state[6] or "", started}
+`)
+
+var takeTraceScript = redigo.NewScript(1, `
+local state = redis.call("HMGET", KEYS[1], "token", "length", "data")
+if state[1] ~= ARGV[1] or not state[2] or not state[3] then
+  return false
+end
+redis.call("HSET", KEYS[1], "length", tonumber(state[2]) + string.len(state[3]))
+redis.call("HDEL", KEYS[1], "data", "since")
+return {state[2], state[3]}
+`)
+
+var restoreTraceScript = redigo.NewScript(1, `
+local state = redis.call("HMGET", KEYS[1], "token", "length", "data", "since")
+if state[1] ~= ARGV[1] or tonumber(state[2]) ~= tonumber(ARGV[2]) + string.len(ARGV[3]) then
+  return 0
+end
+redis.call("HMSET", KEYS[1], "length", ARGV[2], "data", ARGV[3] .. (state[3] or ""), "since", state[4] or ARGV[4])
+return 1
+`)
+
+var rememberTraceScript = redigo.NewScript(1, `
+redis.call("DEL", KEYS[1])
+redis.call("HMSET", KEYS[1], "token", ARGV[1], "length", ARGV[2], "status", ARGV[3], "interval", ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[5])
+return 1
+`)
+
+var updateTraceScript = redigo.NewScript(1, `
+if redis.call("HGET", KEYS[1], "token") ~= ARGV[1] then
+  return 0
+end
+redis.call("HMSET", KEYS[1], "status", ARGV[2], "interval", ARGV[3])
+return 1
+`)
+
+type redisTraceStore struct{}
+
+func (redisTraceStore) append(key, tokenHash string, start int64, chunk []byte, now time.Time, maxSize int, maxAge time.Duration) (appendResult, error) {
+	var result appendResult
+
+	reply, err := doTraceScript(appendTraceScript, key, tokenHash, start, chunk, millis(now), maxSize, maxAge.Nanoseconds()/1e6, traceBufferStateTTL.Nanoseconds()/1e6)
+	if err != nil {
+		return result, err
+	}
+
+	values, err := redigo.Values(reply, nil)
+	if err != nil || len(values) == 0 {
+		return result, fmt.Errorf("append: unexpected reply %v", reply)
+	}
+	if result.action, err = redigo.String(values[0], nil); err != nil {
+		return result, fmt.Errorf("append: %v", err)
+	}
+
+	switch {
+	case result.action == appendFlush && len(values) == 3:
+		if result.length, err = redigo.Int64(values[1], nil); err != nil {
+			return result, fmt.Errorf("append: %v", err)
+		}
+		result.data, err = redigo.Bytes(values[2], nil)
+	case result.action == appendBuffered && len(values) == 5:
+		if result.length, err = redigo.Int64(values[1], nil); err != nil {
+			return result, fmt.Errorf("append: %v", err)
+		}
+		result.status, _ = redigo.String(values[2], nil)
+		result.interval, _ = redigo.String(values[3], nil)
+		result.started, err = redigo.Bool(values[4], nil)
+	case result.action == appendUnknown || result.action == appendMismatch:
+	default:
+		err = fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("append: %v", err)
+	}
+	return result, nil
+}
+
+func (redisTraceStore) take(key, tokenHash string) (int64, []byte, bool, error) {
+	reply, err := doTraceScript(takeTraceScript, key, tokenHash)
+	if err != nil || reply == nil {
+		return 0, nil, false, err
+	}
+
+	values, err := redigo.Values(reply, nil)
+	if err != nil || len(values) != 2 {
+		return 0, nil, false, fmt.Errorf("take: unexpected reply %v", reply)
+	}
+	start, err := redigo.Int64(values[0], nil)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("take: %v", err)
+	}
+	data, err := redigo.Bytes(values[1], nil)
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("take: %v", err)
+	}
+
+	return start, data, true, nil
+}
+
+func (redisTraceStore) restore(key, tokenHash string, start int64, data []byte, now time.Time) (bool, error) {
+	return redigo.Bool(doTraceScript(restoreTraceScript, key, tokenHash, start, data, millis(now)))
+}
+
+func (redisTraceStore) remember(key string, state traceState) error {
+	_, err := doTraceScript(rememberTraceScript, key, state.tokenHash, state.length, state.status, state.interval, traceBufferStateTTL.Nanoseconds()/1e6)
+	return err
+}
+
+func (redisTraceStore) update(key, tokenHash, status, interval string) error {
+	_, err := doTraceScript(updateTraceScript, key, tokenHash, status, interval)
+	return err
+}
+
+func (redisTraceStore) forget(key string) error {
+	conn := redis.Get()
+	if conn == nil {
+		return fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+func doTraceScript(script *redigo.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return nil, fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	return script.Do(conn, keysAndArgs...)
+}
+
+func millis(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/1e6, 10)
+}
@@ -0,0 +1,265 @@
+package builds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+// The job page of a running job polls Rails for new trace every few
+// seconds. The trace stream keeps a Server-Sent Events connection open
+// instead, and only asks Rails for the trace when Rails announces a change
+// of the trace key of the job on the notification channel, or when
+// PollInterval passed without any.
+//
+// Each event is the answer of Rails to trace.json, with the state of the
+// trace as event ID, so that browsers reconnect where they left off.
+
+const (
+	jobTraceKeyPrefix         = "ci:job_trace:"
+	defaultTraceStreamPoll    = 30 * time.Second
+	defaultTraceStreamMaxTime = time.Hour
+)
+
+var (
+	traceStreamsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_builds_trace_streams_open",
+			Help: "How many job trace streams are open",
+		},
+	)
+	traceStreamFetches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_builds_trace_stream_fetches",
+			Help: "How many times trace streams asked Rails for the trace, by what made them ask",
+		},
+		[]string{"reason"},
+	)
+
+	traceStreamMutex sync.Mutex
+	traceStreamCfg   *traceStream
+
+	traceStreamPathRegex = regexp.MustCompile(`/jobs/([0-9]+)/trace/stream\z`)
+)
+
+func init() {
+	prometheus.MustRegister(
+		traceStreamsOpen,
+		traceStreamFetches,
+	)
+}
+
+type traceStream struct {
+	pollInterval time.Duration
+	maxDuration  time.Duration
+}
+
+// traceUpdate is the part of the answer of Rails the stream needs
+type traceUpdate struct {
+	State    string `json:"state"`
+	Complete bool   `json:"complete"`
+}
+
+// ConfigureTraceStream enables the job trace stream
+func ConfigureTraceStream(cfg config.CITraceStreamConfig) error {
+	s, err := newTraceStream(cfg)
+	if err != nil {
+		return err
+	}
+
+	traceStreamMutex.Lock()
+	defer traceStreamMutex.Unlock()
+	traceStreamCfg = s
+
+	return nil
+}
+
+func newTraceStream(cfg config.CITraceStreamConfig) (*traceStream, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	s := &traceStream{
+		pollInterval: defaultTraceStreamPoll,
+		maxDuration:  defaultTraceStreamMaxTime,
+	}
+	if cfg.PollInterval != nil {
+		if cfg.PollInterval.Duration <= 0 {
+			return nil, errors.New("ci_trace_stream: PollInterval must be positive")
+		}
+		s.pollInterval = cfg.PollInterval.Duration
+	}
+	if cfg.MaxDuration != nil {
+		if cfg.MaxDuration.Duration <= 0 {
+			return nil, errors.New("ci_trace_stream: MaxDuration must be positive")
+		}
+		s.maxDuration = cfg.MaxDuration.Duration
+	}
+
+	return s, nil
+}
+
+func currentTraceStream() *traceStream {
+	traceStreamMutex.Lock()
+	defer traceStreamMutex.Unlock()
+	return traceStreamCfg
+}
+
+// TraceStreamHandler streams the trace of a job, as h serves it on
+// trace.json, to the browser. Requests are passed on to h if the stream is
+// disabled.
+func TraceStreamHandler(h http.Handler, keyWatcher KeyWatcher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := currentTraceStream()
+		m := traceStreamPathRegex.FindStringSubmatch(r.URL.Path)
+		if s == nil || m == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		traceStreamsOpen.Inc()
+		defer traceStreamsOpen.Dec()
+
+		s.serve(h, keyWatcher, w, r, jobTraceKeyPrefix+m[1])
+	})
+}
+
+func (s *traceStream) serve(h http.Handler, keyWatcher KeyWatcher, w http.ResponseWriter, r *http.Request, key string) {
+	state := r.URL.Query().Get("state")
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		state = lastEventID
+	}
+	deadline := time.Now().Add(s.maxDuration)
+	reason := "start"
+	started := false
+
+	for {
+		// Read the key before Rails is asked, so that no change is missed
+		value, _ := redis.GetString(key)
+
+		traceStreamFetches.WithLabelValues(reason).Inc()
+		response := newTraceResponse()
+		h.ServeHTTP(response, traceJSONRequest(r, state))
+
+		if response.status != http.StatusOK {
+			if !started {
+				// Let the browser know that it should not reconnect
+				response.writeTo(w)
+				return
+			}
+			writeEvent(w, "error", "", []byte(fmt.Sprintf(`{"status":%d}`, response.status)))
+			return
+		}
+
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			helper.DisableResponseBuffering(w)
+			w.WriteHeader(http.StatusOK)
+		}
+
+		var update traceUpdate
+		if err := json.Unmarshal(response.body.Bytes(), &update); err != nil {
+			helper.LogError(r, fmt.Errorf("trace stream: %v", err))
+			writeEvent(w, "error", "", []byte(`{"status":502}`))
+			return
+		}
+
+		writeEvent(w, "trace", update.State, response.body.Bytes())
+		if update.Complete {
+			writeEvent(w, "complete", "", []byte("{}"))
+			return
+		}
+		if update.State != "" {
+			state = update.State
+		}
+
+		wait := s.pollInterval
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		if wait <= 0 {
+			return
+		}
+
+		status, err := keyWatcher.WatchKey(key, value, wait)
+		if r.Context().Err() != nil {
+			return
+		}
+
+		switch {
+		case err != nil || status == redis.WatchKeyStatusNoChange:
+			// Notifications are not working. Poll.
+			select {
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+			reason = "poll"
+		case status == redis.WatchKeyStatusTimeout:
+			reason = "poll"
+		default:
+			reason = "notification"
+		}
+
+		if !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// traceJSONRequest asks Rails for the trace after state, with the
+// credentials of the browser
+func traceJSONRequest(r *http.Request, state string) *http.Request {
+	req := helper.CloneRequestWithNewBody(r, nil)
+
+	u := *r.URL
+	u.Path = strings.TrimSuffix(u.Path, "/stream") + ".json"
+	u.RawPath = ""
+	query := url.Values{}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+	req.URL = &u
+	req.RequestURI = ""
+
+	req.Header.Del("Last-Event-ID")
+	// The body is read here, it must not be compressed
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set("Accept", "application/json")
+
+	return req
+}
+
+// writeEvent writes a Server-Sent Event and sends it right away
+func writeEvent(w http.ResponseWriter, event, id string, data []byte) {
+	var buf bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", strings.NewReplacer("\n", "", "\r", "").Replace(id))
+	}
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\r\n"), []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", bytes.TrimRight(line, "\r"))
+	}
+	buf.WriteString("\n")
+
+	w.Write(buf.Bytes())
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,160 @@
+package builds
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+// traceJSON serves trace.json for a trace that grows by one line each time
+// it is asked for
+type traceJSON struct {
+	mu       sync.Mutex
+	lines    int
+	complete int
+	queries  []string
+}
+
+func (j *traceJSON) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if r.URL.Path != "/group/project/-/jobs/1/trace.json" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("Cookie") != "_gitlab_session=session" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	j.queries = append(j.queries, r.URL.RawQuery)
+	j.lines++
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"state":"state-%d","complete":%t,"lines":["line %d"]}`, j.lines, j.lines >= j.complete, j.lines)
+}
+
+func setupTraceStream(t *testing.T, pollInterval time.Duration) {
+	s, err := newTraceStream(config.CITraceStreamConfig{Enabled: true, PollInterval: &config.TomlDuration{Duration: pollInterval}})
+	require.NoError(t, err)
+
+	traceStreamMutex.Lock()
+	traceStreamCfg = s
+	traceStreamMutex.Unlock()
+}
+
+func resetTraceStream() {
+	traceStreamMutex.Lock()
+	traceStreamCfg = nil
+	traceStreamMutex.Unlock()
+}
+
+func streamTrace(h http.Handler, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/group/project/-/jobs/1/trace/stream", nil)
+	r.Header.Set("Cookie", "_gitlab_session=session")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestTraceStreamNotifications(t *testing.T) {
+	setupTraceStream(t, time.Hour)
+	defer resetTraceStream()
+
+	rails := &traceJSON{complete: 3}
+	var watched []string
+	watch := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+		watched = append(watched, key)
+		return redis.WatchKeyStatusSeenChange, nil
+	}
+
+	w := streamTrace(TraceStreamHandler(rails, WatchKeyHandler(watch)), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	require.Equal(t, "no", w.Header().Get("X-Accel-Buffering"))
+	require.True(t, w.Flushed)
+
+	require.Equal(t, strings.Join([]string{
+		"id: state-1\nevent: trace\ndata: {\"state\":\"state-1\",\"complete\":false,\"lines\":[\"line 1\"]}\n",
+		"id: state-2\nevent: trace\ndata: {\"state\":\"state-2\",\"complete\":false,\"lines\":[\"line 2\"]}\n",
+		"id: state-3\nevent: trace\ndata: {\"state\":\"state-3\",\"complete\":true,\"lines\":[\"line 3\"]}\n",
+		"event: complete\ndata: {}\n",
+		"",
+	}, "\n"), w.Body.String())
+
+	require.Equal(t, []string{"", "state=state-1", "state=state-2"}, rails.queries, "only the new trace is asked for")
+	require.Equal(t, []string{"ci:job_trace:1", "ci:job_trace:1"}, watched)
+}
+
+func TestTraceStreamPollsWithoutNotifications(t *testing.T) {
+	setupTraceStream(t, time.Millisecond)
+	defer resetTraceStream()
+
+	rails := &traceJSON{complete: 2}
+	watch := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+		require.Equal(t, time.Millisecond, timeout)
+		return redis.WatchKeyStatusNoChange, fmt.Errorf("not connected")
+	}
+
+	w := streamTrace(TraceStreamHandler(rails, WatchKeyHandler(watch)), nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "event: complete\n")
+	require.Len(t, rails.queries, 2)
+}
+
+func TestTraceStreamResumes(t *testing.T) {
+	setupTraceStream(t, time.Hour)
+	defer resetTraceStream()
+
+	rails := &traceJSON{complete: 1}
+	watch := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+		return redis.WatchKeyStatusSeenChange, nil
+	}
+
+	streamTrace(TraceStreamHandler(rails, WatchKeyHandler(watch)), http.Header{"Last-Event-Id": {"state-7"}})
+	require.Equal(t, []string{"state=state-7"}, rails.queries)
+}
+
+func TestTraceStreamUnauthorized(t *testing.T) {
+	setupTraceStream(t, time.Hour)
+	defer resetTraceStream()
+
+	rails := &traceJSON{complete: 1}
+	watch := func(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+		t.Fatal("must not wait for a trace it may not read")
+		return redis.WatchKeyStatusNoChange, nil
+	}
+
+	w := streamTrace(TraceStreamHandler(rails, WatchKeyHandler(watch)), http.Header{"Cookie": {"_gitlab_session=other"}})
+	require.Equal(t, http.StatusUnauthorized, w.Code, "browsers do not reconnect")
+	require.NotEqual(t, "text/event-stream", w.Header().Get("Content-Type"))
+}
+
+func TestTraceStreamDisabled(t *testing.T) {
+	rails := &traceJSON{complete: 1}
+	w := streamTrace(TraceStreamHandler(rails, nil), nil)
+	require.Equal(t, http.StatusNotFound, w.Code, "Rails does not know the stream")
+}
+
+func TestTraceStreamValidation(t *testing.T) {
+	for _, cfg := range []config.CITraceStreamConfig{
+		{Enabled: true, PollInterval: &config.TomlDuration{}},
+		{Enabled: true, MaxDuration: &config.TomlDuration{Duration: -time.Second}},
+	} {
+		_, err := newTraceStream(cfg)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,466 @@
+package builds
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const traceJobToken = "job-token"
+
+// memoryTraceStore does what the Redis scripts do
+type memoryTraceStore struct {
+	mu   sync.Mutex
+	jobs map[string]*memoryTraceJob
+}
+
+type memoryTraceJob struct {
+	traceState
+	data  []byte
+	since time.Time
+}
+
+func newMemoryTraceStore() *memoryTraceStore {
+	return &memoryTraceStore{jobs: make(map[string]*memoryTraceJob)}
+}
+
+func (s *memoryTraceStore) append(key, tokenHash string, start int64, chunk []byte, now time.Time, maxSize int, maxAge time.Duration) (appendResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.jobs[key]
+	if job == nil || job.tokenHash != tokenHash {
+		return appendResult{action: appendUnknown}, nil
+	}
+	if start != job.length+int64(len(job.data)) {
+		return appendResult{action: appendMismatch}, nil
+	}
+
+	started := job.data == nil
+	if started {
+		job.since = now
+	}
+	job.data = append(job.data, chunk...)
+
+	if len(job.data) >= maxSize || now.Sub(job.since) >= maxAge {
+		result := appendResult{action: appendFlush, length: job.length, data: job.data}
+		job.length += int64(len(job.data))
+		job.data = nil
+		return result, nil
+	}
+
+	return appendResult{
+		action:   appendBuffered,
+		length:   job.length + int64(len(job.data)),
+		status:   job.status,
+		interval: job.interval,
+		started:  started,
+	}, nil
+}
+
+func (s *memoryTraceStore) take(key, tokenHash string) (int64, []byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.jobs[key]
+	if job == nil || job.tokenHash != tokenHash || job.data == nil {
+		return 0, nil, false, nil
+	}
+
+	start, data := job.length, job.data
+	job.length += int64(len(job.data))
+	job.data = nil
+	return start, data, true, nil
+}
+
+func (s *memoryTraceStore) restore(key, tokenHash string, start int64, data []byte, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.jobs[key]
+	if job == nil || job.tokenHash != tokenHash || job.length != start+int64(len(data)) {
+		return false, nil
+	}
+	if job.data == nil {
+		job.since = now
+	}
+	job.length = start
+	job.data = append(append([]byte(nil), data...), job.data...)
+	return true, nil
+}
+
+func (s *memoryTraceStore) remember(key string, state traceState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.jobs[key] = &memoryTraceJob{traceState: state}
+	return nil
+}
+
+func (s *memoryTraceStore) update(key, tokenHash, status, interval string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job := s.jobs[key]; job != nil && job.tokenHash == tokenHash {
+		job.status, job.interval = status, interval
+	}
+	return nil
+}
+
+func (s *memoryTraceStore) forget(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.jobs, key)
+	return nil
+}
+
+func (s *memoryTraceStore) known(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.jobs[key] != nil
+}
+
+// traceRails keeps the trace of job 1 like Rails does
+type traceRails struct {
+	mu       sync.Mutex
+	trace    bytes.Buffer
+	status   string
+	requests []string
+	// failures is how many of the next appends fail
+	failures int
+}
+
+func (rails *traceRails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rails.mu.Lock()
+	defer rails.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	rails.requests = append(rails.requests, r.Method+" "+string(body))
+
+	if r.Method != "PATCH" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Header.Get(jobTokenHeader) != traceJobToken {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if rails.failures > 0 {
+		rails.failures--
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set(jobStatusHeader, rails.status)
+	start, _, ok := parseContentRange(r.Header.Get("Content-Range"))
+	if !ok || start != int64(rails.trace.Len()) {
+		w.Header().Set("Range", fmt.Sprintf("0-%d", rails.trace.Len()))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	rails.trace.Write(body)
+	w.Header().Set("Range", fmt.Sprintf("0-%d", rails.trace.Len()))
+	w.Header().Set(traceUpdateIntervalHeader, "3")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (rails *traceRails) received() (string, []string) {
+	rails.mu.Lock()
+	defer rails.mu.Unlock()
+
+	return rails.trace.String(), append([]string(nil), rails.requests...)
+}
+
+func setupTraceBuffer(t *testing.T, maxSize int, maxAge time.Duration) (*memoryTraceStore, *traceRails) {
+	b, err := newTraceBuffer(config.CITraceBufferConfig{
+		Enabled: true,
+		MaxSize: maxSize,
+		MaxAge:  &config.TomlDuration{Duration: maxAge},
+	}, &config.RedisConfig{})
+	require.NoError(t, err)
+
+	store := newMemoryTraceStore()
+	b.store = store
+
+	traceBufferMutex.Lock()
+	traceBufferCfg = b
+	traceBufferMutex.Unlock()
+
+	return store, &traceRails{status: jobStatusRunning}
+}
+
+func resetTraceBuffer() {
+	traceBufferMutex.Lock()
+	traceBufferCfg = nil
+	traceBufferMutex.Unlock()
+}
+
+func appendTrace(h http.Handler, start int, chunk string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PATCH", "/api/v4/jobs/1/trace", strings.NewReader(chunk))
+	r.Header.Set(jobTokenHeader, traceJobToken)
+	r.Header.Set("Content-Range", fmt.Sprintf("%d-%d", start, start+len(chunk)-1))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func requireAccepted(t *testing.T, w *httptest.ResponseRecorder, length int) {
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Equal(t, fmt.Sprintf("0-%d", length), w.Header().Get("Range"))
+	require.Equal(t, jobStatusRunning, w.Header().Get(jobStatusHeader))
+	require.Equal(t, "3", w.Header().Get(traceUpdateIntervalHeader))
+}
+
+func TestTraceBufferCoalescesAppends(t *testing.T) {
+	_, rails := setupTraceBuffer(t, 10, time.Hour)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+	requireAccepted(t, appendTrace(h, 3, "def"), 6)
+	requireAccepted(t, appendTrace(h, 6, "ghijkl"), 12)
+
+	trace, requests := rails.received()
+	require.Equal(t, "abc", trace, "the first append goes to Rails")
+	require.Len(t, requests, 1)
+
+	requireAccepted(t, appendTrace(h, 12, "mn"), 14)
+
+	trace, requests = rails.received()
+	require.Equal(t, "abcdefghijklmn", trace)
+	require.Equal(t, []string{"PATCH abc", "PATCH defghijklmn"}, requests)
+}
+
+func TestTraceBufferMaxAge(t *testing.T) {
+	_, rails := setupTraceBuffer(t, 1024, 10*time.Millisecond)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+	requireAccepted(t, appendTrace(h, 3, "def"), 6)
+
+	requireReceivedTrace(t, rails, "abcdef", "the buffer is sent to Rails without another append")
+}
+
+func TestTraceBufferJobUpdate(t *testing.T) {
+	store, rails := setupTraceBuffer(t, 1024, time.Hour)
+	defer resetTraceBuffer()
+
+	requireAccepted(t, appendTrace(TraceHandler(rails), 0, "abc"), 3)
+	requireAccepted(t, appendTrace(TraceHandler(rails), 3, "def"), 6)
+
+	update := `{"token":"job-token","state":"success"}`
+	r := httptest.NewRequest("PUT", "/api/v4/jobs/1", strings.NewReader(update))
+	w := httptest.NewRecorder()
+	JobUpdateHandler(rails).ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	trace, requests := rails.received()
+	require.Equal(t, "abcdef", trace)
+	require.Equal(t, []string{"PATCH abc", "PATCH def", "PUT " + update}, requests, "the trace is complete before the job is")
+	require.False(t, store.known(traceBufferKeyPrefix+"1"), "finished jobs are forgotten")
+}
+
+func TestTraceBufferJobUpdateWaitsForTrace(t *testing.T) {
+	store, rails := setupTraceBuffer(t, 1024, time.Hour)
+	defer resetTraceBuffer()
+
+	requireAccepted(t, appendTrace(TraceHandler(rails), 0, "abc"), 3)
+	requireAccepted(t, appendTrace(TraceHandler(rails), 3, "def"), 6)
+
+	update := `{"token":"job-token","state":"success"}`
+	sendUpdate := func() int {
+		r := httptest.NewRequest("PUT", "/api/v4/jobs/1", strings.NewReader(update))
+		w := httptest.NewRecorder()
+		JobUpdateHandler(rails).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	rails.failures = 1
+	require.Equal(t, http.StatusServiceUnavailable, sendUpdate())
+	trace, requests := rails.received()
+	require.Equal(t, "abc", trace)
+	require.Equal(t, []string{"PATCH abc", "PATCH def"}, requests, "the update waits for the trace")
+	require.True(t, store.known(traceBufferKeyPrefix+"1"))
+
+	require.Equal(t, http.StatusOK, sendUpdate())
+	trace, requests = rails.received()
+	require.Equal(t, "abcdef", trace)
+	require.Equal(t, []string{"PATCH abc", "PATCH def", "PATCH def", "PUT " + update}, requests)
+	require.False(t, store.known(traceBufferKeyPrefix+"1"))
+}
+
+func TestTraceBufferMaxAgeRetries(t *testing.T) {
+	_, rails := setupTraceBuffer(t, 1024, 10*time.Millisecond)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+	rails.mu.Lock()
+	rails.failures = 2
+	rails.mu.Unlock()
+	requireAccepted(t, appendTrace(h, 3, "def"), 6)
+
+	requireReceivedTrace(t, rails, "abcdef", "the batch is sent again until Rails takes it")
+}
+
+func TestTraceBufferRejectedBatch(t *testing.T) {
+	store, rails := setupTraceBuffer(t, 4, time.Hour)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+	requireAccepted(t, appendTrace(h, 3, "d"), 4)
+
+	// Something else appended to the trace in the meantime
+	rails.mu.Lock()
+	rails.trace.WriteString("X")
+	rails.mu.Unlock()
+
+	w := appendTrace(h, 4, "efg")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	require.Equal(t, "0-4", w.Header().Get("Range"), "the runner learns the length Rails has")
+	require.False(t, store.known(traceBufferKeyPrefix+"1"))
+
+	requireAccepted(t, appendTrace(h, 4, "defg"), 8)
+	trace, _ := rails.received()
+	require.Equal(t, "abcXdefg", trace, "the runner sends the rest again")
+}
+
+func TestTraceBufferMismatch(t *testing.T) {
+	_, rails := setupTraceBuffer(t, 1024, time.Hour)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+	requireAccepted(t, appendTrace(h, 3, "def"), 6)
+
+	// The runner sends from further back than acknowledged
+	w := appendTrace(h, 4, "ef")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	require.Equal(t, "0-6", w.Header().Get("Range"), "the buffer is sent to Rails first")
+}
+
+func TestTraceBufferStoppedJob(t *testing.T) {
+	store, rails := setupTraceBuffer(t, 1024, time.Hour)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	rails.status = "canceled"
+	w := appendTrace(h, 0, "abc")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Equal(t, "canceled", w.Header().Get(jobStatusHeader))
+	require.False(t, store.known(traceBufferKeyPrefix+"1"), "only running jobs are buffered")
+
+	w = appendTrace(h, 3, "def")
+	require.Equal(t, "canceled", w.Header().Get(jobStatusHeader), "the runner hears from Rails")
+}
+
+func TestTraceBufferUnknownToken(t *testing.T) {
+	_, rails := setupTraceBuffer(t, 1024, time.Hour)
+	defer resetTraceBuffer()
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+
+	r := httptest.NewRequest("PATCH", "/api/v4/jobs/1/trace", strings.NewReader("def"))
+	r.Header.Set(jobTokenHeader, "other-token")
+	r.Header.Set("Content-Range", "3-5")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusForbidden, w.Code, "Rails decides about other tokens")
+}
+
+func TestTraceBufferDisabled(t *testing.T) {
+	rails := &traceRails{status: jobStatusRunning}
+	h := TraceHandler(rails)
+
+	requireAccepted(t, appendTrace(h, 0, "abc"), 3)
+	requireAccepted(t, appendTrace(h, 3, "def"), 6)
+
+	_, requests := rails.received()
+	require.Len(t, requests, 2)
+}
+
+func TestTraceBufferValidation(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   config.CITraceBufferConfig
+		redis *config.RedisConfig
+	}{
+		{cfg: config.CITraceBufferConfig{Enabled: true}},
+		{cfg: config.CITraceBufferConfig{Enabled: true, MaxSize: -1}, redis: &config.RedisConfig{}},
+		{cfg: config.CITraceBufferConfig{Enabled: true, MaxAge: &config.TomlDuration{}}, redis: &config.RedisConfig{}},
+	} {
+		_, err := newTraceBuffer(tc.cfg, tc.redis)
+		require.Error(t, err)
+	}
+
+	b, err := newTraceBuffer(config.CITraceBufferConfig{}, nil)
+	require.NoError(t, err)
+	require.Nil(t, b, "disabled")
+}
+
+func TestRedisTraceStoreAppend(t *testing.T) {
+	conn := redigomock.NewConn()
+	redis.Configure(&config.RedisConfig{}, func(_ *config.RedisConfig, _ bool) func() (redigo.Conn, error) {
+		return func() (redigo.Conn, error) {
+			return conn, nil
+		}
+	})
+
+	store := redisTraceStore{}
+
+	conn.GenericCommand("EVALSHA").Expect([]interface{}{[]byte("buffered"), []byte("6"), []byte("running"), []byte("3"), int64(1)})
+	result, err := store.append("key", "hash", 3, []byte("def"), time.Now(), 1024, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, appendResult{action: appendBuffered, length: 6, status: "running", interval: "3", started: true}, result)
+
+	conn.Clear()
+	conn.GenericCommand("EVALSHA").Expect([]interface{}{[]byte("flush"), []byte("3"), []byte("defg")})
+	result, err = store.append("key", "hash", 6, []byte("g"), time.Now(), 4, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, appendResult{action: appendFlush, length: 3, data: []byte("defg")}, result)
+
+	conn.Clear()
+	conn.GenericCommand("EVALSHA").Expect(nil)
+	_, _, ok, err := store.take("key", "hash")
+	require.NoError(t, err)
+	require.False(t, ok, "nothing buffered")
+
+	conn.Clear()
+	conn.GenericCommand("EVALSHA").Expect(int64(1))
+	ok, err = store.restore("key", "hash", 3, []byte("defg"), time.Now())
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+// requireReceivedTrace waits for Rails to have received trace, which the
+// buffer sends in the background
+func requireReceivedTrace(t *testing.T, rails *traceRails, trace string, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		received, _ := rails.received()
+		if received == trace || time.Now().After(deadline) {
+			require.Equal(t, trace, received, msg)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Package cable limits the ActionCable websockets that are proxied to the
+cable backend, and counts their messages.
+
+The websockets are proxied by httputil.ReverseProxy, which copies the bytes
+of the upgraded connection as they are. The client connection is wrapped to
+follow the websocket frames going through it.
+*/
+package cable
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const closeMessageTooBig = 1009
+
+var (
+	connectionsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_cable_connections_open",
+			Help: "How many ActionCable websockets are open",
+		},
+	)
+	connectionsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_cable_connections_rejected",
+			Help: "How many ActionCable websockets were refused or closed because of a limit",
+		},
+		[]string{"reason"},
+	)
+	messages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_cable_messages",
+			Help: "How many ActionCable messages were proxied, sent by the client (in) or the backend (out)",
+		},
+		[]string{"direction"},
+	)
+
+	messagesIn  = messages.WithLabelValues("in")
+	messagesOut = messages.WithLabelValues("out")
+)
+
+func init() {
+	prometheus.MustRegister(connectionsOpen, connectionsRejected, messages)
+}
+
+type limiter struct {
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func (l *limiter) acquire(ip string) bool {
+	if l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *limiter) release(ip string) {
+	if l.max <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// Handler applies the limits of cfg to the websockets proxied by next
+func Handler(next http.Handler, cfg config.CableConfig) http.Handler {
+	l := &limiter{max: cfg.MaxConnectionsPerIP, conns: make(map[string]int)}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !l.acquire(ip) {
+			connectionsRejected.WithLabelValues("connections_per_ip").Inc()
+			helper.HTTPError(w, r, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer l.release(ip)
+
+		hw := &hijackWriter{ResponseWriter: w, maxMessageSize: cfg.MaxMessageSize}
+		next.ServeHTTP(hw, r)
+
+		// The reverse proxy returns once the websocket is closed
+		if hw.hijacked {
+			connectionsOpen.Dec()
+		}
+	})
+}
+
+// RemoteAddr has been fixed up for trusted proxies already
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type hijackWriter struct {
+	http.ResponseWriter
+	maxMessageSize int64
+	hijacked       bool
+}
+
+func (h *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rawConn, brw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h.hijacked = true
+	connectionsOpen.Inc()
+
+	c := &conn{Conn: rawConn}
+	c.in = frameParser{maxMessageSize: h.maxMessageSize, onMessage: messagesIn.Inc}
+	c.out = frameParser{onMessage: messagesOut.Inc}
+	return c, brw, nil
+}
+
+func (h *hijackWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// conn follows the frames read from and written to the client
+type conn struct {
+	net.Conn
+	in frameParser
+
+	writeMu sync.Mutex
+	out     frameParser
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if parseErr := c.in.feed(p[:n]); parseErr != nil {
+		connectionsRejected.WithLabelValues("message_size").Inc()
+		c.closeTooBig()
+		return 0, parseErr
+	}
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.Conn.Write(p)
+	c.out.feed(p[:n])
+	return n, err
+}
+
+// closeTooBig tells the client why its connection is closed, unless the
+// backend is in the middle of sending a frame
+func (c *conn) closeTooBig() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.out.atBoundary() {
+		c.Conn.Write(closeFrame(closeMessageTooBig, "message too big"))
+	}
+	c.Conn.Close()
+}
@@ -0,0 +1,133 @@
+package cable
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func startCable(t *testing.T, cfg config.CableConfig) (string, func()) {
+	upgrader := &websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+
+	backendURL, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	ws := httptest.NewServer(Handler(httputil.NewSingleHostReverseProxy(backendURL), cfg))
+
+	return "ws" + strings.TrimPrefix(ws.URL, "http"), func() {
+		ws.Close()
+		backend.Close()
+	}
+}
+
+func TestCableCountsMessages(t *testing.T) {
+	wsURL, stop := startCable(t, config.CableConfig{})
+	defer stop()
+
+	in, out, open := testutil.ToFloat64(messagesIn), testutil.ToFloat64(messagesOut), testutil.ToFloat64(connectionsOpen)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"command":"subscribe"}`)))
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, `{"command":"subscribe"}`, string(data))
+	}
+
+	require.Equal(t, in+3, testutil.ToFloat64(messagesIn))
+	require.Equal(t, out+3, testutil.ToFloat64(messagesOut))
+	require.Equal(t, open+1, testutil.ToFloat64(connectionsOpen))
+}
+
+func TestCableConnectionsPerIP(t *testing.T) {
+	wsURL, stop := startCable(t, config.CableConfig{MaxConnectionsPerIP: 1})
+	defer stop()
+
+	first, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	first.Close()
+	require.Eventually(t, func() bool {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond, "closed connections should be released")
+}
+
+func TestCableMessageSize(t *testing.T) {
+	wsURL, stop := startCable(t, config.CableConfig{MaxMessageSize: 16})
+	defer stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("small")))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "small", string(data))
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, closeMessageTooBig), "expected close 1009, got %v", err)
+}
+
+func TestFrameParser(t *testing.T) {
+	count := 0
+	f := &frameParser{maxMessageSize: 300, onMessage: func() { count++ }}
+
+	// Masked text frame with a 16 bit length, fed a byte at a time
+	frame := append([]byte{0x81, maskBit | 126, 0x01, 0x00, 1, 2, 3, 4}, make([]byte, 256)...)
+	for _, b := range frame {
+		require.NoError(t, f.feed([]byte{b}))
+	}
+	require.Equal(t, 1, count)
+	require.True(t, f.atBoundary())
+
+	// A fragmented message with a ping in between
+	require.NoError(t, f.feed([]byte{0x01, 2, 'a', 'b'}))
+	require.NoError(t, f.feed([]byte{0x89, 0}))
+	require.NoError(t, f.feed([]byte{0x80, 1, 'c'}))
+	require.Equal(t, 2, count)
+
+	// Fragments add up to more than the limit
+	require.NoError(t, f.feed(append([]byte{0x01, 126, 0x01, 0x00}, make([]byte, 256)...)))
+	require.Equal(t, errMessageTooBig, f.feed([]byte{0x80, 126, 0x01, 0x00}))
+}
@@ -0,0 +1,121 @@
+package cable
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// See https://tools.ietf.org/html/rfc6455#section-5.2 for the framing
+
+const (
+	finBit         = 0x80
+	opcodeMask     = 0x0f
+	controlOpcode  = 0x08
+	maskBit        = 0x80
+	payloadLenMask = 0x7f
+	maxHeaderSize  = 2 + 8 + 4
+)
+
+var errMessageTooBig = errors.New("websocket message too big")
+
+// frameParser follows the frames in one direction of a websocket
+// connection without buffering them. It calls onMessage for every complete
+// data message.
+type frameParser struct {
+	maxMessageSize int64
+	onMessage      func()
+
+	header      [maxHeaderSize]byte
+	headerLen   int
+	remaining   uint64
+	messageSize uint64
+}
+
+// atBoundary is true between frames
+func (f *frameParser) atBoundary() bool {
+	return f.headerLen == 0 && f.remaining == 0
+}
+
+func (f *frameParser) feed(p []byte) error {
+	for len(p) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		f.header[f.headerLen] = p[0]
+		f.headerLen++
+		p = p[1:]
+
+		if f.headerLen < 2 || f.headerLen < f.headerSize() {
+			continue
+		}
+
+		if err := f.endOfHeader(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *frameParser) headerSize() int {
+	size := 2
+	switch f.header[1] & payloadLenMask {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if f.header[1]&maskBit != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (f *frameParser) endOfHeader() error {
+	fin := f.header[0]&finBit != 0
+	control := f.header[0]&opcodeMask&controlOpcode != 0
+
+	length := uint64(f.header[1] & payloadLenMask)
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(f.header[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(f.header[2:10])
+	}
+
+	f.headerLen = 0
+	f.remaining = length
+
+	// Control frames may come between the fragments of a message
+	if control {
+		return nil
+	}
+
+	f.messageSize += length
+	if f.maxMessageSize > 0 && f.messageSize > uint64(f.maxMessageSize) {
+		return errMessageTooBig
+	}
+
+	if fin {
+		f.messageSize = 0
+		if f.onMessage != nil {
+			f.onMessage()
+		}
+	}
+
+	return nil
+}
+
+// closeFrame is an unmasked close frame, as sent by servers
+func closeFrame(code uint16, reason string) []byte {
+	frame := []byte{finBit | controlOpcode, byte(2 + len(reason)), 0, 0}
+	binary.BigEndian.PutUint16(frame[2:], code)
+	return append(frame, reason...)
+}
@@ -1,15 +1,18 @@
 package channel
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"gitlab.com/gitlab-org/labkit/correlation"
 	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
@@ -21,14 +24,17 @@ var (
 	BrowserPingInterval      = 30 * time.Second
 )
 
-func Handler(myAPI *api.API) http.Handler {
+func Handler(myAPI *api.API, cfg config.ChannelConfig) http.Handler {
 	return myAPI.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, a *api.Response) {
 		if err := a.Channel.Validate(); err != nil {
 			helper.Fail500(w, r, err)
 			return
 		}
 
-		proxy := NewProxy(2) // two stoppers: auth checker, max time
+		done := make(chan struct{})
+		defer close(done)
+
+		proxy := NewProxy(3) // three stoppers: auth checker, max time, idle time
 		checker := NewAuthChecker(
 			authCheckFunc(myAPI, r, "authorize"),
 			a.Channel,
@@ -36,7 +42,10 @@ func Handler(myAPI *api.API) http.Handler {
 		)
 		defer checker.Close()
 		go checker.Loop(ReauthenticationInterval)
-		go closeAfterMaxTime(proxy, a.Channel.MaxSessionTime)
+		go closeAfterMaxTime(proxy, maxSessionTime(a.Channel.MaxSessionTime, cfg), done)
+		if cfg.IdleTimeout != nil {
+			go closeWhenIdle(proxy, cfg.IdleTimeout.Duration, done)
+		}
 
 		ProxyChannel(w, r, a.Channel, proxy)
 	}, "authorize")
@@ -52,11 +61,28 @@ func ProxyChannel(w http.ResponseWriter, r *http.Request, settings *api.ChannelS
 	defer server.UnderlyingConn().Close()
 	serverAddr := server.UnderlyingConn().RemoteAddr().String()
 
+	// Sessions that must be recorded are refused if recording fails
+	var rec *recorder
+	if settings.RecordingToken != "" {
+		rec, err = newRecorder(settings.RecordingToken, r.URL.Path)
+		if err != nil {
+			helper.Fail500(w, r, fmt.Errorf("Channel: start recording: %v", err))
+			return
+		}
+		server = &recordingConnection{Connection: server, recorder: rec, kind: recordingEventOutput}
+	}
+
 	client, err := upgradeClient(w, r)
 	if err != nil {
+		if rec != nil {
+			rec.discard()
+		}
 		log.ContextLogger(r.Context()).WithError(err).Print("Channel: upgrading client to websocket failed")
 		return
 	}
+	if rec != nil {
+		client = &recordingConnection{Connection: client, recorder: rec, kind: recordingEventInput}
+	}
 
 	// Regularly send ping messages to the browser to keep the websocket from
 	// being timed out by intervening proxies.
@@ -74,8 +100,26 @@ func ProxyChannel(w http.ResponseWriter, r *http.Request, settings *api.ChannelS
 
 	defer logEntry.Print("Channel: finished proxying")
 
-	if err := proxy.Serve(server, client, serverAddr, clientAddr); err != nil {
+	sessionsOpen.Inc()
+	err = proxy.Serve(server, client, serverAddr, clientAddr)
+	sessionsOpen.Dec()
+	sessionsClosed.WithLabelValues(closeReason(err)).Inc()
+	if err != nil {
 		logEntry.WithError(err).Print("Channel: error proxying")
+		sendClose(client, websocket.CloseNormalClosure, err)
+		sendClose(server, websocket.CloseNormalClosure, err)
+	}
+
+	if rec != nil {
+		// Don't keep the session open while uploading
+		client.UnderlyingConn().Close()
+		server.UnderlyingConn().Close()
+
+		// The request context ends with the connection
+		ctx := correlation.ContextWithCorrelation(context.Background(), correlation.ExtractFromContext(r.Context()))
+		if err := rec.upload(ctx); err != nil {
+			logEntry.WithError(err).Error("Channel: uploading recording failed")
+		}
 	}
 }
 
@@ -118,15 +162,3 @@ func connectToServer(settings *api.ChannelSettings, r *http.Request) (Connection
 
 	return Wrap(conn, conn.Subprotocol()), nil
 }
-
-func closeAfterMaxTime(proxy *Proxy, maxSessionTime int) {
-	if maxSessionTime == 0 {
-		return
-	}
-
-	<-time.After(time.Duration(maxSessionTime) * time.Second)
-	proxy.StopCh <- fmt.Errorf(
-		"connection closed: session time greater than maximum time allowed - %v seconds",
-		maxSessionTime,
-	)
-}
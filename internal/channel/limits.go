@@ -0,0 +1,124 @@
+package channel
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+var (
+	IdleCheckInterval = 10 * time.Second
+
+	ErrIdleTimeout = errors.New("connection closed: session idle for too long")
+
+	sessionsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_channel_sessions_open",
+			Help: "How many channel sessions are being proxied",
+		},
+	)
+	sessionsClosed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_channel_sessions_closed",
+			Help: "How many channel sessions were closed, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sessionsOpen, sessionsClosed)
+}
+
+type maxTimeError struct {
+	maxSessionTime time.Duration
+}
+
+func (e *maxTimeError) Error() string {
+	return "connection closed: session time greater than maximum time allowed - " + e.maxSessionTime.String()
+}
+
+// maxSessionTime is the shorter of the limits of Rails and of the config,
+// or 0 if neither is set
+func maxSessionTime(railsSeconds int, cfg config.ChannelConfig) time.Duration {
+	max := time.Duration(railsSeconds) * time.Second
+	if cfg.MaxDuration != nil && (max == 0 || cfg.MaxDuration.Duration < max) {
+		max = cfg.MaxDuration.Duration
+	}
+	return max
+}
+
+func closeAfterMaxTime(proxy *Proxy, maxSessionTime time.Duration, done <-chan struct{}) {
+	if maxSessionTime == 0 {
+		return
+	}
+
+	select {
+	case <-time.After(maxSessionTime):
+		proxy.StopCh <- &maxTimeError{maxSessionTime}
+	case <-done:
+	}
+}
+
+func closeWhenIdle(proxy *Proxy, idleTimeout time.Duration, done <-chan struct{}) {
+	if idleTimeout == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(IdleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if proxy.idleFor() >= idleTimeout {
+				proxy.StopCh <- ErrIdleTimeout
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *Proxy) touch() {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+}
+
+func (p *Proxy) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+}
+
+func closeReason(err error) string {
+	switch err.(type) {
+	case *maxTimeError:
+		return "max_duration"
+	}
+
+	switch err {
+	case ErrIdleTimeout:
+		return "idle_timeout"
+	case ErrAuthChanged:
+		return "auth_changed"
+	}
+
+	return "connection"
+}
+
+// sendClose tells a websocket peer why the session ends. The connection may
+// already be broken, so errors are ignored.
+func sendClose(conn Connection, code int, err error) {
+	reason := err.Error()
+	// Control frames carry at most 125 bytes, 2 of which are the code
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	deadline := time.Now().Add(time.Second)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+}
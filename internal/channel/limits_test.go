@@ -0,0 +1,69 @@
+package channel
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestMaxSessionTime(t *testing.T) {
+	minute := &config.TomlDuration{Duration: time.Minute}
+
+	require.Equal(t, time.Duration(0), maxSessionTime(0, config.ChannelConfig{}))
+	require.Equal(t, 30*time.Second, maxSessionTime(30, config.ChannelConfig{}))
+	require.Equal(t, time.Minute, maxSessionTime(0, config.ChannelConfig{MaxDuration: minute}))
+	require.Equal(t, time.Minute, maxSessionTime(600, config.ChannelConfig{MaxDuration: minute}))
+	require.Equal(t, 30*time.Second, maxSessionTime(30, config.ChannelConfig{MaxDuration: minute}))
+}
+
+func TestCloseWhenIdle(t *testing.T) {
+	defer func(interval time.Duration) { IdleCheckInterval = interval }(IdleCheckInterval)
+	IdleCheckInterval = 10 * time.Millisecond
+
+	proxy := NewProxy(1)
+	done := make(chan struct{})
+	defer close(done)
+	go closeWhenIdle(proxy, 100*time.Millisecond, done)
+
+	// Activity keeps the session open
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		proxy.touch()
+	}
+	require.Empty(t, proxy.StopCh)
+
+	select {
+	case err := <-proxy.StopCh:
+		require.Equal(t, ErrIdleTimeout, err)
+		require.Equal(t, "idle_timeout", closeReason(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not stopped")
+	}
+}
+
+func TestCloseAfterMaxTime(t *testing.T) {
+	proxy := NewProxy(1)
+	done := make(chan struct{})
+	defer close(done)
+	go closeAfterMaxTime(proxy, 10*time.Millisecond, done)
+
+	err := <-proxy.StopCh
+	require.Equal(t, "max_duration", closeReason(err))
+}
+
+func TestSendClose(t *testing.T) {
+	conn := fake(0, nil, nil)
+	sendClose(conn, websocket.CloseNormalClosure, ErrIdleTimeout)
+
+	require.Equal(t, websocket.CloseMessage, conn.mt)
+	require.Equal(t, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ErrIdleTimeout.Error()), conn.data)
+
+	sendClose(conn, websocket.CloseNormalClosure, errors.New(strings.Repeat("x", 200)))
+	require.Len(t, conn.data, 125, "control frames are limited to 125 bytes")
+}
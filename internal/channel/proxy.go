@@ -21,13 +21,18 @@ type Connection interface {
 
 type Proxy struct {
 	StopCh chan error
+
+	// lastActivity is the time in nanoseconds data was last proxied
+	lastActivity int64
 }
 
 // stoppers is the number of goroutines that may attempt to call Stop()
 func NewProxy(stoppers int) *Proxy {
-	return &Proxy{
+	p := &Proxy{
 		StopCh: make(chan error, stoppers+2), // each proxy() call is a stopper
 	}
+	p.touch()
+	return p
 }
 
 func (p *Proxy) Serve(upstream, downstream Connection, upstreamAddr, downstreamAddr string) error {
@@ -52,5 +57,9 @@ func (p *Proxy) proxy(to, from Connection, toAddr, fromAddr string) {
 			p.StopCh <- fmt.Errorf("writing to %s: %s", toAddr, err)
 			break
 		}
+
+		if isData(messageType) {
+			p.touch()
+		}
 	}
 }
@@ -0,0 +1,258 @@
+package channel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+)
+
+// Sessions are recorded in the asciicast v2 format of asciinema:
+// https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+
+const (
+	recordingDefaultWidth  = 80
+	recordingDefaultHeight = 24
+	recordingEventOutput   = "o"
+	recordingEventInput    = "i"
+	recordingTruncated     = "\r\n[recording truncated]\r\n"
+)
+
+var (
+	RecordingUploadTimeout = 5 * time.Minute
+	// RecordingMaxSize is the size in bytes at which recordings stop when
+	// the token sets no max_size
+	RecordingMaxSize int64 = 100 * 1024 * 1024
+
+	recordings = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_channel_recordings",
+			Help: "How many channel sessions were recorded, by the result of the upload",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(recordings)
+}
+
+// RecordingClaims are signed by Rails to request a recording of a session
+type RecordingClaims struct {
+	// PutURL is a presigned URL the recording is uploaded to
+	PutURL string `json:"put_url"`
+	// PutHeaders are sent along with the upload
+	PutHeaders map[string]string `json:"put_headers,omitempty"`
+	// Width and Height of the terminal, 80x24 if not set
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// MaxSize is the size in bytes at which the recording stops,
+	// RecordingMaxSize if not set
+	MaxSize int64 `json:"max_size,omitempty"`
+	jwt.StandardClaims
+}
+
+type recordingHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Title     string `json:"title,omitempty"`
+}
+
+type recorder struct {
+	claims RecordingClaims
+	start  time.Time
+
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	size      int64
+	err       error
+	finished  bool
+	truncated bool
+}
+
+func newRecorder(token, title string) (*recorder, error) {
+	claims := RecordingClaims{}
+	if err := secret.ParseJWT(token, &claims); err != nil {
+		return nil, fmt.Errorf("recording token: %v", err)
+	}
+	if claims.PutURL == "" {
+		return nil, errors.New("recording token: no upload URL")
+	}
+	if claims.Width <= 0 || claims.Height <= 0 {
+		claims.Width, claims.Height = recordingDefaultWidth, recordingDefaultHeight
+	}
+	if claims.MaxSize <= 0 {
+		claims.MaxSize = RecordingMaxSize
+	}
+
+	// Presigned URLs need the size of the upload, so the recording is kept
+	// on disk until the session ends
+	file, err := ioutil.TempFile("", "channel-recording")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &recorder{claims: claims, start: time.Now(), file: file, w: bufio.NewWriter(file)}
+	r.writeLine(recordingHeader{
+		Version:   2,
+		Width:     claims.Width,
+		Height:    claims.Height,
+		Timestamp: r.start.Unix(),
+		Title:     title,
+	})
+	if r.err != nil {
+		r.discard()
+		return nil, r.err
+	}
+
+	return r, nil
+}
+
+// record adds an event to the recording. Non-UTF-8 data is replaced by
+// U+FFFD, as asciicast events are JSON strings. Once the recording reaches
+// its maximum size, a last event says it was truncated and the rest of the
+// session is not recorded.
+func (r *recorder) record(kind string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.truncated {
+		return
+	}
+
+	elapsed := time.Since(r.start).Seconds()
+	line, ok := r.marshal([]interface{}{elapsed, kind, string(data)})
+	if !ok {
+		return
+	}
+
+	if r.size+int64(len(line)) > r.claims.MaxSize {
+		r.truncated = true
+		line, ok = r.marshal([]interface{}{elapsed, recordingEventOutput, recordingTruncated})
+		if !ok {
+			return
+		}
+	}
+
+	r.write(line)
+}
+
+func (r *recorder) writeLine(v interface{}) {
+	if line, ok := r.marshal(v); ok {
+		r.write(line)
+	}
+}
+
+func (r *recorder) marshal(v interface{}) ([]byte, bool) {
+	if r.err != nil || r.finished {
+		return nil, false
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		r.err = err
+		return nil, false
+	}
+	return append(line, '\n'), true
+}
+
+func (r *recorder) write(line []byte) {
+	n, err := r.w.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		r.err = err
+	}
+}
+
+// upload stores the recording in object storage and removes it from disk
+func (r *recorder) upload(ctx context.Context) error {
+	defer r.discard()
+
+	if err := r.finish(); err != nil {
+		recordings.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	fi, err := r.file.Stat()
+	if err != nil {
+		recordings.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RecordingUploadTimeout)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+	object, err := objectstore.NewObject(ctx, r.claims.PutURL, "", r.claims.PutHeaders, deadline, fi.Size())
+	if err != nil {
+		recordings.WithLabelValues("failed").Inc()
+		return err
+	}
+
+	_, copyErr := io.Copy(object, r.file)
+	if err := object.Close(); err != nil || copyErr != nil {
+		recordings.WithLabelValues("failed").Inc()
+		if copyErr != nil {
+			return copyErr
+		}
+		return err
+	}
+
+	if r.truncated {
+		recordings.WithLabelValues("truncated").Inc()
+	} else {
+		recordings.WithLabelValues("uploaded").Inc()
+	}
+	return nil
+}
+
+func (r *recorder) finish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.finished = true
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	_, err := r.file.Seek(0, 0)
+	return err
+}
+
+func (r *recorder) discard() {
+	r.file.Close()
+	os.Remove(r.file.Name())
+}
+
+// recordingConnection records the data read from a connection
+type recordingConnection struct {
+	Connection
+	recorder *recorder
+	kind     string
+}
+
+func (c *recordingConnection) ReadMessage() (int, []byte, error) {
+	mt, data, err := c.Connection.ReadMessage()
+	if err == nil && isData(mt) {
+		c.recorder.record(c.kind, data)
+	}
+	return mt, data, err
+}
@@ -0,0 +1,103 @@
+package channel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func recordingToken(t *testing.T, claims RecordingClaims) string {
+	token, err := secret.JWTTokenString(claims)
+	require.NoError(t, err)
+	return token
+}
+
+func TestRecorderRejectsInvalidToken(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	_, err := newRecorder("not a token", "")
+	require.Error(t, err)
+
+	_, err = newRecorder(recordingToken(t, RecordingClaims{}), "")
+	require.Error(t, err, "no upload URL")
+}
+
+func TestRecorderUpload(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	rec, err := newRecorder(recordingToken(t, RecordingClaims{PutURL: ts.URL + test.ObjectPath}), "/terminal.ws")
+	require.NoError(t, err)
+
+	rec.record(recordingEventInput, []byte("ls\r"))
+	rec.record(recordingEventOutput, []byte("file\r\n"))
+	require.NoError(t, rec.finish())
+
+	data, err := ioutil.ReadAll(rec.file)
+	require.NoError(t, err)
+	_, err = rec.file.Seek(0, 0)
+	require.NoError(t, err)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	require.True(t, scanner.Scan())
+	var header recordingHeader
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &header))
+	require.Equal(t, recordingHeader{Version: 2, Width: 80, Height: 24, Timestamp: header.Timestamp, Title: "/terminal.ws"}, header)
+
+	for _, expected := range [][2]string{{"i", "ls\r"}, {"o", "file\r\n"}} {
+		require.True(t, scanner.Scan())
+		var event []interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		require.Len(t, event, 3)
+		require.Equal(t, expected[0], event[1])
+		require.Equal(t, expected[1], event[2])
+	}
+	require.False(t, scanner.Scan())
+
+	name := rec.file.Name()
+	require.NoError(t, rec.upload(context.Background()))
+
+	sum := md5.Sum(data)
+	require.Equal(t, hex.EncodeToString(sum[:]), osStub.GetObjectMD5(test.ObjectPath))
+
+	_, err = os.Stat(name)
+	require.True(t, os.IsNotExist(err), "recording should be removed from disk")
+}
+
+func TestRecorderMaxSize(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	rec, err := newRecorder(recordingToken(t, RecordingClaims{PutURL: "http://example.com/recording", MaxSize: 200}), "")
+	require.NoError(t, err)
+	defer rec.discard()
+
+	for i := 0; i < 10; i++ {
+		rec.record(recordingEventOutput, bytes.Repeat([]byte("x"), 40))
+	}
+	require.NoError(t, rec.finish())
+	require.True(t, rec.truncated)
+
+	data, err := ioutil.ReadAll(rec.file)
+	require.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	require.True(t, len(lines) < 10, "later events are not recorded")
+	require.True(t, len(data)-len(lines[len(lines)-1]) <= 200, "only the last event goes past the maximum size")
+
+	var event []interface{}
+	require.NoError(t, json.Unmarshal(lines[len(lines)-1], &event))
+	require.Equal(t, recordingTruncated, event[2])
+}
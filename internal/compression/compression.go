@@ -0,0 +1,241 @@
+/*
+Package compression compresses the responses Rails didn't compress, like
+large API responses in JSON, with brotli or gzip, whichever the client
+prefers.
+
+A response is compressed when its media type is allowed, it is at least
+MinSize bytes long and nothing compressed it before. Small responses are
+held back until MinSize bytes are written, so the decision can be made
+without a Content-Length.
+*/
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	defaultMinSize = 1024
+	defaultLevel   = 6
+	// defaultBrotliLevel compresses better than gzip at about its speed
+	defaultBrotliLevel = 4
+)
+
+type settings struct {
+	enabled        bool
+	minSize        int
+	level          int
+	brotliLevel    int
+	contentTypes   map[string]bool
+	disabledRoutes []*regexp.Regexp
+}
+
+var (
+	mu      sync.RWMutex
+	current settings
+
+	encoderPools = map[string]*sync.Pool{
+		"br":   {},
+		"gzip": {},
+	}
+
+	compressedResponses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_compressed_responses",
+			Help: "How many responses gitlab-workhorse compressed",
+		},
+	)
+	compressionBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_compression_bytes",
+			Help: "How many bytes of responses gitlab-workhorse compressed, before and after compression",
+		},
+		[]string{"stage"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(compressedResponses)
+	prometheus.MustRegister(compressionBytes)
+}
+
+// Configure sets which responses are compressed
+func Configure(cfg config.CompressionConfig) error {
+	s := settings{
+		enabled:      cfg.Enabled,
+		minSize:      defaultMinSize,
+		level:        defaultLevel,
+		brotliLevel:  defaultBrotliLevel,
+		contentTypes: make(map[string]bool),
+	}
+
+	if cfg.MinSize < 0 {
+		return fmt.Errorf("MinSize must not be negative")
+	}
+	if cfg.MinSize > 0 {
+		s.minSize = cfg.MinSize
+	}
+	if cfg.Level != 0 {
+		if cfg.Level < gzip.BestSpeed || cfg.Level > gzip.BestCompression {
+			return fmt.Errorf("Level must be between %d and %d", gzip.BestSpeed, gzip.BestCompression)
+		}
+		s.level = cfg.Level
+	}
+	if cfg.BrotliLevel != 0 {
+		if cfg.BrotliLevel < 1 || cfg.BrotliLevel > brotli.BestCompression {
+			return fmt.Errorf("BrotliLevel must be between 1 and %d", brotli.BestCompression)
+		}
+		s.brotliLevel = cfg.BrotliLevel
+	}
+
+	contentTypes := cfg.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = []string{"application/json"}
+	}
+	for _, contentType := range contentTypes {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return fmt.Errorf("ContentTypes: %q: %v", contentType, err)
+		}
+		s.contentTypes[mediaType] = true
+	}
+
+	for _, route := range cfg.DisabledRoutes {
+		regex, err := regexp.Compile(route)
+		if err != nil {
+			return fmt.Errorf("DisabledRoutes: %v", err)
+		}
+		s.disabledRoutes = append(s.disabledRoutes, regex)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	current = s
+
+	return nil
+}
+
+func getSettings() settings {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func (s settings) routeDisabled(path string) bool {
+	for _, regex := range s.disabledRoutes {
+		if regex.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler compresses the responses of next that are worth it
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := getSettings()
+		if !s.enabled || r.Method == "HEAD" || r.Header.Get("Range") != "" || s.routeDisabled(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		encoding := negotiateEncoding(r)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{rw: w, settings: s, encoding: encoding}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks brotli or gzip, going by the q-values of the
+// Accept-Encoding header of r, or "" if the client accepts neither. An
+// explicit coding wins over "*", and brotli wins a tie.
+func negotiateEncoding(r *http.Request) string {
+	qvalues := make(map[string]float64)
+
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(header, ",") {
+			params := strings.Split(coding, ";")
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					var err error
+					if q, err = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err != nil {
+						q = 0
+					}
+				}
+			}
+
+			qvalues[strings.ToLower(strings.TrimSpace(params[0]))] = q
+		}
+	}
+
+	qvalue := func(encoding string) float64 {
+		if q, ok := qvalues[encoding]; ok {
+			return q
+		}
+		return qvalues["*"]
+	}
+
+	br, gz := qvalue("br"), qvalue("gzip")
+	switch {
+	case br > 0 && br >= gz:
+		return "br"
+	case gz > 0:
+		return "gzip"
+	default:
+		return ""
+	}
+}
+
+// encoder is a gzip or brotli writer
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+type pooledEncoder struct {
+	encoder
+	encoding string
+	level    int
+}
+
+func getEncoder(w io.Writer, encoding string, level int) *pooledEncoder {
+	if e, ok := encoderPools[encoding].Get().(*pooledEncoder); ok && e.level == level {
+		e.Reset(w)
+		return e
+	}
+
+	e := &pooledEncoder{encoding: encoding, level: level}
+	if encoding == "br" {
+		e.encoder = brotli.NewWriterLevel(w, level)
+	} else {
+		// The level is validated by Configure
+		e.encoder, _ = gzip.NewWriterLevel(w, level)
+	}
+	return e
+}
+
+func putEncoder(e *pooledEncoder) {
+	encoderPools[e.encoding].Put(e)
+}
@@ -0,0 +1,224 @@
+package compression
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+var largeJSON = `{"data":"` + strings.Repeat("x", 4096) + `"}`
+
+func setup(t *testing.T, cfg config.CompressionConfig) {
+	cfg.Enabled = true
+	require.NoError(t, Configure(cfg))
+}
+
+func serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	Handler(handler).ServeHTTP(w, r)
+	return w
+}
+
+func jsonResponse(body string, header http.Header) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}
+}
+
+func gzipRequest(path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate")
+	return r
+}
+
+func brotliRequest(path string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	return r
+}
+
+func gunzip(t *testing.T, w *httptest.ResponseRecorder) string {
+	reader, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestCompress(t *testing.T) {
+	setup(t, config.CompressionConfig{})
+
+	w := serve(jsonResponse(largeJSON, http.Header{"Content-Length": {strconv.Itoa(len(largeJSON))}, "Etag": {`"abc"`}}), gzipRequest("/api/v4/projects"))
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	require.Empty(t, w.Header().Get("Content-Length"))
+	require.Equal(t, `W/"abc"`, w.Header().Get("ETag"))
+	require.Equal(t, largeJSON, gunzip(t, w))
+}
+
+func TestCompressBrotli(t *testing.T) {
+	setup(t, config.CompressionConfig{})
+
+	w := serve(jsonResponse(largeJSON, nil), brotliRequest("/api/v4/projects"))
+
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "br", w.Header().Get("Content-Encoding"))
+	body, err := ioutil.ReadAll(brotli.NewReader(w.Body))
+	require.NoError(t, err)
+	require.Equal(t, largeJSON, string(body))
+}
+
+func TestCompressStreamed(t *testing.T) {
+	setup(t, config.CompressionConfig{MinSize: 10})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(201)
+		for _, part := range []string{`{"a"`, `:"`, strings.Repeat("y", 100), `"}`} {
+			w.Write([]byte(part))
+		}
+	}
+	w := serve(handler, gzipRequest("/api/v4/projects"))
+
+	require.Equal(t, 201, w.Code)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Equal(t, `{"a":"`+strings.Repeat("y", 100)+`"}`, gunzip(t, w))
+}
+
+func TestFlushCompresses(t *testing.T) {
+	setup(t, config.CompressionConfig{})
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"a":`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`1}`))
+	}
+	w := serve(handler, gzipRequest("/api/v4/jobs/request"))
+
+	require.True(t, w.Flushed)
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Equal(t, `{"a":1}`, gunzip(t, w))
+}
+
+func TestNotCompressed(t *testing.T) {
+	setup(t, config.CompressionConfig{DisabledRoutes: []string{`^/api/v4/jobs/[0-9]+/trace\z`}})
+
+	small := `{"a":1}`
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		request  *http.Request
+		body     string
+		encoding string
+	}{
+		{name: "small response", handler: jsonResponse(small, nil), request: gzipRequest("/api/v4/projects"), body: small},
+		{
+			name:    "small response with a length",
+			handler: jsonResponse(small, http.Header{"Content-Length": {strconv.Itoa(len(small))}}),
+			request: gzipRequest("/api/v4/projects"),
+			body:    small,
+		},
+		{
+			name:     "compressed by Rails",
+			handler:  jsonResponse(largeJSON, http.Header{"Content-Encoding": {"br"}}),
+			request:  gzipRequest("/api/v4/projects"),
+			body:     largeJSON,
+			encoding: "br",
+		},
+		{
+			name: "other content type",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write([]byte(largeJSON))
+			},
+			request: gzipRequest("/api/v4/projects"),
+			body:    largeJSON,
+		},
+		{
+			name: "error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(500)
+				w.Write([]byte(largeJSON))
+			},
+			request: gzipRequest("/api/v4/projects"),
+			body:    largeJSON,
+		},
+		{name: "disabled route", handler: jsonResponse(largeJSON, nil), request: gzipRequest("/api/v4/jobs/1/trace"), body: largeJSON},
+		{name: "gzip not accepted", handler: jsonResponse(largeJSON, nil), request: httptest.NewRequest("GET", "/api/v4/projects", nil), body: largeJSON},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(tc.handler, tc.request)
+
+			require.Equal(t, tc.encoding, w.Header().Get("Content-Encoding"))
+			require.Equal(t, tc.body, w.Body.String())
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	require.NoError(t, Configure(config.CompressionConfig{}))
+
+	w := serve(jsonResponse(largeJSON, nil), gzipRequest("/api/v4/projects"))
+	require.Empty(t, w.Header().Get("Content-Encoding"))
+	require.Empty(t, w.Header().Get("Vary"))
+	require.Equal(t, largeJSON, w.Body.String())
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+	}{
+		{acceptEncoding: "", encoding: ""},
+		{acceptEncoding: "gzip", encoding: "gzip"},
+		{acceptEncoding: "deflate, GZIP;q=0.5", encoding: "gzip"},
+		{acceptEncoding: "gzip;q=0", encoding: ""},
+		{acceptEncoding: "br", encoding: "br"},
+		{acceptEncoding: "gzip, br", encoding: "br"},
+		{acceptEncoding: "gzip, br;q=0.5", encoding: "gzip"},
+		{acceptEncoding: "br;q=0, gzip;q=0.1", encoding: "gzip"},
+		{acceptEncoding: "*", encoding: "br"},
+		{acceptEncoding: "*, br;q=0", encoding: "gzip"},
+		{acceptEncoding: "*, gzip;q=0, br;q=0", encoding: ""},
+		{acceptEncoding: "identity, *;q=0", encoding: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			require.Equal(t, tc.encoding, negotiateEncoding(r))
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	require.NoError(t, Configure(config.CompressionConfig{ContentTypes: []string{"application/json", "text/plain; charset=utf-8"}}))
+	require.True(t, getSettings().contentTypes["text/plain"])
+	require.Equal(t, defaultMinSize, getSettings().minSize)
+
+	require.Error(t, Configure(config.CompressionConfig{Level: 10}))
+	require.Error(t, Configure(config.CompressionConfig{BrotliLevel: 12}))
+	require.Error(t, Configure(config.CompressionConfig{MinSize: -1}))
+	require.Error(t, Configure(config.CompressionConfig{ContentTypes: []string{"/"}}))
+	require.Error(t, Configure(config.CompressionConfig{DisabledRoutes: []string{"("}}))
+}
@@ -0,0 +1,191 @@
+package compression
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressWriter holds back the start of a response until it knows if it
+// is worth compressing
+type compressWriter struct {
+	rw       http.ResponseWriter
+	settings settings
+	encoding string
+
+	status int
+	// decided is set once the header was sent, compressed or not
+	decided bool
+	held    []byte
+
+	encoder *pooledEncoder
+	counter *countingWriter
+	written int64
+}
+
+func (w *compressWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	if !w.compressible() {
+		w.sendHeader(false)
+		return
+	}
+
+	if size, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+		w.sendHeader(size >= w.settings.minSize)
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.decided {
+		w.held = append(w.held, data...)
+		if len(w.held) < w.settings.minSize {
+			return len(data), nil
+		}
+
+		w.sendHeader(true)
+		if err := w.flushHeld(); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if w.encoder != nil {
+		w.written += int64(len(data))
+		return w.encoder.Write(data)
+	}
+	return w.rw.Write(data)
+}
+
+// Flush sends what was written so far. A response held back is compressed
+// from then on, since more of it is coming.
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.sendHeader(true)
+		if w.flushHeld() != nil {
+			return
+		}
+	}
+
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close ends the response: held back responses go out as they are, too
+// small to be compressed
+func (w *compressWriter) close() {
+	if w.status == 0 {
+		return
+	}
+
+	if !w.decided {
+		w.sendHeader(false)
+		w.flushHeld()
+		return
+	}
+
+	if w.encoder != nil {
+		w.encoder.Close()
+		putEncoder(w.encoder)
+		w.encoder = nil
+
+		compressedResponses.Inc()
+		compressionBytes.WithLabelValues("uncompressed").Add(float64(w.written))
+		compressionBytes.WithLabelValues("compressed").Add(float64(w.counter.n))
+	}
+}
+
+// compressible tells if the response, going by its status and header, may
+// be compressed
+func (w *compressWriter) compressible() bool {
+	switch w.status {
+	case http.StatusOK, http.StatusCreated, http.StatusAccepted, http.StatusNonAuthoritativeInfo:
+	default:
+		return false
+	}
+
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return w.settings.contentTypes[mediaType]
+}
+
+func (w *compressWriter) sendHeader(compress bool) {
+	w.decided = true
+
+	header := w.Header()
+	if w.compressible() {
+		// Caches must keep the compressed and uncompressed responses apart
+		header.Add("Vary", "Accept-Encoding")
+	}
+
+	if compress {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		// The compressed body is not the same bytes as the one Rails tagged
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		w.counter = &countingWriter{w: w.rw}
+		level := w.settings.level
+		if w.encoding == "br" {
+			level = w.settings.brotliLevel
+		}
+		w.encoder = getEncoder(w.counter, w.encoding, level)
+	}
+
+	w.rw.WriteHeader(w.status)
+}
+
+func (w *compressWriter) flushHeld() error {
+	held := w.held
+	w.held = nil
+	if len(held) == 0 {
+		return nil
+	}
+
+	if w.encoder != nil {
+		w.written += int64(len(held))
+		_, err := w.encoder.Write(held)
+		return err
+	}
+	_, err := w.rw.Write(held)
+	return err
+}
+
+type countingWriter struct {
+	w http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.w.Write(data)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/url"
 	"time"
 
@@ -13,18 +15,33 @@ type TomlURL struct {
 
 func (u *TomlURL) UnmarshalText(text []byte) error {
 	temp, err := url.Parse(string(text))
+	if err != nil {
+		return err
+	}
 	u.URL = *temp
-	return err
+	return nil
 }
 
+// TomlDuration is a duration written like "1m30s" in config.toml
 type TomlDuration struct {
 	time.Duration
 }
 
-func (d *TomlDuration) UnmarshalTest(text []byte) error {
+func (d *TomlDuration) UnmarshalText(text []byte) error {
 	temp, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	if temp < 0 {
+		return fmt.Errorf("duration %q must not be negative", text)
+	}
 	d.Duration = temp
-	return err
+	return nil
+}
+
+// MarshalText writes d like it is written in config.toml
+func (d TomlDuration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
 }
 
 type RedisConfig struct {
@@ -40,28 +57,804 @@ type RedisConfig struct {
 	MaxActive       *int
 }
 
+// NATSConfig configures a NATS server as the source of CI long polling
+// notifications, for installations without Redis
+type NATSConfig struct {
+	// URL is nats://[user:password@]host:port, or nats://token@host:port
+	URL TomlURL
+	// Subject Rails publishes notifications to. Defaults to
+	// workhorse.notifications.
+	Subject        string
+	ConnectTimeout *TomlDuration
+}
+
+// CIPollIntervalConfig makes Workhorse suggest how long CI runners should
+// wait before their next job request
+type CIPollIntervalConfig struct {
+	// Min is the interval suggested to runners that recently got a job.
+	// Suggestions are disabled if it is not set.
+	Min *TomlDuration
+	// Max caps the suggested interval. Defaults to ten times Min.
+	Max *TomlDuration
+	// IdleStep is how long a runner must go without a job before the
+	// suggested interval doubles. Defaults to five minutes.
+	IdleStep *TomlDuration
+}
+
+// CIJobRequestCacheConfig makes Workhorse remember the queue state Rails
+// returned to each runner, so that repeated polls with a stale state are
+// not forwarded to Rails
+type CIJobRequestCacheConfig struct {
+	// TTL is how long the answer of Rails is remembered. The cache is
+	// disabled if it is not set.
+	TTL *TomlDuration
+	// MaxEntries is how many runners are remembered. Defaults to 100000.
+	MaxEntries int
+}
+
+// CITraceBufferConfig makes Workhorse collect the small trace appends of
+// running jobs in Redis and send them to Rails in larger batches
+type CITraceBufferConfig struct {
+	// Enabled turns the buffer on. It needs [redis].
+	Enabled bool
+	// MaxSize is how many bytes of trace are collected before they are
+	// sent to Rails. Defaults to 64kB.
+	MaxSize int
+	// MaxAge is how long trace is collected before it is sent to Rails.
+	// Defaults to five seconds.
+	MaxAge *TomlDuration
+}
+
+// CITraceStreamConfig lets browsers follow the trace of running jobs over
+// Server-Sent Events, instead of polling Rails for it
+type CITraceStreamConfig struct {
+	// Enabled turns the stream on
+	Enabled bool
+	// PollInterval is how long a stream waits for a notification about the
+	// trace before it asks Rails anyway. Defaults to 30 seconds.
+	PollInterval *TomlDuration
+	// MaxDuration closes streams that are open this long. Browsers reconnect
+	// where they left off. Defaults to one hour.
+	MaxDuration *TomlDuration
+}
+
+// ChannelConfig limits the lifetime of terminal and service websockets
+type ChannelConfig struct {
+	// IdleTimeout closes sessions without input or output for this long
+	IdleTimeout *TomlDuration
+	// MaxDuration closes sessions that are open for this long, even if Rails
+	// allows a longer session
+	MaxDuration *TomlDuration
+}
+
+// CableConfig limits the ActionCable websockets proxied to the cable backend
+type CableConfig struct {
+	// MaxConnectionsPerIP is how many websockets a client IP can open at
+	// once. Unlimited if 0.
+	MaxConnectionsPerIP int
+	// MaxMessageSize is the size of the largest message clients can send,
+	// in bytes. Unlimited if 0.
+	MaxMessageSize int64
+}
+
+type ArchiveConfig struct {
+	// Transcode makes Workhorse request plain tar archives from Gitaly and
+	// convert them to zip or tar.gz itself
+	Transcode bool
+}
+
+type GitConfig struct {
+	// CoalesceUploadPack lets identical concurrent upload-pack requests
+	// share a single Gitaly stream
+	CoalesceUploadPack bool
+	// ProtocolV2 is one of "allow" (default), "force" or "forbid"
+	ProtocolV2 string
+	// StripCapabilities lists capabilities to remove from the info/refs
+	// advertisement
+	StripCapabilities []string
+	// MaxPushSize is the maximum size in bytes of a git-receive-pack
+	// request body. Zero means no limit.
+	MaxPushSize int64
+	// RepositoryBandwidthMetrics enables per-repository byte counters for
+	// upload-pack and receive-pack
+	RepositoryBandwidthMetrics bool
+	// TraceNegotiation logs a sanitized summary of each upload-pack
+	// negotiation
+	TraceNegotiation bool
+	// MaxConcurrentPerUser and MaxConcurrentPerRepository limit the number
+	// of concurrent upload-pack and receive-pack requests. Zero means no
+	// limit.
+	MaxConcurrentPerUser       int
+	MaxConcurrentPerRepository int
+}
+
+type GitalyConfig struct {
+	// CAFile is a PEM bundle of additional CAs trusted for tls:// Gitaly
+	// addresses
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerNameOverride is the name expected in the Gitaly server
+	// certificate, if it differs from the host name in the address
+	ServerNameOverride string
+	// ConnectionsPerServer is the number of connections pooled for each
+	// Gitaly server. Defaults to 1.
+	ConnectionsPerServer int
+	// FastTimeout limits unary RPCs and info/refs, StreamTimeout limits
+	// RPCs that stream packs, archives, blobs or diffs
+	FastTimeout   *TomlDuration
+	StreamTimeout *TomlDuration
+	// CopyBufferSize is the size in bytes of the pooled buffers request
+	// bodies are sent to Gitaly with. Defaults to 128KB.
+	CopyBufferSize int
+}
+
+// ProfilingConfig enables the profiling endpoints on the Prometheus
+// listener
+type ProfilingConfig struct {
+	Enabled bool
+	// TokenFile holds the bearer token of /debug/pprof/ and /debug/fgprof
+	TokenFile string
+	// MaxDuration limits CPU profiles, fgprof profiles and execution
+	// traces. Defaults to one minute.
+	MaxDuration *TomlDuration
+}
+
+// StatusConfig restricts who can see /-/status
+type StatusConfig struct {
+	// AllowedCIDRs are the networks of clients that can see the status.
+	// Defaults to localhost.
+	AllowedCIDRs []string
+}
+
+// ErrorReportingConfig decides which parts of a request are sent to
+// Sentry with its errors, and how many of them are sent
+type ErrorReportingConfig struct {
+	// ScrubHeaders are redacted in addition to Authorization and
+	// Private-Token. Add Cookie to redact cookies.
+	ScrubHeaders []string
+	// ScrubQueryParams are regular expressions of query parameter names
+	// that are filtered, in addition to the ones filtered from URLs in logs
+	ScrubQueryParams []string
+	// Body is what is sent of request bodies: "none", "metadata" for
+	// their type and length, or "form" for the fields of parsed forms,
+	// filtered like query parameters. Defaults to "none".
+	Body string
+	// ErrorSampleRates are the shares, between 0 and 1, of the errors of
+	// route classes ("git", "uploads", "api", "websocket", "default") that
+	// are reported. Errors of other classes are all reported.
+	ErrorSampleRates map[string]float64
+}
+
+// SigningConfig lets Workhorse sign the tokens it sends to Rails with a
+// private key, so that Rails only needs the public key to verify them.
+// Without it they are signed with the shared secret.
+type SigningConfig struct {
+	// Algorithm is "RS256" or "EdDSA"
+	Algorithm string
+	// KeyFile holds the PEM encoded private key
+	KeyFile string
+	// KeyID is sent as the "kid" header of tokens, to tell Rails which
+	// public key verifies them
+	KeyID string
+}
+
+// SecretsConfig configures the providers of settings written as
+// vault:<path>#<key> or aws-sm:<secret-id>[#<key>]
+type SecretsConfig struct {
+	// RefreshInterval is how often secrets are fetched again. Defaults to
+	// five minutes.
+	RefreshInterval *TomlDuration
+	// VaultAddress defaults to the VAULT_ADDR environment variable
+	VaultAddress string
+	// VaultTokenFile holds the Vault token, e.g. written by Vault Agent.
+	// Defaults to the VAULT_TOKEN environment variable.
+	VaultTokenFile string
+	// AWSRegion of AWS Secrets Manager. Defaults to the AWS_REGION
+	// environment variable. Credentials are taken from AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+	AWSRegion string
+}
+
+// TimeoutsConfig sets the timeouts of the command line flags in
+// config.toml. Flags given on the command line take precedence.
+type TimeoutsConfig struct {
+	// ProxyHeaders is -proxyHeadersTimeout
+	ProxyHeaders *TomlDuration
+	// APIQueue is -apiQueueDuration
+	APIQueue *TomlDuration
+	// APICILongPolling is -apiCiLongPollingDuration
+	APICILongPolling *TomlDuration
+	// Upgrade is -upgradeTimeout
+	Upgrade *TomlDuration
+	// Shutdown is -shutdownTimeout
+	Shutdown *TomlDuration
+}
+
+// ObjectStorageConfig holds the defaults of uploads to an object storage
+// destination, used when Rails doesn't send its own values
+type ObjectStorageConfig struct {
+	// URLPrefix selects the uploads of the destination by the beginning
+	// of their presigned URLs, like "https://avatars.s3.amazonaws.com/".
+	// The longest matching prefix wins.
+	URLPrefix string
+	// Timeout replaces DefaultObjectStoreTimeout
+	Timeout *TomlDuration
+	// PartSize is the size of multipart upload parts, if Rails sends part
+	// URLs without a part size
+	PartSize int64
+	// Concurrency is the number of parts of a multipart upload sent at
+	// the same time. Defaults to 1.
+	Concurrency int
+	// WriteTimeout is how long the destination may take to accept a chunk
+	// of an upload. Defaults to 10m. Writes of multipart uploads wait for
+	// a part upload when all Concurrency parts are in flight.
+	WriteTimeout *TomlDuration
+	// TrailingChecksum sends a CRC32 checksum of uploads in a trailer, so
+	// that object storage verifies them rather than Workhorse comparing
+	// the ETag. Needs S3 or another object storage with trailing
+	// checksums.
+	TrailingChecksum bool
+
+	// Provider lets Workhorse presign URLs of the destination itself,
+	// with URLPrefix as the bucket URL: "AWS" or "Google"
+	Provider string
+	// Region of the bucket for AWS. Defaults to us-east-1.
+	Region string
+	// AccessKeyID and SecretAccessKey sign the URLs for AWS. They can be
+	// secret references, so that rotated keys are picked up when the
+	// secrets are refreshed. Default to the AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+	// GoogleJSONKeyFile holds the service account key for Google. It is
+	// read again when it changes.
+	GoogleJSONKeyFile string
+	// PresignExpiry is how long presigned URLs are valid. Defaults to 15m.
+	PresignExpiry *TomlDuration
+
+	// Failover names another object_storage section, with a Provider, in
+	// another region or bucket. After FailoverAfter uploads in a row
+	// failed in object storage, single PUT uploads go there for a minute.
+	Failover string
+	// FailoverAfter defaults to 3
+	FailoverAfter int
+}
+
+// UploadRouteConfig sends the uploads of a type, like "lfs", to an
+// [object_storage.<name>] destination
+type UploadRouteConfig struct {
+	// Destination is the name of the object_storage section
+	Destination string
+	// RemotePathPrefix is where the uploads of the type are stored in the
+	// destination, like "lfs-objects/". It is appended to the URLPrefix of
+	// the destination.
+	RemotePathPrefix string
+}
+
+// FeatureFlagsConfig makes Workhorse fetch feature flags from an Unleash
+// compatible API, like the one of GitLab feature flags, to roll out new
+// behaviour without restarts
+type FeatureFlagsConfig struct {
+	// URL of the Unleash API, e.g.
+	// https://gitlab.example.com/api/v4/feature_flags/unleash/42. Without
+	// it, only Defaults apply.
+	URL string
+	// AppName is sent as UNLEASH-APPNAME, the environment of GitLab feature
+	// flags. Defaults to "production".
+	AppName string
+	// InstanceID is sent as UNLEASH-INSTANCEID. It can be a secret
+	// reference like vault:secret/data/workhorse#unleash_instance_id.
+	InstanceID string
+	// RefreshInterval defaults to 15s
+	RefreshInterval *TomlDuration
+	// Defaults hold the state of flags until they are fetched, and of
+	// flags the API doesn't know
+	Defaults map[string]bool
+}
+
+// AdminConfig serves the admin API for runtime operations on a Unix
+// socket or a loopback address
+type AdminConfig struct {
+	// Socket is the path of the Unix socket of the API
+	Socket string
+	// Addr is a loopback address like localhost:9230, instead of Socket
+	Addr string
+	// TokenFile holds the bearer token of the API
+	TokenFile string
+}
+
+// QueueConfig limits how many requests of a class of routes are handled
+// at once
+type QueueConfig struct {
+	// Limit is how many requests are handled at once. Disabled if 0.
+	Limit uint
+	// QueueLimit is how many more requests may wait for a slot
+	QueueLimit uint
+	// Timeout is how long a request may wait for a slot. Defaults to 30s.
+	Timeout *TomlDuration
+}
+
+// QueuesConfig holds the queue of each class of routes, so that a burst of
+// one class doesn't take the slots of the others
+type QueuesConfig struct {
+	API     QueueConfig
+	Git     QueueConfig
+	Uploads QueueConfig
+}
+
+// SlowRequestsConfig logs the requests still in flight after Threshold,
+// to find out where they hang
+type SlowRequestsConfig struct {
+	// Threshold is how long a request may take before it is logged.
+	// Disabled if not set.
+	Threshold *TomlDuration
+	// CaptureStack adds the stack of the goroutine handling the request
+	// to the log
+	CaptureStack bool
+}
+
+// UploadJanitorConfig removes the temporary files of uploads left behind,
+// e.g. by a crash
+type UploadJanitorConfig struct {
+	// MaxAge is how long a temporary file may be left untouched before it
+	// is removed. Disabled if not set.
+	MaxAge *TomlDuration
+	// Interval is how often the directories are scanned. Defaults to 1h.
+	Interval *TomlDuration
+	// Dirs are more directories only holding temporary files of Workhorse
+	Dirs []string
+}
+
+// GraphQLCacheConfig caches the responses of persisted GraphQL queries in
+// Redis
+type GraphQLCacheConfig struct {
+	// Queries are the SHA-256 hashes of the persisted queries that may be
+	// cached. The cache is off without them.
+	Queries []string
+	// TTL is how long a response is cached. Defaults to 10s.
+	TTL *TomlDuration
+	// MaxResponseSize is the size in bytes of the largest response that is
+	// cached. Defaults to 1MB.
+	MaxResponseSize int64
+}
+
+// CompressionConfig compresses the responses Rails didn't compress, for
+// the clients that accept brotli or gzip
+type CompressionConfig struct {
+	// Enabled turns the compression on
+	Enabled bool
+	// MinSize is the size in bytes of the smallest response that is
+	// compressed. Defaults to 1024.
+	MinSize int
+	// Level is the gzip level, from 1 to 9. Defaults to 6.
+	Level int
+	// BrotliLevel is the brotli level, from 1 to 11. Defaults to 4.
+	BrotliLevel int
+	// ContentTypes are the media types that are compressed. Defaults to
+	// application/json.
+	ContentTypes []string
+	// DisabledRoutes are regular expressions of the paths that are never
+	// compressed
+	DisabledRoutes []string
+}
+
+// CloneFloodConfig limits the clones and fetches of a network, to keep
+// scrapers from cloning every public repository at once
+type CloneFloodConfig struct {
+	// Enabled turns the limit on
+	Enabled bool
+	// IPv4Prefix and IPv6Prefix are the lengths of the networks that
+	// share a limit. Default to 24 and 64.
+	IPv4Prefix int
+	IPv6Prefix int
+	// Rate is the number of info/refs requests per second a network may
+	// make, Burst the number it may make at once. Default to 1 and 10.
+	Rate  float64
+	Burst int
+	// Challenge lets the requests over the limit through if they solve a
+	// proof-of-work challenge
+	Challenge bool
+	// Difficulty is the number of leading zero bits of a solution.
+	// Defaults to 20.
+	Difficulty int
+	// ChallengeTTL is how long a challenge can be solved. Defaults to 5m.
+	ChallengeTTL *TomlDuration
+}
+
+// GeoIPConfig tags the requests with the country of their client
+type GeoIPConfig struct {
+	// Database is the path of a MaxMind GeoIP2 or GeoLite2 Country or City
+	// database. Requests are not tagged without it.
+	Database string
+}
+
+// CrossOriginConfig sets the cross-origin policy of the user content
+// downloads Rails sent no policy for
+type CrossOriginConfig struct {
+	// ResourcePolicy is their Cross-Origin-Resource-Policy: "same-origin",
+	// "same-site" or "cross-origin". Empty sends none.
+	ResourcePolicy string
+}
+
+// TerraformStateConfig makes Workhorse keep the locks of Terraform states
+// in Redis, so that a state is never locked or written by two clients at
+// once while Rails is slow to answer
+type TerraformStateConfig struct {
+	// Enabled turns the lock fencing on. It needs [redis].
+	Enabled bool
+	// LockTTL is how long Workhorse remembers a lock Rails granted.
+	// Defaults to 12 hours.
+	LockTTL *TomlDuration
+}
+
+// CorrelationConfig decides which correlation ID requests get. The ID is
+// sent to Rails, Gitaly and object storage, and added to logs and Sentry
+// events.
+type CorrelationConfig struct {
+	// Propagation is what happens to the X-Request-Id header of incoming
+	// requests: "regenerate" ignores it, "trust" uses it, "trust_proxies"
+	// uses it if the request comes from a trusted proxy and "namespace"
+	// puts it in front of a new ID. Defaults to "regenerate".
+	Propagation string
+	// Prefix is put in front of generated IDs
+	Prefix string
+}
+
+// BackendTarget is one of the URLs of authBackend. Requests are spread
+// over the targets in proportion to their Weight.
+type BackendTarget struct {
+	URL    *url.URL
+	Weight int
+}
+
+// BackendAffinityConfig sends the requests with the same affinity key to
+// the same authBackend target, when there is more than one, e.g. the trace
+// chunks of a CI job to a single Puma
+type BackendAffinityConfig struct {
+	// Enabled turns the affinity on
+	Enabled bool
+	// Paths are regular expressions of the request paths that stick to a
+	// target. The key is what the first group of the expression matched,
+	// or the whole path without a group. Defaults to the updates and
+	// traces of CI jobs, keyed by job ID.
+	Paths []string
+	// Header or Cookie, if one is set, holds the key instead of the path
+	Header string
+	Cookie string
+}
+
+// BackendHealthCheckConfig checks the authBackend targets when there is
+// more than one. No requests are sent to unhealthy targets.
+type BackendHealthCheckConfig struct {
+	// Path is requested on every target. Defaults to /-/readiness.
+	Path string
+	// Interval is the time between checks. Defaults to 5s.
+	Interval *TomlDuration
+	// Timeout of a check. Defaults to 2s.
+	Timeout *TomlDuration
+	// UnhealthyThreshold is how many checks in a row must fail for a
+	// target to become unhealthy. Defaults to 2.
+	UnhealthyThreshold int
+	// HealthyThreshold is how many checks in a row must succeed for an
+	// unhealthy target to get requests again. Defaults to 2.
+	HealthyThreshold int
+}
+
+// BackendTLSConfig is used for https:// authBackend and cableBackend URLs
+type BackendTLSConfig struct {
+	// CAFile is a PEM bundle of the CAs trusted for the backend, instead of
+	// the system pool
+	CAFile string
+	// CertFile and KeyFile hold the client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+	// ServerNameOverride is the name expected in the backend certificate,
+	// if it differs from the host name in the backend URL
+	ServerNameOverride string
+}
+
+// BackendTransportConfig tunes the connection pool used for authBackend and
+// cableBackend
+type BackendTransportConfig struct {
+	// MaxIdleConns is how many idle connections are kept in total.
+	// Defaults to 100.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is how many idle connections are kept for each
+	// backend. Defaults to 2.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes connections that were idle for this long.
+	// Defaults to 90s.
+	IdleConnTimeout *TomlDuration
+	// KeepAlive is the interval of TCP keep-alive probes. Defaults to 30s.
+	KeepAlive *TomlDuration
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+	// DisableCompression stops asking the backend for gzip responses
+	DisableCompression bool
+}
+
+// PreAuthorizeRetryConfig retries pre-authorization requests that fail
+// because Rails is unavailable, e.g. while Puma restarts
+type PreAuthorizeRetryConfig struct {
+	// MaxAttempts includes the first attempt. Requests are not retried if
+	// it is less than 2.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles for every
+	// further retry. Defaults to 100ms.
+	Backoff *TomlDuration
+	// Budget is the total time spent on attempts and backoff. No retry is
+	// started after it. Defaults to 5s.
+	Budget *TomlDuration
+	// HedgeDelay starts another attempt if the previous one has not
+	// answered after this long. Disabled if not set.
+	HedgeDelay *TomlDuration
+}
+
+type RateLimitRule struct {
+	// Name identifies the rule in metrics and logs
+	Name string
+	// Path is a regular expression matched against the request path
+	Path string
+	// Methods restricts the rule to these HTTP methods. Empty matches all
+	// methods.
+	Methods []string
+	// Key is "ip" (default) for a bucket per client IP address or "user"
+	// for a bucket per set of credentials as well
+	Key string
+	// Rate is the number of requests per second refilled into each bucket,
+	// Burst is the bucket size. Burst defaults to Rate.
+	Rate  float64
+	Burst int
+}
+
+// IPRule restricts the routes it matches to the clients of some networks
+type IPRule struct {
+	// Name identifies the rule in metrics and logs
+	Name string
+	// Classes are the route classes the rule applies to: "default",
+	// "git", "uploads", "api" or "websocket". Empty matches all classes.
+	Classes []string
+	// Path is a regular expression matched against the request path.
+	// Empty matches all paths.
+	Path string
+	// Allow are the CIDRs of the networks that may use the routes. Empty
+	// allows all networks that are not denied.
+	Allow []string
+	// Deny are the CIDRs of the networks that may not use the routes,
+	// even if they are allowed
+	Deny []string
+}
+
+type CertificateConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+type ListenerConfig struct {
+	// Network is "tcp" (default), "tcp4", "tcp6", "unix" or "systemd". For
+	// "systemd" Addr is the FileDescriptorName of an inherited socket.
+	Network string
+	Addr    string
+	// Umask is applied when creating a Unix socket
+	Umask int
+	// ProxyProtocol expects a PROXY protocol header on every connection
+	ProxyProtocol bool
+	// Certificates enables TLS. The certificate is picked by SNI server
+	// name, the first one is the default.
+	Certificates []CertificateConfig
+	// MinTLSVersion is one of "tls1.0", "tls1.1", "tls1.2" (default) or
+	// "tls1.3"
+	MinTLSVersion string
+	// H2C accepts HTTP/2 without TLS on a listener without certificates
+	H2C bool
+	// MaxConcurrentStreams limits the number of concurrent requests per
+	// HTTP/2 connection. Defaults to 250.
+	MaxConcurrentStreams uint32
+}
+
+type AccessLogRule struct {
+	// Path is a regular expression matched against the request path
+	Path string
+	// SampleRate is the fraction of matching requests that is logged.
+	// Zero excludes the requests from the access log.
+	SampleRate float64
+}
+
+type AccessLogConfig struct {
+	// Rules set the sample rate for requests by path. The first matching
+	// rule applies.
+	Rules []AccessLogRule
+	// SampleRate applies to requests that match no rule. Defaults to 1.
+	SampleRate *float64
+	// Server errors and requests slower than SlowRequestThreshold are
+	// always logged
+	SlowRequestThreshold *TomlDuration
+}
+
+type HeaderRule struct {
+	// Path is a regular expression matched against the request path
+	Path string
+	// SetRequestHeaders and RemoveRequestHeaders change the request before
+	// it is handled
+	SetRequestHeaders    map[string]string
+	RemoveRequestHeaders []string
+	// AddResponseHeaders are only added if the response does not have the
+	// header yet, SetResponseHeaders are always overridden
+	AddResponseHeaders    map[string]string
+	SetResponseHeaders    map[string]string
+	RemoveResponseHeaders []string
+}
+
+type RouteLimits struct {
+	// ReadTimeout limits the total time spent reading the request body
+	ReadTimeout *TomlDuration
+	// IdleTimeout limits the time to wait for the next chunk of the
+	// request body
+	IdleTimeout *TomlDuration
+	// WriteTimeout limits the time spent writing the response
+	WriteTimeout *TomlDuration
+	// MaxBodySize is the maximum request body size in bytes
+	MaxBodySize int64
+}
+
+// BackendBreakerConfig sheds low-priority requests while Rails keeps
+// failing with 502 or 504
+type BackendBreakerConfig struct {
+	// FailureRatio is the share of failed requests in a window that opens
+	// the breaker. Disabled if 0.
+	FailureRatio float64
+	// MinRequests is how many requests a window needs before the breaker
+	// can open. Defaults to 20.
+	MinRequests int
+	// Window is how long requests are counted for. Defaults to 10s.
+	Window *TomlDuration
+	// OpenDuration is how long requests are shed before one is let through
+	// to probe Rails. Defaults to 5s.
+	OpenDuration *TomlDuration
+}
+
+// RouteLimitsConfig holds the limits for each class of routes. Routes
+// that are not Git, upload or API routes use Default.
+type RouteLimitsConfig struct {
+	Git     RouteLimits
+	Uploads RouteLimits
+	API     RouteLimits
+	Default RouteLimits
+}
+
+type AssetCacheConfig struct {
+	// Disabled turns off the in-memory cache for fingerprinted assets
+	Disabled bool
+	// MaxSize is the memory used by the cache in bytes. Defaults to 32MB.
+	MaxSize int64
+	// MaxFileSize is the size of the largest file kept in the cache.
+	// Defaults to 1MB.
+	MaxFileSize int64
+	// NotFoundTTL is how long a missing asset is remembered. Defaults to
+	// one minute.
+	NotFoundTTL *TomlDuration
+	// NotFoundMaxEntries is how many missing assets are remembered, apart
+	// from MaxSize. Defaults to 1024.
+	NotFoundMaxEntries int
+}
+
 type Config struct {
-	Redis                    *RedisConfig  `toml:"redis"`
-	Backend                  *url.URL      `toml:"-"`
-	CableBackend             *url.URL      `toml:"-"`
-	Version                  string        `toml:"-"`
-	DocumentRoot             string        `toml:"-"`
-	DevelopmentMode          bool          `toml:"-"`
-	Socket                   string        `toml:"-"`
-	CableSocket              string        `toml:"-"`
-	ProxyHeadersTimeout      time.Duration `toml:"-"`
-	APILimit                 uint          `toml:"-"`
-	APIQueueLimit            uint          `toml:"-"`
-	APIQueueTimeout          time.Duration `toml:"-"`
-	APICILongPollingDuration time.Duration `toml:"-"`
+	Redis              *RedisConfig             `toml:"redis"`
+	NATS               *NATSConfig              `toml:"nats"`
+	CIPollInterval     CIPollIntervalConfig     `toml:"ci_poll_interval"`
+	CIJobRequestCache  CIJobRequestCacheConfig  `toml:"ci_job_request_cache"`
+	CITraceBuffer      CITraceBufferConfig      `toml:"ci_trace_buffer"`
+	CITraceStream      CITraceStreamConfig      `toml:"ci_trace_stream"`
+	Archive            ArchiveConfig            `toml:"archive"`
+	Git                GitConfig                `toml:"git"`
+	Gitaly             GitalyConfig             `toml:"gitaly"`
+	BackendTLS         BackendTLSConfig         `toml:"backend_tls"`
+	BackendTransport   BackendTransportConfig   `toml:"backend_transport"`
+	BackendHealthCheck BackendHealthCheckConfig `toml:"backend_health_check"`
+	BackendAffinity    BackendAffinityConfig    `toml:"backend_affinity"`
+	PreAuthorizeRetry  PreAuthorizeRetryConfig  `toml:"preauthorize_retry"`
+	BackendBreaker     BackendBreakerConfig     `toml:"backend_breaker"`
+	Correlation        CorrelationConfig        `toml:"correlation"`
+	Profiling          ProfilingConfig          `toml:"profiling"`
+	Status             StatusConfig             `toml:"status"`
+	ErrorReporting     ErrorReportingConfig     `toml:"error_reporting"`
+	Signing            SigningConfig            `toml:"signing"`
+	Secrets            SecretsConfig            `toml:"secrets"`
+	Timeouts           TimeoutsConfig           `toml:"timeouts"`
+	FeatureFlags       FeatureFlagsConfig       `toml:"feature_flags"`
+	Admin              AdminConfig              `toml:"admin"`
+	Queues             QueuesConfig             `toml:"queues"`
+	SlowRequests       SlowRequestsConfig       `toml:"slow_requests"`
+	UploadJanitor      UploadJanitorConfig      `toml:"upload_janitor"`
+	GraphQLCache       GraphQLCacheConfig       `toml:"graphql_cache"`
+	Compression        CompressionConfig        `toml:"compression"`
+	CloneFlood         CloneFloodConfig         `toml:"clone_flood"`
+	GeoIP              GeoIPConfig              `toml:"geoip"`
+	CrossOrigin        CrossOriginConfig        `toml:"cross_origin"`
+	TerraformState     TerraformStateConfig     `toml:"terraform_state"`
+	RateLimits         []RateLimitRule          `toml:"rate_limit"`
+	IPRules            []IPRule                 `toml:"ip_rule"`
+	Listeners          []ListenerConfig         `toml:"listeners"`
+	AccessLog          AccessLogConfig          `toml:"access_log"`
+	Headers            []HeaderRule             `toml:"headers"`
+	RouteLimits        RouteLimitsConfig        `toml:"route_limits"`
+	AssetCache         AssetCacheConfig         `toml:"asset_cache"`
+	Channel            ChannelConfig            `toml:"channel"`
+	Cable              CableConfig              `toml:"cable"`
+	// LogLevel is the level of the logs other than access logs, e.g.
+	// "debug". Defaults to "info".
+	LogLevel string `toml:"log_level"`
+	// ObjectStorage holds the upload defaults of object storage
+	// destinations by name
+	ObjectStorage map[string]ObjectStorageConfig `toml:"object_storage"`
+	// UploadRoutes maps upload types to object storage destinations
+	UploadRoutes map[string]UploadRouteConfig `toml:"upload_routes"`
+	// TrustedCIDRsForXForwardedFor lists the networks of proxies whose
+	// X-Forwarded-For header is trusted
+	TrustedCIDRsForXForwardedFor []string        `toml:"trusted_cidrs_for_x_forwarded_for"`
+	Backend                      *url.URL        `toml:"-"`
+	BackendTargets               []BackendTarget `toml:"-"`
+	CableBackend                 *url.URL        `toml:"-"`
+	Version                      string          `toml:"-"`
+	DocumentRoot                 string          `toml:"-"`
+	ErrorPagesDir                string          `toml:"-"`
+	DevelopmentMode              bool            `toml:"-"`
+	Socket                       string          `toml:"-"`
+	BackendH2C                   bool            `toml:"-"`
+	CableSocket                  string          `toml:"-"`
+	ProxyHeadersTimeout          time.Duration   `toml:"-"`
+	APILimit                     uint            `toml:"-"`
+	APIQueueLimit                uint            `toml:"-"`
+	APIQueueTimeout              time.Duration   `toml:"-"`
+	APICILongPollingDuration     time.Duration   `toml:"-"`
 }
 
 // LoadConfig from a file
+// LoadConfig reads a config file. ${VAR} references in the file are
+// replaced with environment variables, and GITLAB_WORKHORSE_* environment
+// variables override its settings.
 func LoadConfig(filename string) (*Config, error) {
-	cfg := &Config{}
-	if _, err := toml.DecodeFile(filename, cfg); err != nil {
+	cfg, _, err := decodeConfig(filename)
+	return cfg, err
+}
+
+// UnknownKeys returns the keys of a config file that are no settings of
+// Workhorse, like misspelled ones. LoadConfig ignores them.
+func UnknownKeys(filename string) ([]string, error) {
+	_, md, err := decodeConfig(filename)
+	if err != nil {
 		return nil, err
 	}
 
-	return cfg, nil
+	var keys []string
+	for _, key := range md.Undecoded() {
+		keys = append(keys, key.String())
+	}
+	return keys, nil
+}
+
+func decodeConfig(filename string) (*Config, toml.MetaData, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, toml.MetaData{}, err
+	}
+
+	expanded, err := expandEnv(string(contents))
+	if err != nil {
+		return nil, toml.MetaData{}, err
+	}
+
+	cfg := &Config{}
+	md, err := toml.Decode(expanded, cfg)
+	if err != nil {
+		return nil, md, err
+	}
+
+	if err := applyEnvOverrides(cfg); err != nil {
+		return nil, md, err
+	}
+
+	return cfg, md, nil
 }
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTomlDuration(t *testing.T) {
+	cfg, err := loadConfigString(t, `
+[timeouts]
+ProxyHeaders = "1m30s"
+
+[redis]
+URL = "tcp://localhost:6379"
+ReadTimeout = "500ms"
+`)
+	require.NoError(t, err)
+	require.Equal(t, 90*time.Second, cfg.Timeouts.ProxyHeaders.Duration)
+	require.Equal(t, 500*time.Millisecond, cfg.Redis.ReadTimeout.Duration)
+	require.Nil(t, cfg.Timeouts.Shutdown)
+
+	data, err := json.Marshal(cfg.Timeouts.ProxyHeaders)
+	require.NoError(t, err)
+	require.Equal(t, `"1m30s"`, string(data))
+}
+
+func TestInvalidTomlDuration(t *testing.T) {
+	for _, value := range []string{`"30"`, `"-1s"`, `"soon"`, `30`} {
+		t.Run(value, func(t *testing.T) {
+			_, err := loadConfigString(t, "[timeouts]\nShutdown = "+value+"\n")
+			require.Error(t, err)
+		})
+	}
+}
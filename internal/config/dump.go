@@ -0,0 +1,180 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	maskedValue = "[MASKED]"
+	// maskedURLPassword is what url.URL.Redacted writes
+	maskedURLPassword = "xxxxx"
+)
+
+// sensitiveHeaderWords make the values of header rules with these words in
+// the header name masked in DumpConfig
+var sensitiveHeaderWords = []string{"auth", "cookie", "token", "secret", "password", "key"}
+
+// MarshalText writes u without its password, so that it can't leak into
+// logs or the config hash
+func (u TomlURL) MarshalText() ([]byte, error) {
+	return []byte(redactURL(&u.URL)), nil
+}
+
+// DumpConfig returns cfg as JSON for the logs, with passwords, URL
+// credentials and sensitive header values masked. References to secret
+// providers are kept, they are no secrets. Settings of config.toml have
+// their names in the file, the others the names of the Config fields.
+func DumpConfig(cfg Config) ([]byte, error) {
+	data, err := json.Marshal(dumpValue(reflect.ValueOf(maskConfig(cfg))))
+	if err != nil {
+		return nil, fmt.Errorf("config: dump: %v", err)
+	}
+	return data, nil
+}
+
+func dumpValue(v reflect.Value) interface{} {
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil
+	}
+
+	switch value := v.Interface().(type) {
+	case *url.URL:
+		return redactURL(value)
+	case time.Duration:
+		return value.String()
+	case encoding.TextMarshaler:
+		text, err := value.MarshalText()
+		if err != nil {
+			return err.Error()
+		}
+		return string(text)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return dumpValue(v.Elem())
+	case reflect.Struct:
+		fields := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			key := field.Name
+			if tag := strings.Split(field.Tag.Get("toml"), ",")[0]; tag != "" && tag != "-" {
+				key = tag
+			}
+			fields[key] = dumpValue(v.Field(i))
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = dumpValue(v.Index(i))
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		entries := make(map[string]interface{})
+		for _, key := range v.MapKeys() {
+			entries[fmt.Sprint(key.Interface())] = dumpValue(v.MapIndex(key))
+		}
+		return entries
+	}
+
+	return v.Interface()
+}
+
+func maskConfig(cfg Config) Config {
+	if cfg.Redis != nil {
+		redis := *cfg.Redis
+		redis.Password = maskSecret(redis.Password)
+		cfg.Redis = &redis
+	}
+
+	cfg.FeatureFlags.InstanceID = maskSecret(cfg.FeatureFlags.InstanceID)
+
+	if cfg.ObjectStorage != nil {
+		objectStorage := make(map[string]ObjectStorageConfig, len(cfg.ObjectStorage))
+		for name, c := range cfg.ObjectStorage {
+			c.SecretAccessKey = maskSecret(c.SecretAccessKey)
+			objectStorage[name] = c
+		}
+		cfg.ObjectStorage = objectStorage
+	}
+
+	var headers []HeaderRule
+	for _, rule := range cfg.Headers {
+		rule.SetRequestHeaders = maskHeaders(rule.SetRequestHeaders)
+		rule.AddResponseHeaders = maskHeaders(rule.AddResponseHeaders)
+		rule.SetResponseHeaders = maskHeaders(rule.SetResponseHeaders)
+		headers = append(headers, rule)
+	}
+	cfg.Headers = headers
+
+	return cfg
+}
+
+func maskSecret(value string) string {
+	if value == "" || IsSecretRef(value) {
+		return value
+	}
+	return maskedValue
+}
+
+func maskHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+
+	masked := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if isSensitiveHeader(name) {
+			value = maskSecret(value)
+		}
+		masked[name] = value
+	}
+	return masked
+}
+
+func isSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range sensitiveHeaderWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURL masks the password of u, or the user name if there is no
+// password because it may be a token, like in nats://token@host
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if u.User == nil {
+		return u.String()
+	}
+
+	redacted := *u
+	if _, ok := u.User.Password(); ok {
+		redacted.User = url.UserPassword(u.User.Username(), maskedURLPassword)
+	} else {
+		redacted.User = url.User(maskedURLPassword)
+	}
+	return redacted.String()
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// EnvOverridePrefix starts the names of environment variables that
+// override settings of config.toml, e.g. GITLAB_WORKHORSE_REDIS_PASSWORD
+// for Password in the [redis] section
+const EnvOverridePrefix = "GITLAB_WORKHORSE_"
+
+// ${VAR} is expanded, $${VAR} is the literal ${VAR}
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// expandEnv replaces the ${VAR} references of a config file with the
+// values of the environment variables. Unset variables are an error, so
+// that a missing secret is not mistaken for an empty one.
+func expandEnv(contents string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(contents, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+
+		name := envReference.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+
+	return expanded, err
+}
+
+// applyEnvOverrides sets the settings of cfg that have a
+// GITLAB_WORKHORSE_<SECTION>_<KEY> environment variable, with the section
+// and key written uppercase. Settings outside of sections are
+// GITLAB_WORKHORSE_<KEY>. Lists of strings are comma separated. Arrays of
+// sections, like [[rate_limit]], can't be overridden.
+func applyEnvOverrides(cfg *Config) error {
+	_, err := overrideStruct(reflect.ValueOf(cfg).Elem(), strings.TrimSuffix(EnvOverridePrefix, "_"))
+	return err
+}
+
+// overrideStruct returns whether an environment variable set a field of v
+func overrideStruct(v reflect.Value, prefix string) (bool, error) {
+	overridden := false
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Name
+		if tag := field.Tag.Get("toml"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			key = strings.Split(tag, ",")[0]
+		}
+
+		ok, err := overrideValue(v.Field(i), prefix+"_"+strings.ToUpper(key))
+		if err != nil {
+			return false, err
+		}
+		overridden = overridden || ok
+	}
+
+	return overridden, nil
+}
+
+func overrideValue(v reflect.Value, name string) (bool, error) {
+	if !v.CanSet() {
+		return false, nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		// Only allocate nil pointers when something is overridden, a
+		// missing section may mean that a feature is disabled
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if !v.IsNil() {
+			elem = v.Elem()
+		}
+
+		ok, err := overrideValue(elem, name)
+		if ok && v.IsNil() {
+			v.Set(elem.Addr())
+		}
+		return ok, err
+	}
+
+	if v.Kind() == reflect.Struct && !reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		return overrideStruct(v, name)
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return false, nil
+	}
+
+	if err := setFromString(v, value); err != nil {
+		return false, fmt.Errorf("%s: %v", name, err)
+	}
+	return true, nil
+}
+
+func setFromString(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		elemType := v.Type().Elem()
+		if elemType.Kind() != reflect.String && !reflect.PtrTo(elemType).Implements(textUnmarshalerType) {
+			return fmt.Errorf("can't be set from the environment")
+		}
+
+		items := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+
+			elem := reflect.New(elemType).Elem()
+			if err := setFromString(elem, item); err != nil {
+				return err
+			}
+			items = reflect.Append(items, elem)
+		}
+		v.Set(items)
+	default:
+		return fmt.Errorf("can't be set from the environment")
+	}
+
+	return nil
+}
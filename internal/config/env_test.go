@@ -0,0 +1,110 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setEnv(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		require.NoError(t, os.Setenv(name, value))
+	}
+
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func loadConfigString(t *testing.T, contents string) (*Config, error) {
+	f, err := ioutil.TempFile("", "config")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	return LoadConfig(f.Name())
+}
+
+func TestLoadConfigExpandsEnv(t *testing.T) {
+	defer setEnv(t, map[string]string{"TEST_REDIS_PASSWORD": "s3cret"})()
+
+	cfg, err := loadConfigString(t, `
+[redis]
+URL = "redis://:${TEST_REDIS_PASSWORD}@localhost:6379"
+Password = "${TEST_REDIS_PASSWORD}"
+SentinelMaster = "$${NOT_EXPANDED}"
+`)
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", cfg.Redis.Password)
+	password, _ := cfg.Redis.URL.User.Password()
+	require.Equal(t, "s3cret", password)
+	require.Equal(t, "${NOT_EXPANDED}", cfg.Redis.SentinelMaster)
+}
+
+func TestLoadConfigUnsetEnv(t *testing.T) {
+	_, err := loadConfigString(t, `log_level = "${TEST_UNSET_VARIABLE}"`)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "TEST_UNSET_VARIABLE")
+}
+
+func TestLoadConfigEnvOverrides(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"GITLAB_WORKHORSE_LOG_LEVEL":                         "debug",
+		"GITLAB_WORKHORSE_REDIS_PASSWORD":                    "s3cret",
+		"GITLAB_WORKHORSE_REDIS_READTIMEOUT":                 "2s",
+		"GITLAB_WORKHORSE_REDIS_MAXIDLE":                     "3",
+		"GITLAB_WORKHORSE_REDIS_SENTINEL":                    "tcp://a:26379, tcp://b:26379",
+		"GITLAB_WORKHORSE_TRUSTED_CIDRS_FOR_X_FORWARDED_FOR": "10.0.0.0/8,192.168.0.0/16",
+		"GITLAB_WORKHORSE_PROFILING_ENABLED":                 "true",
+	})()
+
+	cfg, err := loadConfigString(t, `
+log_level = "info"
+
+[redis]
+Password = "from-file"
+`)
+	require.NoError(t, err)
+	require.Equal(t, "debug", cfg.LogLevel)
+	require.Equal(t, "s3cret", cfg.Redis.Password)
+	require.Equal(t, 2*time.Second, cfg.Redis.ReadTimeout.Duration)
+	require.Equal(t, 3, *cfg.Redis.MaxIdle)
+	require.Len(t, cfg.Redis.Sentinel, 2)
+	require.Equal(t, "b:26379", cfg.Redis.Sentinel[1].Host)
+	require.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, cfg.TrustedCIDRsForXForwardedFor)
+	require.True(t, cfg.Profiling.Enabled)
+	require.Nil(t, cfg.NATS, "sections without overrides must stay disabled")
+}
+
+func TestLoadConfigEnvOverrideCreatesSection(t *testing.T) {
+	defer setEnv(t, map[string]string{"GITLAB_WORKHORSE_REDIS_URL": "redis://localhost:6379"})()
+
+	cfg, err := loadConfigString(t, "")
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Redis)
+	require.Equal(t, "localhost:6379", cfg.Redis.URL.Host)
+}
+
+func TestLoadConfigInvalidEnvOverride(t *testing.T) {
+	for name, value := range map[string]string{
+		"GITLAB_WORKHORSE_REDIS_MAXIDLE": "many",
+		"GITLAB_WORKHORSE_REDIS_URL":     "redis://%zz",
+		"GITLAB_WORKHORSE_RATE_LIMIT":    "anything",
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer setEnv(t, map[string]string{name: value})()
+
+			_, err := loadConfigString(t, "")
+			require.Error(t, err)
+			require.Contains(t, err.Error(), name)
+		})
+	}
+}
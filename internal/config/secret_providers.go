@@ -0,0 +1,200 @@
+package config
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const secretFetchTimeout = 10 * time.Second
+
+var secretsHTTPClient = &http.Client{Timeout: secretFetchTimeout}
+
+// vaultProvider reads a key of a secret of a Vault KV secrets engine,
+// version 1 or 2: vault:secret/data/workhorse#redis_password
+type vaultProvider struct {
+	address string
+	token   string
+}
+
+func (v *vaultProvider) fetch(path string) (string, error) {
+	path, key := splitSecretKey(path)
+	if key == "" {
+		return "", fmt.Errorf("vault references need a #key")
+	}
+
+	req, err := http.NewRequest("GET", v.address+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := doSecretRequest(req, &body); err != nil {
+		return "", err
+	}
+
+	data := body.Data
+	// KV version 2 nests the secret and its metadata
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("no string %q in the secret", key)
+	}
+	return value, nil
+}
+
+// awsSMProvider reads a secret of AWS Secrets Manager, or a key of a
+// secret holding a JSON object: aws-sm:workhorse/redis#password
+type awsSMProvider struct {
+	region   string
+	endpoint string
+}
+
+func newAWSSMProvider(region string) *awsSMProvider {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	return &awsSMProvider{region: region, endpoint: strings.TrimSuffix(endpoint, "/")}
+}
+
+func (a *awsSMProvider) fetch(path string) (string, error) {
+	secretID, key := splitSecretKey(path)
+
+	payload, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", a.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if err := signAWSRequest(req, payload, a.region, "secretsmanager", time.Now()); err != nil {
+		return "", err
+	}
+
+	var body struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := doSecretRequest(req, &body); err != nil {
+		return "", err
+	}
+
+	if key == "" {
+		return body.SecretString, nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(body.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret is no JSON object: %v", err)
+	}
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("no string %q in the secret", key)
+	}
+	return value, nil
+}
+
+func doSecretRequest(req *http.Request, body interface{}) error {
+	resp, err := secretsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(body)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to req, with the
+// credentials of the environment
+func signAWSRequest(req *http.Request, payload []byte, region, service string, now time.Time) error {
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	// All headers are signed
+	signed := []string{"host"}
+	for name := range req.Header {
+		signed = append(signed, strings.ToLower(name))
+	}
+	sort.Strings(signed)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(value))
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+func canonicalPath(u *url.URL) string {
+	if path := u.EscapedPath(); path != "" {
+		return path
+	}
+	return "/"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
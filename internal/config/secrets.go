@@ -0,0 +1,202 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+const (
+	vaultScheme = "vault:"
+	awsSMScheme = "aws-sm:"
+
+	defaultSecretsRefreshInterval = 5 * time.Minute
+)
+
+// secretProvider fetches the secret at path, the part of a reference
+// after the scheme
+type secretProvider interface {
+	fetch(path string) (string, error)
+}
+
+// secretResolver caches the secrets of references, so that they are
+// fetched at startup and refreshed in the background rather than on
+// every use
+type secretResolver struct {
+	mu              sync.RWMutex
+	providers       map[string]secretProvider
+	refreshInterval time.Duration
+	cache           map[string]string
+}
+
+var secrets = &secretResolver{cache: make(map[string]string)}
+
+// IsSecretRef tells if value refers to a secret of a provider instead of
+// being the secret itself
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, vaultScheme) || strings.HasPrefix(value, awsSMScheme)
+}
+
+// ConfigureSecrets sets up the providers of secret references
+func ConfigureSecrets(cfg SecretsConfig) error {
+	providers := make(map[string]secretProvider)
+
+	vaultAddress := cfg.VaultAddress
+	if vaultAddress == "" {
+		vaultAddress = os.Getenv("VAULT_ADDR")
+	}
+	if vaultAddress != "" {
+		token := os.Getenv("VAULT_TOKEN")
+		if cfg.VaultTokenFile != "" {
+			data, err := ioutil.ReadFile(cfg.VaultTokenFile)
+			if err != nil {
+				return fmt.Errorf("secrets: VaultTokenFile: %v", err)
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		providers[vaultScheme] = &vaultProvider{address: strings.TrimSuffix(vaultAddress, "/"), token: token}
+	}
+
+	region := cfg.AWSRegion
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region != "" {
+		providers[awsSMScheme] = newAWSSMProvider(region)
+	}
+
+	interval := defaultSecretsRefreshInterval
+	if cfg.RefreshInterval != nil {
+		interval = cfg.RefreshInterval.Duration
+	}
+	if interval <= 0 {
+		return fmt.Errorf("secrets: RefreshInterval must be positive")
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	secrets.providers = providers
+	secrets.refreshInterval = interval
+
+	return nil
+}
+
+// ResolveSecret returns the secret value refers to, or value itself if it
+// is no reference. Secrets are fetched on first use and then cached.
+func ResolveSecret(value string) (string, error) {
+	if !IsSecretRef(value) {
+		return value, nil
+	}
+
+	secrets.mu.RLock()
+	secret, ok := secrets.cache[value]
+	secrets.mu.RUnlock()
+	if ok {
+		return secret, nil
+	}
+
+	secret, err := secrets.fetch(value)
+	if err != nil {
+		return "", err
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	secrets.cache[value] = secret
+
+	return secret, nil
+}
+
+// ResolveSecrets fetches the secrets referenced by cfg and by refs, other
+// settings like -secretPath, so that Workhorse doesn't start with secrets
+// it can't get
+func ResolveSecrets(cfg Config, refs ...string) error {
+	if cfg.Redis != nil {
+		refs = append(refs, cfg.Redis.Password)
+	}
+	refs = append(refs, cfg.FeatureFlags.InstanceID)
+	for _, c := range cfg.ObjectStorage {
+		refs = append(refs, c.AccessKeyID, c.SecretAccessKey)
+	}
+
+	for _, ref := range refs {
+		if _, err := ResolveSecret(ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RefreshSecrets fetches the cached secrets again every RefreshInterval.
+// If a secret can't be fetched, the cached value stays in use.
+func RefreshSecrets() {
+	for {
+		secrets.mu.RLock()
+		interval := secrets.refreshInterval
+		secrets.mu.RUnlock()
+		if interval <= 0 {
+			interval = defaultSecretsRefreshInterval
+		}
+
+		time.Sleep(interval)
+		secrets.refresh()
+	}
+}
+
+func (r *secretResolver) refresh() {
+	r.mu.RLock()
+	refs := make([]string, 0, len(r.cache))
+	for ref := range r.cache {
+		refs = append(refs, ref)
+	}
+	r.mu.RUnlock()
+
+	for _, ref := range refs {
+		secret, err := r.fetch(ref)
+		if err != nil {
+			log.WithError(err).Error("secrets: refresh failed, keeping the cached secret")
+			continue
+		}
+
+		r.mu.Lock()
+		r.cache[ref] = secret
+		r.mu.Unlock()
+	}
+}
+
+func (r *secretResolver) fetch(ref string) (string, error) {
+	scheme := vaultScheme
+	if strings.HasPrefix(ref, awsSMScheme) {
+		scheme = awsSMScheme
+	}
+
+	r.mu.RLock()
+	provider := r.providers[scheme]
+	r.mu.RUnlock()
+
+	if provider == nil {
+		return "", fmt.Errorf("secrets: %s: the %s provider is not configured", ref, strings.TrimSuffix(scheme, ":"))
+	}
+
+	secret, err := provider.fetch(strings.TrimPrefix(ref, scheme))
+	if err != nil {
+		// The reference is logged, never the secret
+		return "", fmt.Errorf("secrets: %s: %v", ref, err)
+	}
+
+	return secret, nil
+}
+
+// splitSecretKey splits <path>#<key>
+func splitSecretKey(path string) (string, string) {
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
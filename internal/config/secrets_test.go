@@ -0,0 +1,121 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func resetSecrets() {
+	secrets = &secretResolver{cache: make(map[string]string)}
+}
+
+func TestResolveVaultSecret(t *testing.T) {
+	defer resetSecrets()
+
+	password := "first"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/secret/data/workhorse", r.URL.Path)
+		require.Equal(t, "s.token", r.Header.Get("X-Vault-Token"))
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]string{"redis_password": password},
+				"metadata": map[string]interface{}{"version": 1},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	defer setEnv(t, map[string]string{"VAULT_ADDR": ts.URL, "VAULT_TOKEN": "s.token"})()
+	require.NoError(t, ConfigureSecrets(SecretsConfig{}))
+
+	ref := "vault:secret/data/workhorse#redis_password"
+	require.NoError(t, ResolveSecrets(Config{Redis: &RedisConfig{Password: ref}}))
+
+	password = "second"
+	value, err := ResolveSecret(ref)
+	require.NoError(t, err)
+	require.Equal(t, "first", value, "secrets must be cached")
+
+	secrets.refresh()
+	value, err = ResolveSecret(ref)
+	require.NoError(t, err)
+	require.Equal(t, "second", value, "secrets must be refreshed")
+
+	ts.Close()
+	secrets.refresh()
+	value, err = ResolveSecret(ref)
+	require.NoError(t, err)
+	require.Equal(t, "second", value, "failed refreshes must keep the cached secret")
+
+	_, err = ResolveSecret("vault:secret/data/workhorse#missing")
+	require.Error(t, err)
+}
+
+func TestResolveAWSSMSecret(t *testing.T) {
+	defer resetSecrets()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		require.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request")
+
+		var req struct{ SecretId string }
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "workhorse/redis", req.SecretId)
+
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"password":"from-aws"}`})
+	}))
+	defer ts.Close()
+
+	defer setEnv(t, map[string]string{
+		"AWS_ENDPOINT_URL_SECRETS_MANAGER": ts.URL,
+		"AWS_ACCESS_KEY_ID":                "AKID",
+		"AWS_SECRET_ACCESS_KEY":            "secret",
+	})()
+	require.NoError(t, ConfigureSecrets(SecretsConfig{AWSRegion: "eu-west-1"}))
+
+	value, err := ResolveSecret("aws-sm:workhorse/redis#password")
+	require.NoError(t, err)
+	require.Equal(t, "from-aws", value)
+
+	value, err = ResolveSecret("aws-sm:workhorse/redis")
+	require.NoError(t, err)
+	require.Equal(t, `{"password":"from-aws"}`, value)
+}
+
+func TestResolveSecretWithoutProvider(t *testing.T) {
+	defer resetSecrets()
+	require.NoError(t, ConfigureSecrets(SecretsConfig{}))
+
+	value, err := ResolveSecret("plain")
+	require.NoError(t, err)
+	require.Equal(t, "plain", value)
+
+	_, err = ResolveSecret("aws-sm:workhorse/redis")
+	require.Error(t, err)
+}
+
+// The get-vanilla example of the AWS Signature Version 4 test suite
+func TestSignAWSRequest(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	})()
+
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	require.NoError(t, err)
+	now, err := time.Parse("20060102T150405Z", "20150830T123600Z")
+	require.NoError(t, err)
+
+	require.NoError(t, signAWSRequest(req, nil, "us-east-1", "service", now))
+	require.Equal(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
@@ -0,0 +1,105 @@
+/*
+Package correlationid gives every request a correlation ID.
+
+The ID is stored in the request context, where the labkit round trippers
+and gRPC interceptors find it to send it to Rails, object storage and
+Gitaly. It also replaces the X-Request-Id header of the request, so that
+errors reported with the request carry it too.
+*/
+package correlationid
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const (
+	PropagationRegenerate   = "regenerate"
+	PropagationTrust        = "trust"
+	PropagationTrustProxies = "trust_proxies"
+	PropagationNamespace    = "namespace"
+
+	header = "X-Request-Id"
+)
+
+// Incoming IDs end up in logs and headers, so only harmless ones are kept
+var validID = regexp.MustCompile(`\A[\w.:/+=-]{1,128}\z`)
+
+var (
+	policyMu sync.RWMutex
+	policy   config.CorrelationConfig
+)
+
+// Configure sets the propagation policy of Inject
+func Configure(cfg config.CorrelationConfig) error {
+	switch cfg.Propagation {
+	case "", PropagationRegenerate, PropagationTrust, PropagationTrustProxies, PropagationNamespace:
+	default:
+		return fmt.Errorf("correlation: unknown Propagation %q", cfg.Propagation)
+	}
+
+	if cfg.Prefix != "" && !validID.MatchString(cfg.Prefix) {
+		return fmt.Errorf("correlation: invalid Prefix %q", cfg.Prefix)
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = cfg
+
+	return nil
+}
+
+// Inject gives requests handled by h a correlation ID
+func Inject(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policyMu.RLock()
+		cfg := policy
+		policyMu.RUnlock()
+
+		id := correlationID(r, cfg)
+		r.Header.Set(header, id)
+
+		h.ServeHTTP(w, r.WithContext(correlation.ContextWithCorrelation(r.Context(), id)))
+	})
+}
+
+func correlationID(r *http.Request, cfg config.CorrelationConfig) string {
+	incoming := r.Header.Get(header)
+	if !validID.MatchString(incoming) {
+		incoming = ""
+	}
+
+	if incoming != "" {
+		switch cfg.Propagation {
+		case PropagationTrust:
+			return incoming
+		case PropagationTrustProxies:
+			if helper.IsTrustedPeer(r) {
+				return incoming
+			}
+		case PropagationNamespace:
+			return incoming + ":" + generate(cfg.Prefix)
+		}
+	}
+
+	return generate(cfg.Prefix)
+}
+
+func generate(prefix string) string {
+	id, err := correlation.RandomID()
+	if err != nil {
+		// Good enough to tell requests apart if the random source fails
+		id = "E" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return prefix + id
+}
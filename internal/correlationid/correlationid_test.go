@@ -0,0 +1,84 @@
+package correlationid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/labkit/correlation"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func injectedID(t *testing.T, remoteAddr, incoming string) string {
+	var id string
+	h := Inject(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = correlation.ExtractFromContext(r.Context())
+		require.Equal(t, id, r.Header.Get("X-Request-Id"), "header matches context")
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remoteAddr
+	if incoming != "" {
+		r.Header.Set("X-Request-Id", incoming)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	require.NotEmpty(t, id)
+	return id
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure(config.CorrelationConfig{})
+
+	require.Error(t, Configure(config.CorrelationConfig{Propagation: "sometimes"}))
+	require.Error(t, Configure(config.CorrelationConfig{Prefix: "has spaces"}))
+	require.NoError(t, Configure(config.CorrelationConfig{Propagation: PropagationTrust, Prefix: "wh1-"}))
+}
+
+func TestPropagation(t *testing.T) {
+	require.NoError(t, helper.ConfigureTrustedProxies([]string{"10.0.0.0/8"}))
+	defer helper.ConfigureTrustedProxies(nil)
+	defer Configure(config.CorrelationConfig{})
+
+	testCases := []struct {
+		propagation string
+		remoteAddr  string
+		incoming    string
+		kept        bool
+	}{
+		{propagation: "", remoteAddr: "10.0.0.1:1234", incoming: "abc123"},
+		{propagation: PropagationRegenerate, remoteAddr: "10.0.0.1:1234", incoming: "abc123"},
+		{propagation: PropagationTrust, remoteAddr: "18.245.0.1:1234", incoming: "abc123", kept: true},
+		{propagation: PropagationTrust, remoteAddr: "18.245.0.1:1234", incoming: "<script>"},
+		{propagation: PropagationTrust, remoteAddr: "18.245.0.1:1234", incoming: strings.Repeat("a", 129)},
+		{propagation: PropagationTrustProxies, remoteAddr: "10.0.0.1:1234", incoming: "abc123", kept: true},
+		{propagation: PropagationTrustProxies, remoteAddr: "18.245.0.1:1234", incoming: "abc123"},
+	}
+
+	for _, tc := range testCases {
+		require.NoError(t, Configure(config.CorrelationConfig{Propagation: tc.propagation}))
+
+		id := injectedID(t, tc.remoteAddr, tc.incoming)
+		if tc.kept {
+			require.Equal(t, tc.incoming, id, "%+v", tc)
+		} else {
+			require.NotEqual(t, tc.incoming, id, "%+v", tc)
+		}
+	}
+}
+
+func TestNamespaceAndPrefix(t *testing.T) {
+	defer Configure(config.CorrelationConfig{})
+	require.NoError(t, Configure(config.CorrelationConfig{Propagation: PropagationNamespace, Prefix: "wh1-"}))
+
+	id := injectedID(t, "18.245.0.1:1234", "lb-42")
+	require.True(t, strings.HasPrefix(id, "lb-42:wh1-"), id)
+	require.NotEqual(t, id, injectedID(t, "18.245.0.1:1234", "lb-42"), "every request gets its own ID")
+
+	id = injectedID(t, "18.245.0.1:1234", "")
+	require.True(t, strings.HasPrefix(id, "wh1-"), id)
+}
@@ -0,0 +1,168 @@
+/*
+Package crossorigin sets the CORS and Cross-Origin-Resource-Policy headers
+of user content downloads, as directed by Rails in a signed response
+header, so that the pages allowed to embed or read user content are
+decided in one place.
+*/
+package crossorigin
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/downloadpolicy"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+)
+
+// Header is the response header in which Rails sends the Claims. Workhorse
+// removes it before the response leaves.
+const Header = "Gitlab-Workhorse-Cross-Origin-Policy"
+
+const (
+	ResourcePolicySameOrigin  = "same-origin"
+	ResourcePolicySameSite    = "same-site"
+	ResourcePolicyCrossOrigin = "cross-origin"
+
+	resourcePolicyHeader = "Cross-Origin-Resource-Policy"
+	anyOrigin            = "*"
+)
+
+var crossOriginResponses = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_cross_origin_policy_responses",
+		Help: "How many user content responses had a cross-origin policy applied, by Cross-Origin-Resource-Policy. Invalid policies are counted as 'invalid'.",
+	},
+	[]string{"resource_policy"},
+)
+
+func init() {
+	prometheus.MustRegister(crossOriginResponses)
+}
+
+var (
+	mu                    sync.RWMutex
+	defaultResourcePolicy string
+)
+
+// Claims tell which other sites may embed a user content response, and
+// which origins may read it with CORS
+type Claims struct {
+	// ResourcePolicy is the Cross-Origin-Resource-Policy of the response
+	ResourcePolicy string `json:"resource_policy"`
+	// AllowedOrigins may read the response with CORS. "*" allows all
+	// origins.
+	AllowedOrigins []string `json:"allowed_origins"`
+	// AllowCredentials lets the allowed origins read the response of
+	// requests with cookies
+	AllowCredentials bool `json:"allow_credentials"`
+	jwt.StandardClaims
+}
+
+// Configure sets the Cross-Origin-Resource-Policy of the user content
+// downloads Rails sent no cross-origin policy for
+func Configure(cfg config.CrossOriginConfig) error {
+	if cfg.ResourcePolicy != "" && !validResourcePolicy(cfg.ResourcePolicy) {
+		return fmt.Errorf("unknown ResourcePolicy %q", cfg.ResourcePolicy)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	defaultResourcePolicy = cfg.ResourcePolicy
+
+	return nil
+}
+
+func getDefaultResourcePolicy() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultResourcePolicy
+}
+
+func validResourcePolicy(policy string) bool {
+	switch policy {
+	case ResourcePolicySameOrigin, ResourcePolicySameSite, ResourcePolicyCrossOrigin:
+		return true
+	}
+	return false
+}
+
+// Filter applies the cross-origin policy set by Rails, if any, to the
+// response of h. Responses with a download policy and no cross-origin
+// policy are user content too, they get the configured default. Filter
+// must run before downloadpolicy.Filter removes its header.
+func Filter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(helper.NewHeaderRewritingResponseWriter(w, func(header http.Header) {
+			apply(r, header)
+		}), r)
+	})
+}
+
+// apply turns the policy header into Cross-Origin-Resource-Policy and CORS
+// headers
+func apply(r *http.Request, h http.Header) {
+	token := h.Get(Header)
+	h.Del(Header)
+
+	if token == "" {
+		if policy := getDefaultResourcePolicy(); policy != "" && h.Get(downloadpolicy.Header) != "" {
+			h.Set(resourcePolicyHeader, policy)
+			crossOriginResponses.WithLabelValues(policy).Inc()
+		}
+		return
+	}
+
+	claims := &Claims{}
+	if err := secret.ParseJWT(token, claims); err != nil || !validResourcePolicy(claims.ResourcePolicy) {
+		if err == nil {
+			err = fmt.Errorf("unknown resource policy %q", claims.ResourcePolicy)
+		}
+		// Fail closed: no other origin may embed or read the response
+		helper.LogError(r, fmt.Errorf("crossorigin: %v", err))
+		h.Set(resourcePolicyHeader, ResourcePolicySameOrigin)
+		crossOriginResponses.WithLabelValues("invalid").Inc()
+		return
+	}
+
+	h.Set(resourcePolicyHeader, claims.ResourcePolicy)
+	allowOrigin(r, h, claims)
+	crossOriginResponses.WithLabelValues(claims.ResourcePolicy).Inc()
+}
+
+// allowOrigin sets the CORS headers for the Origin of the request, if the
+// policy allows it
+func allowOrigin(r *http.Request, h http.Header, claims *Claims) {
+	if len(claims.AllowedOrigins) == 0 {
+		return
+	}
+	// Caches must keep the responses to each origin apart
+	h.Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	for _, allowed := range claims.AllowedOrigins {
+		if allowed != origin && allowed != anyOrigin {
+			continue
+		}
+
+		if allowed == anyOrigin && !claims.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", anyOrigin)
+		} else {
+			// Browsers refuse "*" for requests with credentials
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if claims.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		return
+	}
+}
@@ -0,0 +1,129 @@
+package crossorigin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/downloadpolicy"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func signedPolicy(t *testing.T, claims *Claims) string {
+	token, err := secret.JWTTokenString(claims)
+	require.NoError(t, err)
+	return token
+}
+
+func TestFilter(t *testing.T) {
+	testhelper.ConfigureSecret()
+	require.NoError(t, Configure(config.CrossOriginConfig{ResourcePolicy: ResourcePolicySameSite}))
+	defer Configure(config.CrossOriginConfig{})
+
+	testCases := []struct {
+		desc             string
+		policy           string
+		downloadPolicy   bool
+		origin           string
+		resourcePolicy   string
+		allowOrigin      string
+		allowCredentials string
+		vary             string
+	}{
+		{
+			desc: "no policy leaves the response alone",
+		},
+		{
+			desc:           "user content without a policy gets the default",
+			downloadPolicy: true,
+			resourcePolicy: ResourcePolicySameSite,
+		},
+		{
+			desc:           "resource policy only",
+			policy:         signedPolicy(t, &Claims{ResourcePolicy: ResourcePolicyCrossOrigin}),
+			origin:         "https://example.com",
+			resourcePolicy: ResourcePolicyCrossOrigin,
+		},
+		{
+			desc:           "allowed origin",
+			policy:         signedPolicy(t, &Claims{ResourcePolicy: ResourcePolicyCrossOrigin, AllowedOrigins: []string{"https://example.com"}}),
+			origin:         "https://example.com",
+			resourcePolicy: ResourcePolicyCrossOrigin,
+			allowOrigin:    "https://example.com",
+			vary:           "Origin",
+		},
+		{
+			desc:           "other origin",
+			policy:         signedPolicy(t, &Claims{ResourcePolicy: ResourcePolicyCrossOrigin, AllowedOrigins: []string{"https://example.com"}}),
+			origin:         "https://evil.example",
+			resourcePolicy: ResourcePolicyCrossOrigin,
+			vary:           "Origin",
+		},
+		{
+			desc:           "any origin",
+			policy:         signedPolicy(t, &Claims{ResourcePolicy: ResourcePolicyCrossOrigin, AllowedOrigins: []string{"*"}}),
+			origin:         "https://example.com",
+			resourcePolicy: ResourcePolicyCrossOrigin,
+			allowOrigin:    "*",
+			vary:           "Origin",
+		},
+		{
+			desc:             "any origin with credentials",
+			policy:           signedPolicy(t, &Claims{ResourcePolicy: ResourcePolicySameSite, AllowedOrigins: []string{"*"}, AllowCredentials: true}),
+			origin:           "https://example.com",
+			resourcePolicy:   ResourcePolicySameSite,
+			allowOrigin:      "https://example.com",
+			allowCredentials: "true",
+			vary:             "Origin",
+		},
+		{
+			desc:           "invalid signature fails closed",
+			policy:         signedPolicy(t, &Claims{ResourcePolicy: ResourcePolicyCrossOrigin, AllowedOrigins: []string{"*"}}) + "x",
+			origin:         "https://example.com",
+			resourcePolicy: ResourcePolicySameOrigin,
+		},
+		{
+			desc:           "unknown resource policy fails closed",
+			policy:         signedPolicy(t, &Claims{ResourcePolicy: "anywhere", AllowedOrigins: []string{"*"}}),
+			origin:         "https://example.com",
+			resourcePolicy: ResourcePolicySameOrigin,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tc.policy != "" {
+					w.Header().Set(Header, tc.policy)
+				}
+				if tc.downloadPolicy {
+					w.Header().Set(downloadpolicy.Header, "policy")
+				}
+				w.Write([]byte("content"))
+			})
+
+			r := httptest.NewRequest("GET", "/download", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+			Filter(h).ServeHTTP(w, r)
+
+			resp := w.Result()
+			require.Equal(t, tc.resourcePolicy, resp.Header.Get("Cross-Origin-Resource-Policy"))
+			require.Equal(t, tc.allowOrigin, resp.Header.Get("Access-Control-Allow-Origin"))
+			require.Equal(t, tc.allowCredentials, resp.Header.Get("Access-Control-Allow-Credentials"))
+			require.Equal(t, tc.vary, resp.Header.Get("Vary"))
+			require.Empty(t, resp.Header.Get(Header), "policy header must not reach the client")
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	require.Error(t, Configure(config.CrossOriginConfig{ResourcePolicy: "anywhere"}))
+	require.NoError(t, Configure(config.CrossOriginConfig{}))
+}
@@ -0,0 +1,254 @@
+/*
+Package dependencyproxy serves the blobs and manifests of the GitLab
+dependency proxy for container images when Rails hasn't cached them yet.
+
+Rails answers the pull with a send-dependency header that holds the URL of
+the upstream registry and the headers to fetch it with, including the
+bearer token Rails got from the registry. Workhorse streams the upstream
+response to the client and, at the same time, uploads it through the
+/upload/authorize and /upload endpoints of the pull, so that Rails caches
+it in object storage. The bandwidth of the pull never goes through Rails.
+*/
+package dependencyproxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/mask"
+	"gitlab.com/gitlab-org/labkit/tracing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+// Injector is the send-dependency injecter. It needs an upload handler,
+// set with SetUploadHandler, to cache what it sends.
+type Injector struct {
+	senddata.Prefix
+	uploadHandler http.Handler
+}
+
+type entryParams struct {
+	URL    string
+	Header http.Header
+}
+
+// The headers of the upstream response that are passed on to the client
+// and to Rails
+var forwardedHeaderKeys = []string{
+	"Content-Type",
+	"Content-Length",
+	"Docker-Content-Digest",
+	"Docker-Distribution-Api-Version",
+	"Etag",
+}
+
+// Registries redirect blob downloads to object storage or a CDN. Go drops
+// the Authorization header when a redirect leaves the host.
+var httpClient = &http.Client{
+	Transport: tracing.NewRoundTripper(correlation.NewInstrumentedRoundTripper(&http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          2,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	})),
+}
+
+var (
+	dependencyProxyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_dependency_proxy_requests",
+			Help: "How many dependency proxy requests gitlab-workhorse has processed, by result",
+		},
+		[]string{"result"},
+	)
+	dependencyProxyBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_dependency_proxy_bytes",
+			Help: "How many bytes gitlab-workhorse has sent from upstream registries",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(dependencyProxyRequests, dependencyProxyBytes)
+}
+
+// NewInjector returns a send-dependency injecter
+func NewInjector() *Injector {
+	return &Injector{Prefix: "send-dependency:"}
+}
+
+// SetUploadHandler sets the handler of the uploads that cache the
+// dependencies. It is called with POST requests to the path of the pull
+// followed by /upload.
+func (p *Injector) SetUploadHandler(uploadHandler http.Handler) {
+	p.uploadHandler = uploadHandler
+}
+
+func (p *Injector) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params entryParams
+	if err := p.Unpack(&params, sendData); err != nil {
+		dependencyProxyRequests.WithLabelValues("invalid-data").Inc()
+		helper.Fail500(w, r, fmt.Errorf("dependency proxy: unpack sendData: %v", err))
+		return
+	}
+	if params.URL == "" {
+		dependencyProxyRequests.WithLabelValues("invalid-data").Inc()
+		helper.Fail500(w, r, fmt.Errorf("dependency proxy: URL is empty"))
+		return
+	}
+	if p.uploadHandler == nil {
+		helper.Fail500(w, r, fmt.Errorf("dependency proxy: no upload handler"))
+		return
+	}
+
+	log.WithContextFields(r.Context(), log.Fields{
+		"url":  mask.URL(params.URL),
+		"path": r.URL.Path,
+	}).Info("dependency proxy: fetching")
+
+	resp, err := fetch(r, params)
+	if err != nil {
+		dependencyProxyRequests.WithLabelValues("request-failed").Inc()
+		helper.Fail500(w, r, fmt.Errorf("dependency proxy: fetch: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	// Errors of the registry, like 401 or 404, go to the client as they
+	// are and are not cached
+	if resp.StatusCode != http.StatusOK {
+		dependencyProxyRequests.WithLabelValues("upstream-error").Inc()
+		forwardHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		helper.Copy(w, resp.Body)
+		return
+	}
+
+	// The client gets the body while it is uploaded
+	body := &countingReader{r: io.TeeReader(resp.Body, w)}
+	uploadReq, err := newUploadRequest(r, resp, body)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("dependency proxy: %v", err))
+		return
+	}
+	forwardHeaders(w.Header(), resp.Header)
+
+	uploadResponse := &uploadResponseWriter{header: make(http.Header)}
+	p.uploadHandler.ServeHTTP(uploadResponse, uploadReq)
+
+	// If Rails refused the upload or it failed, the client still gets the
+	// rest of the body
+	_, copyErr := io.Copy(ioutil.Discard, body)
+	dependencyProxyBytes.Add(float64(body.n))
+	if copyErr != nil {
+		dependencyProxyRequests.WithLabelValues("request-failed").Inc()
+		helper.LogError(r, fmt.Errorf("dependency proxy: copy response: %v", copyErr))
+		return
+	}
+
+	if uploadResponse.status != http.StatusOK {
+		dependencyProxyRequests.WithLabelValues("cache-failed").Inc()
+		log.WithContextFields(r.Context(), log.Fields{
+			"url":  mask.URL(params.URL),
+			"path": r.URL.Path,
+			"code": uploadResponse.status,
+		}).Error("dependency proxy: caching failed")
+		return
+	}
+
+	dependencyProxyRequests.WithLabelValues("cached").Inc()
+}
+
+func fetch(r *http.Request, params entryParams) (*http.Response, error) {
+	req, err := http.NewRequest("GET", params.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(r.Context())
+	for key, values := range params.Header {
+		req.Header[key] = values
+	}
+
+	return httpClient.Do(req)
+}
+
+// newUploadRequest returns the request that uploads body, the body of
+// resp, to Rails
+func newUploadRequest(r *http.Request, resp *http.Response, body io.Reader) (*http.Request, error) {
+	u := *r.URL
+	u.Path += "/upload"
+	u.RawPath = ""
+
+	req, err := http.NewRequest("POST", u.String(), ioutil.NopCloser(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(filestore.WithUploadType(r.Context(), filestore.UploadTypeDependencyProxy))
+
+	req.Header = helper.HeaderClone(r.Header)
+	forwardHeaders(req.Header, resp.Header)
+	req.ContentLength = resp.ContentLength
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+
+	return req, nil
+}
+
+func forwardHeaders(dst http.Header, src http.Header) {
+	for _, key := range forwardedHeaderKeys {
+		if values, ok := src[key]; ok {
+			dst[key] = values
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadResponseWriter keeps the response of the upload from the client
+type uploadResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *uploadResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *uploadResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return len(data), nil
+}
+
+func (w *uploadResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
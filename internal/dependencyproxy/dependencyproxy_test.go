@@ -0,0 +1,121 @@
+package dependencyproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	blobPath    = "/v2/group/dependency_proxy/containers/alpine/blobs/sha256:abc"
+	blobContent = "layer data"
+	blobDigest  = "sha256:abc"
+)
+
+type uploadHandler struct {
+	called bool
+	path   string
+	body   string
+	digest string
+	status int
+}
+
+func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.called = true
+	h.path = r.URL.Path
+	h.digest = r.Header.Get("Docker-Content-Digest")
+	if h.status != http.StatusOK {
+		w.WriteHeader(h.status)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	h.body = string(body)
+}
+
+func registry(t *testing.T, status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer registry-token", r.Header.Get("Authorization"))
+
+		w.Header().Set("Docker-Content-Digest", blobDigest)
+		w.Header().Set("Set-Cookie", "upstream=1")
+		w.WriteHeader(status)
+		w.Write([]byte(blobContent))
+	}))
+}
+
+func sendData(t *testing.T, url string) string {
+	params := entryParams{
+		URL:    url,
+		Header: http.Header{"Authorization": {"Bearer registry-token"}},
+	}
+	data, err := json.Marshal(params)
+	require.NoError(t, err)
+	return "send-dependency:" + base64.URLEncoding.EncodeToString(data)
+}
+
+func inject(t *testing.T, h *uploadHandler, sendData string) *httptest.ResponseRecorder {
+	injector := NewInjector()
+	injector.SetUploadHandler(h)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", blobPath, nil)
+	injector.Inject(w, r, sendData)
+	return w
+}
+
+func TestInject(t *testing.T) {
+	server := registry(t, http.StatusOK)
+	defer server.Close()
+
+	h := &uploadHandler{status: http.StatusOK}
+	w := inject(t, h, sendData(t, server.URL+"/v2/library/alpine/blobs/sha256:abc"))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, blobContent, w.Body.String())
+	require.Equal(t, blobDigest, w.Header().Get("Docker-Content-Digest"))
+	require.Empty(t, w.Header().Get("Set-Cookie"))
+
+	require.Equal(t, blobPath+"/upload", h.path)
+	require.Equal(t, blobContent, h.body)
+	require.Equal(t, blobDigest, h.digest)
+}
+
+func TestInjectUploadRefused(t *testing.T) {
+	server := registry(t, http.StatusOK)
+	defer server.Close()
+
+	h := &uploadHandler{status: http.StatusForbidden}
+	w := inject(t, h, sendData(t, server.URL+"/blob"))
+
+	require.True(t, h.called)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, blobContent, w.Body.String())
+}
+
+func TestInjectUpstreamError(t *testing.T) {
+	server := registry(t, http.StatusNotFound)
+	defer server.Close()
+
+	h := &uploadHandler{status: http.StatusOK}
+	w := inject(t, h, sendData(t, server.URL+"/blob"))
+
+	require.False(t, h.called)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, blobContent, w.Body.String())
+}
+
+func TestInjectInvalidData(t *testing.T) {
+	h := &uploadHandler{status: http.StatusOK}
+
+	for _, data := range []string{"send-dependency:not base64", sendData(t, "")} {
+		w := inject(t, h, data)
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	}
+	require.False(t, h.called)
+}
@@ -0,0 +1,105 @@
+/*
+Package downloadpolicy enforces safe Content-Disposition and Content-Type
+combinations on downloads, as directed by Rails in a signed response header.
+*/
+package downloadpolicy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+)
+
+// Header carries the policy as a JWT signed with the Workhorse secret
+const Header = "Gitlab-Workhorse-Download-Policy"
+
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+var downloadPolicyResponses = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_download_policy_responses",
+		Help: "How many responses had a download policy applied, by resulting disposition. Invalid policies are counted as 'invalid'.",
+	},
+	[]string{"disposition"},
+)
+
+func init() {
+	prometheus.MustRegister(downloadPolicyResponses)
+}
+
+// Claims are set by Rails for responses that serve user content
+type Claims struct {
+	// Disposition is the one Rails would like to use. Inline is only
+	// honoured for types that are safe to render in the browser.
+	Disposition string `json:"disposition"`
+	// Filename is sent to the client in Content-Disposition
+	Filename string `json:"filename"`
+	jwt.StandardClaims
+}
+
+// Filter applies the download policy set by Rails, if any, to the response
+// of h
+func Filter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(helper.NewHeaderRewritingResponseWriter(w, func(header http.Header) {
+			apply(r, header)
+		}), r)
+	})
+}
+
+// apply replaces the policy header by the Content-Disposition and
+// Content-Type it calls for
+func apply(r *http.Request, h http.Header) {
+	token := h.Get(Header)
+	if token == "" {
+		return
+	}
+	h.Del(Header)
+
+	claims := &Claims{}
+	metricLabel := ""
+	if err := secret.ParseJWT(token, claims); err != nil {
+		// Fail closed: a download is always safe
+		helper.LogError(r, fmt.Errorf("downloadpolicy: %v", err))
+		claims = &Claims{Disposition: DispositionAttachment, Filename: currentFilename(h)}
+		metricLabel = "invalid"
+	}
+
+	disposition := DispositionAttachment
+	if claims.Disposition == DispositionInline {
+		if contentType, ok := headers.InlineContentType(h.Get(headers.ContentTypeHeader)); ok {
+			h.Set(headers.ContentTypeHeader, contentType)
+			disposition = DispositionInline
+		}
+	}
+
+	params := map[string]string{}
+	if claims.Filename != "" {
+		params["filename"] = claims.Filename
+	}
+	h.Set(headers.ContentDispositionHeader, mime.FormatMediaType(disposition, params))
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if metricLabel == "" {
+		metricLabel = disposition
+	}
+	downloadPolicyResponses.WithLabelValues(metricLabel).Inc()
+}
+
+func currentFilename(h http.Header) string {
+	_, params, err := mime.ParseMediaType(h.Get(headers.ContentDispositionHeader))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
@@ -0,0 +1,126 @@
+package downloadpolicy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func signedPolicy(t *testing.T, claims *Claims) string {
+	token, err := secret.JWTTokenString(claims)
+	require.NoError(t, err)
+	return token
+}
+
+func TestFilter(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	testCases := []struct {
+		desc               string
+		policy             string
+		contentType        string
+		contentDisposition string
+		expectedType       string
+		expectedDisp       string
+	}{
+		{
+			desc:         "no policy leaves the response alone",
+			contentType:  "text/html",
+			expectedType: "text/html",
+			expectedDisp: "",
+		},
+		{
+			desc:         "inline image",
+			policy:       signedPolicy(t, &Claims{Disposition: DispositionInline, Filename: "cat.png"}),
+			contentType:  "image/png",
+			expectedType: "image/png",
+			expectedDisp: `inline; filename=cat.png`,
+		},
+		{
+			desc:         "inline HTML is rendered as text",
+			policy:       signedPolicy(t, &Claims{Disposition: DispositionInline, Filename: "page.html"}),
+			contentType:  "text/html; charset=utf-8",
+			expectedType: "text/plain; charset=utf-8",
+			expectedDisp: `inline; filename=page.html`,
+		},
+		{
+			desc:         "inline SVG is downloaded",
+			policy:       signedPolicy(t, &Claims{Disposition: DispositionInline, Filename: "logo.svg"}),
+			contentType:  "image/svg+xml",
+			expectedType: "image/svg+xml",
+			expectedDisp: `attachment; filename=logo.svg`,
+		},
+		{
+			desc:         "inline binary is downloaded",
+			policy:       signedPolicy(t, &Claims{Disposition: DispositionInline}),
+			contentType:  "application/octet-stream",
+			expectedType: "application/octet-stream",
+			expectedDisp: `attachment`,
+		},
+		{
+			desc:         "attachment",
+			policy:       signedPolicy(t, &Claims{Disposition: DispositionAttachment, Filename: "cat.png"}),
+			contentType:  "image/png",
+			expectedType: "image/png",
+			expectedDisp: `attachment; filename=cat.png`,
+		},
+		{
+			desc:         "non-ASCII filename",
+			policy:       signedPolicy(t, &Claims{Disposition: DispositionAttachment, Filename: "résumé.pdf"}),
+			contentType:  "application/pdf",
+			expectedType: "application/pdf",
+			expectedDisp: `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf`,
+		},
+		{
+			desc:               "invalid signature fails closed",
+			policy:             signedPolicy(t, &Claims{Disposition: DispositionInline, Filename: "page.html"}) + "x",
+			contentType:        "text/html",
+			contentDisposition: `inline; filename="page.html"`,
+			expectedType:       "text/html",
+			expectedDisp:       `attachment; filename=page.html`,
+		},
+		{
+			desc: "expired policy fails closed",
+			policy: signedPolicy(t, &Claims{
+				Disposition:    DispositionInline,
+				StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+			}),
+			contentType:  "image/png",
+			expectedType: "image/png",
+			expectedDisp: `attachment`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tc.policy != "" {
+					w.Header().Set(Header, tc.policy)
+				}
+				w.Header().Set("Content-Type", tc.contentType)
+				if tc.contentDisposition != "" {
+					w.Header().Set("Content-Disposition", tc.contentDisposition)
+				}
+				w.Write([]byte("content"))
+			})
+
+			w := httptest.NewRecorder()
+			Filter(h).ServeHTTP(w, httptest.NewRequest("GET", "/download", nil))
+
+			resp := w.Result()
+			require.Equal(t, tc.expectedType, resp.Header.Get("Content-Type"))
+			require.Equal(t, tc.expectedDisp, resp.Header.Get("Content-Disposition"))
+			require.Empty(t, resp.Header.Get(Header), "policy header must not reach the client")
+			if tc.policy != "" {
+				require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+			}
+		})
+	}
+}
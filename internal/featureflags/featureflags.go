@@ -0,0 +1,154 @@
+/*
+Package featureflags lets new Workhorse behaviour be rolled out per user
+without command line flags and restarts.
+
+The flags are fetched from an Unleash compatible API, like the one GitLab
+offers for the feature flags of a project, and refreshed in the
+background. Until they are fetched, and for flags the API doesn't know,
+the Defaults of the config apply.
+*/
+package featureflags
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
+)
+
+const (
+	defaultAppName         = "production"
+	defaultRefreshInterval = 15 * time.Second
+)
+
+type settings struct {
+	url             string
+	appName         string
+	instanceID      string
+	refreshInterval time.Duration
+	defaults        map[string]bool
+}
+
+var (
+	mu        sync.RWMutex
+	current   = settings{refreshInterval: defaultRefreshInterval}
+	flags     map[string]flag
+	refreshed time.Time
+
+	refreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_feature_flags_refreshes_total",
+			Help: "How many times gitlab-workhorse fetched the feature flags, by result.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(refreshes)
+}
+
+// Configure sets where the flags are fetched from and their defaults.
+// Flags fetched before are kept until the next refresh.
+func Configure(cfg config.FeatureFlagsConfig) error {
+	s := settings{
+		url:             cfg.URL,
+		appName:         cfg.AppName,
+		instanceID:      cfg.InstanceID,
+		refreshInterval: defaultRefreshInterval,
+		defaults:        cfg.Defaults,
+	}
+	if s.appName == "" {
+		s.appName = defaultAppName
+	}
+	if cfg.RefreshInterval != nil {
+		if cfg.RefreshInterval.Duration <= 0 {
+			return fmt.Errorf("RefreshInterval must be positive")
+		}
+		s.refreshInterval = cfg.RefreshInterval.Duration
+	}
+	if s.url != "" {
+		u, err := url.Parse(s.url)
+		if err != nil {
+			return fmt.Errorf("URL: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("URL must start with http:// or https://, got %q", s.url)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if s.url != current.url {
+		flags = nil
+	}
+	current = s
+
+	status.Register("feature_flags", featureFlagsStatus)
+
+	return nil
+}
+
+// Enabled tells if the flag name is on for the user with userID, which may
+// be empty for anonymous requests
+func Enabled(name string, userID string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if f, ok := flags[name]; ok {
+		return f.enabled(userID)
+	}
+	return current.defaults[name]
+}
+
+// Process refreshes the flags every RefreshInterval
+func Process() {
+	for {
+		mu.RLock()
+		s := current
+		mu.RUnlock()
+
+		if s.url != "" {
+			refresh(s)
+		}
+		time.Sleep(s.refreshInterval)
+	}
+}
+
+func refresh(s settings) {
+	fetched, err := fetchFlags(s)
+	if err != nil {
+		refreshes.WithLabelValues("error").Inc()
+		log.WithError(err).Error("featureflags: refresh failed, keeping the current flags")
+		return
+	}
+	refreshes.WithLabelValues("success").Inc()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The config may have changed while fetching
+	if s.url != current.url {
+		return
+	}
+	flags = fetched
+	refreshed = time.Now()
+}
+
+func featureFlagsStatus() interface{} {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	st := map[string]interface{}{
+		"flags": len(flags),
+	}
+	if !refreshed.IsZero() {
+		st["refreshed_at"] = refreshed.UTC().Format(time.RFC3339)
+	}
+	return st
+}
@@ -0,0 +1,111 @@
+package featureflags
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const features = `{"version":1,"features":[
+	{"name":"upload_v2","enabled":true,"strategies":[{"name":"userWithId","parameters":{"userIds":"1, 42"}}]},
+	{"name":"protocol_v2","enabled":true,"strategies":[{"name":"default","parameters":{}}]},
+	{"name":"disabled","enabled":false,"strategies":[{"name":"default","parameters":{}}]},
+	{"name":"half","enabled":true,"strategies":[{"name":"gradualRolloutUserId","parameters":{"percentage":"50","groupId":"half"}}]},
+	{"name":"unknown_strategy","enabled":true,"strategies":[{"name":"remoteAddress","parameters":{"IPs":"127.0.0.1"}}]}
+]}`
+
+func TestEnabled(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v4/feature_flags/unleash/42/client/features", r.URL.Path)
+		require.Equal(t, "staging", r.Header.Get("UNLEASH-APPNAME"))
+		require.Equal(t, "instance-id", r.Header.Get("UNLEASH-INSTANCEID"))
+		w.Write([]byte(features))
+	}))
+	defer ts.Close()
+
+	cfg := config.FeatureFlagsConfig{
+		URL:        ts.URL + "/api/v4/feature_flags/unleash/42",
+		AppName:    "staging",
+		InstanceID: "instance-id",
+		Defaults:   map[string]bool{"protocol_v2": false, "default_on": true},
+	}
+	require.NoError(t, Configure(cfg))
+	defer Configure(config.FeatureFlagsConfig{})
+
+	require.False(t, Enabled("protocol_v2", ""), "defaults apply before the first refresh")
+	require.True(t, Enabled("default_on", ""))
+
+	refresh(current)
+
+	tests := []struct {
+		flag    string
+		userID  string
+		enabled bool
+	}{
+		{flag: "upload_v2", userID: "42", enabled: true},
+		{flag: "upload_v2", userID: "4", enabled: false},
+		{flag: "upload_v2", userID: "", enabled: false},
+		{flag: "protocol_v2", userID: "", enabled: true},
+		{flag: "disabled", userID: "42", enabled: false},
+		{flag: "unknown_strategy", userID: "42", enabled: false},
+		{flag: "default_on", userID: "", enabled: true},
+		{flag: "missing", userID: "42", enabled: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.flag+"/"+tc.userID, func(t *testing.T) {
+			require.Equal(t, tc.enabled, Enabled(tc.flag, tc.userID))
+		})
+	}
+}
+
+func TestRefreshFailureKeepsFlags(t *testing.T) {
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(features))
+	}))
+	defer ts.Close()
+
+	require.NoError(t, Configure(config.FeatureFlagsConfig{URL: ts.URL}))
+	defer Configure(config.FeatureFlagsConfig{})
+
+	refresh(current)
+	require.True(t, Enabled("protocol_v2", ""))
+
+	fail = true
+	refresh(current)
+	require.True(t, Enabled("protocol_v2", ""))
+}
+
+func TestGradualRollout(t *testing.T) {
+	f := flag{Enabled: true, Strategies: []strategy{{Name: "gradualRolloutUserId", Parameters: map[string]string{"percentage": "50", "groupId": "half"}}}}
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		userID := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		if f.enabled(userID) {
+			enabled++
+		}
+		require.Equal(t, f.enabled(userID), f.enabled(userID), "the same user gets the same answer")
+	}
+	require.InDelta(t, 500, enabled, 100)
+}
+
+func TestMurmur3(t *testing.T) {
+	require.Equal(t, uint32(0), murmur3([]byte(""), 0))
+	require.Equal(t, uint32(0x248bfa47), murmur3([]byte("hello"), 0))
+	require.Equal(t, uint32(0x2e4ff723), murmur3([]byte("The quick brown fox jumps over the lazy dog"), 0))
+}
+
+func TestConfigureInvalid(t *testing.T) {
+	require.Error(t, Configure(config.FeatureFlagsConfig{URL: "unleash.example.com"}))
+	require.Error(t, Configure(config.FeatureFlagsConfig{RefreshInterval: &config.TomlDuration{}}))
+}
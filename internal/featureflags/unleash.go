@@ -0,0 +1,174 @@
+package featureflags
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const fetchTimeout = 10 * time.Second
+
+var httpClient = &http.Client{Timeout: fetchTimeout}
+
+// flag is a feature of the Unleash client API:
+// https://docs.getunleash.io/reference/api/legacy/unleash/client/features
+type flag struct {
+	Name       string     `json:"name"`
+	Enabled    bool       `json:"enabled"`
+	Strategies []strategy `json:"strategies"`
+}
+
+type strategy struct {
+	Name       string            `json:"name"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+func fetchFlags(s settings) (map[string]flag, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(s.url, "/")+"/client/features", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("UNLEASH-APPNAME", s.appName)
+	if s.instanceID != "" {
+		instanceID, err := config.ResolveSecret(s.instanceID)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("UNLEASH-INSTANCEID", instanceID)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", req.URL.Host, resp.Status)
+	}
+
+	var body struct {
+		Features []flag `json:"features"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode features: %v", err)
+	}
+
+	fetched := make(map[string]flag, len(body.Features))
+	for _, f := range body.Features {
+		fetched[f.Name] = f
+	}
+	return fetched, nil
+}
+
+// enabled is true if the flag is on and one of its strategies, if it has
+// any, applies to userID
+func (f flag) enabled(userID string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if len(f.Strategies) == 0 {
+		return true
+	}
+
+	for _, s := range f.Strategies {
+		if s.enabled(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled evaluates the strategies of Unleash that GitLab feature flags
+// use. Unknown strategies are off.
+func (s strategy) enabled(userID string) bool {
+	switch s.Name {
+	case "default":
+		return true
+	case "userWithId":
+		for _, id := range strings.Split(s.Parameters["userIds"], ",") {
+			if userID != "" && strings.TrimSpace(id) == userID {
+				return true
+			}
+		}
+		return false
+	case "gradualRolloutUserId":
+		return userID != "" && inRollout(s.Parameters["groupId"], userID, s.Parameters["percentage"])
+	case "gradualRolloutRandom":
+		return inRollout("", strconv.Itoa(rand.Int()), s.Parameters["percentage"])
+	case "flexibleRollout":
+		switch s.Parameters["stickiness"] {
+		case "random":
+			return inRollout("", strconv.Itoa(rand.Int()), s.Parameters["rollout"])
+		default:
+			return userID != "" && inRollout(s.Parameters["groupId"], userID, s.Parameters["rollout"])
+		}
+	}
+
+	return false
+}
+
+// inRollout puts id in one of 100 buckets like the Unleash clients do, so
+// that a user gets the same answer from Workhorse and Rails
+func inRollout(groupID, id string, percentage string) bool {
+	pct, err := strconv.Atoi(percentage)
+	if err != nil || pct <= 0 {
+		return false
+	}
+
+	bucket := int(murmur3([]byte(groupID+":"+id), 0)%100) + 1
+	return bucket <= pct
+}
+
+// murmur3 is the 32-bit MurmurHash3 of data
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := uint32(data[4*i]) | uint32(data[4*i+1])<<8 | uint32(data[4*i+2])<<16 | uint32(data[4*i+3])<<24
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[4*n:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
@@ -49,9 +49,16 @@ func BodyUploader(rails PreAuthorizer, h http.Handler, p UploadPreparer) http.Ha
 			return
 		}
 
+		// The destination of the upload route may set the part size
+		opts.applyUploadRoute(r.Context())
+		if err := opts.Validate(); err != nil {
+			helper.Fail500(w, r, fmt.Errorf("BodyUploader: invalid upload options: %v", err))
+			return
+		}
+
 		fh, err := SaveFileFromReader(r.Context(), r.Body, r.ContentLength, opts)
 		if err != nil {
-			helper.Fail500(w, r, fmt.Errorf("BodyUploader: upload failed: %v", err))
+			FailUpload(w, r, fmt.Errorf("BodyUploader: upload failed: %w", err))
 			return
 		}
 
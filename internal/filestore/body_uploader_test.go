@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 
@@ -65,10 +66,11 @@ func TestBodyUploaderAuthorizationFailure(t *testing.T) {
 func TestBodyUploaderErrors(t *testing.T) {
 	tests := []struct {
 		name     string
-		preparer *alwaysLocalPreparer
+		preparer filestore.UploadPreparer
 	}{
 		{name: "Prepare failure", preparer: &alwaysLocalPreparer{prepareError: fmt.Errorf("")}},
 		{name: "Verify failure", preparer: &alwaysLocalPreparer{verifier: &alwaysFailsVerifier{}}},
+		{name: "Invalid options", preparer: &noDestinationPreparer{}},
 	}
 
 	for _, test := range tests {
@@ -78,6 +80,16 @@ func TestBodyUploaderErrors(t *testing.T) {
 	}
 }
 
+func TestBodyUploaderClientTimeout(t *testing.T) {
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Fail(t, "request proxied upstream")
+	})
+
+	body := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(timeoutError{}))
+	resp := testUpload(&rails{}, nil, proxy, body)
+	require.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+}
+
 func testNoProxyInvocation(t *testing.T, expectedStatus int, auth filestore.PreAuthorizer, preparer filestore.UploadPreparer) {
 	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		require.Fail(t, "request proxied upstream")
@@ -148,6 +160,12 @@ func (a *alwaysLocalPreparer) Prepare(_ *api.Response) (*filestore.SaveFileOpts,
 	return filestore.GetOpts(&api.Response{TempPath: os.TempDir()}), a.verifier, a.prepareError
 }
 
+type noDestinationPreparer struct{}
+
+func (noDestinationPreparer) Prepare(_ *api.Response) (*filestore.SaveFileOpts, filestore.UploadVerifier, error) {
+	return filestore.GetOpts(&api.Response{}), nil, nil
+}
+
 type alwaysFailsVerifier struct{}
 
 func (alwaysFailsVerifier) Verify(handler *filestore.FileHandler) error {
@@ -0,0 +1,154 @@
+package filestore
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// stallCopier copies an upload to its destinations like io.Copy, but
+// gives up as soon as either side stops making progress. Reads and writes
+// that block can't be interrupted, so they run in a goroutine that is left
+// behind when the copy fails: the server unblocks a stalled read when the
+// request ends, and aborting the upload unblocks a stalled write.
+type stallCopier struct {
+	dst          io.Writer
+	src          io.Reader
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu       sync.Mutex
+	deadline time.Time
+	stallErr error
+	stopped  bool
+}
+
+type copyResult struct {
+	n   int64
+	err error
+}
+
+// copyWithTimeouts copies src to dst. It fails with ErrClientTimeout if a
+// read of src takes longer than readTimeout, with ErrDestinationTimeout if
+// a write to dst takes longer than writeTimeout, and with the error of ctx
+// when it is done. Zero timeouts are not enforced.
+func copyWithTimeouts(ctx context.Context, dst io.Writer, src io.Reader, readTimeout, writeTimeout time.Duration) (int64, error) {
+	c := &stallCopier{dst: dst, src: src, readTimeout: readTimeout, writeTimeout: writeTimeout}
+
+	result := make(chan copyResult, 1)
+	go func() {
+		n, err := c.copy()
+		result <- copyResult{n, err}
+	}()
+
+	var tick <-chan time.Time
+	if interval := checkInterval(readTimeout, writeTimeout); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case r := <-result:
+			return r.n, r.err
+		case <-ctx.Done():
+			c.stop()
+			return 0, ctx.Err()
+		case now := <-tick:
+			if err := c.stalled(now); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// checkInterval is how often the deadline of the read or write in flight
+// is checked, so that a stall is noticed within a tenth of its timeout
+func checkInterval(timeouts ...time.Duration) time.Duration {
+	var interval time.Duration
+	for _, timeout := range timeouts {
+		if timeout > 0 && (interval == 0 || timeout < interval) {
+			interval = timeout
+		}
+	}
+	return interval / 10
+}
+
+func (c *stallCopier) copy() (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+
+	for {
+		if !c.watch(c.readTimeout, ErrClientTimeout) {
+			return written, nil
+		}
+		nr, readErr := c.src.Read(buf)
+		if os.IsTimeout(readErr) {
+			// The read deadline of the upload routes expired
+			readErr = ErrClientTimeout
+		}
+
+		if nr > 0 {
+			if !c.watch(c.writeTimeout, ErrDestinationTimeout) {
+				return written, nil
+			}
+			nw, writeErr := c.dst.Write(buf[:nr])
+			written += int64(nw)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// watch sets the deadline of the next read or write. It returns false if
+// the copy was given up, so that nothing is written after the upload is
+// aborted.
+func (c *stallCopier) watch(timeout time.Duration, stallErr error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return false
+	}
+
+	c.deadline = time.Time{}
+	if timeout > 0 {
+		c.deadline = time.Now().Add(timeout)
+	}
+	c.stallErr = stallErr
+	return true
+}
+
+// stalled gives up the copy and returns the error of the read or write in
+// flight if it is past its deadline
+func (c *stallCopier) stalled(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.deadline.IsZero() || now.Before(c.deadline) {
+		return nil
+	}
+
+	c.stopped = true
+	return c.stallErr
+}
+
+func (c *stallCopier) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+}
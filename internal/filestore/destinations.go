@@ -0,0 +1,178 @@
+package filestore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// destination holds the upload defaults of the object storage URLs
+// starting with urlPrefix
+type destination struct {
+	name      string
+	urlPrefix string
+	config.ObjectStorageConfig
+}
+
+// Upload types, the keys of upload_routes
+const (
+	UploadTypeLFS       = "lfs"
+	UploadTypeArtifacts = "artifacts"
+	UploadTypePackages  = "packages"
+	UploadTypeUploads   = "uploads"
+	UploadTypeImports   = "imports"
+
+	UploadTypeDependencyProxy = "dependency_proxy"
+)
+
+var uploadTypes = []string{UploadTypeLFS, UploadTypeArtifacts, UploadTypePackages, UploadTypeUploads, UploadTypeImports, UploadTypeDependencyProxy}
+
+type uploadTypeKey struct{}
+
+var (
+	destinations      []destination
+	uploadRoutes      map[string]destination
+	destinationsMutex sync.RWMutex
+)
+
+// WithUploadType tells SaveFileFromReader the upload type of the files of
+// a request, to find their destination in upload_routes
+func WithUploadType(ctx context.Context, uploadType string) context.Context {
+	return context.WithValue(ctx, uploadTypeKey{}, uploadType)
+}
+
+// ConfigureObjectStorage sets the upload defaults of object storage
+// destinations. They apply to the uploads whose upload type is routed to
+// a destination, or else whose presigned URLs start with the URLPrefix of
+// a destination, when Rails doesn't send the values.
+func ConfigureObjectStorage(cfg map[string]config.ObjectStorageConfig, routes map[string]config.UploadRouteConfig) error {
+	var dests []destination
+	byName := make(map[string]destination)
+	for name, c := range cfg {
+		if err := validateDestination(c); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		d := destination{name: name, urlPrefix: c.URLPrefix, ObjectStorageConfig: c}
+		dests = append(dests, d)
+		byName[name] = d
+	}
+
+	routed := make(map[string]destination)
+	for uploadType, route := range routes {
+		if !isUploadType(uploadType) {
+			return fmt.Errorf("upload_routes: unknown upload type %q, expected one of %s", uploadType, strings.Join(uploadTypes, ", "))
+		}
+		d, ok := byName[route.Destination]
+		if !ok {
+			return fmt.Errorf("upload_routes.%s: no object_storage section %q", uploadType, route.Destination)
+		}
+		d.urlPrefix += strings.TrimPrefix(route.RemotePathPrefix, "/")
+		routed[uploadType] = d
+	}
+
+	if err := configurePresigners(cfg); err != nil {
+		return err
+	}
+	if err := validateFailovers(cfg); err != nil {
+		return err
+	}
+
+	// The longest prefix wins, so check it first
+	sort.Slice(dests, func(i, j int) bool {
+		if len(dests[i].urlPrefix) != len(dests[j].urlPrefix) {
+			return len(dests[i].urlPrefix) > len(dests[j].urlPrefix)
+		}
+		return dests[i].name < dests[j].name
+	})
+
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+	destinations = dests
+	uploadRoutes = routed
+
+	return nil
+}
+
+func isUploadType(uploadType string) bool {
+	for _, t := range uploadTypes {
+		if t == uploadType {
+			return true
+		}
+	}
+	return false
+}
+
+func validateDestination(c config.ObjectStorageConfig) error {
+	u, err := url.Parse(c.URLPrefix)
+	if err != nil {
+		return fmt.Errorf("URLPrefix: %v", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("URLPrefix must be an absolute URL like https://bucket.s3.amazonaws.com/")
+	}
+	if c.Timeout != nil && c.Timeout.Duration == 0 {
+		return fmt.Errorf("Timeout must be positive")
+	}
+	if c.WriteTimeout != nil && c.WriteTimeout.Duration <= 0 {
+		return fmt.Errorf("WriteTimeout must be positive")
+	}
+	if c.PartSize < 0 {
+		return fmt.Errorf("PartSize must not be negative")
+	}
+	if c.Concurrency < 0 {
+		return fmt.Errorf("Concurrency must not be negative")
+	}
+	if c.TrailingChecksum && c.Provider == ProviderGoogle {
+		return fmt.Errorf("TrailingChecksum is not supported by Google Cloud Storage")
+	}
+
+	return nil
+}
+
+// findDestination returns the destination of the presigned URL, if any
+func findDestination(presignedURL string) (destination, bool) {
+	destinationsMutex.RLock()
+	defer destinationsMutex.RUnlock()
+
+	for _, d := range destinations {
+		if strings.HasPrefix(presignedURL, d.urlPrefix) {
+			return d, true
+		}
+	}
+
+	return destination{}, false
+}
+
+// findRoutedDestination returns the destination of the upload type of
+// ctx. If Rails presigned the URL for another place, the route doesn't
+// apply.
+func findRoutedDestination(ctx context.Context, presignedURL string) (destination, bool) {
+	uploadType, _ := ctx.Value(uploadTypeKey{}).(string)
+	if uploadType == "" || presignedURL == "" {
+		return destination{}, false
+	}
+
+	destinationsMutex.RLock()
+	d, ok := uploadRoutes[uploadType]
+	destinationsMutex.RUnlock()
+
+	if !ok {
+		return destination{}, false
+	}
+	if !strings.HasPrefix(presignedURL, d.urlPrefix) {
+		log.WithContextFields(ctx, log.Fields{
+			"uploadType":  uploadType,
+			"destination": d.name,
+		}).Warning("upload_routes: the upload goes to another place than its destination, ignoring the route")
+		return destination{}, false
+	}
+
+	return d, true
+}
@@ -0,0 +1,112 @@
+package filestore_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+)
+
+func TestGetOptsObjectStorageDefaults(t *testing.T) {
+	require.NoError(t, filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{
+		"uploads": {
+			URLPrefix: "https://uploads.example.com/",
+			Timeout:   &config.TomlDuration{Duration: 5 * time.Minute},
+		},
+		"imports": {
+			URLPrefix:   "https://uploads.example.com/imports/",
+			Timeout:     &config.TomlDuration{Duration: 48 * time.Hour},
+			PartSize:    100,
+			Concurrency: 4,
+
+			TrailingChecksum: true,
+		},
+	}, nil))
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	tests := []struct {
+		name        string
+		remote      api.RemoteObject
+		timeout     time.Duration
+		partSize    int64
+		concurrency int
+		trailing    bool
+	}{
+		{
+			name:        "unknown destination",
+			remote:      api.RemoteObject{StoreURL: "https://other.example.com/avatar.png"},
+			timeout:     filestore.DefaultObjectStoreTimeout,
+			concurrency: 1,
+		},
+		{
+			name:        "destination timeout",
+			remote:      api.RemoteObject{StoreURL: "https://uploads.example.com/avatar.png"},
+			timeout:     5 * time.Minute,
+			concurrency: 1,
+		},
+		{
+			name:        "Rails timeout wins",
+			remote:      api.RemoteObject{StoreURL: "https://uploads.example.com/avatar.png", Timeout: 10},
+			timeout:     10 * time.Second,
+			concurrency: 1,
+		},
+		{
+			name: "longest prefix wins",
+			remote: api.RemoteObject{MultipartUpload: &api.MultipartUploadParams{
+				PartURLs: []string{"https://uploads.example.com/imports/project.tar.gz?partNumber=1"},
+			}},
+			timeout:     48 * time.Hour,
+			partSize:    100,
+			concurrency: 4,
+			trailing:    true,
+		},
+		{
+			name: "Rails part size wins",
+			remote: api.RemoteObject{MultipartUpload: &api.MultipartUploadParams{
+				PartSize: 10,
+				PartURLs: []string{"https://uploads.example.com/imports/project.tar.gz?partNumber=1"},
+			}},
+			timeout:     48 * time.Hour,
+			partSize:    10,
+			concurrency: 4,
+			trailing:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := filestore.GetOpts(&api.Response{RemoteObject: tc.remote})
+
+			require.WithinDuration(t, time.Now().Add(tc.timeout), opts.Deadline, time.Minute)
+			require.Equal(t, tc.partSize, opts.PartSize)
+			require.Equal(t, tc.concurrency, opts.Concurrency)
+			require.Equal(t, tc.trailing, opts.TrailingChecksum)
+		})
+	}
+}
+
+func TestConfigureObjectStorageInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ObjectStorageConfig
+	}{
+		{name: "no URLPrefix", cfg: config.ObjectStorageConfig{}},
+		{name: "relative URLPrefix", cfg: config.ObjectStorageConfig{URLPrefix: "/uploads"}},
+		{name: "zero timeout", cfg: config.ObjectStorageConfig{URLPrefix: "https://example.com/", Timeout: &config.TomlDuration{}}},
+		{name: "negative part size", cfg: config.ObjectStorageConfig{URLPrefix: "https://example.com/", PartSize: -1}},
+		{name: "negative concurrency", cfg: config.ObjectStorageConfig{URLPrefix: "https://example.com/", Concurrency: -1}},
+		{name: "trailing checksum on Google", cfg: config.ObjectStorageConfig{URLPrefix: "https://example.com/", Provider: "Google", TrailingChecksum: true}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{"uploads": tc.cfg}, nil)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "uploads: ")
+		})
+	}
+}
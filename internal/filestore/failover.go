@@ -0,0 +1,174 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/mask"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+)
+
+// DefaultFailoverAfter is how many uploads in a row must fail in object
+// storage before the uploads of a destination go to its failover
+const DefaultFailoverAfter = 3
+
+// failoverCooldown is how long uploads go to the failover before the
+// primary destination is tried again
+const failoverCooldown = time.Minute
+
+// destinationHealth tracks the failed uploads of a destination
+type destinationHealth struct {
+	failures        int
+	failedOverUntil time.Time
+}
+
+var (
+	health      = make(map[string]*destinationHealth)
+	healthMutex sync.Mutex
+)
+
+func validateFailovers(cfg map[string]config.ObjectStorageConfig) error {
+	for name, c := range cfg {
+		if c.FailoverAfter < 0 {
+			return fmt.Errorf("%s: FailoverAfter must not be negative", name)
+		}
+		if c.Failover == "" {
+			continue
+		}
+		if c.Failover == name {
+			return fmt.Errorf("%s: Failover must name another object_storage section", name)
+		}
+		failover, ok := cfg[c.Failover]
+		if !ok {
+			return fmt.Errorf("%s: no object_storage section %q for Failover", name, c.Failover)
+		}
+		if failover.Provider == "" {
+			return fmt.Errorf("%s: Failover %q needs a Provider to presign uploads", name, c.Failover)
+		}
+	}
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	health = make(map[string]*destinationHealth)
+
+	return nil
+}
+
+// failedOver tells if the uploads of the destination name go to its
+// failover now
+func failedOver(name string, now time.Time) bool {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h, ok := health[name]
+	return ok && now.Before(h.failedOverUntil)
+}
+
+// recordUploadResult counts the uploads to dest that failed in object
+// storage, and fails over once FailoverAfter of them failed in a row.
+// Errors of clients and of Workhorse don't count.
+func recordUploadResult(dest destination, err error, now time.Time) {
+	if dest.Failover == "" {
+		return
+	}
+
+	failed := errors.Is(err, objectstore.ErrObjectStoreUnavailable) ||
+		errors.Is(err, objectstore.ErrDeadlineExceeded) ||
+		errors.Is(err, ErrDestinationTimeout)
+	if err != nil && !failed {
+		return
+	}
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	h, ok := health[dest.name]
+	if !ok {
+		h = &destinationHealth{}
+		health[dest.name] = h
+	}
+	if !failed {
+		h.failures = 0
+		return
+	}
+
+	h.failures++
+	threshold := dest.FailoverAfter
+	if threshold == 0 {
+		threshold = DefaultFailoverAfter
+	}
+	if h.failures >= threshold {
+		h.failures = 0
+		h.failedOverUntil = now.Add(failoverCooldown)
+		uploadFailovers.WithLabelValues(dest.name, dest.Failover).Inc()
+	}
+}
+
+// applyFailover sends a single PUT upload to the failover of its
+// destination if the destination failed over. Multipart uploads can't
+// fail over: the failover would need an upload ID from Rails.
+func (s *SaveFileOpts) applyFailover(now time.Time) error {
+	dest := s.destination
+	if dest == nil || dest.Failover == "" || s.IsMultipart() || s.PresignedPut == "" || !failedOver(dest.name, now) {
+		return nil
+	}
+
+	presigner, ok := Presigner(dest.Failover)
+	if !ok {
+		return fmt.Errorf("failover %q of %q has no presigner", dest.Failover, dest.name)
+	}
+
+	key, err := objectKey(dest.URLPrefix, s.PresignedPut)
+	if err != nil {
+		return fmt.Errorf("failover %q of %q: %v", dest.Failover, dest.name, err)
+	}
+
+	presign := func(method string) (string, error) {
+		return presigner.Presign(method, key, 0)
+	}
+	if s.PresignedPut, err = presign("PUT"); err != nil {
+		return err
+	}
+	if s.RemoteURL, err = presign("GET"); err != nil {
+		return err
+	}
+	if s.PresignedDelete != "" {
+		if s.PresignedDelete, err = presign("DELETE"); err != nil {
+			return err
+		}
+	}
+	if s.PresignedHead != "" {
+		if s.PresignedHead, err = presign("HEAD"); err != nil {
+			return err
+		}
+	}
+
+	s.FailoverDestination = dest.Failover
+	return nil
+}
+
+// objectKey is the key of the object presignedURL uploads to, in the bucket
+// at bucketURL
+func objectKey(bucketURL, presignedURL string) (string, error) {
+	bucket, err := url.Parse(bucketURL)
+	if err != nil {
+		return "", err
+	}
+	object, err := url.Parse(presignedURL)
+	if err != nil {
+		return "", err
+	}
+
+	prefix := strings.TrimSuffix(bucket.Path, "/") + "/"
+	if object.Host != bucket.Host || !strings.HasPrefix(object.Path, prefix) || object.Path == prefix {
+		return "", fmt.Errorf("%s is no object of the bucket %s", mask.URL(presignedURL), bucketURL)
+	}
+
+	return strings.TrimPrefix(object.Path, prefix), nil
+}
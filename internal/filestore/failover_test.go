@@ -0,0 +1,138 @@
+package filestore_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
+)
+
+func TestSaveFileFailover(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+
+	osStub, secondary := test.StartObjectStore()
+	defer secondary.Close()
+
+	require.NoError(t, filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{
+		"uploads": {
+			URLPrefix:     primary.URL + "/uploads/",
+			Failover:      "uploads-eu",
+			FailoverAfter: 2,
+		},
+		"uploads-eu": {
+			URLPrefix:       secondary.URL + "/uploads-eu/",
+			Provider:        filestore.ProviderAWS,
+			Region:          "eu-central-1",
+			AccessKeyID:     "AKIAEXAMPLE",
+			SecretAccessKey: "secret",
+		},
+	}, nil))
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upload := func() (*filestore.FileHandler, error) {
+		opts := filestore.GetOpts(&api.Response{RemoteObject: api.RemoteObject{
+			ID:       "test-file",
+			GetURL:   primary.URL + "/uploads/tmp/test-file",
+			StoreURL: primary.URL + "/uploads/tmp/test-file?Signature=ASignature",
+		}})
+		return filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := upload()
+		require.True(t, errors.Is(err, objectstore.ErrObjectStoreUnavailable), "%v", err)
+	}
+
+	fh, err := upload()
+	require.NoError(t, err)
+	require.Equal(t, "uploads-eu", fh.RemoteDestination)
+	require.Equal(t, "uploads-eu", fh.GitLabFinalizeFields("file")["file.remote_destination"])
+	require.True(t, strings.HasPrefix(fh.RemoteURL, secondary.URL+"/uploads-eu/tmp/test-file?"), fh.RemoteURL)
+	require.Equal(t, test.ObjectMD5, osStub.GetObjectMD5("/uploads-eu/tmp/test-file"))
+}
+
+func TestSaveFileNoFailoverOnClientErrors(t *testing.T) {
+	osStub, primary := test.StartObjectStore()
+	defer primary.Close()
+
+	require.NoError(t, filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{
+		"uploads": {URLPrefix: primary.URL + "/uploads/", Failover: "uploads-eu", FailoverAfter: 1},
+		"uploads-eu": {
+			URLPrefix:       "https://uploads-eu.s3.amazonaws.com/",
+			Provider:        filestore.ProviderAWS,
+			AccessKeyID:     "AKIAEXAMPLE",
+			SecretAccessKey: "secret",
+		},
+	}, nil))
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		opts := filestore.GetOpts(&api.Response{RemoteObject: api.RemoteObject{
+			StoreURL: primary.URL + "/uploads/tmp/test-file?Signature=ASignature",
+		}})
+
+		fh, err := filestore.SaveFileFromReader(ctx, disconnectingReader(), -1, opts)
+		require.Nil(t, fh)
+		require.Equal(t, filestore.ErrClientDisconnected, err)
+	}
+
+	opts := filestore.GetOpts(&api.Response{RemoteObject: api.RemoteObject{
+		StoreURL: primary.URL + "/uploads/tmp/test-file?Signature=ASignature",
+	}})
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.NoError(t, err)
+	require.Empty(t, fh.RemoteDestination)
+	require.Equal(t, test.ObjectMD5, osStub.GetObjectMD5("/uploads/tmp/test-file"), "the upload must go to the primary")
+}
+
+func TestConfigureObjectStorageInvalidFailover(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  map[string]config.ObjectStorageConfig
+	}{
+		{
+			name: "unknown failover",
+			cfg:  map[string]config.ObjectStorageConfig{"uploads": {URLPrefix: "https://uploads.example.com/", Failover: "missing"}},
+		},
+		{
+			name: "failover to itself",
+			cfg:  map[string]config.ObjectStorageConfig{"uploads": {URLPrefix: "https://uploads.example.com/", Failover: "uploads"}},
+		},
+		{
+			name: "failover without provider",
+			cfg: map[string]config.ObjectStorageConfig{
+				"uploads":    {URLPrefix: "https://uploads.example.com/", Failover: "uploads-eu"},
+				"uploads-eu": {URLPrefix: "https://uploads-eu.example.com/"},
+			},
+		},
+		{
+			name: "negative FailoverAfter",
+			cfg:  map[string]config.ObjectStorageConfig{"uploads": {URLPrefix: "https://uploads.example.com/", FailoverAfter: -1}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Error(t, filestore.ConfigureObjectStorage(tc.cfg, nil))
+		})
+	}
+}
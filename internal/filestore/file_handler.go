@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strconv"
+	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
 )
@@ -17,6 +19,17 @@ type SizeError error
 // ErrEntityTooLarge means that the uploaded content is bigger then maximum allowed size
 var ErrEntityTooLarge = errors.New("entity is too large")
 
+// ErrClientDisconnected means that the client went away before the upload was saved
+var ErrClientDisconnected = errors.New("client disconnected during upload")
+
+// ErrClientTimeout means that the client sent no data of the upload for
+// longer than SaveFileOpts.ClientTimeout
+var ErrClientTimeout = errors.New("client sent no upload data in time")
+
+// ErrDestinationTimeout means that a destination of the upload accepted no
+// data for longer than SaveFileOpts.WriteTimeout
+var ErrDestinationTimeout = errors.New("upload destination accepted no data in time")
+
 // FileHandler represent a file that has been processed for upload
 // it may be either uploaded to an ObjectStore and/or saved on local path.
 type FileHandler struct {
@@ -27,6 +40,9 @@ type FileHandler struct {
 	RemoteID string
 	// RemoteURL is ObjectStore URL provided by GitLab Rails
 	RemoteURL string
+	// RemoteDestination is the object_storage destination the file went
+	// to, if it failed over from the one of Rails
+	RemoteDestination string
 
 	// Size is the persisted file size
 	Size int64
@@ -64,6 +80,9 @@ func (fh *FileHandler) GitLabFinalizeFields(prefix string) map[string]string {
 	data[key("path")] = fh.LocalPath
 	data[key("remote_url")] = fh.RemoteURL
 	data[key("remote_id")] = fh.RemoteID
+	if fh.RemoteDestination != "" {
+		data[key("remote_destination")] = fh.RemoteDestination
+	}
 	data[key("size")] = strconv.FormatInt(fh.Size, 10)
 	for hashName, hash := range fh.hashes {
 		data[key(hashName)] = hash
@@ -75,31 +94,67 @@ func (fh *FileHandler) GitLabFinalizeFields(prefix string) map[string]string {
 // SaveFileFromReader persists the provided reader content to all the location specified in opts. A cleanup will be performed once ctx is Done
 // Make sure the provided context will not expire before finalizing upload with GitLab Rails.
 func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts *SaveFileOpts) (fh *FileHandler, err error) {
+	opts.applyUploadRoute(ctx)
+	if err := opts.applyFailover(time.Now()); err != nil {
+		return nil, err
+	}
+
+	if opts.MaximumSize > 0 && size > opts.MaximumSize {
+		return nil, ErrEntityTooLarge
+	}
+
+	uploadsOpen.Inc()
+	defer uploadsOpen.Dec()
+
 	var remoteWriter objectstore.Upload
 	fh = &FileHandler{
-		Name:      opts.TempFilePrefix,
-		RemoteID:  opts.RemoteID,
-		RemoteURL: opts.RemoteURL,
+		Name:              opts.TempFilePrefix,
+		RemoteID:          opts.RemoteID,
+		RemoteURL:         opts.RemoteURL,
+		RemoteDestination: opts.FailoverDestination,
 	}
 	hashes := newMultiHash()
 	writers := []io.Writer{hashes.Writer}
+	body := &readErrorReader{r: reader}
 	defer func() {
+		if err != nil && err != ErrClientTimeout && err != ErrDestinationTimeout && clientDisconnected(ctx, body.err) {
+			uploadsClientDisconnected.Inc()
+			err = ErrClientDisconnected
+		}
+
 		for _, w := range writers {
+			if upload, ok := w.(objectstore.Upload); ok && err != nil {
+				// Closing the upload would complete it with the data read so far
+				upload.Abort(err)
+			}
 			if closer, ok := w.(io.WriteCloser); ok {
 				closer.Close()
 			}
 		}
+
+		if opts.destination != nil && opts.FailoverDestination == "" && remoteWriter != nil {
+			recordUploadResult(*opts.destination, err, time.Now())
+		}
 	}()
 
+	if opts.IsRemote() && opts.PresignedHead != "" {
+		headCtx, cancel := context.WithDeadline(ctx, opts.Deadline)
+		err = objectstore.CheckNotExists(headCtx, opts.PresignedHead)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if opts.IsMultipart() {
-		remoteWriter, err = objectstore.NewMultipart(ctx, opts.PresignedParts, opts.PresignedCompleteMultipart, opts.PresignedAbortMultipart, opts.PresignedDelete, opts.PutHeaders, opts.Deadline, opts.PartSize)
+		remoteWriter, err = objectstore.NewProviderMultipart(ctx, opts.provider(), opts.PresignedParts, opts.PresignedCompleteMultipart, opts.PresignedAbortMultipart, opts.PresignedDelete, opts.PutHeaders, opts.Deadline, opts.PartSize, opts.Concurrency)
 		if err != nil {
 			return nil, err
 		}
 
 		writers = append(writers, remoteWriter)
 	} else if opts.IsRemote() {
-		remoteWriter, err = objectstore.NewObject(ctx, opts.PresignedPut, opts.PresignedDelete, opts.PutHeaders, opts.Deadline, size)
+		remoteWriter, err = objectstore.NewProviderObject(ctx, opts.provider(), opts.PresignedPut, opts.PresignedDelete, opts.PutHeaders, opts.Deadline, size)
 		if err != nil {
 			return nil, err
 		}
@@ -120,8 +175,16 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 		return nil, errors.New("missing upload destination")
 	}
 
+	var src io.Reader = body
+	if opts.MaximumSize > 0 {
+		src = &hardLimitReader{r: body, n: opts.MaximumSize}
+	}
+
 	multiWriter := io.MultiWriter(writers...)
-	fh.Size, err = io.Copy(multiWriter, reader)
+	fh.Size, err = copyWithTimeouts(ctx, multiWriter, src, opts.ClientTimeout, opts.WriteTimeout)
+	if err == ErrClientTimeout || err == ErrDestinationTimeout {
+		uploadsTimedOut.WithLabelValues(timeoutLabel(err)).Inc()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -149,12 +212,69 @@ func SaveFileFromReader(ctx context.Context, reader io.Reader, size int64, opts
 	return fh, err
 }
 
+func timeoutLabel(err error) string {
+	if err == ErrClientTimeout {
+		return "client"
+	}
+	return "destination"
+}
+
+// readErrorReader remembers the error of reading an upload, other than
+// io.EOF
+type readErrorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// hardLimitReader fails with ErrEntityTooLarge once more than n bytes
+// are read, unlike io.LimitReader which ends silently
+type hardLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (h *hardLimitReader) Read(p []byte) (int, error) {
+	if h.n < 0 {
+		return 0, ErrEntityTooLarge
+	}
+	if int64(len(p)) > h.n+1 {
+		p = p[:h.n+1]
+	}
+
+	n, err := h.r.Read(p)
+	h.n -= int64(n)
+	if h.n < 0 {
+		return 0, ErrEntityTooLarge
+	}
+	return n, err
+}
+
+// clientDisconnected tells if an upload failed because the client went
+// away: its request was canceled, or its body ended or broke midway
+func clientDisconnected(ctx context.Context, readErr error) bool {
+	if ctx.Err() == context.Canceled || readErr == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	_, ok := readErr.(net.Error)
+	return ok
+}
+
 func (fh *FileHandler) uploadLocalFile(ctx context.Context, opts *SaveFileOpts) (io.WriteCloser, error) {
 	// make sure TempFolder exists
 	err := os.MkdirAll(opts.LocalTempPath, 0700)
 	if err != nil {
 		return nil, fmt.Errorf("uploadLocalFile: mkdir %q: %v", opts.LocalTempPath, err)
 	}
+	registerTempDir(opts.LocalTempPath)
 
 	file, err := ioutil.TempFile(opts.LocalTempPath, opts.TempFilePrefix)
 	if err != nil {
@@ -2,19 +2,25 @@ package filestore_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore/test"
 )
 
@@ -68,6 +74,43 @@ func TestSaveFileWrongSize(t *testing.T) {
 	assert.Nil(fh)
 }
 
+func TestSaveFileMaximumSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        int64
+		maximumSize int64
+		err         error
+	}{
+		{name: "no limit", size: test.ObjectSize, maximumSize: 0},
+		{name: "at the limit", size: test.ObjectSize, maximumSize: test.ObjectSize},
+		{name: "unknown size at the limit", size: -1, maximumSize: test.ObjectSize},
+		{name: "known size too large", size: test.ObjectSize, maximumSize: test.ObjectSize - 1, err: filestore.ErrEntityTooLarge},
+		{name: "unknown size too large", size: -1, maximumSize: test.ObjectSize - 1, err: filestore.ErrEntityTooLarge},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+			require.NoError(t, err)
+			defer os.RemoveAll(tmpFolder)
+
+			opts := &filestore.SaveFileOpts{LocalTempPath: tmpFolder, TempFilePrefix: "test-file", MaximumSize: tc.maximumSize}
+			fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), tc.size, opts)
+			if tc.err != nil {
+				require.Equal(t, tc.err, err)
+				require.Nil(t, fh)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.ObjectSize, fh.Size)
+		})
+	}
+}
+
 func TestSaveFromDiskNotExistingFile(t *testing.T) {
 	assert := assert.New(t)
 
@@ -115,7 +158,7 @@ func TestSaveFileWrongETag(t *testing.T) {
 			ctx, cancel := context.WithCancel(context.Background())
 			fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
 			assert.Nil(fh)
-			assert.Error(err)
+			assert.True(errors.Is(err, objectstore.ErrETagMismatch), "%v", err)
 			assert.Equal(1, osStub.PutsCnt(), "File not uploaded")
 
 			cancel() // this will trigger an async cleanup
@@ -304,4 +347,181 @@ func TestSaveMultipartInBodyFailure(t *testing.T) {
 	assert.Nil(fh)
 	require.Error(t, err)
 	assert.EqualError(err, test.MultipartUploadInternalError().Error())
+	assert.True(errors.Is(err, objectstore.ErrObjectStoreUnavailable))
+}
+
+// disconnectingReader returns some data and then fails like the body of a
+// request whose client went away
+func disconnectingReader() io.Reader {
+	return io.MultiReader(strings.NewReader(test.ObjectContent[:5]), iotest.ErrReader(io.ErrUnexpectedEOF))
+}
+
+func TestSaveFileClientDisconnectedSingle(t *testing.T) {
+	completed := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.Copy(ioutil.Discard, r.Body)
+		completed <- err == nil
+	}))
+	defer ts.Close()
+
+	opts := filestore.SaveFileOpts{
+		RemoteID:     "test-file",
+		RemoteURL:    ts.URL + test.ObjectPath,
+		PresignedPut: ts.URL + test.ObjectPath + "?Signature=ASignature",
+		Deadline:     testDeadline(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, disconnectingReader(), -1, &opts)
+	require.Nil(t, fh)
+	require.Equal(t, filestore.ErrClientDisconnected, err)
+
+	select {
+	case ok := <-completed:
+		require.False(t, ok, "the PUT must not complete with the partial body")
+	case <-time.After(time.Second):
+		// The PUT was canceled before it reached the server
+	}
+}
+
+func TestSaveFileClientDisconnectedMultipart(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	opts := filestore.SaveFileOpts{
+		RemoteID:                   "test-file",
+		RemoteURL:                  objectURL,
+		PartSize:                   test.ObjectSize,
+		PresignedParts:             []string{objectURL + "?partNumber=1", objectURL + "?partNumber=2"},
+		PresignedCompleteMultipart: objectURL + "?Signature=CompleteSignature",
+		Deadline:                   testDeadline(),
+	}
+	osStub.InitiateMultipartUpload(test.ObjectPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, disconnectingReader(), -1, &opts)
+	require.Nil(t, fh)
+	require.Equal(t, filestore.ErrClientDisconnected, err)
+	require.True(t, osStub.IsMultipartUpload(test.ObjectPath), "the multipart upload must not be completed")
+}
+
+func TestSaveFileRequestCanceled(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	opts := filestore.SaveFileOpts{
+		RemoteID:     "test-file",
+		RemoteURL:    objectURL,
+		PresignedPut: objectURL + "?Signature=ASignature",
+		Deadline:     testDeadline(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, &opts)
+	require.Nil(t, fh)
+	require.Equal(t, filestore.ErrClientDisconnected, err)
+	require.Empty(t, osStub.GetObjectMD5(test.ObjectPath))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestSaveFileClientTimeout(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "workhorse-test-tmp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpFolder)
+
+	stalled, w := io.Pipe()
+	defer w.Close()
+
+	for _, reader := range []io.Reader{
+		io.MultiReader(strings.NewReader(test.ObjectContent[:5]), stalled),
+		io.MultiReader(strings.NewReader(test.ObjectContent[:5]), iotest.ErrReader(timeoutError{})),
+	} {
+		opts := filestore.SaveFileOpts{LocalTempPath: tmpFolder, ClientTimeout: 50 * time.Millisecond}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		started := time.Now()
+		fh, err := filestore.SaveFileFromReader(ctx, reader, -1, &opts)
+		cancel()
+
+		require.Nil(t, fh)
+		require.Equal(t, filestore.ErrClientTimeout, err)
+		require.True(t, time.Since(started) < 5*time.Second, "the upload fails promptly")
+	}
+}
+
+func TestSaveFileDestinationTimeout(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Object storage that doesn't read the upload
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	opts := filestore.SaveFileOpts{
+		RemoteID:     "test-file",
+		RemoteURL:    ts.URL + test.ObjectPath,
+		PresignedPut: ts.URL + test.ObjectPath + "?Signature=ASignature",
+		Deadline:     testDeadline(),
+		WriteTimeout: 100 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// More than the socket buffers take
+	body := io.LimitReader(zeroReader{}, 256*1024*1024)
+	fh, err := filestore.SaveFileFromReader(ctx, body, -1, &opts)
+	require.Nil(t, fh)
+	require.Equal(t, filestore.ErrDestinationTimeout, err)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestSaveFileExistingObject(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	objectURL := ts.URL + test.ObjectPath
+	opts := &filestore.SaveFileOpts{
+		RemoteID:      "test-file",
+		RemoteURL:     objectURL,
+		PresignedPut:  objectURL + "?Signature=ASignature",
+		PresignedHead: objectURL + "?Signature=HeadSignature",
+		Deadline:      testDeadline(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fh, err := filestore.SaveFileFromReader(ctx, strings.NewReader(test.ObjectContent), test.ObjectSize, opts)
+	require.NoError(t, err)
+	require.NotNil(t, fh)
+	require.Equal(t, 1, osStub.PutsCnt())
+
+	fh, err = filestore.SaveFileFromReader(ctx, strings.NewReader("other content"), 13, opts)
+	require.Nil(t, fh)
+	require.True(t, errors.Is(err, objectstore.ErrObjectExists), "%v", err)
+	require.Equal(t, 1, osStub.PutsCnt(), "the existing object must not be overwritten")
+	require.Equal(t, test.ObjectMD5, osStub.GetObjectMD5(test.ObjectPath))
 }
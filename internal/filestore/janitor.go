@@ -0,0 +1,177 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const defaultJanitorInterval = time.Hour
+
+// workhorseTempPrefixes are the prefixes of the temporary files Workhorse
+// creates in the temporary directory of the system, which it shares with
+// other programs
+var workhorseTempPrefixes = []string{"part-buffer", "metadata.gz", "gitlab-workhorse-", "channel-recording"}
+
+type janitorSettings struct {
+	maxAge   time.Duration
+	interval time.Duration
+	dirs     []string
+}
+
+var (
+	janitor      = janitorSettings{interval: defaultJanitorInterval}
+	tempDirs     = make(map[string]bool)
+	janitorMutex sync.Mutex
+
+	janitorRemovedFiles = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_filestore_janitor_removed_files",
+			Help: "How many temporary files of uploads left behind the janitor removed",
+		},
+	)
+	janitorRemovedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_filestore_janitor_removed_bytes",
+			Help: "How many bytes of temporary files of uploads left behind the janitor reclaimed",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(janitorRemovedFiles)
+	prometheus.MustRegister(janitorRemovedBytes)
+}
+
+// ConfigureJanitor sets how old the temporary files of uploads must be to
+// be removed. Besides cfg.Dirs and dirs, the janitor scans the
+// LocalTempPath of the uploads since startup.
+func ConfigureJanitor(cfg config.UploadJanitorConfig, dirs ...string) error {
+	s := janitorSettings{interval: defaultJanitorInterval}
+	if cfg.MaxAge != nil {
+		if cfg.MaxAge.Duration <= 0 {
+			return fmt.Errorf("MaxAge must be positive")
+		}
+		s.maxAge = cfg.MaxAge.Duration
+	}
+	if cfg.Interval != nil {
+		if cfg.Interval.Duration <= 0 {
+			return fmt.Errorf("Interval must be positive")
+		}
+		s.interval = cfg.Interval.Duration
+	}
+	for _, dir := range append(cfg.Dirs, dirs...) {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("Dirs: %q is not an absolute path", dir)
+		}
+		s.dirs = append(s.dirs, filepath.Clean(dir))
+	}
+
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	janitor = s
+
+	return nil
+}
+
+// registerTempDir lets the janitor scan dir, the LocalTempPath of an
+// upload
+func registerTempDir(dir string) {
+	janitorMutex.Lock()
+	defer janitorMutex.Unlock()
+	tempDirs[filepath.Clean(dir)] = true
+}
+
+// RunJanitor removes the temporary files left behind at startup and then
+// every Interval
+func RunJanitor() {
+	for {
+		janitorMutex.Lock()
+		s := janitor
+		janitorMutex.Unlock()
+
+		if s.maxAge > 0 {
+			cleanTempDirs(s, time.Now())
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+func cleanTempDirs(s janitorSettings, now time.Time) {
+	janitorMutex.Lock()
+	dirs := append([]string{}, s.dirs...)
+	for dir := range tempDirs {
+		dirs = append(dirs, dir)
+	}
+	janitorMutex.Unlock()
+
+	sort.Strings(dirs)
+	systemTempDir := filepath.Clean(os.TempDir())
+	for i, dir := range dirs {
+		if i > 0 && dirs[i-1] == dir {
+			continue
+		}
+
+		// Other programs have files in the temporary directory of the
+		// system too, only remove the files of Workhorse
+		var prefixes []string
+		if dir == systemTempDir {
+			prefixes = workhorseTempPrefixes
+		}
+		cleanTempDir(dir, prefixes, now.Add(-s.maxAge))
+	}
+}
+
+// cleanTempDir removes the files of dir, but not its directories, that
+// start with one of prefixes, if any, and were last modified before
+// cutoff
+func cleanTempDir(dir string, prefixes []string, cutoff time.Time) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("dir", dir).Error("filestore: janitor failed to scan directory")
+		}
+		return
+	}
+
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !fi.ModTime().Before(cutoff) || !hasAnyPrefix(fi.Name(), prefixes) {
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				log.WithError(err).WithField("path", path).Error("filestore: janitor failed to remove temporary file")
+			}
+			continue
+		}
+
+		janitorRemovedFiles.Inc()
+		janitorRemovedBytes.Add(float64(fi.Size()))
+		log.WithFields(log.Fields{"path": path, "size": fi.Size(), "modified": fi.ModTime()}).Info("filestore: janitor removed temporary file left behind")
+	}
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	if prefixes == nil {
+		return true
+	}
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func writeTempFile(t *testing.T, dir, name string, modified time.Time) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte("left behind"), 0600))
+	require.NoError(t, os.Chtimes(path, modified, modified))
+	return path
+}
+
+func requireExists(t *testing.T, path string, exists bool) {
+	_, err := os.Stat(path)
+	if exists {
+		require.NoError(t, err, path)
+	} else {
+		require.True(t, os.IsNotExist(err), "%s should be removed", path)
+	}
+}
+
+func TestCleanTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := writeTempFile(t, dir, "avatar.png123", now.Add(-2*time.Hour))
+	recent := writeTempFile(t, dir, "upload.zip456", now.Add(-time.Minute))
+	subdir := filepath.Join(dir, "subdir")
+	require.NoError(t, os.Mkdir(subdir, 0700))
+	require.NoError(t, os.Chtimes(subdir, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+
+	cleanTempDir(dir, nil, now.Add(-time.Hour))
+
+	requireExists(t, old, false)
+	requireExists(t, recent, true)
+	requireExists(t, subdir, true)
+}
+
+func TestCleanTempDirPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	modified := time.Now().Add(-2 * time.Hour)
+	ours := writeTempFile(t, dir, "part-buffer123", modified)
+	theirs := writeTempFile(t, dir, "systemd-private", modified)
+
+	cleanTempDir(dir, workhorseTempPrefixes, time.Now().Add(-time.Hour))
+
+	requireExists(t, ours, false)
+	requireExists(t, theirs, true)
+}
+
+func TestCleanTempDirsRegistered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "janitor")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	old := writeTempFile(t, dir, "lfs-object", time.Now().Add(-2*time.Hour))
+
+	registerTempDir(dir)
+	defer func() {
+		janitorMutex.Lock()
+		delete(tempDirs, dir)
+		janitorMutex.Unlock()
+	}()
+
+	cleanTempDirs(janitorSettings{maxAge: time.Hour}, time.Now())
+	requireExists(t, old, false)
+}
+
+func TestConfigureJanitor(t *testing.T) {
+	defer ConfigureJanitor(config.UploadJanitorConfig{})
+
+	require.NoError(t, ConfigureJanitor(config.UploadJanitorConfig{
+		MaxAge:   &config.TomlDuration{Duration: 6 * time.Hour},
+		Interval: &config.TomlDuration{Duration: time.Minute},
+		Dirs:     []string{"/var/tmp/uploads/"},
+	}, "/srv/public/uploads/tmp"))
+	require.Equal(t, janitorSettings{
+		maxAge:   6 * time.Hour,
+		interval: time.Minute,
+		dirs:     []string{"/var/tmp/uploads", "/srv/public/uploads/tmp"},
+	}, janitor)
+
+	require.Error(t, ConfigureJanitor(config.UploadJanitorConfig{MaxAge: &config.TomlDuration{}}))
+	require.Error(t, ConfigureJanitor(config.UploadJanitorConfig{Interval: &config.TomlDuration{}}))
+	require.Error(t, ConfigureJanitor(config.UploadJanitorConfig{Dirs: []string{"relative/tmp"}}))
+}
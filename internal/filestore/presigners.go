@@ -0,0 +1,166 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+)
+
+// Providers of object_storage destinations Workhorse presigns URLs for
+const (
+	ProviderAWS    = "AWS"
+	ProviderGoogle = "Google"
+)
+
+var (
+	presigners      map[string]objectstore.Presigner
+	presignersMutex sync.RWMutex
+)
+
+// Presigner returns the presigner of the object_storage destination name,
+// if it has a Provider
+func Presigner(name string) (objectstore.Presigner, bool) {
+	presignersMutex.RLock()
+	defer presignersMutex.RUnlock()
+
+	p, ok := presigners[name]
+	return p, ok
+}
+
+func configurePresigners(cfg map[string]config.ObjectStorageConfig) error {
+	configured := make(map[string]objectstore.Presigner)
+	for name, c := range cfg {
+		p, err := newPresigner(c)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if p != nil {
+			configured[name] = p
+		}
+	}
+
+	presignersMutex.Lock()
+	defer presignersMutex.Unlock()
+	presigners = configured
+
+	return nil
+}
+
+func newPresigner(c config.ObjectStorageConfig) (objectstore.Presigner, error) {
+	var expiry time.Duration
+	if c.PresignExpiry != nil {
+		expiry = c.PresignExpiry.Duration
+		if expiry <= 0 || expiry > objectstore.MaxPresignExpiry {
+			return nil, fmt.Errorf("PresignExpiry must be positive and at most %v", objectstore.MaxPresignExpiry)
+		}
+	}
+
+	switch c.Provider {
+	case "":
+		return nil, nil
+	case ProviderAWS:
+		// Secret references are resolved by config.ResolveSecrets, not
+		// here, so that offline validation doesn't fetch them
+		if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+			return nil, fmt.Errorf("AccessKeyID and SecretAccessKey go together")
+		}
+		if c.AccessKeyID == "" && (os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "") {
+			return nil, fmt.Errorf("AccessKeyID and SecretAccessKey, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, are needed for AWS")
+		}
+		return &objectstore.S3Presigner{
+			BucketURL:   c.URLPrefix,
+			Region:      c.Region,
+			Expiry:      expiry,
+			Credentials: awsCredentials(c.AccessKeyID, c.SecretAccessKey),
+		}, nil
+	case ProviderGoogle:
+		if c.GoogleJSONKeyFile == "" {
+			return nil, fmt.Errorf("GoogleJSONKeyFile is needed for Google")
+		}
+		keyFile := &gcsKeyFile{path: c.GoogleJSONKeyFile}
+		if _, err := keyFile.credentials(); err != nil {
+			return nil, err
+		}
+		return &objectstore.GCSPresigner{
+			BucketURL:   c.URLPrefix,
+			Expiry:      expiry,
+			Credentials: keyFile.credentials,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown Provider %q, expected %s or %s", c.Provider, ProviderAWS, ProviderGoogle)
+	}
+}
+
+// awsCredentials resolves the keys, or else reads the environment, on
+// every call. Secret references are cached and refreshed by config, so
+// this is cheap.
+func awsCredentials(accessKeyID, secretAccessKey string) func() (objectstore.S3Credentials, error) {
+	return func() (objectstore.S3Credentials, error) {
+		if accessKeyID == "" && secretAccessKey == "" {
+			return objectstore.S3Credentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			}, nil
+		}
+
+		id, err := config.ResolveSecret(accessKeyID)
+		if err != nil {
+			return objectstore.S3Credentials{}, err
+		}
+		key, err := config.ResolveSecret(secretAccessKey)
+		if err != nil {
+			return objectstore.S3Credentials{}, err
+		}
+		return objectstore.S3Credentials{AccessKeyID: id, SecretAccessKey: key}, nil
+	}
+}
+
+// gcsKeyFile reads the service account key again when the file changes,
+// so that a rotated key is used without a reload. If the new file can't
+// be read, the last key stays in use.
+type gcsKeyFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	creds   objectstore.GCSCredentials
+}
+
+func (f *gcsKeyFile) credentials() (objectstore.GCSCredentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.lastCredentials(fmt.Errorf("GoogleJSONKeyFile: %v", err))
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return f.creds, nil
+	}
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.lastCredentials(fmt.Errorf("GoogleJSONKeyFile: %v", err))
+	}
+	creds, err := objectstore.ParseGCSCredentials(data)
+	if err != nil {
+		return f.lastCredentials(fmt.Errorf("GoogleJSONKeyFile: %v", err))
+	}
+
+	f.creds = creds
+	f.modTime = info.ModTime()
+	return creds, nil
+}
+
+func (f *gcsKeyFile) lastCredentials(err error) (objectstore.GCSCredentials, error) {
+	if f.creds.PrivateKey == nil {
+		return objectstore.GCSCredentials{}, err
+	}
+	return f.creds, nil
+}
@@ -0,0 +1,119 @@
+package filestore_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+)
+
+func TestPresignerAWS(t *testing.T) {
+	require.NoError(t, filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{
+		"lfs": {
+			URLPrefix:       "https://lfs.s3.amazonaws.com/",
+			Provider:        filestore.ProviderAWS,
+			Region:          "eu-west-1",
+			AccessKeyID:     "AKIAEXAMPLE",
+			SecretAccessKey: "secret",
+			PresignExpiry:   &config.TomlDuration{Duration: time.Hour},
+		},
+		"avatars": {URLPrefix: "https://avatars.s3.amazonaws.com/"},
+	}, nil))
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	_, ok := filestore.Presigner("avatars")
+	require.False(t, ok, "destinations without Provider don't presign")
+
+	p, ok := filestore.Presigner("lfs")
+	require.True(t, ok)
+
+	presigned, err := p.Presign("GET", "lfs-objects/ab/cd/ef", 0)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(presigned, "https://lfs.s3.amazonaws.com/lfs-objects/ab/cd/ef?"), presigned)
+
+	u, err := url.Parse(presigned)
+	require.NoError(t, err)
+	require.Equal(t, "3600", u.Query().Get("X-Amz-Expires"))
+	require.True(t, strings.HasPrefix(u.Query().Get("X-Amz-Credential"), "AKIAEXAMPLE/"))
+	require.Contains(t, u.Query().Get("X-Amz-Credential"), "/eu-west-1/s3/")
+}
+
+func writeGoogleKeyFile(t *testing.T, path, email string, modTime time.Time) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+
+	data, err := json.Marshal(map[string]string{
+		"client_email": email,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+	})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestPresignerGoogleKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "presigners")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.json")
+	writeGoogleKeyFile(t, keyFile, "old@project.iam.gserviceaccount.com", time.Now().Add(-time.Hour))
+
+	require.NoError(t, filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{
+		"artifacts": {
+			URLPrefix:         "https://storage.googleapis.com/artifacts/",
+			Provider:          filestore.ProviderGoogle,
+			GoogleJSONKeyFile: keyFile,
+		},
+	}, nil))
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	p, ok := filestore.Presigner("artifacts")
+	require.True(t, ok)
+
+	credential := func() string {
+		presigned, err := p.Presign("GET", "artifacts.zip", 0)
+		require.NoError(t, err)
+		u, err := url.Parse(presigned)
+		require.NoError(t, err)
+		require.Equal(t, "900", u.Query().Get("X-Goog-Expires"))
+		return u.Query().Get("X-Goog-Credential")
+	}
+	require.True(t, strings.HasPrefix(credential(), "old@"))
+
+	writeGoogleKeyFile(t, keyFile, "new@project.iam.gserviceaccount.com", time.Now())
+	require.True(t, strings.HasPrefix(credential(), "new@"), "the rotated key is used")
+
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	require.NoError(t, os.Chtimes(keyFile, time.Now().Add(time.Hour), time.Now().Add(time.Hour)))
+	require.True(t, strings.HasPrefix(credential(), "new@"), "a broken key file keeps the last key")
+}
+
+func TestConfigurePresignersInvalid(t *testing.T) {
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	for _, c := range []config.ObjectStorageConfig{
+		{Provider: "Azure"},
+		{Provider: filestore.ProviderAWS, AccessKeyID: "AKIAEXAMPLE"},
+		{Provider: filestore.ProviderAWS, AccessKeyID: "a", SecretAccessKey: "b", PresignExpiry: &config.TomlDuration{Duration: 8 * 24 * time.Hour}},
+		{Provider: filestore.ProviderGoogle},
+		{Provider: filestore.ProviderGoogle, GoogleJSONKeyFile: "/does/not/exist.json"},
+	} {
+		c.URLPrefix = "https://bucket.example.com/"
+		err := filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{"bucket": c}, nil)
+		require.Error(t, err, "%+v", c)
+	}
+}
@@ -0,0 +1,55 @@
+package filestore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
+)
+
+var (
+	uploadsOpen = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_filestore_uploads_open",
+			Help: "How many uploads are being saved to disk or object storage now",
+		},
+	)
+	uploadsClientDisconnected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_filestore_uploads_client_disconnected",
+			Help: "How many uploads were aborted because the client went away",
+		},
+	)
+	uploadErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_filestore_upload_errors",
+			Help: "How many uploads failed, by reason",
+		},
+		[]string{"reason"},
+	)
+	uploadsTimedOut = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_filestore_uploads_timed_out",
+			Help: "How many uploads were aborted because the client or a destination stalled, by side",
+		},
+		[]string{"side"},
+	)
+	uploadFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_filestore_upload_failovers",
+			Help: "How often the uploads of an object storage destination failed over to another",
+		},
+		[]string{"destination", "failover"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(uploadsOpen)
+	prometheus.MustRegister(uploadsClientDisconnected)
+	prometheus.MustRegister(uploadsTimedOut)
+	prometheus.MustRegister(uploadErrors)
+	prometheus.MustRegister(uploadFailovers)
+
+	status.Register("uploads", func() interface{} {
+		return map[string]interface{}{"open": status.GaugeValue(uploadsOpen)}
+	})
+}
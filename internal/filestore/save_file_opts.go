@@ -1,14 +1,28 @@
 package filestore
 
 import (
+	"context"
+	"fmt"
+	"os"
 	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
 )
 
-// DefaultObjectStoreTimeout is the timeout for ObjectStore upload operation
+// DefaultObjectStoreTimeout is the timeout for ObjectStore upload operation, unless Rails
+// or the object_storage config set one
 const DefaultObjectStoreTimeout = 4 * time.Hour
 
+// DefaultClientTimeout is how long a read of the upload from the client
+// may take before the upload fails with ErrClientTimeout
+const DefaultClientTimeout = 5 * time.Minute
+
+// DefaultWriteTimeout is how long a write of the upload to its
+// destinations may take before the upload fails with ErrDestinationTimeout,
+// unless the object_storage config sets another
+const DefaultWriteTimeout = 10 * time.Minute
+
 // SaveFileOpts represents all the options available for saving a file to object store
 type SaveFileOpts struct {
 	// TempFilePrefix is the prefix used to create temporary local file
@@ -23,6 +37,10 @@ type SaveFileOpts struct {
 	PresignedPut string
 	// PresignedDelete is a presigned S3 DeleteObject compatible URL.
 	PresignedDelete string
+	// PresignedHead is an optional presigned S3 HeadObject compatible URL.
+	// The upload fails with objectstore.ErrObjectExists when it finds an
+	// object.
+	PresignedHead string
 	// HTTP headers to be sent along with PUT request
 	PutHeaders map[string]string
 
@@ -38,6 +56,30 @@ type SaveFileOpts struct {
 	PresignedCompleteMultipart string
 	// PresignedAbortMultipart is a presigned URL for AbortMultipartUpload
 	PresignedAbortMultipart string
+	// Concurrency is the number of parts uploaded at the same time
+	Concurrency int
+	// MaximumSize is the size above which the upload fails with
+	// ErrEntityTooLarge. Zero means no limit.
+	MaximumSize int64
+	// ClientTimeout is how long a read from the client may take. Zero
+	// means no limit.
+	ClientTimeout time.Duration
+	// WriteTimeout is how long a write to the destinations may take. Zero
+	// means no limit.
+	WriteTimeout time.Duration
+	// TrailingChecksum sends a checksum of the upload in a trailer, for
+	// object storage to verify it, rather than comparing the ETag
+	TrailingChecksum bool
+
+	// FailoverDestination is the object_storage destination the upload
+	// went to instead of the one Rails presigned it for, if it failed over
+	FailoverDestination string
+
+	// The values sent by Rails take precedence over the destination
+	railsTimeout  time.Duration
+	railsPartSize int64
+	// destination is the object_storage destination of the upload, if any
+	destination *destination
 }
 
 // IsLocal checks if the options require the writing of the file on disk
@@ -55,11 +97,43 @@ func (s *SaveFileOpts) IsMultipart() bool {
 	return s.PartSize > 0
 }
 
+// Validate checks that the options describe an upload SaveFileFromReader
+// can make, so that broken authorization responses fail before the body
+// is read, with an error that tells what is missing
+func (s *SaveFileOpts) Validate() error {
+	if len(s.PresignedParts) > 0 && s.PartSize <= 0 {
+		return fmt.Errorf("multipart upload with %d part URLs but no part size", len(s.PresignedParts))
+	}
+	if s.PartSize > 0 && len(s.PresignedParts) == 0 {
+		return fmt.Errorf("multipart upload with part size %d but no part URLs", s.PartSize)
+	}
+	if s.IsMultipart() && s.PresignedCompleteMultipart == "" {
+		return fmt.Errorf("multipart upload without a CompleteMultipartUpload URL")
+	}
+	if s.IsRemote() && s.Deadline.IsZero() {
+		return fmt.Errorf("object storage upload without a deadline")
+	}
+	if s.MaximumSize < 0 {
+		return fmt.Errorf("negative maximum size %d", s.MaximumSize)
+	}
+	if !s.IsLocal() && !s.IsRemote() {
+		return fmt.Errorf("no upload destination: neither a TempPath nor presigned object storage URLs")
+	}
+	if s.IsLocal() {
+		if fi, err := os.Stat(s.LocalTempPath); err == nil && !fi.IsDir() {
+			return fmt.Errorf("TempPath %q is not a directory", s.LocalTempPath)
+		}
+	}
+
+	return nil
+}
+
 // GetOpts converts GitLab api.Response to a proper SaveFileOpts
 func GetOpts(apiResponse *api.Response) *SaveFileOpts {
 	timeout := time.Duration(apiResponse.RemoteObject.Timeout) * time.Second
-	if timeout == 0 {
-		timeout = DefaultObjectStoreTimeout
+	deadline := timeout
+	if deadline == 0 {
+		deadline = DefaultObjectStoreTimeout
 	}
 
 	opts := SaveFileOpts{
@@ -68,8 +142,14 @@ func GetOpts(apiResponse *api.Response) *SaveFileOpts {
 		RemoteURL:       apiResponse.RemoteObject.GetURL,
 		PresignedPut:    apiResponse.RemoteObject.StoreURL,
 		PresignedDelete: apiResponse.RemoteObject.DeleteURL,
+		PresignedHead:   apiResponse.RemoteObject.HeadURL,
 		PutHeaders:      apiResponse.RemoteObject.PutHeaders,
-		Deadline:        time.Now().Add(timeout),
+		Deadline:        time.Now().Add(deadline),
+		Concurrency:     1,
+		MaximumSize:     apiResponse.MaximumSize,
+		ClientTimeout:   DefaultClientTimeout,
+		WriteTimeout:    DefaultWriteTimeout,
+		railsTimeout:    timeout,
 	}
 
 	// Backwards compatibility to ensure API servers that do not include the
@@ -84,7 +164,55 @@ func GetOpts(apiResponse *api.Response) *SaveFileOpts {
 		opts.PresignedCompleteMultipart = multiParams.CompleteURL
 		opts.PresignedAbortMultipart = multiParams.AbortURL
 		opts.PresignedParts = append([]string(nil), multiParams.PartURLs...)
+		opts.railsPartSize = multiParams.PartSize
+	}
+
+	if dest, ok := findDestination(opts.presignedURL()); ok {
+		opts.applyDestination(dest)
 	}
 
 	return &opts
 }
+
+// provider sends the requests of the upload to object storage
+func (s *SaveFileOpts) provider() objectstore.Provider {
+	if s.TrailingChecksum {
+		return objectstore.S3TrailingChecksum
+	}
+	return objectstore.S3
+}
+
+// presignedURL is the URL the upload, or its first part, goes to
+func (s *SaveFileOpts) presignedURL() string {
+	if len(s.PresignedParts) > 0 {
+		return s.PresignedParts[0]
+	}
+	return s.PresignedPut
+}
+
+// applyDestination sets the defaults of dest for the values Rails didn't
+// send
+func (s *SaveFileOpts) applyDestination(dest destination) {
+	if s.railsTimeout == 0 && dest.Timeout != nil {
+		s.Deadline = time.Now().Add(dest.Timeout.Duration)
+	}
+	if s.railsPartSize == 0 && len(s.PresignedParts) > 0 && dest.PartSize > 0 {
+		s.PartSize = dest.PartSize
+	}
+	if dest.Concurrency > 0 {
+		s.Concurrency = dest.Concurrency
+	}
+	if dest.WriteTimeout != nil {
+		s.WriteTimeout = dest.WriteTimeout.Duration
+	}
+	s.TrailingChecksum = dest.TrailingChecksum
+	s.destination = &dest
+}
+
+// applyUploadRoute sets the defaults of the destination of the upload type
+// of ctx, which win over the destination found by URL
+func (s *SaveFileOpts) applyUploadRoute(ctx context.Context) {
+	if dest, ok := findRoutedDestination(ctx, s.presignedURL()); ok {
+		s.applyDestination(dest)
+	}
+}
@@ -1,10 +1,14 @@
 package filestore_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
@@ -114,7 +118,8 @@ func TestGetOpts(t *testing.T) {
 
 			assert := assert.New(t)
 			apiResponse := &api.Response{
-				TempPath: "/tmp",
+				TempPath:    "/tmp",
+				MaximumSize: 1024,
 				RemoteObject: api.RemoteObject{
 					Timeout:          10,
 					ID:               "id",
@@ -135,6 +140,7 @@ func TestGetOpts(t *testing.T) {
 			assert.Equal(apiResponse.RemoteObject.GetURL, opts.RemoteURL)
 			assert.Equal(apiResponse.RemoteObject.StoreURL, opts.PresignedPut)
 			assert.Equal(apiResponse.RemoteObject.DeleteURL, opts.PresignedDelete)
+			assert.Equal(apiResponse.MaximumSize, opts.MaximumSize)
 			if test.customPutHeaders {
 				assert.Equal(opts.PutHeaders, apiResponse.RemoteObject.PutHeaders)
 			} else {
@@ -166,3 +172,86 @@ func TestGetOptsDefaultTimeout(t *testing.T) {
 
 	assert.WithinDuration(deadline, opts.Deadline, time.Minute)
 }
+
+func TestSaveFileOptsValidate(t *testing.T) {
+	file, err := ioutil.TempFile("", "not-a-dir")
+	require.NoError(t, err)
+	file.Close()
+	defer os.Remove(file.Name())
+
+	multipart := &api.MultipartUploadParams{
+		PartSize:    10,
+		PartURLs:    []string{"https://bucket.example.com/object?partNumber=1"},
+		CompleteURL: "https://bucket.example.com/object?uploadId=1",
+	}
+
+	tests := []struct {
+		name  string
+		opts  func(*filestore.SaveFileOpts)
+		error string
+	}{
+		{name: "local", opts: func(o *filestore.SaveFileOpts) { o.LocalTempPath = os.TempDir() }},
+		{name: "missing local dir is created", opts: func(o *filestore.SaveFileOpts) { o.LocalTempPath = filepath.Join(os.TempDir(), "missing") }},
+		{name: "remote", opts: func(o *filestore.SaveFileOpts) { o.PresignedPut = "https://bucket.example.com/object" }},
+		{name: "multipart", opts: func(o *filestore.SaveFileOpts) {
+			*o = *filestore.GetOpts(&api.Response{RemoteObject: api.RemoteObject{MultipartUpload: multipart}})
+		}},
+		{name: "no destination", opts: func(o *filestore.SaveFileOpts) {}, error: "no upload destination"},
+		{name: "temp path is a file", opts: func(o *filestore.SaveFileOpts) { o.LocalTempPath = file.Name() }, error: "is not a directory"},
+		{
+			name: "part URLs without part size",
+			opts: func(o *filestore.SaveFileOpts) {
+				o.PresignedParts = multipart.PartURLs
+				o.PresignedCompleteMultipart = multipart.CompleteURL
+			},
+			error: "no part size",
+		},
+		{
+			name: "part size without part URLs",
+			opts: func(o *filestore.SaveFileOpts) {
+				o.PartSize = 10
+				o.PresignedCompleteMultipart = multipart.CompleteURL
+			},
+			error: "no part URLs",
+		},
+		{
+			name: "multipart without complete URL",
+			opts: func(o *filestore.SaveFileOpts) {
+				o.PartSize = 10
+				o.PresignedParts = multipart.PartURLs
+			},
+			error: "CompleteMultipartUpload URL",
+		},
+		{
+			name: "remote without deadline",
+			opts: func(o *filestore.SaveFileOpts) {
+				o.PresignedPut = "https://bucket.example.com/object"
+				o.Deadline = time.Time{}
+			},
+			error: "without a deadline",
+		},
+		{
+			name: "negative maximum size",
+			opts: func(o *filestore.SaveFileOpts) {
+				o.LocalTempPath = os.TempDir()
+				o.MaximumSize = -1
+			},
+			error: "negative maximum size",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := filestore.GetOpts(&api.Response{})
+			tc.opts(opts)
+
+			err := opts.Validate()
+			if tc.error == "" {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tc.error)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package filestore
+
+import (
+	"errors"
+	"net/http"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+)
+
+// uploadErrorKinds are the errors of failed uploads that are not the fault
+// of Workhorse, with the status the client gets for them and their label
+// in gitlab_workhorse_filestore_upload_errors
+var uploadErrorKinds = []struct {
+	err    error
+	status int
+	reason string
+}{
+	{ErrEntityTooLarge, http.StatusRequestEntityTooLarge, "too_large"},
+	{ErrClientDisconnected, helper.StatusClientClosedRequest, "client_disconnected"},
+	{ErrClientTimeout, http.StatusRequestTimeout, "client_timeout"},
+	{ErrDestinationTimeout, http.StatusBadGateway, "destination_timeout"},
+	{objectstore.ErrObjectStoreUnavailable, http.StatusBadGateway, "object_storage_unavailable"},
+	{objectstore.ErrETagMismatch, http.StatusBadGateway, "etag_mismatch"},
+	{objectstore.ErrObjectExists, http.StatusConflict, "object_exists"},
+	{objectstore.ErrDeadlineExceeded, http.StatusGatewayTimeout, "deadline_exceeded"},
+}
+
+// FailUpload answers a request whose upload failed with err, with a status
+// that tells if the client, object storage or Workhorse is to blame
+func FailUpload(w http.ResponseWriter, r *http.Request, err error) {
+	status, reason := http.StatusInternalServerError, "internal"
+	for _, kind := range uploadErrorKinds {
+		if errors.Is(err, kind.err) {
+			status, reason = kind.status, kind.reason
+			break
+		}
+	}
+	uploadErrors.WithLabelValues(reason).Inc()
+
+	switch status {
+	case helper.StatusClientClosedRequest:
+		helper.ClientClosedRequest(w, r, err)
+	case http.StatusInternalServerError:
+		helper.Fail500(w, r, err)
+	default:
+		helper.CaptureAndFail(w, r, err, http.StatusText(status), status)
+	}
+}
@@ -0,0 +1,42 @@
+package filestore_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/objectstore"
+)
+
+func TestFailUpload(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{filestore.ErrEntityTooLarge, http.StatusRequestEntityTooLarge},
+		{filestore.ErrClientDisconnected, helper.StatusClientClosedRequest},
+		{filestore.ErrClientTimeout, http.StatusRequestTimeout},
+		{filestore.ErrDestinationTimeout, http.StatusBadGateway},
+		{fmt.Errorf("upload part 2: %w", fmt.Errorf("%w: PUT request: 503", objectstore.ErrObjectStoreUnavailable)), http.StatusBadGateway},
+		{fmt.Errorf("%w: expected %q got %q", objectstore.ErrETagMismatch, "a", "b"), http.StatusBadGateway},
+		{fmt.Errorf("%w: context deadline exceeded", objectstore.ErrDeadlineExceeded), http.StatusGatewayTimeout},
+		{fmt.Errorf("%w: http://store/tmp/uploads/1", objectstore.ErrObjectExists), http.StatusConflict},
+		{errors.New("uploadLocalFile: create file: no space left on device"), http.StatusInternalServerError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("PUT", "/upload", nil)
+
+			filestore.FailUpload(w, r, fmt.Errorf("BodyUploader: upload failed: %w", tc.err))
+			require.Equal(t, tc.status, w.Code)
+		})
+	}
+}
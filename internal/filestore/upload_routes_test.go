@@ -0,0 +1,104 @@
+package filestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestApplyUploadRoute(t *testing.T) {
+	require.NoError(t, ConfigureObjectStorage(
+		map[string]config.ObjectStorageConfig{
+			"default": {
+				URLPrefix: "https://uploads.example.com/",
+				Timeout:   &config.TomlDuration{Duration: 5 * time.Minute},
+			},
+			"lfs": {
+				URLPrefix:   "https://uploads.example.com/",
+				Timeout:     &config.TomlDuration{Duration: 12 * time.Hour},
+				Concurrency: 8,
+			},
+		},
+		map[string]config.UploadRouteConfig{
+			UploadTypeLFS: {Destination: "lfs", RemotePathPrefix: "lfs-objects/"},
+		},
+	))
+	defer ConfigureObjectStorage(nil, nil)
+
+	tests := []struct {
+		name        string
+		uploadType  string
+		storeURL    string
+		railsTime   int
+		timeout     time.Duration
+		concurrency int
+	}{
+		{
+			name:        "routed",
+			uploadType:  UploadTypeLFS,
+			storeURL:    "https://uploads.example.com/lfs-objects/ab/cd",
+			timeout:     12 * time.Hour,
+			concurrency: 8,
+		},
+		{
+			name:        "Rails timeout wins",
+			uploadType:  UploadTypeLFS,
+			storeURL:    "https://uploads.example.com/lfs-objects/ab/cd",
+			railsTime:   60,
+			timeout:     time.Minute,
+			concurrency: 8,
+		},
+		{
+			name:        "presigned elsewhere",
+			uploadType:  UploadTypeLFS,
+			storeURL:    "https://uploads.example.com/other/ab/cd",
+			timeout:     5 * time.Minute,
+			concurrency: 1,
+		},
+		{
+			name:        "no route for the type",
+			uploadType:  UploadTypeArtifacts,
+			storeURL:    "https://uploads.example.com/lfs-objects/ab/cd",
+			timeout:     5 * time.Minute,
+			concurrency: 1,
+		},
+		{
+			name:        "no upload type",
+			storeURL:    "https://uploads.example.com/lfs-objects/ab/cd",
+			timeout:     5 * time.Minute,
+			concurrency: 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.uploadType != "" {
+				ctx = WithUploadType(ctx, tc.uploadType)
+			}
+
+			opts := GetOpts(&api.Response{RemoteObject: api.RemoteObject{StoreURL: tc.storeURL, Timeout: tc.railsTime}})
+			opts.applyUploadRoute(ctx)
+
+			require.WithinDuration(t, time.Now().Add(tc.timeout), opts.Deadline, time.Minute)
+			require.Equal(t, tc.concurrency, opts.Concurrency)
+		})
+	}
+}
+
+func TestConfigureUploadRoutesInvalid(t *testing.T) {
+	destinations := map[string]config.ObjectStorageConfig{"lfs": {URLPrefix: "https://uploads.example.com/"}}
+
+	err := ConfigureObjectStorage(destinations, map[string]config.UploadRouteConfig{"avatars": {Destination: "lfs"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown upload type")
+
+	err = ConfigureObjectStorage(destinations, map[string]config.UploadRouteConfig{UploadTypeLFS: {Destination: "missing"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `no object_storage section "missing"`)
+}
@@ -0,0 +1,88 @@
+/*
+Package geoip tells the country of the clients of requests, from a MaxMind
+GeoIP2 or GeoLite2 database, so that logs and metrics can tell where the
+traffic comes from without exporting the addresses of the clients.
+*/
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+var (
+	mu sync.RWMutex
+	db *maxminddb.Reader
+)
+
+// record is the part of a Country or City database record we use
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Configure opens the database of cfg. The database is memory mapped
+// and lookups may be in flight, so it is only opened once, at startup.
+func Configure(cfg config.GeoIPConfig) error {
+	var reader *maxminddb.Reader
+	if cfg.Database != "" {
+		var err error
+		if reader, err = maxminddb.Open(cfg.Database); err != nil {
+			return fmt.Errorf("Database: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	db = reader
+
+	return nil
+}
+
+// Enabled tells if a database is configured
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return db != nil
+}
+
+// Country returns the ISO 3166-1 code of the country of the client of r,
+// or "" if it is unknown. Clients without a country of their own, like
+// anonymous proxies, get the country where their network is registered.
+func Country(r *http.Request) string {
+	mu.RLock()
+	reader := db
+	mu.RUnlock()
+
+	if reader == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	var rec record
+	if err := reader.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	return rec.RegisteredCountry.ISOCode
+}
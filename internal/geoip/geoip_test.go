@@ -0,0 +1,183 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// treeNode is a node of the search tree of a MaxMind DB. A record is
+// either another node or the offset of a country in the data section.
+type treeNode struct {
+	children [2]*treeNode
+	data     [2]int
+}
+
+// writeDatabase writes an IPv6 MaxMind DB that maps the networks to the
+// ISO codes of their country, with 24 bit records
+func writeDatabase(t *testing.T, dir string, networks map[string]string) string {
+	var data bytes.Buffer
+	offsets := make(map[string]int)
+	root := &treeNode{data: [2]int{-1, -1}}
+
+	var cidrs []string
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	for _, cidr := range cidrs {
+		country := networks[cidr]
+		if _, ok := offsets[country]; !ok {
+			offsets[country] = data.Len()
+			data.Write(encodeMap(map[string][]byte{"country": encodeMap(map[string][]byte{"iso_code": encodeString(country)})}))
+		}
+
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, bits := ipNet.Mask.Size()
+		if ipv4 := ip.To4(); ipv4 != nil {
+			// IPv4 networks are in the ::/96 subtree
+			ip = append(make(net.IP, 12), ipv4...)
+			ones += 96
+		}
+		require.True(t, bits == 32 || bits == 128)
+
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				node.data[bit] = offsets[country]
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &treeNode{data: [2]int{-1, -1}}
+			}
+			node = node.children[bit]
+		}
+	}
+
+	var nodes []*treeNode
+	index := make(map[*treeNode]int)
+	for queue := []*treeNode{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, child := range queue[0].children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+	var db bytes.Buffer
+	for _, node := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := nodeCount
+			if node.children[bit] != nil {
+				record = index[node.children[bit]]
+			} else if node.data[bit] >= 0 {
+				record = nodeCount + 16 + node.data[bit]
+			}
+			db.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xAB\xCD\xEFMaxMind.com")
+	db.Write(encodeMap(map[string][]byte{
+		"binary_format_major_version": encodeUint(5, 2),
+		"binary_format_minor_version": encodeUint(5, 0),
+		"build_epoch":                 encodeUint(6, 0),
+		"database_type":               encodeString("Test-Country"),
+		"ip_version":                  encodeUint(5, 6),
+		"node_count":                  encodeUint(6, uint32(nodeCount)),
+		"record_size":                 encodeUint(5, 24),
+	}))
+
+	path := filepath.Join(dir, "test.mmdb")
+	require.NoError(t, ioutil.WriteFile(path, db.Bytes(), 0644))
+	return path
+}
+
+func encodeString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func encodeUint(typ byte, n uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, n)
+	buf = bytes.TrimLeft(buf, "\x00")
+	return append([]byte{typ<<5 | byte(len(buf))}, buf...)
+}
+
+func encodeMap(m map[string][]byte) []byte {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encoded := []byte{7<<5 | byte(len(m))}
+	for _, key := range keys {
+		encoded = append(encoded, encodeString(key)...)
+		encoded = append(encoded, m[key]...)
+	}
+	return encoded
+}
+
+func TestCountry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeDatabase(t, dir, map[string]string{
+		"192.0.2.0/24":  "DE",
+		"10.0.0.0/8":    "FR",
+		"2001:db8::/32": "JP",
+	})
+	require.NoError(t, Configure(config.GeoIPConfig{Database: path}))
+	defer Configure(config.GeoIPConfig{})
+	require.True(t, Enabled())
+
+	tests := []struct {
+		remoteAddr string
+		country    string
+	}{
+		{remoteAddr: "192.0.2.1:1000", country: "DE"},
+		{remoteAddr: "10.20.30.40:1000", country: "FR"},
+		{remoteAddr: "[2001:db8::1]:1000", country: "JP"},
+		{remoteAddr: "198.51.100.1:1000", country: ""},
+		{remoteAddr: "@", country: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.remoteAddr, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			require.Equal(t, tc.country, Country(r))
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	require.NoError(t, Configure(config.GeoIPConfig{}))
+	require.False(t, Enabled())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	require.Empty(t, Country(r))
+}
+
+func TestConfigureMissingDatabase(t *testing.T) {
+	require.Error(t, Configure(config.GeoIPConfig{Database: "/does/not/exist.mmdb"}))
+}
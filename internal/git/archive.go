@@ -21,12 +21,16 @@ import (
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
 )
 
-type archive struct{ senddata.Prefix }
+type archive struct {
+	senddata.Prefix
+	transcode bool
+}
 type archiveParams struct {
 	ArchivePath       string
 	ArchivePrefix     string
@@ -35,10 +39,16 @@ type archiveParams struct {
 	GitalyRepository  gitalypb.Repository
 	DisableCache      bool
 	GetArchiveRequest []byte
+
+	// ArchiveFilename is the download file name when there is no
+	// ArchivePath to cache the archive on
+	ArchiveFilename string
+	// Path limits the archive to a subdirectory of the repository
+	Path string
 }
 
 var (
-	SendArchive     = &archive{"git-archive:"}
+	SendArchive     = &archive{Prefix: "git-archive:"}
 	gitArchiveCache = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gitlab_workhorse_git_archive_cache",
@@ -52,6 +62,13 @@ func init() {
 	prometheus.MustRegister(gitArchiveCache)
 }
 
+// NewSendArchive returns a 'git-archive:' injecter. When cfg enables
+// transcoding, zip and tar.gz archives are produced by Workhorse from a
+// plain tar stream requested from Gitaly.
+func NewSendArchive(cfg config.ArchiveConfig) senddata.Injecter {
+	return &archive{Prefix: SendArchive.Prefix, transcode: cfg.Transcode}
+}
+
 func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 	var params archiveParams
 	if err := a.Unpack(&params, sendData); err != nil {
@@ -60,14 +77,17 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 	}
 
 	urlPath := r.URL.Path
-	format, ok := parseBasename(filepath.Base(urlPath))
-	if !ok {
-		helper.Fail500(w, r, fmt.Errorf("SendArchive: invalid format: %s", urlPath))
+	request, err := newArchiveRequest(params, urlPath)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendArchive: %v", err))
 		return
 	}
+	format := request.Format
 
-	cacheEnabled := !params.DisableCache
-	archiveFilename := path.Base(params.ArchivePath)
+	// Without an ArchivePath there is no shared storage to cache the
+	// archive on, and every request is streamed from Gitaly.
+	cacheEnabled := !params.DisableCache && params.ArchivePath != ""
+	archiveFilename := archiveFilename(params, urlPath)
 
 	if cacheEnabled {
 		cachedArchive, err := os.Open(params.ArchivePath)
@@ -78,7 +98,7 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 			// Even if somebody deleted the cachedArchive from disk since we opened
 			// the file, Unix file semantics guarantee we can still read from the
 			// open file in this process.
-			http.ServeContent(w, r, "", time.Unix(0, 0), cachedArchive)
+			http.ServeContent(helper.WithPooledCopy(w), r, "", time.Unix(0, 0), cachedArchive)
 			return
 		}
 	}
@@ -86,7 +106,6 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 	gitArchiveCache.WithLabelValues("miss").Inc()
 
 	var tempFile *os.File
-	var err error
 
 	if cacheEnabled {
 		// We assume the tempFile has a unique name so that concurrent requests are
@@ -104,12 +123,16 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 
 	var archiveReader io.Reader
 
-	archiveReader, err = handleArchiveWithGitaly(r, params, format)
+	archiveReader, err = handleArchiveWithGitaly(r, params.GitalyServer, request, a.transcode)
 	if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("operations.GetArchive: %v", err))
 		return
 	}
 
+	if closer, ok := archiveReader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	reader := archiveReader
 	if cacheEnabled {
 		reader = io.TeeReader(archiveReader, tempFile)
@@ -118,7 +141,7 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 	// Start writing the response
 	setArchiveHeaders(w, format, archiveFilename)
 	w.WriteHeader(200) // Don't bother with HTTP 500 from this point on, just return
-	if _, err := io.Copy(w, reader); err != nil {
+	if _, err := helper.Copy(w, reader); err != nil {
 		helper.LogError(r, &copyError{fmt.Errorf("SendArchive: copy 'git archive' output: %v", err)})
 		return
 	}
@@ -132,29 +155,63 @@ func (a *archive) Inject(w http.ResponseWriter, r *http.Request, sendData string
 	}
 }
 
-func handleArchiveWithGitaly(r *http.Request, params archiveParams, format gitalypb.GetArchiveRequest_Format) (io.Reader, error) {
-	var request *gitalypb.GetArchiveRequest
-	ctx, c, err := gitaly.NewRepositoryClient(r.Context(), params.GitalyServer)
+// newArchiveRequest builds the Gitaly request for params. Rails either
+// sends a complete serialized GetArchiveRequest, or the individual fields
+// with the format derived from the requested file name.
+func newArchiveRequest(params archiveParams, urlPath string) (*gitalypb.GetArchiveRequest, error) {
+	if params.GetArchiveRequest != nil {
+		request := &gitalypb.GetArchiveRequest{}
+		if err := proto.Unmarshal(params.GetArchiveRequest, request); err != nil {
+			return nil, fmt.Errorf("unmarshal GetArchiveRequest: %v", err)
+		}
+
+		return request, nil
+	}
+
+	format, ok := parseBasename(filepath.Base(urlPath))
+	if !ok {
+		return nil, fmt.Errorf("invalid format: %s", urlPath)
+	}
+
+	return &gitalypb.GetArchiveRequest{
+		Repository: &params.GitalyRepository,
+		CommitId:   params.CommitId,
+		Prefix:     params.ArchivePrefix,
+		Format:     format,
+		Path:       []byte(params.Path),
+	}, nil
+}
+
+func archiveFilename(params archiveParams, urlPath string) string {
+	switch {
+	case params.ArchivePath != "":
+		return path.Base(params.ArchivePath)
+	case params.ArchiveFilename != "":
+		return path.Base(params.ArchiveFilename)
+	default:
+		return path.Base(urlPath)
+	}
+}
+
+func handleArchiveWithGitaly(r *http.Request, server gitaly.Server, request *gitalypb.GetArchiveRequest, transcode bool) (io.Reader, error) {
+	ctx, c, err := gitaly.NewRepositoryClient(r.Context(), server)
 	if err != nil {
 		return nil, err
 	}
 
-	if params.GetArchiveRequest != nil {
-		request = &gitalypb.GetArchiveRequest{}
+	if !transcode || !canTranscode(request.Format) {
+		return c.ArchiveReader(ctx, request)
+	}
 
-		if err := proto.Unmarshal(params.GetArchiveRequest, request); err != nil {
-			return nil, fmt.Errorf("unmarshal GetArchiveRequest: %v", err)
-		}
-	} else {
-		request = &gitalypb.GetArchiveRequest{
-			Repository: &params.GitalyRepository,
-			CommitId:   params.CommitId,
-			Prefix:     params.ArchivePrefix,
-			Format:     format,
-		}
+	targetFormat := request.Format
+	request.Format = gitalypb.GetArchiveRequest_TAR
+
+	reader, err := c.ArchiveReader(ctx, request)
+	if err != nil {
+		return nil, err
 	}
 
-	return c.ArchiveReader(ctx, request)
+	return transcodeArchive(reader, targetFormat), nil
 }
 
 func setArchiveHeaders(w http.ResponseWriter, format gitalypb.GetArchiveRequest_Format, archiveFilename string) {
@@ -5,6 +5,8 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
@@ -83,3 +85,45 @@ func TestSetArchiveHeaders(t *testing.T) {
 		testhelper.AssertAbsentResponseWriterHeader(t, w, "Set-Cookie")
 	}
 }
+
+func TestNewArchiveRequest(t *testing.T) {
+	params := archiveParams{
+		GitalyRepository: gitalypb.Repository{StorageName: "default", RelativePath: "foo/bar.git"},
+		CommitId:         "c7fbe50c7c7419d9701eebe64b1fdacc3df5b9dd",
+		ArchivePrefix:    "bar-master-docs",
+		Path:             "docs",
+	}
+
+	request, err := newArchiveRequest(params, "/foo/bar/-/archive/master/bar-master-docs.zip")
+	require.NoError(t, err)
+	require.Equal(t, gitalypb.GetArchiveRequest_ZIP, request.Format)
+	require.Equal(t, "default", request.Repository.StorageName)
+	require.Equal(t, params.CommitId, request.CommitId)
+	require.Equal(t, params.ArchivePrefix, request.Prefix)
+	require.Equal(t, []byte("docs"), request.Path)
+
+	_, err = newArchiveRequest(params, "/foo/bar/-/archive/master/bar-master.rar")
+	require.Error(t, err, "unknown format")
+
+	// A serialized request wins, including its format
+	serialized, err := proto.Marshal(&gitalypb.GetArchiveRequest{
+		CommitId: params.CommitId,
+		Format:   gitalypb.GetArchiveRequest_TAR_BZ2,
+		Path:     []byte("src"),
+	})
+	require.NoError(t, err)
+	params.GetArchiveRequest = serialized
+
+	request, err = newArchiveRequest(params, "/foo/bar/-/archive/master/archive")
+	require.NoError(t, err)
+	require.Equal(t, gitalypb.GetArchiveRequest_TAR_BZ2, request.Format)
+	require.Equal(t, []byte("src"), request.Path)
+}
+
+func TestArchiveFilename(t *testing.T) {
+	urlPath := "/foo/bar/-/archive/master/bar-master.zip"
+
+	require.Equal(t, "cached.zip", archiveFilename(archiveParams{ArchivePath: "/cache/project/cached.zip", ArchiveFilename: "ignored.zip"}, urlPath))
+	require.Equal(t, "bar-v1.0.zip", archiveFilename(archiveParams{ArchiveFilename: "bar-v1.0.zip"}, urlPath))
+	require.Equal(t, "bar-master.zip", archiveFilename(archiveParams{}, urlPath))
+}
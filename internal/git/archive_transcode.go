@@ -0,0 +1,134 @@
+/*
+In this file we convert plain tar streams coming from Gitaly into other
+archive formats on the fly
+*/
+
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+)
+
+// canTranscode reports whether Workhorse can produce format from a plain
+// tar stream. There is no bzip2 writer in the standard library so those
+// archives are always generated by Gitaly.
+func canTranscode(format gitalypb.GetArchiveRequest_Format) bool {
+	switch format {
+	case gitalypb.GetArchiveRequest_ZIP, gitalypb.GetArchiveRequest_TAR_GZ:
+		return true
+	}
+
+	return false
+}
+
+// transcodeArchive converts the tar stream read from r into format. The
+// conversion runs in a goroutine connected with a pipe, so the archive is
+// never held in memory as a whole. The caller must close the returned
+// reader to release the goroutine.
+func transcodeArchive(r io.Reader, format gitalypb.GetArchiveRequest_Format) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		var err error
+
+		switch format {
+		case gitalypb.GetArchiveRequest_ZIP:
+			err = tarToZip(pw, r)
+		case gitalypb.GetArchiveRequest_TAR_GZ:
+			err = tarToTarGz(pw, r)
+		default:
+			err = fmt.Errorf("transcodeArchive: unsupported format %v", format)
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func tarToTarGz(w io.Writer, r io.Reader) error {
+	gz := gzip.NewWriter(w)
+	if _, err := io.Copy(gz, r); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func tarToZip(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	zw := zip.NewWriter(w)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar header: %v", err)
+		}
+
+		// 'git archive' stores the commit ID in a pax global header. The zip
+		// equivalent is the archive comment.
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if comment, ok := hdr.PAXRecords["comment"]; ok {
+				if err := zw.SetComment(comment); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := copyTarEntryToZip(zw, hdr, tr); err != nil {
+			return fmt.Errorf("transcode %q: %v", hdr.Name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+func copyTarEntryToZip(zw *zip.Writer, hdr *tar.Header, tr *tar.Reader) error {
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return err
+	}
+	fh.Name = hdr.Name
+	fh.Modified = hdr.ModTime
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		fh.Method = zip.Store
+		_, err := zw.CreateHeader(fh)
+		return err
+	case tar.TypeSymlink:
+		// Like 'git archive --format=zip' we store the link target as the
+		// entry contents.
+		fh.Method = zip.Store
+		fh.SetMode(os.ModeSymlink | 0777)
+		entry, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(entry, hdr.Linkname)
+		return err
+	case tar.TypeReg, tar.TypeRegA:
+		fh.Method = zip.Deflate
+		entry, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, tr)
+		return err
+	}
+
+	// Git archives contain nothing but directories, files and symlinks;
+	// anything else is silently dropped.
+	return nil
+}
@@ -0,0 +1,105 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+)
+
+func testTarArchive(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	modTime := time.Unix(1500000000, 0)
+	entries := []struct {
+		hdr  tar.Header
+		body string
+	}{
+		{tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "deadbeef"}}, ""},
+		{tar.Header{Typeflag: tar.TypeDir, Name: "project/", Mode: 0775, ModTime: modTime}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "project/README.md", Mode: 0664, ModTime: modTime}, "hello world"},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "project/link", Linkname: "README.md", Mode: 0777, ModTime: modTime}, ""},
+	}
+
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.body))
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(e.body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	return buf.Bytes()
+}
+
+func TestCanTranscode(t *testing.T) {
+	require.True(t, canTranscode(gitalypb.GetArchiveRequest_ZIP))
+	require.True(t, canTranscode(gitalypb.GetArchiveRequest_TAR_GZ))
+	require.False(t, canTranscode(gitalypb.GetArchiveRequest_TAR))
+	require.False(t, canTranscode(gitalypb.GetArchiveRequest_TAR_BZ2))
+}
+
+func TestTranscodeTarToZip(t *testing.T) {
+	reader := transcodeArchive(bytes.NewReader(testTarArchive(t)), gitalypb.GetArchiveRequest_ZIP)
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Equal(t, "deadbeef", archive.Comment)
+	require.Len(t, archive.File, 3)
+
+	require.Equal(t, "project/", archive.File[0].Name)
+	require.True(t, archive.File[0].Mode().IsDir())
+
+	readme := archive.File[1]
+	require.Equal(t, "project/README.md", readme.Name)
+	require.Equal(t, os.FileMode(0664), readme.Mode().Perm())
+	require.Equal(t, int64(1500000000), readme.Modified.Unix())
+	rc, err := readme.Open()
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(contents))
+
+	link := archive.File[2]
+	require.Equal(t, os.ModeSymlink, link.Mode()&os.ModeSymlink)
+	rc, err = link.Open()
+	require.NoError(t, err)
+	contents, err = ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	require.Equal(t, "README.md", string(contents))
+}
+
+func TestTranscodeTarToTarGz(t *testing.T) {
+	tarData := testTarArchive(t)
+
+	reader := transcodeArchive(bytes.NewReader(tarData), gitalypb.GetArchiveRequest_TAR_GZ)
+	defer reader.Close()
+
+	gz, err := gzip.NewReader(reader)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, tarData, data)
+}
+
+func TestTranscodeInvalidTar(t *testing.T) {
+	reader := transcodeArchive(bytes.NewReader([]byte("not a tar archive, but long enough to fill a header block")), gitalypb.GetArchiveRequest_ZIP)
+	defer reader.Close()
+
+	_, err := ioutil.ReadAll(reader)
+	require.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+var (
+	gitHTTPRepositoryBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_http_repository_bytes",
+			Help: "How many Git HTTP bytes have been streamed by gitlab-workhorse, partitioned by service, hashed repository path, protocol version and direction.",
+		},
+		[]string{"service", "repository", "protocol", "direction"},
+	)
+
+	gitHTTPResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_git_http_response_size_bytes",
+			Help:    "Size of Git HTTP upload-pack and receive-pack responses, partitioned by service and protocol version.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12), // 1KiB up to 4GiB
+		},
+		[]string{"service", "protocol"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(gitHTTPRepositoryBytes)
+	prometheus.MustRegister(gitHTTPResponseBytes)
+}
+
+// logBandwidth records the bytes streamed for a single upload-pack or
+// receive-pack request. Repository paths are hashed so the metrics can be
+// shared without disclosing project names.
+func logBandwidth(r *http.Request, a *api.Response, writtenIn, writtenOut int64, perRepository bool) {
+	service := getService(r)
+	protocol := gitProtocolVersion(r.Header.Get("Git-Protocol"))
+
+	gitHTTPResponseBytes.WithLabelValues(service, protocol).Observe(float64(writtenOut))
+
+	if !perRepository {
+		return
+	}
+
+	repository := repositoryHash(a)
+	gitHTTPRepositoryBytes.WithLabelValues(service, repository, protocol, directionIn).Add(float64(writtenIn))
+	gitHTTPRepositoryBytes.WithLabelValues(service, repository, protocol, directionOut).Add(float64(writtenOut))
+}
+
+func repositoryHash(a *api.Response) string {
+	h := sha256.Sum256([]byte(a.Repository.StorageName + "/" + a.Repository.RelativePath))
+	return hex.EncodeToString(h[:8])
+}
+
+// gitProtocolVersion returns the protocol version requested in a
+// Git-Protocol header. Clients that send no header speak version 0. The
+// header is sent by clients, so unknown versions are all "other" to bound
+// the label values.
+func gitProtocolVersion(gitProtocol string) string {
+	for _, p := range strings.Split(gitProtocol, ":") {
+		if strings.HasPrefix(p, "version=") {
+			switch version := strings.TrimPrefix(p, "version="); version {
+			case "0", "1", "2":
+				return version
+			default:
+				return "other"
+			}
+		}
+	}
+	return "0"
+}
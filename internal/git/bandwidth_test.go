@@ -0,0 +1,29 @@
+package git
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestGitProtocolVersion(t *testing.T) {
+	require.Equal(t, "0", gitProtocolVersion(""))
+	require.Equal(t, "2", gitProtocolVersion("version=2"))
+	require.Equal(t, "1", gitProtocolVersion("foo=bar:version=1"))
+	require.Equal(t, "other", gitProtocolVersion("version=3"))
+	require.Equal(t, "other", gitProtocolVersion("version=abc123"))
+}
+
+func TestRepositoryHash(t *testing.T) {
+	a := &api.Response{Repository: gitalypb.Repository{StorageName: "default", RelativePath: "group/project.git"}}
+	b := &api.Response{Repository: gitalypb.Repository{StorageName: "default", RelativePath: "group/other.git"}}
+
+	require.Len(t, repositoryHash(a), 16)
+	require.Equal(t, repositoryHash(a), repositoryHash(a))
+	require.NotEqual(t, repositoryHash(a), repositoryHash(b))
+	require.NotContains(t, repositoryHash(a), "project")
+}
@@ -33,7 +33,10 @@ func (b *blob) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
 	}
 
 	setBlobHeaders(w)
-	if err := blobClient.SendBlob(ctx, w, &params.GetBlobRequest); err != nil {
+	if err := blobClient.SendBlob(ctx, w, &params.GetBlobRequest); err == gitaly.ErrBlobNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		helper.Fail500(w, r, fmt.Errorf("blob.GetBlob: %v", err))
 		return
 	}
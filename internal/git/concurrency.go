@@ -0,0 +1,93 @@
+/*
+In this file we limit the number of concurrent Git operations per user and
+per repository
+*/
+
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/limiter"
+)
+
+const concurrencyRetryAfter = 30 * time.Second
+
+var gitConcurrencyLimited = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_git_concurrency_limited",
+		Help: "How many Git HTTP requests were rejected because of a per-user or per-repository concurrency limit",
+	},
+	[]string{"limit"},
+)
+
+func init() {
+	prometheus.MustRegister(gitConcurrencyLimited)
+}
+
+type concurrencyLimit struct {
+	name string
+	key  string
+	max  int
+}
+
+func concurrencyLimits(a *api.Response, cfg config.GitConfig) []concurrencyLimit {
+	var limits []concurrencyLimit
+
+	// Anonymous requests have no GL_ID, we can't tell those users apart
+	if cfg.MaxConcurrentPerUser > 0 && a.GL_ID != "" {
+		limits = append(limits, concurrencyLimit{"user", "user:" + a.GL_ID, cfg.MaxConcurrentPerUser})
+	}
+
+	if cfg.MaxConcurrentPerRepository > 0 {
+		repository := a.GL_REPOSITORY
+		if repository == "" {
+			repository = a.Repository.StorageName + "/" + a.Repository.RelativePath
+		}
+		limits = append(limits, concurrencyLimit{"repository", "repository:" + repository, cfg.MaxConcurrentPerRepository})
+	}
+
+	return limits
+}
+
+// acquireConcurrencySlots takes a slot for each configured limit. If a
+// limit is saturated it responds with 429 and returns false. Limiter
+// errors are logged and the request is let through: a Redis outage should
+// not stop all Git traffic.
+func acquireConcurrencySlots(w http.ResponseWriter, r *http.Request, a *api.Response, l limiter.Limiter, cfg config.GitConfig) (func(), bool) {
+	var releases []func()
+	release := func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+
+	for _, limit := range concurrencyLimits(a, cfg) {
+		f, ok, err := l.Acquire(limit.key, limit.max)
+		if err != nil {
+			helper.LogError(r, fmt.Errorf("acquireConcurrencySlots: %v", err))
+			continue
+		}
+
+		if !ok {
+			release()
+			gitConcurrencyLimited.WithLabelValues(limit.name).Inc()
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(concurrencyRetryAfter.Seconds())))
+			http.Error(w, fmt.Sprintf("Too many concurrent Git operations for this %s, please try again later", limit.name), http.StatusTooManyRequests)
+			return nil, false
+		}
+
+		releases = append(releases, f)
+	}
+
+	return release, true
+}
@@ -0,0 +1,68 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+type fakeLimiter struct {
+	full     map[string]bool
+	acquired []string
+	released []string
+}
+
+func (l *fakeLimiter) Acquire(key string, max int) (func(), bool, error) {
+	if l.full[key] {
+		return nil, false, nil
+	}
+	l.acquired = append(l.acquired, key)
+	return func() { l.released = append(l.released, key) }, true, nil
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	cfg := config.GitConfig{MaxConcurrentPerUser: 2, MaxConcurrentPerRepository: 10}
+
+	a := &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-1"}
+	require.Equal(t, []concurrencyLimit{
+		{"user", "user:user-1", 2},
+		{"repository", "repository:project-1", 10},
+	}, concurrencyLimits(a, cfg))
+
+	anonymous := &api.Response{Repository: gitalypb.Repository{StorageName: "default", RelativePath: "group/project.git"}}
+	require.Equal(t, []concurrencyLimit{
+		{"repository", "repository:default/group/project.git", 10},
+	}, concurrencyLimits(anonymous, cfg))
+
+	require.Empty(t, concurrencyLimits(a, config.GitConfig{}))
+}
+
+func TestAcquireConcurrencySlots(t *testing.T) {
+	cfg := config.GitConfig{MaxConcurrentPerUser: 2, MaxConcurrentPerRepository: 10}
+	a := &api.Response{GL_ID: "user-1", GL_REPOSITORY: "project-1"}
+	r := httptest.NewRequest("POST", "/group/project.git/git-upload-pack", nil)
+
+	l := &fakeLimiter{}
+	w := httptest.NewRecorder()
+	release, ok := acquireConcurrencySlots(w, r, a, l, cfg)
+	require.True(t, ok)
+	require.Equal(t, []string{"user:user-1", "repository:project-1"}, l.acquired)
+
+	release()
+	require.Equal(t, l.acquired, l.released)
+
+	l = &fakeLimiter{full: map[string]bool{"repository:project-1": true}}
+	w = httptest.NewRecorder()
+	_, ok = acquireConcurrencySlots(w, r, a, l, cfg)
+	require.False(t, ok)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "30", w.Header().Get("Retry-After"))
+	require.Equal(t, []string{"user:user-1"}, l.released, "slots taken before the saturated limit must be released")
+}
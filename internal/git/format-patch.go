@@ -38,7 +38,15 @@ func (p *patch) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 		return
 	}
 
-	if err := diffClient.SendRawPatch(ctx, w, request); err != nil {
+	// Gitaly rejects invalid commit ranges before sending any data. Only
+	// then can we still tell the client something went wrong.
+	cw := helper.NewCountingResponseWriter(w)
+	if err := diffClient.SendRawPatch(ctx, cw, request); err != nil {
+		if cw.Status() == 0 {
+			helper.Fail500(w, r, fmt.Errorf("diff.RawPatch: %v", err))
+			return
+		}
+
 		helper.LogError(
 			r,
 			&copyError{fmt.Errorf("diff.RawPatch: request=%v, err=%v", request, err)},
@@ -0,0 +1,98 @@
+/*
+In this file we stream git push requests arriving at a Geo secondary to
+the primary
+*/
+
+package git
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/tracing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+// There is no ResponseHeaderTimeout: the primary only responds to a push
+// once it has received and processed the whole pack.
+var geoProxyClient = &http.Client{
+	Transport: tracing.NewRoundTripper(correlation.NewInstrumentedRoundTripper(&http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	})),
+	// Redirects are for the Git client to follow, we can't replay the
+	// request body
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+var (
+	geoProxyRequestHeaders  = []string{"Accept", "Accept-Encoding", "Content-Type", "Git-Protocol", "User-Agent"}
+	geoProxyResponseHeaders = []string{"Cache-Control", "Content-Encoding", "Content-Type", "Location", "WWW-Authenticate"}
+)
+
+// proxyToGeoPrimary streams r to the repository URL of the primary with
+// suffix appended, and the response back to w.
+func proxyToGeoPrimary(w http.ResponseWriter, r *http.Request, settings *api.GeoProxySettings, suffix string) error {
+	target := strings.TrimSuffix(settings.Url, "/") + suffix
+
+	var body io.Reader
+	if r.Method == "POST" {
+		// The body may have been decompressed, so Content-Length is no
+		// longer accurate and we send it chunked
+		body = r.Body
+	}
+
+	req, err := http.NewRequest(r.Method, target, body)
+	if err != nil {
+		return fmt.Errorf("geo proxy: new request: %v", err)
+	}
+	req = req.WithContext(r.Context())
+
+	for _, h := range geoProxyRequestHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	for k, v := range settings.Header {
+		req.Header[k] = v
+	}
+
+	log.WithContextFields(r.Context(), log.Fields{
+		"path":   r.URL.Path,
+		"target": req.URL.Host,
+	}).Print("geo proxy: forwarding git push to primary")
+
+	resp, err := geoProxyClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("geo proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	for _, h := range geoProxyResponseHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return &copyError{fmt.Errorf("geo proxy: copy response: %v", err)}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package git
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func startGeoPrimary(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Geo secret-jwt" {
+			w.WriteHeader(401)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/group/project.git/info/refs":
+			require.Equal(t, "git-receive-pack", r.URL.Query().Get("service"))
+			w.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
+			w.Write([]byte("primary refs"))
+		case "/group/project.git/git-receive-pack":
+			require.Equal(t, "POST", r.Method)
+			require.Equal(t, "version=1", r.Header.Get("Git-Protocol"))
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+
+			w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+			w.Header().Set("Set-Cookie", "primary=1")
+			w.Write([]byte("received: " + string(body)))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func geoProxyResponse(primaryURL string) *api.Response {
+	return &api.Response{
+		GeoProxy: &api.GeoProxySettings{
+			Url:    primaryURL + "/group/project.git",
+			Header: http.Header{"Authorization": []string{"Geo secret-jwt"}},
+		},
+	}
+}
+
+func TestGeoProxyReceivePack(t *testing.T) {
+	primary := startGeoPrimary(t)
+	defer primary.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/group/project.git/git-receive-pack", strings.NewReader("pack data"))
+	r.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+	r.Header.Set("Git-Protocol", "version=1")
+
+	require.NoError(t, handleReceivePack(NewHttpResponseWriter(w), r, geoProxyResponse(primary.URL), config.GitConfig{}))
+
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseBody(t, w, "received: pack data")
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Type", "application/x-git-receive-pack-result")
+	testhelper.AssertAbsentResponseWriterHeader(t, w, "Set-Cookie")
+}
+
+func TestGeoProxyInfoRefs(t *testing.T) {
+	primary := startGeoPrimary(t)
+	defer primary.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-receive-pack", nil)
+
+	handleGetInfoRefs(w, r, geoProxyResponse(primary.URL), config.GitConfig{})
+
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseBody(t, w, "primary refs")
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Type", "application/x-git-receive-pack-advertisement")
+}
+
+func TestGeoProxyPassesErrorsThrough(t *testing.T) {
+	primary := startGeoPrimary(t)
+	defer primary.Close()
+
+	a := geoProxyResponse(primary.URL)
+	a.GeoProxy.Header = nil
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/group/project.git/git-receive-pack", strings.NewReader("pack data"))
+
+	require.NoError(t, handleReceivePack(NewHttpResponseWriter(w), r, a, config.GitConfig{}))
+	testhelper.AssertResponseCode(t, w, 401)
+}
+
+func TestGeoProxyPrimaryUnreachable(t *testing.T) {
+	primary := startGeoPrimary(t)
+	primary.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-receive-pack", nil)
+
+	handleGetInfoRefs(w, r, geoProxyResponse(primary.URL), config.GitConfig{})
+	testhelper.AssertResponseCode(t, w, 500)
+}
@@ -12,7 +12,9 @@ import (
 	"sync"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/limiter"
 )
 
 const (
@@ -21,12 +23,20 @@ const (
 	GitConfigShowAllRefs = "transfer.hideRefs=!refs"
 )
 
-func ReceivePack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleReceivePack", handleReceivePack)
+func ReceivePack(a *api.API, cfg config.GitConfig, l limiter.Limiter) http.Handler {
+	return postRPCHandler(a, "handleReceivePack", func(w *HttpResponseWriter, r *http.Request, ar *api.Response) error {
+		return handleReceivePack(w, r, ar, cfg)
+	}, cfg, l)
 }
 
-func UploadPack(a *api.API) http.Handler {
-	return postRPCHandler(a, "handleUploadPack", handleUploadPack)
+func UploadPack(a *api.API, cfg config.GitConfig, l limiter.Limiter) http.Handler {
+	return postRPCHandler(a, "handleUploadPack", func(w *HttpResponseWriter, r *http.Request, ar *api.Response) error {
+		return handleUploadPack(w, r, ar, cfg)
+	}, cfg, l)
+}
+
+func UploadArchive(a *api.API, cfg config.GitConfig) http.Handler {
+	return postRPCHandler(a, "handleUploadArchive", handleUploadArchive, cfg, nil)
 }
 
 func gitConfigOptions(a *api.Response) []string {
@@ -39,7 +49,9 @@ func gitConfigOptions(a *api.Response) []string {
 	return out
 }
 
-func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *http.Request, *api.Response) error) http.Handler {
+// postRPCHandler runs handler for a pre-authorized request. If l is not
+// nil the concurrency limits in cfg are applied.
+func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *http.Request, *api.Response) error, cfg config.GitConfig, l limiter.Limiter) http.Handler {
 	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
 		cr := &countReadCloser{ReadCloser: r.Body}
 		r.Body = cr
@@ -47,8 +59,17 @@ func postRPCHandler(a *api.API, name string, handler func(*HttpResponseWriter, *
 		w := NewHttpResponseWriter(rw)
 		defer func() {
 			w.Log(r, cr.Count())
+			logBandwidth(r, ar, cr.Count(), w.Count(), cfg.RepositoryBandwidthMetrics)
 		}()
 
+		if l != nil {
+			release, ok := acquireConcurrencySlots(w, r, ar, l, cfg)
+			if !ok {
+				return
+			}
+			defer release()
+		}
+
 		if err := handler(w, r, ar); err != nil {
 			// If the handler already wrote a response this WriteHeader call is a
 			// no-op. It never reaches net/http because GitHttpResponseWriter calls
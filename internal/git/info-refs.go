@@ -12,40 +12,64 @@ import (
 	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
-func GetInfoRefsHandler(a *api.API) http.Handler {
-	return repoPreAuthorizeHandler(a, handleGetInfoRefs)
+func GetInfoRefsHandler(a *api.API, cfg config.GitConfig) http.Handler {
+	return repoPreAuthorizeHandler(a, func(rw http.ResponseWriter, r *http.Request, ar *api.Response) {
+		handleGetInfoRefs(rw, r, ar, cfg)
+	})
 }
 
-func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response) {
+func handleGetInfoRefs(rw http.ResponseWriter, r *http.Request, a *api.Response, cfg config.GitConfig) {
 	responseWriter := NewHttpResponseWriter(rw)
 	// Log 0 bytes in because we ignore the request body (and there usually is none anyway).
 	defer responseWriter.Log(r, 0)
 
 	rpc := getService(r)
-	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
+	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack" || rpc == "git-upload-archive") {
 		// The 'dumb' Git HTTP protocol is not supported
 		http.Error(responseWriter, "Not Found", 404)
 		return
 	}
 
+	if rpc == "git-receive-pack" && a.GeoProxy != nil {
+		err := proxyToGeoPrimary(responseWriter, r, a.GeoProxy, "/info/refs?service=git-receive-pack")
+		if err != nil && responseWriter.Status() == 0 {
+			helper.Fail500(responseWriter, r, fmt.Errorf("handleGetInfoRefs: %v", err))
+		} else if err != nil {
+			helper.LogError(r, fmt.Errorf("handleGetInfoRefs: %v", err))
+		}
+		return
+	}
+
+	gitProtocol, err := gitProtocolFor(r, rpc, cfg)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	responseWriter.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", rpc))
 	responseWriter.Header().Set("Cache-Control", "no-cache")
 
-	gitProtocol := r.Header.Get("Git-Protocol")
+	if rpc == "git-upload-archive" {
+		if err := writeUploadArchiveAdvertisement(responseWriter); err != nil {
+			log.WithError(err).Error("GetInfoRefsHandler: error writing upload-archive advertisement")
+		}
+		return
+	}
 
 	offers := []string{"gzip", "identity"}
 	encoding := httputil.NegotiateContentEncoding(r, offers)
 
-	if err := handleGetInfoRefsWithGitaly(r.Context(), responseWriter, a, rpc, gitProtocol, encoding); err != nil {
+	if err := handleGetInfoRefsWithGitaly(r.Context(), responseWriter, a, rpc, gitProtocol, encoding, cfg.StripCapabilities); err != nil {
 		helper.Fail500(responseWriter, r, fmt.Errorf("handleGetInfoRefs: %v", err))
 	}
 }
 
-func handleGetInfoRefsWithGitaly(ctx context.Context, responseWriter *HttpResponseWriter, a *api.Response, rpc, gitProtocol, encoding string) error {
+func handleGetInfoRefsWithGitaly(ctx context.Context, responseWriter *HttpResponseWriter, a *api.Response, rpc, gitProtocol, encoding string, stripCapabilities []string) error {
 	ctx, smarthttp, err := gitaly.NewSmartHTTPClient(ctx, a.GitalyServer)
 	if err != nil {
 		return fmt.Errorf("GetInfoRefsHandler: %v", err)
@@ -68,7 +92,7 @@ func handleGetInfoRefsWithGitaly(ctx context.Context, responseWriter *HttpRespon
 		w = responseWriter
 	}
 
-	if _, err = io.Copy(w, infoRefsResponseReader); err != nil {
+	if err = filterCapabilities(w, infoRefsResponseReader, stripCapabilities); err != nil {
 		log.WithError(err).Error("GetInfoRefsHandler: error copying gitaly response")
 	}
 
@@ -0,0 +1,112 @@
+/*
+In this file we summarize upload-pack negotiations for debug logging
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+// negotiationTrace is a sanitized summary of an upload-pack request. It
+// contains counts and capability names but no object IDs or ref names.
+type negotiationTrace struct {
+	command      string
+	capabilities []string
+	agent        string
+	wants        int
+	haves        int
+	shallows     int
+	deepen       bool
+	filter       bool
+	done         bool
+}
+
+// traceNegotiation parses a protocol v0/v1 or v2 upload-pack request
+func traceNegotiation(body io.Reader) (*negotiationTrace, error) {
+	trace := &negotiationTrace{}
+	br := bufio.NewReader(body)
+
+	for {
+		pkt, err := readPktLine(br)
+		if err == io.EOF {
+			return trace, nil
+		}
+		if err != nil {
+			return trace, err
+		}
+
+		line := string(bytes.TrimSuffix(pkt[4:], []byte("\n")))
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch keyword := fields[0]; {
+		case strings.HasPrefix(keyword, "command="):
+			trace.command = strings.TrimPrefix(keyword, "command=")
+		case keyword == "want" || keyword == "want-ref":
+			trace.wants++
+			// In protocol v0 the first want line carries the capabilities
+			if trace.wants == 1 && len(fields) > 2 {
+				for _, c := range fields[2:] {
+					trace.addCapability(c)
+				}
+			}
+		case keyword == "have":
+			trace.haves++
+		case keyword == "shallow":
+			trace.shallows++
+		case strings.HasPrefix(keyword, "deepen"):
+			trace.deepen = true
+		case keyword == "filter":
+			trace.filter = true
+		case keyword == "done":
+			trace.done = true
+		case trace.command != "" && trace.wants == 0:
+			// Protocol v2 capabilities come between the command and the
+			// delimiter packet. Only the first field is kept, so that
+			// nothing else a client sends on the line is logged.
+			trace.addCapability(keyword)
+		default:
+			// Arguments such as thin-pack or ofs-delta
+			trace.addCapability(keyword)
+		}
+	}
+}
+
+func (t *negotiationTrace) addCapability(c string) {
+	split := strings.SplitN(c, "=", 2)
+	if split[0] == "agent" && len(split) == 2 {
+		t.agent = split[1]
+		return
+	}
+
+	t.capabilities = append(t.capabilities, split[0])
+}
+
+func (t *negotiationTrace) log(r *http.Request, gitProtocol string, requestBytes, responseBytes int64, started time.Time) {
+	log.WithContextFields(r.Context(), log.Fields{
+		"path":                     r.URL.Path,
+		"git_protocol":             gitProtocol,
+		"negotiation_command":      t.command,
+		"negotiation_capabilities": strings.Join(t.capabilities, " "),
+		"negotiation_agent":        t.agent,
+		"negotiation_wants":        t.wants,
+		"negotiation_haves":        t.haves,
+		"negotiation_shallows":     t.shallows,
+		"negotiation_deepen":       t.deepen,
+		"negotiation_filter":       t.filter,
+		"negotiation_done":         t.done,
+		"request_bytes":            requestBytes,
+		"response_bytes":           responseBytes,
+		"duration_s":               time.Since(started).Seconds(),
+	}).Info("upload-pack negotiation")
+}
@@ -0,0 +1,72 @@
+package git
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceNegotiationV0(t *testing.T) {
+	body := pktLines(
+		"want 1111111111111111111111111111111111111111 multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.24.0\n",
+		"want 2222222222222222222222222222222222222222\n",
+		"shallow 3333333333333333333333333333333333333333\n",
+		"deepen 1\n",
+		"",
+		"have 4444444444444444444444444444444444444444\n",
+		"have 5555555555555555555555555555555555555555\n",
+		"done\n",
+	)
+
+	trace, err := traceNegotiation(strings.NewReader(body))
+	require.NoError(t, err)
+
+	require.Equal(t, &negotiationTrace{
+		capabilities: []string{"multi_ack_detailed", "side-band-64k", "thin-pack", "ofs-delta"},
+		agent:        "git/2.24.0",
+		wants:        2,
+		haves:        2,
+		shallows:     1,
+		deepen:       true,
+		done:         true,
+	}, trace)
+}
+
+func TestTraceNegotiationV2(t *testing.T) {
+	body := pktLines(
+		"command=fetch\n",
+		"agent=git/2.24.0\n",
+		"object-format=sha1\n",
+		"server-option secret-value\n",
+	) + "0001" + pktLines(
+		"thin-pack\n",
+		"ofs-delta\n",
+		"want 1111111111111111111111111111111111111111\n",
+		"filter blob:none\n",
+		"have 2222222222222222222222222222222222222222\n",
+		"done\n",
+		"",
+	)
+
+	trace, err := traceNegotiation(strings.NewReader(body))
+	require.NoError(t, err)
+
+	require.Equal(t, &negotiationTrace{
+		command:      "fetch",
+		capabilities: []string{"object-format", "server-option", "thin-pack", "ofs-delta"},
+		agent:        "git/2.24.0",
+		wants:        1,
+		haves:        1,
+		filter:       true,
+		done:         true,
+	}, trace)
+}
+
+func TestTraceNegotiationInvalid(t *testing.T) {
+	body := pktLines("want 1111111111111111111111111111111111111111\n") + "garbage"
+
+	trace, err := traceNegotiation(strings.NewReader(body))
+	require.Error(t, err)
+	require.Equal(t, 1, trace.wants, "keep what was parsed")
+}
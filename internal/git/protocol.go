@@ -0,0 +1,228 @@
+/*
+In this file we enforce the Git protocol version policy and filter the
+capabilities advertised to clients
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	// ProtocolV2Allow passes the Git-Protocol header through unchanged
+	ProtocolV2Allow = "allow"
+	// ProtocolV2Force rejects fetches that do not negotiate protocol v2
+	ProtocolV2Force = "force"
+	// ProtocolV2Forbid strips version=2 so clients fall back to protocol v0
+	ProtocolV2Forbid = "forbid"
+
+	gitProtocolV2 = "version=2"
+)
+
+var errProtocolV2Required = errors.New("Git protocol version 2 is required by this server. Use 'git -c protocol.version=2' or upgrade your Git client.")
+
+// ValidateConfig checks the protocol v2 policy of cfg
+func ValidateConfig(cfg config.GitConfig) error {
+	switch cfg.ProtocolV2 {
+	case "", ProtocolV2Allow, ProtocolV2Force, ProtocolV2Forbid:
+		return nil
+	default:
+		return fmt.Errorf("unknown ProtocolV2 %q, must be %q, %q or %q", cfg.ProtocolV2, ProtocolV2Allow, ProtocolV2Force, ProtocolV2Forbid)
+	}
+}
+
+// gitProtocolFor applies the protocol v2 policy to the Git-Protocol header
+// of r. Only upload-pack speaks protocol v2, pushes are left untouched.
+func gitProtocolFor(r *http.Request, rpc string, cfg config.GitConfig) (string, error) {
+	gitProtocol := r.Header.Get("Git-Protocol")
+	if rpc != "git-upload-pack" {
+		return gitProtocol, nil
+	}
+
+	switch cfg.ProtocolV2 {
+	case ProtocolV2Force:
+		if !hasProtocolParam(gitProtocol, gitProtocolV2) {
+			return "", errProtocolV2Required
+		}
+	case ProtocolV2Forbid:
+		return removeProtocolParam(gitProtocol, gitProtocolV2), nil
+	}
+
+	return gitProtocol, nil
+}
+
+// The Git-Protocol header is a colon-separated list of parameters
+func hasProtocolParam(gitProtocol, param string) bool {
+	for _, p := range strings.Split(gitProtocol, ":") {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
+func removeProtocolParam(gitProtocol, param string) string {
+	var kept []string
+	for _, p := range strings.Split(gitProtocol, ":") {
+		if p != param && p != "" {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, ":")
+}
+
+// filterCapabilities copies an info/refs response from r to w, removing
+// the capabilities listed in strip from the advertisement. Only the
+// capability section is parsed; the rest of the response (the ref
+// listing) is copied unchanged.
+func filterCapabilities(w io.Writer, r io.Reader, strip []string) error {
+	if len(strip) == 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	v2 := false
+
+	for {
+		pkt, err := readPktLine(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		payload := pkt[4:]
+		switch {
+		case len(pkt) == 4 || bytes.HasPrefix(payload, []byte("# service=")):
+			// flush, delimiter or smart HTTP service header
+			if v2 && len(pkt) == 4 {
+				if _, err := w.Write(pkt); err != nil {
+					return err
+				}
+				_, err := io.Copy(w, br)
+				return err
+			}
+		case bytes.Equal(payload, []byte("version 2\n")):
+			v2 = true
+		case v2:
+			payload = filterV2Capability(payload, strip)
+			if payload == nil {
+				continue
+			}
+			pkt = pktLine(payload)
+		default:
+			// Protocol v0/v1: capabilities follow a NUL byte on the first
+			// ref line; everything after it is a plain ref listing.
+			if i := bytes.IndexByte(payload, 0); i >= 0 {
+				caps := filterV0Capabilities(payload[i+1:], strip)
+				pkt = pktLine(append(append([]byte{}, payload[:i+1]...), caps...))
+			}
+			if _, err := w.Write(pkt); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, br)
+			return err
+		}
+
+		if _, err := w.Write(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func filterV0Capabilities(caps []byte, strip []string) []byte {
+	trailer := ""
+	if bytes.HasSuffix(caps, []byte("\n")) {
+		trailer = "\n"
+	}
+
+	var kept []string
+	for _, c := range strings.Fields(string(caps)) {
+		if !stripCapability(c, strip) {
+			kept = append(kept, c)
+		}
+	}
+
+	return []byte(strings.Join(kept, " ") + trailer)
+}
+
+// In protocol v2 each capability is on its own line, e.g. 'ls-refs' or
+// 'fetch=shallow filter'. Features of a capability can be stripped too.
+func filterV2Capability(line []byte, strip []string) []byte {
+	capability := strings.TrimSuffix(string(line), "\n")
+	if stripCapability(capability, strip) {
+		return nil
+	}
+
+	split := strings.SplitN(capability, "=", 2)
+	if len(split) == 1 {
+		return line
+	}
+
+	var features []string
+	for _, f := range strings.Fields(split[1]) {
+		if !stripCapability(f, strip) {
+			features = append(features, f)
+		}
+	}
+
+	if len(features) == 0 {
+		return []byte(split[0] + "\n")
+	}
+	return []byte(split[0] + "=" + strings.Join(features, " ") + "\n")
+}
+
+func stripCapability(capability string, strip []string) bool {
+	name := strings.SplitN(capability, "=", 2)[0]
+	for _, s := range strip {
+		if name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readPktLine returns a complete pkt-line including its length prefix
+func readPktLine(r *bufio.Reader) ([]byte, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("readPktLine: incomplete length prefix %q", prefix)
+		}
+		return nil, err
+	}
+
+	length, err := strconv.ParseUint(string(prefix), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("readPktLine: decode length: %v", err)
+	}
+
+	// 0000 (flush), 0001 (delim) and 0002 (response end) carry no payload
+	if length < 4 {
+		return prefix, nil
+	}
+
+	pkt := make([]byte, length)
+	copy(pkt, prefix)
+	if _, err := io.ReadFull(r, pkt[4:]); err != nil {
+		return nil, fmt.Errorf("readPktLine: read payload: %v", err)
+	}
+
+	return pkt, nil
+}
+
+func pktLine(payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("%04x", len(payload)+4)), payload...)
+}
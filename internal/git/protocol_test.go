@@ -0,0 +1,125 @@
+package git
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestGitProtocolFor(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		policy   string
+		rpc      string
+		header   string
+		expected string
+		err      error
+	}{
+		{"allow v2", ProtocolV2Allow, "git-upload-pack", "version=2", "version=2", nil},
+		{"default policy", "", "git-upload-pack", "version=2", "version=2", nil},
+		{"forbid v2", ProtocolV2Forbid, "git-upload-pack", "version=2", "", nil},
+		{"forbid keeps other params", ProtocolV2Forbid, "git-upload-pack", "version=2:foo=bar", "foo=bar", nil},
+		{"force with v2", ProtocolV2Force, "git-upload-pack", "foo=bar:version=2", "foo=bar:version=2", nil},
+		{"force without v2", ProtocolV2Force, "git-upload-pack", "", "", errProtocolV2Required},
+		{"force ignores pushes", ProtocolV2Force, "git-receive-pack", "", "", nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/info/refs", nil)
+			if tc.header != "" {
+				r.Header.Set("Git-Protocol", tc.header)
+			}
+
+			gitProtocol, err := gitProtocolFor(r, tc.rpc, config.GitConfig{ProtocolV2: tc.policy})
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.expected, gitProtocol)
+		})
+	}
+}
+
+func pktLines(lines ...string) string {
+	var out []string
+	for _, l := range lines {
+		if l == "" {
+			out = append(out, "0000")
+			continue
+		}
+		out = append(out, string(pktLine([]byte(l))))
+	}
+	return strings.Join(out, "")
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, policy := range []string{"", ProtocolV2Allow, ProtocolV2Force, ProtocolV2Forbid} {
+		require.NoError(t, ValidateConfig(config.GitConfig{ProtocolV2: policy}), policy)
+	}
+
+	require.Error(t, ValidateConfig(config.GitConfig{ProtocolV2: "Force"}))
+}
+
+func TestFilterCapabilitiesV0(t *testing.T) {
+	input := pktLines(
+		"# service=git-upload-pack\n",
+		"",
+		"0a53e9ddeaddad63ad106860237bbf53411d11a7 HEAD\x00multi_ack thin-pack filter side-band-64k agent=git/2.24.0\n",
+		"0a53e9ddeaddad63ad106860237bbf53411d11a7 refs/heads/master\x00filter\n",
+		"",
+	)
+	expected := pktLines(
+		"# service=git-upload-pack\n",
+		"",
+		"0a53e9ddeaddad63ad106860237bbf53411d11a7 HEAD\x00multi_ack thin-pack side-band-64k\n",
+		"0a53e9ddeaddad63ad106860237bbf53411d11a7 refs/heads/master\x00filter\n",
+		"",
+	)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, filterCapabilities(out, strings.NewReader(input), []string{"filter", "agent"}))
+	require.Equal(t, expected, out.String())
+}
+
+func TestFilterCapabilitiesV2(t *testing.T) {
+	input := pktLines(
+		"# service=git-upload-pack\n",
+		"",
+		"version 2\n",
+		"agent=git/2.24.0\n",
+		"ls-refs\n",
+		"fetch=shallow filter\n",
+		"server-option\n",
+		"",
+	)
+	expected := pktLines(
+		"# service=git-upload-pack\n",
+		"",
+		"version 2\n",
+		"agent=git/2.24.0\n",
+		"ls-refs\n",
+		"fetch=shallow\n",
+		"",
+	)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, filterCapabilities(out, strings.NewReader(input), []string{"filter", "server-option"}))
+	require.Equal(t, expected, out.String())
+}
+
+func TestFilterCapabilitiesPassthrough(t *testing.T) {
+	input := "not even pkt-lines"
+
+	out := &bytes.Buffer{}
+	require.NoError(t, filterCapabilities(out, strings.NewReader(input), nil))
+	require.Equal(t, input, out.String())
+}
+
+func TestFilterCapabilitiesInvalidInput(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.Error(t, filterCapabilities(out, strings.NewReader("zzzz"), []string{"filter"}))
+	require.Error(t, filterCapabilities(out, strings.NewReader("0010short"), []string{"filter"}))
+}
@@ -0,0 +1,140 @@
+/*
+In this file we enforce the maximum size of a 'git push'
+*/
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errPushTooLarge = errors.New("push exceeds maximum size")
+
+	pushesTooLarge = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_push_too_large",
+			Help: "How many git-receive-pack requests were terminated because they exceeded the maximum push size",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pushesTooLarge)
+}
+
+// pushSizeLimiter couples the request body and the response of a
+// git-receive-pack request. Once more than maxSize bytes have been read
+// from the body, reads fail and whatever Gitaly still writes to the
+// response is discarded, so that we can send our own error message.
+type pushSizeLimiter struct {
+	r         io.Reader
+	remaining int64
+
+	w        io.Writer
+	mu       sync.Mutex
+	exceeded bool
+}
+
+func newPushSizeLimiter(r io.Reader, w io.Writer, maxSize int64) *pushSizeLimiter {
+	return &pushSizeLimiter{r: r, w: w, remaining: maxSize}
+}
+
+func (l *pushSizeLimiter) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Find out if there is more data, or if the push was exactly maxSize bytes
+		var b [1]byte
+		if n, err := l.r.Read(b[:]); n == 0 {
+			return 0, err
+		}
+
+		l.mu.Lock()
+		l.exceeded = true
+		l.mu.Unlock()
+
+		return 0, errPushTooLarge
+	}
+
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+
+	return n, err
+}
+
+func (l *pushSizeLimiter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.exceeded {
+		return len(p), nil
+	}
+	return l.w.Write(p)
+}
+
+func (l *pushSizeLimiter) Exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+// pushUsesSideband peeks at the first command of a push to find out if
+// the client asked for side-band multiplexing
+func pushUsesSideband(r *bufio.Reader) bool {
+	prefix, err := r.Peek(4)
+	if err != nil {
+		return false
+	}
+
+	length, err := strconv.ParseUint(string(prefix), 16, 16)
+	if err != nil || length <= 4 {
+		return false
+	}
+
+	pkt, err := r.Peek(int(length))
+	if err != nil {
+		return false
+	}
+
+	i := bytes.IndexByte(pkt, 0)
+	if i < 0 {
+		return false
+	}
+
+	for _, c := range bytes.Fields(pkt[i+1:]) {
+		if string(c) == "side-band-64k" || string(c) == "side-band" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writePushTooLarge sends an error the Git client shows to the user as
+// "remote error: ..."
+func writePushTooLarge(w io.Writer, sideband bool, maxSize int64) error {
+	pushesTooLarge.Inc()
+
+	msg := fmt.Sprintf("push exceeds the maximum allowed size of %d bytes\n", maxSize)
+	if !sideband {
+		_, err := w.Write(pktLine([]byte("ERR " + msg)))
+		return err
+	}
+
+	// Band 3 carries fatal errors
+	if _, err := w.Write(pktLine(append([]byte{3}, msg...))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "0000")
+	return err
+}
@@ -0,0 +1,78 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushSizeLimiter(t *testing.T) {
+	out := &bytes.Buffer{}
+	limiter := newPushSizeLimiter(strings.NewReader("0123456789"), out, 5)
+
+	data, err := ioutil.ReadAll(limiter)
+	require.Equal(t, errPushTooLarge, err)
+	require.Equal(t, "01234", string(data))
+	require.True(t, limiter.Exceeded())
+
+	n, err := limiter.Write([]byte("discarded"))
+	require.NoError(t, err)
+	require.Equal(t, len("discarded"), n)
+	require.Empty(t, out.String())
+}
+
+func TestPushSizeLimiterExactSize(t *testing.T) {
+	out := &bytes.Buffer{}
+	limiter := newPushSizeLimiter(strings.NewReader("01234"), out, 5)
+
+	data, err := ioutil.ReadAll(limiter)
+	require.NoError(t, err)
+	require.Equal(t, "01234", string(data))
+	require.False(t, limiter.Exceeded())
+
+	_, err = limiter.Write([]byte("response"))
+	require.NoError(t, err)
+	require.Equal(t, "response", out.String())
+}
+
+func TestPushUsesSideband(t *testing.T) {
+	command := "0000000000000000000000000000000000000000 0a53e9ddeaddad63ad106860237bbf53411d11a7 refs/heads/master"
+
+	testCases := []struct {
+		desc     string
+		input    string
+		sideband bool
+	}{
+		{"side-band-64k", string(pktLine([]byte(command+"\x00 report-status side-band-64k agent=git/2.24.0"))) + "0000PACK", true},
+		{"no sideband", string(pktLine([]byte(command+"\x00 report-status"))) + "0000PACK", false},
+		{"no capabilities", string(pktLine([]byte(command))) + "0000PACK", false},
+		{"garbage", "garbage", false},
+		{"empty", "", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tc.input))
+			require.Equal(t, tc.sideband, pushUsesSideband(br))
+
+			// Peeking must not consume the request body
+			data, err := ioutil.ReadAll(br)
+			require.NoError(t, err)
+			require.Equal(t, tc.input, string(data))
+		})
+	}
+}
+
+func TestWritePushTooLarge(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, writePushTooLarge(out, true, 100))
+	require.Equal(t, "0038\x03push exceeds the maximum allowed size of 100 bytes\n0000", out.String())
+
+	out.Reset()
+	require.NoError(t, writePushTooLarge(out, false, 100))
+	require.Equal(t, "003bERR push exceeds the maximum allowed size of 100 bytes\n", out.String())
+}
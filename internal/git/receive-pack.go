@@ -1,21 +1,46 @@
 package git
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"net/http"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response, cfg config.GitConfig) error {
+	if a.GeoProxy != nil {
+		return proxyToGeoPrimary(w, r, a.GeoProxy, "/git-receive-pack")
+	}
+
 	action := getService(r)
 	writePostRPCHeader(w, action)
 
-	cr, cw := helper.NewWriteAfterReader(r.Body, w)
+	var body io.Reader = r.Body
+	var response io.Writer = w
+	var limiter *pushSizeLimiter
+	sideband := false
+
+	if cfg.MaxPushSize > 0 {
+		br := bufio.NewReader(r.Body)
+		sideband = pushUsesSideband(br)
+
+		if r.ContentLength > cfg.MaxPushSize {
+			return writePushTooLarge(w, sideband, cfg.MaxPushSize)
+		}
+
+		limiter = newPushSizeLimiter(br, w, cfg.MaxPushSize)
+		body = limiter
+		response = limiter
+	}
+
+	cr, cw := helper.NewWriteAfterReader(body, response)
 	defer cw.Flush()
 
 	gitProtocol := r.Header.Get("Git-Protocol")
@@ -26,6 +51,9 @@ func handleReceivePack(w *HttpResponseWriter, r *http.Request, a *api.Response)
 	}
 
 	if err := smarthttp.ReceivePack(ctx, &a.Repository, a.GL_ID, a.GL_USERNAME, a.GL_REPOSITORY, a.GitConfigOptions, cr, cw, gitProtocol); err != nil {
+		if limiter != nil && limiter.Exceeded() {
+			return writePushTooLarge(w, sideband, cfg.MaxPushSize)
+		}
 		return fmt.Errorf("smarthttp.ReceivePack: %v", err)
 	}
 
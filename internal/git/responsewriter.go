@@ -7,6 +7,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
 )
 
 const (
@@ -41,6 +42,10 @@ func init() {
 	prometheus.MustRegister(gitHTTPSessionsActive)
 	prometheus.MustRegister(gitHTTPRequests)
 	prometheus.MustRegister(gitHTTPBytes)
+
+	status.Register("git", func() interface{} {
+		return map[string]interface{}{"active_streams": status.GaugeValue(gitHTTPSessionsActive)}
+	})
 }
 
 type HttpResponseWriter struct {
@@ -2,7 +2,6 @@ package git
 
 import (
 	"fmt"
-	"io"
 	"net/http"
 
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
@@ -58,7 +57,7 @@ func (s *snapshot) Inject(w http.ResponseWriter, r *http.Request, sendData strin
 	w.Header().Set("Cache-Control", "private")
 	w.WriteHeader(http.StatusOK) // Errors aren't detectable beyond this point
 
-	if _, err := io.Copy(w, reader); err != nil {
+	if _, err := helper.Copy(w, reader); err != nil {
 		helper.LogError(r, fmt.Errorf("SendSnapshot: copy gitaly output: %v", err))
 	}
 }
@@ -0,0 +1,53 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+)
+
+// The request body only holds the 'argument' lines sent by 'git archive
+// --remote', e.g. the tree-ish, format and paths
+const maxUploadArchiveRequestSize = 1024 * 1024
+
+// writeUploadArchiveAdvertisement writes the info/refs response for
+// git-upload-archive. Unlike upload-pack, upload-archive does not advertise
+// any refs, so we don't need to ask Gitaly.
+func writeUploadArchiveAdvertisement(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s0000", pktLine([]byte("# service=git-upload-archive\n")))
+	return err
+}
+
+// Will not return a non-nil error after the response body has been
+// written to.
+func handleUploadArchive(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+	request, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUploadArchiveRequestSize+1))
+	if err != nil {
+		return fmt.Errorf("read request body: %v", err)
+	}
+	r.Body.Close()
+
+	if len(request) > maxUploadArchiveRequestSize {
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	ctx, ssh, err := gitaly.NewSSHClient(r.Context(), a.GitalyServer)
+	if err != nil {
+		return fmt.Errorf("ssh.UploadArchive: %v", err)
+	}
+
+	writePostRPCHeader(w, "git-upload-archive")
+
+	stderr := &bytes.Buffer{}
+	if err := ssh.UploadArchive(ctx, &a.Repository, bytes.NewReader(request), w, stderr); err != nil {
+		return fmt.Errorf("ssh.UploadArchive: %v, stderr: %q", err, stderr.String())
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package git
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func TestUploadArchiveAdvertisement(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-upload-archive", nil)
+
+	// No Gitaly server is configured: the advertisement must not need one
+	handleGetInfoRefs(w, r, &api.Response{}, config.GitConfig{})
+
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Type", "application/x-git-upload-archive-advertisement")
+	require.Equal(t, "0021# service=git-upload-archive\n0000", w.Body.String())
+}
+
+func TestUploadArchiveRequestTooLarge(t *testing.T) {
+	w := httptest.NewRecorder()
+	body := make([]byte, maxUploadArchiveRequestSize+1)
+	r := httptest.NewRequest("POST", "/group/project.git/git-upload-archive", bytes.NewReader(body))
+
+	require.NoError(t, handleUploadArchive(NewHttpResponseWriter(w), r, &api.Response{}))
+	testhelper.AssertResponseCode(t, w, 413)
+}
@@ -0,0 +1,243 @@
+/*
+In this file we let identical concurrent upload-pack requests share a
+single Gitaly stream
+*/
+
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/correlation"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+var (
+	uploadPackCoalescing = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_git_upload_pack_coalescing",
+			Help: "How many upload-pack requests started a new Gitaly stream (leader) or joined an identical one (follower)",
+		},
+		[]string{"role"},
+	)
+
+	sharedPacks = &packCoalescer{streams: make(map[string]*sharedPack)}
+)
+
+func init() {
+	prometheus.MustRegister(uploadPackCoalescing)
+}
+
+type packCoalescer struct {
+	sync.Mutex
+	streams map[string]*sharedPack
+}
+
+// sharedPack spools the output of a single Gitaly PostUploadPack stream to
+// an unlinked temporary file. Each client reads the spool at its own pace
+// so a slow client never holds back the others.
+type sharedPack struct {
+	file   *os.File
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	size    int64
+	done    bool
+	err     error
+	readers int
+	changed chan struct{}
+}
+
+// uploadPackKey identifies requests that are guaranteed to produce the same
+// response: same repository, same options and the same negotiation.
+func uploadPackKey(a *api.Response, gitProtocol string, body io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s\x00", a.GitalyServer.Address, a.Repository.StorageName, a.Repository.RelativePath, gitProtocol)
+	for _, opt := range gitConfigOptions(a) {
+		fmt.Fprintf(h, "%s\x00", opt)
+	}
+
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// join returns the in-flight stream for key, or starts a new one by
+// calling start. The boolean result is true if a new stream was started.
+// The caller must call release when done reading.
+func (c *packCoalescer) join(ctx context.Context, key string, start func(context.Context, io.Writer) error) (*sharedPack, bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if s := c.streams[key]; s != nil && s.acquire() {
+		uploadPackCoalescing.WithLabelValues("follower").Inc()
+		return s, false, nil
+	}
+
+	file, err := ioutil.TempFile("", "gitlab-workhorse-upload-pack")
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.Remove(file.Name()); err != nil {
+		file.Close()
+		return nil, false, err
+	}
+
+	// The Gitaly stream must outlive the request that started it, other
+	// clients may still be reading from it.
+	streamCtx := correlation.ContextWithCorrelation(context.Background(), correlation.ExtractFromContext(ctx))
+	streamCtx, cancel := context.WithCancel(streamCtx)
+	s := &sharedPack{
+		file:    file,
+		cancel:  cancel,
+		readers: 1,
+		changed: make(chan struct{}),
+	}
+	c.streams[key] = s
+	uploadPackCoalescing.WithLabelValues("leader").Inc()
+
+	go func() {
+		err := start(streamCtx, s)
+		c.forget(key, s)
+		s.finish(err)
+	}()
+
+	return s, true, nil
+}
+
+func (c *packCoalescer) forget(key string, s *sharedPack) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.streams[key] == s {
+		delete(c.streams, key)
+	}
+}
+
+func (s *sharedPack) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readers == 0 {
+		return false
+	}
+	s.readers++
+	return true
+}
+
+func (s *sharedPack) release() {
+	s.mu.Lock()
+	s.readers--
+	last := s.readers == 0
+	s.mu.Unlock()
+
+	if last {
+		s.cancel()
+		s.file.Close()
+	}
+}
+
+// Write is only called by the goroutine running the Gitaly stream
+func (s *sharedPack) Write(p []byte) (int, error) {
+	n, err := s.file.WriteAt(p, s.size)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size += int64(n)
+	s.notify()
+
+	return n, err
+}
+
+func (s *sharedPack) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done = true
+	s.err = err
+	s.notify()
+}
+
+func (s *sharedPack) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// copyTo streams the spooled pack to w while it is being written, until the
+// Gitaly stream is finished or ctx is cancelled.
+func (s *sharedPack) copyTo(ctx context.Context, w io.Writer) error {
+	buf := make([]byte, 32*1024)
+	var offset int64
+
+	for {
+		s.mu.Lock()
+		size, done, streamErr, changed := s.size, s.done, s.err, s.changed
+		s.mu.Unlock()
+
+		if offset < size {
+			chunk := buf
+			if remaining := size - offset; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+
+			n, err := s.file.ReadAt(chunk, offset)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("read spooled pack: %v", err)
+			}
+			if _, err := w.Write(chunk[:n]); err != nil {
+				return err
+			}
+			offset += int64(n)
+			continue
+		}
+
+		if done {
+			return streamErr
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// handleCoalescedUploadPack takes ownership of clientRequest: if this
+// request starts a new Gitaly stream, the body is closed once the stream is
+// finished rather than when the client goes away.
+func handleCoalescedUploadPack(ctx context.Context, a *api.Response, clientRequest *os.File, clientResponse io.Writer, gitProtocol string) error {
+	key, err := uploadPackKey(a, gitProtocol, clientRequest)
+	if err != nil {
+		clientRequest.Close()
+		return fmt.Errorf("uploadPackKey: %v", err)
+	}
+
+	s, leader, err := sharedPacks.join(ctx, key, func(streamCtx context.Context, w io.Writer) error {
+		defer clientRequest.Close()
+		return handleUploadPackWithGitaly(streamCtx, a, clientRequest, w, gitProtocol)
+	})
+	if !leader {
+		clientRequest.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("join upload-pack stream: %v", err)
+	}
+	defer s.release()
+
+	return s.copyTo(ctx, clientResponse)
+}
@@ -0,0 +1,127 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestUploadPackKey(t *testing.T) {
+	a := &api.Response{Repository: gitalypb.Repository{StorageName: "default", RelativePath: "foo.git"}}
+
+	body := strings.NewReader("0032want 0a53e9ddeaddad63ad106860237bbf53411d11a7\n")
+	key1, err := uploadPackKey(a, "version=2", body)
+	require.NoError(t, err)
+
+	// The body must be rewound so it can be sent to Gitaly
+	rest, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.NotEmpty(t, rest)
+
+	key2, err := uploadPackKey(a, "version=2", strings.NewReader(string(rest)))
+	require.NoError(t, err)
+	require.Equal(t, key1, key2)
+
+	key3, err := uploadPackKey(a, "", strings.NewReader(string(rest)))
+	require.NoError(t, err)
+	require.NotEqual(t, key1, key3)
+
+	a.ShowAllRefs = true
+	key4, err := uploadPackKey(a, "version=2", strings.NewReader(string(rest)))
+	require.NoError(t, err)
+	require.NotEqual(t, key1, key4)
+}
+
+func TestPackCoalescerSharesStream(t *testing.T) {
+	c := &packCoalescer{streams: make(map[string]*sharedPack)}
+	ctx := context.Background()
+
+	proceed := make(chan struct{})
+	starts := 0
+	start := func(ctx context.Context, w io.Writer) error {
+		starts++
+		io.WriteString(w, "first chunk,")
+		<-proceed
+		io.WriteString(w, "second chunk")
+		return nil
+	}
+
+	leader, isLeader, err := c.join(ctx, "key", start)
+	require.NoError(t, err)
+	require.True(t, isLeader)
+
+	follower, isLeader, err := c.join(ctx, "key", start)
+	require.NoError(t, err)
+	require.False(t, isLeader)
+	require.Equal(t, leader, follower)
+
+	var wg sync.WaitGroup
+	outputs := make([]bytes.Buffer, 2)
+	for i, s := range []*sharedPack{leader, follower} {
+		wg.Add(1)
+		go func(i int, s *sharedPack) {
+			defer wg.Done()
+			defer s.release()
+			require.NoError(t, s.copyTo(ctx, &outputs[i]))
+		}(i, s)
+	}
+
+	close(proceed)
+	wg.Wait()
+
+	require.Equal(t, 1, starts)
+	for _, out := range outputs {
+		require.Equal(t, "first chunk,second chunk", out.String())
+	}
+
+	_, isLeader, err = c.join(ctx, "key", func(context.Context, io.Writer) error { return nil })
+	require.NoError(t, err)
+	require.True(t, isLeader, "finished streams should not be joined")
+}
+
+func TestPackCoalescerPropagatesErrors(t *testing.T) {
+	c := &packCoalescer{streams: make(map[string]*sharedPack)}
+	ctx := context.Background()
+
+	s, _, err := c.join(ctx, "key", func(ctx context.Context, w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("gitaly went away")
+	})
+	require.NoError(t, err)
+	defer s.release()
+
+	out := &bytes.Buffer{}
+	require.EqualError(t, s.copyTo(ctx, out), "gitaly went away")
+	require.Equal(t, "partial", out.String())
+}
+
+func TestPackCoalescerClientCancellation(t *testing.T) {
+	c := &packCoalescer{streams: make(map[string]*sharedPack)}
+
+	streamDone := make(chan error)
+	s, _, err := c.join(context.Background(), "key", func(ctx context.Context, w io.Writer) error {
+		<-ctx.Done()
+		streamDone <- ctx.Err()
+		return ctx.Err()
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, s.copyTo(ctx, &bytes.Buffer{}))
+
+	// Once the last reader is gone the Gitaly stream is cancelled
+	s.release()
+	require.Equal(t, context.Canceled, <-streamDone)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
@@ -18,7 +19,7 @@ var (
 
 // Will not return a non-nil error after the response body has been
 // written to.
-func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) error {
+func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response, cfg config.GitConfig) error {
 	ctx := r.Context()
 
 	// The body will consist almost entirely of 'have XXX' and 'want XXX'
@@ -42,14 +43,32 @@ func handleUploadPack(w *HttpResponseWriter, r *http.Request, a *api.Response) e
 	if err != nil {
 		return fmt.Errorf("ReadAllTempfile: %v", err)
 	}
-	defer buffer.Close()
 	r.Body.Close()
 
 	action := getService(r)
+	gitProtocol, err := gitProtocolFor(r, action, cfg)
+	if err != nil {
+		buffer.Close()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	if cfg.TraceNegotiation {
+		logTrace, err := traceUploadPack(w, r, buffer, gitProtocol)
+		if err != nil {
+			buffer.Close()
+			return fmt.Errorf("traceUploadPack: %v", err)
+		}
+		defer logTrace()
+	}
+
 	writePostRPCHeader(w, action)
 
-	gitProtocol := r.Header.Get("Git-Protocol")
+	if cfg.CoalesceUploadPack {
+		return handleCoalescedUploadPack(ctx, a, buffer, w, gitProtocol)
+	}
 
+	defer buffer.Close()
 	return handleUploadPackWithGitaly(ctx, a, buffer, w, gitProtocol)
 }
 
@@ -65,3 +84,26 @@ func handleUploadPackWithGitaly(ctx context.Context, a *api.Response, clientRequ
 
 	return nil
 }
+
+// traceUploadPack parses the negotiation in body and rewinds it for
+// Gitaly. The returned function logs the summary and should be called
+// once the response is finished.
+func traceUploadPack(w *HttpResponseWriter, r *http.Request, body io.ReadSeeker, gitProtocol string) (func(), error) {
+	started := time.Now()
+
+	trace, err := traceNegotiation(body)
+	if err != nil {
+		// A partial summary is still useful
+		helper.LogError(r, fmt.Errorf("traceNegotiation: %v", err))
+	}
+
+	requestBytes, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return func() { trace.log(r, gitProtocol, requestBytes, w.Count(), started) }, nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 )
 
 var (
@@ -33,7 +34,7 @@ func TestUploadPackTimesOut(t *testing.T) {
 	r := httptest.NewRequest("GET", "/", body)
 	a := &api.Response{}
 
-	err := handleUploadPack(NewHttpResponseWriter(w), r, a)
+	err := handleUploadPack(NewHttpResponseWriter(w), r, a, config.GitConfig{})
 	require.EqualError(t, err, "ReadAllTempfile: context deadline exceeded")
 
 }
@@ -2,6 +2,7 @@ package gitaly
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,21 +16,36 @@ type BlobClient struct {
 	gitalypb.BlobServiceClient
 }
 
+// ErrBlobNotFound is returned by SendBlob before anything is written to
+// the response
+var ErrBlobNotFound = errors.New("blob not found")
+
 func (client *BlobClient) SendBlob(ctx context.Context, w http.ResponseWriter, request *gitalypb.GetBlobRequest) error {
 	c, err := client.GetBlob(ctx, request)
 	if err != nil {
 		return fmt.Errorf("rpc failed: %v", err)
 	}
 
-	firstResponseReceived := false
-	rr := streamio.NewReader(func() ([]byte, error) {
-		resp, err := c.Recv()
+	// Gitaly sends a single response with an empty object ID if the
+	// blob does not exist
+	first, err := c.Recv()
+	if err != nil {
+		return fmt.Errorf("rpc failed: %v", err)
+	}
+	if first.GetOid() == "" {
+		return ErrBlobNotFound
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(first.GetSize(), 10))
 
-		if !firstResponseReceived && err == nil {
-			firstResponseReceived = true
-			w.Header().Set("Content-Length", strconv.FormatInt(resp.GetSize(), 10))
-		}
+	// Not io.MultiReader: its WriteTo allocates a buffer, while the one of
+	// the stream reader writes the messages as received
+	if _, err := w.Write(first.GetData()); err != nil {
+		return fmt.Errorf("copy rpc data: %v", err)
+	}
 
+	rr := streamio.NewReader(func() ([]byte, error) {
+		resp, err := c.Recv()
 		return resp.GetData(), err
 	})
 
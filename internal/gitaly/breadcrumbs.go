@@ -0,0 +1,33 @@
+package gitaly
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// Gitaly calls are recorded as breadcrumbs of the request, so that errors
+// reported to Sentry show which RPCs came before them
+
+func unaryBreadcrumbInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	addBreadcrumb(ctx, method, err)
+	return err
+}
+
+// Streams are recorded when they start, they often outlive the error that
+// is reported
+func streamBreadcrumbInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	addBreadcrumb(ctx, method, err)
+	return stream, err
+}
+
+func addBreadcrumb(ctx context.Context, method string, err error) {
+	helper.AddBreadcrumb(ctx, "gitaly", method, err != nil, map[string]interface{}{
+		"code": status.Code(err).String(),
+	})
+}
@@ -0,0 +1,20 @@
+package gitaly
+
+import (
+	"io"
+
+	"gitlab.com/gitlab-org/gitaly/streamio"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// copyBuffers are shared by the copies of request bodies to Gitaly
+// streams. The ReadFrom of a streamio writer would allocate a buffer of
+// streamio.WriteBufferSize for each request. Readers of Gitaly streams
+// need no buffer: their WriteTo writes the messages as received.
+var copyBuffers = helper.NewBufferPool(streamio.WriteBufferSize)
+
+// copyToStream copies src to the streamio writer dst
+func copyToStream(dst io.Writer, src io.Reader) (int64, error) {
+	return helper.CopyWithPool(dst, src, copyBuffers)
+}
@@ -0,0 +1,55 @@
+package gitaly
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitaly/streamio"
+)
+
+func TestCopyToStream(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+
+	var sent [][]byte
+	sw := streamio.NewWriter(func(p []byte) error {
+		sent = append(sent, append([]byte(nil), p...))
+		return nil
+	})
+
+	n, err := copyToStream(sw, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, bytes.Join(sent, nil))
+	for _, p := range sent {
+		require.True(t, len(p) <= streamio.WriteBufferSize)
+	}
+}
+
+func benchmarkCopyToStream(b *testing.B, copy func(io.Writer, io.Reader) (int64, error)) {
+	data := bytes.Repeat([]byte("x"), 1024*1024)
+	sw := streamio.NewWriter(func([]byte) error { return nil })
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			// Request bodies have no WriteTo
+			body := struct{ io.Reader }{bytes.NewReader(data)}
+			if _, err := copy(sw, body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkIOCopyToStream(b *testing.B) {
+	benchmarkCopyToStream(b, io.Copy)
+}
+
+func BenchmarkCopyToStream(b *testing.B) {
+	benchmarkCopyToStream(b, copyToStream)
+}
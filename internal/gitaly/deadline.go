@@ -0,0 +1,75 @@
+package gitaly
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+var (
+	// fastTimeout applies to unary RPCs and ref advertisements, which
+	// should finish in seconds. Zero means no timeout.
+	fastTimeout time.Duration
+	// streamTimeout applies to RPCs streaming packs, archives, blobs and
+	// diffs, which may legitimately take a long time. Zero means no timeout.
+	streamTimeout time.Duration
+
+	// Server-streaming RPCs that only return metadata
+	fastStreamingRPCs = map[string]bool{
+		"/gitaly.SmartHTTPService/InfoRefsUploadPack":  true,
+		"/gitaly.SmartHTTPService/InfoRefsReceivePack": true,
+	}
+)
+
+func rpcTimeout(method string, streaming bool) time.Duration {
+	if !streaming || fastStreamingRPCs[method] {
+		return fastTimeout
+	}
+	return streamTimeout
+}
+
+// withTimeout is like context.WithTimeout, except that a zero timeout
+// leaves ctx alone. Deadlines already set on ctx, e.g. from the HTTP
+// request, are kept if they are earlier.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func unaryDeadlineInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, cancel := withTimeout(ctx, rpcTimeout(method, false))
+	defer cancel()
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func streamDeadlineInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, cancel := withTimeout(ctx, rpcTimeout(method, true))
+
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &deadlineStream{ClientStream: stream, cancel: cancel}, nil
+}
+
+// deadlineStream releases the timeout context once the stream is finished.
+// Callers that abandon a stream before reading it to the end leave the
+// timer running until it expires, which is harmless.
+type deadlineStream struct {
+	grpc.ClientStream
+	cancel context.CancelFunc
+}
+
+func (s *deadlineStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.cancel()
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package gitaly
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestRPCTimeout(t *testing.T) {
+	defer func(fast, stream time.Duration) { fastTimeout, streamTimeout = fast, stream }(fastTimeout, streamTimeout)
+	fastTimeout, streamTimeout = time.Second, time.Hour
+
+	require.Equal(t, time.Second, rpcTimeout("/gitaly.RepositoryService/RepositoryExists", false))
+	require.Equal(t, time.Second, rpcTimeout("/gitaly.SmartHTTPService/InfoRefsUploadPack", true))
+	require.Equal(t, time.Hour, rpcTimeout("/gitaly.SmartHTTPService/PostUploadPack", true))
+}
+
+func TestStreamDeadline(t *testing.T) {
+	defer func(fast, stream time.Duration) { fastTimeout, streamTimeout = fast, stream }(fastTimeout, streamTimeout)
+	fastTimeout, streamTimeout = time.Minute, 50*time.Millisecond
+
+	_, server, stop := startHealthServer(t)
+	defer stop()
+
+	conn, err := newConnection(server)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	client := healthpb.NewHealthClient(conn)
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err, "unary RPC is not affected by the stream timeout")
+
+	// Watch sends the current status and then blocks until it changes
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	_, err = stream.Recv()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+}
+
+func TestUnaryDeadlineKeepsEarlierDeadline(t *testing.T) {
+	defer func(fast time.Duration) { fastTimeout = fast }(fastTimeout)
+	fastTimeout = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	expected, _ := ctx.Deadline()
+
+	var actual time.Time
+	invoker := func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		actual, _ = ctx.Deadline()
+		return nil
+	}
+
+	require.NoError(t, unaryDeadlineInterceptor(ctx, "/gitaly.RepositoryService/RepositoryExists", nil, nil, nil, invoker))
+	require.Equal(t, expected, actual)
+}
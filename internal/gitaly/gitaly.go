@@ -2,6 +2,7 @@ package gitaly
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"sync"
 
@@ -14,10 +15,14 @@ import (
 	gitalyclient "gitlab.com/gitlab-org/gitaly/client"
 	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 
 	grpccorrelation "gitlab.com/gitlab-org/labkit/correlation/grpc"
 	grpctracing "gitlab.com/gitlab-org/labkit/tracing/grpc"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
 type Server struct {
@@ -34,13 +39,13 @@ func (server Server) cacheKey() cacheKey {
 
 type connectionsCache struct {
 	sync.RWMutex
-	connections map[cacheKey]*grpc.ClientConn
+	connections map[cacheKey]*connectionPool
 }
 
 var (
 	jsonUnMarshaler = jsonpb.Unmarshaler{AllowUnknownFields: true}
 	cache           = connectionsCache{
-		connections: make(map[cacheKey]*grpc.ClientConn),
+		connections: make(map[cacheKey]*connectionPool),
 	}
 
 	connectionsTotal = prometheus.NewCounterVec(
@@ -56,6 +61,39 @@ func init() {
 	prometheus.MustRegister(connectionsTotal)
 }
 
+// Configure sets up the process-wide Gitaly connection settings. It must
+// be called before the first connection is made.
+func Configure(cfg config.GitalyConfig) error {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		tlsCredentials = credentials.NewTLS(tlsConfig)
+	}
+
+	if cfg.ConnectionsPerServer > 0 {
+		poolSize = cfg.ConnectionsPerServer
+	}
+
+	if cfg.FastTimeout != nil {
+		fastTimeout = cfg.FastTimeout.Duration
+	}
+	if cfg.StreamTimeout != nil {
+		streamTimeout = cfg.StreamTimeout.Duration
+	}
+
+	if cfg.CopyBufferSize < 0 {
+		return fmt.Errorf("CopyBufferSize must not be negative")
+	}
+	if cfg.CopyBufferSize > 0 {
+		copyBuffers = helper.NewBufferPool(cfg.CopyBufferSize)
+	}
+
+	return nil
+}
+
 func withOutgoingMetadata(ctx context.Context, features map[string]string) context.Context {
 	md := metadata.New(nil)
 	for k, v := range features {
@@ -77,6 +115,15 @@ func NewSmartHTTPClient(ctx context.Context, server Server) (context.Context, *S
 	return withOutgoingMetadata(ctx, server.Features), &SmartHTTPClient{grpcClient}, nil
 }
 
+func NewSSHClient(ctx context.Context, server Server) (context.Context, *SSHClient, error) {
+	conn, err := getOrCreateConnection(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	grpcClient := gitalypb.NewSSHServiceClient(conn)
+	return withOutgoingMetadata(ctx, server.Features), &SSHClient{grpcClient}, nil
+}
+
 func NewBlobClient(ctx context.Context, server Server) (context.Context, *BlobClient, error) {
 	conn, err := getOrCreateConnection(server)
 	if err != nil {
@@ -118,36 +165,37 @@ func getOrCreateConnection(server Server) (*grpc.ClientConn, error) {
 	key := server.cacheKey()
 
 	cache.RLock()
-	conn := cache.connections[key]
+	pool := cache.connections[key]
 	cache.RUnlock()
 
-	if conn != nil {
-		return conn, nil
+	if pool != nil {
+		return pool.pick(), nil
 	}
 
 	cache.Lock()
 	defer cache.Unlock()
 
-	if conn := cache.connections[key]; conn != nil {
-		return conn, nil
+	if pool := cache.connections[key]; pool != nil {
+		return pool.pick(), nil
 	}
 
-	conn, err := newConnection(server)
+	pool, err := newConnectionPool(server, poolSize)
 	if err != nil {
 		return nil, err
 	}
 
-	cache.connections[key] = conn
+	cache.connections[key] = pool
 
-	return conn, nil
+	return pool.pick(), nil
 }
 
 func CloseConnections() {
 	cache.Lock()
 	defer cache.Unlock()
 
-	for _, conn := range cache.connections {
-		conn.Close()
+	for key, pool := range cache.connections {
+		pool.Close()
+		delete(cache.connections, key)
 	}
 }
 
@@ -156,7 +204,10 @@ func newConnection(server Server) (*grpc.ClientConn, error) {
 		grpc.WithPerRPCCredentials(gitalyauth.RPCCredentialsV2(server.Token)),
 		grpc.WithStreamInterceptor(
 			grpc_middleware.ChainStreamClient(
+				streamDeadlineInterceptor,
 				grpctracing.StreamClientTracingInterceptor(),
+				streamBytesInterceptor,
+				streamBreadcrumbInterceptor,
 				grpc_prometheus.StreamClientInterceptor,
 				grpccorrelation.StreamClientCorrelationInterceptor(),
 			),
@@ -164,14 +215,22 @@ func newConnection(server Server) (*grpc.ClientConn, error) {
 
 		grpc.WithUnaryInterceptor(
 			grpc_middleware.ChainUnaryClient(
+				unaryDeadlineInterceptor,
 				grpctracing.UnaryClientTracingInterceptor(),
+				unaryBreadcrumbInterceptor,
 				grpc_prometheus.UnaryClientInterceptor,
 				grpccorrelation.UnaryClientCorrelationInterceptor(),
 			),
 		),
 	)
 
-	conn, connErr := gitalyclient.Dial(server.Address, connOpts)
+	var conn *grpc.ClientConn
+	var connErr error
+	if tlsCredentials != nil && strings.HasPrefix(server.Address, "tls://") {
+		conn, connErr = dialTLS(server.Address, connOpts)
+	} else {
+		conn, connErr = gitalyclient.Dial(server.Address, connOpts)
+	}
 
 	label := "ok"
 	if connErr != nil {
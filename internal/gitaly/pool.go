@@ -0,0 +1,223 @@
+package gitaly
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var (
+	// poolSize is the number of connections kept open per Gitaly server
+	poolSize = 1
+
+	healthCheckInterval = 15 * time.Second
+	healthCheckTimeout  = 5 * time.Second
+	// A connection that fails this many health checks in a row is replaced
+	// by a fresh one
+	maxHealthCheckFailures = 3
+
+	healthChecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_gitaly_health_checks_total",
+			Help: "Number of health checks performed on pooled Gitaly connections",
+		},
+		[]string{"status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(healthChecksTotal)
+}
+
+// connectionPool holds the connections to a single Gitaly server. New
+// streams are spread over the connections round-robin, skipping those that
+// are failing health checks. A connection that stays unhealthy is closed
+// and dialed again, so a pool recovers from e.g. a Gitaly restart behind a
+// new IP address.
+type connectionPool struct {
+	server Server
+
+	mu    sync.Mutex
+	conns []*pooledConn
+	next  int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type pooledConn struct {
+	*grpc.ClientConn
+	failures int
+}
+
+func (pc *pooledConn) healthy() bool {
+	if pc.failures > 0 {
+		return false
+	}
+
+	switch pc.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	}
+
+	return true
+}
+
+func newConnectionPool(server Server, size int) (*connectionPool, error) {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &connectionPool{
+		server: server,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		conn, err := newConnection(server)
+		if err != nil {
+			p.closeConns()
+			return nil, err
+		}
+		p.conns = append(p.conns, &pooledConn{ClientConn: conn})
+	}
+
+	go p.healthCheckLoop()
+
+	return p, nil
+}
+
+// pick returns the next healthy connection. If no connection is healthy
+// we still return one, so the caller gets a meaningful error from gRPC.
+func (p *connectionPool) pick() *grpc.ClientConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < len(p.conns); i++ {
+		pc := p.conns[(p.next+i)%len(p.conns)]
+		if pc.healthy() {
+			p.next = (p.next + i + 1) % len(p.conns)
+			return pc.ClientConn
+		}
+	}
+
+	pc := p.conns[p.next]
+	p.next = (p.next + 1) % len(p.conns)
+	return pc.ClientConn
+}
+
+func (p *connectionPool) healthCheckLoop() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkHealth()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *connectionPool) checkHealth() {
+	p.mu.Lock()
+	conns := make([]*pooledConn, len(p.conns))
+	copy(conns, p.conns)
+	p.mu.Unlock()
+
+	for i, pc := range conns {
+		err := checkConnection(pc.ClientConn)
+
+		p.mu.Lock()
+		if err == nil {
+			healthChecksTotal.WithLabelValues("ok").Inc()
+			pc.failures = 0
+			p.mu.Unlock()
+			continue
+		}
+
+		healthChecksTotal.WithLabelValues("fail").Inc()
+		pc.failures++
+		failures := pc.failures
+		p.mu.Unlock()
+
+		log.WithError(err).WithFields(log.Fields{
+			"address":  p.server.Address,
+			"failures": failures,
+		}).Warning("gitaly: connection failed health check")
+
+		if failures >= maxHealthCheckFailures {
+			p.replace(i, pc)
+		}
+	}
+}
+
+func checkConnection(conn *grpc.ClientConn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return &unhealthyError{resp.Status}
+	}
+
+	return nil
+}
+
+type unhealthyError struct {
+	status healthpb.HealthCheckResponse_ServingStatus
+}
+
+func (e *unhealthyError) Error() string {
+	return "health check status " + e.status.String()
+}
+
+// replace dials a new connection for slot i. Streams still running on the
+// old connection are cut off, but it has been failing health checks for a
+// while so they are unlikely to succeed anyway.
+func (p *connectionPool) replace(i int, old *pooledConn) {
+	conn, err := newConnection(p.server)
+	if err != nil {
+		log.WithError(err).WithField("address", p.server.Address).Error("gitaly: replace connection")
+		return
+	}
+
+	p.mu.Lock()
+	if p.conns[i] != old {
+		p.mu.Unlock()
+		conn.Close()
+		return
+	}
+	p.conns[i] = &pooledConn{ClientConn: conn}
+	p.mu.Unlock()
+
+	old.Close()
+}
+
+func (p *connectionPool) Close() {
+	close(p.stop)
+	<-p.done
+	p.closeConns()
+}
+
+func (p *connectionPool) closeConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pc := range p.conns {
+		pc.Close()
+	}
+}
@@ -0,0 +1,84 @@
+package gitaly
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func startHealthServer(t *testing.T) (*health.Server, Server, func()) {
+	healthServer := health.NewServer()
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+
+	return healthServer, Server{Address: "tcp://" + listener.Addr().String()}, server.Stop
+}
+
+func TestConnectionPoolRoundRobin(t *testing.T) {
+	_, server, stop := startHealthServer(t)
+	defer stop()
+
+	pool, err := newConnectionPool(server, 2)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	first, second := pool.pick(), pool.pick()
+	require.True(t, first != second, "pick the connections in turn")
+	require.Same(t, first, pool.pick())
+}
+
+func TestConnectionPoolSkipsUnhealthy(t *testing.T) {
+	_, server, stop := startHealthServer(t)
+	defer stop()
+
+	pool, err := newConnectionPool(server, 2)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	pool.conns[0].failures = 1
+	healthy := pool.conns[1].ClientConn
+
+	for i := 0; i < 3; i++ {
+		require.Same(t, healthy, pool.pick())
+	}
+
+	pool.conns[1].failures = 1
+	require.NotNil(t, pool.pick(), "return a connection even if none is healthy")
+}
+
+func TestConnectionPoolReplacesUnhealthy(t *testing.T) {
+	healthServer, server, stop := startHealthServer(t)
+	defer stop()
+
+	pool, err := newConnectionPool(server, 1)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	pool.checkHealth()
+	require.Equal(t, 0, pool.conns[0].failures)
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	original := pool.conns[0]
+
+	for i := 1; i < maxHealthCheckFailures; i++ {
+		pool.checkHealth()
+		require.Equal(t, i, pool.conns[0].failures)
+		require.Same(t, original, pool.conns[0])
+	}
+
+	pool.checkHealth()
+	require.True(t, original != pool.conns[0], "connection replaced")
+	require.Equal(t, 0, pool.conns[0].failures)
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	pool.checkHealth()
+	require.Equal(t, 0, pool.conns[0].failures)
+}
@@ -0,0 +1,55 @@
+package gitaly
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/golang/protobuf/proto"
+	opentracing "github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+)
+
+// streamBytesInterceptor adds the size of the messages of a stream to the
+// span of the RPC. It must come after the tracing interceptor, which
+// finishes the span once it sees the end of the stream.
+func streamBytesInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return stream, nil
+	}
+
+	return &bytesStream{ClientStream: stream, span: span}, nil
+}
+
+type bytesStream struct {
+	grpc.ClientStream
+	span     opentracing.Span
+	sent     int64 // Streams can be sent to and read from concurrently
+	received int64
+}
+
+func (s *bytesStream) SendMsg(m interface{}) error {
+	if msg, ok := m.(proto.Message); ok {
+		atomic.AddInt64(&s.sent, int64(proto.Size(msg)))
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *bytesStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.span.SetTag("grpc.bytes_sent", atomic.LoadInt64(&s.sent))
+		s.span.SetTag("grpc.bytes_received", s.received)
+		return err
+	}
+
+	if msg, ok := m.(proto.Message); ok {
+		s.received += int64(proto.Size(msg))
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package gitaly
+
+import (
+	"io"
+	"testing"
+
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+	"google.golang.org/grpc"
+)
+
+type fakeClientStream struct {
+	grpc.ClientStream
+	messages int
+}
+
+func (s *fakeClientStream) SendMsg(m interface{}) error { return nil }
+
+func (s *fakeClientStream) RecvMsg(m interface{}) error {
+	if s.messages == 0 {
+		return io.EOF
+	}
+	s.messages--
+	m.(*gitalypb.PostUploadPackResponse).Data = []byte("0008NAK\n")
+	return nil
+}
+
+func TestBytesStreamTagsSpan(t *testing.T) {
+	span := mocktracer.New().StartSpan("rpc").(*mocktracer.MockSpan)
+	s := &bytesStream{ClientStream: &fakeClientStream{messages: 2}, span: span}
+
+	require.NoError(t, s.SendMsg(&gitalypb.PostUploadPackRequest{Data: []byte("0000")}))
+
+	for {
+		if err := s.RecvMsg(&gitalypb.PostUploadPackResponse{}); err != nil {
+			require.Equal(t, io.EOF, err)
+			break
+		}
+	}
+
+	require.Equal(t, int64(6), span.Tag("grpc.bytes_sent"))
+	require.Equal(t, int64(20), span.Tag("grpc.bytes_received"))
+}
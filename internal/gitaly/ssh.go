@@ -0,0 +1,71 @@
+package gitaly
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"gitlab.com/gitlab-org/gitaly/proto/go/gitalypb"
+	"gitlab.com/gitlab-org/gitaly/streamio"
+)
+
+// SSHClient encapsulates SSHService calls
+type SSHClient struct {
+	gitalypb.SSHServiceClient
+}
+
+// UploadArchive runs 'git upload-archive' in Gitaly. There is no smart HTTP
+// RPC for upload-archive, but the SSH RPC is a plain stdin/stdout proxy so
+// it serves HTTP clients just as well. Standard error of the Git process is
+// copied to stderr.
+func (client *SSHClient) UploadArchive(ctx context.Context, repo *gitalypb.Repository, clientRequest io.Reader, clientResponse io.Writer, stderr io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.SSHUploadArchive(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := stream.Send(&gitalypb.SSHUploadArchiveRequest{Repository: repo}); err != nil {
+		return fmt.Errorf("initial request: %v", err)
+	}
+
+	// Git stops reading its input once it has seen the arguments, so the
+	// outcome is decided by the exit status and errors on this side are
+	// not interesting. Cancelling ctx releases a blocked Send.
+	go func() {
+		sw := streamio.NewWriter(func(data []byte) error {
+			return stream.Send(&gitalypb.SSHUploadArchiveRequest{Stdin: data})
+		})
+		copyToStream(sw, clientRequest)
+		stream.CloseSend()
+	}()
+
+	var exitStatus *gitalypb.ExitStatus
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := clientResponse.Write(resp.GetStdout()); err != nil {
+			return err
+		}
+		if _, err := stderr.Write(resp.GetStderr()); err != nil {
+			return err
+		}
+		if resp.GetExitStatus() != nil {
+			exitStatus = resp.GetExitStatus()
+		}
+	}
+
+	if code := exitStatus.GetValue(); code != 0 {
+		return fmt.Errorf("git-upload-archive: exit status %d", code)
+	}
+
+	return nil
+}
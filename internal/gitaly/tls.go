@@ -0,0 +1,85 @@
+package gitaly
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// tlsCredentials are used for tls:// Gitaly addresses when a custom CA,
+// client certificate or server name is configured. When nil the Gitaly
+// client library defaults (system CA pool) apply.
+var tlsCredentials credentials.TransportCredentials
+
+func newTLSConfig(cfg config.GitalyConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.ServerNameOverride == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerNameOverride,
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("gitaly: read CAFile: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("gitaly: no certificates found in CAFile %q", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("gitaly: CertFile and KeyFile must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("gitaly: load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// dialTLS connects to a tls:// address using tlsCredentials. We can't use
+// gitalyclient.Dial here because it always installs its own transport
+// credentials.
+func dialTLS(rawAddress string, connOpts []grpc.DialOption) (*grpc.ClientConn, error) {
+	u, err := url.Parse(rawAddress)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid connection string: %s", rawAddress)
+	}
+
+	connOpts = append(connOpts,
+		grpc.WithTransportCredentials(tlsCredentials),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                20 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+
+	return grpc.DialContext(context.Background(), u.Host, connOpts...)
+}
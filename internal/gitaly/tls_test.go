@@ -0,0 +1,97 @@
+package gitaly
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitaly-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := testhelper.WriteCertificate(t, dir, "gitaly.example.com", "gitaly.example.com", 1)
+
+	tlsConfig, err := newTLSConfig(config.GitalyConfig{})
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig, "no custom TLS config")
+
+	tlsConfig, err = newTLSConfig(config.GitalyConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerNameOverride: "gitaly"})
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig.RootCAs)
+	require.Len(t, tlsConfig.Certificates, 1)
+	require.Equal(t, "gitaly", tlsConfig.ServerName)
+
+	_, err = newTLSConfig(config.GitalyConfig{CertFile: certFile})
+	require.Error(t, err, "key file missing")
+
+	_, err = newTLSConfig(config.GitalyConfig{CAFile: filepath.Join(dir, "missing.crt")})
+	require.Error(t, err)
+
+	_, err = newTLSConfig(config.GitalyConfig{CAFile: keyFile})
+	require.Error(t, err, "no certificates in CA file")
+}
+
+func TestDialMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitaly-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := testhelper.WriteCertificate(t, dir, "gitaly.internal", "gitaly.internal", 1)
+	clientCert, clientKey := testhelper.WriteCertificate(t, dir, "workhorse.internal", "workhorse.internal", 1)
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientPEM, err := ioutil.ReadFile(clientCert)
+	require.NoError(t, err)
+	require.True(t, clientCAs.AppendCertsFromPEM(clientPEM))
+
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	tlsConfig, err := newTLSConfig(config.GitalyConfig{
+		CAFile:             serverCert,
+		CertFile:           clientCert,
+		KeyFile:            clientKey,
+		ServerNameOverride: "gitaly.internal",
+	})
+	require.NoError(t, err)
+
+	defer func(old credentials.TransportCredentials) { tlsCredentials = old }(tlsCredentials)
+	tlsCredentials = credentials.NewTLS(tlsConfig)
+
+	conn, err := dialTLS("tls://"+listener.Addr().String(), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+}
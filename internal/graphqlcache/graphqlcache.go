@@ -0,0 +1,376 @@
+/*
+Package graphqlcache serves hot persisted GraphQL queries, like the ones of
+dashboards, from Redis instead of Puma.
+
+Only the persisted queries whose hashes are allowed in the config are
+cached, for a short TTL. The cache key covers the query hash, the
+operation name, the variables and the credentials of the user. The
+credentials go into the key as an HMAC keyed with the Workhorse secret, so
+that Redis never holds them.
+*/
+package graphqlcache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+)
+
+const (
+	defaultTTL             = 10 * time.Second
+	defaultMaxResponseSize = 1024 * 1024
+	// Persisted queries are small, larger bodies are not looked at
+	maxRequestSize = 64 * 1024
+
+	keyPrefix = "workhorse:graphql:"
+	// CacheHeader tells the client if the response came from the cache
+	CacheHeader = "X-Gitlab-Workhorse-Cache"
+)
+
+var queryHashRegex = regexp.MustCompile(`\A[0-9a-f]{64}\z`)
+
+type settings struct {
+	queries         map[string]bool
+	ttl             time.Duration
+	maxResponseSize int64
+}
+
+var (
+	mu      sync.RWMutex
+	current settings
+
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_graphql_cache_requests",
+			Help: "How many persisted GraphQL queries gitlab-workhorse looked up in its cache, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests)
+}
+
+// Configure sets the persisted queries that are cached and for how long
+func Configure(cfg config.GraphQLCacheConfig) error {
+	s := settings{
+		queries:         make(map[string]bool),
+		ttl:             defaultTTL,
+		maxResponseSize: defaultMaxResponseSize,
+	}
+
+	for _, hash := range cfg.Queries {
+		if !queryHashRegex.MatchString(hash) {
+			return fmt.Errorf("Queries: %q is not a SHA-256 hash in hex", hash)
+		}
+		s.queries[hash] = true
+	}
+	if cfg.TTL != nil {
+		if cfg.TTL.Duration <= 0 {
+			return fmt.Errorf("TTL must be positive")
+		}
+		s.ttl = cfg.TTL.Duration
+	}
+	if cfg.MaxResponseSize < 0 {
+		return fmt.Errorf("MaxResponseSize must not be negative")
+	}
+	if cfg.MaxResponseSize > 0 {
+		s.maxResponseSize = cfg.MaxResponseSize
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	current = s
+
+	return nil
+}
+
+func getSettings() settings {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// persistedQuery is the part of a GraphQL request that makes the key
+type persistedQuery struct {
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+	Query         string          `json:"query"`
+	Extensions    struct {
+		PersistedQuery struct {
+			SHA256Hash string `json:"sha256Hash"`
+		} `json:"persistedQuery"`
+	} `json:"extensions"`
+}
+
+// Handler serves the cached responses of allowed persisted queries, and
+// caches the successful responses of next for them
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := getSettings()
+		if len(s.queries) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := cacheKey(r, s)
+		if !ok {
+			cacheRequests.WithLabelValues("bypass").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := get(key)
+		if err != nil {
+			cacheRequests.WithLabelValues("error").Inc()
+			log.WithContextFields(r.Context(), log.Fields{"key": key}).WithError(err).Error("graphqlcache: get")
+			next.ServeHTTP(w, r)
+			return
+		}
+		if body != nil {
+			cacheRequests.WithLabelValues("hit").Inc()
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set(CacheHeader, "HIT")
+			w.Write(body)
+			return
+		}
+
+		cacheRequests.WithLabelValues("miss").Inc()
+		w.Header().Set(CacheHeader, "MISS")
+		rw := &recordingResponseWriter{ResponseWriter: w, max: s.maxResponseSize}
+		next.ServeHTTP(rw, r)
+
+		if !rw.cacheable() {
+			return
+		}
+		if err := set(key, rw.body.Bytes(), s.ttl); err != nil {
+			log.WithContextFields(r.Context(), log.Fields{"key": key}).WithError(err).Error("graphqlcache: set")
+		}
+	})
+}
+
+// cacheKey returns the key of the response of r, or false if r is not an
+// allowed persisted query. The body of r is read and put back.
+func cacheKey(r *http.Request, s settings) (string, bool) {
+	var q persistedQuery
+
+	switch r.Method {
+	case "GET":
+		values := r.URL.Query()
+		q.OperationName = values.Get("operationName")
+		q.Query = values.Get("query")
+		if v := values.Get("variables"); v != "" {
+			q.Variables = json.RawMessage(v)
+		}
+		if err := json.Unmarshal([]byte(values.Get("extensions")), &q.Extensions); err != nil {
+			return "", false
+		}
+	case "POST":
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			return "", false
+		}
+		body, ok := peekBody(r)
+		if !ok {
+			return "", false
+		}
+		// Batched queries are JSON arrays and fail here
+		if err := json.Unmarshal(body, &q); err != nil {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	hash := q.Extensions.PersistedQuery.SHA256Hash
+	if !s.queries[hash] {
+		return "", false
+	}
+	// The query text, if sent, must be the persisted one
+	if q.Query != "" && sha256Hex([]byte(q.Query)) != hash {
+		return "", false
+	}
+
+	variables, err := normalizeVariables(q.Variables)
+	if err != nil {
+		return "", false
+	}
+	user, err := userKey(r)
+	if err != nil {
+		return "", false
+	}
+
+	parts := []string{hash, q.OperationName, string(variables), user}
+	return keyPrefix + sha256Hex([]byte(strings.Join(parts, "\x00"))), true
+}
+
+// peekBody reads up to maxRequestSize bytes of the body of r and puts them
+// back in front of the rest
+func peekBody(r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+	return body, err == nil && len(body) <= maxRequestSize
+}
+
+// normalizeVariables orders the keys of objects, so that the same
+// variables make the same key
+func normalizeVariables(variables json.RawMessage) ([]byte, error) {
+	if len(variables) == 0 {
+		return []byte("null"), nil
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(variables, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// userKey identifies the user by the credentials of r, whatever they are.
+// Anonymous requests share an empty set of credentials.
+func userKey(r *http.Request) (string, error) {
+	var credentials []string
+	for _, header := range []string{"Authorization", "Private-Token", "Job-Token"} {
+		credentials = append(credentials, r.Header.Get(header))
+	}
+	// Rails also accepts tokens in the query string
+	query := r.URL.Query()
+	for _, param := range []string{"private_token", "job_token", "access_token"} {
+		credentials = append(credentials, query.Get(param))
+	}
+	if cookie, err := r.Cookie("_gitlab_session"); err == nil {
+		credentials = append(credentials, cookie.Value)
+	}
+
+	key, err := secret.Bytes()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(credentials, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// get returns the cached response of key, or nil
+func get(key string) ([]byte, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return nil, fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	body, err := redigo.Bytes(conn.Do("GET", key))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+	return body, err
+}
+
+func set(key string, body []byte, ttl time.Duration) error {
+	conn := redis.Get()
+	if conn == nil {
+		return fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	_, err := conn.Do("SET", key, body, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+// recordingResponseWriter keeps a copy of the response while it is
+// written, as long as it is small enough to be cached
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	max      int64
+	status   int
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.tooLarge {
+		if int64(w.body.Len()+len(data)) > w.max {
+			w.tooLarge = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(data)
+		}
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// cacheable tells if the response is a successful JSON response that is
+// the same for every request of the key, and that Rails allows to store
+func (w *recordingResponseWriter) cacheable() bool {
+	if w.status != http.StatusOK || w.tooLarge || w.body.Len() == 0 {
+		return false
+	}
+
+	header := w.Header()
+	if mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type")); mediaType != "application/json" {
+		return false
+	}
+	if header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "private", "no-store":
+			return false
+		}
+	}
+
+	var response map[string]json.RawMessage
+	if err := json.Unmarshal(w.body.Bytes(), &response); err != nil {
+		return false
+	}
+	_, hasErrors := response["errors"]
+	return !hasErrors
+}
@@ -0,0 +1,258 @@
+package graphqlcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const (
+	query         = `query dashboard { currentUser { name } }`
+	graphQLResult = `{"data":{"currentUser":{"name":"root"}}}`
+)
+
+var queryHash = func() string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}()
+
+func setup(t *testing.T, queries ...string) *redigomock.Conn {
+	testhelper.ConfigureSecret()
+	require.NoError(t, Configure(config.GraphQLCacheConfig{Queries: queries, TTL: &config.TomlDuration{Duration: time.Minute}}))
+
+	conn := redigomock.NewConn()
+	redis.Configure(&config.RedisConfig{}, func(_ *config.RedisConfig, _ bool) func() (redigo.Conn, error) {
+		return func() (redigo.Conn, error) {
+			return conn, nil
+		}
+	})
+	return conn
+}
+
+func persistedQueryBody(hash string, variables string) string {
+	return `{"operationName":"dashboard","variables":` + variables + `,"extensions":{"persistedQuery":{"version":1,"sha256Hash":"` + hash + `"}}}`
+}
+
+func newRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "/api/graphql", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Private-Token", "secret-token")
+	return r
+}
+
+type rails struct {
+	calls    int
+	body     string
+	response string
+	header   http.Header
+}
+
+func (h *rails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls++
+	body, _ := ioutil.ReadAll(r.Body)
+	h.body = string(body)
+
+	for k, v := range h.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write([]byte(h.response))
+}
+
+func TestCacheMissAndHit(t *testing.T) {
+	conn := setup(t, queryHash)
+	body := persistedQueryBody(queryHash, `{"id":1}`)
+
+	get := conn.GenericCommand("GET").Expect(nil)
+	set := conn.GenericCommand("SET").Expect("OK")
+
+	backend := &rails{response: graphQLResult}
+	w := httptest.NewRecorder()
+	Handler(backend).ServeHTTP(w, newRequest(body))
+
+	require.Equal(t, 1, backend.calls)
+	require.Equal(t, body, backend.body, "the body must reach Rails unchanged")
+	require.Equal(t, graphQLResult, w.Body.String())
+	require.Equal(t, "MISS", w.Header().Get(CacheHeader))
+	require.Equal(t, 1, conn.Stats(get))
+	require.Equal(t, 1, conn.Stats(set))
+
+	conn.Clear()
+	conn.GenericCommand("GET").Expect([]byte(graphQLResult))
+
+	w = httptest.NewRecorder()
+	Handler(backend).ServeHTTP(w, newRequest(body))
+
+	require.Equal(t, 1, backend.calls, "a hit must not reach Rails")
+	require.Equal(t, graphQLResult, w.Body.String())
+	require.Equal(t, "HIT", w.Header().Get(CacheHeader))
+	require.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+}
+
+func TestGetRequest(t *testing.T) {
+	conn := setup(t, queryHash)
+	conn.GenericCommand("GET").Expect([]byte(graphQLResult))
+
+	values := url.Values{
+		"operationName": {"dashboard"},
+		"variables":     {`{"id":1}`},
+		"extensions":    {`{"persistedQuery":{"version":1,"sha256Hash":"` + queryHash + `"}}`},
+	}
+	r := httptest.NewRequest("GET", "/api/graphql?"+values.Encode(), nil)
+
+	backend := &rails{response: graphQLResult}
+	w := httptest.NewRecorder()
+	Handler(backend).ServeHTTP(w, r)
+
+	require.Equal(t, 0, backend.calls)
+	require.Equal(t, "HIT", w.Header().Get(CacheHeader))
+}
+
+func TestBypass(t *testing.T) {
+	otherHash := strings.Repeat("0", 64)
+
+	tests := []struct {
+		name    string
+		queries []string
+		request *http.Request
+	}{
+		{name: "not configured", request: newRequest(persistedQueryBody(queryHash, `{}`))},
+		{name: "query not allowed", queries: []string{otherHash}, request: newRequest(persistedQueryBody(queryHash, `{}`))},
+		{
+			name:    "query text not matching the hash",
+			queries: []string{queryHash},
+			request: newRequest(`{"query":"mutation { destroyEverything }","extensions":{"persistedQuery":{"sha256Hash":"` + queryHash + `"}}}`),
+		},
+		{name: "batched queries", queries: []string{queryHash}, request: newRequest(`[` + persistedQueryBody(queryHash, `{}`) + `]`)},
+		{name: "not JSON", queries: []string{queryHash}, request: httptest.NewRequest("POST", "/api/graphql", strings.NewReader(persistedQueryBody(queryHash, `{}`)))},
+		{name: "too large", queries: []string{queryHash}, request: newRequest(persistedQueryBody(queryHash, `"`+strings.Repeat("x", maxRequestSize)+`"`))},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := setup(t, tc.queries...)
+			get := conn.GenericCommand("GET").Expect(nil)
+			expected, _ := ioutil.ReadAll(tc.request.Body)
+			tc.request.Body = ioutil.NopCloser(strings.NewReader(string(expected)))
+
+			backend := &rails{response: graphQLResult}
+			w := httptest.NewRecorder()
+			Handler(backend).ServeHTTP(w, tc.request)
+
+			require.Equal(t, 1, backend.calls)
+			require.Equal(t, string(expected), backend.body)
+			require.Empty(t, w.Header().Get(CacheHeader))
+			require.Equal(t, 0, conn.Stats(get), "the cache must not be used")
+		})
+	}
+}
+
+func TestUncacheableResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		header   http.Header
+	}{
+		{name: "GraphQL errors", response: `{"errors":[{"message":"boom"}]}`},
+		{name: "Set-Cookie", response: graphQLResult, header: http.Header{"Set-Cookie": {"a=b"}}},
+		{name: "not JSON", response: "<html>"},
+		{name: "Cache-Control private", response: graphQLResult, header: http.Header{"Cache-Control": {"max-age=0, private, must-revalidate"}}},
+		{name: "Cache-Control no-store", response: graphQLResult, header: http.Header{"Cache-Control": {"no-store"}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			conn := setup(t, queryHash)
+			conn.GenericCommand("GET").Expect(nil)
+			set := conn.GenericCommand("SET").Expect("OK")
+
+			backend := &rails{response: tc.response, header: tc.header}
+			w := httptest.NewRecorder()
+			Handler(backend).ServeHTTP(w, newRequest(persistedQueryBody(queryHash, `{}`)))
+
+			require.Equal(t, tc.response, w.Body.String())
+			require.Equal(t, 0, conn.Stats(set))
+		})
+	}
+}
+
+func TestQueryTokenNotServedToAnonymous(t *testing.T) {
+	conn := setup(t, queryHash)
+	body := persistedQueryBody(queryHash, `{}`)
+
+	newQueryRequest := func(rawQuery string) *http.Request {
+		r := httptest.NewRequest("POST", "/api/graphql?"+rawQuery, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+
+	for _, param := range []string{"private_token", "job_token", "access_token"} {
+		t.Run(param, func(t *testing.T) {
+			conn.Clear()
+			tokenKey, ok := cacheKey(newQueryRequest(param+"=secret-token"), getSettings())
+			require.True(t, ok)
+			conn.Command("GET", tokenKey).Expect([]byte(graphQLResult))
+			conn.GenericCommand("GET").Expect(nil)
+			conn.GenericCommand("SET").Expect("OK")
+
+			backend := &rails{response: `{"data":{"currentUser":null}}`}
+			w := httptest.NewRecorder()
+			Handler(backend).ServeHTTP(w, newQueryRequest(param+"=secret-token"))
+			require.Equal(t, "HIT", w.Header().Get(CacheHeader))
+
+			w = httptest.NewRecorder()
+			Handler(backend).ServeHTTP(w, newQueryRequest(""))
+			require.Equal(t, "MISS", w.Header().Get(CacheHeader))
+			require.Equal(t, 1, backend.calls)
+			require.Equal(t, backend.response, w.Body.String())
+		})
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	setup(t, queryHash)
+	s := getSettings()
+
+	key := func(r *http.Request) string {
+		k, ok := cacheKey(r, s)
+		require.True(t, ok)
+		return k
+	}
+
+	base := key(newRequest(persistedQueryBody(queryHash, `{"a":1,"b":2}`)))
+	require.True(t, strings.HasPrefix(base, keyPrefix))
+	require.NotContains(t, base, "secret-token")
+
+	require.Equal(t, base, key(newRequest(persistedQueryBody(queryHash, `{"b":2, "a":1}`))), "the order of variables doesn't matter")
+	require.NotEqual(t, base, key(newRequest(persistedQueryBody(queryHash, `{"a":1,"b":3}`))))
+
+	otherUser := newRequest(persistedQueryBody(queryHash, `{"a":1,"b":2}`))
+	otherUser.Header.Set("Private-Token", "other-token")
+	require.NotEqual(t, base, key(otherUser))
+
+	withQuery := newRequest(`{"operationName":"dashboard","query":` + `"` + query + `","variables":{"a":1,"b":2},"extensions":{"persistedQuery":{"sha256Hash":"` + queryHash + `"}}}`)
+	require.Equal(t, base, key(withQuery))
+}
+
+func TestConfigure(t *testing.T) {
+	require.NoError(t, Configure(config.GraphQLCacheConfig{Queries: []string{queryHash}}))
+	require.Equal(t, defaultTTL, getSettings().ttl)
+
+	require.Error(t, Configure(config.GraphQLCacheConfig{Queries: []string{"dashboard"}}))
+	require.Error(t, Configure(config.GraphQLCacheConfig{TTL: &config.TomlDuration{}}))
+	require.Error(t, Configure(config.GraphQLCacheConfig{MaxResponseSize: -1}))
+}
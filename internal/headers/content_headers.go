@@ -107,3 +107,27 @@ func inlineDisposition(contentDisposition string) string {
 func isType(contentType string, mimeType *regexp.Regexp) bool {
 	return mimeType.MatchString(contentType)
 }
+
+// InlineContentType returns the Content-Type to render a response of
+// contentType inline with, or false if the response must be downloaded.
+// Text is always rendered as plain text so that HTML and JavaScript are
+// never interpreted by the browser.
+func InlineContentType(contentType string) (string, bool) {
+	for _, element := range forbiddenInlineTypes {
+		if isType(contentType, element) {
+			return "", false
+		}
+	}
+
+	if isType(contentType, TextTypeRegex) {
+		return "text/plain; charset=utf-8", true
+	}
+
+	for _, element := range allowedInlineTypes {
+		if isType(contentType, element) {
+			return contentType, true
+		}
+	}
+
+	return "", false
+}
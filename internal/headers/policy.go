@@ -0,0 +1,88 @@
+package headers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+var (
+	policyMu sync.RWMutex
+	policy   []*headerRule
+)
+
+type headerRule struct {
+	path *regexp.Regexp
+	config.HeaderRule
+}
+
+// ConfigurePolicy sets the header rules from the [[headers]] sections of
+// config.toml
+func ConfigurePolicy(cfgs []config.HeaderRule) error {
+	var rules []*headerRule
+	for i, cfg := range cfgs {
+		path, err := regexp.Compile(cfg.Path)
+		if err != nil {
+			return fmt.Errorf("header rule %d: Path: %v", i, err)
+		}
+		rules = append(rules, &headerRule{path: path, HeaderRule: cfg})
+	}
+
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = rules
+
+	return nil
+}
+
+// ApplyPolicy changes the headers of r according to the rules matching
+// path, and returns a ResponseWriter that does the same for the response.
+// If no rule matches w is returned unchanged.
+func ApplyPolicy(w http.ResponseWriter, r *http.Request, path string) http.ResponseWriter {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+
+	var matched []*headerRule
+	for _, rule := range policy {
+		if rule.path.MatchString(path) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return w
+	}
+
+	for _, rule := range matched {
+		for _, name := range rule.RemoveRequestHeaders {
+			r.Header.Del(name)
+		}
+		for name, value := range rule.SetRequestHeaders {
+			r.Header.Set(name, value)
+		}
+	}
+
+	return helper.NewHeaderRewritingResponseWriter(w, func(h http.Header) {
+		applyResponseRules(h, matched)
+	})
+}
+
+// applyResponseRules changes the response headers just before they are sent
+func applyResponseRules(h http.Header, rules []*headerRule) {
+	for _, rule := range rules {
+		for _, name := range rule.RemoveResponseHeaders {
+			h.Del(name)
+		}
+		for name, value := range rule.AddResponseHeaders {
+			if h.Get(name) == "" {
+				h.Set(name, value)
+			}
+		}
+		for name, value := range rule.SetResponseHeaders {
+			h.Set(name, value)
+		}
+	}
+}
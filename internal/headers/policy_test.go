@@ -0,0 +1,90 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	require.NoError(t, ConfigurePolicy([]config.HeaderRule{
+		{
+			Path:               "^/",
+			AddResponseHeaders: map[string]string{"Strict-Transport-Security": "max-age=31536000"},
+		},
+		{
+			Path:                  "^/assets/",
+			SetResponseHeaders:    map[string]string{"Cache-Control": "public, max-age=31536000, immutable"},
+			RemoveResponseHeaders: []string{"Set-Cookie"},
+			SetRequestHeaders:     map[string]string{"X-Asset-Request": "true"},
+			RemoveRequestHeaders:  []string{"Cookie"},
+		},
+	}))
+	defer ConfigurePolicy(nil)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, r.URL.Path == "/assets/app.js", r.Header.Get("X-Asset-Request") == "true")
+		require.Equal(t, r.URL.Path != "/assets/app.js", r.Header.Get("Cookie") != "")
+
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Set-Cookie", "session=1")
+		if r.URL.Path == "/rails-hsts" {
+			w.Header().Set("Strict-Transport-Security", "max-age=60")
+		}
+		w.Write([]byte("ok"))
+	}
+
+	testCases := []struct {
+		path         string
+		cacheControl string
+		setCookie    string
+		hsts         string
+	}{
+		{path: "/assets/app.js", cacheControl: "public, max-age=31536000, immutable", hsts: "max-age=31536000"},
+		{path: "/api/v4/projects", cacheControl: "no-cache", setCookie: "session=1", hsts: "max-age=31536000"},
+		{path: "/rails-hsts", cacheControl: "no-cache", setCookie: "session=1", hsts: "max-age=60"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			r.Header.Set("Cookie", "session=1")
+			w := httptest.NewRecorder()
+
+			handler(ApplyPolicy(w, r, tc.path), r)
+
+			require.Equal(t, tc.cacheControl, w.Header().Get("Cache-Control"))
+			require.Equal(t, tc.setCookie, w.Header().Get("Set-Cookie"))
+			require.Equal(t, tc.hsts, w.Header().Get("Strict-Transport-Security"))
+			require.Equal(t, "ok", w.Body.String())
+		})
+	}
+}
+
+func TestApplyPolicyWithoutMatch(t *testing.T) {
+	require.NoError(t, ConfigurePolicy([]config.HeaderRule{{Path: "^/assets/"}}))
+	defer ConfigurePolicy(nil)
+
+	w := httptest.NewRecorder()
+	require.Equal(t, w, ApplyPolicy(w, httptest.NewRequest("GET", "/", nil), "/"))
+}
+
+func TestApplyPolicyFlush(t *testing.T) {
+	require.NoError(t, ConfigurePolicy([]config.HeaderRule{{Path: "^/", SetResponseHeaders: map[string]string{"X-Frame-Options": "DENY"}}}))
+	defer ConfigurePolicy(nil)
+
+	w := httptest.NewRecorder()
+	pw := ApplyPolicy(w, httptest.NewRequest("GET", "/", nil), "/")
+	pw.(http.Flusher).Flush()
+
+	require.True(t, w.Flushed)
+	require.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+}
+
+func TestConfigurePolicyInvalidPath(t *testing.T) {
+	require.Error(t, ConfigurePolicy([]config.HeaderRule{{Path: "("}}))
+}
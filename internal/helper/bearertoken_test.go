@@ -0,0 +1,42 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})
+
+	tests := []struct {
+		desc          string
+		token         string
+		authorization string
+		code          int
+	}{
+		{desc: "valid token", token: "secret", authorization: "Bearer secret", code: 200},
+		{desc: "wrong token", token: "secret", authorization: "Bearer secreT", code: 401},
+		{desc: "prefix of the token", token: "secret", authorization: "Bearer sec", code: 401},
+		{desc: "no header", token: "secret", code: 401},
+		{desc: "empty token", token: "", authorization: "Bearer ", code: 401},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			RequireBearerToken(tc.token, ok).ServeHTTP(w, r)
+
+			require.Equal(t, tc.code, w.Code)
+			if tc.code == 401 {
+				require.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// Only the latest breadcrumbs of a request are kept, like the Sentry SDKs do
+const maxBreadcrumbs = 50
+
+type breadcrumbsKey struct{}
+
+// breadcrumbs are the steps of a request, sent to Sentry with its errors
+type breadcrumbs struct {
+	mu     sync.Mutex
+	values []*sentry.Breadcrumb
+}
+
+func (b *breadcrumbs) add(c *sentry.Breadcrumb) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.values) == maxBreadcrumbs {
+		b.values = append(b.values[:0], b.values[1:]...)
+	}
+	b.values = append(b.values, c)
+}
+
+// list returns a copy, the request may still add breadcrumbs
+func (b *breadcrumbs) list() []*sentry.Breadcrumb {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*sentry.Breadcrumb(nil), b.values...)
+}
+
+// WithBreadcrumbs lets AddBreadcrumb record the steps of r
+func WithBreadcrumbs(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), breadcrumbsKey{}, &breadcrumbs{}))
+}
+
+// AddBreadcrumb records a step of the request of ctx, e.g. a call to Rails
+// or Gitaly. Errors of the request reported to Sentry show its steps. A
+// failed step has the error level.
+func AddBreadcrumb(ctx context.Context, category, message string, failed bool, data map[string]interface{}) {
+	b := breadcrumbsFromContext(ctx)
+	if b == nil {
+		return
+	}
+
+	c := &sentry.Breadcrumb{
+		Timestamp: time.Now().Unix(),
+		Category:  category,
+		Message:   message,
+		Data:      data,
+	}
+	if failed {
+		c.Level = sentry.LevelError
+	}
+	b.add(c)
+}
+
+func breadcrumbsFromContext(ctx context.Context) *breadcrumbs {
+	b, _ := ctx.Value(breadcrumbsKey{}).(*breadcrumbs)
+	return b
+}
@@ -0,0 +1,33 @@
+package helper
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreadcrumbs(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Without WithBreadcrumbs nothing is recorded
+	AddBreadcrumb(r.Context(), "gitaly", "/gitaly.RefService/FindDefaultBranchName", false, nil)
+	require.Nil(t, breadcrumbsFromContext(r.Context()))
+
+	r = WithBreadcrumbs(r)
+	b := breadcrumbsFromContext(r.Context())
+	require.Empty(t, b.list())
+
+	for i := 0; i < maxBreadcrumbs+1; i++ {
+		AddBreadcrumb(r.Context(), "gitaly", fmt.Sprintf("rpc%d", i), i == maxBreadcrumbs, map[string]interface{}{"code": "OK"})
+	}
+
+	values := b.list()
+	require.Len(t, values, maxBreadcrumbs)
+	require.Equal(t, "rpc1", values[0].Message, "the oldest breadcrumb is dropped")
+	require.Equal(t, sentry.Level(""), values[0].Level)
+	require.Equal(t, fmt.Sprintf("rpc%d", maxBreadcrumbs), values[maxBreadcrumbs-1].Message)
+	require.Equal(t, sentry.LevelError, values[maxBreadcrumbs-1].Level)
+}
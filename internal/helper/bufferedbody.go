@@ -0,0 +1,81 @@
+package helper
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// BufferedBody is a request body read by ReadRequestBodyBuffered. Up to a
+// limit it is kept in memory, beyond it in a temporary file, which Close
+// removes.
+type BufferedBody struct {
+	io.ReadSeeker
+	size int64
+	file *os.File
+}
+
+// Size is the length of the body in bytes
+func (b *BufferedBody) Size() int64 {
+	return b.size
+}
+
+// OnDisk tells if the body was spilled to a temporary file
+func (b *BufferedBody) OnDisk() bool {
+	return b.file != nil
+}
+
+// Close releases the temporary file of the body, if any
+func (b *BufferedBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
+
+// ReadRequestBodyBuffered reads the body of r up to maxBodySize like
+// ReadRequestBody, but keeps at most memoryLimit bytes of it in memory.
+// The caller must close the body.
+func ReadRequestBodyBuffered(w http.ResponseWriter, r *http.Request, maxBodySize, memoryLimit int64) (*BufferedBody, error) {
+	limitedBody := http.MaxBytesReader(w, r.Body, maxBodySize)
+	defer limitedBody.Close()
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, limitedBody, memoryLimit+1)
+	if err == io.EOF || (err == nil && n <= memoryLimit) {
+		return &BufferedBody{ReadSeeker: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The body is larger than memoryLimit, so spill it to disk
+	file, err := ReadAllTempfile(io.MultiReader(&buf, limitedBody))
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &BufferedBody{ReadSeeker: file, size: size, file: file}, nil
+}
+
+// CloneRequestWithBufferedBody is CloneRequestWithNewBody for a body read
+// by ReadRequestBodyBuffered. The caller closes body once the request is
+// served.
+func CloneRequestWithBufferedBody(r *http.Request, body *BufferedBody) *http.Request {
+	newReq := *r
+	newReq.Body = ioutil.NopCloser(body)
+	newReq.Header = HeaderClone(r.Header)
+	newReq.ContentLength = body.Size()
+	return &newReq
+}
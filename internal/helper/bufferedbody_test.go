@@ -0,0 +1,82 @@
+package helper
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readBuffered(t *testing.T, data []byte, maxBodySize, memoryLimit int64) (*BufferedBody, error) {
+	rw := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/test", bytes.NewReader(data))
+	require.NoError(t, err)
+
+	return ReadRequestBodyBuffered(rw, req, maxBodySize, memoryLimit)
+}
+
+func TestReadRequestBodyBuffered(t *testing.T) {
+	tests := []struct {
+		name        string
+		memoryLimit int64
+		onDisk      bool
+	}{
+		{name: "in memory", memoryLimit: 100},
+		{name: "exactly the memory limit", memoryLimit: 6},
+		{name: "spilled to disk", memoryLimit: 2, onDisk: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := []byte("123456")
+			body, err := readBuffered(t, data, 1000, tc.memoryLimit)
+			require.NoError(t, err)
+			defer body.Close()
+
+			require.Equal(t, tc.onDisk, body.OnDisk())
+			require.Equal(t, int64(len(data)), body.Size())
+
+			result, err := ioutil.ReadAll(body)
+			require.NoError(t, err)
+			require.Equal(t, data, result)
+
+			// The body can be read again, e.g. after parsing it
+			_, err = body.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			result, err = ioutil.ReadAll(body)
+			require.NoError(t, err)
+			require.Equal(t, data, result)
+		})
+	}
+}
+
+func TestReadRequestBodyBufferedLimit(t *testing.T) {
+	_, err := readBuffered(t, []byte("123456"), 2, 1)
+	require.Error(t, err)
+
+	_, err = readBuffered(t, []byte("123456"), 4, 100)
+	require.Error(t, err)
+}
+
+func TestCloneRequestWithBufferedBody(t *testing.T) {
+	body, err := readBuffered(t, []byte("new body"), 1000, 2)
+	require.NoError(t, err)
+	defer body.Close()
+
+	req, err := http.NewRequest("POST", "/test", bytes.NewBufferString("test"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	newReq := CloneRequestWithBufferedBody(req, body)
+	require.NotEqual(t, req, newReq)
+	require.Equal(t, int64(8), newReq.ContentLength)
+	require.Equal(t, "application/json", newReq.Header.Get("Content-Type"))
+
+	result, err := ioutil.ReadAll(newReq.Body)
+	require.NoError(t, err)
+	require.Equal(t, "new body", string(result))
+}
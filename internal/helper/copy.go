@@ -0,0 +1,86 @@
+package helper
+
+import (
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+const copyBufferSize = 32 * 1024
+
+type bufferPool struct {
+	pool sync.Pool
+	size int
+}
+
+// BufferPool holds the buffers response bodies are copied with, so that
+// large downloads don't allocate 32KB per request. It can be used as the
+// BufferPool of a httputil.ReverseProxy.
+var BufferPool = NewBufferPool(copyBufferSize)
+
+// NewBufferPool returns a pool of buffers of size bytes
+func NewBufferPool(size int) httputil.BufferPool {
+	return &bufferPool{size: size}
+}
+
+func (p *bufferPool) Get() []byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return make([]byte, p.size)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	if cap(buf) < p.size {
+		return
+	}
+	buf = buf[:p.size]
+	p.pool.Put(&buf)
+}
+
+// Copy copies src to dst like io.Copy. If dst is an io.ReaderFrom, like
+// the response writer of net/http which uses sendfile for files, it reads
+// src itself. Otherwise the copy goes through a buffer of BufferPool.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := dst.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+
+	return CopyWithPool(dst, src, BufferPool)
+}
+
+// CopyWithPool copies src to dst through a buffer of pool. It doesn't use
+// the io.ReaderFrom of dst or the io.WriterTo of src, which may allocate
+// buffers of their own: *os.File does for instance.
+func CopyWithPool(dst io.Writer, src io.Reader, pool httputil.BufferPool) (int64, error) {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+}
+
+type readerOnly struct {
+	io.Reader
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerFromResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w readerFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	return Copy(w.ResponseWriter, src)
+}
+
+// WithPooledCopy makes the copies of code we don't control, like
+// http.ServeContent, use Copy when writing to w
+func WithPooledCopy(w http.ResponseWriter) http.ResponseWriter {
+	if _, ok := w.(io.ReaderFrom); ok {
+		return w
+	}
+	return readerFromResponseWriter{w}
+}
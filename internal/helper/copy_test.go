@@ -0,0 +1,124 @@
+package helper
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type readerFromRecorder struct {
+	bytes.Buffer
+	readFrom bool
+}
+
+func (w *readerFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return w.Buffer.ReadFrom(r)
+}
+
+// plainWriter hides the io.ReaderFrom of bytes.Buffer
+type plainWriter struct {
+	w io.Writer
+}
+
+func (w plainWriter) Write(p []byte) (int, error) { return w.w.Write(p) }
+
+func TestCopyUsesReaderFrom(t *testing.T) {
+	dst := &readerFromRecorder{}
+
+	n, err := Copy(dst, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	require.True(t, dst.readFrom)
+	require.Equal(t, "hello", dst.String())
+}
+
+func TestCopyFromFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	file := tempFileWith(t, data)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	var buf bytes.Buffer
+	n, err := Copy(plainWriter{&buf}, file)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf.Bytes())
+}
+
+func TestBufferPool(t *testing.T) {
+	buf := BufferPool.Get()
+	require.Len(t, buf, copyBufferSize)
+	BufferPool.Put(buf[:10])
+
+	require.Len(t, BufferPool.Get(), copyBufferSize)
+
+	// Too small to be pooled
+	BufferPool.Put(make([]byte, 10))
+	require.Len(t, BufferPool.Get(), copyBufferSize)
+}
+
+func TestWithPooledCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	file := tempFileWith(t, data)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	rec := httptest.NewRecorder()
+	w := WithPooledCopy(rec)
+	_, ok := w.(io.ReaderFrom)
+	require.True(t, ok)
+
+	r := httptest.NewRequest("GET", "/file", nil)
+	r.Header.Set("Range", "bytes=10-19")
+	http.ServeContent(w, r, "", time.Now(), file)
+
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "0123456789", rec.Body.String())
+}
+
+func tempFileWith(t testing.TB, data []byte) *os.File {
+	file, err := ioutil.TempFile("", "copy-test")
+	require.NoError(t, err)
+	_, err = file.Write(data)
+	require.NoError(t, err)
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	return file
+}
+
+func benchmarkCopy(b *testing.B, copy func(io.Writer, io.Reader) (int64, error)) {
+	data := bytes.Repeat([]byte("x"), 4*1024*1024)
+	file := tempFileWith(b, data)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := copy(plainWriter{ioutil.Discard}, file); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIOCopy(b *testing.B) {
+	benchmarkCopy(b, io.Copy)
+}
+
+func BenchmarkCopy(b *testing.B) {
+	benchmarkCopy(b, Copy)
+}
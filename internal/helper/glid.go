@@ -0,0 +1,32 @@
+package helper
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+type glIDKey struct{}
+
+// WithGLID lets SetGLID record the GitLab user of r, which Rails only
+// tells once r is pre-authorized
+func WithGLID(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), glIDKey{}, &atomic.Value{}))
+}
+
+// SetGLID records glID, e.g. user-42, as the user of the request of ctx
+func SetGLID(ctx context.Context, glID string) {
+	if v, ok := ctx.Value(glIDKey{}).(*atomic.Value); ok {
+		v.Store(glID)
+	}
+}
+
+// GLID returns the user of the request of ctx, or "" if it is not known
+func GLID(ctx context.Context) string {
+	v, ok := ctx.Value(glIDKey{}).(*atomic.Value)
+	if !ok {
+		return ""
+	}
+	glID, _ := v.Load().(string)
+	return glID
+}
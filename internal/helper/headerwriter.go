@@ -0,0 +1,65 @@
+package helper
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+type headerRewritingResponseWriter struct {
+	rw          http.ResponseWriter
+	rewrite     func(http.Header)
+	wroteHeader bool
+}
+
+// NewHeaderRewritingResponseWriter returns a ResponseWriter that calls
+// rewrite on the response headers just before they are sent. Handlers
+// behind it can still flush, and hijack if rw can.
+func NewHeaderRewritingResponseWriter(rw http.ResponseWriter, rewrite func(http.Header)) http.ResponseWriter {
+	w := &headerRewritingResponseWriter{rw: rw, rewrite: rewrite}
+	if _, ok := rw.(http.Hijacker); ok {
+		return &hijackingHeaderRewritingResponseWriter{w}
+	}
+	return w
+}
+
+func (w *headerRewritingResponseWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *headerRewritingResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.rw.Write(data)
+}
+
+func (w *headerRewritingResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.rewrite(w.rw.Header())
+	}
+	w.rw.WriteHeader(status)
+}
+
+func (w *headerRewritingResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *headerRewritingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
+
+type hijackingHeaderRewritingResponseWriter struct {
+	*headerRewritingResponseWriter
+}
+
+func (h *hijackingHeaderRewritingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.rw.(http.Hijacker).Hijack()
+}
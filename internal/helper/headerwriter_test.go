@@ -0,0 +1,33 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRewritingResponseWriter(t *testing.T) {
+	calls := 0
+	rec := httptest.NewRecorder()
+	w := NewHeaderRewritingResponseWriter(rec, func(h http.Header) {
+		calls++
+		h.Set("X-Rewritten", h.Get("X-Original"))
+	})
+
+	w.Header().Set("X-Original", "yes")
+	_, err := w.Write([]byte("a"))
+	require.NoError(t, err)
+	w.(http.Flusher).Flush()
+	_, err = w.Write([]byte("b"))
+	require.NoError(t, err)
+
+	require.Equal(t, 1, calls, "headers are rewritten once")
+	require.Equal(t, "yes", rec.Header().Get("X-Rewritten"))
+	require.Equal(t, "ab", rec.Body.String())
+	require.True(t, rec.Flushed)
+
+	_, hijacker := w.(http.Hijacker)
+	require.False(t, hijacker, "the recorder can't be hijacked")
+}
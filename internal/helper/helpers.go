@@ -20,13 +20,17 @@ import (
 
 const NginxResponseBufferHeader = "X-Accel-Buffering"
 
+// StatusClientClosedRequest is the status NGINX logs for requests whose
+// client went away before the response
+const StatusClientClosedRequest = 499
+
 func LogError(r *http.Request, err error) {
 	LogErrorWithFields(r, err, nil)
 }
 
 func LogErrorWithFields(r *http.Request, err error, fields log.Fields) {
 	if err != nil {
-		captureRavenError(r, err, fields)
+		captureSentryError(r, err, fields)
 	}
 
 	printError(r, err, fields)
@@ -45,6 +49,16 @@ func RequestEntityTooLarge(w http.ResponseWriter, r *http.Request, err error) {
 	CaptureAndFail(w, r, err, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
 }
 
+// ClientClosedRequest logs err when the client went away. Nobody reads
+// the response, and it is no error of Workhorse to report.
+func ClientClosedRequest(w http.ResponseWriter, r *http.Request, err error) {
+	w.WriteHeader(StatusClientClosedRequest)
+	log.WithContextFields(r.Context(), log.Fields{
+		"method": r.Method,
+		"uri":    mask.URL(r.RequestURI),
+	}).WithError(err).Info("client closed request")
+}
+
 func printError(r *http.Request, err error, fields log.Fields) {
 	if r != nil {
 		entry := log.WithContextFields(r.Context(), log.Fields{
@@ -157,12 +171,27 @@ func AllowResponseBuffering(w http.ResponseWriter) {
 	w.Header().Del(NginxResponseBufferHeader)
 }
 
+// FixRemoteAddr replaces the remote address of r with the client address
+// from X-Forwarded-For. If trusted proxies are configured the header is
+// only used when the peer is one of them. Otherwise the xff package picks
+// the first public address from the header.
 func FixRemoteAddr(r *http.Request) {
+	trustedProxiesMu.RLock()
+	nets := trustedProxies
+	trustedProxiesMu.RUnlock()
+
 	// Unix domain sockets have a remote addr of @. This will make the
 	// xff package lookup the X-Forwarded-For address if available.
-	if r.RemoteAddr == "@" {
+	unixSocket := r.RemoteAddr == "@"
+	if unixSocket {
 		r.RemoteAddr = "127.0.0.1:0"
 	}
+
+	if len(nets) > 0 {
+		r.RemoteAddr = remoteAddrBehindTrustedProxies(r, nets, unixSocket)
+		return
+	}
+
 	r.RemoteAddr = xff.GetRemoteAddr(r)
 }
 
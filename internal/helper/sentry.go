@@ -0,0 +1,245 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/getsentry/sentry-go"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/log"
+	"gitlab.com/gitlab-org/labkit/mask"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	sentryBodyNone     = "none"
+	sentryBodyMetadata = "metadata"
+	sentryBodyForm     = "form"
+
+	// sentryCorrelationExtraKey is where the correlation ID was sent with
+	// raven-go, kept so that existing Sentry searches still work
+	sentryCorrelationExtraKey = "gitlab.CorrelationID"
+)
+
+var sentryHeaderBlacklist = []string{
+	"Authorization",
+	"Private-Token",
+}
+
+// sentryRules are the configurable parts of what is sent to Sentry
+type sentryRules struct {
+	headers          []string
+	queryParams      []*regexp.Regexp
+	body             string
+	errorSampleRates map[string]float64
+}
+
+var (
+	sentryRulesMu         sync.RWMutex
+	configuredSentryRules = sentryRules{headers: sentryHeaderBlacklist, body: sentryBodyNone}
+)
+
+type routeClassKey struct{}
+
+// ConfigureErrorReporting sets which parts of requests are sent to Sentry
+// with their errors, and which share of the errors of each route class
+func ConfigureErrorReporting(cfg config.ErrorReportingConfig) error {
+	rules := sentryRules{
+		headers: append(append([]string{}, sentryHeaderBlacklist...), cfg.ScrubHeaders...),
+		body:    cfg.Body,
+	}
+
+	for _, param := range cfg.ScrubQueryParams {
+		re, err := regexp.Compile(param)
+		if err != nil {
+			return fmt.Errorf("error reporting: ScrubQueryParams %q: %v", param, err)
+		}
+		rules.queryParams = append(rules.queryParams, re)
+	}
+
+	switch rules.body {
+	case "":
+		rules.body = sentryBodyNone
+	case sentryBodyNone, sentryBodyMetadata, sentryBodyForm:
+	default:
+		return fmt.Errorf("error reporting: unknown Body %q", cfg.Body)
+	}
+
+	for class, rate := range cfg.ErrorSampleRates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("error reporting: ErrorSampleRates %q: %v is not between 0 and 1", class, rate)
+		}
+	}
+	rules.errorSampleRates = cfg.ErrorSampleRates
+
+	sentryRulesMu.Lock()
+	defer sentryRulesMu.Unlock()
+	configuredSentryRules = rules
+
+	return nil
+}
+
+func currentSentryRules() sentryRules {
+	sentryRulesMu.RLock()
+	defer sentryRulesMu.RUnlock()
+	return configuredSentryRules
+}
+
+// WithRouteClass tells error reporting which class of route serves r, to
+// sample its errors
+func WithRouteClass(r *http.Request, class string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeClassKey{}, class))
+}
+
+func routeClassFromContext(ctx context.Context) string {
+	class, _ := ctx.Value(routeClassKey{}).(string)
+	return class
+}
+
+// sampled decides with roll, a random number in [0, 1), whether an error
+// of a route of class is reported. Classes without a rate are all
+// reported.
+func (rules sentryRules) sampled(class string, roll float64) bool {
+	rate, ok := rules.errorSampleRates[class]
+	return !ok || roll < rate
+}
+
+func captureSentryError(r *http.Request, err error, fields log.Fields) {
+	event := sentry.NewEvent()
+	event.Level = sentry.LevelError
+	event.Message = err.Error()
+	event.Exception = []sentry.Exception{{
+		Type:       reflect.TypeOf(err).String(),
+		Value:      err.Error(),
+		Stacktrace: sentry.NewStacktrace(),
+	}}
+
+	for k, v := range fields {
+		event.Extra[k] = v
+	}
+
+	if r != nil {
+		rules := currentSentryRules()
+		if !rules.sampled(routeClassFromContext(r.Context()), rand.Float64()) {
+			return
+		}
+
+		event.Request = newSentryRequest(r, rules)
+		if correlationID := correlation.ExtractFromContext(r.Context()); correlationID != "" {
+			event.Tags["correlation_id"] = correlationID
+			event.Extra[sentryCorrelationExtraKey] = correlationID
+		}
+		if b := breadcrumbsFromContext(r.Context()); b != nil {
+			event.Breadcrumbs = b.list()
+		}
+	}
+
+	sentry.CaptureEvent(event)
+}
+
+// newSentryRequest describes r to Sentry. The request may still be in use,
+// so it is scrubbed on a copy.
+func newSentryRequest(r *http.Request, rules sentryRules) sentry.Request {
+	scrubbed := *r
+	scrubbed.Header = HeaderClone(r.Header)
+	u := *r.URL
+	scrubbed.URL = &u
+	// Bodies are never read for Sentry
+	scrubbed.GetBody = nil
+	scrubSentryRequest(&scrubbed, rules)
+
+	request := sentry.Request{}.FromHTTPRequest(&scrubbed)
+	request.Data = sentryBody(r, rules)
+	return request
+}
+
+func scrubSentryRequest(r *http.Request, rules sentryRules) {
+	for _, key := range rules.headers {
+		if r.Header.Get(key) != "" {
+			r.Header.Set(key, "[redacted]")
+		}
+	}
+
+	if r.URL != nil && r.URL.RawQuery != "" {
+		r.URL.RawQuery = scrubValues(r.URL.Query(), rules).Encode()
+	}
+}
+
+func isSensitiveParam(name string, rules sentryRules) bool {
+	if mask.IsSensitiveParam(name) {
+		return true
+	}
+
+	for _, re := range rules.queryParams {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func scrubValues(values url.Values, rules sentryRules) url.Values {
+	scrubbed := make(url.Values, len(values))
+	for name, v := range values {
+		if isSensitiveParam(name, rules) {
+			scrubbed[name] = []string{mask.RedactionString}
+		} else {
+			scrubbed[name] = v
+		}
+	}
+	return scrubbed
+}
+
+// sentryBody never reads the body, only what has been parsed already is
+// sent, as JSON
+func sentryBody(r *http.Request, rules sentryRules) string {
+	var data map[string]string
+
+	switch rules.body {
+	case sentryBodyMetadata:
+		data = map[string]string{
+			"content_type":   r.Header.Get("Content-Type"),
+			"content_length": strconv.FormatInt(r.ContentLength, 10),
+		}
+
+	case sentryBodyForm:
+		form := url.Values{}
+		for name, v := range r.PostForm {
+			form[name] = v
+		}
+		if r.MultipartForm != nil {
+			for name, v := range r.MultipartForm.Value {
+				form[name] = v
+			}
+		}
+		if len(form) == 0 {
+			return ""
+		}
+
+		data = make(map[string]string, len(form))
+		for name, v := range scrubValues(form, rules) {
+			data[name] = strings.Join(v, ",")
+		}
+	}
+
+	if data == nil {
+		return ""
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return ""
+	}
+	return string(body)
+}
@@ -0,0 +1,164 @@
+package helper
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+type fakeSentryTransport struct {
+	events []*sentry.Event
+}
+
+func (t *fakeSentryTransport) Configure(sentry.ClientOptions) {}
+func (t *fakeSentryTransport) Flush(time.Duration) bool       { return true }
+func (t *fakeSentryTransport) SendEvent(event *sentry.Event)  { t.events = append(t.events, event) }
+
+// withFakeSentry makes the current hub send events to the returned
+// transport, and returns a function to restore the hub
+func withFakeSentry(t *testing.T) (*fakeSentryTransport, func()) {
+	transport := &fakeSentryTransport{}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:          "https://key@sentry.example.com/1",
+		Transport:    transport,
+		Integrations: func([]sentry.Integration) []sentry.Integration { return nil },
+	})
+	require.NoError(t, err)
+
+	hub := sentry.CurrentHub()
+	previous := hub.Client()
+	hub.BindClient(client)
+	return transport, func() { hub.BindClient(previous) }
+}
+
+func TestSentryRequestScrubsRequestCopy(t *testing.T) {
+	require.NoError(t, ConfigureErrorReporting(config.ErrorReportingConfig{
+		ScrubHeaders:     []string{"Cookie"},
+		ScrubQueryParams: []string{`^ref$`},
+	}))
+	defer ConfigureErrorReporting(config.ErrorReportingConfig{})
+
+	r := httptest.NewRequest("GET", "/api/v4/projects?private_token=abc&ref=master&page=2", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	r.Header.Set("Cookie", "_gitlab_session=abc")
+	r.Header.Set("Accept", "application/json")
+
+	h := newSentryRequest(r, currentSentryRules())
+
+	require.Equal(t, "[redacted]", h.Headers["Authorization"])
+	require.Equal(t, "[redacted]", h.Headers["Cookie"])
+	require.Equal(t, "[redacted]", h.Cookies)
+	require.Equal(t, "application/json", h.Headers["Accept"])
+
+	query, err := url.ParseQuery(h.QueryString)
+	require.NoError(t, err)
+	require.Equal(t, "[FILTERED]", query.Get("private_token"), "logs filter it too")
+	require.Equal(t, "[FILTERED]", query.Get("ref"))
+	require.Equal(t, "2", query.Get("page"))
+	require.Empty(t, h.Data)
+
+	require.Equal(t, "Bearer abc", r.Header.Get("Authorization"), "the request may still be in use")
+	require.Equal(t, "master", r.URL.Query().Get("ref"))
+}
+
+func TestSentryRequestBody(t *testing.T) {
+	body := "user[login]=root&user[password]=secret"
+	r := httptest.NewRequest("POST", "/users/sign_in", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	require.NoError(t, r.ParseForm())
+
+	require.Empty(t, newSentryRequest(r, currentSentryRules()).Data, "bodies are not sent by default")
+
+	require.NoError(t, ConfigureErrorReporting(config.ErrorReportingConfig{Body: "metadata"}))
+	defer ConfigureErrorReporting(config.ErrorReportingConfig{})
+	require.JSONEq(t, `{"content_type":"application/x-www-form-urlencoded","content_length":"38"}`, newSentryRequest(r, currentSentryRules()).Data)
+
+	require.NoError(t, ConfigureErrorReporting(config.ErrorReportingConfig{Body: "form"}))
+	require.JSONEq(t, `{"user[login]":"root","user[password]":"[FILTERED]"}`, newSentryRequest(r, currentSentryRules()).Data)
+
+	r = httptest.NewRequest("POST", "/users/sign_in", strings.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader(body)), nil }
+	require.Empty(t, newSentryRequest(r, currentSentryRules()).Data, "unparsed bodies are never read")
+}
+
+func TestConfigureErrorReportingRejectsInvalidRules(t *testing.T) {
+	require.Error(t, ConfigureErrorReporting(config.ErrorReportingConfig{ScrubQueryParams: []string{"("}}))
+	require.Error(t, ConfigureErrorReporting(config.ErrorReportingConfig{Body: "everything"}))
+	require.Error(t, ConfigureErrorReporting(config.ErrorReportingConfig{ErrorSampleRates: map[string]float64{"git": 1.5}}))
+	require.Error(t, ConfigureErrorReporting(config.ErrorReportingConfig{ErrorSampleRates: map[string]float64{"git": -0.1}}))
+}
+
+func TestSentrySampling(t *testing.T) {
+	require.NoError(t, ConfigureErrorReporting(config.ErrorReportingConfig{
+		ErrorSampleRates: map[string]float64{"git": 0.25, "api": 0},
+	}))
+	defer ConfigureErrorReporting(config.ErrorReportingConfig{})
+	rules := currentSentryRules()
+
+	tests := []struct {
+		class   string
+		roll    float64
+		sampled bool
+	}{
+		{class: "git", roll: 0, sampled: true},
+		{class: "git", roll: 0.2, sampled: true},
+		{class: "git", roll: 0.25, sampled: false},
+		{class: "git", roll: 0.9, sampled: false},
+		{class: "api", roll: 0, sampled: false},
+		{class: "uploads", roll: 0.99, sampled: true},
+		{class: "", roll: 0.99, sampled: true},
+	}
+
+	for _, tc := range tests {
+		require.Equal(t, tc.sampled, rules.sampled(tc.class, tc.roll), "class %q, roll %v", tc.class, tc.roll)
+	}
+}
+
+func TestCaptureSentryError(t *testing.T) {
+	transport, restore := withFakeSentry(t)
+	defer restore()
+
+	require.NoError(t, ConfigureErrorReporting(config.ErrorReportingConfig{
+		ErrorSampleRates: map[string]float64{"uploads": 0},
+	}))
+	defer ConfigureErrorReporting(config.ErrorReportingConfig{})
+
+	r := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-upload-pack", nil)
+	r = r.WithContext(correlation.ContextWithCorrelation(r.Context(), "abc123"))
+	r = WithRouteClass(WithBreadcrumbs(r), "git")
+	AddBreadcrumb(r.Context(), "rails", "preauthorization", false, map[string]interface{}{"status_code": 200})
+	AddBreadcrumb(r.Context(), "gitaly", "/gitaly.SmartHTTPService/InfoRefsUploadPack", true, nil)
+
+	captureSentryError(r, errors.New("boom"), log.Fields{"path": "info/refs"})
+
+	require.Len(t, transport.events, 1)
+	event := transport.events[0]
+	require.Equal(t, "boom", event.Message)
+	require.Equal(t, "boom", event.Exception[0].Value)
+	require.NotNil(t, event.Exception[0].Stacktrace)
+	require.Equal(t, "abc123", event.Tags["correlation_id"])
+	require.Equal(t, "abc123", event.Extra["gitlab.CorrelationID"])
+	require.Equal(t, "info/refs", event.Extra["path"])
+	require.Equal(t, "service=git-upload-pack", event.Request.QueryString)
+
+	require.Len(t, event.Breadcrumbs, 2)
+	require.Equal(t, "rails", event.Breadcrumbs[0].Category)
+	require.Equal(t, "preauthorization", event.Breadcrumbs[0].Message)
+	require.Equal(t, "/gitaly.SmartHTTPService/InfoRefsUploadPack", event.Breadcrumbs[1].Message)
+	require.Equal(t, sentry.LevelError, event.Breadcrumbs[1].Level)
+
+	captureSentryError(WithRouteClass(r, "uploads"), errors.New("boom"), nil)
+	require.Len(t, transport.events, 1, "errors of uploads are not sampled")
+}
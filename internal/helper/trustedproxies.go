@@ -0,0 +1,101 @@
+package helper
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   []*net.IPNet
+)
+
+// ConfigureTrustedProxies sets the networks of proxies whose
+// X-Forwarded-For header is trusted by FixRemoteAddr. With an empty list
+// FixRemoteAddr keeps its legacy behaviour.
+func ConfigureTrustedProxies(cidrs []string) error {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("trusted proxy %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	trustedProxiesMu.Lock()
+	defer trustedProxiesMu.Unlock()
+	trustedProxies = nets
+
+	return nil
+}
+
+// IsTrustedPeer tells if r was sent by a trusted proxy, or over the Unix
+// socket. It must be called before FixRemoteAddr.
+func IsTrustedPeer(r *http.Request) bool {
+	if r.RemoteAddr == "@" {
+		return true
+	}
+
+	trustedProxiesMu.RLock()
+	nets := trustedProxies
+	trustedProxiesMu.RUnlock()
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	peer := net.ParseIP(host)
+	return peer != nil && isTrustedProxy(peer, nets)
+}
+
+func isTrustedProxy(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddrBehindTrustedProxies walks the X-Forwarded-For chain from
+// right to left and returns the first address that is not a trusted
+// proxy. Entries left of it were added by the client and can't be
+// trusted.
+// Only local processes can connect to our Unix socket, so a peer on
+// unixSocket is always trusted.
+func remoteAddrBehindTrustedProxies(r *http.Request, nets []*net.IPNet, unixSocket bool) string {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	if peer := net.ParseIP(host); !unixSocket && (peer == nil || !isTrustedProxy(peer, nets)) {
+		return r.RemoteAddr
+	}
+
+	var chain []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		chain = append(chain, strings.Split(h, ",")...)
+	}
+
+	client := ""
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(chain[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !isTrustedProxy(ip, nets) {
+			break
+		}
+	}
+
+	if client == "" {
+		return r.RemoteAddr
+	}
+	return net.JoinHostPort(client, port)
+}
@@ -0,0 +1,68 @@
+package helper
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureTrustedProxiesInvalidCIDR(t *testing.T) {
+	require.Error(t, ConfigureTrustedProxies([]string{"10.0.0.0/33"}))
+}
+
+func TestFixRemoteAddrWithTrustedProxies(t *testing.T) {
+	require.NoError(t, ConfigureTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"}))
+	defer ConfigureTrustedProxies(nil)
+
+	testCases := []struct {
+		desc      string
+		initial   string
+		forwarded []string
+		expected  string
+	}{
+		{desc: "no header", initial: "10.0.0.1:1234", expected: "10.0.0.1:1234"},
+		{desc: "single proxy", initial: "10.0.0.1:1234", forwarded: []string{"18.245.0.1"}, expected: "18.245.0.1:1234"},
+		{desc: "untrusted peer", initial: "18.245.0.2:1234", forwarded: []string{"18.245.0.1"}, expected: "18.245.0.2:1234"},
+		{desc: "multiple proxies", initial: "10.0.0.1:1234", forwarded: []string{"18.245.0.1, 10.0.0.3, 10.0.0.2"}, expected: "18.245.0.1:1234"},
+		{desc: "multiple headers", initial: "10.0.0.1:1234", forwarded: []string{"18.245.0.1", "10.0.0.2"}, expected: "18.245.0.1:1234"},
+		{desc: "spoofed by client", initial: "10.0.0.1:1234", forwarded: []string{"1.1.1.1, 18.245.0.1, 10.0.0.2"}, expected: "18.245.0.1:1234"},
+		{desc: "private client address", initial: "10.0.0.1:1234", forwarded: []string{"192.168.0.1"}, expected: "192.168.0.1:1234"},
+		{desc: "all proxies trusted", initial: "10.0.0.1:1234", forwarded: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3:1234"},
+		{desc: "invalid entry", initial: "10.0.0.1:1234", forwarded: []string{"garbage, 18.245.0.1"}, expected: "18.245.0.1:1234"},
+		{desc: "IPv6", initial: "[2001:db8::1]:1234", forwarded: []string{"2001:db9::1"}, expected: "[2001:db9::1]:1234"},
+		{desc: "unix socket", initial: "@", forwarded: []string{"18.245.0.1, 10.0.0.2"}, expected: "18.245.0.1:0"},
+		{desc: "unix socket without header", initial: "@", expected: "127.0.0.1:0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.initial
+			for _, f := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", f)
+			}
+
+			FixRemoteAddr(req)
+
+			require.Equal(t, tc.expected, req.RemoteAddr)
+		})
+	}
+}
+
+func TestIsTrustedPeer(t *testing.T) {
+	require.NoError(t, ConfigureTrustedProxies([]string{"10.0.0.0/8"}))
+	defer ConfigureTrustedProxies(nil)
+
+	for remoteAddr, trusted := range map[string]bool{
+		"10.0.0.1:1234":    true,
+		"18.245.0.1:1234":  false,
+		"@":                true,
+		"not an address":   false,
+		"[2001:db8::1]:80": false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		require.Equal(t, trusted, IsTrustedPeer(req), remoteAddr)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+In this file we fill in the hrefs of git LFS batch responses, so that Rails
+only decides which objects a client may transfer and not how
+*/
+
+package lfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/senddata"
+)
+
+const (
+	// TokenParam is the query parameter of the hrefs that holds the JWT
+	// authorizing the transfer of the object
+	TokenParam = "lfs_token"
+
+	batchContentType = "application/vnd.git-lfs+json"
+	defaultExpiresIn = time.Hour
+)
+
+type batch struct{ senddata.Prefix }
+
+// SendBatch writes the batch response Rails sent in the send-data header
+var SendBatch = &batch{"lfs-batch:"}
+
+type batchParams struct {
+	// Operation is "download" or "upload"
+	Operation string
+	// Transfer is the transfer adapter. Defaults to "basic".
+	Transfer string
+	// Objects are the objects of the response as Rails would send them
+	Objects []*batchObject
+	// Sign are the oids of the objects that get an href for Operation
+	Sign []string
+	// Href is the URL the oid, and for uploads the size, of each object
+	// are appended to
+	Href string
+	// Header are the headers the client sends with each transfer
+	Header map[string]string
+	// ExpiresIn is how many seconds the hrefs are valid. Defaults to one
+	// hour.
+	ExpiresIn int64
+	// Destination is the object_storage section the objects are in. If it
+	// is set, the hrefs are presigned URLs of the objects instead of Href.
+	Destination string
+	// KeyPrefix is where the objects are in the bucket of Destination,
+	// like "lfs-objects/"
+	KeyPrefix string
+}
+
+type batchObject struct {
+	Oid           string                  `json:"oid"`
+	Size          int64                   `json:"size"`
+	Authenticated bool                    `json:"authenticated,omitempty"`
+	Actions       map[string]*batchAction `json:"actions,omitempty"`
+	Error         json.RawMessage         `json:"error,omitempty"`
+}
+
+type batchAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int64             `json:"expires_in,omitempty"`
+}
+
+type batchResponse struct {
+	Transfer string         `json:"transfer"`
+	Objects  []*batchObject `json:"objects"`
+}
+
+// objectClaims authorize a single operation on an object. Rails checks
+// them instead of the credentials of the client.
+type objectClaims struct {
+	Operation string `json:"operation"`
+	Oid       string `json:"oid"`
+	Size      int64  `json:"size"`
+	jwt.StandardClaims
+}
+
+var batchSignedHrefs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_lfs_batch_signed_hrefs",
+		Help: "How many hrefs of LFS batch responses gitlab-workhorse made, by operation",
+	},
+	[]string{"operation"},
+)
+
+func init() {
+	prometheus.MustRegister(batchSignedHrefs)
+}
+
+func (b *batch) Inject(w http.ResponseWriter, r *http.Request, sendData string) {
+	var params batchParams
+	if err := b.Unpack(&params, sendData); err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBatch: unpack sendData: %v", err))
+		return
+	}
+
+	response, err := params.response(time.Now())
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBatch: %v", err))
+		return
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		helper.Fail500(w, r, fmt.Errorf("SendBatch: marshal response: %v", err))
+		return
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", batchContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (params *batchParams) response(now time.Time) (*batchResponse, error) {
+	if params.Operation != "download" && params.Operation != "upload" {
+		return nil, fmt.Errorf("unknown operation %q", params.Operation)
+	}
+	if params.Href == "" && params.Destination == "" && len(params.Sign) > 0 {
+		return nil, fmt.Errorf("Href is empty")
+	}
+
+	expiresIn := defaultExpiresIn
+	if params.ExpiresIn > 0 {
+		expiresIn = time.Duration(params.ExpiresIn) * time.Second
+	}
+
+	sign := make(map[string]bool)
+	for _, oid := range params.Sign {
+		sign[oid] = true
+	}
+
+	for _, object := range params.Objects {
+		if !sign[object.Oid] || object.Error != nil {
+			continue
+		}
+
+		var href string
+		var err error
+		if params.Destination != "" {
+			href, err = params.presignedHref(object, expiresIn)
+		} else {
+			href, err = params.href(object, now.Add(expiresIn))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if object.Actions == nil {
+			object.Actions = make(map[string]*batchAction)
+		}
+		object.Actions[params.Operation] = &batchAction{
+			Href:      href,
+			Header:    params.Header,
+			ExpiresIn: int64(expiresIn / time.Second),
+		}
+		batchSignedHrefs.WithLabelValues(params.Operation).Inc()
+	}
+
+	transfer := params.Transfer
+	if transfer == "" {
+		transfer = "basic"
+	}
+	return &batchResponse{Transfer: transfer, Objects: params.Objects}, nil
+}
+
+// presignedHref is the object storage URL the object is transferred with,
+// at the key GitLab stores LFS objects at
+func (params *batchParams) presignedHref(object *batchObject, expiresIn time.Duration) (string, error) {
+	presigner, ok := filestore.Presigner(params.Destination)
+	if !ok {
+		return "", fmt.Errorf("object_storage.%s presigns no URLs", params.Destination)
+	}
+	if len(object.Oid) < 5 {
+		return "", fmt.Errorf("invalid oid %q", object.Oid)
+	}
+
+	method := "GET"
+	if params.Operation == "upload" {
+		method = "PUT"
+	}
+	key := params.KeyPrefix + object.Oid[0:2] + "/" + object.Oid[2:4] + "/" + object.Oid[4:]
+
+	return presigner.Presign(method, key, expiresIn)
+}
+
+// href is the URL the object is transferred with, authorized until expires
+func (params *batchParams) href(object *batchObject, expires time.Time) (string, error) {
+	path := object.Oid
+	if params.Operation == "upload" {
+		path += "/" + strconv.FormatInt(object.Size, 10)
+	}
+
+	u, err := url.Parse(params.Href + path)
+	if err != nil {
+		return "", fmt.Errorf("parse href of %s: %v", object.Oid, err)
+	}
+
+	claims := objectClaims{
+		Operation:      params.Operation,
+		Oid:            object.Oid,
+		Size:           object.Size,
+		StandardClaims: secret.DefaultClaims,
+	}
+	claims.ExpiresAt = expires.Unix()
+
+	token, err := secret.JWTTokenString(claims)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set(TokenParam, token)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
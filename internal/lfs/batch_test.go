@@ -0,0 +1,154 @@
+package lfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const (
+	oid1 = "bf1b5da3b2df3ebbc6ac0f2b4ec0e6d0d7a0f7fd2c0a0c3e0d8f6a1e2b3c4d5e"
+	oid2 = "1f3c5d7e9a0b2c4d6e8f0a1b3c5d7e9f1a2b4c6d8e0f1a3b5c7d9e1f2a4b6c8d"
+	href = "https://gitlab.example.com/group/project.git/gitlab-lfs/objects/"
+)
+
+func sendBatch(t *testing.T, params batchParams) *httptest.ResponseRecorder {
+	data, err := json.Marshal(params)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Length", "1234")
+	r := httptest.NewRequest("POST", "/group/project.git/info/lfs/objects/batch", nil)
+	SendBatch.Inject(w, r, "lfs-batch:"+base64.URLEncoding.EncodeToString(data))
+	return w
+}
+
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) *batchResponse {
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, batchContentType, w.Header().Get("Content-Type"))
+	require.Empty(t, w.Header().Get("Content-Length"))
+
+	var response batchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return &response
+}
+
+func requireToken(t *testing.T, rawHref string, operation, oid string, size int64) string {
+	u, err := url.Parse(rawHref)
+	require.NoError(t, err)
+
+	claims := &objectClaims{}
+	require.NoError(t, secret.ParseJWT(u.Query().Get(TokenParam), claims))
+	require.Equal(t, operation, claims.Operation)
+	require.Equal(t, oid, claims.Oid)
+	require.Equal(t, size, claims.Size)
+	require.Equal(t, "gitlab-workhorse", claims.Issuer)
+	require.InDelta(t, time.Now().Add(time.Minute).Unix(), claims.ExpiresAt, 5)
+
+	u.RawQuery = ""
+	return u.String()
+}
+
+func TestSendBatchDownload(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	w := sendBatch(t, batchParams{
+		Operation: "download",
+		Objects: []*batchObject{
+			{Oid: oid1, Size: 10, Authenticated: true},
+			{Oid: oid2, Size: 20, Error: json.RawMessage(`{"code":404,"message":"Object does not exist"}`)},
+		},
+		Sign:      []string{oid1, oid2},
+		Href:      href,
+		Header:    map[string]string{"Authorization": "Basic dXNlcjp0b2tlbg=="},
+		ExpiresIn: 60,
+	})
+
+	response := decodeResponse(t, w)
+	require.Equal(t, "basic", response.Transfer)
+	require.Len(t, response.Objects, 2)
+
+	download := response.Objects[0].Actions["download"]
+	require.NotNil(t, download)
+	require.Equal(t, href+oid1, requireToken(t, download.Href, "download", oid1, 10))
+	require.Equal(t, "Basic dXNlcjp0b2tlbg==", download.Header["Authorization"])
+	require.Equal(t, int64(60), download.ExpiresIn)
+
+	require.Nil(t, response.Objects[1].Actions, "objects with errors get no href")
+	require.JSONEq(t, `{"code":404,"message":"Object does not exist"}`, string(response.Objects[1].Error))
+}
+
+func TestSendBatchUpload(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	w := sendBatch(t, batchParams{
+		Operation: "upload",
+		Objects:   []*batchObject{{Oid: oid1, Size: 10}, {Oid: oid2, Size: 20}},
+		Sign:      []string{oid2},
+		Href:      href,
+		ExpiresIn: 60,
+	})
+
+	response := decodeResponse(t, w)
+	require.Nil(t, response.Objects[0].Actions, "Rails has the object already")
+
+	upload := response.Objects[1].Actions["upload"]
+	require.NotNil(t, upload)
+	require.Equal(t, href+oid2+"/20", requireToken(t, upload.Href, "upload", oid2, 20))
+}
+
+func TestSendBatchPresigned(t *testing.T) {
+	require.NoError(t, filestore.ConfigureObjectStorage(map[string]config.ObjectStorageConfig{
+		"lfs": {
+			URLPrefix:       "https://lfs.s3.amazonaws.com/",
+			Provider:        filestore.ProviderAWS,
+			AccessKeyID:     "AKIAEXAMPLE",
+			SecretAccessKey: "secret",
+		},
+	}, nil))
+	defer filestore.ConfigureObjectStorage(nil, nil)
+
+	w := sendBatch(t, batchParams{
+		Operation:   "upload",
+		Objects:     []*batchObject{{Oid: oid1, Size: 10}},
+		Sign:        []string{oid1},
+		Destination: "lfs",
+		KeyPrefix:   "lfs-objects/",
+		ExpiresIn:   60,
+	})
+
+	response := decodeResponse(t, w)
+	upload := response.Objects[0].Actions["upload"]
+	require.NotNil(t, upload)
+
+	u, err := url.Parse(upload.Href)
+	require.NoError(t, err)
+	require.Equal(t, "lfs.s3.amazonaws.com", u.Host)
+	require.Equal(t, "/lfs-objects/"+oid1[0:2]+"/"+oid1[2:4]+"/"+oid1[4:], u.Path)
+	require.Equal(t, "60", u.Query().Get("X-Amz-Expires"))
+	require.Empty(t, u.Query().Get(TokenParam))
+}
+
+func TestSendBatchInvalid(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	for _, params := range []batchParams{
+		{Operation: "delete"},
+		{Operation: "download", Objects: []*batchObject{{Oid: oid1}}, Sign: []string{oid1}},
+		{Operation: "download", Objects: []*batchObject{{Oid: oid1}}, Sign: []string{oid1}, Destination: "unknown"},
+	} {
+		w := sendBatch(t, params)
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Package limiter caps the number of concurrent operations per key, e.g. per
+user or per repository. With Redis configured the limits apply across all
+Workhorse nodes, otherwise they are enforced per process.
+*/
+package limiter
+
+import (
+	"sync"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+// Limiter hands out slots for keys
+type Limiter interface {
+	// Acquire takes a slot for key if fewer than max slots are in use. If
+	// ok is true, release must be called when the operation is done.
+	Acquire(key string, max int) (release func(), ok bool, err error)
+}
+
+// New returns a Redis-backed Limiter if Redis is configured, and a
+// process-local one otherwise. Keys are namespaced with name.
+func New(name string) Limiter {
+	if conn := redis.Get(); conn != nil {
+		conn.Close()
+		return newRedisLimiter(name)
+	}
+
+	return newLocalLimiter()
+}
+
+type localLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{active: make(map[string]int)}
+}
+
+func (l *localLimiter) Acquire(key string, max int) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active[key] >= max {
+		return nil, false, nil
+	}
+	l.active[key]++
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(key) }) }, true, nil
+}
+
+func (l *localLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active[key]--
+	if l.active[key] <= 0 {
+		delete(l.active, key)
+	}
+}
@@ -0,0 +1,48 @@
+package limiter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalLimiter(t *testing.T) {
+	l := newLocalLimiter()
+
+	release1, ok, err := l.Acquire("user:1", 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	release2, ok, err := l.Acquire("user:1", 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, ok, err = l.Acquire("user:1", 2)
+	require.NoError(t, err)
+	require.False(t, ok, "third slot should be refused")
+
+	_, ok, err = l.Acquire("user:2", 2)
+	require.NoError(t, err)
+	require.True(t, ok, "other keys are counted separately")
+
+	release1()
+	release1()
+	require.Equal(t, 1, l.active["user:1"], "release must be idempotent")
+
+	_, ok, err = l.Acquire("user:1", 2)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	release2()
+}
+
+func TestLocalLimiterCleansUpKeys(t *testing.T) {
+	l := newLocalLimiter()
+
+	release, ok, err := l.Acquire("repository:group/project", 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	release()
+	require.Empty(t, l.active)
+}
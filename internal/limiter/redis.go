@@ -0,0 +1,122 @@
+package limiter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+var (
+	// Slots of a Workhorse process that died are freed after leaseTime.
+	// Live slots are renewed well before that.
+	leaseTime    = 60 * time.Second
+	renewalDelay = leaseTime / 3
+)
+
+// Each key is a sorted set of slot tokens scored by the time of their last
+// renewal. Expired slots are dropped before counting.
+var acquireScript = redigo.NewScript(1, `
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", tonumber(ARGV[1]) - tonumber(ARGV[2]))
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+  return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+type redisLimiter struct {
+	prefix string
+}
+
+func newRedisLimiter(name string) *redisLimiter {
+	return &redisLimiter{prefix: "workhorse:limiter:" + name + ":"}
+}
+
+func (l *redisLimiter) Acquire(key string, max int) (func(), bool, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return nil, false, fmt.Errorf("limiter: could not get Redis connection")
+	}
+	defer conn.Close()
+
+	token, err := newToken()
+	if err != nil {
+		return nil, false, err
+	}
+
+	redisKey := l.prefix + key
+	acquired, err := redigo.Bool(acquireScript.Do(conn, redisKey, nowMillis(), leaseTime.Nanoseconds()/1e6, max, token))
+	if err != nil {
+		return nil, false, fmt.Errorf("limiter: acquire %q: %v", key, err)
+	}
+	if !acquired {
+		return nil, false, nil
+	}
+
+	done := make(chan struct{})
+	go renewSlot(redisKey, token, done)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			close(done)
+			if err := do("ZREM", redisKey, token); err != nil {
+				log.WithError(err).WithField("key", redisKey).Error("limiter: release slot")
+			}
+		})
+	}
+
+	return release, true, nil
+}
+
+// renewSlot keeps the slot alive for long-running operations such as
+// clones of large repositories
+func renewSlot(redisKey, token string, done chan struct{}) {
+	ticker := time.NewTicker(renewalDelay)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := do("ZADD", redisKey, "XX", nowMillis(), token); err != nil {
+				log.WithError(err).WithField("key", redisKey).Error("limiter: renew slot")
+			}
+			if err := do("PEXPIRE", redisKey, leaseTime.Nanoseconds()/1e6); err != nil {
+				log.WithError(err).WithField("key", redisKey).Error("limiter: renew slot")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func do(command string, args ...interface{}) error {
+	conn := redis.Get()
+	if conn == nil {
+		return fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	_, err := conn.Do(command, args...)
+	return err
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / 1e6
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,46 @@
+package limiter
+
+import (
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+func setupMockRedis() *redigomock.Conn {
+	conn := redigomock.NewConn()
+	redis.Configure(&config.RedisConfig{}, func(_ *config.RedisConfig, _ bool) func() (redigo.Conn, error) {
+		return func() (redigo.Conn, error) {
+			return conn, nil
+		}
+	})
+	return conn
+}
+
+func TestRedisLimiter(t *testing.T) {
+	conn := setupMockRedis()
+	l := New("git")
+	require.IsType(t, &redisLimiter{}, l)
+
+	conn.GenericCommand("EVALSHA").Expect(int64(1))
+	release := conn.GenericCommand("ZREM").Expect(int64(1))
+
+	f, ok, err := l.Acquire("user:1", 5)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	f()
+	f()
+	require.Equal(t, 1, conn.Stats(release), "slot should be released exactly once")
+
+	conn.Clear()
+	conn.GenericCommand("EVALSHA").Expect(int64(0))
+
+	_, ok, err = l.Acquire("user:1", 5)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
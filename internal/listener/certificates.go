@@ -0,0 +1,164 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// How often certificate files are checked for changes
+var reloadInterval = 10 * time.Second
+
+// certificateStore picks a certificate by SNI server name. The first
+// certificate is used for clients that send no or an unknown name.
+type certificateStore struct {
+	files []config.CertificateConfig
+
+	mu      sync.RWMutex
+	certs   []*tls.Certificate
+	byName  map[string]*tls.Certificate
+	modTime time.Time
+}
+
+func newCertificateStore(files []config.CertificateConfig) (*certificateStore, error) {
+	s := &certificateStore{files: files}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *certificateStore) load() error {
+	modTime, err := s.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	var certs []*tls.Certificate
+	byName := make(map[string]*tls.Certificate)
+
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate %q: %v", f.CertFile, err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parse certificate %q: %v", f.CertFile, err)
+		}
+		cert.Leaf = leaf
+
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+
+		certs = append(certs, &cert)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.certs = certs
+	s.byName = byName
+	s.modTime = modTime
+
+	return nil
+}
+
+func (s *certificateStore) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range s.files {
+		for _, name := range []string{f.CertFile, f.KeyFile} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if fi.ModTime().After(latest) {
+				latest = fi.ModTime()
+			}
+		}
+	}
+
+	return latest, nil
+}
+
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+
+	// Wildcards only match a single label, e.g. *.example.com
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return s.certs[0], nil
+}
+
+// watch reloads the certificates on SIGHUP or when one of the files
+// changes. If the new certificates can't be loaded, the old ones stay in
+// use.
+func (s *certificateStore) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			s.reload("SIGHUP")
+		case <-ticker.C:
+			if s.changed() {
+				s.reload("file change")
+			}
+		}
+	}
+}
+
+func (s *certificateStore) changed() bool {
+	modTime, err := s.latestModTime()
+	if err != nil {
+		// Probably in the middle of a certificate rotation, try again later
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return modTime.After(s.modTime)
+}
+
+func (s *certificateStore) reload(reason string) {
+	logger := log.WithField("reason", reason)
+	if err := s.load(); err != nil {
+		logger.WithError(err).Error("listener: failed to reload certificates")
+		return
+	}
+
+	logger.Info("listener: reloaded certificates")
+}
@@ -0,0 +1,203 @@
+/*
+Package listener opens the listeners configured with [[listeners]] in
+config.toml or with the -listen* flags
+*/
+package listener
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/proxyproto"
+)
+
+const defaultMaxConcurrentStreams = 250
+
+var tlsVersions = map[string]uint16{
+	"tls1.0": tls.VersionTLS10,
+	"tls1.1": tls.VersionTLS11,
+	"tls1.2": tls.VersionTLS12,
+	"tls1.3": tls.VersionTLS13,
+}
+
+// Server serves HTTP on a configured listener
+type Server struct {
+	net.Listener
+	server *http.Server
+}
+
+// NewServer opens a listener for cfg and prepares an HTTP server for
+// handler on it. HTTP/2 is offered on TLS listeners, and on plain text
+// listeners if H2C is set.
+func NewServer(cfg config.ListenerConfig, handler http.Handler) (*Server, error) {
+	l, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h2 := &http2.Server{MaxConcurrentStreams: cfg.MaxConcurrentStreams}
+	if h2.MaxConcurrentStreams == 0 {
+		h2.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+
+	if cfg.H2C && len(cfg.Certificates) == 0 {
+		handler = h2c.NewHandler(handler, h2)
+	}
+
+	server := &http.Server{Handler: handler}
+	if err := http2.ConfigureServer(server, h2); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &Server{Listener: l, server: server}, nil
+}
+
+// Serve accepts connections until the listener is closed
+func (s *Server) Serve() error {
+	return s.server.Serve(s.Listener)
+}
+
+// Shutdown stops accepting connections and waits for active requests to
+// finish, or until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// New opens a listener for cfg. If certificates are configured the
+// listener terminates TLS; the certificates are reloaded when they change
+// on disk or on SIGHUP.
+func New(cfg config.ListenerConfig) (net.Listener, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := listen(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ProxyProtocol {
+		l = proxyproto.NewListener(l)
+	}
+
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	return l, nil
+}
+
+// listen takes over the listener from the parent process after a graceful
+// upgrade, or opens a new one
+func listen(cfg config.ListenerConfig) (net.Listener, error) {
+	key := listenerKey(cfg)
+
+	l, err := inheritedListener(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if l == nil {
+		l, err = open(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	register(key, l)
+	return l, nil
+}
+
+func open(cfg config.ListenerConfig) (net.Listener, error) {
+	switch cfg.Network {
+	case "":
+		return net.Listen("tcp", cfg.Addr)
+	case "systemd":
+		return systemdListener(cfg.Addr)
+	case "unix":
+		// Good housekeeping for Unix sockets: unlink before binding
+		if err := os.Remove(cfg.Addr); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove socket: %v", err)
+		}
+
+		// Change the umask only around net.Listen()
+		oldUmask := syscall.Umask(cfg.Umask)
+		defer syscall.Umask(oldUmask)
+	}
+
+	return net.Listen(cfg.Network, cfg.Addr)
+}
+
+func newTLSConfig(cfg config.ListenerConfig) (*tls.Config, error) {
+	if len(cfg.Certificates) == 0 {
+		return nil, nil
+	}
+
+	minVersion, err := minTLSVersion(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := newCertificateStore(cfg.Certificates)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %v", cfg.Addr, err)
+	}
+	go store.watch()
+
+	return &tls.Config{
+		GetCertificate: store.getCertificate,
+		MinVersion:     minVersion,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
+
+func minTLSVersion(cfg config.ListenerConfig) (uint16, error) {
+	if cfg.MinTLSVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+
+	v, ok := tlsVersions[cfg.MinTLSVersion]
+	if !ok {
+		return 0, fmt.Errorf("listener %s: unknown MinTLSVersion %q", cfg.Addr, cfg.MinTLSVersion)
+	}
+	return v, nil
+}
+
+// Validate checks cfg, including its certificates, without opening the
+// listener
+func Validate(cfg config.ListenerConfig) error {
+	if cfg.Addr == "" {
+		return fmt.Errorf("listener: Addr is empty")
+	}
+
+	switch cfg.Network {
+	case "", "tcp", "tcp4", "tcp6", "unix", "systemd":
+	default:
+		return fmt.Errorf("listener %s: unknown Network %q", cfg.Addr, cfg.Network)
+	}
+
+	if len(cfg.Certificates) == 0 {
+		return nil
+	}
+
+	if _, err := minTLSVersion(cfg); err != nil {
+		return err
+	}
+
+	if _, err := newCertificateStore(cfg.Certificates); err != nil {
+		return fmt.Errorf("listener %s: %v", cfg.Addr, err)
+	}
+
+	return nil
+}
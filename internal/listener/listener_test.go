@@ -0,0 +1,179 @@
+package listener
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func writeCertificate(t *testing.T, dir, name, dnsName string, serial int64) config.CertificateConfig {
+	certFile, keyFile := testhelper.WriteCertificate(t, dir, name, dnsName, serial)
+	return config.CertificateConfig{CertFile: certFile, KeyFile: keyFile}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "listener")
+	require.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestTLSListenerWithSNI(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	certs := []config.CertificateConfig{
+		writeCertificate(t, dir, "default", "gitlab.example.com", 1),
+		writeCertificate(t, dir, "registry", "registry.example.com", 2),
+		writeCertificate(t, dir, "pages", "*.pages.example.com", 3),
+	}
+
+	l, err := New(config.ListenerConfig{Addr: "127.0.0.1:0", Certificates: certs})
+	require.NoError(t, err)
+	defer l.Close()
+
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+
+	testCases := []struct {
+		serverName string
+		serial     int64
+	}{
+		{serverName: "gitlab.example.com", serial: 1},
+		{serverName: "REGISTRY.example.com", serial: 2},
+		{serverName: "group.pages.example.com", serial: 3},
+		{serverName: "a.group.pages.example.com", serial: 1},
+		{serverName: "unknown.example.com", serial: 1},
+		{serverName: "", serial: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.serverName, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true})
+			require.NoError(t, err)
+			defer conn.Close()
+
+			peer := conn.ConnectionState().PeerCertificates[0]
+			require.Equal(t, tc.serial, peer.SerialNumber.Int64())
+		})
+	}
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+}
+
+func TestInvalidTLSConfig(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cert := writeCertificate(t, dir, "default", "gitlab.example.com", 1)
+
+	_, err := New(config.ListenerConfig{Addr: "127.0.0.1:0", Certificates: []config.CertificateConfig{cert}, MinTLSVersion: "ssl3"})
+	require.Error(t, err)
+
+	_, err = New(config.ListenerConfig{Addr: "127.0.0.1:0", Certificates: []config.CertificateConfig{{CertFile: cert.CertFile, KeyFile: filepath.Join(dir, "missing.key")}}})
+	require.Error(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cert := writeCertificate(t, dir, "default", "gitlab.example.com", 1)
+	store, err := newCertificateStore([]config.CertificateConfig{cert})
+	require.NoError(t, err)
+	require.False(t, store.changed())
+
+	serial := func() int64 {
+		c, err := store.getCertificate(&tls.ClientHelloInfo{ServerName: "gitlab.example.com"})
+		require.NoError(t, err)
+		return c.Leaf.SerialNumber.Int64()
+	}
+	require.Equal(t, int64(1), serial())
+
+	require.NoError(t, os.Remove(cert.KeyFile))
+	store.reload("test")
+	require.Equal(t, int64(1), serial(), "old certificate should stay in use if the new one can't be loaded")
+
+	writeCertificate(t, dir, "default", "gitlab.example.com", 2)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(cert.CertFile, later, later))
+	require.True(t, store.changed())
+
+	store.reload("test")
+	require.Equal(t, int64(2), serial())
+	require.False(t, store.changed())
+}
+
+func TestServerH2C(t *testing.T) {
+	s, err := NewServer(config.ListenerConfig{Addr: "127.0.0.1:0", H2C: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	requireProto(t, client, "http://"+s.Addr().String(), "HTTP/2.0")
+	requireProto(t, http.DefaultClient, "http://"+s.Addr().String(), "HTTP/1.1")
+}
+
+func TestServerTLSOffersHTTP2(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	cert := writeCertificate(t, dir, "default", "gitlab.example.com", 1)
+	s, err := NewServer(config.ListenerConfig{Addr: "127.0.0.1:0", Certificates: []config.CertificateConfig{cert}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	requireProto(t, client, "https://"+s.Addr().String(), "HTTP/2.0")
+}
+
+func requireProto(t *testing.T, client *http.Client, url string, proto string) {
+	res, err := client.Get(url)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, proto, string(body))
+}
+
+func TestUnixListener(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	socket := filepath.Join(dir, "workhorse.socket")
+	require.NoError(t, ioutil.WriteFile(socket, nil, 0600), "create a stale socket file")
+
+	l, err := New(config.ListenerConfig{Network: "unix", Addr: socket, Umask: 0077})
+	require.NoError(t, err)
+	defer l.Close()
+
+	fi, err := os.Stat(socket)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
@@ -0,0 +1,83 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	// The first file descriptor passed by systemd, see sd_listen_fds(3)
+	listenFdsStart = 3
+
+	systemdOnce  sync.Once
+	systemdFiles map[string]*os.File
+	systemdErr   error
+)
+
+// systemdListener returns the socket systemd passed to us under name, the
+// FileDescriptorName= of the socket unit. Sockets without a name can be
+// referred to by their index, starting at 0.
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		systemdFiles, systemdErr = systemdSockets()
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+
+	f, ok := systemdFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("systemd did not pass a socket named %q", name)
+	}
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd socket %q: %v", name, err)
+	}
+
+	return l, nil
+}
+
+func systemdSockets() (map[string]*os.File, error) {
+	defer func() {
+		// Child processes must not think the sockets are meant for them
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("no sockets passed by systemd")
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	files := make(map[string]*os.File)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		index := strconv.Itoa(i)
+		f := os.NewFile(uintptr(fd), "systemd:"+index)
+		files[index] = f
+		if i < len(names) && names[i] != "" {
+			files[names[i]] = f
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,64 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestSystemdListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+
+	f, err := tcp.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+
+	defer func(start int) {
+		listenFdsStart = start
+		systemdOnce = sync.Once{}
+	}(listenFdsStart)
+	// The socket now belongs to the systemd code, like inherited sockets
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	listenFdsStart = fd
+	systemdOnce = sync.Once{}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "workhorse")
+
+	for _, name := range []string{"workhorse", "0"} {
+		t.Run(name, func(t *testing.T) {
+			l, err := New(config.ListenerConfig{Network: "systemd", Addr: name})
+			require.NoError(t, err)
+			defer l.Close()
+
+			require.Equal(t, tcp.Addr().String(), l.Addr().String())
+		})
+	}
+
+	_, err = New(config.ListenerConfig{Network: "systemd", Addr: "missing"})
+	require.Error(t, err)
+
+	require.Empty(t, os.Getenv("LISTEN_FDS"), "environment should be cleared for child processes")
+}
+
+func TestSystemdListenerWithoutSockets(t *testing.T) {
+	defer func() { systemdOnce = sync.Once{} }()
+	systemdOnce = sync.Once{}
+
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+
+	_, err := New(config.ListenerConfig{Network: "systemd", Addr: "0"})
+	require.Error(t, err, "sockets for another process must be ignored")
+}
@@ -0,0 +1,235 @@
+package listener
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+/*
+A graceful upgrade works like this:
+
+1. The running process receives SIGUSR2 and calls Upgrade.
+2. Upgrade starts the (new) binary with the same arguments and passes all
+   open listeners to it, keyed by network and address.
+3. The new process takes over the listeners instead of opening new ones
+   and calls Ready once it serves requests.
+4. The old process stops accepting connections and finishes the requests
+   in flight.
+
+Because the listening sockets are never closed, no connection is refused
+during the upgrade.
+*/
+
+const (
+	inheritedListenersEnv = "GITLAB_WORKHORSE_INHERITED_LISTENERS"
+	upgradeReadyEnv       = "GITLAB_WORKHORSE_UPGRADE_READY_FD"
+)
+
+// upgradeCommand returns the binary and arguments for the new process
+var upgradeCommand = func() (string, []string, error) {
+	executable, err := os.Executable()
+	return executable, os.Args[1:], err
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]net.Listener)
+
+	inheritedOnce sync.Once
+	inherited     map[string]int
+	inheritedErr  error
+)
+
+func listenerKey(cfg config.ListenerConfig) string {
+	network := cfg.Network
+	if network == "" {
+		network = "tcp"
+	}
+	return network + ":" + cfg.Addr
+}
+
+func register(key string, l net.Listener) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[key] = l
+}
+
+// inheritedListener returns the listener for key passed by the parent
+// process, or nil if there is none
+func inheritedListener(key string) (net.Listener, error) {
+	inheritedOnce.Do(func() {
+		inherited, inheritedErr = parseInheritedListeners()
+	})
+	if inheritedErr != nil {
+		return nil, inheritedErr
+	}
+
+	fd, ok := inherited[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(inherited, key)
+
+	f := os.NewFile(uintptr(fd), key)
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inherited listener %s: %v", key, err)
+	}
+
+	return l, nil
+}
+
+func parseInheritedListeners() (map[string]int, error) {
+	value := os.Getenv(inheritedListenersEnv)
+	os.Unsetenv(inheritedListenersEnv)
+
+	fds := make(map[string]int)
+	if value == "" {
+		return fds, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &fds); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", inheritedListenersEnv, err)
+	}
+
+	return fds, nil
+}
+
+// Upgrade starts a new process that takes over all listeners, and waits
+// up to timeout until it is ready to serve requests. If Upgrade returns
+// nil the caller should stop accepting connections and exit once the
+// requests in flight are done.
+func Upgrade(timeout time.Duration) error {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	fds := make(map[string]int)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for key, l := range registry {
+		fl, ok := l.(filer)
+		if !ok {
+			return fmt.Errorf("upgrade: can't pass listener %s", key)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("upgrade: listener %s: %v", key, err)
+		}
+
+		// ExtraFiles start at file descriptor 3 in the child
+		fds[key] = 3 + len(files)
+		files = append(files, f)
+	}
+
+	encoded, err := json.Marshal(fds)
+	if err != nil {
+		return err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	executable, args, err := upgradeCommand()
+	if err != nil {
+		readyW.Close()
+		return fmt.Errorf("upgrade: %v", err)
+	}
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		inheritedListenersEnv+"="+string(encoded),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, 3+len(files)),
+	)
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: start %s: %v", executable, err)
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err == io.EOF {
+			// The new process closed the pipe without signalling, it died
+			go cmd.Wait()
+			return fmt.Errorf("upgrade: new process exited before it was ready")
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			go cmd.Wait()
+			return fmt.Errorf("upgrade: wait for new process: %v", err)
+		}
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("upgrade: new process not ready after %v", timeout)
+	}
+
+	// The new process owns the listeners now. Closing ours must not remove
+	// the socket file it is listening on.
+	for _, l := range registry {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	log.WithField("pid", cmd.Process.Pid).Info("listener: upgrade complete, handed over listeners")
+	return nil
+}
+
+// Ready tells the parent process of a graceful upgrade that we serve
+// requests. It does nothing if we were not started by Upgrade.
+func Ready() {
+	value := os.Getenv(upgradeReadyEnv)
+	if value == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+
+	var fd int
+	if _, err := fmt.Sscanf(value, "%d", &fd); err != nil {
+		log.WithError(err).Error("listener: invalid upgrade ready fd")
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer f.Close()
+
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.WithError(err).Error("listener: signal upgrade ready")
+	}
+}
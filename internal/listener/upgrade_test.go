@@ -0,0 +1,108 @@
+package listener
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const upgradeHelperEnv = "GITLAB_WORKHORSE_TEST_UPGRADE_HELPER"
+
+// TestUpgradeHelperProcess is the new process started by TestUpgrade. It
+// takes over the listener and answers a single connection with its PID.
+func TestUpgradeHelperProcess(t *testing.T) {
+	addr := os.Getenv(upgradeHelperEnv)
+	if addr == "" {
+		return
+	}
+
+	l, err := New(config.ListenerConfig{Addr: addr})
+	require.NoError(t, err)
+	require.Equal(t, addr, l.Addr().String())
+	Ready()
+
+	c, err := l.Accept()
+	require.NoError(t, err)
+	c.Write([]byte(strconv.Itoa(os.Getpid()) + "\n"))
+	c.Close()
+}
+
+func withUpgradeCommand(t *testing.T, env string) func() {
+	old := upgradeCommand
+	upgradeCommand = func() (string, []string, error) {
+		return os.Args[0], []string{"-test.run=TestUpgradeHelperProcess"}, nil
+	}
+	os.Setenv(upgradeHelperEnv, env)
+
+	return func() {
+		upgradeCommand = old
+		os.Unsetenv(upgradeHelperEnv)
+		registryMu.Lock()
+		registry = make(map[string]net.Listener)
+		registryMu.Unlock()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	l, err := New(config.ListenerConfig{Addr: "127.0.0.1:0"})
+	require.NoError(t, err)
+
+	defer withUpgradeCommand(t, l.Addr().String())()
+
+	// The listener is registered under the address we asked for
+	registryMu.Lock()
+	registry = map[string]net.Listener{"tcp:" + l.Addr().String(): l}
+	registryMu.Unlock()
+
+	require.NoError(t, Upgrade(10*time.Second))
+	require.NoError(t, l.Close())
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err, "the socket must stay open after the old listener is closed")
+	defer c.Close()
+
+	pid, err := bufio.NewReader(c).ReadString('\n')
+	require.NoError(t, err)
+	require.NotEqual(t, strconv.Itoa(os.Getpid())+"\n", pid, "connection should be served by the new process")
+}
+
+func TestUpgradeNewProcessFails(t *testing.T) {
+	l, err := New(config.ListenerConfig{Addr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// The helper process can't listen on this address, so it fails before
+	// calling Ready
+	defer withUpgradeCommand(t, "256.0.0.1:1")()
+
+	require.Error(t, Upgrade(10*time.Second))
+}
+
+func TestInheritedListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer tcp.Close()
+
+	f, err := tcp.(*net.TCPListener).File()
+	require.NoError(t, err)
+
+	key := "tcp:" + tcp.Addr().String()
+	os.Setenv(inheritedListenersEnv, `{"`+key+`":`+strconv.Itoa(int(f.Fd()))+`}`)
+	defer func() { inheritedOnce = sync.Once{} }()
+	inheritedOnce = sync.Once{}
+
+	l, err := New(config.ListenerConfig{Addr: tcp.Addr().String()})
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.Equal(t, tcp.Addr().String(), l.Addr().String())
+	require.Empty(t, os.Getenv(inheritedListenersEnv))
+}
@@ -0,0 +1,163 @@
+package nats
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is the subset of the NATS client protocol needed to subscribe to a
+// single subject: https://docs.nats.io/reference/reference-protocols/nats-protocol
+
+const subscriptionID = "1"
+
+type connectOptions struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+type subscription struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// subscribe connects to the server at u and subscribes to subject
+func subscribe(u *url.URL, subject string, timeout time.Duration) (*subscription, error) {
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &subscription{conn: conn, r: bufio.NewReader(conn)}
+	if err := s.handshake(u, subject, timeout); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *subscription) handshake(u *url.URL, subject string, timeout time.Duration) error {
+	s.conn.SetDeadline(time.Now().Add(timeout))
+	defer s.conn.SetDeadline(time.Time{})
+
+	line, err := s.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO, got %q", line)
+	}
+
+	opts := connectOptions{Name: "gitlab-workhorse", Lang: "go", Version: "1.0.0"}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts.User, opts.Pass = u.User.Username(), pass
+		} else {
+			opts.AuthToken = u.User.Username()
+		}
+	}
+	connect, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+
+	// The PING makes the server answer with PONG once it has processed the
+	// commands before it, or with -ERR if the connection was rejected.
+	if _, err := fmt.Fprintf(s.conn, "CONNECT %s\r\nSUB %s %s\r\nPING\r\n", connect, subject, subscriptionID); err != nil {
+		return err
+	}
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", line)
+		}
+	}
+}
+
+// next blocks until the next message is received and returns its payload
+func (s *subscription) next() ([]byte, error) {
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case line == "PING":
+			if _, err := io.WriteString(s.conn, "PONG\r\n"); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "MSG "):
+			return s.readPayload(line)
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, fmt.Errorf("server error: %s", line)
+		}
+		// Anything else (+OK, PONG, INFO updates) needs no action
+	}
+}
+
+// readPayload reads the payload announced by 'MSG <subject> <sid> [reply-to] <#bytes>'
+func (s *subscription) readPayload(line string) ([]byte, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || len(fields) > 5 {
+		return nil, fmt.Errorf("invalid MSG: %q", line)
+	}
+
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid MSG size: %q", line)
+	}
+
+	payload := make([]byte, size+2)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return nil, err
+	}
+	if string(payload[size:]) != "\r\n" {
+		return nil, errors.New("MSG payload not terminated by CRLF")
+	}
+
+	return payload[:size], nil
+}
+
+func (s *subscription) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (s *subscription) Close() error {
+	return s.conn.Close()
+}
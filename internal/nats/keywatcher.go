@@ -0,0 +1,272 @@
+/*
+Package nats delivers CI long polling notifications from a NATS server, as
+an alternative to Redis pubsub.
+
+Rails publishes the same 'key=value' notifications it would publish on the
+Redis workhorse:notifications channel. NATS keeps no values to GET, so the
+last value notified for each key is remembered instead, for as long as
+Rails keeps the key in Redis. A watch for a value that is not the last one
+seen, or for a key without a known value, e.g. after a reconnect, returns
+WatchKeyStatusAlreadyChanged so that the request goes to Rails.
+*/
+package nats
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
+)
+
+const (
+	defaultSubject        = "workhorse.notifications"
+	defaultConnectTimeout = 5 * time.Second
+
+	// lastValueTTL is how long Rails keeps the runner queue keys in Redis
+	lastValueTTL = time.Hour
+)
+
+var (
+	keyWatcher      = make(map[string][]chan string)
+	keyWatcherMutex sync.Mutex
+	// lastValues are guarded by keyWatcherMutex too, so that a watch sees
+	// either the last value or the notification that replaces it
+	lastValues      = make(map[string]notifiedValue)
+	lastValuesSwept time.Time
+	reconnectDelay  = backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    60 * time.Second,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	serverURL      *url.URL
+	subject        string
+	connectTimeout time.Duration
+
+	connected     bool
+	connectedLock sync.RWMutex
+
+	natsConnected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_nats_keywatcher_connected",
+			Help: "Whether the keywatcher is subscribed to NATS (1) or not (0)",
+		},
+	)
+	natsMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_nats_keywatcher_total_messages",
+			Help: "How many messages gitlab-workhorse has received in total from NATS.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(natsConnected, natsMessages)
+}
+
+type notifiedValue struct {
+	value string
+	at    time.Time
+}
+
+// KeyWatcher watches keys with NATS notifications
+type KeyWatcher struct{}
+
+// WatchKey calls the WatchKey function of the package
+func (KeyWatcher) WatchKey(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+	return WatchKey(key, value, timeout)
+}
+
+// Configure sets up the NATS connection used by Process
+func Configure(cfg *config.NATSConfig) error {
+	if cfg.URL.Scheme != "nats" {
+		return fmt.Errorf("nats: URL must start with nats://, got %q", cfg.URL.String())
+	}
+
+	serverURL = &cfg.URL.URL
+	subject = cfg.Subject
+	if subject == "" {
+		subject = defaultSubject
+	}
+	connectTimeout = defaultConnectTimeout
+	if cfg.ConnectTimeout != nil {
+		connectTimeout = cfg.ConnectTimeout.Duration
+	}
+
+	status.Register("keywatcher", keyWatcherStatus)
+
+	return nil
+}
+
+func keyWatcherStatus() interface{} {
+	keyWatcherMutex.Lock()
+	keys := len(keyWatcher)
+	keyWatcherMutex.Unlock()
+
+	return map[string]interface{}{
+		"backend":   "nats",
+		"connected": isConnected(),
+		"keys":      keys,
+	}
+}
+
+// Process NATS notifications. Run it once: the connection state it keeps
+// is the state of its own subscription.
+func Process() {
+	log.Info("nats: starting process loop")
+	for {
+		time.Sleep(processOnce())
+	}
+}
+
+func processOnce() time.Duration {
+	sub, err := subscribe(serverURL, subject, connectTimeout)
+	if err != nil {
+		helper.LogError(nil, fmt.Errorf("nats: subscribe: %v", err))
+		return reconnectDelay.Duration()
+	}
+	defer sub.Close()
+
+	start := time.Now()
+	setConnected(true)
+	err = processMessages(sub)
+	setConnected(false)
+	// Notifications sent while disconnected are lost
+	forgetValues()
+	helper.LogError(nil, fmt.Errorf("nats: process loop: %v", err))
+
+	if time.Since(start) >= 30*time.Second {
+		reconnectDelay.Reset()
+	}
+	return reconnectDelay.Duration()
+}
+
+func processMessages(sub *subscription) error {
+	for {
+		payload, err := sub.next()
+		if err != nil {
+			return err
+		}
+
+		natsMessages.Inc()
+		msg := strings.SplitN(string(payload), "=", 2)
+		if len(msg) != 2 {
+			helper.LogError(nil, fmt.Errorf("nats: invalid notification: %q", payload))
+			continue
+		}
+		notifyChanWatchers(msg[0], msg[1])
+	}
+}
+
+func setConnected(value bool) {
+	connectedLock.Lock()
+	defer connectedLock.Unlock()
+
+	connected = value
+	if value {
+		natsConnected.Set(1)
+	} else {
+		natsConnected.Set(0)
+	}
+}
+
+func isConnected() bool {
+	connectedLock.RLock()
+	defer connectedLock.RUnlock()
+	return connected
+}
+
+func notifyChanWatchers(key, value string) {
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(lastValuesSwept) >= lastValueTTL {
+		for k, v := range lastValues {
+			if now.Sub(v.at) >= lastValueTTL {
+				delete(lastValues, k)
+			}
+		}
+		lastValuesSwept = now
+	}
+	lastValues[key] = notifiedValue{value: value, at: now}
+
+	for _, c := range keyWatcher[key] {
+		c <- value
+	}
+	delete(keyWatcher, key)
+}
+
+func forgetValues() {
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+	lastValues = make(map[string]notifiedValue)
+}
+
+// addKeyChan registers c and returns the last value notified for key
+func addKeyChan(key string, c chan string) (string, bool) {
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+	keyWatcher[key] = append(keyWatcher[key], c)
+
+	last, ok := lastValues[key]
+	if !ok || time.Since(last.at) >= lastValueTTL {
+		return "", false
+	}
+	return last.value, true
+}
+
+func delKeyChan(key string, c chan string) {
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+
+	chans := keyWatcher[key]
+	for i := range chans {
+		if chans[i] == c {
+			keyWatcher[key] = append(chans[:i], chans[i+1:]...)
+			break
+		}
+	}
+	if len(keyWatcher[key]) == 0 {
+		delete(keyWatcher, key)
+	}
+}
+
+// WatchKey waits for a notification that key changed from value. It has
+// the signature of redis.WatchKey so the two are interchangeable.
+func WatchKey(key, value string, timeout time.Duration) (redis.WatchKeyStatus, error) {
+	if !isConnected() {
+		return redis.WatchKeyStatusNoChange, errors.New("nats: not connected")
+	}
+
+	c := make(chan string, 1)
+	last, known := addKeyChan(key, c)
+	defer delKeyChan(key, c)
+
+	if !known || last != value {
+		return redis.WatchKeyStatusAlreadyChanged, nil
+	}
+
+	select {
+	case currentValue := <-c:
+		if currentValue == value {
+			return redis.WatchKeyStatusNoChange, nil
+		}
+		return redis.WatchKeyStatusSeenChange, nil
+
+	case <-time.After(timeout):
+		return redis.WatchKeyStatusTimeout, nil
+	}
+}
@@ -0,0 +1,219 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+// fakeServer accepts a single client and returns the commands it sent
+// during the handshake on commands. Messages written to publish are sent to
+// the client.
+func fakeServer(t *testing.T, reject bool) (addr string, commands <-chan string, publish chan<- string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cmds := make(chan string, 10)
+	pub := make(chan string)
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "INFO {\"server_id\":\"test\",\"version\":\"2.1.0\"}\r\n")
+
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			cmds <- line
+
+			if line == "PING" {
+				break
+			}
+		}
+
+		if reject {
+			fmt.Fprint(conn, "-ERR 'Authorization Violation'\r\n")
+			return
+		}
+
+		fmt.Fprint(conn, "+OK\r\nPONG\r\n")
+
+		for msg := range pub {
+			fmt.Fprintf(conn, "PING\r\nMSG workhorse.notifications 1 %d\r\n%s\r\n", len(msg), msg)
+		}
+	}()
+
+	return l.Addr().String(), cmds, pub
+}
+
+func TestSubscribeHandshake(t *testing.T) {
+	addr, commands, publish := fakeServer(t, false)
+	defer close(publish)
+
+	u, err := url.Parse("nats://user:secret@" + addr)
+	require.NoError(t, err)
+
+	sub, err := subscribe(u, "workhorse.notifications", time.Second)
+	require.NoError(t, err)
+	defer sub.Close()
+
+	connect := <-commands
+	require.True(t, strings.HasPrefix(connect, "CONNECT {"), connect)
+	require.Contains(t, connect, `"user":"user"`)
+	require.Contains(t, connect, `"pass":"secret"`)
+	require.Equal(t, "SUB workhorse.notifications 1", <-commands)
+	require.Equal(t, "PING", <-commands)
+
+	publish <- "runner:build_queue:10=new"
+	payload, err := sub.next()
+	require.NoError(t, err)
+	require.Equal(t, "runner:build_queue:10=new", string(payload))
+}
+
+func TestSubscribeRejected(t *testing.T) {
+	addr, _, _ := fakeServer(t, true)
+
+	u, err := url.Parse("nats://" + addr)
+	require.NoError(t, err)
+
+	_, err = subscribe(u, "workhorse.notifications", time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Authorization Violation")
+}
+
+func TestConfigureRejectsOtherSchemes(t *testing.T) {
+	u, err := url.Parse("tls://localhost:4222")
+	require.NoError(t, err)
+
+	require.Error(t, Configure(&config.NATSConfig{URL: config.TomlURL{URL: *u}}))
+}
+
+// startProcessing runs processOnce against a fake server. The returned
+// function disconnects it and waits for processOnce to return.
+func startProcessing(t *testing.T) (publish chan<- string, stop func()) {
+	addr, _, publish := fakeServer(t, false)
+
+	u, err := url.Parse("nats://" + addr)
+	require.NoError(t, err)
+	require.NoError(t, Configure(&config.NATSConfig{URL: config.TomlURL{URL: *u}}))
+
+	done := make(chan struct{})
+	go func() {
+		processOnce()
+		close(done)
+	}()
+
+	return publish, func() {
+		close(publish)
+		<-done
+	}
+}
+
+func TestWatchKey(t *testing.T) {
+	publish, stop := startProcessing(t)
+	defer stop()
+
+	for !isConnected() {
+		time.Sleep(time.Millisecond)
+	}
+
+	key := "runner:build_queue:10"
+
+	testCases := []struct {
+		desc     string
+		message  string
+		expected redis.WatchKeyStatus
+	}{
+		{desc: "seen change", message: key + "=new", expected: redis.WatchKeyStatusSeenChange},
+		{desc: "same value", message: key + "=old", expected: redis.WatchKeyStatusNoChange},
+		{desc: "other key", message: "runner:build_queue:11=new", expected: redis.WatchKeyStatusTimeout},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			notifyChanWatchers(key, "old")
+
+			result := make(chan redis.WatchKeyStatus)
+			go func() {
+				status, err := WatchKey(key, "old", 200*time.Millisecond)
+				require.NoError(t, err)
+				result <- status
+			}()
+
+			for countWatchers(key) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			publish <- tc.message
+
+			require.Equal(t, tc.expected, <-result)
+		})
+	}
+}
+
+func TestWatchKeyAlreadyChanged(t *testing.T) {
+	setConnected(true)
+	defer setConnected(false)
+	defer forgetValues()
+
+	key := "runner:build_queue:10"
+
+	status, err := WatchKey(key, "old", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, redis.WatchKeyStatusAlreadyChanged, status, "unknown key")
+
+	notifyChanWatchers(key, "new")
+	status, err = WatchKey(key, "old", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, redis.WatchKeyStatusAlreadyChanged, status, "changed before the watch")
+
+	lastValues[key] = notifiedValue{value: "old", at: time.Now().Add(-lastValueTTL)}
+	status, err = WatchKey(key, "old", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, redis.WatchKeyStatusAlreadyChanged, status, "expired value")
+
+	require.Equal(t, 0, countWatchers(key))
+}
+
+func TestProcessOnceForgetsValuesOnDisconnect(t *testing.T) {
+	publish, stop := startProcessing(t)
+
+	publish <- "runner:build_queue:10=new"
+	stop()
+
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+	require.Empty(t, lastValues)
+}
+
+func TestWatchKeyNotConnected(t *testing.T) {
+	setConnected(false)
+
+	status, err := WatchKey("runner:build_queue:10", "old", time.Second)
+	require.Error(t, err)
+	require.Equal(t, redis.WatchKeyStatusNoChange, status)
+}
+
+func countWatchers(key string) int {
+	keyWatcherMutex.Lock()
+	defer keyWatcherMutex.Unlock()
+	return len(keyWatcher[key])
+}
@@ -0,0 +1,98 @@
+package objectstore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// awsChunkSize is the size of the chunks of aws-chunked bodies
+const awsChunkSize = 64 * 1024
+
+// checksumTrailer is the trailer of aws-chunked bodies
+const checksumTrailer = "x-amz-checksum-crc32"
+
+// awsChunkedReader frames size bytes of src in the aws-chunked encoding
+// and computes their CRC32 on the way, which it sends in a trailer after
+// the last chunk
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/checking-object-integrity.html#trailing-checksums
+type awsChunkedReader struct {
+	src       io.Reader
+	remaining int64
+	crc       hash.Hash32
+	chunk     []byte
+	buf       bytes.Buffer
+	done      bool
+}
+
+func newAWSChunkedReader(src io.Reader, size int64) *awsChunkedReader {
+	return &awsChunkedReader{src: src, remaining: size, crc: crc32.NewIEEE()}
+}
+
+func (r *awsChunkedReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.buf.Read(p)
+}
+
+// fill frames the next chunk, or the trailer after the last one
+func (r *awsChunkedReader) fill() error {
+	if r.remaining == 0 {
+		fmt.Fprintf(&r.buf, "0\r\n%s:%s\r\n\r\n", checksumTrailer, r.checksum())
+		r.done = true
+		return nil
+	}
+
+	n := r.remaining
+	if n > awsChunkSize {
+		n = awsChunkSize
+	}
+	if r.chunk == nil {
+		r.chunk = make([]byte, awsChunkSize)
+	}
+
+	chunk := r.chunk[:n]
+	if _, err := io.ReadFull(r.src, chunk); err != nil {
+		return err
+	}
+	r.crc.Write(chunk)
+	r.remaining -= n
+
+	fmt.Fprintf(&r.buf, "%x\r\n", n)
+	r.buf.Write(chunk)
+	r.buf.WriteString("\r\n")
+	return nil
+}
+
+func (r *awsChunkedReader) checksum() string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, r.crc.Sum32())
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// awsChunkedLength is the length of size bytes in the aws-chunked encoding
+func awsChunkedLength(size int64) int64 {
+	length := int64(0)
+	for size > 0 {
+		n := size
+		if n > awsChunkSize {
+			n = awsChunkSize
+		}
+		length += int64(len(fmt.Sprintf("%x", n))) + 2 + n + 2
+		size -= n
+	}
+
+	// the last chunk and the trailer, with a base64 CRC32 of 8 bytes
+	return length + int64(len("0\r\n"+checksumTrailer+":\r\n\r\n")) + 8
+}
@@ -0,0 +1,118 @@
+package objectstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// decodeAWSChunked returns the data and the checksum trailer of an
+// aws-chunked body
+func decodeAWSChunked(body io.Reader) (string, string, error) {
+	r := bufio.NewReader(body)
+	var data bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(line, "\r\n"), 16, 64)
+		if err != nil {
+			return "", "", err
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, r, n); err != nil {
+			return "", "", err
+		}
+		if _, err := r.Discard(2); err != nil {
+			return "", "", err
+		}
+	}
+
+	trailer, err := r.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "\r\n" {
+		return "", "", fmt.Errorf("unexpected end of body %q", rest)
+	}
+
+	return data.String(), strings.TrimSuffix(trailer, "\r\n"), nil
+}
+
+func crc32Base64(data string) string {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE([]byte(data)))
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+func TestAWSChunkedReader(t *testing.T) {
+	for _, size := range []int{0, 1, awsChunkSize - 1, awsChunkSize, 3*awsChunkSize + 17} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			data := strings.Repeat("x", size)
+
+			body, err := ioutil.ReadAll(newAWSChunkedReader(strings.NewReader(data), int64(size)))
+			require.NoError(t, err)
+			require.Equal(t, awsChunkedLength(int64(size)), int64(len(body)))
+
+			decoded, trailer, err := decodeAWSChunked(bytes.NewReader(body))
+			require.NoError(t, err)
+			require.Equal(t, data, decoded)
+			require.Equal(t, checksumTrailer+":"+crc32Base64(data), trailer)
+		})
+	}
+}
+
+func TestAWSChunkedReaderShortSource(t *testing.T) {
+	_, err := ioutil.ReadAll(newAWSChunkedReader(strings.NewReader("short"), 10))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestObjectUploadTrailingChecksum(t *testing.T) {
+	const content = "trailing checksum content"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "aws-chunked", r.Header.Get("Content-Encoding"))
+		require.Equal(t, "STREAMING-UNSIGNED-PAYLOAD-TRAILER", r.Header.Get("X-Amz-Content-Sha256"))
+		require.Equal(t, strconv.Itoa(len(content)), r.Header.Get("X-Amz-Decoded-Content-Length"))
+		require.Equal(t, checksumTrailer, r.Header.Get("X-Amz-Trailer"))
+
+		data, trailer, err := decodeAWSChunked(r.Body)
+		require.NoError(t, err)
+		if data != content || trailer != checksumTrailer+":"+crc32Base64(data) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Not the MD5 of the data, as for objects with checksums in S3
+		w.Header().Set("ETag", `"not-an-md5"`)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := NewProviderObject(ctx, S3TrailingChecksum, ts.URL+"/bucket/object", "", nil, time.Now().Add(time.Minute), int64(len(content)))
+	require.NoError(t, err)
+
+	_, err = io.Copy(o, strings.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+	require.Equal(t, "not-an-md5", o.ETag())
+}
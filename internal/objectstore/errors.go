@@ -0,0 +1,48 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// The kinds of upload failures, for errors.Is. The errors of uploads wrap
+// one of them when object storage, rather than Workhorse or the client,
+// is to blame.
+var (
+	// ErrObjectStoreUnavailable means that object storage could not be
+	// reached, or answered with an error
+	ErrObjectStoreUnavailable = errors.New("object storage unavailable")
+	// ErrETagMismatch means that object storage stored other data than
+	// was sent
+	ErrETagMismatch = errors.New("ETag mismatch")
+	// ErrDeadlineExceeded means that the upload did not finish before its
+	// deadline
+	ErrDeadlineExceeded = errors.New("object storage deadline exceeded")
+	// ErrObjectExists means that the upload would overwrite an object,
+	// e.g. because Rails sent the ID of another upload in flight
+	ErrObjectExists = errors.New("object already exists")
+)
+
+// remoteError is an error answer of object storage. It keeps the message
+// of object storage, which tells what went wrong well enough.
+type remoteError struct {
+	error
+}
+
+func (e remoteError) Is(target error) bool {
+	return target == ErrObjectStoreUnavailable
+}
+
+func (e remoteError) Unwrap() error {
+	return e.error
+}
+
+// requestError wraps the error of a request to object storage in the kind
+// of its failure
+func requestError(ctx context.Context, request string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%w: %s: %v", ErrDeadlineExceeded, request, err)
+	}
+	return fmt.Errorf("%w: %s: %v", ErrObjectStoreUnavailable, request, err)
+}
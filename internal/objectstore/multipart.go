@@ -1,19 +1,16 @@
 package objectstore
 
 import (
-	"bytes"
 	"context"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"gitlab.com/gitlab-org/labkit/log"
-	"gitlab.com/gitlab-org/labkit/mask"
 )
 
 // ErrNotEnoughParts will be used when writing more than size * len(partURLs)
@@ -29,20 +26,38 @@ type Multipart struct {
 	// DeleteURL is a presigned URL for RemoveObject
 	DeleteURL string
 
+	// body counts the bytes of the upload
+	body *countingReader
+
 	uploader
 }
 
 // NewMultipart provides Multipart pointer that can be used for uploading. Data written will be split buffered on disk up to size bytes
-// then uploaded with S3 Upload Part. Once Multipart is Closed a final call to CompleteMultipartUpload will be sent.
+// then uploaded with S3 Upload Part. Up to concurrency parts are buffered and uploaded at the same time.
+// Once Multipart is Closed a final call to CompleteMultipartUpload will be sent.
 // In case of any error a call to AbortMultipartUpload will be made to cleanup all the resources
-func NewMultipart(ctx context.Context, partURLs []string, completeURL, abortURL, deleteURL string, putHeaders map[string]string, deadline time.Time, partSize int64) (*Multipart, error) {
+func NewMultipart(ctx context.Context, partURLs []string, completeURL, abortURL, deleteURL string, putHeaders map[string]string, deadline time.Time, partSize int64, concurrency int) (*Multipart, error) {
+	return newMultipart(ctx, S3, partURLs, completeURL, abortURL, deleteURL, putHeaders, deadline, partSize, concurrency)
+}
+
+// NewProviderMultipart is NewMultipart sending the requests with provider
+func NewProviderMultipart(ctx context.Context, provider Provider, partURLs []string, completeURL, abortURL, deleteURL string, putHeaders map[string]string, deadline time.Time, partSize int64, concurrency int) (*Multipart, error) {
+	return newMultipart(ctx, provider, partURLs, completeURL, abortURL, deleteURL, putHeaders, deadline, partSize, concurrency)
+}
+
+func newMultipart(ctx context.Context, provider Provider, partURLs []string, completeURL, abortURL, deleteURL string, putHeaders map[string]string, deadline time.Time, partSize int64, concurrency int) (*Multipart, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
 	pr, pw := io.Pipe()
 	uploadCtx, cancelFn := context.WithDeadline(ctx, deadline)
 	m := &Multipart{
 		CompleteURL: completeURL,
 		AbortURL:    abortURL,
 		DeleteURL:   deleteURL,
-		uploader:    newUploader(uploadCtx, pw),
+		body:        &countingReader{r: pr},
+		uploader:    newUploader(uploadCtx, cancelFn, pw, provider),
 	}
 
 	go m.trackUploadTime()
@@ -51,26 +66,17 @@ func NewMultipart(ctx context.Context, partURLs []string, completeURL, abortURL,
 	objectStorageUploadsOpen.Inc()
 
 	go func() {
-		defer cancelFn()
+		defer m.finish()
 		defer objectStorageUploadsOpen.Dec()
 		defer func() {
 			// This will be returned as error to the next write operation on the pipe
 			pr.CloseWithError(m.uploadError)
 		}()
 
-		cmu := &CompleteMultipartUpload{}
-		for i, partURL := range partURLs {
-			src := io.LimitReader(pr, partSize)
-			part, err := m.readAndUploadOnePart(partURL, putHeaders, src, i+1)
-			if err != nil {
-				m.uploadError = err
-				return
-			}
-			if part == nil {
-				break
-			} else {
-				cmu.Part = append(cmu.Part, part)
-			}
+		parts, err := m.uploadParts(m.body, partURLs, putHeaders, partSize, concurrency)
+		if err != nil {
+			m.uploadError = err
+			return
 		}
 
 		n, err := io.Copy(ioutil.Discard, pr)
@@ -83,7 +89,7 @@ func NewMultipart(ctx context.Context, partURLs []string, completeURL, abortURL,
 			return
 		}
 
-		if err := m.complete(cmu); err != nil {
+		if err := m.complete(parts); err != nil {
 			m.uploadError = err
 			return
 		}
@@ -92,15 +98,89 @@ func NewMultipart(ctx context.Context, partURLs []string, completeURL, abortURL,
 	return m, nil
 }
 
+// uploadParts reads the parts from src and uploads up to concurrency of
+// them at the same time. It returns the uploaded parts in order.
+func (m *Multipart) uploadParts(src io.Reader, partURLs []string, putHeaders map[string]string, partSize int64, concurrency int) ([]*CompletedPart, error) {
+	parts := make([]*CompletedPart, len(partURLs))
+	slots := make(chan struct{}, concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		firstErr error
+	)
+	failed := func() error {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		return firstErr
+	}
+
+	for i, partURL := range partURLs {
+		// Wait for a free slot before buffering the next part, so that at
+		// most concurrency parts are on disk
+		slots <- struct{}{}
+		if failed() != nil {
+			break
+		}
+
+		file, n, err := m.readPart(io.LimitReader(src, partSize), i+1)
+		if err != nil || n == 0 {
+			<-slots
+			if err != nil {
+				errMutex.Lock()
+				firstErr = err
+				errMutex.Unlock()
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, partURL string, file *os.File, n int64) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer removePartBuffer(file)
+
+			etag, err := m.uploadPart(partURL, putHeaders, file, n)
+			if err != nil {
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("upload part %d: %w", i+1, err)
+				}
+				errMutex.Unlock()
+				return
+			}
+			parts[i] = &CompletedPart{PartNumber: i + 1, ETag: etag}
+		}(i, partURL, file, n)
+	}
+
+	wg.Wait()
+
+	if err := failed(); err != nil {
+		return nil, err
+	}
+
+	var uploaded []*CompletedPart
+	for _, part := range parts {
+		if part == nil {
+			break
+		}
+		uploaded = append(uploaded, part)
+	}
+	return uploaded, nil
+}
+
 func (m *Multipart) trackUploadTime() {
 	started := time.Now()
-	<-m.ctx.Done()
+	<-m.done
 	objectStorageUploadTime.Observe(time.Since(started).Seconds())
+	if m.uploadError == nil {
+		observeUpload(uploadTypeMultipart, m.body.count(), time.Since(started))
+	}
 }
 
 func (m *Multipart) cleanup(ctx context.Context) {
 	// wait for the upload to finish
-	<-m.ctx.Done()
+	<-m.done
 
 	if m.uploadError != nil {
 		objectStorageUploadRequestsRequestFailed.Inc()
@@ -116,86 +196,74 @@ func (m *Multipart) cleanup(ctx context.Context) {
 	m.delete()
 }
 
-func (m *Multipart) complete(cmu *CompleteMultipartUpload) error {
-	body, err := xml.Marshal(cmu)
-	if err != nil {
-		return fmt.Errorf("marshal CompleteMultipartUpload request: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", m.CompleteURL, bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("create CompleteMultipartUpload request: %v", err)
-	}
-	req.ContentLength = int64(len(body))
-	req.Header.Set("Content-Type", "application/xml")
-	req = req.WithContext(m.ctx)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("CompleteMultipartUpload request %q: %v", mask.URL(m.CompleteURL), err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("CompleteMultipartUpload request %v returned: %s", mask.URL(m.CompleteURL), resp.Status)
-	}
-
-	result := &compoundCompleteMultipartUploadResult{}
-	decoder := xml.NewDecoder(resp.Body)
-	if err := decoder.Decode(&result); err != nil {
-		return fmt.Errorf("decode CompleteMultipartUpload answer: %v", err)
-	}
-
-	if result.isError() {
-		return result
-	}
-
-	if result.CompleteMultipartUploadResult == nil {
-		return fmt.Errorf("empty CompleteMultipartUploadResult")
-	}
-
-	m.extractETag(result.ETag)
+func (m *Multipart) complete(parts []*CompletedPart) error {
+	return retryThrottled(m.ctx, func() error {
+		etag, err := m.provider.CompleteMultipart(m.ctx, m.CompleteURL, parts)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		m.etag = etag
+		return nil
+	})
 }
 
-func (m *Multipart) readAndUploadOnePart(partURL string, putHeaders map[string]string, src io.Reader, partNumber int) (*completeMultipartUploadPart, error) {
+// readPart buffers a part on disk. The caller removes the file with
+// removePartBuffer.
+func (m *Multipart) readPart(src io.Reader, partNumber int) (*os.File, int64, error) {
 	file, err := ioutil.TempFile("", "part-buffer")
 	if err != nil {
-		return nil, fmt.Errorf("create temporary buffer file: %v", err)
+		return nil, 0, fmt.Errorf("create temporary buffer file: %v", err)
 	}
-	defer func(path string) {
-		if err := os.Remove(path); err != nil {
-			log.WithError(err).WithField("file", path).Warning("Unable to delete temporary file")
-		}
-	}(file.Name())
 
 	n, err := io.Copy(file, src)
 	if err != nil {
-		return nil, fmt.Errorf("write part %d to disk: %v", partNumber, err)
+		removePartBuffer(file)
+		return nil, 0, fmt.Errorf("write part %d to disk: %v", partNumber, err)
 	}
 	if n == 0 {
-		return nil, nil
+		removePartBuffer(file)
+		return nil, 0, nil
 	}
 
 	if _, err = file.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("rewind part %d temporary dump : %v", partNumber, err)
+		removePartBuffer(file)
+		return nil, 0, fmt.Errorf("rewind part %d temporary dump : %v", partNumber, err)
 	}
 
-	etag, err := m.uploadPart(partURL, putHeaders, file, n)
-	if err != nil {
-		return nil, fmt.Errorf("upload part %d: %v", partNumber, err)
+	return file, n, nil
+}
+
+func removePartBuffer(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		log.WithError(err).WithField("file", file.Name()).Warning("Unable to delete temporary file")
 	}
-	return &completeMultipartUploadPart{PartNumber: partNumber, ETag: etag}, nil
 }
 
-func (m *Multipart) uploadPart(url string, headers map[string]string, body io.Reader, size int64) (string, error) {
+// uploadPart uploads a part buffered in body, again if object storage
+// throttles the upload
+func (m *Multipart) uploadPart(url string, headers map[string]string, body io.ReadSeeker, size int64) (string, error) {
 	deadline, ok := m.ctx.Deadline()
 	if !ok {
 		return "", fmt.Errorf("missing deadline")
 	}
 
-	part, err := newObject(m.ctx, url, "", headers, deadline, size, false)
+	var etag string
+	err := retryThrottled(m.ctx, func() error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("rewind part buffer: %v", err)
+		}
+
+		var err error
+		etag, err = m.sendPart(url, headers, body, deadline, size)
+		return err
+	})
+	return etag, err
+}
+
+func (m *Multipart) sendPart(url string, headers map[string]string, body io.Reader, deadline time.Time, size int64) (string, error) {
+	part, err := newObject(m.ctx, m.provider, url, "", headers, deadline, size, false)
 	if err != nil {
 		return "", err
 	}
@@ -214,9 +282,9 @@ func (m *Multipart) uploadPart(url string, headers map[string]string, body io.Re
 }
 
 func (m *Multipart) delete() {
-	m.syncAndDelete(m.DeleteURL)
+	m.syncAndDelete(m.DeleteURL, m.provider.Delete)
 }
 
 func (m *Multipart) abort() {
-	m.syncAndDelete(m.AbortURL)
+	m.syncAndDelete(m.AbortURL, m.provider.Abort)
 }
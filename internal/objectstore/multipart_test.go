@@ -2,10 +2,14 @@ package objectstore_test
 
 import (
 	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,7 +59,8 @@ func TestMultipartUploadWithUpcaseETags(t *testing.T) {
 		"",                  // no delete
 		map[string]string{}, // no custom headers
 		deadline,
-		test.ObjectSize) // parts size equal to the whole content. Only 1 part
+		test.ObjectSize, // parts size equal to the whole content. Only 1 part
+		1)               // one part at a time
 	require.NoError(t, err)
 
 	_, err = m.Write([]byte(test.ObjectContent))
@@ -64,3 +69,134 @@ func TestMultipartUploadWithUpcaseETags(t *testing.T) {
 	require.Equal(t, 1, putCnt, "1 part expected")
 	require.Equal(t, 1, postCnt, "1 complete multipart upload expected")
 }
+
+func TestMultipartUploadConcurrency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const concurrency = 2
+	var (
+		mu            sync.Mutex
+		inFlight, max int
+		completeBody  string
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			completeBody = string(body)
+
+			w.Write([]byte(`<CompleteMultipartUploadResult><ETag>etag</ETag></CompleteMultipartUploadResult>`))
+			return
+		}
+
+		mu.Lock()
+		inFlight++
+		if inFlight > max {
+			max = inFlight
+		}
+		mu.Unlock()
+
+		// Give the other parts a chance to start
+		time.Sleep(50 * time.Millisecond)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		w.Header().Set("ETag", fmt.Sprintf("%x", md5.Sum(body)))
+	}))
+	defer ts.Close()
+
+	var partURLs []string
+	for i := 1; i <= 4; i++ {
+		partURLs = append(partURLs, fmt.Sprintf("%s/object?partNumber=%d", ts.URL, i))
+	}
+
+	m, err := objectstore.NewMultipart(ctx, partURLs, ts.URL, "", "", map[string]string{}, time.Now().Add(testTimeout), 5, concurrency)
+	require.NoError(t, err)
+
+	_, err = m.Write([]byte(strings.Repeat("x", 18)))
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+
+	require.Equal(t, concurrency, max, "parts uploaded at the same time")
+	last := -1
+	for i := 1; i <= 4; i++ {
+		index := strings.Index(completeBody, fmt.Sprintf("<PartNumber>%d</PartNumber>", i))
+		require.True(t, index > last, "part %d missing or out of order", i)
+		last = index
+	}
+}
+
+func TestMultipartUploadRetriesThrottledRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var putCnt, postCnt int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		defer r.Body.Close()
+
+		if r.Method == "PUT" {
+			putCnt++
+			if putCnt == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			require.Equal(t, test.ObjectContent, string(body), "retried part must be sent whole")
+			w.Header().Set("ETag", test.ObjectMD5)
+		}
+
+		if r.Method == "POST" {
+			postCnt++
+			if postCnt == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+
+			w.Write([]byte(`<CompleteMultipartUploadResult><ETag>not checked</ETag></CompleteMultipartUploadResult>`))
+		}
+	}))
+	defer ts.Close()
+
+	m, err := objectstore.NewMultipart(ctx, []string{ts.URL}, ts.URL, "", "", map[string]string{}, time.Now().Add(testTimeout), test.ObjectSize, 1)
+	require.NoError(t, err)
+
+	_, err = m.Write([]byte(test.ObjectContent))
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	require.Equal(t, 2, putCnt, "throttled part must be retried")
+	require.Equal(t, 2, postCnt, "throttled complete multipart upload must be retried")
+}
+
+func TestMultipartUploadThrottledPastDeadline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var putCnt int
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		putCnt++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	m, err := objectstore.NewMultipart(ctx, []string{ts.URL}, ts.URL, "", "", map[string]string{}, time.Now().Add(testTimeout), test.ObjectSize, 1)
+	require.NoError(t, err)
+
+	m.Write([]byte(test.ObjectContent))
+	err = m.Close()
+	require.True(t, errors.Is(err, objectstore.ErrThrottled), "expected throttled error, got %v", err)
+	require.True(t, errors.Is(err, objectstore.ErrObjectStoreUnavailable))
+	require.Equal(t, 1, putCnt, "no retry expected past the deadline")
+}
@@ -2,40 +2,20 @@ package objectstore
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"gitlab.com/gitlab-org/labkit/correlation"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"gitlab.com/gitlab-org/labkit/mask"
-	"gitlab.com/gitlab-org/labkit/tracing"
 )
 
-// httpTransport defines a http.Transport with values
-// that are more restrictive than for http.DefaultTransport,
-// they define shorter TLS Handshake, and more aggressive connection closing
-// to prevent the connection hanging and reduce FD usage
-var httpTransport = tracing.NewRoundTripper(correlation.NewInstrumentedRoundTripper(&http.Transport{
-	Proxy: http.ProxyFromEnvironment,
-	DialContext: (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 10 * time.Second,
-	}).DialContext,
-	MaxIdleConns:          2,
-	IdleConnTimeout:       30 * time.Second,
-	TLSHandshakeTimeout:   10 * time.Second,
-	ExpectContinueTimeout: 10 * time.Second,
-	ResponseHeaderTimeout: 30 * time.Second,
-}))
-
-var httpClient = &http.Client{
-	Transport: httpTransport,
-}
-
 type StatusCodeError error
 
 // Object represents an object on a S3 compatible Object Store service.
@@ -51,31 +31,41 @@ type Object struct {
 
 // NewObject opens an HTTP connection to Object Store and returns an Object pointer that can be used for uploading.
 func NewObject(ctx context.Context, putURL, deleteURL string, putHeaders map[string]string, deadline time.Time, size int64) (*Object, error) {
-	return newObject(ctx, putURL, deleteURL, putHeaders, deadline, size, true)
+	return newObject(ctx, S3, putURL, deleteURL, putHeaders, deadline, size, true)
 }
 
-func newObject(ctx context.Context, putURL, deleteURL string, putHeaders map[string]string, deadline time.Time, size int64, metrics bool) (*Object, error) {
+// NewProviderObject is NewObject sending the requests with provider
+func NewProviderObject(ctx context.Context, provider Provider, putURL, deleteURL string, putHeaders map[string]string, deadline time.Time, size int64) (*Object, error) {
+	return newObject(ctx, provider, putURL, deleteURL, putHeaders, deadline, size, true)
+}
+
+func newObject(ctx context.Context, provider Provider, putURL, deleteURL string, putHeaders map[string]string, deadline time.Time, size int64, metrics bool) (*Object, error) {
 	started := time.Now()
-	pr, pw := io.Pipe()
-	// we should prevent pr.Close() otherwise it may shadow error set with pr.CloseWithError(err)
-	req, err := http.NewRequest(http.MethodPut, putURL, ioutil.NopCloser(pr))
-	if err != nil {
+	if err := checkURL(putURL); err != nil {
 		if metrics {
 			objectStorageUploadRequestsRequestFailed.Inc()
 		}
 		return nil, fmt.Errorf("PUT %q: %v", mask.URL(putURL), err)
 	}
-	req.ContentLength = size
 
-	for k, v := range putHeaders {
-		req.Header.Set(k, v)
+	// Object storage verifies the checksum the provider sends, so the MD5
+	// of the data is not needed
+	verified := false
+	if v, ok := provider.(ChecksumVerifier); ok {
+		verified = v.VerifiesChecksum(size)
 	}
 
+	pr, pw := io.Pipe()
+	body := &countingReader{r: pr}
 	uploadCtx, cancelFn := context.WithDeadline(ctx, deadline)
 	o := &Object{
 		PutURL:    putURL,
 		DeleteURL: deleteURL,
-		uploader:  newMD5Uploader(uploadCtx, pw),
+	}
+	if verified {
+		o.uploader = newUploader(uploadCtx, cancelFn, pw, provider)
+	} else {
+		o.uploader = newMD5Uploader(uploadCtx, cancelFn, pw, provider)
 	}
 
 	if metrics {
@@ -84,9 +74,12 @@ func newObject(ctx context.Context, putURL, deleteURL string, putHeaders map[str
 
 	go func() {
 		// wait for the upload to finish
-		<-o.ctx.Done()
+		<-o.done
 		if metrics {
 			objectStorageUploadTime.Observe(time.Since(started).Seconds())
+			if o.uploadError == nil {
+				observeUpload(uploadTypeSingle, body.count(), time.Since(started))
+			}
 		}
 
 		// wait for provided context to finish before performing cleanup
@@ -95,7 +88,7 @@ func newObject(ctx context.Context, putURL, deleteURL string, putHeaders map[str
 	}()
 
 	go func() {
-		defer cancelFn()
+		defer o.finish()
 		if metrics {
 			defer objectStorageUploadsOpen.Dec()
 		}
@@ -104,40 +97,96 @@ func newObject(ctx context.Context, putURL, deleteURL string, putHeaders map[str
 			pr.CloseWithError(o.uploadError)
 		}()
 
-		req = req.WithContext(o.ctx)
+		span, spanCtx := opentracing.StartSpanFromContext(o.ctx, "objectstore.put")
+		defer func() {
+			span.SetTag("http.request_size", body.count())
+			if o.uploadError != nil {
+				ext.Error.Set(span, true)
+				span.LogKV("error", o.uploadError.Error())
+			}
+			span.Finish()
+		}()
 
-		resp, err := httpClient.Do(req)
+		etag, err := o.provider.Put(spanCtx, o.PutURL, putHeaders, body, size)
 		if err != nil {
 			if metrics {
-				objectStorageUploadRequestsRequestFailed.Inc()
+				var respErr *responseError
+				if errors.As(err, &respErr) {
+					objectStorageUploadRequestsInvalidStatus.Inc()
+				} else {
+					objectStorageUploadRequestsRequestFailed.Inc()
+				}
 			}
-			o.uploadError = fmt.Errorf("PUT request %q: %v", mask.URL(o.PutURL), err)
+			o.uploadError = err
 			return
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			if metrics {
-				objectStorageUploadRequestsInvalidStatus.Inc()
-			}
-			o.uploadError = StatusCodeError(fmt.Errorf("PUT request %v returned: %s", mask.URL(o.PutURL), resp.Status))
-			return
+		o.etag = etag
+		if !verified {
+			o.uploadError = compareMD5(o.md5Sum(), o.etag)
 		}
-
-		o.extractETag(resp.Header.Get("ETag"))
-		o.uploadError = compareMD5(o.md5Sum(), o.etag)
 	}()
 
 	return o, nil
 }
 
+// CheckNotExists fails with ErrObjectExists when there is an object at
+// headURL, a presigned HeadObject URL. Uploads check it before they start,
+// so that they don't overwrite the object of another upload.
+func CheckNotExists(ctx context.Context, headURL string) error {
+	if err := checkURL(headURL); err != nil {
+		return fmt.Errorf("HEAD %q: %v", mask.URL(headURL), err)
+	}
+
+	_, err := S3.Head(ctx, headURL)
+	var respErr *responseError
+	if errors.As(err, &respErr) && respErr.status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%w: %v", ErrObjectExists, mask.URL(headURL))
+}
+
+// checkURL rejects the URLs no provider can upload to. Rails sent them,
+// object storage is not to blame.
+func checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	return nil
+}
+
 func (o *Object) delete() {
-	o.syncAndDelete(o.DeleteURL)
+	o.syncAndDelete(o.DeleteURL, o.provider.Delete)
+}
+
+// countingReader counts the bytes read by the HTTP client, which may still
+// be reading when the response arrives
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
 }
 
 func compareMD5(local, remote string) error {
 	if !strings.EqualFold(local, remote) {
-		return fmt.Errorf("ETag mismatch. expected %q got %q", local, remote)
+		return fmt.Errorf("%w: expected %q got %q", ErrETagMismatch, local, remote)
 	}
 
 	return nil
@@ -2,6 +2,7 @@ package objectstore_test
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -122,9 +123,30 @@ func TestObjectUpload404(t *testing.T) {
 	assert.Error(err)
 	_, isStatusCodeError := err.(objectstore.StatusCodeError)
 	require.True(isStatusCodeError, "Should fail with StatusCodeError")
+	require.True(errors.Is(err, objectstore.ErrObjectStoreUnavailable))
 	require.Contains(err.Error(), "404")
 }
 
+func TestObjectUploadDeadlineExceeded(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	object, err := objectstore.NewObject(ctx, ts.URL+test.ObjectPath, "", map[string]string{}, deadline, test.ObjectSize)
+	require.NoError(t, err)
+	io.Copy(object, strings.NewReader(test.ObjectContent))
+
+	err = object.Close()
+	require.True(t, errors.Is(err, objectstore.ErrDeadlineExceeded), "%v", err)
+}
+
 type endlessReader struct{}
 
 func (e *endlessReader) Read(p []byte) (n int, err error) {
@@ -167,4 +189,37 @@ func TestObjectUploadBrokenConnection(t *testing.T) {
 
 	closeErr := object.Close()
 	require.Equal(t, copyErr, closeErr)
+	require.True(t, errors.Is(closeErr, objectstore.ErrObjectStoreUnavailable))
+}
+
+func TestCheckNotExists(t *testing.T) {
+	osStub, ts := test.StartObjectStore()
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	objectURL := ts.URL + test.ObjectPath
+	require.NoError(t, objectstore.CheckNotExists(ctx, objectURL))
+
+	object, err := objectstore.NewObject(ctx, objectURL, "", map[string]string{}, time.Now().Add(testTimeout), test.ObjectSize)
+	require.NoError(t, err)
+	_, err = io.Copy(object, strings.NewReader(test.ObjectContent))
+	require.NoError(t, err)
+	require.NoError(t, object.Close())
+	require.Equal(t, 1, osStub.PutsCnt())
+
+	err = objectstore.CheckNotExists(ctx, objectURL)
+	require.True(t, errors.Is(err, objectstore.ErrObjectExists), "%v", err)
+}
+
+func TestCheckNotExistsFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	err := objectstore.CheckNotExists(context.Background(), ts.URL+test.ObjectPath)
+	require.True(t, errors.Is(err, objectstore.ErrObjectStoreUnavailable), "%v", err)
+	require.False(t, errors.Is(err, objectstore.ErrObjectExists))
 }
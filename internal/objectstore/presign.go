@@ -0,0 +1,313 @@
+package objectstore
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultPresignExpiry is how long presigned URLs are valid if the
+	// presigner sets no expiry
+	DefaultPresignExpiry = 15 * time.Minute
+	// MaxPresignExpiry is the longest expiry S3 and GCS accept
+	MaxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// Presigner makes URLs that allow a single request on an object without
+// further credentials, until they expire
+type Presigner interface {
+	// Presign returns the URL of a method request on the object key.
+	// The URL expires after expiresIn, or the default expiry of the
+	// presigner if expiresIn is 0.
+	Presign(method, key string, expiresIn time.Duration) (string, error)
+}
+
+// S3Credentials are the keys S3 URLs are signed with
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials
+	SessionToken string
+}
+
+// S3Presigner signs URLs with AWS Signature Version 4
+type S3Presigner struct {
+	// BucketURL is the URL object keys are appended to, like
+	// https://bucket.s3.amazonaws.com/ or https://minio:9000/bucket/
+	BucketURL string
+	// Region of the bucket. Defaults to us-east-1.
+	Region string
+	// Expiry is the default expiry of the URLs
+	Expiry time.Duration
+	// Credentials returns the keys to sign with. It is called for every
+	// URL, so that rotated keys are used as soon as they are known.
+	Credentials func() (S3Credentials, error)
+
+	now func() time.Time
+}
+
+// GCSCredentials are the service account keys GCS URLs are signed with
+type GCSCredentials struct {
+	ClientEmail string
+	PrivateKey  *rsa.PrivateKey
+}
+
+// GCSPresigner signs URLs with the V4 signing process of Google Cloud
+// Storage
+type GCSPresigner struct {
+	// BucketURL is the URL object keys are appended to, like
+	// https://storage.googleapis.com/bucket/
+	BucketURL string
+	// Expiry is the default expiry of the URLs
+	Expiry time.Duration
+	// Credentials returns the keys to sign with. It is called for every
+	// URL, so that rotated keys are used as soon as they are known.
+	Credentials func() (GCSCredentials, error)
+
+	now func() time.Time
+}
+
+// ParseGCSCredentials reads the JSON key file of a service account
+func ParseGCSCredentials(data []byte) (GCSCredentials, error) {
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return GCSCredentials{}, fmt.Errorf("parse key file: %v", err)
+	}
+	if key.ClientEmail == "" {
+		return GCSCredentials{}, errors.New("key file has no client_email")
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return GCSCredentials{}, errors.New("key file has no PEM private_key")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return GCSCredentials{}, fmt.Errorf("parse private_key: %v", err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return GCSCredentials{}, errors.New("private_key is no RSA key")
+	}
+
+	return GCSCredentials{ClientEmail: key.ClientEmail, PrivateKey: privateKey}, nil
+}
+
+func (p *S3Presigner) Presign(method, key string, expiresIn time.Duration) (string, error) {
+	creds, err := p.Credentials()
+	if err != nil {
+		return "", fmt.Errorf("S3 credentials: %v", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return "", errors.New("S3 credentials: no access key")
+	}
+
+	region := p.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	s := &v4Signer{
+		algorithm: "AWS4-HMAC-SHA256",
+		prefix:    "X-Amz-",
+		now:       currentTime(p.now),
+		payload:   "UNSIGNED-PAYLOAD",
+	}
+	s.scope = s.date() + "/" + region + "/s3/aws4_request"
+	s.credential = creds.AccessKeyID + "/" + s.scope
+	if creds.SessionToken != "" {
+		s.extra = map[string]string{"X-Amz-Security-Token": creds.SessionToken}
+	}
+	s.sign = func(stringToSign string) ([]byte, error) {
+		signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), s.date())
+		signingKey = hmacSHA256(signingKey, region)
+		signingKey = hmacSHA256(signingKey, "s3")
+		signingKey = hmacSHA256(signingKey, "aws4_request")
+		return hmacSHA256(signingKey, stringToSign), nil
+	}
+
+	return s.presign(method, p.BucketURL, key, expiry(expiresIn, p.Expiry))
+}
+
+func (p *GCSPresigner) Presign(method, key string, expiresIn time.Duration) (string, error) {
+	creds, err := p.Credentials()
+	if err != nil {
+		return "", fmt.Errorf("GCS credentials: %v", err)
+	}
+	if creds.ClientEmail == "" || creds.PrivateKey == nil {
+		return "", errors.New("GCS credentials: no service account key")
+	}
+
+	s := &v4Signer{
+		algorithm: "GOOG4-RSA-SHA256",
+		prefix:    "X-Goog-",
+		now:       currentTime(p.now),
+		payload:   "UNSIGNED-PAYLOAD",
+	}
+	s.scope = s.date() + "/auto/storage/goog4_request"
+	s.credential = creds.ClientEmail + "/" + s.scope
+	s.sign = func(stringToSign string) ([]byte, error) {
+		digest := sha256.Sum256([]byte(stringToSign))
+		return rsa.SignPKCS1v15(rand.Reader, creds.PrivateKey, crypto.SHA256, digest[:])
+	}
+
+	return s.presign(method, p.BucketURL, key, expiry(expiresIn, p.Expiry))
+}
+
+func expiry(expiresIn, defaultExpiry time.Duration) time.Duration {
+	if expiresIn > 0 {
+		return expiresIn
+	}
+	if defaultExpiry > 0 {
+		return defaultExpiry
+	}
+	return DefaultPresignExpiry
+}
+
+func currentTime(now func() time.Time) time.Time {
+	if now != nil {
+		return now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// v4Signer presigns URLs the way S3 and GCS share: the canonical request
+// of the URL is hashed into a string to sign, and the signature becomes
+// a query parameter. Only the host header is signed.
+type v4Signer struct {
+	algorithm  string
+	prefix     string
+	scope      string
+	credential string
+	payload    string
+	extra      map[string]string
+	now        time.Time
+	sign       func(stringToSign string) ([]byte, error)
+}
+
+func (s *v4Signer) date() string {
+	return s.now.Format("20060102")
+}
+
+func (s *v4Signer) presign(method, bucketURL, key string, expiresIn time.Duration) (string, error) {
+	if expiresIn > MaxPresignExpiry {
+		return "", fmt.Errorf("expiry %v is longer than %v", expiresIn, MaxPresignExpiry)
+	}
+
+	scheme, host, path, err := splitBucketURL(bucketURL)
+	if err != nil {
+		return "", err
+	}
+	path += escapeKey(strings.TrimPrefix(key, "/"), false)
+
+	timestamp := s.now.Format("20060102T150405Z")
+	query := map[string]string{
+		s.prefix + "Algorithm":     s.algorithm,
+		s.prefix + "Credential":    s.credential,
+		s.prefix + "Date":          timestamp,
+		s.prefix + "Expires":       strconv.FormatInt(int64(expiresIn/time.Second), 10),
+		s.prefix + "SignedHeaders": "host",
+	}
+	for k, v := range s.extra {
+		query[k] = v
+	}
+	canonicalQuery := canonicalQueryString(query)
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		s.payload,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := s.algorithm + "\n" + timestamp + "\n" + s.scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signature, err := s.sign(stringToSign)
+	if err != nil {
+		return "", fmt.Errorf("sign: %v", err)
+	}
+
+	return scheme + "://" + host + path + "?" + canonicalQuery + "&" + s.prefix + "Signature=" + hex.EncodeToString(signature), nil
+}
+
+// splitBucketURL returns the parts of the bucket URL, with the path
+// escaped and ending in a slash
+func splitBucketURL(bucketURL string) (scheme, host, path string, err error) {
+	i := strings.Index(bucketURL, "://")
+	if i < 0 {
+		return "", "", "", fmt.Errorf("bucket URL %q is not absolute", bucketURL)
+	}
+	scheme, rest := bucketURL[:i], bucketURL[i+3:]
+
+	host, path = rest, "/"
+	if j := strings.Index(rest, "/"); j >= 0 {
+		host, path = rest[:j], rest[j:]
+	}
+	if host == "" || strings.ContainsAny(path, "?#") {
+		return "", "", "", fmt.Errorf("bucket URL %q must be a scheme, a host and a path", bucketURL)
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	return scheme, host, escapeKey(path, false), nil
+}
+
+func canonicalQueryString(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, escapeKey(k, true)+"="+escapeKey(query[k], true))
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapeKey percent-encodes everything but unreserved characters, and
+// slashes unless escapeSlash is set, as both S3 and GCS expect
+func escapeKey(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,6 +1,10 @@
 package objectstore
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	objectStorageUploadRequests = prometheus.NewCounterVec(
@@ -28,6 +32,29 @@ var (
 			Help:    "How long it took to upload objects",
 			Buckets: objectStorageUploadTimeBuckets,
 		})
+	objectStorageThrottledRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_object_storage_throttled_requests",
+			Help: "How many object storage requests were throttled with 503 Slow Down or 429 Too Many Requests, per bucket",
+		},
+		[]string{"bucket"},
+	)
+	objectStorageUploadThroughput = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_object_storage_upload_throughput_bytes_per_second",
+			Help:    "How fast objects were uploaded, by upload type",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 11),
+		},
+		[]string{"type"},
+	)
+	objectStorageUploadSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_object_storage_upload_size_bytes",
+			Help:    "How big uploaded objects were, by upload type",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 13),
+		},
+		[]string{"type"},
+	)
 
 	objectStorageUploadRequestsRequestFailed = objectStorageUploadRequests.WithLabelValues("request-failed")
 	objectStorageUploadRequestsInvalidStatus = objectStorageUploadRequests.WithLabelValues("invalid-status")
@@ -39,5 +66,22 @@ func init() {
 	prometheus.MustRegister(
 		objectStorageUploadRequests,
 		objectStorageUploadsOpen,
-		objectStorageUploadBytes)
+		objectStorageUploadBytes,
+		objectStorageThrottledRequests,
+		objectStorageUploadThroughput,
+		objectStorageUploadSize)
+}
+
+// Upload types of objectStorageUploadThroughput and objectStorageUploadSize
+const (
+	uploadTypeSingle    = "single"
+	uploadTypeMultipart = "multipart"
+)
+
+// observeUpload records the size and the throughput of a successful upload
+func observeUpload(uploadType string, size int64, elapsed time.Duration) {
+	objectStorageUploadSize.WithLabelValues(uploadType).Observe(float64(size))
+	if elapsed > 0 {
+		objectStorageUploadThroughput.WithLabelValues(uploadType).Observe(float64(size) / elapsed.Seconds())
+	}
 }
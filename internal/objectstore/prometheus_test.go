@@ -0,0 +1,72 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func histogram(t *testing.T, vec *prometheus.HistogramVec, uploadType string) *dto.Histogram {
+	m := &dto.Metric{}
+	require.NoError(t, vec.WithLabelValues(uploadType).(prometheus.Histogram).Write(m))
+	return m.GetHistogram()
+}
+
+func TestObserveUploadMetrics(t *testing.T) {
+	const content = "upload size and throughput"
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hasher := md5.New()
+		io.Copy(hasher, r.Body)
+		w.Header().Set("ETag", hex.EncodeToString(hasher.Sum(nil)))
+	}))
+	defer ts.Close()
+
+	sizes := histogram(t, objectStorageUploadSize, uploadTypeSingle)
+	throughputs := histogram(t, objectStorageUploadThroughput, uploadTypeSingle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := NewObject(ctx, ts.URL+"/bucket/object", "", nil, time.Now().Add(time.Minute), int64(len(content)))
+	require.NoError(t, err)
+	_, err = io.Copy(o, strings.NewReader(content))
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	// observeUpload records the throughput last
+	require.Eventually(t, func() bool {
+		return histogram(t, objectStorageUploadThroughput, uploadTypeSingle).GetSampleCount() == throughputs.GetSampleCount()+1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, sizes.GetSampleCount()+1, histogram(t, objectStorageUploadSize, uploadTypeSingle).GetSampleCount())
+	require.Equal(t, sizes.GetSampleSum()+float64(len(content)), histogram(t, objectStorageUploadSize, uploadTypeSingle).GetSampleSum())
+}
+
+func TestObserveUploadMetricsSkipsFailures(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	sizes := histogram(t, objectStorageUploadSize, uploadTypeSingle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	o, err := NewObject(ctx, ts.URL+"/bucket/object", "", nil, time.Now().Add(time.Minute), 4)
+	require.NoError(t, err)
+	io.Copy(o, strings.NewReader("fail"))
+	require.Error(t, o.Close())
+
+	// the metrics are observed after Close returns
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, sizes.GetSampleCount(), histogram(t, objectStorageUploadSize, uploadTypeSingle).GetSampleCount())
+}
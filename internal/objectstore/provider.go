@@ -0,0 +1,40 @@
+package objectstore
+
+import (
+	"context"
+	"io"
+)
+
+// Provider sends the requests of uploads to one kind of object storage, at
+// URLs presigned by Rails. Object and Multipart hold what all providers
+// share: the pipe the upload is written to, the goroutines sending it, and
+// the cleanup once Rails is done with the object.
+type Provider interface {
+	// Put stores size bytes of body as the object at url and returns its
+	// ETag
+	Put(ctx context.Context, url string, headers map[string]string, body io.Reader, size int64) (string, error)
+	// CompleteMultipart assembles the parts uploaded with Put into the
+	// object and returns its ETag
+	CompleteMultipart(ctx context.Context, url string, parts []*CompletedPart) (string, error)
+	// Abort drops the parts of a multipart upload
+	Abort(ctx context.Context, url string) error
+	// Delete removes the object at url
+	Delete(ctx context.Context, url string) error
+	// Head returns the size and the ETag of the object at url
+	Head(ctx context.Context, url string) (ObjectInfo, error)
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Size int64
+	ETag string
+}
+
+// ChecksumVerifier is implemented by providers that send a checksum of the
+// data along with it, so that object storage rejects corrupted uploads
+// itself and the ETag needs no comparison with the MD5 of the data
+type ChecksumVerifier interface {
+	// VerifiesChecksum tells if Put sends a checksum of size bytes. The
+	// size of some uploads is unknown.
+	VerifiesChecksum(size int64) bool
+}
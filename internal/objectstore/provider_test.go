@@ -0,0 +1,148 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider stores objects in memory and records the requests
+type fakeProvider struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	requests []string
+	putErr   error
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{objects: make(map[string]string)}
+}
+
+func (p *fakeProvider) record(request string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests = append(p.requests, request)
+}
+
+func (p *fakeProvider) recorded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+func (p *fakeProvider) Put(ctx context.Context, url string, headers map[string]string, body io.Reader, size int64) (string, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	p.record("PUT " + url)
+	if p.putErr != nil {
+		return "", p.putErr
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.objects[url] = string(data)
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (p *fakeProvider) CompleteMultipart(ctx context.Context, url string, parts []*CompletedPart) (string, error) {
+	p.record(fmt.Sprintf("COMPLETE %s %d", url, len(parts)))
+	return "multipart-etag", nil
+}
+
+func (p *fakeProvider) Abort(ctx context.Context, url string) error {
+	p.record("ABORT " + url)
+	return nil
+}
+
+func (p *fakeProvider) Delete(ctx context.Context, url string) error {
+	p.record("DELETE " + url)
+	return nil
+}
+
+func (p *fakeProvider) Head(ctx context.Context, url string) (ObjectInfo, error) {
+	return ObjectInfo{}, errors.New("not implemented")
+}
+
+func TestObjectUsesProvider(t *testing.T) {
+	provider := newFakeProvider()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	o, err := newObject(ctx, provider, "http://store/object", "http://store/delete", nil, time.Now().Add(time.Minute), 5, false)
+	require.NoError(t, err)
+
+	_, err = io.Copy(o, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+	require.Equal(t, "hello", provider.objects["http://store/object"])
+	require.Equal(t, "5d41402abc4b2a76b9719d911017c592", o.ETag())
+
+	cancel()
+	require.Eventually(t, func() bool { return len(provider.recorded()) == 2 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"PUT http://store/object", "DELETE http://store/delete"}, provider.recorded())
+}
+
+func TestMultipartUsesProvider(t *testing.T) {
+	provider := newFakeProvider()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := newMultipart(ctx, provider, []string{"http://store/part1", "http://store/part2"}, "http://store/complete", "http://store/abort", "", nil, time.Now().Add(time.Minute), 3, 1)
+	require.NoError(t, err)
+
+	_, err = io.Copy(m, strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, m.Close())
+	require.Equal(t, "multipart-etag", m.ETag())
+	require.Equal(t, []string{"PUT http://store/part1", "PUT http://store/part2", "COMPLETE http://store/complete 2"}, provider.recorded())
+}
+
+func TestMultipartAbortsWithProvider(t *testing.T) {
+	provider := newFakeProvider()
+	provider.putErr = errors.New("broken")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := newMultipart(ctx, provider, []string{"http://store/part1"}, "http://store/complete", "http://store/abort", "", nil, time.Now().Add(time.Minute), 5, 1)
+	require.NoError(t, err)
+
+	io.Copy(m, strings.NewReader("hello"))
+	require.Error(t, m.Close())
+	require.Eventually(t, func() bool { return len(provider.recorded()) == 2 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"PUT http://store/part1", "ABORT http://store/abort"}, provider.recorded())
+}
+
+func TestS3Head(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "HEAD", r.Method)
+		if r.URL.Path != "/bucket/object" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", "42")
+		w.Header().Set("ETag", `"5d41402abc4b2a76b9719d911017c592"`)
+	}))
+	defer ts.Close()
+
+	info, err := S3.Head(context.Background(), ts.URL+"/bucket/object")
+	require.NoError(t, err)
+	require.Equal(t, ObjectInfo{Size: 42, ETag: "5d41402abc4b2a76b9719d911017c592"}, info)
+
+	_, err = S3.Head(context.Background(), ts.URL+"/bucket/missing")
+	require.True(t, errors.Is(err, ErrObjectStoreUnavailable))
+	require.Contains(t, err.Error(), "404")
+}
@@ -7,10 +7,12 @@ import (
 
 // CompleteMultipartUpload is the S3 CompleteMultipartUpload body
 type CompleteMultipartUpload struct {
-	Part []*completeMultipartUploadPart
+	Part []*CompletedPart
 }
 
-type completeMultipartUploadPart struct {
+// CompletedPart is a part of a multipart upload, as listed in
+// CompleteMultipartUpload
+type CompletedPart struct {
 	PartNumber int
 	ETag       string
 }
@@ -0,0 +1,185 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"gitlab.com/gitlab-org/labkit/correlation"
+	"gitlab.com/gitlab-org/labkit/mask"
+	"gitlab.com/gitlab-org/labkit/tracing"
+)
+
+// httpTransport defines a http.Transport with values
+// that are more restrictive than for http.DefaultTransport,
+// they define shorter TLS Handshake, and more aggressive connection closing
+// to prevent the connection hanging and reduce FD usage
+var httpTransport = tracing.NewRoundTripper(correlation.NewInstrumentedRoundTripper(&http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 10 * time.Second,
+	}).DialContext,
+	MaxIdleConns:          2,
+	IdleConnTimeout:       30 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 10 * time.Second,
+	ResponseHeaderTimeout: 30 * time.Second,
+}))
+
+var httpClient = &http.Client{
+	Transport: httpTransport,
+}
+
+// S3 is the Provider of the S3 API, which Google Cloud Storage and most
+// other object storages speak too
+var S3 Provider = s3Provider{}
+
+// S3TrailingChecksum is S3 sending a CRC32 checksum of the uploads of known
+// size in a trailer
+var S3TrailingChecksum Provider = s3Provider{trailingChecksum: true}
+
+type s3Provider struct {
+	trailingChecksum bool
+}
+
+func (p s3Provider) VerifiesChecksum(size int64) bool {
+	return p.trailingChecksum && size >= 0
+}
+
+func (p s3Provider) Put(ctx context.Context, url string, headers map[string]string, body io.Reader, size int64) (string, error) {
+	length := size
+	if p.VerifiesChecksum(size) {
+		body = newAWSChunkedReader(body, size)
+		length = awsChunkedLength(size)
+	}
+
+	// we should prevent body.Close() otherwise it may shadow error set with pr.CloseWithError(err)
+	req, err := http.NewRequest(http.MethodPut, url, ioutil.NopCloser(body))
+	if err != nil {
+		return "", fmt.Errorf("PUT %q: %v", mask.URL(url), err)
+	}
+	req.ContentLength = length
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if p.VerifiesChecksum(size) {
+		req.Header.Set("Content-Encoding", "aws-chunked")
+		req.Header.Set("X-Amz-Content-Sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER")
+		req.Header.Set("X-Amz-Decoded-Content-Length", strconv.FormatInt(size, 10))
+		req.Header.Set("X-Amz-Trailer", checksumTrailer)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", requestError(ctx, fmt.Sprintf("PUT request %q", mask.URL(url)), err)
+	}
+	defer resp.Body.Close()
+
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		ext.HTTPStatusCode.Set(span, uint16(resp.StatusCode))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", StatusCodeError(statusError(resp, fmt.Sprintf("PUT request %v", mask.URL(url))))
+	}
+
+	return trimETag(resp.Header.Get("ETag")), nil
+}
+
+func (s3Provider) CompleteMultipart(ctx context.Context, url string, parts []*CompletedPart) (string, error) {
+	body, err := xml.Marshal(&CompleteMultipartUpload{Part: parts})
+	if err != nil {
+		return "", fmt.Errorf("marshal CompleteMultipartUpload request: %v", err)
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("create CompleteMultipartUpload request: %v", err)
+	}
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", requestError(ctx, fmt.Sprintf("CompleteMultipartUpload request %q", mask.URL(url)), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", statusError(resp, fmt.Sprintf("CompleteMultipartUpload request %v", mask.URL(url)))
+	}
+
+	result := &compoundCompleteMultipartUploadResult{}
+	decoder := xml.NewDecoder(resp.Body)
+	if err := decoder.Decode(&result); err != nil {
+		return "", fmt.Errorf("%w: decode CompleteMultipartUpload answer: %v", ErrObjectStoreUnavailable, err)
+	}
+
+	if result.isError() {
+		return "", remoteError{result}
+	}
+
+	if result.CompleteMultipartUploadResult == nil {
+		return "", fmt.Errorf("%w: empty CompleteMultipartUploadResult", ErrObjectStoreUnavailable)
+	}
+
+	return trimETag(result.ETag), nil
+}
+
+// Abort sends AbortMultipartUpload, a DELETE like RemoveObject
+func (p s3Provider) Abort(ctx context.Context, url string) error {
+	return p.Delete(ctx, url)
+}
+
+func (s3Provider) Delete(ctx context.Context, url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s3Provider) Head(ctx context.Context, url string) (ObjectInfo, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("HEAD %q: %v", mask.URL(url), err)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return ObjectInfo{}, requestError(ctx, fmt.Sprintf("HEAD request %q", mask.URL(url)), err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ObjectInfo{}, statusError(resp, fmt.Sprintf("HEAD request %v", mask.URL(url)))
+	}
+
+	return ObjectInfo{Size: resp.ContentLength, ETag: trimETag(resp.Header.Get("ETag"))}, nil
+}
+
+// trimETag removes the quotes S3 puts around ETags
+func trimETag(rawETag string) string {
+	if len(rawETag) >= 2 && rawETag[0] == '"' {
+		rawETag = rawETag[1 : len(rawETag)-1]
+	}
+	return rawETag
+}
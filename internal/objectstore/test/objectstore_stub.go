@@ -146,6 +146,20 @@ func (o *ObjectstoreStub) removeObject(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (o *ObjectstoreStub) headObject(w http.ResponseWriter, r *http.Request) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	etag, ok := o.bucket[r.URL.Path]
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(200)
+}
+
 func (o *ObjectstoreStub) putObject(w http.ResponseWriter, r *http.Request) {
 	o.m.Lock()
 	defer o.m.Unlock()
@@ -272,6 +286,8 @@ func (o *ObjectstoreStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		o.putObject(w, r)
 	case "POST":
 		o.completeMultipartUpload(w, r)
+	case "HEAD":
+		o.headObject(w, r)
 	default:
 		w.WriteHeader(404)
 	}
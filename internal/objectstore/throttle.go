@@ -0,0 +1,134 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxThrottledAttempts is how often a request object storage throttles
+	// is sent in total
+	maxThrottledAttempts = 5
+	// Without Retry-After, the backoff starts at minThrottleBackoff and
+	// doubles with each attempt
+	minThrottleBackoff = 500 * time.Millisecond
+	// maxThrottleBackoff caps the wait for a Retry-After too far off
+	maxThrottleBackoff = time.Minute
+)
+
+// ErrThrottled means that object storage asked to slow down, with 503
+// Slow Down or 429 Too Many Requests
+var ErrThrottled = errors.New("object storage throttled the request")
+
+// responseError is an answer of object storage with another status than
+// 200 OK. It is ErrObjectStoreUnavailable, and ErrThrottled when object
+// storage asked to slow down.
+type responseError struct {
+	error
+	status int
+	// retryAfter is the wait object storage asked for, or 0
+	retryAfter time.Duration
+}
+
+func (e *responseError) Is(target error) bool {
+	return target == ErrThrottled && e.throttled()
+}
+
+func (e *responseError) Unwrap() error {
+	return e.error
+}
+
+func (e *responseError) throttled() bool {
+	return e.status == http.StatusServiceUnavailable || e.status == http.StatusTooManyRequests
+}
+
+// statusError is the error of a request to object storage that was
+// answered with another status than 200 OK
+func statusError(resp *http.Response, request string) error {
+	err := &responseError{
+		error:  fmt.Errorf("%w: %s returned: %s", ErrObjectStoreUnavailable, request, resp.Status),
+		status: resp.StatusCode,
+	}
+	if err.throttled() {
+		objectStorageThrottledRequests.WithLabelValues(bucketName(resp.Request.URL)).Inc()
+		err.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	}
+	return err
+}
+
+// parseRetryAfter reads a Retry-After header of seconds or of an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryThrottled calls do until it succeeds, fails with another error than
+// ErrThrottled, or the next attempt would not start before the deadline of
+// ctx. do must send the whole request again.
+func retryThrottled(ctx context.Context, do func() error) error {
+	backoff := minThrottleBackoff
+	for attempt := 1; ; attempt++ {
+		err := do()
+
+		var throttled *responseError
+		if !errors.As(err, &throttled) || !throttled.throttled() || attempt == maxThrottledAttempts {
+			return err
+		}
+
+		wait := throttled.retryAfter
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		if wait > maxThrottleBackoff {
+			wait = maxThrottleBackoff
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// bucketName guesses the bucket of a presigned URL, from the host of
+// virtual-hosted style URLs like https://bucket.s3.amazonaws.com/key, or
+// else from the path, like https://storage.googleapis.com/bucket/key
+func bucketName(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+
+	host := u.Hostname()
+	for _, service := range []string{".s3.", ".s3-", ".storage.googleapis.com"} {
+		if i := strings.Index(host, service); i > 0 {
+			return host[:i]
+		}
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
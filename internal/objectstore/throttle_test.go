@@ -0,0 +1,50 @@
+package objectstore
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"0", 0},
+		{"-3", 0},
+		{"soon", 0},
+		{"Mon, 04 May 2020 12:00:30 GMT", 30 * time.Second},
+		{"Mon, 04 May 2020 11:00:00 GMT", 0},
+	}
+
+	for _, tc := range tests {
+		require.Equal(t, tc.expected, parseRetryAfter(tc.value, now), "Retry-After: %q", tc.value)
+	}
+}
+
+func TestBucketName(t *testing.T) {
+	tests := []struct {
+		url    string
+		bucket string
+	}{
+		{"https://my-bucket.s3.amazonaws.com/tmp/uploads/1", "my-bucket"},
+		{"https://my-bucket.s3.eu-central-1.amazonaws.com/tmp/uploads/1", "my-bucket"},
+		{"https://my-bucket.s3-eu-west-1.amazonaws.com/tmp/uploads/1", "my-bucket"},
+		{"https://my-bucket.storage.googleapis.com/tmp/uploads/1", "my-bucket"},
+		{"https://storage.googleapis.com/my-bucket/tmp/uploads/1", "my-bucket"},
+		{"http://minio.example.com:9000/my-bucket/tmp/uploads/1", "my-bucket"},
+	}
+
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		require.NoError(t, err)
+		require.Equal(t, tc.bucket, bucketName(u), tc.url)
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"fmt"
 	"hash"
 	"io"
-	"net/http"
 
+	"gitlab.com/gitlab-org/labkit/correlation"
 	"gitlab.com/gitlab-org/labkit/log"
 	"gitlab.com/gitlab-org/labkit/mask"
 )
@@ -16,6 +17,9 @@ import (
 type Upload interface {
 	io.WriteCloser
 	ETag() string
+	// Abort fails the upload with err rather than completing it with the
+	// data written so far
+	Abort(err error)
 }
 
 // uploader is an io.WriteCloser that can be used as write end of the uploading pipe.
@@ -26,36 +30,51 @@ type uploader struct {
 	// md5 is an optional hasher for calculating md5 on the fly
 	md5 hash.Hash
 
-	w io.Writer
-	c io.Closer
+	w  io.Writer
+	pw *io.PipeWriter
+
+	// provider sends the requests of the upload
+	provider Provider
 
 	// uploadError is the last error occourred during upload
 	uploadError error
 	// ctx is the internal context bound to the upload request
 	ctx context.Context
+	// cancel cancels ctx
+	cancel context.CancelFunc
+	// done is closed once the upload finished and uploadError is set. ctx
+	// may be done before, e.g. when the upload is aborted.
+	done chan struct{}
 }
 
-func newUploader(ctx context.Context, w io.WriteCloser) uploader {
-	return uploader{w: w, c: w, ctx: ctx}
+func newUploader(ctx context.Context, cancel context.CancelFunc, pw *io.PipeWriter, provider Provider) uploader {
+	return uploader{w: pw, pw: pw, provider: provider, ctx: ctx, cancel: cancel, done: make(chan struct{})}
 }
 
-func newMD5Uploader(ctx context.Context, w io.WriteCloser) uploader {
+func newMD5Uploader(ctx context.Context, cancel context.CancelFunc, pw *io.PipeWriter, provider Provider) uploader {
 	hasher := md5.New()
-	mw := io.MultiWriter(w, hasher)
-	return uploader{w: mw, c: w, md5: hasher, ctx: ctx}
+	mw := io.MultiWriter(pw, hasher)
+	return uploader{w: mw, pw: pw, md5: hasher, provider: provider, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+// finish marks the upload as finished. The goroutine uploading calls it
+// once, after setting uploadError.
+func (u *uploader) finish() {
+	close(u.done)
+	u.cancel()
 }
 
 // Close implements the standard io.Closer interface: it closes the http client request.
 // This method will also wait for the connection to terminate and return any error occurred during the upload
 func (u *uploader) Close() error {
-	if err := u.c.Close(); err != nil {
+	if err := u.pw.Close(); err != nil {
 		return err
 	}
 
-	<-u.ctx.Done()
+	<-u.done
 
 	if err := u.ctx.Err(); err == context.DeadlineExceeded {
-		return err
+		return fmt.Errorf("%w: %v", ErrDeadlineExceeded, err)
 	}
 
 	return u.uploadError
@@ -65,35 +84,28 @@ func (u *uploader) Write(p []byte) (int, error) {
 	return u.w.Write(p)
 }
 
-// syncAndDelete wait for Context to be Done and then performs the requested HTTP call
-func (u *uploader) syncAndDelete(url string) {
+// Abort fails the upload with err, e.g. because the client went away, and
+// cancels the requests to object storage in flight. Closing the pipe
+// would complete the upload with the data written so far.
+func (u *uploader) Abort(err error) {
+	u.pw.CloseWithError(err)
+	u.cancel()
+}
+
+// syncAndDelete wait for Context to be Done and then performs the requested cleanup call,
+// Delete or Abort of the provider
+func (u *uploader) syncAndDelete(url string, request func(context.Context, string) error) {
 	if url == "" {
 		return
 	}
 
 	<-u.ctx.Done()
 
-	req, err := http.NewRequest("DELETE", url, nil)
-	if err != nil {
-		log.WithError(err).WithField("object", mask.URL(url)).Warning("Delete failed")
-		return
-	}
-	// TODO: consider adding the context to the outgoing request for better instrumentation
-
 	// here we are not using u.ctx because we must perform cleanup regardless of parent context
-	resp, err := httpClient.Do(req)
-	if err != nil {
+	ctx := correlation.ContextWithCorrelation(context.Background(), correlation.ExtractFromContext(u.ctx))
+	if err := request(ctx, url); err != nil {
 		log.WithError(err).WithField("object", mask.URL(url)).Warning("Delete failed")
-		return
 	}
-	resp.Body.Close()
-}
-
-func (u *uploader) extractETag(rawETag string) {
-	if rawETag != "" && rawETag[0] == '"' {
-		rawETag = rawETag[1 : len(rawETag)-1]
-	}
-	u.etag = rawETag
 }
 
 func (u *uploader) md5Sum() string {
@@ -106,9 +118,9 @@ func (u *uploader) md5Sum() string {
 }
 
 // ETag returns the checksum of the uploaded object returned by the ObjectStorage provider via ETag Header.
-// This method will wait until upload context is done before returning.
+// This method will wait until the upload is finished before returning.
 func (u *uploader) ETag() string {
-	<-u.ctx.Done()
+	<-u.done
 
 	return u.etag
 }
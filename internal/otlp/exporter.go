@@ -0,0 +1,302 @@
+package otlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+const (
+	maxBatchSize  = 512
+	maxQueueSize  = 4096
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// Span kinds and status codes of the OTLP protocol
+const (
+	kindInternal = 1
+	kindServer   = 2
+	kindClient   = 3
+
+	statusError = 2
+)
+
+var exportedSpans = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_otlp_spans",
+		Help: "How many tracing spans were sent to the OTLP collector (exported), could not be sent (failed) or were dropped because the queue was full (dropped)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(exportedSpans)
+}
+
+// The JSON encoding of OTLP, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Events            []otlpEvent     `json:"events,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string          `json:"timeUnixNano"`
+	Name         string          `json:"name"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func attribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		s := fmt.Sprint(v)
+		a.Value.IntValue = &s
+	case float32:
+		f := float64(v)
+		a.Value.DoubleValue = &f
+	case float64:
+		a.Value.DoubleValue = &v
+	case string:
+		a.Value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+
+	return a
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// toOTLP converts a finished span
+func (s *span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.context.traceID[:]),
+		SpanID:            hex.EncodeToString(s.context.spanID[:]),
+		Name:              s.name,
+		Kind:              kindInternal,
+		StartTimeUnixNano: unixNano(s.start),
+		EndTimeUnixNano:   unixNano(s.end),
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+
+	for k, v := range s.tags {
+		switch {
+		case k == string(ext.SpanKind):
+			switch fmt.Sprint(v) {
+			case string(ext.SpanKindRPCServerEnum):
+				o.Kind = kindServer
+			case string(ext.SpanKindRPCClientEnum):
+				o.Kind = kindClient
+			}
+		case k == string(ext.Error) && v == true:
+			o.Status = &otlpStatus{Code: statusError}
+		default:
+			o.Attributes = append(o.Attributes, attribute(k, v))
+		}
+	}
+
+	for _, e := range s.events {
+		oe := otlpEvent{TimeUnixNano: unixNano(e.time), Name: "log"}
+		for _, f := range e.fields {
+			if f.Key() == "event" {
+				oe.Name = fmt.Sprint(f.Value())
+				continue
+			}
+			oe.Attributes = append(oe.Attributes, attribute(f.Key(), f.Value()))
+		}
+		o.Events = append(o.Events, oe)
+	}
+
+	return o
+}
+
+// exporter sends spans in batches to the OTLP/HTTP endpoint of a collector
+type exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	mu    sync.Mutex
+	queue []otlpSpan
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newExporter(url, serviceName string) *exporter {
+	e := &exporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: exportTimeout},
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	e.wg.Add(1)
+	go e.run()
+
+	return e
+}
+
+func (e *exporter) add(s *span) {
+	o := s.toOTLP()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.queue) >= maxQueueSize {
+		exportedSpans.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	e.queue = append(e.queue, o)
+	if len(e.queue) >= maxBatchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *exporter) run() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.flush:
+		case <-e.done:
+			e.export()
+			return
+		}
+		e.export()
+	}
+}
+
+// export sends the queued spans
+func (e *exporter) export() {
+	for {
+		e.mu.Lock()
+		n := len(e.queue)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		batch := e.queue[:n]
+		e.queue = e.queue[n:]
+		e.mu.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		result := "exported"
+		if err := e.send(batch); err != nil {
+			log.WithError(err).Warn("otlp: exporting spans failed")
+			result = "failed"
+		}
+		exportedSpans.WithLabelValues(result).Add(float64(len(batch)))
+	}
+}
+
+func (e *exporter) send(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: []otlpAttribute{attribute("service.name", e.serviceName)}},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "gitlab-workhorse"}, Spans: spans}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", e.url, resp.Status)
+	}
+
+	return nil
+}
+
+// Close sends the remaining spans
+func (e *exporter) Close() error {
+	close(e.done)
+	e.wg.Wait()
+	return nil
+}
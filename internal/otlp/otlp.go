@@ -0,0 +1,75 @@
+/*
+Package otlp sends tracing spans to an OpenTelemetry collector over
+OTLP/HTTP, as an alternative to the tracers built into labkit.
+
+It is selected with a GITLAB_TRACING connection string like
+
+	opentracing://otlp?endpoint=http://localhost:4318&sample_rate=0.1
+
+Span contexts are propagated in W3C traceparent headers.
+*/
+package otlp
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"gitlab.com/gitlab-org/labkit/tracing/connstr"
+)
+
+const (
+	driverName      = "otlp"
+	defaultEndpoint = "http://localhost:4318"
+	tracesPath      = "/v1/traces"
+)
+
+// Initialize sets up the OTLP tracer as the global tracer if
+// connectionString selects it. It returns false if another tracer was
+// selected, which labkit should set up instead.
+func Initialize(connectionString, serviceName string) (io.Closer, bool, error) {
+	driver, options, err := connstr.Parse(connectionString)
+	if err != nil || driver != driverName {
+		return nil, false, nil
+	}
+
+	t, err := newTracer(options, serviceName)
+	if err != nil {
+		return nil, true, err
+	}
+
+	opentracing.SetGlobalTracer(t)
+	return t.exporter, true, nil
+}
+
+func newTracer(options map[string]string, serviceName string) (*tracer, error) {
+	endpoint := defaultEndpoint
+	if e, ok := options["endpoint"]; ok {
+		endpoint = e
+	}
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("otlp: endpoint must be an http:// or https:// URL: %q", endpoint)
+	}
+
+	sampleRate := 1.0
+	if s, ok := options["sample_rate"]; ok {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("otlp: sample_rate must be between 0 and 1: %q", s)
+		}
+		sampleRate = rate
+	}
+
+	if s, ok := options["service_name"]; ok {
+		serviceName = s
+	}
+
+	return &tracer{
+		exporter:   newExporter(strings.TrimSuffix(endpoint, "/")+tracesPath, serviceName),
+		sampleRate: sampleRate,
+		random:     rand.Float64,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package otlp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInitialize(t *testing.T) {
+	_, selected, err := Initialize("opentracing://jaeger", "gitlab-workhorse")
+	require.NoError(t, err)
+	require.False(t, selected, "other drivers are left to labkit")
+
+	_, selected, err = Initialize("", "gitlab-workhorse")
+	require.NoError(t, err)
+	require.False(t, selected)
+
+	_, selected, err = Initialize("opentracing://otlp?sample_rate=2", "gitlab-workhorse")
+	require.True(t, selected)
+	require.Error(t, err)
+
+	_, _, err = Initialize("opentracing://otlp?endpoint=localhost:4318", "gitlab-workhorse")
+	require.Error(t, err)
+}
+
+func TestPropagation(t *testing.T) {
+	tr := &tracer{exporter: &exporter{}, sampleRate: 1, random: func() float64 { return 0 }}
+
+	parent := tr.StartSpan("parent")
+	header := http.Header{}
+	require.NoError(t, tr.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)))
+	require.Regexp(t, `\A00-[0-9a-f]{32}-[0-9a-f]{16}-01\z`, header.Get("traceparent"))
+
+	extracted, err := tr.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+	require.NoError(t, err)
+	require.Equal(t, parent.Context(), extracted)
+
+	child := tr.StartSpan("child", opentracing.ChildOf(extracted)).(*span)
+	require.Equal(t, parent.(*span).context.traceID, child.context.traceID)
+	require.Equal(t, parent.(*span).context.spanID, child.parentID)
+	require.NotEqual(t, child.parentID, child.context.spanID)
+
+	_, err = tr.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(http.Header{}))
+	require.Equal(t, opentracing.ErrSpanContextNotFound, err)
+
+	for _, invalid := range []string{"garbage", "00-00000000000000000000000000000000-0000000000000000-01", "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"} {
+		_, ok := parseTraceparent(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
+func TestExport(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		var req otlpRequest
+		require.NoError(t, json.Unmarshal(body, &req))
+		requests <- req
+	}))
+	defer ts.Close()
+
+	tr, err := newTracer(map[string]string{"endpoint": ts.URL}, "gitlab-workhorse")
+	require.NoError(t, err)
+
+	s := tr.StartSpan("proxy", ext.SpanKindRPCServer)
+	s.SetTag("http.response_size", int64(42))
+	ext.Error.Set(s, true)
+	s.LogKV("event", "retry", "attempt", 2)
+	s.Finish()
+
+	tr.sampleRate = 0
+	tr.StartSpan("unsampled").Finish()
+
+	require.NoError(t, tr.exporter.Close())
+
+	req := <-requests
+	require.Len(t, req.ResourceSpans, 1)
+	require.Equal(t, "service.name", req.ResourceSpans[0].Resource.Attributes[0].Key)
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	require.Equal(t, "proxy", spans[0].Name)
+	require.Equal(t, kindServer, spans[0].Kind)
+	require.Equal(t, &otlpStatus{Code: statusError}, spans[0].Status)
+	require.Equal(t, "http.response_size", spans[0].Attributes[0].Key)
+	require.Equal(t, "42", *spans[0].Attributes[0].Value.IntValue)
+	require.Equal(t, "retry", spans[0].Events[0].Name)
+}
@@ -0,0 +1,298 @@
+package otlp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/log"
+)
+
+// The W3C trace context header, understood by OpenTelemetry services
+const traceparentHeader = "traceparent"
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+	baggage map[string]string
+}
+
+func (c spanContext) ForeachBaggageItem(handler func(k, v string) bool) {
+	for k, v := range c.baggage {
+		if !handler(k, v) {
+			return
+		}
+	}
+}
+
+func (c spanContext) traceparent() string {
+	flags := "00"
+	if c.sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", c.traceID, c.spanID, flags)
+}
+
+func parseTraceparent(value string) (spanContext, bool) {
+	var c spanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return c, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(c.traceID) {
+		return c, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(c.spanID) {
+		return c, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return c, false
+	}
+
+	copy(c.traceID[:], traceID)
+	copy(c.spanID[:], spanID)
+	if c.traceID == [16]byte{} || c.spanID == [8]byte{} {
+		return c, false
+	}
+	c.sampled = flags[0]&1 == 1
+
+	return c, true
+}
+
+// tracer is an opentracing.Tracer that sends sampled spans to an exporter
+type tracer struct {
+	exporter   *exporter
+	sampleRate float64
+	random     func() float64
+}
+
+func (t *tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	var sso opentracing.StartSpanOptions
+	for _, o := range opts {
+		o.Apply(&sso)
+	}
+
+	s := &span{
+		tracer: t,
+		name:   operationName,
+		start:  sso.StartTime,
+		tags:   make(map[string]interface{}, len(sso.Tags)),
+	}
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	for k, v := range sso.Tags {
+		s.tags[k] = v
+	}
+
+	for _, ref := range sso.References {
+		parent, ok := ref.ReferencedContext.(spanContext)
+		if !ok {
+			continue
+		}
+
+		s.context.traceID = parent.traceID
+		s.context.sampled = parent.sampled
+		s.parentID = parent.spanID
+		if len(parent.baggage) > 0 {
+			s.context.baggage = make(map[string]string, len(parent.baggage))
+			for k, v := range parent.baggage {
+				s.context.baggage[k] = v
+			}
+		}
+		break
+	}
+
+	if s.parentID == [8]byte{} {
+		rand.Read(s.context.traceID[:])
+		s.context.sampled = t.random() < t.sampleRate
+	}
+	rand.Read(s.context.spanID[:])
+
+	return s
+}
+
+func (t *tracer) Inject(sc opentracing.SpanContext, format interface{}, carrier interface{}) error {
+	c, ok := sc.(spanContext)
+	if !ok {
+		return opentracing.ErrInvalidSpanContext
+	}
+
+	switch format {
+	case opentracing.HTTPHeaders, opentracing.TextMap:
+	default:
+		return opentracing.ErrUnsupportedFormat
+	}
+
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+
+	writer.Set(traceparentHeader, c.traceparent())
+	return nil
+}
+
+func (t *tracer) Extract(format interface{}, carrier interface{}) (opentracing.SpanContext, error) {
+	switch format {
+	case opentracing.HTTPHeaders, opentracing.TextMap:
+	default:
+		return nil, opentracing.ErrUnsupportedFormat
+	}
+
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return nil, opentracing.ErrInvalidCarrier
+	}
+
+	var c spanContext
+	found := false
+	err := reader.ForeachKey(func(key, val string) error {
+		if strings.EqualFold(key, traceparentHeader) {
+			c, found = parseTraceparent(val)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, opentracing.ErrSpanContextNotFound
+	}
+
+	return c, nil
+}
+
+type event struct {
+	time   time.Time
+	fields []log.Field
+}
+
+type span struct {
+	tracer   *tracer
+	parentID [8]byte
+
+	mu       sync.Mutex
+	context  spanContext
+	name     string
+	start    time.Time
+	end      time.Time
+	tags     map[string]interface{}
+	events   []event
+	finished bool
+}
+
+func (s *span) Finish() {
+	s.FinishWithOptions(opentracing.FinishOptions{})
+}
+
+func (s *span) FinishWithOptions(opts opentracing.FinishOptions) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+
+	s.end = opts.FinishTime
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	for _, r := range opts.LogRecords {
+		s.events = append(s.events, event{time: r.Timestamp, fields: r.Fields})
+	}
+	for _, ld := range opts.BulkLogData {
+		r := ld.ToLogRecord()
+		s.events = append(s.events, event{time: r.Timestamp, fields: r.Fields})
+	}
+	sampled := s.context.sampled
+	s.mu.Unlock()
+
+	if sampled {
+		s.tracer.exporter.add(s)
+	}
+}
+
+func (s *span) Context() opentracing.SpanContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.context
+}
+
+func (s *span) SetOperationName(operationName string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = operationName
+	return s
+}
+
+func (s *span) SetTag(key string, value interface{}) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags[key] = value
+	return s
+}
+
+func (s *span) LogFields(fields ...log.Field) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event{time: time.Now(), fields: fields})
+}
+
+func (s *span) LogKV(alternatingKeyValues ...interface{}) {
+	fields, err := log.InterleavedKVToFields(alternatingKeyValues...)
+	if err != nil {
+		fields = []log.Field{log.Error(err)}
+	}
+	s.LogFields(fields...)
+}
+
+func (s *span) SetBaggageItem(restrictedKey, value string) opentracing.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Span contexts are values, other spans must not see the new item
+	baggage := make(map[string]string, len(s.context.baggage)+1)
+	for k, v := range s.context.baggage {
+		baggage[k] = v
+	}
+	baggage[restrictedKey] = value
+	s.context.baggage = baggage
+
+	return s
+}
+
+func (s *span) BaggageItem(restrictedKey string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.context.baggage[restrictedKey]
+}
+
+func (s *span) Tracer() opentracing.Tracer {
+	return s.tracer
+}
+
+func (s *span) LogEvent(event string) {
+	s.LogFields(log.String("event", event))
+}
+
+func (s *span) LogEventWithPayload(event string, payload interface{}) {
+	s.LogFields(log.String("event", event), log.Object("payload", payload))
+}
+
+func (s *span) Log(data opentracing.LogData) {
+	r := data.ToLogRecord()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event{time: r.Timestamp, fields: r.Fields})
+}
@@ -0,0 +1,114 @@
+package profiling
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Samples per second, like the CPU profiler
+const fgprofHz = 99
+
+var samplerName = runtime.FuncForPC(reflect.ValueOf(sampleGoroutines).Pointer()).Name()
+
+// fgprof samples the stacks of all goroutines, whether they run or wait,
+// like github.com/felixge/fgprof. Unlike a CPU profile it shows where
+// requests spend their time waiting for Rails, Gitaly or object storage.
+// The result is in the folded format of flame graph tools.
+func fgprof(w http.ResponseWriter, r *http.Request) {
+	seconds, _ := strconv.Atoi(r.URL.Query().Get("seconds"))
+
+	ticker := time.NewTicker(time.Second / fgprofHz)
+	defer ticker.Stop()
+	timeout := time.NewTimer(time.Duration(seconds) * time.Second)
+	defer timeout.Stop()
+
+	counts := make(map[[32]uintptr]int)
+	var records []runtime.StackRecord
+
+sampling:
+	for {
+		select {
+		case <-ticker.C:
+			records = sampleGoroutines(records)
+			for _, rec := range records {
+				counts[rec.Stack0]++
+			}
+		case <-timeout.C:
+			break sampling
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeFolded(w, counts)
+}
+
+// sampleGoroutines returns the stacks of all goroutines, reusing records
+func sampleGoroutines(records []runtime.StackRecord) []runtime.StackRecord {
+	for {
+		n, ok := runtime.GoroutineProfile(records[:cap(records)])
+		if ok {
+			return records[:n]
+		}
+		records = make([]runtime.StackRecord, n*2)
+	}
+}
+
+func writeFolded(w http.ResponseWriter, counts map[[32]uintptr]int) {
+	folded := make(map[string]int)
+	for stack, count := range counts {
+		if f := fold(stack); f != "" {
+			folded[f] += count
+		}
+	}
+
+	lines := make([]string, 0, len(folded))
+	for f, count := range folded {
+		lines = append(lines, fmt.Sprintf("%s %d\n", f, count))
+	}
+	sort.Strings(lines)
+
+	for _, l := range lines {
+		fmt.Fprint(w, l)
+	}
+}
+
+// fold turns a stack into "root;caller;leaf", or "" for the stack of the
+// sampler itself
+func fold(stack [32]uintptr) string {
+	pcs := stack[:]
+	for i, pc := range pcs {
+		if pc == 0 {
+			pcs = pcs[:i]
+			break
+		}
+	}
+
+	var functions []string
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.Function == samplerName {
+			return ""
+		}
+		if frame.Function != "" {
+			functions = append(functions, frame.Function)
+		}
+		if !more {
+			break
+		}
+	}
+
+	for i, j := 0, len(functions)-1; i < j; i, j = i+1, j-1 {
+		functions[i], functions[j] = functions[j], functions[i]
+	}
+
+	return strings.Join(functions, ";")
+}
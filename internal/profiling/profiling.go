@@ -0,0 +1,102 @@
+/*
+Package profiling serves runtime profiles on the Prometheus listener, to
+debug latency in production without a redeploy.
+
+The pprof and fgprof endpoints need the bearer token of the profiling
+configuration. Execution traces slow down every request, so they need a
+request signed by Rails instead.
+*/
+package profiling
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const (
+	defaultMaxDuration = time.Minute
+	// The default duration of pprof CPU profiles
+	defaultProfileDuration = 30 * time.Second
+)
+
+// Register adds the profiling endpoints to mux if they are enabled
+func Register(mux *http.ServeMux, cfg config.ProfilingConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if cfg.TokenFile == "" {
+		return fmt.Errorf("profiling: TokenFile is required")
+	}
+	data, err := ioutil.ReadFile(cfg.TokenFile)
+	if err != nil {
+		return fmt.Errorf("profiling: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("profiling: %s is empty", cfg.TokenFile)
+	}
+
+	maxDuration := defaultMaxDuration
+	if cfg.MaxDuration != nil {
+		maxDuration = cfg.MaxDuration.Duration
+	}
+	if maxDuration < time.Second {
+		return fmt.Errorf("profiling: MaxDuration must be at least one second")
+	}
+
+	protect := func(h http.HandlerFunc) http.Handler {
+		return helper.RequireBearerToken(token, limitSeconds(maxDuration, h))
+	}
+
+	mux.Handle("/debug/pprof/", protect(pprof.Index))
+	mux.Handle("/debug/pprof/cmdline", protect(pprof.Cmdline))
+	mux.Handle("/debug/pprof/profile", protect(pprof.Profile))
+	mux.Handle("/debug/pprof/symbol", protect(pprof.Symbol))
+	mux.Handle("/debug/fgprof", protect(fgprof))
+	mux.Handle("/debug/trace", &traceHandler{maxDuration: maxDuration})
+
+	return nil
+}
+
+// limitSeconds rejects profiles that would take longer than max, and makes
+// the pprof default explicit so that it is limited too
+func limitSeconds(max time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		if query.Get("seconds") == "" {
+			if r.URL.Path != "/debug/pprof/profile" && r.URL.Path != "/debug/fgprof" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			d := defaultProfileDuration
+			if d > max {
+				d = max
+			}
+			query.Set("seconds", strconv.Itoa(int(d/time.Second)))
+			r.URL.RawQuery = query.Encode()
+		}
+
+		seconds, err := strconv.Atoi(query.Get("seconds"))
+		if err != nil || seconds <= 0 {
+			helper.HTTPError(w, r, "Bad Request: invalid seconds", http.StatusBadRequest)
+			return
+		}
+		if time.Duration(seconds)*time.Second > max {
+			helper.HTTPError(w, r, fmt.Sprintf("Bad Request: profiles are limited to %v", max), http.StatusBadRequest)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,164 @@
+package profiling
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const testToken = "s3cr3t"
+
+func newServer(t *testing.T, maxDuration time.Duration) *httptest.Server {
+	dir, err := ioutil.TempDir("", "profiling")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // The token is read by Register
+
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte(testToken+"\n"), 0600))
+
+	mux := http.NewServeMux()
+	cfg := config.ProfilingConfig{
+		Enabled:     true,
+		TokenFile:   tokenFile,
+		MaxDuration: &config.TomlDuration{Duration: maxDuration},
+	}
+	require.NoError(t, Register(mux, cfg))
+
+	return httptest.NewServer(mux)
+}
+
+func get(t *testing.T, url, token string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestRegisterDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	require.NoError(t, Register(mux, config.ProfilingConfig{}))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRegisterNeedsToken(t *testing.T) {
+	require.Error(t, Register(http.NewServeMux(), config.ProfilingConfig{Enabled: true}))
+	require.Error(t, Register(http.NewServeMux(), config.ProfilingConfig{Enabled: true, TokenFile: "/nonexistent"}))
+}
+
+func TestPprofNeedsToken(t *testing.T) {
+	ts := newServer(t, time.Minute)
+	defer ts.Close()
+
+	resp, _ := get(t, ts.URL+"/debug/pprof/", "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = get(t, ts.URL+"/debug/pprof/", "wrong")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body := get(t, ts.URL+"/debug/pprof/goroutine?debug=1", testToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, body, "goroutine profile")
+}
+
+func TestProfileDurationIsLimited(t *testing.T) {
+	ts := newServer(t, time.Second)
+	defer ts.Close()
+
+	resp, _ := get(t, ts.URL+"/debug/pprof/profile?seconds=2", testToken)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = get(t, ts.URL+"/debug/fgprof?seconds=-1", testToken)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestFgprofSeesWaitingGoroutines(t *testing.T) {
+	ts := newServer(t, time.Second)
+	defer ts.Close()
+
+	block := make(chan struct{})
+	defer close(block)
+	go waitingForTest(block)
+
+	// Without seconds the profile takes as long as allowed
+	resp, body := get(t, ts.URL+"/debug/fgprof", testToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var line string
+	for _, l := range strings.Split(body, "\n") {
+		if strings.Contains(l, "profiling.waitingForTest") {
+			line = l
+		}
+	}
+	require.NotEmpty(t, line, "waiting goroutine should be sampled")
+	require.Regexp(t, `\Aruntime\.goexit;.*profiling\.waitingForTest;.* \d+\z`, line)
+	require.NotContains(t, body, "sampleGoroutines")
+}
+
+func waitingForTest(block chan struct{}) {
+	<-block
+}
+
+func traceRequest(t *testing.T, url string, claims *TraceClaims) *http.Response {
+	req, err := http.NewRequest("POST", url, nil)
+	require.NoError(t, err)
+	if claims != nil {
+		token, err := secret.JWTTokenString(claims)
+		require.NoError(t, err)
+		req.Header.Set(TraceRequestHeader, token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestTrace(t *testing.T) {
+	testhelper.ConfigureSecret()
+	ts := newServer(t, 2*time.Second)
+	defer ts.Close()
+	expires := time.Now().Add(time.Minute).Unix()
+
+	resp := traceRequest(t, ts.URL+"/debug/trace", nil)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = traceRequest(t, ts.URL+"/debug/trace", &TraceClaims{Seconds: 1})
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode, "requests must expire")
+
+	resp = traceRequest(t, ts.URL+"/debug/trace", &TraceClaims{Seconds: 3, StandardClaims: jwt.StandardClaims{ExpiresAt: expires}})
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = traceRequest(t, ts.URL+"/debug/trace", &TraceClaims{Seconds: 1, StandardClaims: jwt.StandardClaims{ExpiresAt: expires}})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	trace, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(trace), "go 1."), "expected an execution trace")
+}
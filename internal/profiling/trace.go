@@ -0,0 +1,69 @@
+package profiling
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/trace"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+)
+
+// TraceRequestHeader carries the JWT, signed with the Workhorse secret,
+// that asks for an execution trace
+const TraceRequestHeader = "Gitlab-Workhorse-Trace-Request"
+
+// TraceClaims describe the requested execution trace. They must expire,
+// so that a leaked request cannot be replayed forever.
+type TraceClaims struct {
+	// Seconds is how long the trace runs
+	Seconds int `json:"seconds"`
+	jwt.StandardClaims
+}
+
+type traceHandler struct {
+	maxDuration time.Duration
+}
+
+func (t *traceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		helper.HTTPError(w, r, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims := &TraceClaims{}
+	if err := secret.ParseJWT(r.Header.Get(TraceRequestHeader), claims); err != nil || claims.ExpiresAt == 0 {
+		helper.HTTPError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	duration := time.Duration(claims.Seconds) * time.Second
+	if duration <= 0 || duration > t.maxDuration {
+		helper.HTTPError(w, r, fmt.Sprintf("Bad Request: traces are limited to %v", t.maxDuration), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+
+	// Only one trace can run at a time
+	if err := trace.Start(w); err != nil {
+		helper.HTTPError(w, r, "Conflict: a trace is already running", http.StatusConflict)
+		return
+	}
+
+	log.WithFields(log.Fields{"duration": duration, "subject": claims.Subject}).Info("profiling: capturing execution trace")
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	trace.Stop()
+}
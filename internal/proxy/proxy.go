@@ -7,6 +7,9 @@ import (
 	"net/url"
 	"time"
 
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
@@ -31,6 +34,7 @@ func NewProxy(myURL *url.URL, version string, roundTripper http.RoundTripper) *P
 	u.Path = ""
 	p.reverseProxy = httputil.NewSingleHostReverseProxy(&u)
 	p.reverseProxy.Transport = roundTripper
+	p.reverseProxy.BufferPool = helper.BufferPool
 	return &p
 }
 
@@ -47,6 +51,18 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		helper.AllowResponseBuffering(w)
 	}
 
+	span, ctx := opentracing.StartSpanFromContext(req.Context(), "proxy")
+	req = *req.WithContext(ctx)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer func() {
+		if cw.status != 0 {
+			ext.HTTPStatusCode.Set(span, uint16(cw.status))
+		}
+		span.SetTag("http.response_size", cw.bytes)
+		span.Finish()
+	}()
+	w = cw
+
 	// If the ultimate client disconnects when the response isn't fully written
 	// to them yet, httputil.ReverseProxy panics with a net/http.ErrAbortHandler
 	// error. We can catch and discard this to keep the error log clean
@@ -60,3 +76,36 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	p.reverseProxy.ServeHTTP(w, &req)
 }
+
+// countingResponseWriter records the status and size of the response for
+// the proxy span
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *countingResponseWriter) Flush() {
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets the reverse proxy hijack the connection for websockets
+func (c *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// discardResponseWriter has no io.ReaderFrom, like the response writers
+// wrapping the one of net/http in Workhorse
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func BenchmarkProxyLargeResponse(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 4*1024*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	p := NewProxy(helper.URLMustParse(backend.URL), "123", http.DefaultTransport)
+	r := httptest.NewRequest("GET", "/file", nil)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, r)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Package proxyproto implements the receiving side of the PROXY protocol
+(versions 1 and 2), which TCP load balancers such as AWS NLB and HAProxy
+use to pass on the address of the client.
+
+https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+*/
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+)
+
+const (
+	// The longest possible version 1 header, including CRLF
+	maxV1HeaderLength = 107
+
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// HeaderTimeout limits how long a client may take to send the header
+	HeaderTimeout = 10 * time.Second
+
+	errNoHeader = errors.New("proxyproto: missing PROXY protocol header")
+)
+
+type listener struct {
+	net.Listener
+}
+
+// NewListener wraps l so that every accepted connection must start with a
+// PROXY protocol header. The header is read on first use of the
+// connection, so a slow client does not hold up Accept.
+func NewListener(l net.Listener) net.Listener {
+	return &listener{l}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header.
+// For LOCAL connections, e.g. health checks from the load balancer, it is
+// the address of the peer.
+func (c *conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+func (c *conn) readHeader() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout)); err != nil {
+		c.err = err
+		return
+	}
+
+	c.remoteAddr, c.err = readHeader(c.r)
+	if c.err != nil {
+		log.WithError(c.err).WithField("peer", c.Conn.RemoteAddr().String()).Error("proxyproto: invalid header")
+		c.Conn.Close()
+		return
+	}
+
+	c.err = c.Conn.SetReadDeadline(time.Time{})
+}
+
+// readHeader returns the source address from the header, or nil if the
+// header carries no address
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(v1Signature))
+	if err != nil {
+		return nil, errNoHeader
+	}
+
+	if bytes.Equal(signature, v1Signature) {
+		return readV1Header(r)
+	}
+
+	signature, err = r.Peek(len(v2Signature))
+	if err == nil && bytes.Equal(signature, v2Signature) {
+		return readV2Header(r)
+	}
+
+	return nil, errNoHeader
+}
+
+// Version 1 is a single line, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxV1HeaderLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: read v1 header: %v", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("proxyproto: v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v1 source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// Version 2 is binary: the signature, a version/command byte, an address
+// family byte, the length of the rest of the header and the addresses.
+// Any TLVs after the addresses are ignored.
+func readV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxyproto: read v2 header: %v", err)
+	}
+
+	versionCommand, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", versionCommand>>4)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("proxyproto: read v2 addresses: %v", err)
+	}
+
+	switch versionCommand & 0xf {
+	case v2CommandLocal:
+		return nil, nil
+	case v2CommandProxy:
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported command %d", versionCommand&0xf)
+	}
+
+	switch family {
+	case v2FamilyTCP4:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("proxyproto: short v2 TCP4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case v2FamilyTCP6:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("proxyproto: short v2 TCP6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+
+	// UDP and Unix socket addresses are of no use to an HTTP server
+	return nil, nil
+}
@@ -0,0 +1,122 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip sends header and body to a PROXY protocol listener and returns
+// the remote address and body seen by the server
+func roundTrip(t *testing.T, header []byte, body string) (string, string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	pl := NewListener(l)
+	defer pl.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer c.Close()
+
+		c.Write(header)
+		c.Write([]byte(body))
+	}()
+
+	c, err := pl.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+
+	remoteAddr := c.RemoteAddr().String()
+	received, err := ioutil.ReadAll(c)
+	return remoteAddr, string(received), err
+}
+
+func v2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestV1Header(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		header     string
+		remoteAddr string
+	}{
+		{desc: "TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", remoteAddr: "192.0.2.1:56324"},
+		{desc: "TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", remoteAddr: "[2001:db8::1]:56324"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			remoteAddr, body, err := roundTrip(t, []byte(tc.header), "GET / HTTP/1.1\r\n")
+			require.NoError(t, err)
+			require.Equal(t, tc.remoteAddr, remoteAddr)
+			require.Equal(t, "GET / HTTP/1.1\r\n", body)
+		})
+	}
+}
+
+func TestV1Unknown(t *testing.T) {
+	remoteAddr, body, err := roundTrip(t, []byte("PROXY UNKNOWN\r\n"), "hello")
+	require.NoError(t, err)
+	require.Contains(t, remoteAddr, "127.0.0.1:")
+	require.Equal(t, "hello", body)
+}
+
+func TestV2Header(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	tcp6 := bytes.Repeat([]byte{0}, 36)
+	copy(tcp6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(tcp6[32:], 56324)
+
+	testCases := []struct {
+		desc       string
+		header     []byte
+		remoteAddr string
+	}{
+		{desc: "TCP4", header: v2Header(v2CommandProxy, v2FamilyTCP4, tcp4), remoteAddr: "192.0.2.1:56324"},
+		{desc: "TCP4 with TLVs", header: v2Header(v2CommandProxy, v2FamilyTCP4, append(tcp4, 0x04, 0x00, 0x01, 0xff)), remoteAddr: "192.0.2.1:56324"},
+		{desc: "TCP6", header: v2Header(v2CommandProxy, v2FamilyTCP6, tcp6), remoteAddr: "[2001:db8::1]:56324"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			remoteAddr, body, err := roundTrip(t, tc.header, "hello")
+			require.NoError(t, err)
+			require.Equal(t, tc.remoteAddr, remoteAddr)
+			require.Equal(t, "hello", body)
+		})
+	}
+}
+
+func TestV2Local(t *testing.T) {
+	remoteAddr, body, err := roundTrip(t, v2Header(v2CommandLocal, 0, nil), "hello")
+	require.NoError(t, err)
+	require.Contains(t, remoteAddr, "127.0.0.1:")
+	require.Equal(t, "hello", body)
+}
+
+func TestInvalidHeader(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		header string
+	}{
+		{desc: "no header", header: "GET / HTTP/1.1\r\n"},
+		{desc: "bad v1 address", header: "PROXY TCP4 foo 198.51.100.1 56324 443\r\n"},
+		{desc: "v1 too long", header: "PROXY TCP4 " + string(bytes.Repeat([]byte("1"), maxV1HeaderLength))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, _, err := roundTrip(t, []byte(tc.header), "hello")
+			require.Error(t, err)
+		})
+	}
+}
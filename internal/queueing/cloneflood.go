@@ -0,0 +1,273 @@
+package queueing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	// ChallengeHeader holds the proof-of-work challenge of a rejected
+	// clone: "sha256 <difficulty> <nonce>"
+	ChallengeHeader = "Gitlab-Workhorse-Challenge"
+	// ChallengeResponseHeader holds the solution of a challenge:
+	// "<nonce> <counter>", where the SHA-256 of "<nonce>:<counter>" starts
+	// with difficulty zero bits
+	ChallengeResponseHeader = "Gitlab-Workhorse-Challenge-Response"
+
+	cloneFloodRule = "clone_flood"
+
+	defaultCloneFloodIPv4Prefix = 24
+	defaultCloneFloodIPv6Prefix = 64
+	defaultCloneFloodRate       = 1
+	defaultCloneFloodBurst      = 10
+	defaultChallengeDifficulty  = 20
+	defaultChallengeTTL         = 5 * time.Minute
+	maxChallengeDifficulty      = 32
+)
+
+var cloneFloodChallenges = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_clone_flood_challenges",
+		Help: "How many proof-of-work challenges of clones were issued, solved or failed",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(cloneFloodChallenges)
+}
+
+var (
+	cloneFloodMu sync.RWMutex
+	cloneFlood   *cloneFloodLimit
+)
+
+type cloneFloodLimit struct {
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+	limit    *rateLimitRule
+
+	challenge    bool
+	difficulty   int
+	challengeTTL time.Duration
+	secret       []byte
+
+	mu sync.Mutex
+	// solved holds the solutions already used until their challenge
+	// expires, so that each solution lets a single request through
+	solved map[string]time.Time
+}
+
+// ConfigureCloneFlood sets the limit of clones per network. The
+// challenges issued before keep working if the limit stays enabled.
+func ConfigureCloneFlood(cfg config.CloneFloodConfig) error {
+	if !cfg.Enabled {
+		cloneFloodMu.Lock()
+		defer cloneFloodMu.Unlock()
+		cloneFlood = nil
+		return nil
+	}
+
+	ipv4Prefix, err := prefixLength("IPv4Prefix", cfg.IPv4Prefix, defaultCloneFloodIPv4Prefix, 32)
+	if err != nil {
+		return err
+	}
+	ipv6Prefix, err := prefixLength("IPv6Prefix", cfg.IPv6Prefix, defaultCloneFloodIPv6Prefix, 128)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Rate < 0 || cfg.Burst < 0 {
+		return fmt.Errorf("Rate and Burst must not be negative")
+	}
+	rate, burst := cfg.Rate, float64(cfg.Burst)
+	if rate == 0 {
+		rate = defaultCloneFloodRate
+	}
+	if burst == 0 {
+		burst = defaultCloneFloodBurst
+	}
+
+	l := &cloneFloodLimit{
+		ipv4Mask:     net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask:     net.CIDRMask(ipv6Prefix, 128),
+		limit:        &rateLimitRule{name: cloneFloodRule, rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)},
+		challenge:    cfg.Challenge,
+		difficulty:   defaultChallengeDifficulty,
+		challengeTTL: defaultChallengeTTL,
+		solved:       make(map[string]time.Time),
+	}
+
+	if cfg.Difficulty != 0 {
+		if cfg.Difficulty < 1 || cfg.Difficulty > maxChallengeDifficulty {
+			return fmt.Errorf("Difficulty must be between 1 and %d", maxChallengeDifficulty)
+		}
+		l.difficulty = cfg.Difficulty
+	}
+	if cfg.ChallengeTTL != nil {
+		if cfg.ChallengeTTL.Duration <= 0 {
+			return fmt.Errorf("ChallengeTTL must be positive")
+		}
+		l.challengeTTL = cfg.ChallengeTTL.Duration
+	}
+
+	cloneFloodMu.Lock()
+	defer cloneFloodMu.Unlock()
+
+	if cloneFlood != nil {
+		l.secret = cloneFlood.secret
+	} else {
+		l.secret = make([]byte, 32)
+		if _, err := rand.Read(l.secret); err != nil {
+			return fmt.Errorf("challenge secret: %v", err)
+		}
+	}
+	cloneFlood = l
+
+	return nil
+}
+
+func prefixLength(name string, length, defaultLength, bits int) (int, error) {
+	if length == 0 {
+		return defaultLength, nil
+	}
+	if length < 1 || length > bits {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, bits)
+	}
+	return length, nil
+}
+
+// AllowClone checks the info/refs requests of git clones and fetches
+// against the limit of their network. Requests with credentials count too:
+// Workhorse can't tell valid credentials from made-up ones before Rails
+// checks them. path is the request path without the relative URL root.
+// Rejected requests get the time until they are allowed again and, if
+// challenges are enabled, a challenge for ChallengeHeader.
+func AllowClone(r *http.Request, path string) (time.Duration, string, bool) {
+	cloneFloodMu.RLock()
+	l := cloneFlood
+	cloneFloodMu.RUnlock()
+
+	if l == nil || !isClone(r, path) {
+		return 0, "", true
+	}
+
+	now := time.Now()
+	network := l.network(r)
+
+	if l.challenge && r.Header.Get(ChallengeResponseHeader) != "" {
+		if l.verify(r.Header.Get(ChallengeResponseHeader), network, now) {
+			cloneFloodChallenges.WithLabelValues("solved").Inc()
+			return 0, "", true
+		}
+		cloneFloodChallenges.WithLabelValues("failed").Inc()
+	}
+
+	wait, ok := l.limit.take(network, now)
+	if ok {
+		return 0, "", true
+	}
+
+	rateLimitedRequests.WithLabelValues(cloneFloodRule).Inc()
+	if !l.challenge {
+		return wait, "", false
+	}
+
+	cloneFloodChallenges.WithLabelValues("issued").Inc()
+	return wait, fmt.Sprintf("sha256 %d %s", l.difficulty, l.nonce(network, now.Add(l.challengeTTL))), false
+}
+
+// isClone tells if r starts a git clone or fetch
+func isClone(r *http.Request, path string) bool {
+	return r.Method == "GET" &&
+		strings.HasSuffix(path, "/info/refs") &&
+		r.URL.Query().Get("service") == "git-upload-pack"
+}
+
+// network is the network of the client of r, e.g. 192.0.2.0/24
+func (l *cloneFloodLimit) network(r *http.Request) string {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return clientIP(r)
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return (&net.IPNet{IP: ipv4.Mask(l.ipv4Mask), Mask: l.ipv4Mask}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(l.ipv6Mask), Mask: l.ipv6Mask}).String()
+}
+
+// nonce binds a challenge to network until expiry. It is signed, so
+// nothing needs to be kept until it is solved.
+func (l *cloneFloodLimit) nonce(network string, expiry time.Time) string {
+	unix := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, l.secret)
+	mac.Write([]byte(network + "|" + unix))
+	return unix + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a solution from network. Each solution is accepted once.
+func (l *cloneFloodLimit) verify(response string, network string, now time.Time) bool {
+	fields := strings.Fields(response)
+	if len(fields) != 2 {
+		return false
+	}
+	nonce, counter := fields[0], fields[1]
+
+	parts := strings.SplitN(nonce, ".", 2)
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	expiry := time.Unix(unix, 0)
+	if !now.Before(expiry) || !hmac.Equal([]byte(nonce), []byte(l.nonce(network, expiry))) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(nonce + ":" + counter))
+	if leadingZeroBits(sum[:]) < l.difficulty {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for solution, solutionExpiry := range l.solved {
+		if !now.Before(solutionExpiry) {
+			delete(l.solved, solution)
+		}
+	}
+
+	solution := nonce + ":" + counter
+	if _, used := l.solved[solution]; used {
+		return false
+	}
+	l.solved[solution] = expiry
+
+	return true
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package queueing
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func configureCloneFlood(t *testing.T, cfg config.CloneFloodConfig) {
+	cfg.Enabled = true
+	require.NoError(t, ConfigureCloneFlood(cfg))
+}
+
+func infoRefs(remoteAddr string) *http.Request {
+	r := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-upload-pack", nil)
+	r.RemoteAddr = remoteAddr
+	return r
+}
+
+func allowClone(r *http.Request) (string, bool) {
+	_, challenge, ok := AllowClone(r, r.URL.Path)
+	return challenge, ok
+}
+
+// solve finds the counter of a challenge by brute force
+func solve(t *testing.T, challenge string) string {
+	fields := strings.Fields(challenge)
+	require.Len(t, fields, 3)
+	require.Equal(t, "sha256", fields[0])
+	difficulty, err := strconv.Atoi(fields[1])
+	require.NoError(t, err)
+
+	for counter := 0; ; counter++ {
+		sum := sha256.Sum256([]byte(fields[2] + ":" + strconv.Itoa(counter)))
+		if leadingZeroBits(sum[:]) >= difficulty {
+			return fields[2] + " " + strconv.Itoa(counter)
+		}
+	}
+}
+
+func TestAllowClone(t *testing.T) {
+	configureCloneFlood(t, config.CloneFloodConfig{Burst: 2})
+	defer ConfigureCloneFlood(config.CloneFloodConfig{})
+
+	_, ok := allowClone(infoRefs("192.0.2.1:1000"))
+	require.True(t, ok)
+	_, ok = allowClone(infoRefs("192.0.2.2:1000"))
+	require.True(t, ok)
+
+	challenge, ok := allowClone(infoRefs("192.0.2.3:1000"))
+	require.False(t, ok, "the network exhausted its burst")
+	require.Empty(t, challenge, "challenges are disabled")
+
+	_, ok = allowClone(infoRefs("198.51.100.1:1000"))
+	require.True(t, ok, "other networks have their own limit")
+	_, ok = allowClone(infoRefs("[2001:db8::1]:1000"))
+	require.True(t, ok)
+
+	withCredentials := infoRefs("192.0.2.1:1000")
+	withCredentials.SetBasicAuth("user", "made-up")
+	_, ok = allowClone(withCredentials)
+	require.False(t, ok, "credentials are not checked before Rails, they don't lift the limit")
+
+	push := httptest.NewRequest("GET", "/group/project.git/info/refs?service=git-receive-pack", nil)
+	push.RemoteAddr = "192.0.2.1:1000"
+	_, ok = allowClone(push)
+	require.True(t, ok, "pushes are not limited")
+}
+
+func TestAllowCloneDisabled(t *testing.T) {
+	require.NoError(t, ConfigureCloneFlood(config.CloneFloodConfig{Burst: 1}))
+
+	for i := 0; i < 3; i++ {
+		_, ok := allowClone(infoRefs("192.0.2.1:1000"))
+		require.True(t, ok)
+	}
+}
+
+func TestCloneFloodChallenge(t *testing.T) {
+	configureCloneFlood(t, config.CloneFloodConfig{Burst: 1, Challenge: true, Difficulty: 8})
+	defer ConfigureCloneFlood(config.CloneFloodConfig{})
+
+	_, ok := allowClone(infoRefs("192.0.2.1:1000"))
+	require.True(t, ok)
+
+	challenge, ok := allowClone(infoRefs("192.0.2.1:1000"))
+	require.False(t, ok)
+	require.NotEmpty(t, challenge)
+
+	response := solve(t, challenge)
+
+	otherNetwork := infoRefs("198.51.100.1:1000")
+	otherNetwork.Header.Set(ChallengeResponseHeader, response)
+	_, ok = allowClone(otherNetwork)
+	require.True(t, ok, "other networks have their own limit")
+	_, ok = allowClone(otherNetwork)
+	require.False(t, ok, "challenges are bound to a network")
+
+	solved := infoRefs("192.0.2.9:1000")
+	solved.Header.Set(ChallengeResponseHeader, response)
+	_, ok = allowClone(solved)
+	require.True(t, ok)
+
+	_, ok = allowClone(solved)
+	require.False(t, ok, "solutions are accepted once")
+
+	wrong := infoRefs("192.0.2.1:1000")
+	wrong.Header.Set(ChallengeResponseHeader, strings.Fields(challenge)[2]+" wrong")
+	_, ok = allowClone(wrong)
+	require.False(t, ok)
+}
+
+func TestCloneFloodChallengeExpires(t *testing.T) {
+	configureCloneFlood(t, config.CloneFloodConfig{Challenge: true, Difficulty: 1})
+	defer ConfigureCloneFlood(config.CloneFloodConfig{})
+
+	l := cloneFlood
+	now := time.Now()
+	nonce := l.nonce("192.0.2.0/24", now.Add(-time.Second))
+
+	for counter := 0; counter < 64; counter++ {
+		require.False(t, l.verify(nonce+" "+strconv.Itoa(counter), "192.0.2.0/24", now))
+	}
+}
+
+func TestConfigureCloneFloodInvalid(t *testing.T) {
+	for _, cfg := range []config.CloneFloodConfig{
+		{Enabled: true, IPv4Prefix: 33},
+		{Enabled: true, IPv6Prefix: -1},
+		{Enabled: true, Rate: -1},
+		{Enabled: true, Difficulty: 33},
+		{Enabled: true, ChallengeTTL: &config.TomlDuration{Duration: -time.Second}},
+	} {
+		require.Error(t, ConfigureCloneFlood(cfg))
+	}
+}
@@ -19,7 +19,7 @@ type queueMetrics struct {
 	queueingQueueTimeout prometheus.Gauge
 	queueingBusy         prometheus.Gauge
 	queueingWaiting      prometheus.Gauge
-	queueingWaitingTime  prometheus.Histogram
+	queueingWaitingTime  prometheus.Observer
 	queueingErrors       *prometheus.CounterVec
 }
 
@@ -43,6 +43,15 @@ func newQueueMetrics(name string, timeout time.Duration) *queueMetrics {
 		timeout.Seconds(),
 	}
 
+	waitingTime := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "gitlab_workhorse_queueing_waiting_time",
+		Help: "How many time a request spent in queue",
+		ConstLabels: prometheus.Labels{
+			"queue_name": name,
+		},
+		Buckets: waitingTimeBuckets,
+	})
+
 	metrics := &queueMetrics{
 		queueingLimit: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "gitlab_workhorse_queueing_limit",
@@ -84,14 +93,7 @@ func newQueueMetrics(name string, timeout time.Duration) *queueMetrics {
 			},
 		}),
 
-		queueingWaitingTime: prometheus.NewHistogram(prometheus.HistogramOpts{
-			Name: "gitlab_workhorse_queueing_waiting_time",
-			Help: "How many time a request spent in queue",
-			ConstLabels: prometheus.Labels{
-				"queue_name": name,
-			},
-			Buckets: waitingTimeBuckets,
-		}),
+		queueingWaitingTime: waitingTime,
 
 		queueingErrors: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -110,12 +112,69 @@ func newQueueMetrics(name string, timeout time.Duration) *queueMetrics {
 	prometheus.MustRegister(metrics.queueingQueueTimeout)
 	prometheus.MustRegister(metrics.queueingBusy)
 	prometheus.MustRegister(metrics.queueingWaiting)
-	prometheus.MustRegister(metrics.queueingWaitingTime)
+	prometheus.MustRegister(waitingTime)
 	prometheus.MustRegister(metrics.queueingErrors)
 
 	return metrics
 }
 
+var (
+	classQueueingLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_queueing_class_limit",
+		Help: "Current limit set for the queue of a route class",
+	}, []string{"class"})
+	classQueueingQueueLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_queueing_class_queue_limit",
+		Help: "Current queueLimit set for the queue of a route class",
+	}, []string{"class"})
+	classQueueingQueueTimeout = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_queueing_class_queue_timeout",
+		Help: "Current queueTimeout set for the queue of a route class",
+	}, []string{"class"})
+	classQueueingBusy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_queueing_class_busy",
+		Help: "How many requests of a route class are now processed",
+	}, []string{"class"})
+	classQueueingWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gitlab_workhorse_queueing_class_waiting",
+		Help: "How many requests of a route class are now queued",
+	}, []string{"class"})
+	classQueueingWaitingTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gitlab_workhorse_queueing_class_waiting_time",
+		Help:    "How many time a request of a route class spent in queue",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"class"})
+	classQueueingErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitlab_workhorse_queueing_class_errors",
+		Help: "How many requests of a route class were rejected with TooManyRequests or QueueingTimedout, partitioned by error type",
+	}, []string{"class", "type"})
+)
+
+func init() {
+	prometheus.MustRegister(classQueueingLimit)
+	prometheus.MustRegister(classQueueingQueueLimit)
+	prometheus.MustRegister(classQueueingQueueTimeout)
+	prometheus.MustRegister(classQueueingBusy)
+	prometheus.MustRegister(classQueueingWaiting)
+	prometheus.MustRegister(classQueueingWaitingTime)
+	prometheus.MustRegister(classQueueingErrors)
+}
+
+// classQueueMetrics returns the metrics of the queue of a route class.
+// They are labelled with the class rather than registered per queue, so
+// there may be several queues of a class.
+func classQueueMetrics(class string) *queueMetrics {
+	return &queueMetrics{
+		queueingLimit:        classQueueingLimit.WithLabelValues(class),
+		queueingQueueLimit:   classQueueingQueueLimit.WithLabelValues(class),
+		queueingQueueTimeout: classQueueingQueueTimeout.WithLabelValues(class),
+		queueingBusy:         classQueueingBusy.WithLabelValues(class),
+		queueingWaiting:      classQueueingWaiting.WithLabelValues(class),
+		queueingWaitingTime:  classQueueingWaitingTime.WithLabelValues(class),
+		queueingErrors:       classQueueingErrors.MustCurryWith(prometheus.Labels{"class": class}),
+	}
+}
+
 type Queue struct {
 	*queueMetrics
 
@@ -133,6 +192,10 @@ type Queue struct {
 // timeout specifies the time limit of storing the request in the queue
 // if the number of requests is above the limit
 func newQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue {
+	return newQueueWithMetrics(name, limit, queueLimit, timeout, newQueueMetrics(name, timeout))
+}
+
+func newQueueWithMetrics(name string, limit, queueLimit uint, timeout time.Duration, metrics *queueMetrics) *Queue {
 	queue := &Queue{
 		name:      name,
 		busyCh:    make(chan struct{}, limit),
@@ -140,7 +203,7 @@ func newQueue(name string, limit, queueLimit uint, timeout time.Duration) *Queue
 		timeout:   timeout,
 	}
 
-	queue.queueMetrics = newQueueMetrics(name, timeout)
+	queue.queueMetrics = metrics
 	queue.queueingLimit.Set(float64(limit))
 	queue.queueingQueueLimit.Set(float64(queueLimit))
 	queue.queueingQueueTimeout.Set(timeout.Seconds())
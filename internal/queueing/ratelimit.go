@@ -0,0 +1,259 @@
+/*
+In this file we limit the rate of requests with rules configured in
+config.toml, next to the limits on concurrent requests of the queues. Each
+rule matches requests by path and method and keeps a token bucket per client
+IP or per user.
+
+Buckets are kept in memory, so limits apply per Workhorse process.
+*/
+
+package queueing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	// RateLimitKeyIP keeps a bucket per client IP address
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyUser keeps a bucket per set of credentials on top of the
+	// bucket per client IP address. Workhorse does not check credentials,
+	// so made-up ones must not get a bucket of their own.
+	RateLimitKeyUser = "user"
+)
+
+// Idle buckets are dropped once they are full again
+var rateLimitSweepInterval = time.Minute
+
+var rateLimitedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_rate_limited_requests",
+		Help: "How many requests were rejected by a rate limiting rule",
+	},
+	[]string{"rule"},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitedRequests)
+}
+
+var (
+	rateLimitRulesMu sync.RWMutex
+	rateLimitRules   []*rateLimitRule
+)
+
+type rateLimitRule struct {
+	name    string
+	path    *regexp.Regexp
+	methods map[string]bool
+	key     string
+	rate    float64
+	burst   float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ConfigureRateLimits replaces the active rules. Rules are validated as a whole; on
+// error the previous rules stay active.
+func ConfigureRateLimits(cfgs []config.RateLimitRule) error {
+	var newRateLimitRules []*rateLimitRule
+	for i, cfg := range cfgs {
+		r, err := newRateLimitRule(cfg)
+		if err != nil {
+			return fmt.Errorf("rate limit rule %d: %v", i, err)
+		}
+		newRateLimitRules = append(newRateLimitRules, r)
+	}
+
+	rateLimitRulesMu.Lock()
+	defer rateLimitRulesMu.Unlock()
+	rateLimitRules = newRateLimitRules
+
+	return nil
+}
+
+func newRateLimitRule(cfg config.RateLimitRule) (*rateLimitRule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("Name is empty")
+	}
+
+	path, err := regexp.Compile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: Path: %v", cfg.Name, err)
+	}
+
+	if cfg.Rate <= 0 {
+		return nil, fmt.Errorf("%s: Rate must be positive", cfg.Name)
+	}
+
+	key := cfg.Key
+	switch key {
+	case "":
+		key = RateLimitKeyIP
+	case RateLimitKeyIP, RateLimitKeyUser:
+	default:
+		return nil, fmt.Errorf("%s: unknown Key %q", cfg.Name, cfg.Key)
+	}
+
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(cfg.Rate))
+	}
+
+	var methods map[string]bool
+	if len(cfg.Methods) > 0 {
+		methods = make(map[string]bool)
+		for _, m := range cfg.Methods {
+			methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	return &rateLimitRule{
+		name:    cfg.Name,
+		path:    path,
+		methods: methods,
+		key:     key,
+		rate:    cfg.Rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}, nil
+}
+
+// AllowRateLimit checks r against all matching rules. path is the request path
+// without the relative URL root. If a rule rejects the request, its name
+// and the time until a token is available are returned.
+func AllowRateLimit(r *http.Request, path string) (string, time.Duration, bool) {
+	rateLimitRulesMu.RLock()
+	defer rateLimitRulesMu.RUnlock()
+
+	now := time.Now()
+	for _, rl := range rateLimitRules {
+		if !rl.matches(r, path) {
+			continue
+		}
+
+		for _, key := range rl.bucketKeys(r) {
+			if wait, ok := rl.take(key, now); !ok {
+				rateLimitedRequests.WithLabelValues(rl.name).Inc()
+				return rl.name, wait, false
+			}
+		}
+	}
+
+	return "", 0, true
+}
+
+func (rl *rateLimitRule) matches(r *http.Request, path string) bool {
+	if rl.methods != nil && !rl.methods[r.Method] {
+		return false
+	}
+	return rl.path.MatchString(path)
+}
+
+// bucketKeys returns the buckets r takes a token from. The bucket of the
+// client IP comes first: a client making up credentials is stopped there
+// before it can add a bucket for each of them.
+func (rl *rateLimitRule) bucketKeys(r *http.Request) []string {
+	keys := []string{"ip:" + clientIP(r)}
+
+	if rl.key == RateLimitKeyUser {
+		if credentials := userCredentials(r); credentials != "" {
+			sum := sha256.Sum256([]byte(credentials))
+			keys = append(keys, "user:"+hex.EncodeToString(sum[:]))
+		}
+	}
+
+	return keys
+}
+
+// take removes a token from the bucket for key. If the bucket is empty it
+// returns how long it takes until the next token is available.
+func (rl *rateLimitRule) take(key string, now time.Time) (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) >= rateLimitSweepInterval {
+		rl.sweep(now)
+	}
+
+	b := rl.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = rl.refill(b, now)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return wait, false
+	}
+
+	b.tokens--
+	return 0, true
+}
+
+func (rl *rateLimitRule) refill(b *tokenBucket, now time.Time) float64 {
+	return math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+}
+
+func (rl *rateLimitRule) sweep(now time.Time) {
+	for key, b := range rl.buckets {
+		if rl.refill(b, now) >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	rl.lastSweep = now
+}
+
+// userCredentials returns whatever identifies the user of r. Workhorse
+// cannot tell which user a token or session belongs to without asking
+// Rails, so the credentials themselves are used as the key.
+func userCredentials(r *http.Request) string {
+	for _, h := range []string{"Authorization", "Private-Token", "Job-Token"} {
+		if v := r.Header.Get(h); v != "" {
+			return h + ":" + v
+		}
+	}
+
+	query := r.URL.Query()
+	for _, q := range []string{"private_token", "job_token"} {
+		if v := query.Get(q); v != "" {
+			return q + ":" + v
+		}
+	}
+
+	if c, err := r.Cookie("_gitlab_session"); err == nil && c.Value != "" {
+		return "session:" + c.Value
+	}
+
+	return ""
+}
+
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,129 @@
+package queueing
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func configure(t *testing.T, cfgs ...config.RateLimitRule) {
+	require.NoError(t, ConfigureRateLimits(cfgs))
+}
+
+func TestConfigureInvalidRules(t *testing.T) {
+	testCases := []struct {
+		desc string
+		rule config.RateLimitRule
+	}{
+		{"no name", config.RateLimitRule{Path: "^/api/", Rate: 1}},
+		{"invalid path", config.RateLimitRule{Name: "api", Path: "(", Rate: 1}},
+		{"no rate", config.RateLimitRule{Name: "api", Path: "^/api/"}},
+		{"unknown key", config.RateLimitRule{Name: "api", Path: "^/api/", Rate: 1, Key: "project"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Error(t, ConfigureRateLimits([]config.RateLimitRule{tc.rule}))
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	configure(t, config.RateLimitRule{Name: "search", Path: `^/api/v4/search\z`, Methods: []string{"get"}, Rate: 1, Burst: 2})
+	defer configure(t)
+
+	request := func(method, path, remoteAddr string) bool {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = remoteAddr
+		_, _, ok := AllowRateLimit(r, r.URL.Path)
+		return ok
+	}
+
+	require.True(t, request("GET", "/api/v4/search", "1.2.3.4:1000"))
+	require.True(t, request("GET", "/api/v4/search", "1.2.3.4:1001"))
+	require.False(t, request("GET", "/api/v4/search", "1.2.3.4:1002"), "burst is exhausted")
+
+	require.True(t, request("GET", "/api/v4/search", "5.6.7.8:1000"), "other clients have their own bucket")
+	require.True(t, request("POST", "/api/v4/search", "1.2.3.4:1000"), "other methods are not limited")
+	require.True(t, request("GET", "/api/v4/projects", "1.2.3.4:1000"), "other paths are not limited")
+
+	r := httptest.NewRequest("GET", "/api/v4/search", nil)
+	r.RemoteAddr = "1.2.3.4:1000"
+	rule, retryAfter, ok := AllowRateLimit(r, r.URL.Path)
+	require.False(t, ok)
+	require.Equal(t, "search", rule)
+	require.True(t, retryAfter > 0 && retryAfter <= time.Second, "retryAfter %v", retryAfter)
+}
+
+func TestAllowPerUser(t *testing.T) {
+	configure(t, config.RateLimitRule{Name: "api", Path: "^/api/", Key: RateLimitKeyUser, Rate: 1, Burst: 2})
+	defer configure(t)
+
+	request := func(token, remoteAddr string) bool {
+		r := httptest.NewRequest("GET", "/api/v4/projects", nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("Private-Token", token)
+		}
+		_, _, ok := AllowRateLimit(r, r.URL.Path)
+		return ok
+	}
+
+	require.True(t, request("token-1", "1.2.3.4:1000"))
+	require.True(t, request("token-1", "1.2.3.4:1000"))
+	require.False(t, request("token-1", "5.6.7.8:1000"), "the bucket of a user is shared by all IPs")
+	require.True(t, request("token-2", "5.6.7.8:1000"))
+
+	require.False(t, request("token-3", "1.2.3.4:1000"), "made-up credentials do not get around the bucket of the IP")
+	require.False(t, request("", "1.2.3.4:1000"), "anonymous requests are counted per IP")
+}
+
+func TestAllowPerUserAddsNoBucketsOverIPLimit(t *testing.T) {
+	configure(t, config.RateLimitRule{Name: "api", Path: "^/api/", Key: RateLimitKeyUser, Rate: 1, Burst: 1})
+	defer configure(t)
+
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest("GET", "/api/v4/projects", nil)
+		r.RemoteAddr = "1.2.3.4:1000"
+		r.Header.Set("Private-Token", fmt.Sprintf("token-%d", i))
+		AllowRateLimit(r, r.URL.Path)
+	}
+
+	require.Len(t, rateLimitRules[0].buckets, 2, "only the first token gets a bucket")
+}
+
+func TestTakeRefillsOverTime(t *testing.T) {
+	rl, err := newRateLimitRule(config.RateLimitRule{Name: "api", Path: "^/", Rate: 2, Burst: 1})
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, ok := rl.take("ip:1.2.3.4", now)
+	require.True(t, ok)
+
+	wait, ok := rl.take("ip:1.2.3.4", now)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	_, ok = rl.take("ip:1.2.3.4", now.Add(500*time.Millisecond))
+	require.True(t, ok)
+}
+
+func TestSweepDropsIdleBuckets(t *testing.T) {
+	rl, err := newRateLimitRule(config.RateLimitRule{Name: "api", Path: "^/", Rate: 1, Burst: 5})
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, ok := rl.take("ip:1.2.3.4", now)
+	require.True(t, ok)
+	require.Len(t, rl.buckets, 1)
+
+	_, ok = rl.take("ip:5.6.7.8", now.Add(rateLimitSweepInterval))
+	require.True(t, ok)
+	require.Len(t, rl.buckets, 1, "the refilled bucket should be swept")
+	require.Contains(t, rl.buckets, "ip:5.6.7.8")
+}
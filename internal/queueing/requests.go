@@ -1,9 +1,11 @@
 package queueing
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 )
 
@@ -30,22 +32,62 @@ func QueueRequests(name string, h http.Handler, limit, queueLimit uint, queueTim
 	queue := newQueue(name, limit, queueLimit, queueTimeout)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := queue.Acquire()
+		queue.Handle(w, r, h)
+	})
+}
+
+// NewClassQueue creates the queue of the requests of a route class, or
+// returns nil if cfg has no Limit. Its metrics are labelled with the
+// class, so unlike QueueRequests it can be called twice with a class.
+func NewClassQueue(class string, cfg config.QueueConfig) *Queue {
+	if cfg.Limit == 0 {
+		return nil
+	}
 
-		switch err {
-		case nil:
-			defer queue.Release()
-			h.ServeHTTP(w, r)
+	timeout := DefaultTimeout
+	if cfg.Timeout != nil {
+		timeout = cfg.Timeout.Duration
+	}
 
-		case ErrTooManyRequests:
-			http.Error(w, "Too Many Requests", httpStatusTooManyRequests)
+	return newQueueWithMetrics(class, cfg.Limit, cfg.QueueLimit, timeout, classQueueMetrics(class))
+}
 
-		case ErrQueueingTimedout:
-			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+// ValidateQueues checks the queues of the route classes
+func ValidateQueues(cfg config.QueuesConfig) error {
+	queues := []struct {
+		name string
+		config.QueueConfig
+	}{{"API", cfg.API}, {"Git", cfg.Git}, {"Uploads", cfg.Uploads}}
 
-		default:
-			helper.Fail500(w, r, err)
+	for _, q := range queues {
+		if q.Limit == 0 && q.QueueLimit > 0 {
+			return fmt.Errorf("%s: QueueLimit needs a Limit", q.name)
 		}
+		if q.Timeout != nil && q.Timeout.Duration <= 0 {
+			return fmt.Errorf("%s: Timeout must be positive", q.name)
+		}
+	}
 
-	})
+	return nil
+}
+
+// Handle serves r with h once the queue has a slot for it. If the queue
+// is full, or r waits too long, it responds with 429 or 503.
+func (s *Queue) Handle(w http.ResponseWriter, r *http.Request, h http.Handler) {
+	err := s.Acquire()
+
+	switch err {
+	case nil:
+		defer s.Release()
+		h.ServeHTTP(w, r)
+
+	case ErrTooManyRequests:
+		http.Error(w, "Too Many Requests", httpStatusTooManyRequests)
+
+	case ErrQueueingTimedout:
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+
+	default:
+		helper.Fail500(w, r, err)
+	}
 }
@@ -6,6 +6,8 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 )
 
 var httpHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -74,3 +76,37 @@ func TestQueueingTooManyRequests(t *testing.T) {
 		t.Fatal("QueueRequests should return immediately and return too many requests")
 	}
 }
+
+func TestClassQueue(t *testing.T) {
+	if NewClassQueue("api", config.QueueConfig{}) != nil {
+		t.Fatal("a queue without Limit should be disabled")
+	}
+
+	// Class queues don't register their own metrics, so there can be two
+	q1 := NewClassQueue("git", config.QueueConfig{Limit: 1})
+	q2 := NewClassQueue("git", config.QueueConfig{Limit: 1, Timeout: &config.TomlDuration{Duration: time.Microsecond}})
+	if q1.timeout != DefaultTimeout || q2.timeout != time.Microsecond {
+		t.Fatal("unexpected queue timeouts")
+	}
+
+	if err := q2.Acquire(); err != nil {
+		t.Fatal("we should acquire a new slot")
+	}
+	w := httptest.NewRecorder()
+	q2.Handle(w, nil, httpHandler)
+	if w.Code != 429 {
+		t.Fatal("the full queue should reject the request")
+	}
+}
+
+func TestValidateQueues(t *testing.T) {
+	if err := ValidateQueues(config.QueuesConfig{API: config.QueueConfig{Limit: 10, QueueLimit: 100}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ValidateQueues(config.QueuesConfig{Git: config.QueueConfig{QueueLimit: 100}}); err == nil {
+		t.Fatal("QueueLimit without Limit should be invalid")
+	}
+	if err := ValidateQueues(config.QueuesConfig{Uploads: config.QueueConfig{Limit: 1, Timeout: &config.TomlDuration{}}}); err == nil {
+		t.Fatal("a zero Timeout should be invalid")
+	}
+}
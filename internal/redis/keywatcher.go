@@ -12,6 +12,7 @@ import (
 	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
 )
 
 var (
@@ -36,12 +37,37 @@ var (
 			Help: "How many messages gitlab-workhorse has received in total on pubsub.",
 		},
 	)
+	keyWatcherConnected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_keywatcher_connected",
+			Help: "Whether the keywatcher is subscribed to Redis pubsub (1) or not (0)",
+		},
+	)
+	keyWatcherReconnects = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_keywatcher_reconnects",
+			Help: "How many times the keywatcher has reconnected to Redis pubsub.",
+		},
+	)
+	droppedNotifications = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_keywatcher_dropped_notifications",
+			Help: "How many pubsub notifications were dropped because they could not be parsed.",
+		},
+	)
+
+	// A connection must be up this long before a failure is considered
+	// intermittent and we reconnect without backing off
+	stableConnectionTime = 30 * time.Second
 )
 
 func init() {
 	prometheus.MustRegister(
 		keyWatchers,
 		totalMessages,
+		keyWatcherConnected,
+		keyWatcherReconnects,
+		droppedNotifications,
 	)
 }
 
@@ -49,6 +75,18 @@ const (
 	keySubChannel = "workhorse:notifications"
 )
 
+func keyWatcherStatus() interface{} {
+	keyWatcherMutex.Lock()
+	keys := len(keyWatcher)
+	keyWatcherMutex.Unlock()
+
+	return map[string]interface{}{
+		"backend":   "redis",
+		"connected": status.GaugeValue(keyWatcherConnected) == 1,
+		"keys":      keys,
+	}
+}
+
 // KeyChan holds a key and a channel
 type KeyChan struct {
 	Key  string
@@ -71,14 +109,13 @@ func processInner(conn redis.Conn) error {
 			msg := strings.SplitN(dataStr, "=", 2)
 			if len(msg) != 2 {
 				helper.LogError(nil, fmt.Errorf("keywatcher: invalid notification: %q", dataStr))
+				droppedNotifications.Inc()
 				continue
 			}
 			key, value := msg[0], msg[1]
 			notifyChanWatchers(key, value)
 		case error:
-			helper.LogError(nil, fmt.Errorf("keywatcher: pubsub receive: %v", v))
-			// Intermittent error, return nil so that it doesn't wait before reconnect
-			return nil
+			return fmt.Errorf("pubsub receive: %v", v)
 		}
 	}
 }
@@ -105,18 +142,33 @@ func dialPubSub(dialer redisDialerFunc) (redis.Conn, error) {
 func Process() {
 	log.Info("keywatcher: starting process loop")
 	for {
-		conn, err := dialPubSub(workerDialFunc)
-		if err != nil {
-			helper.LogError(nil, fmt.Errorf("keywatcher: %v", err))
-			time.Sleep(redisReconnectTimeout.Duration())
-			continue
-		}
-		redisReconnectTimeout.Reset()
+		time.Sleep(processOnce(workerDialFunc))
+		keyWatcherReconnects.Inc()
+	}
+}
 
-		if err = processInner(conn); err != nil {
-			helper.LogError(nil, fmt.Errorf("keywatcher: process loop: %v", err))
-		}
+// processOnce handles notifications until the connection to Redis fails,
+// and returns how long to wait before reconnecting
+func processOnce(dialer redisDialerFunc) time.Duration {
+	conn, err := dialPubSub(dialer)
+	if err != nil {
+		helper.LogError(nil, fmt.Errorf("keywatcher: %v", err))
+		return redisReconnectTimeout.Duration()
+	}
+
+	start := time.Now()
+	keyWatcherConnected.Set(1)
+	err = processInner(conn)
+	keyWatcherConnected.Set(0)
+	helper.LogError(nil, fmt.Errorf("keywatcher: process loop: %v", err))
+
+	// Resetting the backoff as soon as we are connected would make us spin
+	// on a connection that breaks right away
+	if time.Since(start) >= stableConnectionTime {
+		redisReconnectTimeout.Reset()
 	}
+
+	return redisReconnectTimeout.Duration()
 }
 
 func notifyChanWatchers(key, value string) {
@@ -170,6 +222,14 @@ const (
 	WatchKeyStatusNoChange
 )
 
+// KeyWatcher watches keys with Redis pubsub
+type KeyWatcher struct{}
+
+// WatchKey calls the WatchKey function of the package
+func (KeyWatcher) WatchKey(key, value string, timeout time.Duration) (WatchKeyStatus, error) {
+	return WatchKey(key, value, timeout)
+}
+
 // WatchKey waits for a key to be updated or expired
 func WatchKey(key, value string, timeout time.Duration) (WatchKeyStatus, error) {
 	kw := &KeyChan{
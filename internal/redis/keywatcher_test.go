@@ -1,12 +1,16 @@
 package redis
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
+	"github.com/jpillora/backoff"
 	"github.com/rafaeljusto/redigomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -160,3 +164,47 @@ func TestWatchKeyMassivelyParallel(t *testing.T) {
 	processMessages(runTimes, "somethingelse")
 	wg.Wait()
 }
+
+func brokenPubSubDialer() (redis.Conn, error) {
+	conn := redigomock.NewConn()
+	conn.Command("PING").Expect("PONG")
+	conn.Command("SUBSCRIBE", keySubChannel).Expect(createSubscribeMessage(keySubChannel))
+	conn.Command("UNSUBSCRIBE", keySubChannel).Expect(createUnsubscribeMessage(keySubChannel))
+	// No subscription messages: the first receive fails
+	return conn, nil
+}
+
+func TestProcessOnceBacksOffOnBrokenConnection(t *testing.T) {
+	defer func(b backoff.Backoff, stable time.Duration) {
+		redisReconnectTimeout, stableConnectionTime = b, stable
+	}(redisReconnectTimeout, stableConnectionTime)
+
+	redisReconnectTimeout = backoff.Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+
+	require.Equal(t, 100*time.Millisecond, processOnce(brokenPubSubDialer))
+	require.Equal(t, 200*time.Millisecond, processOnce(brokenPubSubDialer))
+	require.Equal(t, 400*time.Millisecond, processOnce(brokenPubSubDialer))
+}
+
+func TestProcessOnceResetsBackoffAfterStableConnection(t *testing.T) {
+	defer func(b backoff.Backoff, stable time.Duration) {
+		redisReconnectTimeout, stableConnectionTime = b, stable
+	}(redisReconnectTimeout, stableConnectionTime)
+
+	redisReconnectTimeout = backoff.Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+	stableConnectionTime = 0
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 100*time.Millisecond, processOnce(brokenPubSubDialer))
+	}
+}
+
+func TestProcessOnceBacksOffWhenDialFails(t *testing.T) {
+	defer func(b backoff.Backoff) { redisReconnectTimeout = b }(redisReconnectTimeout)
+
+	redisReconnectTimeout = backoff.Backoff{Min: 100 * time.Millisecond, Max: time.Second, Factor: 2}
+	dialer := func() (redis.Conn, error) { return nil, errors.New("connection refused") }
+
+	require.Equal(t, 100*time.Millisecond, processOnce(dialer))
+	require.Equal(t, 200*time.Millisecond, processOnce(dialer))
+}
@@ -14,6 +14,7 @@ import (
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
 )
 
 var (
@@ -176,20 +177,46 @@ func keepAliveDialer(timeout time.Duration) func(string, string) (net.Conn, erro
 
 type redisDialerFunc func() (redis.Conn, error)
 
-func sentinelDialer(dopts []redis.DialOption, keepAlivePeriod time.Duration) redisDialerFunc {
+// dialOptionsFunc builds the options of every dial, so that new
+// connections use the current password if it is a secret reference
+type dialOptionsFunc func() ([]redis.DialOption, error)
+
+func secretDialOptions(cfg *config.RedisConfig, setTimeouts bool) dialOptionsFunc {
+	return func() ([]redis.DialOption, error) {
+		password, err := config.ResolveSecret(cfg.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		resolved := *cfg
+		resolved.Password = password
+		return dialOptionsBuilder(&resolved, setTimeouts), nil
+	}
+}
+
+func sentinelDialer(options dialOptionsFunc, keepAlivePeriod time.Duration) redisDialerFunc {
 	return func() (redis.Conn, error) {
 		address, err := sntnl.MasterAddr()
 		if err != nil {
 			errorCounter.WithLabelValues("master", "sentinel").Inc()
 			return nil, err
 		}
+		dopts, err := options()
+		if err != nil {
+			return nil, err
+		}
 		dopts = append(dopts, redis.DialNetDial(keepAliveDialer(keepAlivePeriod)))
 		return redisDial("tcp", address, dopts...)
 	}
 }
 
-func defaultDialer(dopts []redis.DialOption, keepAlivePeriod time.Duration, url url.URL) redisDialerFunc {
+func defaultDialer(options dialOptionsFunc, keepAlivePeriod time.Duration, url url.URL) redisDialerFunc {
 	return func() (redis.Conn, error) {
+		dopts, err := options()
+		if err != nil {
+			return nil, err
+		}
+
 		if url.Scheme == "unix" {
 			return redisDial(url.Scheme, url.Path, dopts...)
 		}
@@ -241,11 +268,11 @@ func DefaultDialFunc(cfg *config.RedisConfig, setReadTimeout bool) func() (redis
 	if cfg.KeepAlivePeriod != nil {
 		keepAlivePeriod = cfg.KeepAlivePeriod.Duration
 	}
-	dopts := dialOptionsBuilder(cfg, setReadTimeout)
+	options := secretDialOptions(cfg, setReadTimeout)
 	if sntnl != nil {
-		return countDialer(sentinelDialer(dopts, keepAlivePeriod))
+		return countDialer(sentinelDialer(options, keepAlivePeriod))
 	}
-	return countDialer(defaultDialer(dopts, keepAlivePeriod, cfg.URL.URL))
+	return countDialer(defaultDialer(options, keepAlivePeriod, cfg.URL.URL))
 }
 
 // Configure redis-connection
@@ -279,6 +306,8 @@ func Configure(cfg *config.RedisConfig, dialFunc func(*config.RedisConfig, bool)
 			return nil
 		}
 	}
+
+	status.Register("keywatcher", keyWatcherStatus)
 }
 
 // Get a connection for the Redis-pool
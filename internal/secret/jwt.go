@@ -10,7 +10,22 @@ var (
 	DefaultClaims = jwt.StandardClaims{Issuer: "gitlab-workhorse"}
 )
 
+// JWTTokenString signs claims for Rails, with the private key of the
+// signing configuration if there is one, or else with the shared secret
 func JWTTokenString(claims jwt.Claims) (string, error) {
+	if s := getSigner(); s != nil {
+		token := jwt.NewWithClaims(s.method, claims)
+		if s.keyID != "" {
+			token.Header["kid"] = s.keyID
+		}
+
+		tokenString, err := token.SignedString(s.key)
+		if err != nil {
+			return "", fmt.Errorf("secret.JWTTokenString: sign JWT: %v", err)
+		}
+		return tokenString, nil
+	}
+
 	secretBytes, err := Bytes()
 	if err != nil {
 		return "", fmt.Errorf("secret.JWTTokenString: %v", err)
@@ -23,3 +38,37 @@ func JWTTokenString(claims jwt.Claims) (string, error) {
 
 	return tokenString, nil
 }
+
+// ParseJWT verifies a token signed by Rails with the shared secret and
+// decodes it into claims. While the secret is rotated, tokens signed with
+// any of the keys of the secret file are accepted.
+func ParseJWT(tokenString string, claims jwt.Claims) error {
+	keys, err := getKeys()
+	if err != nil {
+		return fmt.Errorf("secret.ParseJWT: %v", err)
+	}
+
+	for _, key := range keys {
+		_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key, nil
+		})
+		if !isSignatureInvalid(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("secret.ParseJWT: %v", err)
+	}
+
+	return nil
+}
+
+// isSignatureInvalid tells if err means that the token may have been
+// signed with another key
+func isSignatureInvalid(err error) bool {
+	validationErr, ok := err.(*jwt.ValidationError)
+	return ok && validationErr.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
@@ -4,14 +4,25 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 )
 
 const numSecretBytes = 32
 
+// The secret file is checked for changes at most this often
+var reloadInterval = time.Second
+
 type sec struct {
-	path  string
-	bytes []byte
+	path     string
+	keys     [][]byte
+	contents string
+	checked  time.Time
 	sync.RWMutex
 }
 
@@ -23,24 +34,21 @@ func SetPath(path string) {
 	theSecret.Lock()
 	defer theSecret.Unlock()
 	theSecret.path = path
-	theSecret.bytes = nil
+	theSecret.keys = nil
 }
 
 // Lazy access to the HMAC secret key. We must be lazy because if the key
 // is not already there, it will be generated by gitlab-rails, and
 // gitlab-rails is slow.
+//
+// Bytes returns the primary key, the one Workhorse signs with.
 func Bytes() ([]byte, error) {
-	if bytes := getBytes(); bytes != nil {
-		return copyBytes(bytes), nil
+	keys, err := getKeys()
+	if err != nil {
+		return nil, err
 	}
 
-	return setBytes()
-}
-
-func getBytes() []byte {
-	theSecret.RLock()
-	defer theSecret.RUnlock()
-	return theSecret.bytes
+	return copyBytes(keys[0]), nil
 }
 
 func copyBytes(bytes []byte) []byte {
@@ -49,29 +57,95 @@ func copyBytes(bytes []byte) []byte {
 	return out
 }
 
-func setBytes() ([]byte, error) {
+// getKeys returns the keys of the secret file, the primary key first. To
+// rotate the secret without restarting Workhorse and Rails together, the
+// file can hold several keys, one per line. Changes of the file are picked
+// up within reloadInterval.
+//
+// Instead of a file, the path can be a reference to a secret provider,
+// like vault:secret/data/workhorse#secret.
+func getKeys() ([][]byte, error) {
+	theSecret.RLock()
+	keys, fresh := theSecret.keys, time.Since(theSecret.checked) < reloadInterval
+	theSecret.RUnlock()
+
+	if keys != nil && fresh {
+		return keys, nil
+	}
+
+	return loadKeys()
+}
+
+func loadKeys() ([][]byte, error) {
 	theSecret.Lock()
 	defer theSecret.Unlock()
 
-	if theSecret.bytes != nil {
-		return theSecret.bytes, nil
+	if theSecret.keys != nil && time.Since(theSecret.checked) < reloadInterval {
+		return theSecret.keys, nil
+	}
+
+	contents, err := readSecret(theSecret.path)
+	if err == nil && theSecret.keys != nil && contents == theSecret.contents {
+		theSecret.checked = time.Now()
+		return theSecret.keys, nil
 	}
 
-	base64Bytes, err := ioutil.ReadFile(theSecret.path)
+	var keys [][]byte
+	if err == nil {
+		keys, err = parseKeys(contents, theSecret.path)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("secret.setBytes: read %q: %v", theSecret.path, err)
+		if theSecret.keys == nil {
+			return nil, err
+		}
+
+		// The file may be in the middle of being replaced. Keep the keys
+		// that worked so far rather than failing all requests.
+		log.WithError(err).Error("secret: keeping the previous keys")
+		theSecret.checked = time.Now()
+		return theSecret.keys, nil
+	}
+
+	if theSecret.keys != nil {
+		log.WithField("keys", len(keys)).Info("secret: reloaded keys")
+	}
+
+	theSecret.keys = keys
+	theSecret.contents = contents
+	theSecret.checked = time.Now()
+	return keys, nil
+}
+
+func readSecret(path string) (string, error) {
+	if config.IsSecretRef(path) {
+		return config.ResolveSecret(path)
 	}
 
-	secretBytes := make([]byte, base64.StdEncoding.DecodedLen(len(base64Bytes)))
-	n, err := base64.StdEncoding.Decode(secretBytes, base64Bytes)
+	contents, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("secret.setBytes: decode secret: %v", err)
+		return "", fmt.Errorf("secret.readSecret: read %q: %v", path, err)
+	}
+	return string(contents), nil
+}
+
+func parseKeys(contents string, path string) ([][]byte, error) {
+	var keys [][]byte
+	for _, line := range strings.Fields(contents) {
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("secret.parseKeys: decode secret: %v", err)
+		}
+
+		if len(key) != numSecretBytes {
+			return nil, fmt.Errorf("secret.parseKeys: expected %d secretBytes in %s, found %d", numSecretBytes, path, len(key))
+		}
+
+		keys = append(keys, key)
 	}
 
-	if n != numSecretBytes {
-		return nil, fmt.Errorf("secret.setBytes: expected %d secretBytes in %s, found %d", numSecretBytes, theSecret.path, n)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("secret.parseKeys: no key in %s", path)
 	}
 
-	theSecret.bytes = secretBytes
-	return copyBytes(theSecret.bytes), nil
+	return keys, nil
 }
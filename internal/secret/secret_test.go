@@ -0,0 +1,109 @@
+package secret
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(b byte) []byte {
+	key := make([]byte, numSecretBytes)
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func writeKeys(t *testing.T, path string, keys ...[]byte) {
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, base64.StdEncoding.EncodeToString(key))
+	}
+	require.NoError(t, ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+}
+
+func withSecretFile(t *testing.T, keys ...[]byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "secret")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "secret")
+	writeKeys(t, path, keys...)
+	SetPath(path)
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func signWith(t *testing.T, key []byte) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, DefaultClaims).SignedString(key)
+	require.NoError(t, err)
+	return token
+}
+
+func TestMultipleKeys(t *testing.T) {
+	primary, old, unknown := newKey(1), newKey(2), newKey(3)
+	_, cleanup := withSecretFile(t, primary, old)
+	defer cleanup()
+
+	signing, err := Bytes()
+	require.NoError(t, err)
+	require.Equal(t, primary, signing, "tokens must be signed with the first key")
+
+	require.NoError(t, ParseJWT(signWith(t, primary), &jwt.StandardClaims{}))
+	require.NoError(t, ParseJWT(signWith(t, old), &jwt.StandardClaims{}))
+	require.Error(t, ParseJWT(signWith(t, unknown), &jwt.StandardClaims{}))
+}
+
+func TestParseJWTStopsAtInvalidClaims(t *testing.T) {
+	_, cleanup := withSecretFile(t, newKey(1), newKey(2))
+	defer cleanup()
+
+	claims := jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(newKey(1))
+	require.NoError(t, err)
+
+	err = ParseJWT(token, &jwt.StandardClaims{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expired")
+}
+
+func TestReload(t *testing.T) {
+	defer func(interval time.Duration) { reloadInterval = interval }(reloadInterval)
+	reloadInterval = 0
+
+	first, second := newKey(1), newKey(2)
+	path, cleanup := withSecretFile(t, first)
+	defer cleanup()
+
+	key, err := Bytes()
+	require.NoError(t, err)
+	require.Equal(t, first, key)
+
+	writeKeys(t, path, second, first)
+	key, err = Bytes()
+	require.NoError(t, err)
+	require.Equal(t, second, key, "changes of the file must be picked up")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("garbage"), 0600))
+	key, err = Bytes()
+	require.NoError(t, err)
+	require.Equal(t, second, key, "invalid files must not replace valid keys")
+}
+
+func TestInvalidSecretFile(t *testing.T) {
+	path, cleanup := withSecretFile(t)
+	defer cleanup()
+
+	_, err := Bytes()
+	require.Error(t, err, "empty file")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString([]byte("short"))), 0600))
+	_, err = Bytes()
+	require.Error(t, err, "short key")
+}
@@ -0,0 +1,145 @@
+package secret
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// signer signs tokens with a private key instead of the shared secret
+type signer struct {
+	method jwt.SigningMethod
+	key    interface{}
+	keyID  string
+}
+
+var (
+	signerMu      sync.RWMutex
+	currentSigner *signer
+)
+
+// ConfigureSigning makes JWTTokenString sign with the private key of cfg.
+// Without an algorithm, tokens are signed with the shared secret.
+func ConfigureSigning(cfg config.SigningConfig) error {
+	s, err := newSigner(cfg)
+	if err != nil {
+		return err
+	}
+
+	signerMu.Lock()
+	defer signerMu.Unlock()
+	currentSigner = s
+
+	return nil
+}
+
+func newSigner(cfg config.SigningConfig) (*signer, error) {
+	if cfg.Algorithm == "" {
+		return nil, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("signing: read key: %v", err)
+	}
+
+	s := &signer{keyID: cfg.KeyID}
+	switch cfg.Algorithm {
+	case AlgorithmRS256:
+		s.method = jwt.SigningMethodRS256
+		s.key, err = jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+	case AlgorithmEdDSA:
+		s.method = SigningMethodEdDSA
+		s.key, err = parseEdPrivateKeyFromPEM(pemBytes)
+	default:
+		return nil, fmt.Errorf("signing: unknown Algorithm %q", cfg.Algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing: parse key %q: %v", cfg.KeyFile, err)
+	}
+
+	return s, nil
+}
+
+func getSigner() *signer {
+	signerMu.RLock()
+	defer signerMu.RUnlock()
+	return currentSigner
+}
+
+func parseEdPrivateKeyFromPEM(pemBytes []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("key must be PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an Ed25519 key")
+	}
+
+	return edKey, nil
+}
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys. jwt-go doesn't
+// implement it.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+var errEdDSAVerification = errors.New("EdDSA verification failed")
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return AlgorithmEdDSA
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(edKey, []byte(signingString))), nil
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(edKey, []byte(signingString), sig) {
+		return errEdDSAVerification
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package secret
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func writePEM(t *testing.T, dir string, blockType string, der []byte) string {
+	path := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer ConfigureSigning(config.SigningConfig{})
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	require.NoError(t, err)
+
+	tests := []struct {
+		algorithm string
+		blockType string
+		der       []byte
+		publicKey interface{}
+	}{
+		{AlgorithmRS256, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), &rsaKey.PublicKey},
+		{AlgorithmEdDSA, "PRIVATE KEY", edDER, edPublic},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.algorithm, func(t *testing.T) {
+			keyFile := writePEM(t, dir, tc.blockType, tc.der)
+			require.NoError(t, ConfigureSigning(config.SigningConfig{Algorithm: tc.algorithm, KeyFile: keyFile, KeyID: "key-1"}))
+
+			tokenString, err := JWTTokenString(DefaultClaims)
+			require.NoError(t, err)
+
+			token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+				return tc.publicKey, nil
+			})
+			require.NoError(t, err)
+			require.True(t, token.Valid)
+			require.Equal(t, tc.algorithm, token.Header["alg"])
+			require.Equal(t, "key-1", token.Header["kid"])
+		})
+	}
+}
+
+func TestConfigureSigningErrors(t *testing.T) {
+	defer ConfigureSigning(config.SigningConfig{})
+
+	require.Error(t, ConfigureSigning(config.SigningConfig{Algorithm: "HS512", KeyFile: "../../testdata/test-secret"}))
+	require.Error(t, ConfigureSigning(config.SigningConfig{Algorithm: AlgorithmEdDSA, KeyFile: "does-not-exist"}))
+	require.Error(t, ConfigureSigning(config.SigningConfig{Algorithm: AlgorithmEdDSA, KeyFile: "../../testdata/test-secret"}), "not a PEM file")
+}
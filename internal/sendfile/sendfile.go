@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"regexp"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -145,7 +146,20 @@ func sendFileFromDisk(w http.ResponseWriter, r *http.Request, file string) {
 		w.Header().Set(headers.ContentDispositionHeader, contentDisposition)
 	}
 
-	http.ServeContent(w, r, "", fi.ModTime(), content)
+	// http.ServeContent sets Last-Modified and answers conditional requests
+	// with 304 Not Modified. An ETag set by Rails takes precedence.
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", fileETag(fi))
+	}
+
+	http.ServeContent(helper.WithPooledCopy(w), r, "", fi.ModTime(), content)
+}
+
+// fileETag derives a strong validator from the modification time and size
+// of a file, like NGINX does. Uploaded files are never modified in place, so
+// hashing the contents would be wasted effort.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().Unix(), fi.Size())
 }
 
 func countSendFileMetrics(size int64, r *http.Request) {
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -169,3 +170,76 @@ func makeRequest(t *testing.T, fixturePath string, httpHeaders map[string]string
 
 	return resp
 }
+
+func TestConditionalRequests(t *testing.T) {
+	fixturePath := "testdata/sent-file.txt"
+	fi, err := os.Stat(fixturePath)
+	require.NoError(t, err)
+
+	etag := fileETag(fi)
+	lastModified := fi.ModTime().UTC().Format(http.TimeFormat)
+
+	testCases := []struct {
+		desc          string
+		requestHeader map[string]string
+		upstreamETag  string
+		status        int
+		etag          string
+	}{
+		{
+			desc:   "unconditional request",
+			status: 200,
+			etag:   etag,
+		},
+		{
+			desc:          "matching If-None-Match",
+			requestHeader: map[string]string{"If-None-Match": etag},
+			status:        304,
+			etag:          etag,
+		},
+		{
+			desc:          "other If-None-Match",
+			requestHeader: map[string]string{"If-None-Match": `"other"`},
+			status:        200,
+			etag:          etag,
+		},
+		{
+			desc:          "If-Modified-Since",
+			requestHeader: map[string]string{"If-Modified-Since": lastModified},
+			status:        304,
+			etag:          etag,
+		},
+		{
+			desc:          "ETag from Rails",
+			requestHeader: map[string]string{"If-None-Match": `"rails"`},
+			upstreamETag:  `"rails"`,
+			status:        304,
+			etag:          `"rails"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "/foo", nil)
+			require.NoError(t, err)
+			for k, v := range tc.requestHeader {
+				r.Header.Set(k, v)
+			}
+
+			rw := httptest.NewRecorder()
+			sf := &sendFileResponseWriter{rw: rw, req: r}
+			sf.Header().Set(headers.XSendFileHeader, fixturePath)
+			if tc.upstreamETag != "" {
+				sf.Header().Set("ETag", tc.upstreamETag)
+			}
+			sf.flush()
+
+			resp := rw.Result()
+			require.Equal(t, tc.status, resp.StatusCode)
+			require.Equal(t, tc.etag, resp.Header.Get("ETag"))
+			if tc.status == 200 {
+				require.Equal(t, lastModified, resp.Header.Get("Last-Modified"))
+			}
+		})
+	}
+}
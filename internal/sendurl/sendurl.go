@@ -2,7 +2,6 @@ package sendurl
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"time"
@@ -157,7 +156,7 @@ func (e *entry) Inject(w http.ResponseWriter, r *http.Request, sendData string)
 	w.WriteHeader(resp.StatusCode)
 
 	defer resp.Body.Close()
-	n, err := io.Copy(w, resp.Body)
+	n, err := helper.Copy(w, resp.Body)
 	sendURLBytes.Add(float64(n))
 
 	if err != nil {
@@ -0,0 +1,282 @@
+package staticpages
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+const (
+	defaultAssetCacheSize        = 32 * 1024 * 1024
+	defaultAssetCacheMaxFileSize = 1024 * 1024
+	defaultAssetCacheNotFoundTTL = time.Minute
+
+	defaultAssetCacheNotFoundEntries = 1024
+)
+
+var (
+	assetCacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_static_asset_cache_requests",
+			Help: "How many lookups of fingerprinted assets were served from the in-memory cache (hit), including cached 404s (not_found), or had to go to disk (miss)",
+		},
+		[]string{"result"},
+	)
+
+	// Fingerprinted assets have a content digest in their name, e.g.
+	// application-5f1d3e...c2.css (Sprockets) or main.3b9f1a2c.chunk.js
+	// (webpack). Their contents never change.
+	fingerprintPattern = regexp.MustCompile(`[.-][0-9a-f]{8,}\.`)
+)
+
+func init() {
+	prometheus.MustRegister(assetCacheRequests)
+}
+
+func isFingerprinted(file string) bool {
+	return fingerprintPattern.MatchString(filepath.Base(file))
+}
+
+type staticFile struct {
+	io.ReadSeeker
+	io.Closer
+	modTime time.Time
+}
+
+func openStaticFile(name string) (*staticFile, error) {
+	file, fi, err := helper.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &staticFile{ReadSeeker: file, Closer: file, modTime: fi.ModTime()}, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+type cachedAsset struct {
+	name     string
+	data     []byte
+	modTime  time.Time
+	notFound bool
+	expires  time.Time
+}
+
+// assetCache is an LRU cache of small fingerprinted assets. It saves the
+// open and stat calls for hot assets, which are slow if the document root is
+// on NFS. Only fingerprinted assets are cached so entries never go stale;
+// missing assets are remembered for a limited time only, they may be added
+// by a deploy. Missing assets are kept apart, in a small cache of their own,
+// so that requests for made-up names can't evict the assets.
+type assetCache struct {
+	maxFileSize int64
+	notFoundTTL time.Duration
+
+	mu       sync.Mutex
+	assets   *assetLRU
+	notFound *assetLRU
+}
+
+// assetLRU is a list of cached assets, least recently used last. Callers
+// hold the lock of the cache.
+type assetLRU struct {
+	maxSize int64
+	cost    func(*cachedAsset) int64
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// assetCaches are all asset caches, for FlushAssetCaches
+var (
+	assetCaches      []*assetCache
+	assetCachesMutex sync.Mutex
+)
+
+func newAssetCache(cfg config.AssetCacheConfig) *assetCache {
+	if cfg.Disabled {
+		return nil
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultAssetCacheSize
+	}
+	maxNotFound := int64(cfg.NotFoundMaxEntries)
+	if maxNotFound <= 0 {
+		maxNotFound = defaultAssetCacheNotFoundEntries
+	}
+
+	c := &assetCache{
+		maxFileSize: cfg.MaxFileSize,
+		notFoundTTL: defaultAssetCacheNotFoundTTL,
+		// The name is counted too, so that many small assets can't grow
+		// the cache without bounds
+		assets:   newAssetLRU(maxSize, func(a *cachedAsset) int64 { return int64(len(a.name) + len(a.data)) }),
+		notFound: newAssetLRU(maxNotFound, func(*cachedAsset) int64 { return 1 }),
+	}
+	if c.maxFileSize <= 0 {
+		c.maxFileSize = defaultAssetCacheMaxFileSize
+	}
+	if cfg.NotFoundTTL != nil {
+		c.notFoundTTL = cfg.NotFoundTTL.Duration
+	}
+
+	assetCachesMutex.Lock()
+	defer assetCachesMutex.Unlock()
+	assetCaches = append(assetCaches, c)
+
+	return c
+}
+
+func newAssetLRU(maxSize int64, cost func(*cachedAsset) int64) *assetLRU {
+	return &assetLRU{
+		maxSize: maxSize,
+		cost:    cost,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// FlushAssetCaches empties the in-memory asset caches, e.g. after assets
+// were replaced without changing their fingerprints. It returns the number
+// of entries removed.
+func FlushAssetCaches() int {
+	assetCachesMutex.Lock()
+	caches := append([]*assetCache(nil), assetCaches...)
+	assetCachesMutex.Unlock()
+
+	flushed := 0
+	for _, c := range caches {
+		flushed += c.flush()
+	}
+	return flushed
+}
+
+func (c *assetCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.assets.flush() + c.notFound.flush()
+}
+
+// open behaves like openStaticFile, but serves fingerprinted assets from
+// memory if possible
+func (c *assetCache) open(name string) (*staticFile, error) {
+	if c == nil || !isFingerprinted(name) {
+		return openStaticFile(name)
+	}
+
+	if asset := c.get(name); asset != nil {
+		if asset.notFound {
+			assetCacheRequests.WithLabelValues("not_found").Inc()
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+
+		assetCacheRequests.WithLabelValues("hit").Inc()
+		return &staticFile{ReadSeeker: bytes.NewReader(asset.data), Closer: nopCloser{}, modTime: asset.modTime}, nil
+	}
+	assetCacheRequests.WithLabelValues("miss").Inc()
+
+	file, fi, err := helper.OpenFile(name)
+	if os.IsNotExist(err) {
+		c.add(&cachedAsset{name: name, notFound: true, expires: time.Now().Add(c.notFoundTTL)})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() > c.maxFileSize {
+		return &staticFile{ReadSeeker: file, Closer: file, modTime: fi.ModTime()}, nil
+	}
+
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c.add(&cachedAsset{name: name, data: data, modTime: fi.ModTime()})
+	return &staticFile{ReadSeeker: bytes.NewReader(data), Closer: nopCloser{}, modTime: fi.ModTime()}, nil
+}
+
+func (c *assetCache) get(name string) *cachedAsset {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if asset := c.assets.get(name); asset != nil {
+		return asset
+	}
+
+	asset := c.notFound.get(name)
+	if asset != nil && time.Now().After(asset.expires) {
+		c.notFound.remove(c.notFound.entries[name])
+		return nil
+	}
+	return asset
+}
+
+func (c *assetCache) add(asset *cachedAsset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// An asset is in one of the lists at most
+	if elem := c.notFound.entries[asset.name]; elem != nil {
+		c.notFound.remove(elem)
+	}
+	if elem := c.assets.entries[asset.name]; elem != nil {
+		c.assets.remove(elem)
+	}
+
+	if asset.notFound {
+		c.notFound.add(asset)
+	} else {
+		c.assets.add(asset)
+	}
+}
+
+func (l *assetLRU) get(name string) *cachedAsset {
+	elem := l.entries[name]
+	if elem == nil {
+		return nil
+	}
+
+	l.lru.MoveToFront(elem)
+	return elem.Value.(*cachedAsset)
+}
+
+func (l *assetLRU) add(asset *cachedAsset) {
+	l.entries[asset.name] = l.lru.PushFront(asset)
+	l.size += l.cost(asset)
+
+	for l.size > l.maxSize {
+		l.remove(l.lru.Back())
+	}
+}
+
+func (l *assetLRU) remove(elem *list.Element) {
+	asset := l.lru.Remove(elem).(*cachedAsset)
+	delete(l.entries, asset.name)
+	l.size -= l.cost(asset)
+}
+
+func (l *assetLRU) flush() int {
+	flushed := len(l.entries)
+	l.size = 0
+	l.lru.Init()
+	l.entries = make(map[string]*list.Element)
+	return flushed
+}
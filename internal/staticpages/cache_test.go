@@ -0,0 +1,178 @@
+package staticpages
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+const fingerprintedAsset = "application-5f1d3e4c6b7a8d9e0f1a2b3c4d5e6f7a.css"
+
+func TestIsFingerprinted(t *testing.T) {
+	testCases := map[string]bool{
+		"/assets/" + fingerprintedAsset:                  true,
+		"/assets/webpack/main.3b9f1a2c.chunk.js":         true,
+		"/assets/webpack/main.3b9f1a2c.chunk.js.gz":      true,
+		"/assets/favicon.png":                            false,
+		"/assets/icons-stacked.svg":                      false,
+		"/assets/application-5f1d3e4c6b7a8d9e0f1a2b3c4d": false,
+	}
+
+	for file, expected := range testCases {
+		require.Equal(t, expected, isFingerprinted(file), file)
+	}
+}
+
+func serveAsset(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("GET", path, nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAssetCacheServesFromMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	asset := filepath.Join(dir, fingerprintedAsset)
+	require.NoError(t, ioutil.WriteFile(asset, []byte("body { }"), 0600))
+
+	st := &Static{DocumentRoot: dir}
+	handler := st.ServeExisting("/", CacheExpireMax, nil)
+
+	w := serveAsset(t, handler, "/"+fingerprintedAsset)
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseBody(t, w, "body { }")
+	testhelper.AssertResponseWriterHeader(t, w, "Cache-Control", "public, max-age=31536000, immutable")
+
+	// The second request must not touch the disk
+	require.NoError(t, os.Remove(asset))
+
+	w = serveAsset(t, handler, "/"+fingerprintedAsset)
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseBody(t, w, "body { }")
+}
+
+func TestAssetCacheRemembersMissingAssets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st := &Static{
+		DocumentRoot: dir,
+		AssetCache:   config.AssetCacheConfig{NotFoundTTL: &config.TomlDuration{Duration: 100 * time.Millisecond}},
+	}
+	handler := st.ServeExisting("/", CacheExpireMax, nil)
+
+	w := serveAsset(t, handler, "/"+fingerprintedAsset)
+	testhelper.AssertResponseCode(t, w, 404)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fingerprintedAsset), []byte("body { }"), 0600))
+
+	w = serveAsset(t, handler, "/"+fingerprintedAsset)
+	testhelper.AssertResponseCode(t, w, 404)
+
+	time.Sleep(150 * time.Millisecond)
+
+	w = serveAsset(t, handler, "/"+fingerprintedAsset)
+	testhelper.AssertResponseCode(t, w, 200)
+}
+
+func TestAssetCacheSkipsMutableFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	asset := filepath.Join(dir, "favicon.ico")
+	require.NoError(t, ioutil.WriteFile(asset, []byte("old"), 0600))
+
+	st := &Static{DocumentRoot: dir}
+	handler := st.ServeExisting("/", CacheExpireMax, nil)
+
+	w := serveAsset(t, handler, "/favicon.ico")
+	testhelper.AssertResponseBody(t, w, "old")
+	testhelper.AssertResponseWriterHeader(t, w, "Cache-Control", "public")
+
+	require.NoError(t, ioutil.WriteFile(asset, []byte("new"), 0600))
+
+	w = serveAsset(t, handler, "/favicon.ico")
+	testhelper.AssertResponseBody(t, w, "new")
+}
+
+func TestAssetCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := newAssetCache(config.AssetCacheConfig{MaxSize: 1024, MaxFileSize: 512})
+
+	names := []string{"a-0123456789abcdef.js", "b-0123456789abcdef.js", "c-0123456789abcdef.js"}
+	for _, name := range names {
+		file := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(file, make([]byte, 400), 0600))
+
+		f, err := c.open(file)
+		require.NoError(t, err)
+		f.Close()
+	}
+
+	require.True(t, c.assets.size <= c.assets.maxSize, "cache size %d exceeds %d", c.assets.size, c.assets.maxSize)
+	require.Nil(t, c.get(filepath.Join(dir, names[0])), "least recently used asset should be evicted")
+	require.NotNil(t, c.get(filepath.Join(dir, names[2])))
+}
+
+func TestAssetCacheKeepsMissingAssetsApart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := newAssetCache(config.AssetCacheConfig{NotFoundMaxEntries: 2})
+
+	asset := filepath.Join(dir, "a-0123456789abcdef.js")
+	require.NoError(t, ioutil.WriteFile(asset, []byte("a"), 0600))
+	f, err := c.open(asset)
+	require.NoError(t, err)
+	f.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := c.open(filepath.Join(dir, fmt.Sprintf("missing-%016x.js", i)))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	require.Equal(t, int64(2), c.notFound.size, "missing assets are bounded by NotFoundMaxEntries")
+	require.NotNil(t, c.get(asset), "missing assets do not evict assets")
+	require.Equal(t, 3, c.flush())
+}
+
+func TestAssetCacheSkipsLargeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, fingerprintedAsset)
+	require.NoError(t, ioutil.WriteFile(file, make([]byte, 2048), 0600))
+
+	c := newAssetCache(config.AssetCacheConfig{MaxFileSize: 1024})
+	f, err := c.open(file)
+	require.NoError(t, err)
+	f.Close()
+
+	require.Nil(t, c.get(file))
+}
+
+func TestAssetCacheDisabled(t *testing.T) {
+	require.Nil(t, newAssetCache(config.AssetCacheConfig{Disabled: true}))
+}
@@ -0,0 +1,77 @@
+package staticpages
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// precompressedEncoding maps a Content-Encoding to the file extension of
+// the precompressed variant of an asset
+type precompressedEncoding struct {
+	name      string
+	extension string
+}
+
+// precompressedEncodings are listed in order of preference: they compress
+// better, in that order.
+var precompressedEncodings = []precompressedEncoding{
+	{name: "br", extension: ".br"},
+	{name: "zstd", extension: ".zst"},
+	{name: "gzip", extension: ".gz"},
+}
+
+// acceptedEncodings returns the precompressed encodings accepted by the
+// client, the ones with the highest quality value first
+func acceptedEncodings(r *http.Request) []precompressedEncoding {
+	qualities := parseAcceptEncoding(r.Header.Get("Accept-Encoding"))
+
+	var accepted []precompressedEncoding
+	for _, e := range precompressedEncodings {
+		if encodingQuality(qualities, e.name) > 0 {
+			accepted = append(accepted, e)
+		}
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return encodingQuality(qualities, accepted[i].name) > encodingQuality(qualities, accepted[j].name)
+	})
+
+	return accepted
+}
+
+func parseAcceptEncoding(header string) map[string]float64 {
+	qualities := make(map[string]float64)
+
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+				q = parsed
+			}
+		}
+
+		qualities[coding] = q
+	}
+
+	return qualities
+}
+
+func encodingQuality(qualities map[string]float64, coding string) float64 {
+	if q, ok := qualities[coding]; ok {
+		return q
+	}
+	// The wildcard matches any coding not listed explicitly
+	return qualities["*"]
+}
@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -28,6 +32,15 @@ const (
 	ErrorFormatHTML ErrorFormat = iota
 	ErrorFormatJSON
 	ErrorFormatText
+	// ErrorFormatNegotiate serves HTML error pages unless the client
+	// prefers JSON. Git clients get a pkt-line error.
+	ErrorFormatNegotiate
+	// ErrorFormatAPI only replaces the responses sent when the backend is
+	// unavailable, with JSON unless the client prefers HTML. Git clients
+	// get a pkt-line error.
+	ErrorFormatAPI
+	// Git clients are only detected by negotiation
+	errorFormatGit
 )
 
 func init() {
@@ -40,6 +53,11 @@ type errorPageResponseWriter struct {
 	hijacked bool
 	path     string
 	format   ErrorFormat
+	// unavailableOnly restricts error pages to the responses sent when the
+	// backend is unavailable. Other errors come from Rails and are already
+	// in the format the client asked for.
+	unavailableOnly bool
+	gitService      string
 }
 
 func (s *errorPageResponseWriter) Header() http.Header {
@@ -68,6 +86,11 @@ func (s *errorPageResponseWriter) WriteHeader(status int) {
 		return
 	}
 
+	if s.unavailableOnly && (!isUnavailableStatus(s.status) || s.isFormatted()) {
+		s.rw.WriteHeader(status)
+		return
+	}
+
 	var contentType string
 	var data []byte
 	switch s.format {
@@ -75,6 +98,11 @@ func (s *errorPageResponseWriter) WriteHeader(status int) {
 		contentType, data = s.writeText()
 	case ErrorFormatJSON:
 		contentType, data = s.writeJSON()
+	case errorFormatGit:
+		contentType, data = s.writeGit()
+		// Git clients ignore the body of unsuccessful responses, the
+		// error is part of the Git protocol instead
+		status = http.StatusOK
 	default:
 		contentType, data = s.writeHTML()
 	}
@@ -91,7 +119,7 @@ func (s *errorPageResponseWriter) WriteHeader(status int) {
 	s.rw.Header().Set("Content-Type", contentType)
 	s.rw.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
 	s.rw.Header().Del("Transfer-Encoding")
-	s.rw.WriteHeader(s.status)
+	s.rw.WriteHeader(status)
 	s.rw.Write(data)
 }
 
@@ -121,6 +149,15 @@ func (s *errorPageResponseWriter) writeText() (string, []byte) {
 	return "text/plain; charset=utf-8", []byte(http.StatusText(s.status) + "\n")
 }
 
+// writeGit sends an ERR pkt-line, which Git shows to the user as 'remote
+// error: ...'
+func (s *errorPageResponseWriter) writeGit() (string, []byte) {
+	message := fmt.Sprintf("ERR GitLab is currently unavailable: %d %s\n", s.status, http.StatusText(s.status))
+	data := []byte(fmt.Sprintf("%04x%s", len(message)+4, message))
+
+	return "application/x-" + s.gitService, data
+}
+
 func (s *errorPageResponseWriter) flush() {
 	s.WriteHeader(http.StatusOK)
 }
@@ -132,10 +169,108 @@ func (st *Static) ErrorPagesUnless(disabled bool, format ErrorFormat, handler ht
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		rw := errorPageResponseWriter{
 			rw:     w,
-			path:   st.DocumentRoot,
+			path:   st.errorPagesDir(),
 			format: format,
 		}
+
+		if format == ErrorFormatNegotiate || format == ErrorFormatAPI {
+			rw.negotiate(r)
+		}
+
 		defer rw.flush()
 		handler.ServeHTTP(&rw, r)
 	})
 }
+
+// negotiate picks the error format for r. Only HTML error pages replace
+// every error response.
+func (s *errorPageResponseWriter) negotiate(r *http.Request) {
+	s.unavailableOnly = true
+
+	if service := gitService(r); service != "" {
+		s.format, s.gitService = errorFormatGit, service
+		return
+	}
+
+	// Git shows the plain text body of failed info/refs requests, and
+	// scripts rely on their status
+	if isGitInfoRefs(r) {
+		s.format = ErrorFormatText
+		return
+	}
+
+	htmlQ, jsonQ := acceptQuality(r.Header.Get("Accept"), "text/html"), acceptQuality(r.Header.Get("Accept"), "application/json")
+	switch {
+	case s.format == ErrorFormatNegotiate && jsonQ > htmlQ:
+		s.format = ErrorFormatJSON
+	case s.format == ErrorFormatNegotiate:
+		s.format, s.unavailableOnly = ErrorFormatHTML, false
+	case htmlQ > jsonQ:
+		s.format = ErrorFormatHTML
+	default:
+		s.format = ErrorFormatJSON
+	}
+}
+
+// isFormatted reports whether the response already is in the negotiated
+// format, e.g. a JSON error sent by Rails
+func (s *errorPageResponseWriter) isFormatted() bool {
+	switch s.format {
+	case ErrorFormatJSON:
+		return isContentType(s.rw.Header(), "application/json")
+	case errorFormatGit:
+		return isContentType(s.rw.Header(), "application/x-"+s.gitService)
+	}
+	return false
+}
+
+func isUnavailableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isContentType(h http.Header, mimeType string) bool {
+	parsed, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && parsed == mimeType
+}
+
+// gitService returns the content type suffix of the response expected by
+// a Git smart HTTP client to a fetch or a push, e.g.
+// 'git-upload-pack-result'. Only these responses can carry an ERR
+// pkt-line: Git reads them after a successful info/refs request.
+func gitService(r *http.Request) string {
+	switch base := path.Base(r.URL.Path); base {
+	case "git-upload-pack", "git-receive-pack":
+		if r.Method == "POST" {
+			return base + "-result"
+		}
+	}
+
+	return ""
+}
+
+func isGitInfoRefs(r *http.Request) bool {
+	return r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/info/refs") && r.URL.Query().Get("service") != ""
+}
+
+// acceptQuality returns the quality value of mimeType in an Accept header.
+// Wildcards don't count, they express no preference.
+func acceptQuality(accept string, mimeType string) float64 {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parsed, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || parsed != mimeType {
+			continue
+		}
+
+		q, err := strconv.ParseFloat(params["q"], 64)
+		if err != nil {
+			return 1
+		}
+		return q
+	}
+
+	return 0
+}
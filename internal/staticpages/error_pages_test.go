@@ -32,7 +32,7 @@ func TestIfErrorPageIsPresented(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, len(upstreamBody), n, "bytes written")
 	})
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ErrorPagesUnless(false, ErrorFormatHTML, h).ServeHTTP(w, nil)
 	w.Flush()
 
@@ -54,7 +54,7 @@ func TestIfErrorPassedIfNoErrorPageIsFound(t *testing.T) {
 		w.WriteHeader(404)
 		fmt.Fprint(w, errorResponse)
 	})
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ErrorPagesUnless(false, ErrorFormatHTML, h).ServeHTTP(w, nil)
 	w.Flush()
 
@@ -78,7 +78,7 @@ func TestIfErrorPageIsIgnoredInDevelopment(t *testing.T) {
 		w.WriteHeader(500)
 		fmt.Fprint(w, serverError)
 	})
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ErrorPagesUnless(true, ErrorFormatHTML, h).ServeHTTP(w, nil)
 	w.Flush()
 	testhelper.AssertResponseCode(t, w, 500)
@@ -102,7 +102,7 @@ func TestIfErrorPageIsIgnoredIfCustomError(t *testing.T) {
 		w.WriteHeader(500)
 		fmt.Fprint(w, serverError)
 	})
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ErrorPagesUnless(false, ErrorFormatHTML, h).ServeHTTP(w, nil)
 	w.Flush()
 	testhelper.AssertResponseCode(t, w, 500)
@@ -137,7 +137,7 @@ func TestErrorPageInterceptedByContentType(t *testing.T) {
 			w.WriteHeader(500)
 			fmt.Fprint(w, serverError)
 		})
-		st := &Static{dir}
+		st := &Static{DocumentRoot: dir}
 		st.ErrorPagesUnless(false, ErrorFormatHTML, h).ServeHTTP(w, nil)
 		w.Flush()
 		testhelper.AssertResponseCode(t, w, 500)
@@ -161,7 +161,7 @@ func TestIfErrorPageIsPresentedJSON(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, len(upstreamBody), n, "bytes written")
 	})
-	st := &Static{""}
+	st := &Static{}
 	st.ErrorPagesUnless(false, ErrorFormatJSON, h).ServeHTTP(w, nil)
 	w.Flush()
 
@@ -181,7 +181,7 @@ func TestIfErrorPageIsPresentedText(t *testing.T) {
 		require.NoError(t, err)
 		require.Equal(t, len(upstreamBody), n, "bytes written")
 	})
-	st := &Static{""}
+	st := &Static{}
 	st.ErrorPagesUnless(false, ErrorFormatText, h).ServeHTTP(w, nil)
 	w.Flush()
 
@@ -189,3 +189,147 @@ func TestIfErrorPageIsPresentedText(t *testing.T) {
 	testhelper.AssertResponseBody(t, w, errorPage)
 	testhelper.AssertResponseHeader(t, w, "Content-Type", "text/plain; charset=utf-8")
 }
+
+func TestErrorPagesDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "error_page")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	errorPage := "CUSTOM ERROR"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "502.html"), []byte(errorPage), 0600))
+
+	w := httptest.NewRecorder()
+	h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(502)
+	})
+	st := &Static{DocumentRoot: "/does/not/exist", ErrorPagesDir: dir}
+	st.ErrorPagesUnless(false, ErrorFormatHTML, h).ServeHTTP(w, nil)
+	w.Flush()
+
+	testhelper.AssertResponseCode(t, w, 502)
+	testhelper.AssertResponseBody(t, w, errorPage)
+}
+
+func TestErrorPageNegotiation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "error_page")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, code := range []int{404, 502} {
+		page := []byte(fmt.Sprintf("HTML %d", code))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.html", code)), page, 0600))
+	}
+
+	jsonError := "{\"error\":\"Bad Gateway\",\"status\":502}\n"
+
+	testCases := []struct {
+		desc        string
+		format      ErrorFormat
+		method      string
+		url         string
+		accept      string
+		status      int
+		contentType string
+		code        int
+		body        string
+	}{
+		{
+			desc:   "browser",
+			format: ErrorFormatNegotiate, method: "GET", url: "/group/project", accept: "text/html,application/xhtml+xml,*/*;q=0.8",
+			status: 404, code: 404, body: "HTML 404",
+		},
+		{
+			desc:   "JSON client",
+			format: ErrorFormatNegotiate, method: "GET", url: "/group/project", accept: "application/json",
+			status: 502, code: 502, body: jsonError,
+		},
+		{
+			desc:   "JSON client with error from Rails",
+			format: ErrorFormatNegotiate, method: "GET", url: "/group/project", accept: "application/json",
+			status: 404, code: 404, body: "upstream",
+		},
+		{
+			desc:   "API client without preference",
+			format: ErrorFormatAPI, method: "GET", url: "/api/v4/projects", accept: "*/*",
+			status: 502, code: 502, body: jsonError,
+		},
+		{
+			desc:   "API client preferring HTML",
+			format: ErrorFormatAPI, method: "GET", url: "/api/v4/projects", accept: "text/html,application/json;q=0.9",
+			status: 502, code: 502, body: "HTML 502",
+		},
+		{
+			desc:   "API error from Rails",
+			format: ErrorFormatAPI, method: "GET", url: "/api/v4/projects", accept: "text/html",
+			status: 404, code: 404, body: "upstream",
+		},
+		{
+			desc:   "API JSON error from Rails",
+			format: ErrorFormatAPI, method: "GET", url: "/api/v4/projects",
+			status: 503, contentType: "application/json", code: 503, body: "upstream",
+		},
+		{
+			desc:   "Git info/refs",
+			format: ErrorFormatAPI, method: "GET", url: "/group/project.git/info/refs?service=git-upload-pack",
+			status: 502, code: 502, body: "Bad Gateway\n", contentType: "text/plain",
+		},
+		{
+			desc:   "Git push",
+			format: ErrorFormatAPI, method: "POST", url: "/group/project.git/git-receive-pack",
+			status: 503, code: 200, body: "0041ERR GitLab is currently unavailable: 503 Service Unavailable\n",
+		},
+		{
+			desc:   "Git fetch",
+			format: ErrorFormatAPI, method: "POST", url: "/group/project.git/git-upload-pack",
+			status: 502, code: 200, body: "0039ERR GitLab is currently unavailable: 502 Bad Gateway\n",
+		},
+		{
+			desc:   "Git archive",
+			format: ErrorFormatAPI, method: "POST", url: "/group/project.git/git-upload-archive",
+			status: 502, code: 502, body: jsonError,
+		},
+		{
+			desc:   "Git concurrency limit",
+			format: ErrorFormatAPI, method: "POST", url: "/group/project.git/git-upload-pack",
+			status: 429, code: 429, body: "upstream",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tc.contentType != "" {
+					w.Header().Set("Content-Type", tc.contentType)
+				}
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, "upstream")
+			})
+
+			r := httptest.NewRequest(tc.method, tc.url, nil)
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+
+			w := httptest.NewRecorder()
+			st := &Static{DocumentRoot: dir}
+			st.ErrorPagesUnless(false, tc.format, h).ServeHTTP(w, r)
+
+			testhelper.AssertResponseCode(t, w, tc.code)
+			testhelper.AssertResponseBody(t, w, tc.body)
+		})
+	}
+}
+
+func TestErrorPageGitContentType(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(502)
+	})
+
+	r := httptest.NewRequest("POST", "/group/project.git/git-upload-pack", nil)
+	w := httptest.NewRecorder()
+	st := &Static{}
+	st.ErrorPagesUnless(false, ErrorFormatNegotiate, h).ServeHTTP(w, r)
+
+	testhelper.AssertResponseCode(t, w, 200)
+	testhelper.AssertResponseHeader(t, w, "Content-Type", "application/x-git-upload-pack-result")
+}
@@ -25,6 +25,13 @@ const (
 // handleServeFile will serve foo/bar instead of passing the request
 // upstream.
 func (s *Static) ServeExisting(prefix urlprefix.Prefix, cache CacheMode, notFoundHandler http.Handler) http.Handler {
+	// Only assets that can be cached by clients forever can be cached in
+	// memory, the others may change on disk
+	var assets *assetCache
+	if cache == CacheExpireMax {
+		assets = newAssetCache(s.AssetCache)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		file := filepath.Join(s.DocumentRoot, prefix.Strip(r.URL.Path))
 
@@ -38,21 +45,21 @@ func (s *Static) ServeExisting(prefix urlprefix.Prefix, cache CacheMode, notFoun
 			return
 		}
 
-		var content *os.File
-		var fi os.FileInfo
+		var content *staticFile
 		var err error
 
-		// Serve pre-gzipped assets
-		if acceptEncoding := r.Header.Get("Accept-Encoding"); strings.Contains(acceptEncoding, "gzip") {
-			content, fi, err = helper.OpenFile(file + ".gz")
+		// Serve precompressed assets
+		for _, encoding := range acceptedEncodings(r) {
+			content, err = assets.open(file + encoding.extension)
 			if err == nil {
-				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Encoding", encoding.name)
+				break
 			}
 		}
 
 		// If not found, open the original file
 		if content == nil || err != nil {
-			content, fi, err = helper.OpenFile(file)
+			content, err = assets.open(file)
 		}
 		if err != nil {
 			if notFoundHandler != nil {
@@ -64,12 +71,19 @@ func (s *Static) ServeExisting(prefix urlprefix.Prefix, cache CacheMode, notFoun
 		}
 		defer content.Close()
 
+		// Caches must not hand a compressed file to clients that can't
+		// decode it
+		w.Header().Add("Vary", "Accept-Encoding")
+
 		switch cache {
 		case CacheExpireMax:
 			// Cache statically served files for 1 year
 			cacheUntil := time.Now().AddDate(1, 0, 0).Format(http.TimeFormat)
 			w.Header().Set("Cache-Control", "public")
 			w.Header().Set("Expires", cacheUntil)
+			if isFingerprinted(file) {
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			}
 		}
 
 		log.WithContextFields(r.Context(), log.Fields{
@@ -79,6 +93,6 @@ func (s *Static) ServeExisting(prefix urlprefix.Prefix, cache CacheMode, notFoun
 			"uri":      mask.URL(r.RequestURI),
 		}).Info("Send static file")
 
-		http.ServeContent(w, r, filepath.Base(file), fi.ModTime(), content)
+		http.ServeContent(helper.WithPooledCopy(w), r, filepath.Base(file), content.modTime, content)
 	})
 }
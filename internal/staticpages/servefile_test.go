@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/stretchr/testify/require"
+
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 )
 
@@ -18,7 +20,7 @@ func TestServingNonExistingFile(t *testing.T) {
 	httpRequest, _ := http.NewRequest("GET", "/file", nil)
 
 	w := httptest.NewRecorder()
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
 	testhelper.AssertResponseCode(t, w, 404)
 }
@@ -32,7 +34,7 @@ func TestServingDirectory(t *testing.T) {
 
 	httpRequest, _ := http.NewRequest("GET", "/file", nil)
 	w := httptest.NewRecorder()
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
 	testhelper.AssertResponseCode(t, w, 404)
 }
@@ -42,7 +44,7 @@ func TestServingMalformedUri(t *testing.T) {
 	httpRequest, _ := http.NewRequest("GET", "/../../../static/file", nil)
 
 	w := httptest.NewRecorder()
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
 	testhelper.AssertResponseCode(t, w, 404)
 }
@@ -52,7 +54,7 @@ func TestExecutingHandlerWhenNoFileFound(t *testing.T) {
 	httpRequest, _ := http.NewRequest("GET", "/file", nil)
 
 	executed := false
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ServeExisting("/", CacheDisabled, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
 		executed = (r == httpRequest)
 	})).ServeHTTP(nil, httpRequest)
@@ -74,7 +76,7 @@ func TestServingTheActualFile(t *testing.T) {
 	ioutil.WriteFile(filepath.Join(dir, "file"), []byte(fileContent), 0600)
 
 	w := httptest.NewRecorder()
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
 	testhelper.AssertResponseCode(t, w, 200)
 	if w.Body.String() != fileContent {
@@ -106,7 +108,7 @@ func testServingThePregzippedFile(t *testing.T, enableGzip bool) {
 	ioutil.WriteFile(filepath.Join(dir, "file"), []byte(fileContent), 0600)
 
 	w := httptest.NewRecorder()
-	st := &Static{dir}
+	st := &Static{DocumentRoot: dir}
 	st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
 	testhelper.AssertResponseCode(t, w, 200)
 	if enableGzip {
@@ -130,3 +132,74 @@ func TestServingThePregzippedFile(t *testing.T) {
 func TestServingThePregzippedFileWithoutEncoding(t *testing.T) {
 	testServingThePregzippedFile(t, false)
 }
+
+func TestServingPrecompressedVariants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	variants := map[string]string{
+		"file":     "plain",
+		"file.br":  "brotli",
+		"file.zst": "zstd",
+		"file.gz":  "gzip",
+	}
+	for name, content := range variants {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+
+	testCases := []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{acceptEncoding: "", encoding: "", body: "plain"},
+		{acceptEncoding: "gzip, deflate", encoding: "gzip", body: "gzip"},
+		{acceptEncoding: "gzip, deflate, br", encoding: "br", body: "brotli"},
+		{acceptEncoding: "gzip, zstd", encoding: "zstd", body: "zstd"},
+		{acceptEncoding: "br;q=0.5, zstd;q=0.8, gzip;q=1.0", encoding: "gzip", body: "gzip"},
+		{acceptEncoding: "br;q=0, gzip", encoding: "gzip", body: "gzip"},
+		{acceptEncoding: "*", encoding: "br", body: "brotli"},
+		{acceptEncoding: "gzip;q=0, *;q=0.5", encoding: "br", body: "brotli"},
+		{acceptEncoding: "identity", encoding: "", body: "plain"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			httpRequest, _ := http.NewRequest("GET", "/file", nil)
+			httpRequest.Header.Set("Accept-Encoding", tc.acceptEncoding)
+
+			w := httptest.NewRecorder()
+			st := &Static{DocumentRoot: dir}
+			st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
+
+			testhelper.AssertResponseCode(t, w, 200)
+			if tc.encoding == "" {
+				testhelper.AssertAbsentResponseWriterHeader(t, w, "Content-Encoding")
+			} else {
+				testhelper.AssertResponseWriterHeader(t, w, "Content-Encoding", tc.encoding)
+			}
+			testhelper.AssertResponseWriterHeader(t, w, "Vary", "Accept-Encoding")
+			testhelper.AssertResponseBody(t, w, tc.body)
+		})
+	}
+}
+
+func TestServingFallsBackToAvailableVariant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("plain"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file.gz"), []byte("gzip"), 0600))
+
+	httpRequest, _ := http.NewRequest("GET", "/file", nil)
+	httpRequest.Header.Set("Accept-Encoding", "br, zstd, gzip")
+
+	w := httptest.NewRecorder()
+	st := &Static{DocumentRoot: dir}
+	st.ServeExisting("/", CacheDisabled, nil).ServeHTTP(w, httpRequest)
+
+	testhelper.AssertResponseWriterHeader(t, w, "Content-Encoding", "gzip")
+	testhelper.AssertResponseBody(t, w, "gzip")
+}
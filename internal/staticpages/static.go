@@ -1,5 +1,20 @@
 package staticpages
 
+import "gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+
 type Static struct {
 	DocumentRoot string
+	// ErrorPagesDir holds custom error pages such as 502.html. Defaults to
+	// DocumentRoot.
+	ErrorPagesDir string
+	// AssetCache configures the in-memory cache of ServeExisting with
+	// CacheExpireMax
+	AssetCache config.AssetCacheConfig
+}
+
+func (s *Static) errorPagesDir() string {
+	if s.ErrorPagesDir != "" {
+		return s.ErrorPagesDir
+	}
+	return s.DocumentRoot
 }
@@ -0,0 +1,181 @@
+/*
+Package status serves /-/status, a JSON summary of the internal state of
+Workhorse for operators and external monitoring.
+
+Packages add their state with Register. The values are read on every
+request, so sources must be cheap and safe to call concurrently.
+*/
+package status
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// By default only local monitoring can see the status, like the
+// monitoring whitelist of Rails
+var defaultAllowedCIDRs = []string{"127.0.0.0/8", "::1/128"}
+
+// Source returns the state of a part of Workhorse. The result is encoded
+// as JSON.
+type Source func() interface{}
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]Source)
+
+	started = time.Now()
+)
+
+// Register adds source to the status under name, replacing the source
+// registered before under that name
+func Register(name string, source Source) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[name] = source
+}
+
+// GaugeValue reads the current value of g, so that sources don't need to
+// count what is counted for Prometheus already
+func GaugeValue(g prometheus.Gauge) float64 {
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		return 0
+	}
+	return m.GetGauge().GetValue()
+}
+
+// ConfigHash identifies a configuration, so that operators can tell if
+// all instances run with the same one
+func ConfigHash(cfg config.Config) (string, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("status: hash config: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Info identifies the running Workhorse
+type Info struct {
+	Version    string
+	BuildTime  string
+	ConfigHash string
+}
+
+var (
+	configMu sync.RWMutex
+	info     Info
+	allowed  = mustParseCIDRs(defaultAllowedCIDRs)
+)
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("status: AllowedCIDRs %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// Configure sets who can see the status and how Workhorse identifies
+// itself
+func Configure(cfg config.StatusConfig, i Info) error {
+	cidrs := cfg.AllowedCIDRs
+	if len(cidrs) == 0 {
+		cidrs = defaultAllowedCIDRs
+	}
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	info = i
+	allowed = nets
+
+	return nil
+}
+
+func isAllowed(r *http.Request, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler serves the status to allowed clients, and 404 to the others
+func Handler() http.Handler {
+	return http.HandlerFunc(serveStatus)
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	i, nets := info, allowed
+	configMu.RUnlock()
+
+	if !isAllowed(r, nets) {
+		helper.HTTPError(w, r, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	status := map[string]interface{}{
+		"version":        i.Version,
+		"build_time":     i.BuildTime,
+		"config_hash":    i.ConfigHash,
+		"uptime_seconds": int64(time.Since(started).Seconds()),
+	}
+
+	sourcesMu.RLock()
+	current := make(map[string]Source, len(sources))
+	for name, source := range sources {
+		current[name] = source
+	}
+	sourcesMu.RUnlock()
+
+	for name, source := range current {
+		status[name] = source()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		helper.LogError(r, fmt.Errorf("status: %v", err))
+	}
+}
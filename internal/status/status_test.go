@@ -0,0 +1,84 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func getStatus(t *testing.T, remoteAddr string) (int, map[string]interface{}) {
+	r := httptest.NewRequest("GET", "/-/status", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w.Code, body
+}
+
+func TestStatus(t *testing.T) {
+	require.NoError(t, Configure(config.StatusConfig{}, Info{Version: "v1.2.3", ConfigHash: "abc"}))
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_open"})
+	gauge.Add(3)
+	Register("test", func() interface{} {
+		return map[string]interface{}{"open": GaugeValue(gauge)}
+	})
+
+	code, body := getStatus(t, "127.0.0.1:1234")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "v1.2.3", body["version"])
+	require.Equal(t, "abc", body["config_hash"])
+	require.Equal(t, map[string]interface{}{"open": 3.0}, body["test"])
+
+	code, _ = getStatus(t, "[::1]:1234")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = getStatus(t, "192.0.2.1:1234")
+	require.Equal(t, http.StatusNotFound, code, "only localhost is allowed by default")
+}
+
+func TestStatusAllowedCIDRs(t *testing.T) {
+	require.Error(t, Configure(config.StatusConfig{AllowedCIDRs: []string{"bogus"}}, Info{}))
+
+	require.NoError(t, Configure(config.StatusConfig{AllowedCIDRs: []string{"192.0.2.0/24"}}, Info{}))
+	defer Configure(config.StatusConfig{}, Info{})
+
+	code, _ := getStatus(t, "192.0.2.1:1234")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = getStatus(t, "127.0.0.1:1234")
+	require.Equal(t, http.StatusNotFound, code)
+}
+
+func TestConfigHash(t *testing.T) {
+	backend, err := url.Parse("http://localhost:8080")
+	require.NoError(t, err)
+
+	cfg := config.Config{Backend: backend, Version: "v1"}
+	hash, err := ConfigHash(cfg)
+	require.NoError(t, err)
+	require.Len(t, hash, 64)
+
+	again, err := ConfigHash(cfg)
+	require.NoError(t, err)
+	require.Equal(t, hash, again)
+
+	cfg.Correlation.Propagation = "trust"
+	changed, err := ConfigHash(cfg)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, changed)
+}
@@ -0,0 +1,134 @@
+package terraform
+
+import (
+	"fmt"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+// The lock of a state is a hash with the lock ID, the lock info of
+// Terraform, the fencing token, and whether Rails granted the lock yet.
+// The last fencing token of each state is kept in a counter of its own
+// that never expires, so that tokens only grow.
+
+var reserveScript = redigo.NewScript(2, `
+local lock = redis.call("HMGET", KEYS[1], "id", "info", "token")
+if lock[1] and lock[1] ~= ARGV[1] then
+  return {0, lock[2] or ""}
+end
+if lock[1] then
+  return {2, tonumber(lock[3])}
+end
+local token = redis.call("INCR", KEYS[2])
+redis.call("DEL", KEYS[1])
+redis.call("HMSET", KEYS[1], "id", ARGV[1], "info", ARGV[2], "token", token, "pending", 1)
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return {1, token}
+`)
+
+var confirmScript = redigo.NewScript(1, `
+if redis.call("HGET", KEYS[1], "id") ~= ARGV[1] then
+  return 0
+end
+redis.call("HDEL", KEYS[1], "pending")
+redis.call("PEXPIRE", KEYS[1], ARGV[2])
+return 1
+`)
+
+var releaseScript = redigo.NewScript(1, `
+local lock = redis.call("HMGET", KEYS[1], "id", "token")
+if lock[1] ~= ARGV[1] or lock[2] ~= ARGV[2] then
+  return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+type redisLockStore struct{}
+
+func lockKey(state string) string {
+	return keyPrefix + "lock:" + state
+}
+
+func tokenKey(state string) string {
+	return keyPrefix + "token:" + state
+}
+
+func (redisLockStore) reserve(state, id string, info []byte) (reservation, bool, error) {
+	reply, err := redigo.Values(doScript(reserveScript, lockKey(state), tokenKey(state), id, info, pendingLockTTL.Nanoseconds()/1e6))
+	if err != nil {
+		return reservation{}, false, err
+	}
+	if len(reply) != 2 {
+		return reservation{}, false, fmt.Errorf("reserve: unexpected reply %v", reply)
+	}
+
+	result, err := redigo.Int(reply[0], nil)
+	if err != nil {
+		return reservation{}, false, fmt.Errorf("reserve: %v", err)
+	}
+	if result == 0 {
+		holder, err := redigo.Bytes(reply[1], nil)
+		return reservation{holder: holder}, false, err
+	}
+
+	token, err := redigo.Int64(reply[1], nil)
+	return reservation{token: token, held: result == 2}, true, err
+}
+
+func (redisLockStore) confirm(state, id string, lockTTL time.Duration) error {
+	_, err := doScript(confirmScript, lockKey(state), id, lockTTL.Nanoseconds()/1e6)
+	return err
+}
+
+func (redisLockStore) release(state, id string, token int64) error {
+	_, err := doScript(releaseScript, lockKey(state), id, token)
+	return err
+}
+
+func (redisLockStore) clear(state string) error {
+	conn := redis.Get()
+	if conn == nil {
+		return fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", lockKey(state))
+	return err
+}
+
+func (redisLockStore) check(state, id string) (int64, bool, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return 0, false, fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	lock, err := redigo.Values(conn.Do("HMGET", lockKey(state), "id", "token"))
+	if err != nil {
+		return 0, false, err
+	}
+	if len(lock) != 2 || lock[0] == nil {
+		// Workhorse knows no lock, Rails decides
+		return 0, true, nil
+	}
+
+	holder, err := redigo.String(lock[0], nil)
+	if err != nil || holder != id {
+		return 0, false, err
+	}
+	token, err := redigo.Int64(lock[1], nil)
+	return token, true, err
+}
+
+func doScript(script *redigo.Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn := redis.Get()
+	if conn == nil {
+		return nil, fmt.Errorf("could not get Redis connection")
+	}
+	defer conn.Close()
+
+	return script.Do(conn, keysAndArgs...)
+}
@@ -0,0 +1,303 @@
+/*
+Package terraform fences the locks of the Terraform states GitLab keeps.
+
+Terraform locks a state before it writes it, and Rails decides who holds
+the lock. When Rails is slow, a client can give up on its lock request and
+retry, or a second client can ask for the lock while the first request is
+still on its way, and Rails may end up granting the lock twice. Once
+Rails authorized the user, Workhorse reserves the lock in Redis before the
+request goes to Rails, so that only one lock request per state is in
+flight, and rejects state writes with any other lock ID.
+
+Each reservation gets a fencing token, larger than all tokens of the state
+before. It goes to Rails with the lock request and with every state write
+under the lock, so that Rails can refuse writes under an older lock too.
+Rails stays authoritative: it still checks every request, and Workhorse
+forgets a lock as soon as Rails says it is gone.
+*/
+package terraform
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// FencingTokenHeader carries the fencing token of the lock to Rails
+const FencingTokenHeader = "Gitlab-Workhorse-Fencing-Token"
+
+const (
+	defaultLockTTL = 12 * time.Hour
+	// Reservations of lock requests Rails did not answer yet expire
+	// sooner, in case the Workhorse process that made them dies
+	pendingLockTTL  = 5 * time.Minute
+	maxLockBodySize = 64 * 1024
+
+	keyPrefix = "workhorse:terraform:"
+)
+
+// The state path without the relative URL root, and whether it is the
+// lock of the state
+var statePathRegex = regexp.MustCompile(`/api/v4/(projects/[^/]+/terraform/state/[^/]+)(/lock)?\z`)
+
+var (
+	lockRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_terraform_state_requests",
+			Help: "How many Terraform state requests were fenced, by operation and whether they reached Rails",
+		},
+		[]string{"operation", "result"},
+	)
+
+	mu      sync.RWMutex
+	current *fence
+)
+
+func init() {
+	prometheus.MustRegister(lockRequests)
+}
+
+type fence struct {
+	lockTTL time.Duration
+	store   lockStore
+}
+
+// lockInfo is the part of the lock info of Terraform Workhorse needs
+type lockInfo struct {
+	ID string `json:"ID"`
+}
+
+// reservation is the lock a lock request got
+type reservation struct {
+	// token is the fencing token of the lock
+	token int64
+	// held tells that the lock ID held the lock already, e.g. when
+	// Terraform retries. The lock stays as it is.
+	held bool
+	// holder is the lock info of the other lock ID holding the lock
+	holder []byte
+}
+
+// lockStore keeps the lock of each state
+type lockStore interface {
+	// reserve reserves the lock for id until Rails answers, unless a lock
+	// ID holds it already. It tells if id may ask Rails for the lock.
+	reserve(state, id string, info []byte) (res reservation, ok bool, err error)
+	// confirm keeps the lock of id for lockTTL once Rails granted it
+	confirm(state, id string, lockTTL time.Duration) error
+	// release drops the lock if id holds it with the fencing token
+	release(state, id string, token int64) error
+	// clear drops the lock, whoever holds it
+	clear(state string) error
+	// check tells if a state write with id may go to Rails, and the
+	// fencing token of its lock if there is one
+	check(state, id string) (token int64, ok bool, err error)
+}
+
+// Configure enables the lock fencing. It needs Redis.
+func Configure(cfg config.TerraformStateConfig, redisCfg *config.RedisConfig) error {
+	f, err := newFence(cfg, redisCfg)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	current = f
+
+	return nil
+}
+
+func newFence(cfg config.TerraformStateConfig, redisCfg *config.RedisConfig) (*fence, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if redisCfg == nil {
+		return nil, errors.New("terraform_state: Enabled needs [redis]")
+	}
+
+	f := &fence{lockTTL: defaultLockTTL, store: redisLockStore{}}
+	if cfg.LockTTL != nil {
+		if cfg.LockTTL.Duration <= 0 {
+			return nil, errors.New("terraform_state: LockTTL must be positive")
+		}
+		f.lockTTL = cfg.LockTTL.Duration
+	}
+
+	return f, nil
+}
+
+func currentFence() *fence {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// PreAuthorizer checks with Rails that the user may lock or write a state
+type PreAuthorizer interface {
+	PreAuthorizeHandler(next api.HandleFunc, suffix string) http.Handler
+}
+
+// Handler fences the lock, unlock and write requests of Terraform states
+// before h gets them. Lock and write requests are fenced only once rails
+// authorized them. Requests pass through if the fencing is disabled, or if
+// Redis fails.
+func Handler(rails PreAuthorizer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := currentFence()
+		m := statePathRegex.FindStringSubmatch(r.URL.Path)
+		if f == nil || m == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Only Workhorse sets the fencing token
+		r.Header.Del(FencingTokenHeader)
+
+		state := m[1]
+		if m[2] != "" {
+			switch r.Method {
+			case "POST", "LOCK":
+				authorized(rails, func(w http.ResponseWriter, r *http.Request) {
+					f.lock(h, w, r, state)
+				}).ServeHTTP(w, r)
+				return
+			case "DELETE", "UNLOCK":
+				f.unlock(h, w, r, state)
+				return
+			}
+		} else if r.Method == "POST" || r.Method == "DELETE" {
+			authorized(rails, func(w http.ResponseWriter, r *http.Request) {
+				f.write(h, w, r, state)
+			}).ServeHTTP(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// authorized runs fenced once Rails authorized the request. Until then the
+// request must neither reserve nor hold up a lock, nor learn who holds it.
+func authorized(rails PreAuthorizer, fenced http.HandlerFunc) http.Handler {
+	return rails.PreAuthorizeHandler(func(w http.ResponseWriter, r *http.Request, _ *api.Response) {
+		fenced(w, r)
+	}, "/authorize")
+}
+
+func (f *fence) lock(h http.Handler, w http.ResponseWriter, r *http.Request, state string) {
+	body, err := helper.ReadRequestBody(w, r, maxLockBodySize)
+	if err != nil {
+		helper.RequestEntityTooLarge(w, r, err)
+		return
+	}
+	r = helper.CloneRequestWithNewBody(r, body)
+
+	var info lockInfo
+	if err := json.Unmarshal(body, &info); err != nil || info.ID == "" {
+		// Rails tells the client what is wrong with its lock
+		lockRequests.WithLabelValues("lock", "passed").Inc()
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	res, ok, err := f.store.reserve(state, info.ID, body)
+	if err != nil {
+		helper.LogError(r, fmt.Errorf("terraform: reserve lock: %v", err))
+		lockRequests.WithLabelValues("lock", "passed").Inc()
+		h.ServeHTTP(w, r)
+		return
+	}
+	if !ok {
+		lockRequests.WithLabelValues("lock", "locked").Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusLocked)
+		w.Write(res.holder)
+		return
+	}
+
+	lockRequests.WithLabelValues("lock", "passed").Inc()
+	r.Header.Set(FencingTokenHeader, strconv.FormatInt(res.token, 10))
+	sw := &statusWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, r)
+
+	switch {
+	case sw.status == http.StatusOK:
+		err = f.store.confirm(state, info.ID, f.lockTTL)
+	case !res.held:
+		// Only the request that reserved the lock may drop it
+		err = f.store.release(state, info.ID, res.token)
+	}
+	if err != nil {
+		helper.LogError(r, fmt.Errorf("terraform: lock: %v", err))
+	}
+}
+
+func (f *fence) unlock(h http.Handler, w http.ResponseWriter, r *http.Request, state string) {
+	lockRequests.WithLabelValues("unlock", "passed").Inc()
+	sw := &statusWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, r)
+
+	// Rails may unlock the state for another lock ID, e.g. for
+	// terraform force-unlock
+	if sw.status == http.StatusOK {
+		if err := f.store.clear(state); err != nil {
+			helper.LogError(r, fmt.Errorf("terraform: unlock: %v", err))
+		}
+	}
+}
+
+func (f *fence) write(h http.Handler, w http.ResponseWriter, r *http.Request, state string) {
+	operation := "write"
+	if r.Method == "DELETE" {
+		operation = "delete"
+	}
+
+	token, ok, err := f.store.check(state, r.URL.Query().Get("ID"))
+	if err != nil {
+		helper.LogError(r, fmt.Errorf("terraform: check lock: %v", err))
+		ok = true
+	}
+	if !ok {
+		lockRequests.WithLabelValues(operation, "conflict").Inc()
+		http.Error(w, "The Terraform state is locked by another lock ID", http.StatusConflict)
+		return
+	}
+
+	lockRequests.WithLabelValues(operation, "passed").Inc()
+	if token > 0 {
+		r.Header.Set(FencingTokenHeader, strconv.FormatInt(token, 10))
+	}
+	h.ServeHTTP(w, r)
+}
+
+// statusWriter remembers the status of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
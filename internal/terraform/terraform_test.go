@@ -0,0 +1,352 @@
+package terraform
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+)
+
+const (
+	statePath = "/api/v4/projects/1/terraform/state/production"
+	lockPath  = statePath + "/lock"
+	lockA     = `{"ID":"lock-a","Operation":"OperationTypeApply","Who":"alice@host"}`
+	lockB     = `{"ID":"lock-b","Operation":"OperationTypePlan","Who":"bob@host"}`
+)
+
+// memoryLockStore does what the Redis scripts do
+type memoryLockStore struct {
+	mu     sync.Mutex
+	locks  map[string]*memoryLock
+	tokens map[string]int64
+}
+
+type memoryLock struct {
+	id      string
+	info    []byte
+	token   int64
+	pending bool
+}
+
+func newMemoryLockStore() *memoryLockStore {
+	return &memoryLockStore{locks: make(map[string]*memoryLock), tokens: make(map[string]int64)}
+}
+
+func (s *memoryLockStore) reserve(state, id string, info []byte) (reservation, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lock := s.locks[state]; lock != nil {
+		if lock.id != id {
+			return reservation{holder: lock.info}, false, nil
+		}
+		return reservation{token: lock.token, held: true}, true, nil
+	}
+	s.tokens[state]++
+	s.locks[state] = &memoryLock{id: id, info: info, token: s.tokens[state], pending: true}
+	return reservation{token: s.tokens[state]}, true, nil
+}
+
+func (s *memoryLockStore) confirm(state, id string, lockTTL time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lock := s.locks[state]; lock != nil && lock.id == id {
+		lock.pending = false
+	}
+	return nil
+}
+
+func (s *memoryLockStore) release(state, id string, token int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if lock := s.locks[state]; lock != nil && lock.id == id && lock.token == token {
+		delete(s.locks, state)
+	}
+	return nil
+}
+
+func (s *memoryLockStore) clear(state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.locks, state)
+	return nil
+}
+
+func (s *memoryLockStore) check(state, id string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock := s.locks[state]
+	if lock == nil {
+		return 0, true, nil
+	}
+	if lock.id != id {
+		return 0, false, nil
+	}
+	return lock.token, true, nil
+}
+
+// rails records the requests it gets and answers with status
+type rails struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	// release is closed to let lock requests return
+	release chan struct{}
+}
+
+func (h *rails) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ioutil.ReadAll(r.Body)
+
+	h.mu.Lock()
+	h.requests = append(h.requests, r)
+	status := h.status
+	h.mu.Unlock()
+
+	if h.release != nil && strings.HasSuffix(r.URL.Path, "/lock") {
+		<-h.release
+	}
+	w.WriteHeader(status)
+}
+
+// PreAuthorizeHandler authorizes the requests with a Private-Token
+func (h *rails) PreAuthorizeHandler(next api.HandleFunc, _ string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Private-Token") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r, &api.Response{})
+	})
+}
+
+func (h *rails) fencingTokens() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var tokens []string
+	for _, r := range h.requests {
+		tokens = append(tokens, r.Header.Get(FencingTokenHeader))
+	}
+	return tokens
+}
+
+func setup(t *testing.T) (*memoryLockStore, *rails) {
+	f, err := newFence(config.TerraformStateConfig{Enabled: true}, &config.RedisConfig{})
+	require.NoError(t, err)
+
+	store := newMemoryLockStore()
+	f.store = store
+
+	mu.Lock()
+	current = f
+	mu.Unlock()
+
+	return store, &rails{status: http.StatusOK}
+}
+
+func reset() {
+	mu.Lock()
+	current = nil
+	mu.Unlock()
+}
+
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Private-Token", "token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func doAnonymous(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestLockAndWrite(t *testing.T) {
+	store, rails := setup(t)
+	defer reset()
+	h := Handler(rails, rails)
+
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockA).Code)
+	require.False(t, store.locks["projects/1/terraform/state/production"].pending, "Rails granted the lock")
+
+	w := do(h, "POST", lockPath, lockB)
+	require.Equal(t, http.StatusLocked, w.Code)
+	require.Equal(t, lockA, w.Body.String(), "Terraform shows who holds the lock")
+
+	require.Equal(t, http.StatusOK, do(h, "POST", statePath+"?ID=lock-a", `{"version":4}`).Code)
+	require.Equal(t, http.StatusConflict, do(h, "POST", statePath+"?ID=lock-b", `{"version":4}`).Code)
+	require.Equal(t, http.StatusConflict, do(h, "POST", statePath, `{"version":4}`).Code)
+	require.Equal(t, http.StatusOK, do(h, "GET", statePath, "").Code, "reads are not fenced")
+
+	require.Equal(t, http.StatusOK, do(h, "DELETE", lockPath, lockA).Code)
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockB).Code)
+
+	require.Equal(t, []string{"1", "1", "", "", "2"}, rails.fencingTokens())
+}
+
+func TestConcurrentLocks(t *testing.T) {
+	_, rails := setup(t)
+	defer reset()
+	rails.release = make(chan struct{})
+	h := Handler(rails, rails)
+
+	done := make(chan int)
+	go func() { done <- do(h, "LOCK", lockPath, lockA).Code }()
+
+	for deadline := time.Now().Add(5 * time.Second); len(rails.fencingTokens()) == 0; time.Sleep(10 * time.Millisecond) {
+		require.True(t, time.Now().Before(deadline), "the first lock request reaches Rails")
+	}
+
+	// Rails is slow to answer the first lock request
+	w := do(h, "LOCK", lockPath, lockB)
+	require.Equal(t, http.StatusLocked, w.Code, "the second lock request does not reach Rails")
+	require.Equal(t, http.StatusConflict, do(h, "POST", statePath+"?ID=lock-b", `{}`).Code)
+
+	close(rails.release)
+	require.Equal(t, http.StatusOK, <-done)
+}
+
+func TestRejectedLock(t *testing.T) {
+	store, rails := setup(t)
+	defer reset()
+	h := Handler(rails, rails)
+
+	rails.status = http.StatusLocked
+	require.Equal(t, http.StatusLocked, do(h, "POST", lockPath, lockA).Code)
+	require.Empty(t, store.locks, "the reservation is released")
+
+	rails.status = http.StatusOK
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockB).Code)
+}
+
+func TestUnauthorizedRequests(t *testing.T) {
+	store, rails := setup(t)
+	defer reset()
+	h := Handler(rails, rails)
+	state := "projects/1/terraform/state/production"
+
+	require.Equal(t, http.StatusUnauthorized, doAnonymous(h, "POST", lockPath, lockB).Code)
+	require.Empty(t, store.locks, "an unauthorized request reserves no lock")
+
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockA).Code)
+
+	w := doAnonymous(h, "POST", lockPath, lockB)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.NotContains(t, w.Body.String(), "lock-a", "the holder is not shown before authorization")
+
+	require.Equal(t, http.StatusUnauthorized, doAnonymous(h, "POST", lockPath, lockA).Code, "replaying the lock ID")
+	require.Equal(t, http.StatusUnauthorized, doAnonymous(h, "POST", statePath+"?ID=lock-b", `{}`).Code)
+	require.Equal(t, &memoryLock{id: "lock-a", info: []byte(lockA), token: 1}, store.locks[state])
+
+	// Rails rejects a request of another user with the lock ID
+	rails.status = http.StatusLocked
+	require.Equal(t, http.StatusLocked, do(h, "POST", lockPath, lockA).Code)
+	require.Equal(t, &memoryLock{id: "lock-a", info: []byte(lockA), token: 1}, store.locks[state], "the lock stays as it is")
+
+	rails.status = http.StatusOK
+	require.Equal(t, http.StatusOK, do(h, "POST", statePath+"?ID=lock-a", `{}`).Code)
+	require.Equal(t, []string{"1", "1", "1"}, rails.fencingTokens())
+}
+
+func TestForceUnlock(t *testing.T) {
+	store, rails := setup(t)
+	defer reset()
+	h := Handler(rails, rails)
+
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockA).Code)
+	require.Equal(t, http.StatusOK, do(h, "DELETE", lockPath, `{"ID":"lock-b"}`).Code)
+	require.Empty(t, store.locks, "Rails decides who may unlock")
+}
+
+func TestFencingTokenFromClient(t *testing.T) {
+	_, rails := setup(t)
+	defer reset()
+
+	r := httptest.NewRequest("POST", statePath, strings.NewReader("{}"))
+	r.Header.Set("Private-Token", "token")
+	r.Header.Set(FencingTokenHeader, "1000")
+	Handler(rails, rails).ServeHTTP(httptest.NewRecorder(), r)
+
+	require.Equal(t, []string{""}, rails.fencingTokens())
+}
+
+func TestDisabled(t *testing.T) {
+	rails := &rails{status: http.StatusOK}
+	h := Handler(rails, rails)
+
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockA).Code)
+	require.Equal(t, http.StatusOK, do(h, "POST", lockPath, lockB).Code)
+}
+
+func TestConfigure(t *testing.T) {
+	require.Error(t, Configure(config.TerraformStateConfig{Enabled: true}, nil))
+	require.Error(t, Configure(config.TerraformStateConfig{Enabled: true, LockTTL: &config.TomlDuration{}}, &config.RedisConfig{}))
+	require.NoError(t, Configure(config.TerraformStateConfig{}, nil))
+	require.Nil(t, currentFence())
+}
+
+func TestRedisLockStore(t *testing.T) {
+	conn := redigomock.NewConn()
+	redis.Configure(&config.RedisConfig{}, func(_ *config.RedisConfig, _ bool) func() (redigo.Conn, error) {
+		return func() (redigo.Conn, error) {
+			return conn, nil
+		}
+	})
+	store := redisLockStore{}
+
+	conn.GenericCommand("EVALSHA").Expect([]interface{}{int64(1), int64(7)})
+	res, ok, err := store.reserve("state", "lock-a", []byte(lockA))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, reservation{token: 7}, res)
+
+	conn.Clear()
+	conn.GenericCommand("EVALSHA").Expect([]interface{}{int64(2), int64(7)})
+	res, ok, err = store.reserve("state", "lock-a", []byte(lockA))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, reservation{token: 7, held: true}, res)
+
+	conn.Clear()
+	conn.GenericCommand("EVALSHA").Expect([]interface{}{int64(0), []byte(lockB)})
+	res, ok, err = store.reserve("state", "lock-a", []byte(lockA))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, lockB, string(res.holder))
+
+	conn.Clear()
+	conn.Command("HMGET", lockKey("state"), "id", "token").Expect([]interface{}{[]byte("lock-a"), []byte("7")})
+	token, ok, err := store.check("state", "lock-a")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(7), token)
+
+	_, ok, err = store.check("state", "lock-b")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	conn.Clear()
+	conn.Command("HMGET", lockKey("state"), "id", "token").Expect([]interface{}{nil, nil})
+	_, ok, err = store.check("state", "")
+	require.NoError(t, err)
+	require.True(t, ok, "no lock is known")
+}
@@ -25,6 +25,7 @@ type GitalyTestServer struct {
 	gitalypb.UnimplementedRepositoryServiceServer
 	gitalypb.UnimplementedBlobServiceServer
 	gitalypb.UnimplementedDiffServiceServer
+	gitalypb.UnimplementedSSHServiceServer
 }
 
 var (
@@ -38,6 +39,9 @@ var (
 
 	GitalyReceivePackResponseMock []byte
 	GitalyUploadPackResponseMock  []byte
+
+	// GitalyMissingBlobOid is a blob the fake GetBlob does not find
+	GitalyMissingBlobOid = "0000000000000000000000000000000000000000"
 )
 
 func init() {
@@ -223,6 +227,52 @@ func (s *GitalyTestServer) PostUploadPack(stream gitalypb.SmartHTTPService_PostU
 	return s.finalError()
 }
 
+func (s *GitalyTestServer) SSHUploadArchive(stream gitalypb.SSHService_SSHUploadArchiveServer) error {
+	s.WaitGroup.Add(1)
+	defer s.WaitGroup.Done()
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	if err := validateRepository(req.GetRepository()); err != nil {
+		return err
+	}
+
+	jsonString, err := marshalJSON(req)
+	if err != nil {
+		return err
+	}
+
+	data := []byte(jsonString + "\000")
+
+	// Stdin starts in the second message
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+
+		data = append(data, req.GetStdin()...)
+	}
+
+	if _, err := sendBytes(data, 100, func(p []byte) error {
+		return stream.Send(&gitalypb.SSHUploadArchiveResponse{Stdout: p})
+	}); err != nil {
+		return err
+	}
+
+	if err := s.finalError(); err != nil {
+		return err
+	}
+
+	return stream.Send(&gitalypb.SSHUploadArchiveResponse{ExitStatus: &gitalypb.ExitStatus{Value: 0}})
+}
+
 func (s *GitalyTestServer) CommitIsAncestor(ctx context.Context, in *gitalypb.CommitIsAncestorRequest) (*gitalypb.CommitIsAncestorResponse, error) {
 	return nil, nil
 }
@@ -235,6 +285,10 @@ func (s *GitalyTestServer) GetBlob(in *gitalypb.GetBlobRequest, stream gitalypb.
 		return err
 	}
 
+	if in.GetOid() == GitalyMissingBlobOid {
+		return stream.Send(&gitalypb.GetBlobResponse{})
+	}
+
 	response := &gitalypb.GetBlobResponse{
 		Oid:  in.GetOid(),
 		Size: int64(len(GitalyGetBlobResponseMock)),
@@ -13,6 +13,9 @@ const RewrittenFieldsHeader = "Gitlab-Workhorse-Multipart-Fields"
 
 type MultipartClaims struct {
 	RewrittenFields map[string]string `json:"rewritten_fields"`
+	// FinalizeFields are the finalize fields of the files tracked with
+	// TrackFile, like file.remote_id
+	FinalizeFields map[string]string `json:"finalize_fields,omitempty"`
 	jwt.StandardClaims
 }
 
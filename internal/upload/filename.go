@@ -0,0 +1,100 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+const defaultMaxFilenameLength = 255
+
+// ErrInvalidFilename means that the name of an uploaded file breaks the
+// filename policy of the route
+var ErrInvalidFilename = errors.New("invalid filename")
+
+// rawFilename is the filename of p as the client sent it. FileName()
+// drops the directories, which hides path traversal attempts.
+func rawFilename(p *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if err != nil {
+		return p.FileName()
+	}
+	return params["filename"]
+}
+
+type filenamePolicy struct {
+	normalize func(string) string
+	maxLength int
+	pattern   *regexp.Regexp
+}
+
+// newFilenamePolicy prepares the policy Rails sent for the route. Its
+// errors are the ones of Rails, not of the client.
+func newFilenamePolicy(policy *api.FilenamePolicy) (*filenamePolicy, error) {
+	p := &filenamePolicy{normalize: norm.NFC.String, maxLength: defaultMaxFilenameLength}
+	if policy == nil {
+		return p, nil
+	}
+
+	switch strings.ToUpper(policy.Normalization) {
+	case "", "NFC":
+	case "NFKC":
+		p.normalize = norm.NFKC.String
+	case "NONE":
+		p.normalize = nil
+	default:
+		return nil, fmt.Errorf("filename policy: unknown normalization %q", policy.Normalization)
+	}
+
+	if policy.MaxLength > 0 {
+		p.maxLength = policy.MaxLength
+	}
+
+	if policy.Pattern != "" {
+		pattern, err := regexp.Compile(policy.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("filename policy: %v", err)
+		}
+		p.pattern = pattern
+	}
+
+	return p, nil
+}
+
+// sanitize checks filename against the policy, and returns it in the
+// Unicode normalization form of the policy
+func (p *filenamePolicy) sanitize(filename string) (string, error) {
+	if !utf8.ValidString(filename) {
+		return "", fmt.Errorf("not valid UTF-8")
+	}
+	if p.normalize != nil {
+		filename = p.normalize(filename)
+	}
+
+	if filename == "" || filename == "." || filename == ".." {
+		return "", fmt.Errorf("reserved name")
+	}
+	if strings.ContainsAny(filename, `/\`) {
+		return "", fmt.Errorf("path separator")
+	}
+	if strings.IndexFunc(filename, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("control character")
+	}
+	if len(filename) > p.maxLength {
+		return "", fmt.Errorf("longer than %d bytes", p.maxLength)
+	}
+	if p.pattern != nil && !p.pattern.MatchString(filename) {
+		return "", fmt.Errorf("not matching %q", p.pattern)
+	}
+
+	return filename, nil
+}
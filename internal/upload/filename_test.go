@@ -0,0 +1,64 @@
+package upload
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *api.FilenamePolicy
+		filename string
+		expected string
+	}{
+		{name: "plain", filename: "report.pdf", expected: "report.pdf"},
+		{name: "unicode", filename: "résumé.txt", expected: "résumé.txt"},
+		{name: "NFC by default", filename: "re\u0301sume\u0301.txt", expected: "r\u00e9sum\u00e9.txt"},
+		{name: "NFKC", policy: &api.FilenamePolicy{Normalization: "NFKC"}, filename: "ﬁle.txt", expected: "file.txt"},
+		{name: "no normalization", policy: &api.FilenamePolicy{Normalization: "none"}, filename: "re\u0301sume\u0301.txt", expected: "re\u0301sume\u0301.txt"},
+		{name: "longest", filename: strings.Repeat("a", 255), expected: strings.Repeat("a", 255)},
+		{name: "matching pattern", policy: &api.FilenamePolicy{Pattern: `\.gem\z`}, filename: "rails-6.0.gem", expected: "rails-6.0.gem"},
+		{name: "dot dot", filename: ".."},
+		{name: "slash", filename: "../etc/passwd"},
+		{name: "backslash", filename: `..\windows`},
+		{name: "control character", filename: "a\x7fb"},
+		{name: "C1 control character", filename: "a\u0085b"},
+		{name: "invalid UTF-8", filename: "a\xffb"},
+		{name: "too long", filename: strings.Repeat("a", 256)},
+		{name: "too long for the policy", policy: &api.FilenamePolicy{MaxLength: 8}, filename: "123456789"},
+		{name: "length in bytes", policy: &api.FilenamePolicy{MaxLength: 8}, filename: "ééééé"},
+		{name: "not matching pattern", policy: &api.FilenamePolicy{Pattern: `\.gem\z`}, filename: "rails.tar.gz"},
+		{name: "dot dot after normalization", policy: &api.FilenamePolicy{Normalization: "NFKC"}, filename: "\u2024\u2024"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := newFilenamePolicy(tc.policy)
+			require.NoError(t, err)
+
+			filename, err := policy.sanitize(tc.filename)
+			if tc.expected == "" {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, filename)
+		})
+	}
+}
+
+func TestInvalidFilenamePolicy(t *testing.T) {
+	for _, policy := range []*api.FilenamePolicy{
+		{Normalization: "NFD"},
+		{Pattern: "("},
+	} {
+		_, err := newFilenamePolicy(policy)
+		require.Error(t, err)
+	}
+}
@@ -52,6 +52,11 @@ type rewriter struct {
 	preauth         *api.Response
 	filter          MultipartFormProcessor
 	finalizedFields map[string]bool
+	filenamePolicy  *filenamePolicy
+	// fileFields are the names the file parts were saved under
+	fileFields map[string]bool
+	// arrayIndexes are the next indexes of the array fields, like files[]
+	arrayIndexes map[string]int
 }
 
 func init() {
@@ -73,11 +78,19 @@ func rewriteFormFilesFromMultipart(r *http.Request, writer *multipart.Writer, pr
 
 	multipartUploadRequests.WithLabelValues(filter.Name()).Inc()
 
+	policy, err := newFilenamePolicy(preauth.FilenamePolicy)
+	if err != nil {
+		return err
+	}
+
 	rew := &rewriter{
 		writer:          writer,
 		preauth:         preauth,
 		filter:          filter,
 		finalizedFields: make(map[string]bool),
+		filenamePolicy:  policy,
+		fileFields:      make(map[string]bool),
+		arrayIndexes:    make(map[string]int),
 	}
 
 	for {
@@ -99,7 +112,7 @@ func rewriteFormFilesFromMultipart(r *http.Request, writer *multipart.Writer, pr
 		}
 
 		if p.FileName() != "" {
-			err = rew.handleFilePart(r.Context(), name, p)
+			err = rew.handleFilePart(r.Context(), rew.fileFieldName(name), p)
 		} else {
 			err = rew.copyPart(r.Context(), name, p)
 		}
@@ -112,15 +125,42 @@ func rewriteFormFilesFromMultipart(r *http.Request, writer *multipart.Writer, pr
 	return nil
 }
 
+// fileFieldName gives each file part of an array field, like files[] or
+// package[files][], an index of its own: files[0], files[1]... Without it
+// their finalize fields and rewritten fields would overwrite each other.
+func (rew *rewriter) fileFieldName(name string) string {
+	if !strings.HasSuffix(name, "[]") {
+		return name
+	}
+
+	prefix := strings.TrimSuffix(name, "[]")
+	for {
+		indexed := fmt.Sprintf("%s[%d]", prefix, rew.arrayIndexes[prefix])
+		rew.arrayIndexes[prefix]++
+
+		// The client may have sent files[0] itself
+		if !rew.fileFields[indexed] {
+			// and must not send it after us
+			rew.finalizedFields[indexed] = true
+			return indexed
+		}
+	}
+}
+
 func (rew *rewriter) handleFilePart(ctx context.Context, name string, p *multipart.Part) error {
 	multipartFiles.WithLabelValues(rew.filter.Name()).Inc()
 
-	filename := p.FileName()
+	filename, err := rew.filenamePolicy.sanitize(rawFilename(p))
+	if err != nil {
+		log.WithContextFields(ctx, log.Fields{
+			"filename": rawFilename(p),
+		}).WithError(err).Error("rejecting uploaded file")
 
-	if strings.Contains(filename, "/") || filename == "." || filename == ".." {
-		return fmt.Errorf("illegal filename: %q", filename)
+		return ErrInvalidFilename
 	}
 
+	rew.fileFields[name] = true
+
 	opts := filestore.GetOpts(rew.preauth)
 	opts.TempFilePrefix = filename
 
@@ -143,10 +183,10 @@ func (rew *rewriter) handleFilePart(ctx context.Context, name string, p *multipa
 	fh, err := filestore.SaveFileFromReader(ctx, inputReader, -1, opts)
 	if err != nil {
 		switch err {
-		case filestore.ErrEntityTooLarge, exif.ErrRemovingExif:
+		case filestore.ErrEntityTooLarge, filestore.ErrClientDisconnected, filestore.ErrClientTimeout, filestore.ErrDestinationTimeout, exif.ErrRemovingExif:
 			return err
 		default:
-			return fmt.Errorf("persisting multipart file: %v", err)
+			return fmt.Errorf("persisting multipart file: %w", err)
 		}
 	}
 
@@ -13,6 +13,7 @@ import (
 type SavedFileTracker struct {
 	Request         *http.Request
 	rewrittenFields map[string]string
+	finalizeFields  map[string]string
 }
 
 func (s *SavedFileTracker) Track(fieldName string, localPath string) {
@@ -22,6 +23,19 @@ func (s *SavedFileTracker) Track(fieldName string, localPath string) {
 	s.rewrittenFields[fieldName] = localPath
 }
 
+// TrackFile tracks file like Track, and signs its finalize fields too, so
+// that Rails can trust the ones of remote files
+func (s *SavedFileTracker) TrackFile(fieldName string, file *filestore.FileHandler) {
+	s.Track(fieldName, file.LocalPath)
+
+	if s.finalizeFields == nil {
+		s.finalizeFields = make(map[string]string)
+	}
+	for key, value := range file.GitLabFinalizeFields(fieldName) {
+		s.finalizeFields[key] = value
+	}
+}
+
 func (s *SavedFileTracker) Count() int {
 	return len(s.rewrittenFields)
 }
@@ -40,7 +54,7 @@ func (s *SavedFileTracker) Finalize(_ context.Context) error {
 		return nil
 	}
 
-	claims := MultipartClaims{RewrittenFields: s.rewrittenFields, StandardClaims: secret.DefaultClaims}
+	claims := MultipartClaims{RewrittenFields: s.rewrittenFields, FinalizeFields: s.finalizeFields, StandardClaims: secret.DefaultClaims}
 	tokenString, err := secret.JWTTokenString(claims)
 	if err != nil {
 		return fmt.Errorf("savedFileTracker.Finalize: %v", err)
@@ -37,16 +37,14 @@ func HandleFileUploads(w http.ResponseWriter, r *http.Request, h http.Handler, p
 	err := rewriteFormFilesFromMultipart(r, writer, preauth, filter)
 	if err != nil {
 		switch err {
-		case ErrInjectedClientParam:
+		case ErrInjectedClientParam, ErrInvalidFilename:
 			helper.CaptureAndFail(w, r, err, "Bad Request", http.StatusBadRequest)
 		case http.ErrNotMultipart:
 			h.ServeHTTP(w, r)
-		case filestore.ErrEntityTooLarge:
-			helper.RequestEntityTooLarge(w, r, err)
 		case exif.ErrRemovingExif:
 			helper.CaptureAndFail(w, r, err, "Failed to process image", http.StatusUnprocessableEntity)
 		default:
-			helper.Fail500(w, r, fmt.Errorf("handleFileUploads: extract files from multipart: %v", err))
+			filestore.FailUpload(w, r, fmt.Errorf("handleFileUploads: extract files from multipart: %w", err))
 		}
 		return
 	}
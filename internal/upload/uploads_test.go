@@ -9,6 +9,8 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
@@ -16,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/require"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
@@ -272,6 +275,88 @@ func TestUploadHandlerDetectingInjectedMultiPartData(t *testing.T) {
 	}
 }
 
+func TestUploadHandlerRewritingArrayFields(t *testing.T) {
+	testhelper.ConfigureSecret()
+
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	for _, part := range []struct{ field, filename string }{
+		{"files[0]", "explicit.txt"},
+		{"files[]", "a.txt"},
+		{"files[]", "b.txt"},
+		{"package[files][]", "c.txt"},
+	} {
+		file, err := writer.CreateFormFile(part.field, part.filename)
+		require.NoError(t, err)
+		fmt.Fprint(file, part.filename)
+	}
+	writer.Close()
+
+	httpRequest, err := http.NewRequest("POST", "/url/path", &buffer)
+	require.NoError(t, err)
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var rewrittenFields map[string]interface{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, rewritten *http.Request) {
+		// The multipart reader of the original request is used up
+		r := httptest.NewRequest("POST", "/url/path", rewritten.Body)
+		r.Header = rewritten.Header
+		require.NoError(t, r.ParseMultipartForm(100000))
+		require.Empty(t, r.MultipartForm.File)
+
+		expected := map[string]string{
+			"files[0]":          "explicit.txt",
+			"files[1]":          "a.txt",
+			"files[2]":          "b.txt",
+			"package[files][0]": "c.txt",
+		}
+		for field, filename := range expected {
+			require.Equal(t, filename, r.FormValue(field+".name"))
+			require.Equal(t, strconv.Itoa(len(filename)), r.FormValue(field+".size"))
+			require.True(t, strings.HasPrefix(r.FormValue(field+".path"), tempPath))
+		}
+
+		jwtToken, err := jwt.Parse(r.Header.Get(RewrittenFieldsHeader), testhelper.ParseJWT)
+		require.NoError(t, err)
+		rewrittenFields = jwtToken.Claims.(jwt.MapClaims)["rewritten_fields"].(map[string]interface{})
+	})
+
+	response := httptest.NewRecorder()
+	HandleFileUploads(response, httpRequest, handler, &api.Response{TempPath: tempPath}, &SavedFileTracker{Request: httpRequest})
+	testhelper.AssertResponseCode(t, response, 200)
+
+	require.Len(t, rewrittenFields, 4)
+	require.Contains(t, rewrittenFields, "files[2]")
+	require.Contains(t, rewrittenFields, "package[files][0]")
+}
+
+func TestUploadHandlerDetectingInjectedArrayField(t *testing.T) {
+	tempPath, err := ioutil.TempDir("", "uploads")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempPath)
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	for _, field := range []string{"files[]", "files[0]"} {
+		file, err := writer.CreateFormFile(field, "my.file")
+		require.NoError(t, err)
+		fmt.Fprint(file, "test")
+	}
+	writer.Close()
+
+	httpRequest, err := http.NewRequest("POST", "/url/path", &buffer)
+	require.NoError(t, err)
+	httpRequest.Header.Set("Content-Type", writer.FormDataContentType())
+
+	response := httptest.NewRecorder()
+	HandleFileUploads(response, httpRequest, nilHandler, &api.Response{TempPath: tempPath}, &testFormProcessor{})
+	testhelper.AssertResponseCode(t, response, 400)
+}
+
 func TestUploadProcessingField(t *testing.T) {
 	tempPath, err := ioutil.TempDir("", "uploads")
 	if err != nil {
@@ -368,15 +453,20 @@ func TestInvalidFileNames(t *testing.T) {
 		code     int
 	}{
 		{"foobar", 200}, // sanity check for test setup below
-		{"foo/bar", 500},
-		{"/../../foobar", 500},
-		{".", 500},
-		{"..", 500},
+		{"foo/bar", 400},
+		{"/../../foobar", 400},
+		{`..\foobar`, 400},
+		{".", 400},
+		{"..", 400},
+		{"\x1b[31mred.txt", 400},
 	} {
 		buffer := &bytes.Buffer{}
 
 		writer := multipart.NewWriter(buffer)
-		file, err := writer.CreateFormFile("file", testCase.filename)
+		// RFC 2231 encoding lets the filename hold any byte
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename*=UTF-8''`+url.PathEscape(testCase.filename))
+		file, err := writer.CreatePart(header)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -391,7 +481,7 @@ func TestInvalidFileNames(t *testing.T) {
 
 		response := httptest.NewRecorder()
 		HandleFileUploads(response, httpRequest, nilHandler, &api.Response{TempPath: tempPath}, &SavedFileTracker{Request: httpRequest})
-		testhelper.AssertResponseCode(t, response, testCase.code)
+		require.Equal(t, testCase.code, response.Code, "filename %q", testCase.filename)
 	}
 }
 
@@ -0,0 +1,264 @@
+/*
+In this file we shed low-priority requests while Rails keeps failing, so that
+Puma can recover instead of being buried under retries. Health checks, Git
+reads, assets and websockets are never shed.
+*/
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	defaultBreakerMinRequests  = 20
+	defaultBreakerWindow       = 10 * time.Second
+	defaultBreakerOpenDuration = 5 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+var (
+	breakerStateGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "backend_breaker",
+			Name:      "state",
+			Help:      "State of the Rails backend breaker: 0 closed, 1 open, 2 half-open",
+		},
+	)
+	breakerShedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "backend_breaker",
+			Name:      "shed_requests",
+			Help:      "How many requests were answered with 503 because the Rails backend breaker was open",
+		},
+		[]string{"class"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge, breakerShedRequests)
+}
+
+func withHighPriority() func(*routeOptions) {
+	return func(options *routeOptions) {
+		options.highPriority = true
+	}
+}
+
+type breaker struct {
+	failureRatio float64
+	minRequests  int
+	window       time.Duration
+	openDuration time.Duration
+	now          func() time.Time
+
+	mu          sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openUntil   time.Time
+	probeUntil  time.Time
+}
+
+// newBreaker returns nil if the breaker is disabled
+func newBreaker(cfg config.BackendBreakerConfig) *breaker {
+	if cfg.FailureRatio <= 0 {
+		return nil
+	}
+
+	b := &breaker{
+		failureRatio: cfg.FailureRatio,
+		minRequests:  cfg.MinRequests,
+		window:       defaultBreakerWindow,
+		openDuration: defaultBreakerOpenDuration,
+		now:          time.Now,
+	}
+	if b.minRequests <= 0 {
+		b.minRequests = defaultBreakerMinRequests
+	}
+	if cfg.Window != nil {
+		b.window = cfg.Window.Duration
+	}
+	if cfg.OpenDuration != nil {
+		b.openDuration = cfg.OpenDuration.Duration
+	}
+
+	return b
+}
+
+func (b *breaker) status() interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{"state": b.state.String()}
+}
+
+// allow tells if a low-priority request can go to Rails, and if it is a
+// probe. Once the breaker has been open for long enough, a single request is
+// let through to probe Rails; if it never gets to Rails another one is let
+// through after openDuration.
+func (b *breaker) allow() (retryAfter time.Duration, probe bool, ok bool) {
+	if b == nil {
+		return 0, false, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return b.openUntil.Sub(now), false, false
+		}
+		b.setState(breakerHalfOpen)
+		b.probeUntil = now.Add(b.openDuration)
+		return 0, true, true
+
+	case breakerHalfOpen:
+		if now.Before(b.probeUntil) {
+			return b.probeUntil.Sub(now), false, false
+		}
+		b.probeUntil = now.Add(b.openDuration)
+		return 0, true, true
+	}
+
+	return 0, false, true
+}
+
+type breakerProbeKey struct{}
+
+// withBreakerProbe marks r as a probe admitted by allow
+func withBreakerProbe(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), breakerProbeKey{}, true))
+}
+
+func isBreakerProbe(r *http.Request) bool {
+	probe, _ := r.Context().Value(breakerProbeKey{}).(bool)
+	return probe
+}
+
+// record counts the outcome of a request to Rails. probe tells if allow
+// admitted the request as a probe.
+func (b *breaker) record(failed bool, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case breakerOpen, breakerHalfOpen:
+		// Only probes tell whether Rails recovered. Responses to requests
+		// sent before the breaker opened, or to high-priority requests that
+		// are never shed, may come from the few workers Rails has left.
+		if !probe {
+			return
+		}
+
+		if failed {
+			b.open(now)
+		} else {
+			b.setState(breakerClosed)
+			b.resetWindow(now)
+		}
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.window {
+		b.resetWindow(now)
+	}
+
+	b.requests++
+	if failed {
+		b.failures++
+	}
+
+	if b.requests >= b.minRequests && float64(b.failures) >= b.failureRatio*float64(b.requests) {
+		b.open(now)
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.openUntil = now.Add(b.openDuration)
+	b.setState(breakerOpen)
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *breaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+
+	if state != breakerHalfOpen {
+		log.WithField("state", state.String()).Info("backend breaker changed state")
+	}
+	b.state = state
+	breakerStateGauge.Set(float64(state))
+}
+
+type breakerRoundTripper struct {
+	next    http.RoundTripper
+	breaker *breaker
+}
+
+// roundTripper returns a round tripper that reports the failures of next.
+// Errors of the backend round tripper come back as 502 responses, and slow
+// responses as 504.
+func (b *breaker) roundTripper(next http.RoundTripper) http.RoundTripper {
+	return &breakerRoundTripper{next: next, breaker: b}
+}
+
+func (rt *breakerRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, err := rt.next.RoundTrip(r)
+
+	// Requests canceled by the client are not the fault of Rails
+	if r.Context().Err() == nil {
+		failed := err != nil || res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusGatewayTimeout
+		rt.breaker.record(failed, isBreakerProbe(r))
+	}
+
+	return res, err
+}
+
+func shedRequest(w http.ResponseWriter, class routeClass, retryAfter time.Duration) {
+	breakerShedRequests.WithLabelValues(string(class)).Inc()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds())))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, `{"message":"GitLab is temporarily overloaded, please retry later"}`)
+}
@@ -0,0 +1,153 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func newTestBreaker(now *time.Time) *breaker {
+	b := newBreaker(config.BackendBreakerConfig{
+		FailureRatio: 0.5,
+		MinRequests:  4,
+		Window:       &config.TomlDuration{Duration: 10 * time.Second},
+		OpenDuration: &config.TomlDuration{Duration: 5 * time.Second},
+	})
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(config.BackendBreakerConfig{})
+	require.Nil(t, b)
+
+	_, _, ok := b.allow()
+	require.True(t, ok)
+}
+
+func TestBreakerOpensOnFailureRatio(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+
+	b.record(true, false)
+	b.record(true, false)
+	b.record(false, false)
+	require.Equal(t, breakerClosed, b.state, "not enough requests yet")
+
+	b.record(true, false)
+	require.Equal(t, breakerOpen, b.state)
+
+	now = now.Add(2 * time.Second)
+	retryAfter, _, ok := b.allow()
+	require.False(t, ok)
+	require.Equal(t, 3*time.Second, retryAfter)
+}
+
+func TestBreakerWindow(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+
+	b.record(true, false)
+	b.record(true, false)
+	b.record(true, false)
+
+	now = now.Add(11 * time.Second)
+	b.record(true, false)
+	b.record(false, false)
+	require.Equal(t, breakerClosed, b.state, "failures of the previous window are forgotten")
+}
+
+func TestBreakerProbe(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	for i := 0; i < 4; i++ {
+		b.record(true, false)
+	}
+	require.Equal(t, breakerOpen, b.state)
+
+	now = now.Add(5 * time.Second)
+	_, probe, ok := b.allow()
+	require.True(t, ok, "the probe is let through")
+	require.True(t, probe)
+	_, _, ok = b.allow()
+	require.False(t, ok, "only one probe at a time")
+
+	b.record(true, true)
+	require.Equal(t, breakerOpen, b.state, "failed probe opens the breaker again")
+
+	now = now.Add(5 * time.Second)
+	_, probe, ok = b.allow()
+	require.True(t, ok)
+	require.True(t, probe)
+	b.record(false, true)
+	require.Equal(t, breakerClosed, b.state)
+
+	_, probe, ok = b.allow()
+	require.True(t, ok)
+	require.False(t, probe)
+}
+
+func TestBreakerIgnoresOtherRequestsWhileOpen(t *testing.T) {
+	now := time.Now()
+	b := newTestBreaker(&now)
+	for i := 0; i < 4; i++ {
+		b.record(true, false)
+	}
+
+	now = now.Add(6 * time.Second)
+	b.record(false, false)
+	require.Equal(t, breakerOpen, b.state, "high-priority requests do not close the breaker")
+
+	_, _, ok := b.allow()
+	require.True(t, ok)
+	b.record(false, false)
+	require.Equal(t, breakerHalfOpen, b.state, "nor do they while a probe is out")
+	b.record(true, false)
+	require.Equal(t, breakerHalfOpen, b.state)
+
+	b.record(false, true)
+	require.Equal(t, breakerClosed, b.state)
+}
+
+func TestBreakerShedsLowPriorityRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	cfg := config.Config{
+		Backend: helper.URLMustParse(backend.URL),
+		BackendBreaker: config.BackendBreakerConfig{
+			FailureRatio: 1,
+			MinRequests:  2,
+			OpenDuration: &config.TomlDuration{Duration: time.Minute},
+		},
+	}
+	ws := httptest.NewServer(NewUpstream(cfg, logrus.StandardLogger()))
+	defer ws.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(ws.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, http.StatusBadGateway, get("/api/v4/projects").StatusCode)
+	}
+
+	resp := get("/api/v4/projects")
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+	require.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	require.Equal(t, http.StatusBadGateway, get("/-/readiness").StatusCode, "health checks go to Rails")
+}
@@ -0,0 +1,50 @@
+/*
+In this file we count the git and API requests by the country of their
+client, and add the country to the access log, so that abuse can be
+analysed without the addresses of the clients.
+*/
+
+package upstream
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/geoip"
+)
+
+var requestsByCountry = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: httpSubsystem,
+		Name:      "requests_by_country",
+		Help:      "How many git and API requests were received, by route class and country of the client",
+	},
+	[]string{"class", "country"},
+)
+
+func init() {
+	prometheus.MustRegister(requestsByCountry)
+}
+
+func countCountry(r *http.Request, class routeClass) {
+	if class != routeClassGit && class != routeClassAPI || !geoip.Enabled() {
+		return
+	}
+
+	country := geoip.Country(r)
+	if country == "" {
+		country = "unknown"
+	}
+	requestsByCountry.WithLabelValues(string(class), country).Inc()
+}
+
+// countryLogFields adds the country of the client to the access log
+func countryLogFields(r *http.Request) log.Fields {
+	if country := geoip.Country(r); country != "" {
+		return log.Fields{"country": country}
+	}
+	return log.Fields{}
+}
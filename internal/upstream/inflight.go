@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/correlation"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// InFlightRequest describes a request that is being handled
+type InFlightRequest struct {
+	Method        string        `json:"method"`
+	Path          string        `json:"path"`
+	Class         string        `json:"class"`
+	RemoteAddr    string        `json:"remote_addr"`
+	CorrelationID string        `json:"correlation_id"`
+	GLID          string        `json:"gl_id,omitempty"`
+	Started       time.Time     `json:"started"`
+	Duration      time.Duration `json:"-"`
+
+	r         *http.Request
+	goroutine string
+	logged    bool
+}
+
+var (
+	inFlight      = make(map[*http.Request]*InFlightRequest)
+	inFlightMutex sync.Mutex
+)
+
+// trackRequest records r as in flight until the returned function is
+// called
+func trackRequest(r *http.Request, class routeClass) func() {
+	req := &InFlightRequest{
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Class:         string(class),
+		RemoteAddr:    r.RemoteAddr,
+		CorrelationID: correlation.ExtractFromContext(r.Context()),
+		Started:       time.Now(),
+		r:             r,
+	}
+	if slowRequestSettings().captureStack {
+		req.goroutine = currentGoroutine()
+	}
+
+	inFlightMutex.Lock()
+	inFlight[r] = req
+	inFlightMutex.Unlock()
+
+	return func() {
+		inFlightMutex.Lock()
+		delete(inFlight, r)
+		inFlightMutex.Unlock()
+	}
+}
+
+// LongRequests returns the requests in flight for at least minDuration,
+// the longest first. The query strings are left out, they may hold tokens.
+func LongRequests(minDuration time.Duration) []InFlightRequest {
+	now := time.Now()
+
+	inFlightMutex.Lock()
+	var long []InFlightRequest
+	for _, req := range inFlight {
+		if d := now.Sub(req.Started); d >= minDuration {
+			long = append(long, req.snapshot(d))
+		}
+	}
+	inFlightMutex.Unlock()
+
+	sort.Slice(long, func(i, j int) bool { return long[i].Duration > long[j].Duration })
+	return long
+}
+
+func (req *InFlightRequest) snapshot(d time.Duration) InFlightRequest {
+	s := *req
+	s.Duration = d
+	s.GLID = helper.GLID(req.r.Context())
+	return s
+}
@@ -0,0 +1,183 @@
+/*
+In this file we restrict routes to the clients of some networks, e.g. the
+job requests of CI runners to the networks of the runners, before the
+request costs anything upstream.
+*/
+
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+type ipRule struct {
+	name    string
+	classes map[routeClass]bool
+	path    *regexp.Regexp
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+}
+
+var (
+	ipRules      []*ipRule
+	ipRulesMutex sync.RWMutex
+
+	ipRuleRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: httpSubsystem,
+			Name:      "ip_rule_requests",
+			Help:      "How many requests matched an IP rule, by rule and whether they were allowed or denied",
+		},
+		[]string{"rule", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ipRuleRequests)
+}
+
+// ConfigureIPRules replaces the IP rules. Rules are validated as a whole;
+// on error the previous rules stay active.
+func ConfigureIPRules(cfgs []config.IPRule) error {
+	var rules []*ipRule
+	for i, cfg := range cfgs {
+		rule, err := newIPRule(cfg)
+		if err != nil {
+			return fmt.Errorf("IP rule %d: %v", i, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	ipRulesMutex.Lock()
+	defer ipRulesMutex.Unlock()
+	ipRules = rules
+
+	return nil
+}
+
+func newIPRule(cfg config.IPRule) (*ipRule, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("Name is empty")
+	}
+	if len(cfg.Allow) == 0 && len(cfg.Deny) == 0 {
+		return nil, fmt.Errorf("%s: neither Allow nor Deny is set", cfg.Name)
+	}
+
+	rule := &ipRule{name: cfg.Name}
+
+	if len(cfg.Classes) > 0 {
+		rule.classes = make(map[routeClass]bool)
+		for _, class := range cfg.Classes {
+			switch routeClass(class) {
+			case routeClassDefault, routeClassGit, routeClassUploads, routeClassAPI, routeClassWebsocket:
+				rule.classes[routeClass(class)] = true
+			default:
+				return nil, fmt.Errorf("%s: unknown route class %q", cfg.Name, class)
+			}
+		}
+	}
+
+	if cfg.Path != "" {
+		path, err := regexp.Compile(cfg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: Path: %v", cfg.Name, err)
+		}
+		rule.path = path
+	}
+
+	var err error
+	if rule.allow, err = parseCIDRs(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("%s: Allow: %v", cfg.Name, err)
+	}
+	if rule.deny, err = parseCIDRs(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("%s: Deny: %v", cfg.Name, err)
+	}
+
+	return rule, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// allowIP checks the client of r against the IP rules that match the route
+// class and path. It returns the name of the rule that denied the request.
+func allowIP(r *http.Request, class routeClass, path string) (string, bool) {
+	ipRulesMutex.RLock()
+	rules := ipRules
+	ipRulesMutex.RUnlock()
+
+	if len(rules) == 0 {
+		return "", true
+	}
+
+	ip := clientIP(r)
+	for _, rule := range rules {
+		if !rule.matches(class, path) {
+			continue
+		}
+
+		if !rule.allows(ip) {
+			ipRuleRequests.WithLabelValues(rule.name, "denied").Inc()
+			return rule.name, false
+		}
+		ipRuleRequests.WithLabelValues(rule.name, "allowed").Inc()
+	}
+
+	return "", true
+}
+
+func (rule *ipRule) matches(class routeClass, path string) bool {
+	if rule.classes != nil && !rule.classes[class] {
+		return false
+	}
+	return rule.path == nil || rule.path.MatchString(path)
+}
+
+// allows tells if ip may use the routes of the rule. Clients whose address
+// is unknown are only allowed by rules without an Allow list.
+func (rule *ipRule) allows(ip net.IP) bool {
+	if ip != nil && containsIP(rule.deny, ip) {
+		return false
+	}
+	if len(rule.allow) == 0 {
+		return true
+	}
+	return ip != nil && containsIP(rule.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client of r, once FixRemoteAddr took the
+// trusted proxies into account
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
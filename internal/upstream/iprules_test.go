@@ -0,0 +1,68 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func TestIPRules(t *testing.T) {
+	require.NoError(t, ConfigureIPRules([]config.IPRule{
+		{Name: "runners", Classes: []string{"api"}, Path: `^/api/v4/jobs/request\z`, Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.0.0/16"}},
+		{Name: "blocked", Deny: []string{"192.0.2.0/24", "2001:db8::/32"}},
+	}))
+	defer ConfigureIPRules(nil)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer backend.Close()
+
+	u := NewUpstream(config.Config{Backend: helper.URLMustParse(backend.URL)}, logrus.StandardLogger())
+
+	tests := []struct {
+		desc       string
+		method     string
+		path       string
+		remoteAddr string
+		status     int
+	}{
+		{desc: "runner network", method: "POST", path: "/api/v4/jobs/request", remoteAddr: "10.2.3.4:1000", status: 200},
+		{desc: "other network", method: "POST", path: "/api/v4/jobs/request", remoteAddr: "198.51.100.1:1000", status: 403},
+		{desc: "denied part of the runner network", method: "POST", path: "/api/v4/jobs/request", remoteAddr: "10.1.2.3:1000", status: 403},
+		{desc: "other API route", method: "GET", path: "/api/v4/projects", remoteAddr: "198.51.100.1:1000", status: 200},
+		{desc: "denied network", method: "GET", path: "/", remoteAddr: "192.0.2.1:1000", status: 403},
+		{desc: "denied IPv6 network", method: "GET", path: "/api/v4/projects", remoteAddr: "[2001:db8::1]:1000", status: 403},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			r.RemoteAddr = tc.remoteAddr
+			w := httptest.NewRecorder()
+
+			u.ServeHTTP(w, r)
+
+			require.Equal(t, tc.status, w.Code)
+		})
+	}
+}
+
+func TestConfigureIPRulesInvalid(t *testing.T) {
+	for _, rule := range []config.IPRule{
+		{Allow: []string{"10.0.0.0/8"}},
+		{Name: "empty"},
+		{Name: "class", Classes: []string{"ci"}, Allow: []string{"10.0.0.0/8"}},
+		{Name: "path", Path: "(", Allow: []string{"10.0.0.0/8"}},
+		{Name: "cidr", Allow: []string{"10.0.0.0"}},
+		{Name: "deny", Deny: []string{"example.com"}},
+	} {
+		require.Error(t, ConfigureIPRules([]config.IPRule{rule}), "%+v", rule)
+	}
+}
@@ -0,0 +1,187 @@
+/*
+In this file we enforce the timeouts, body size limits and queues of each
+class of routes, so that slow clients on one class cannot tie up the
+connections needed by another.
+*/
+
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+)
+
+type routeClass string
+
+const (
+	routeClassDefault routeClass = "default"
+	routeClassGit     routeClass = "git"
+	routeClassUploads routeClass = "uploads"
+	routeClassAPI     routeClass = "api"
+	// Websockets are long-lived by design, they are never limited
+	routeClassWebsocket routeClass = "websocket"
+)
+
+var routeLimitExceeded = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: httpSubsystem,
+		Name:      "route_limit_exceeded",
+		Help:      "How many requests exceeded the body size limit or a timeout of their route class",
+	},
+	[]string{"class", "limit"},
+)
+
+func init() {
+	prometheus.MustRegister(routeLimitExceeded)
+}
+
+func withClass(class routeClass) func(*routeOptions) {
+	return func(options *routeOptions) {
+		options.class = class
+	}
+}
+
+func (u *upstream) routeLimits(class routeClass) (config.RouteLimits, bool) {
+	switch class {
+	case routeClassGit:
+		return u.RouteLimits.Git, true
+	case routeClassUploads:
+		return u.RouteLimits.Uploads, true
+	case routeClassAPI:
+		return u.RouteLimits.API, true
+	case routeClassDefault:
+		return u.RouteLimits.Default, true
+	}
+
+	return config.RouteLimits{}, false
+}
+
+// configureQueues creates the queues of the route classes that have one.
+// Requests of other classes are not queued.
+func (u *upstream) configureQueues() {
+	u.queues = make(map[routeClass]*queueing.Queue)
+	for class, cfg := range map[routeClass]config.QueueConfig{
+		routeClassAPI:     u.Queues.API,
+		routeClassGit:     u.Queues.Git,
+		routeClassUploads: u.Queues.Uploads,
+	} {
+		if queue := queueing.NewClassQueue(string(class), cfg); queue != nil {
+			u.queues[class] = queue
+		}
+	}
+}
+
+type responseControllerKey struct{}
+
+// withResponseController remembers a controller for the ResponseWriter of
+// the server. The writers wrapped around it by the access logger cannot be
+// unwrapped, so limitRequest could not set deadlines otherwise.
+func withResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func responseController(w http.ResponseWriter, r *http.Request) *http.ResponseController {
+	if rc, ok := r.Context().Value(responseControllerKey{}).(*http.ResponseController); ok {
+		return rc
+	}
+
+	return http.NewResponseController(w)
+}
+
+// limitRequest applies limits to r. It returns false if the request was
+// rejected; otherwise the caller must call the returned function once the
+// request has been handled.
+func limitRequest(w http.ResponseWriter, r *http.Request, class routeClass, limits config.RouteLimits) (func(), bool) {
+	if max := limits.MaxBodySize; max > 0 {
+		if r.ContentLength > max {
+			routeLimitExceeded.WithLabelValues(string(class), "body_size").Inc()
+			helper.HTTPError(w, r, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return nil, false
+		}
+
+		r.Body = &maxBytesReader{ReadCloser: http.MaxBytesReader(w, r.Body, max), class: class}
+	}
+
+	rc := responseController(w, r)
+
+	if limits.ReadTimeout != nil || limits.IdleTimeout != nil {
+		body := &deadlineReader{ReadCloser: r.Body, rc: rc, class: class}
+		if limits.ReadTimeout != nil {
+			body.deadline = time.Now().Add(limits.ReadTimeout.Duration)
+		}
+		if limits.IdleTimeout != nil {
+			body.idle = limits.IdleTimeout.Duration
+		}
+		r.Body = body
+	}
+
+	if limits.WriteTimeout == nil {
+		return func() {}, true
+	}
+
+	if err := rc.SetWriteDeadline(time.Now().Add(limits.WriteTimeout.Duration)); err != nil {
+		return func() {}, true
+	}
+
+	// The server does not reset the write deadline between requests on a
+	// keep-alive connection
+	return func() { rc.SetWriteDeadline(time.Time{}) }, true
+}
+
+type maxBytesReader struct {
+	io.ReadCloser
+	class routeClass
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	if _, ok := err.(*http.MaxBytesError); ok {
+		routeLimitExceeded.WithLabelValues(string(m.class), "body_size").Inc()
+	}
+	return n, err
+}
+
+// deadlineReader only sets a read deadline while the request body is being
+// read. The server keeps reading from the connection in the background once
+// the body is consumed, and a deadline expiring there would cancel the
+// request context.
+type deadlineReader struct {
+	io.ReadCloser
+	rc       *http.ResponseController
+	class    routeClass
+	deadline time.Time
+	idle     time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	deadline, limit := d.deadline, "read_timeout"
+	if d.idle > 0 {
+		if idle := time.Now().Add(d.idle); deadline.IsZero() || idle.Before(deadline) {
+			deadline, limit = idle, "idle_timeout"
+		}
+	}
+
+	if err := d.rc.SetReadDeadline(deadline); err != nil {
+		return d.ReadCloser.Read(p)
+	}
+	defer d.rc.SetReadDeadline(time.Time{})
+
+	n, err := d.ReadCloser.Read(p)
+	if os.IsTimeout(err) {
+		routeLimitExceeded.WithLabelValues(string(d.class), limit).Inc()
+	}
+	return n, err
+}
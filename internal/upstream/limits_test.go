@@ -0,0 +1,206 @@
+package upstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func limitedServer(limits config.RouteLimits, bodyErr chan<- error) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, ok := limitRequest(w, r, routeClassAPI, limits)
+		if !ok {
+			return
+		}
+		defer release()
+
+		_, err := ioutil.ReadAll(r.Body)
+		bodyErr <- err
+	})
+
+	return httptest.NewServer(withResponseController(handler))
+}
+
+func TestRouteLimitsRejectLargeContentLength(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	ts := limitedServer(config.RouteLimits{MaxBodySize: 4}, bodyErr)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL, "text/plain", strings.NewReader("too large"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Empty(t, bodyErr, "handler should not have read the body")
+}
+
+func TestRouteLimitsTruncateChunkedBody(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	ts := limitedServer(config.RouteLimits{MaxBodySize: 4}, bodyErr)
+	defer ts.Close()
+
+	// Hide the length of the body so that it is sent chunked
+	body := ioutil.NopCloser(strings.NewReader("too large"))
+	resp, err := http.Post(ts.URL, "text/plain", body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	_, ok := (<-bodyErr).(*http.MaxBytesError)
+	require.True(t, ok, "expected MaxBytesError")
+}
+
+func TestRouteLimitsAllowSmallBody(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	ts := limitedServer(config.RouteLimits{MaxBodySize: 4}, bodyErr)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL, "text/plain", strings.NewReader("ok"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, <-bodyErr)
+}
+
+func TestRouteLimitsTimeouts(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		limits config.RouteLimits
+	}{
+		{
+			desc:   "read timeout",
+			limits: config.RouteLimits{ReadTimeout: &config.TomlDuration{Duration: 100 * time.Millisecond}},
+		},
+		{
+			desc:   "idle timeout",
+			limits: config.RouteLimits{IdleTimeout: &config.TomlDuration{Duration: 100 * time.Millisecond}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			bodyErr := make(chan error, 1)
+			ts := limitedServer(tc.limits, bodyErr)
+			defer ts.Close()
+
+			// A slow client that announces a body but never finishes it
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+			require.NoError(t, err)
+
+			select {
+			case err := <-bodyErr:
+				require.True(t, os.IsTimeout(err), "expected timeout, got %v", err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout was not enforced")
+			}
+		})
+	}
+}
+
+func TestRouteLimitsIdleTimeoutExtendsOnProgress(t *testing.T) {
+	bodyErr := make(chan error, 1)
+	idle := &config.TomlDuration{Duration: 200 * time.Millisecond}
+	ts := limitedServer(config.RouteLimits{IdleTimeout: idle}, bodyErr)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\n")
+	require.NoError(t, err)
+	for _, c := range "abcd" {
+		time.Sleep(50 * time.Millisecond)
+		_, err = fmt.Fprint(conn, string(c))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, <-bodyErr)
+}
+
+func TestRouteClasses(t *testing.T) {
+	u := &upstream{Config: config.Config{Backend: DefaultBackend, CableBackend: DefaultBackend}}
+	u.configureRoutes()
+
+	testCases := []struct {
+		method string
+		path   string
+		class  routeClass
+	}{
+		{"POST", "/group/project.git/git-receive-pack", routeClassGit},
+		{"GET", "/group/project.git/info/refs", routeClassGit},
+		{"POST", "/api/v4/jobs/1/artifacts", routeClassUploads},
+		{"POST", "/group/project/uploads", routeClassUploads},
+		{"GET", "/api/v4/projects", routeClassAPI},
+		{"GET", "/group/project", routeClassDefault},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.method == "POST" && strings.HasSuffix(tc.path, "git-receive-pack") {
+			r.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		}
+
+		var class routeClass
+		for _, ro := range u.Routes {
+			if ro.isMatch(tc.path, r) {
+				class = ro.class
+				break
+			}
+		}
+		require.Equal(t, tc.class, class, "%s %s", tc.method, tc.path)
+	}
+}
+
+func TestClassQueues(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v4/projects/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	cfg := config.Config{
+		Backend: helper.URLMustParse(backend.URL),
+		Queues:  config.QueuesConfig{API: config.QueueConfig{Limit: 1}},
+	}
+	ws := httptest.NewServer(NewUpstream(cfg, logrus.StandardLogger()))
+	defer ws.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(ws.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	done := make(chan int)
+	go func() { done <- get("/api/v4/projects/slow") }()
+	<-started
+
+	require.Equal(t, http.StatusTooManyRequests, get("/api/v4/projects"), "the API queue is full")
+	require.Equal(t, http.StatusOK, get("/explore"), "other classes are not queued")
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-done)
+	require.Equal(t, http.StatusOK, get("/api/v4/projects"))
+}
@@ -0,0 +1,42 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// maintenanceRetryAfter is the Retry-After of requests refused during
+// maintenance, in seconds
+const maintenanceRetryAfter = "60"
+
+var maintenance int32
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode,
+// requests are refused with 503 Service Unavailable, except for assets,
+// health checks and the status.
+func SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&maintenance, v)
+}
+
+// InMaintenance tells if maintenance mode is on
+func InMaintenance() bool {
+	return atomic.LoadInt32(&maintenance) == 1
+}
+
+func duringMaintenance() func(*routeOptions) {
+	return func(options *routeOptions) {
+		options.duringMaintenance = true
+	}
+}
+
+func refuseDuringMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Retry-After", maintenanceRetryAfter)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, `{"message":"GitLab is down for maintenance, please retry later"}`)
+}
@@ -0,0 +1,78 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	ws := httptest.NewServer(NewUpstream(config.Config{Backend: helper.URLMustParse(backend.URL)}, logrus.StandardLogger()))
+	defer ws.Close()
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(ws.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, get("/api/v4/projects").StatusCode)
+
+	SetMaintenance(true)
+	defer SetMaintenance(false)
+
+	resp := get("/api/v4/projects")
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, maintenanceRetryAfter, resp.Header.Get("Retry-After"))
+	require.Equal(t, http.StatusOK, get("/-/readiness").StatusCode, "health checks are served")
+
+	SetMaintenance(false)
+	require.Equal(t, http.StatusOK, get("/api/v4/projects").StatusCode)
+}
+
+func TestLongRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer backend.Close()
+
+	ws := httptest.NewServer(NewUpstream(config.Config{Backend: helper.URLMustParse(backend.URL)}, logrus.StandardLogger()))
+	defer ws.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(ws.URL + "/api/v4/projects?private_token=secret")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	requests := LongRequests(0)
+	require.Len(t, requests, 1)
+	require.Equal(t, "GET", requests[0].Method)
+	require.Equal(t, "/api/v4/projects", requests[0].Path, "no query string")
+	require.Equal(t, string(routeClassAPI), requests[0].Class)
+	require.Empty(t, LongRequests(time.Hour))
+
+	close(release)
+	<-done
+	require.Empty(t, LongRequests(0))
+}
@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+var panicsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "panics_total",
+		Help:      "How many panics of request handlers were recovered",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(panicsTotal)
+}
+
+// recoverPanics turns a panic of next into a 500 response. The panic is
+// logged and reported to Sentry with its stack trace and the correlation ID
+// of the request.
+//
+// When the response has started already, a 500 can't be sent anymore. The
+// connection is then aborted, so that the client doesn't mistake the
+// truncated response for a complete one.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveryResponseWriter{rw: w}
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// Handlers abort responses on purpose with http.ErrAbortHandler
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			panicsTotal.Inc()
+			helper.LogErrorWithFields(r, fmt.Errorf("panic: %v", p), log.Fields{"stack": string(debug.Stack())})
+
+			if rw.started {
+				panic(http.ErrAbortHandler)
+			}
+			helper.HTTPError(w, r, "Internal server error", http.StatusInternalServerError)
+		}()
+
+		if _, ok := w.(http.Hijacker); ok {
+			next.ServeHTTP(&hijackingRecoveryResponseWriter{rw}, r)
+		} else {
+			next.ServeHTTP(rw, r)
+		}
+	})
+}
+
+// recoveryResponseWriter remembers whether the response has started
+type recoveryResponseWriter struct {
+	rw      http.ResponseWriter
+	started bool
+}
+
+func (rw *recoveryResponseWriter) Header() http.Header {
+	return rw.rw.Header()
+}
+
+func (rw *recoveryResponseWriter) Write(data []byte) (int, error) {
+	rw.started = true
+	return rw.rw.Write(data)
+}
+
+func (rw *recoveryResponseWriter) WriteHeader(status int) {
+	// Informational responses don't start the final response
+	if status >= 200 {
+		rw.started = true
+	}
+	rw.rw.WriteHeader(status)
+}
+
+func (rw *recoveryResponseWriter) Flush() {
+	rw.started = true
+	if f, ok := rw.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets the handlers behind the recovery writer flush and hijack
+// with an http.ResponseController, like the proxy and ActionCable do
+func (rw *recoveryResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.rw
+}
+
+type hijackingRecoveryResponseWriter struct {
+	*recoveryResponseWriter
+}
+
+func (h *hijackingRecoveryResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.started = true
+	return h.rw.(http.Hijacker).Hijack()
+}
@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverPanicsBeforeResponse(t *testing.T) {
+	panics := testutil.ToFloat64(panicsTotal)
+
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.NotContains(t, w.Body.String(), "boom", "panics must not leak to clients")
+	require.Equal(t, panics+1, testutil.ToFloat64(panicsTotal))
+}
+
+func TestRecoverPanicsAfterResponseAbortsConnection(t *testing.T) {
+	ts := httptest.NewServer(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		http.NewResponseController(w).Flush()
+		panic("boom")
+	})))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = ioutil.ReadAll(resp.Body)
+	require.Error(t, err, "the client must see the response is truncated")
+}
+
+func TestRecoverPanicsKeepsAbortHandler(t *testing.T) {
+	panics := testutil.ToFloat64(panicsTotal)
+
+	handler := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+	require.Equal(t, panics, testutil.ToFloat64(panicsTotal))
+}
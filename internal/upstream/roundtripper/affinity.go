@@ -0,0 +1,121 @@
+package roundtripper
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// The updates and traces of a CI job go to the same Puma, so that its trace
+// chunks are not appended out of order
+var defaultAffinityPaths = []string{`/api/v4/jobs/([0-9]+)(/trace)?\z`}
+
+var affinityRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "gitlab_workhorse_backend_affinity_requests",
+		Help: "How many requests were sent to the target of their affinity key",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(affinityRequests)
+}
+
+// affinity tells which requests stick to a target, and by which key
+type affinity struct {
+	paths  []*regexp.Regexp
+	header string
+	cookie string
+}
+
+// backendAffinity is applied to the balancers created afterwards
+var backendAffinity *affinity
+
+// ConfigureAffinity sets which requests stick to an authBackend target
+func ConfigureAffinity(cfg config.BackendAffinityConfig) error {
+	if !cfg.Enabled {
+		backendAffinity = nil
+		return nil
+	}
+
+	if cfg.Header != "" && cfg.Cookie != "" {
+		return fmt.Errorf("backend_affinity: set either Header or Cookie")
+	}
+
+	a := &affinity{header: cfg.Header, cookie: cfg.Cookie}
+	paths := cfg.Paths
+	if len(paths) == 0 {
+		paths = defaultAffinityPaths
+	}
+	for _, path := range paths {
+		regex, err := regexp.Compile(path)
+		if err != nil {
+			return fmt.Errorf("backend_affinity: Paths: %v", err)
+		}
+		a.paths = append(a.paths, regex)
+	}
+
+	backendAffinity = a
+	return nil
+}
+
+// key returns the affinity key of r, or "" if it doesn't stick to a target
+func (a *affinity) key(r *http.Request) string {
+	if a == nil {
+		return ""
+	}
+
+	for _, regex := range a.paths {
+		match := regex.FindStringSubmatch(r.URL.Path)
+		if match == nil {
+			continue
+		}
+
+		switch {
+		case a.header != "":
+			return r.Header.Get(a.header)
+		case a.cookie != "":
+			if c, err := r.Cookie(a.cookie); err == nil {
+				return c.Value
+			}
+			return ""
+		case len(match) > 1:
+			return match[1]
+		default:
+			return match[0]
+		}
+	}
+
+	return ""
+}
+
+// score ranks t for key with weighted rendezvous hashing: the target with
+// the highest score gets the key. When a target goes away only its keys
+// move to other targets.
+func (t *target) score(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(t.url.Host))
+
+	// A uniform number in (0, 1)
+	u := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -float64(t.weight) / math.Log(u)
+}
+
+// mix spreads the bits of an FNV hash, whose high bits barely change for
+// keys that only differ at the end
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
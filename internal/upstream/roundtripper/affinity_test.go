@@ -0,0 +1,127 @@
+package roundtripper
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func configureAffinity(t *testing.T, cfg config.BackendAffinityConfig) {
+	cfg.Enabled = true
+	require.NoError(t, ConfigureAffinity(cfg))
+}
+
+func TestAffinityKey(t *testing.T) {
+	defer ConfigureAffinity(config.BackendAffinityConfig{})
+
+	request := func(method, path string) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Job-Token", "token")
+		r.AddCookie(&http.Cookie{Name: "session", Value: "cookie"})
+		return r
+	}
+
+	testCases := []struct {
+		desc string
+		cfg  config.BackendAffinityConfig
+		r    *http.Request
+		key  string
+	}{
+		{desc: "job trace", r: request("PATCH", "/gitlab/api/v4/jobs/42/trace"), key: "42"},
+		{desc: "job update", r: request("PUT", "/api/v4/jobs/42"), key: "42"},
+		{desc: "other path", r: request("GET", "/api/v4/jobs/42/artifacts"), key: ""},
+		{desc: "header", cfg: config.BackendAffinityConfig{Header: "Job-Token"}, r: request("PATCH", "/api/v4/jobs/42/trace"), key: "token"},
+		{desc: "cookie", cfg: config.BackendAffinityConfig{Cookie: "session"}, r: request("PATCH", "/api/v4/jobs/42/trace"), key: "cookie"},
+		{desc: "missing cookie", cfg: config.BackendAffinityConfig{Cookie: "other"}, r: request("PATCH", "/api/v4/jobs/42/trace"), key: ""},
+		{desc: "path without group", cfg: config.BackendAffinityConfig{Paths: []string{`^/api/v4/projects/[0-9]+`}}, r: request("GET", "/api/v4/projects/1/jobs"), key: "/api/v4/projects/1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			configureAffinity(t, tc.cfg)
+			require.Equal(t, tc.key, backendAffinity.key(tc.r))
+		})
+	}
+
+	require.NoError(t, ConfigureAffinity(config.BackendAffinityConfig{}))
+	require.Empty(t, backendAffinity.key(request("PATCH", "/api/v4/jobs/42/trace")), "affinity is disabled")
+}
+
+func TestConfigureAffinityInvalid(t *testing.T) {
+	require.Error(t, ConfigureAffinity(config.BackendAffinityConfig{Enabled: true, Paths: []string{"("}}))
+	require.Error(t, ConfigureAffinity(config.BackendAffinityConfig{Enabled: true, Header: "Job-Token", Cookie: "session"}))
+}
+
+func TestBalancerAffinity(t *testing.T) {
+	b := newBalancer([]config.BackendTarget{
+		{URL: helper.URLMustParse("http://puma1"), Weight: 1},
+		{URL: helper.URLMustParse("http://puma2"), Weight: 1},
+		{URL: helper.URLMustParse("http://puma3"), Weight: 2},
+	}, config.BackendHealthCheckConfig{}, func(*url.URL) http.RoundTripper { return nil })
+
+	picked := make(map[string]*target)
+	hits := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		picked[key] = b.sticky(key)
+		hits[picked[key].url.Host]++
+
+		require.Equal(t, picked[key], b.sticky(key), "a key sticks to its target")
+	}
+	require.InDelta(t, 250, hits["puma1"], 60)
+	require.InDelta(t, 250, hits["puma2"], 60)
+	require.InDelta(t, 500, hits["puma3"], 60)
+
+	puma2 := b.targets[1]
+	b.report(puma2, false)
+	b.report(puma2, false)
+	require.False(t, puma2.healthy)
+
+	for key, t0 := range picked {
+		t1 := b.sticky(key)
+		if t0 == puma2 {
+			require.NotEqual(t, puma2, t1, "the keys of an unhealthy target move")
+		} else {
+			require.Equal(t, t0, t1, "the keys of healthy targets stay")
+		}
+	}
+}
+
+func TestBalancedRoundTripperAffinity(t *testing.T) {
+	configureAffinity(t, config.BackendAffinityConfig{})
+	defer ConfigureAffinity(config.BackendAffinityConfig{})
+
+	var hits [2]int
+	newServer := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+		}))
+	}
+	ts1, ts2 := newServer(0), newServer(1)
+	defer ts1.Close()
+	defer ts2.Close()
+
+	b := newBalancer([]config.BackendTarget{
+		{URL: helper.URLMustParse(ts1.URL), Weight: 1},
+		{URL: helper.URLMustParse(ts2.URL), Weight: 1},
+	}, config.BackendHealthCheckConfig{}, func(u *url.URL) http.RoundTripper {
+		return newTargetRoundTripper(u, "", 0, false)
+	})
+
+	for i := 0; i < 6; i++ {
+		req, err := http.NewRequest("PATCH", ts1.URL+"/api/v4/jobs/42/trace", nil)
+		require.NoError(t, err)
+		resp, err := b.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	require.Contains(t, [][2]int{{6, 0}, {0, 6}}, hits, "the trace of a job goes to a single target")
+}
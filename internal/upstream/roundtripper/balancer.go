@@ -0,0 +1,292 @@
+package roundtripper
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
+)
+
+const (
+	defaultHealthCheckPath      = "/-/readiness"
+	defaultHealthCheckInterval  = 5 * time.Second
+	defaultHealthCheckTimeout   = 2 * time.Second
+	defaultHealthCheckThreshold = 2
+)
+
+var (
+	targetHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gitlab_workhorse_backend_target_healthy",
+			Help: "Whether a target of authBackend passes its health checks",
+		},
+		[]string{"target"},
+	)
+	targetRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_backend_target_requests",
+			Help: "How many requests were sent to each target of authBackend",
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(targetHealthy, targetRequests)
+}
+
+type target struct {
+	url       *url.URL
+	healthURL string
+	weight    int
+	rt        http.RoundTripper
+
+	// Guarded by balancer.mu
+	current   int
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// balancer spreads requests over several backends with smooth weighted
+// round robin, the way nginx does. Requests with an affinity key stick to
+// a target instead. Targets that fail their health checks get no new
+// requests until they pass again.
+type balancer struct {
+	targets            []*target
+	affinity           *affinity
+	interval           time.Duration
+	timeout            time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+
+	mu sync.Mutex
+}
+
+// NewBalancedRoundTripper returns a RoundTripper for several backends, which
+// must only differ in their scheme and host
+func NewBalancedRoundTripper(targets []config.BackendTarget, proxyHeadersTimeout time.Duration, developmentMode bool, h2c bool, cfg config.BackendHealthCheckConfig) http.RoundTripper {
+	if len(targets) == 1 {
+		return NewBackendRoundTripper(targets[0].URL, "", proxyHeadersTimeout, developmentMode, h2c)
+	}
+
+	b := newBalancer(targets, cfg, func(u *url.URL) http.RoundTripper {
+		return newTargetRoundTripper(u, "", proxyHeadersTimeout, h2c)
+	})
+	go b.checkHealth()
+	status.Register("backend_targets", b.status)
+
+	return instrumentRoundTripper(b, developmentMode)
+}
+
+func newBalancer(targets []config.BackendTarget, cfg config.BackendHealthCheckConfig, newRoundTripper func(*url.URL) http.RoundTripper) *balancer {
+	b := &balancer{
+		affinity:           backendAffinity,
+		interval:           defaultHealthCheckInterval,
+		timeout:            defaultHealthCheckTimeout,
+		unhealthyThreshold: defaultHealthCheckThreshold,
+		healthyThreshold:   defaultHealthCheckThreshold,
+	}
+	if cfg.Interval != nil {
+		b.interval = cfg.Interval.Duration
+	}
+	if cfg.Timeout != nil {
+		b.timeout = cfg.Timeout.Duration
+	}
+	if cfg.UnhealthyThreshold > 0 {
+		b.unhealthyThreshold = cfg.UnhealthyThreshold
+	}
+	if cfg.HealthyThreshold > 0 {
+		b.healthyThreshold = cfg.HealthyThreshold
+	}
+
+	checkPath := cfg.Path
+	if checkPath == "" {
+		checkPath = defaultHealthCheckPath
+	}
+
+	for _, t := range targets {
+		healthURL := *t.URL
+		healthURL.Path = path.Join(t.URL.Path, checkPath)
+
+		weight := t.Weight
+		if weight < 1 {
+			weight = 1
+		}
+
+		b.targets = append(b.targets, &target{
+			url:       t.URL,
+			healthURL: healthURL.String(),
+			weight:    weight,
+			rt:        newRoundTripper(t.URL),
+			healthy:   true,
+		})
+		targetHealthy.WithLabelValues(t.URL.Host).Set(1)
+	}
+
+	return b
+}
+
+func (b *balancer) status() interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	targets := make([]map[string]interface{}, 0, len(b.targets))
+	for _, t := range b.targets {
+		targets = append(targets, map[string]interface{}{
+			"target":  t.url.Host,
+			"weight":  t.weight,
+			"healthy": t.healthy,
+		})
+	}
+	return targets
+}
+
+// next picks the target of a request. If no target is healthy all of them
+// are used, the health checks could be wrong.
+func (b *balancer) next() *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	anyHealthy := false
+	for _, t := range b.targets {
+		anyHealthy = anyHealthy || t.healthy
+	}
+
+	var best *target
+	total := 0
+	for _, t := range b.targets {
+		if anyHealthy && !t.healthy {
+			continue
+		}
+
+		t.current += t.weight
+		total += t.weight
+		if best == nil || t.current > best.current {
+			best = t
+		}
+	}
+	best.current -= total
+
+	return best
+}
+
+// sticky picks the target of an affinity key. If no target is healthy all
+// of them are used, like in next.
+func (b *balancer) sticky(key string) *target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	anyHealthy := false
+	for _, t := range b.targets {
+		anyHealthy = anyHealthy || t.healthy
+	}
+
+	var best *target
+	bestScore := 0.0
+	for _, t := range b.targets {
+		if anyHealthy && !t.healthy {
+			continue
+		}
+
+		if score := t.score(key); best == nil || score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+
+	return best
+}
+
+func (b *balancer) RoundTrip(r *http.Request) (*http.Response, error) {
+	var t *target
+	if key := b.affinity.key(r); key != "" {
+		t = b.sticky(key)
+		affinityRequests.Inc()
+	} else {
+		t = b.next()
+	}
+	targetRequests.WithLabelValues(t.url.Host).Inc()
+
+	out := *r
+	outURL := *r.URL
+	outURL.Scheme = t.url.Scheme
+	outURL.Host = t.url.Host
+	out.URL = &outURL
+
+	return t.rt.RoundTrip(&out)
+}
+
+func (b *balancer) checkHealth() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var wg sync.WaitGroup
+		for _, t := range b.targets {
+			wg.Add(1)
+			go func(t *target) {
+				defer wg.Done()
+				b.report(t, b.check(t))
+			}(t)
+		}
+		wg.Wait()
+	}
+}
+
+func (b *balancer) check(t *target) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", t.healthURL, nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func (b *balancer) report(t *target, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		t.successes++
+		t.failures = 0
+	} else {
+		t.failures++
+		t.successes = 0
+	}
+
+	switch {
+	case t.healthy && t.failures >= b.unhealthyThreshold:
+		t.healthy = false
+		targetHealthy.WithLabelValues(t.url.Host).Set(0)
+		log.WithField("target", t.url.Host).Warn("backend target is unhealthy, draining it")
+
+		// Requests in flight are allowed to finish, but idle connections
+		// would only be reused once the target is healthy again
+		if c, ok := t.rt.(interface{ CloseIdleConnections() }); ok {
+			c.CloseIdleConnections()
+		}
+
+	case !t.healthy && t.successes >= b.healthyThreshold:
+		t.healthy = true
+		t.current = 0
+		targetHealthy.WithLabelValues(t.url.Host).Set(1)
+		log.WithField("target", t.url.Host).Info("backend target is healthy")
+	}
+}
@@ -0,0 +1,112 @@
+package roundtripper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func TestBalancerWeights(t *testing.T) {
+	b := newBalancer([]config.BackendTarget{
+		{URL: helper.URLMustParse("http://puma1"), Weight: 3},
+		{URL: helper.URLMustParse("http://puma2"), Weight: 1},
+	}, config.BackendHealthCheckConfig{}, func(*url.URL) http.RoundTripper { return nil })
+
+	var order []string
+	for i := 0; i < 8; i++ {
+		order = append(order, b.next().url.Host)
+	}
+
+	require.Equal(t, []string{"puma1", "puma1", "puma2", "puma1", "puma1", "puma1", "puma2", "puma1"}, order)
+}
+
+func TestBalancerDrainsUnhealthyTargets(t *testing.T) {
+	b := newBalancer([]config.BackendTarget{
+		{URL: helper.URLMustParse("http://puma1"), Weight: 1},
+		{URL: helper.URLMustParse("http://puma2"), Weight: 1},
+	}, config.BackendHealthCheckConfig{}, func(*url.URL) http.RoundTripper { return nil })
+	puma1, puma2 := b.targets[0], b.targets[1]
+
+	b.report(puma2, false)
+	require.True(t, puma2.healthy, "a single failure is not enough")
+	b.report(puma2, false)
+	require.False(t, puma2.healthy)
+
+	for i := 0; i < 4; i++ {
+		require.Equal(t, puma1, b.next())
+	}
+
+	b.report(puma1, false)
+	b.report(puma1, false)
+	require.False(t, puma1.healthy)
+	hosts := map[string]bool{b.next().url.Host: true, b.next().url.Host: true}
+	require.Len(t, hosts, 2, "all targets are used when none is healthy")
+
+	b.report(puma2, true)
+	b.report(puma2, true)
+	require.True(t, puma2.healthy)
+	for i := 0; i < 4; i++ {
+		require.Equal(t, puma2, b.next())
+	}
+}
+
+func TestBalancedRoundTripper(t *testing.T) {
+	var hits [2]int32
+	var healthy int32 = 1
+
+	newServer := func(i int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/gitlab/-/readiness" {
+				if i == 1 && atomic.LoadInt32(&healthy) == 0 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			require.Equal(t, "/gitlab/api/v4/projects", r.URL.Path)
+			atomic.AddInt32(&hits[i], 1)
+		}))
+	}
+	ts1, ts2 := newServer(0), newServer(1)
+	defer ts1.Close()
+	defer ts2.Close()
+
+	b := newBalancer([]config.BackendTarget{
+		{URL: helper.URLMustParse(ts1.URL + "/gitlab"), Weight: 1},
+		{URL: helper.URLMustParse(ts2.URL + "/gitlab"), Weight: 1},
+	}, config.BackendHealthCheckConfig{UnhealthyThreshold: 1}, func(u *url.URL) http.RoundTripper {
+		return newTargetRoundTripper(u, "", 0, false)
+	})
+	rt := instrumentRoundTripper(b, true)
+
+	get := func() {
+		req, err := http.NewRequest("GET", ts1.URL+"/gitlab/api/v4/projects", nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	require.Equal(t, [2]int32{2, 2}, hits)
+
+	atomic.StoreInt32(&healthy, 0)
+	for _, target := range b.targets {
+		b.report(target, b.check(target))
+	}
+	require.False(t, b.targets[1].healthy)
+
+	for i := 0; i < 4; i++ {
+		get()
+	}
+	require.Equal(t, [2]int32{6, 2}, hits)
+}
@@ -0,0 +1,80 @@
+package roundtripper
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// newH2CTransport returns a transport that speaks HTTP/2 with prior
+// knowledge and without TLS to the backend. Many requests share a single
+// connection instead of each taking one from the pool.
+func newH2CTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error), proxyHeadersTimeout time.Duration) http.RoundTripper {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(context.Background(), network, addr)
+		},
+	}
+
+	if proxyHeadersTimeout == 0 {
+		return transport
+	}
+
+	return &headerTimeoutRoundTripper{next: transport, timeout: proxyHeadersTimeout}
+}
+
+// headerTimeoutRoundTripper does for http2.Transport what
+// ResponseHeaderTimeout does for http.Transport
+type headerTimeoutRoundTripper struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *headerTimeoutRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+
+	res, err := t.next.RoundTrip(r.WithContext(ctx))
+	if !timer.Stop() && err != nil {
+		cancel()
+		return nil, &headerTimeoutError{}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+func (t *headerTimeoutRoundTripper) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type headerTimeoutError struct{}
+
+func (*headerTimeoutError) Error() string {
+	return "timeout awaiting response headers"
+}
+
+func (*headerTimeoutError) Timeout() bool { return true }
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
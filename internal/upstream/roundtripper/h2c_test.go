@@ -0,0 +1,80 @@
+package roundtripper
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func startH2CBackend(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *url.URL) {
+	ts := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	return ts, u
+}
+
+func TestH2CBackend(t *testing.T) {
+	ts, u := startH2CBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	defer ts.Close()
+
+	rt := NewBackendRoundTripper(u, "", time.Second, true, true)
+	req, err := http.NewRequest("GET", ts.URL+"/api/v4/projects", nil)
+	require.NoError(t, err)
+
+	res, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "HTTP/2.0", string(body))
+}
+
+func TestH2CBackendHeaderTimeout(t *testing.T) {
+	ts, u := startH2CBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	defer ts.Close()
+
+	rt := NewBackendRoundTripper(u, "", 50*time.Millisecond, true, true)
+	req, err := http.NewRequest("GET", ts.URL+"/api/v4/projects", nil)
+	require.NoError(t, err)
+
+	res, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusBadGateway, res.StatusCode)
+}
+
+func TestH2CBackendSlowBody(t *testing.T) {
+	ts, u := startH2CBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	defer ts.Close()
+
+	rt := NewBackendRoundTripper(u, "", 50*time.Millisecond, true, true)
+	req, err := http.NewRequest("GET", ts.URL+"/api/v4/projects", nil)
+	require.NoError(t, err)
+
+	res, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err, "the header timeout must not apply to the body")
+	require.Equal(t, "done", string(body))
+}
@@ -15,10 +15,6 @@ import (
 )
 
 func mustParseAddress(address, scheme string) string {
-	if scheme == "https" {
-		panic("TLS is not supported for backend connections")
-	}
-
 	for _, suffix := range []string{"", ":" + scheme} {
 		address += suffix
 		if host, port, err := net.SplitHostPort(address); err == nil && host != "" && port != "" {
@@ -29,8 +25,15 @@ func mustParseAddress(address, scheme string) string {
 	panic(fmt.Errorf("could not parse host:port from address %q and scheme %q", address, scheme))
 }
 
-// NewBackendRoundTripper returns a new RoundTripper instance using the provided values
-func NewBackendRoundTripper(backend *url.URL, socket string, proxyHeadersTimeout time.Duration, developmentMode bool) http.RoundTripper {
+// NewBackendRoundTripper returns a new RoundTripper instance using the
+// provided values. With h2c the backend is spoken to in HTTP/2 without TLS,
+// or in HTTP/2 over TLS for https:// backends.
+func NewBackendRoundTripper(backend *url.URL, socket string, proxyHeadersTimeout time.Duration, developmentMode bool, h2c bool) http.RoundTripper {
+	return instrumentRoundTripper(newTargetRoundTripper(backend, socket, proxyHeadersTimeout, h2c), developmentMode)
+}
+
+// newTargetRoundTripper returns the transport for a single backend
+func newTargetRoundTripper(backend *url.URL, socket string, proxyHeadersTimeout time.Duration, h2c bool) http.RoundTripper {
 	// Copied from the definition of http.DefaultTransport. We can't literally copy http.DefaultTransport because of its hidden internal state.
 	transport, dialer := newBackendTransport()
 	transport.ResponseHeaderTimeout = proxyHeadersTimeout
@@ -47,15 +50,36 @@ func NewBackendRoundTripper(backend *url.URL, socket string, proxyHeadersTimeout
 	} else {
 		panic("backend is nil and socket is empty")
 	}
+	transport.DialContext = instrumentDial(transport.DialContext)
+
+	tlsBackend := backend != nil && backend.Scheme == "https"
+	if tlsBackend {
+		if backendTLSConfig != nil {
+			transport.TLSClientConfig = backendTLSConfig.Clone()
+		}
+		// HTTP/2 is only attempted by default without a custom dialer
+		transport.ForceAttemptHTTP2 = h2c
+	}
+
+	var rt http.RoundTripper = transport
+	if h2c && !tlsBackend {
+		rt = newH2CTransport(transport.DialContext, proxyHeadersTimeout)
+	}
+
+	return rt
+}
+
+func instrumentRoundTripper(rt http.RoundTripper, developmentMode bool) http.RoundTripper {
+	rt = &connectionsRoundTripper{next: rt}
 
 	return tracing.NewRoundTripper(
 		correlation.NewInstrumentedRoundTripper(
-			badgateway.NewRoundTripper(developmentMode, transport),
+			badgateway.NewRoundTripper(developmentMode, rt),
 		),
 	)
 }
 
 // NewTestBackendRoundTripper sets up a RoundTripper for testing purposes
 func NewTestBackendRoundTripper(backend *url.URL) http.RoundTripper {
-	return NewBackendRoundTripper(backend, "", 0, true)
+	return NewBackendRoundTripper(backend, "", 0, true, false)
 }
@@ -9,6 +9,7 @@ func TestMustParseAddress(t *testing.T) {
 		{"1.2.3.4:56", "http", "1.2.3.4:56"},
 		{"[::1]:23", "http", "::1:23"},
 		{"4.5.6.7", "http", "4.5.6.7:http"},
+		{"1.2.3.4", "https", "1.2.3.4:https"},
 	}
 	for _, example := range successExamples {
 		result := mustParseAddress(example.address, example.scheme)
@@ -19,7 +20,6 @@ func TestMustParseAddress(t *testing.T) {
 
 	panicExamples := []struct{ address, scheme string }{
 		{"1.2.3.4", ""},
-		{"1.2.3.4", "https"},
 	}
 
 	for _, panicExample := range panicExamples {
@@ -0,0 +1,63 @@
+package roundtripper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+// backendTLSConfig is used for https:// backends when a custom CA, client
+// certificate or server name is configured. When nil the system CA pool is
+// used.
+var backendTLSConfig *tls.Config
+
+// ConfigureTLS sets up the TLS settings of https:// backends
+func ConfigureTLS(cfg config.BackendTLSConfig) error {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	backendTLSConfig = tlsConfig
+	return nil
+}
+
+func newTLSConfig(cfg config.BackendTLSConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.ServerNameOverride == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerNameOverride,
+	}
+
+	// The backend is trusted by CAFile alone, not by every public CA
+	if cfg.CAFile != "" {
+		pool := x509.NewCertPool()
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("backend_tls: read CAFile: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("backend_tls: no certificates found in CAFile %q", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("backend_tls: CertFile and KeyFile must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("backend_tls: load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,97 @@
+package roundtripper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := testhelper.WriteCertificate(t, dir, "rails.internal", "rails.internal", 1)
+
+	tlsConfig, err := newTLSConfig(config.BackendTLSConfig{})
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig, "no custom TLS config")
+
+	tlsConfig, err = newTLSConfig(config.BackendTLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerNameOverride: "rails"})
+	require.NoError(t, err)
+	require.Len(t, tlsConfig.RootCAs.Subjects(), 1, "only CAFile is trusted")
+	require.Len(t, tlsConfig.Certificates, 1)
+	require.Equal(t, "rails", tlsConfig.ServerName)
+
+	_, err = newTLSConfig(config.BackendTLSConfig{CertFile: certFile})
+	require.Error(t, err, "CertFile without KeyFile")
+
+	_, err = newTLSConfig(config.BackendTLSConfig{CAFile: keyFile})
+	require.Error(t, err, "no certificates in CA file")
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backend-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCert, serverKey := testhelper.WriteCertificate(t, dir, "rails.internal", "rails.internal", 1)
+	clientCert, clientKey := testhelper.WriteCertificate(t, dir, "workhorse.internal", "workhorse.internal", 1)
+
+	cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientPEM, err := ioutil.ReadFile(clientCert)
+	require.NoError(t, err)
+	require.True(t, clientCAs.AppendCertsFromPEM(clientPEM))
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	defer func(old *tls.Config) { backendTLSConfig = old }(backendTLSConfig)
+
+	request := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		require.NoError(t, err)
+		return NewTestBackendRoundTripper(backend).RoundTrip(req)
+	}
+
+	require.NoError(t, ConfigureTLS(config.BackendTLSConfig{CAFile: serverCert, ServerNameOverride: "rails.internal"}))
+	resp, err := request()
+	if err == nil {
+		// badgateway turns connection errors into 502 responses
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode, "request without client certificate")
+	}
+
+	require.NoError(t, ConfigureTLS(config.BackendTLSConfig{
+		CAFile:             serverCert,
+		CertFile:           clientCert,
+		KeyFile:            clientKey,
+		ServerNameOverride: "rails.internal",
+	}))
+	resp, err = request()
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
@@ -1,11 +1,56 @@
 package roundtripper
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+var (
+	backendConnections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gitlab_workhorse_backend_connections",
+			Help: "How many requests to the backend reused an idle connection (reused=true) or needed a new one (reused=false)",
+		},
+		[]string{"reused"},
+	)
+	backendDialSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "gitlab_workhorse_backend_dial_seconds",
+			Help:    "How long it took to open connections to the backend",
+			Buckets: []float64{0.001, 0.005, 0.025, 0.1, 0.5, 1, 5, 30},
+		},
+	)
 )
 
+func init() {
+	prometheus.MustRegister(backendConnections, backendDialSeconds)
+}
+
+// transportConfig is applied to the transports created afterwards
+var transportConfig config.BackendTransportConfig
+
+// ConfigureTransport sets up the connection pool of backend transports
+func ConfigureTransport(cfg config.BackendTransportConfig) error {
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("backend_transport: MaxIdleConns and MaxIdleConnsPerHost can't be negative")
+	}
+	if cfg.IdleConnTimeout != nil && cfg.IdleConnTimeout.Duration < 0 {
+		return fmt.Errorf("backend_transport: IdleConnTimeout can't be negative")
+	}
+
+	transportConfig = cfg
+	return nil
+}
+
 // newBackendTransport setups the default HTTP transport which Workhorse uses
 // to communicate with the upstream
 func newBackendTransport() (*http.Transport, *net.Dialer) {
@@ -24,5 +69,50 @@ func newBackendTransport() (*http.Transport, *net.Dialer) {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
+	cfg := transportConfig
+	if cfg.KeepAlive != nil {
+		dialler.KeepAlive = cfg.KeepAlive.Duration
+	}
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout != nil {
+		transport.IdleConnTimeout = cfg.IdleConnTimeout.Duration
+	}
+	transport.DisableKeepAlives = cfg.DisableKeepAlives
+	transport.DisableCompression = cfg.DisableCompression
+
 	return transport, dialler
 }
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func instrumentDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			backendDialSeconds.Observe(time.Since(start).Seconds())
+		}
+		return conn, err
+	}
+}
+
+// connectionsRoundTripper counts how often connections to the backend are
+// reused. Many new connections point to a pool that is too small.
+type connectionsRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (rt *connectionsRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			backendConnections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+
+	return rt.next.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+}
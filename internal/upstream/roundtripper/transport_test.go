@@ -0,0 +1,62 @@
+package roundtripper
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func TestConfigureTransport(t *testing.T) {
+	defer func(old config.BackendTransportConfig) { transportConfig = old }(transportConfig)
+
+	require.Error(t, ConfigureTransport(config.BackendTransportConfig{MaxIdleConnsPerHost: -1}))
+
+	require.NoError(t, ConfigureTransport(config.BackendTransportConfig{
+		MaxIdleConnsPerHost: 50,
+		IdleConnTimeout:     &config.TomlDuration{Duration: time.Minute},
+		KeepAlive:           &config.TomlDuration{Duration: 15 * time.Second},
+		DisableCompression:  true,
+	}))
+
+	transport, dialer := newBackendTransport()
+	require.Equal(t, 100, transport.MaxIdleConns, "default is kept")
+	require.Equal(t, 50, transport.MaxIdleConnsPerHost)
+	require.Equal(t, time.Minute, transport.IdleConnTimeout)
+	require.Equal(t, 15*time.Second, dialer.KeepAlive)
+	require.True(t, transport.DisableCompression)
+	require.False(t, transport.DisableKeepAlives)
+}
+
+func TestConnectionReuseMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	rt := NewTestBackendRoundTripper(backend)
+
+	reused, fresh := testutil.ToFloat64(backendConnections.WithLabelValues("true")), testutil.ToFloat64(backendConnections.WithLabelValues("false"))
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	require.Equal(t, fresh+1, testutil.ToFloat64(backendConnections.WithLabelValues("false")))
+	require.Equal(t, reused+1, testutil.ToFloat64(backendConnections.WithLabelValues("true")))
+}
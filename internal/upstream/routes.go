@@ -13,11 +13,20 @@ import (
 	apipkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/api"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/artifacts"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/builds"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/cable"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/channel"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/compression"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/crossorigin"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/dependencyproxy"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/downloadpolicy"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/graphqlcache"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/lfs"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/limiter"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/nats"
 	proxypkg "gitlab.com/gitlab-org/gitlab-workhorse/internal/proxy"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
@@ -26,6 +35,8 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendfile"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/sendurl"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/staticpages"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/terraform"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
 )
 
@@ -36,11 +47,22 @@ type routeEntry struct {
 	regex    *regexp.Regexp
 	handler  http.Handler
 	matchers []matcherFunc
+	class    routeClass
+	// highPriority routes are not shed by the backend breaker
+	highPriority bool
+	// duringMaintenance routes are served in maintenance mode
+	duringMaintenance bool
 }
 
 type routeOptions struct {
-	tracing  bool
-	matchers []matcherFunc
+	tracing      bool
+	matchers     []matcherFunc
+	class        routeClass
+	traffic      trafficClass
+	highPriority bool
+	// uploadType selects the object storage destination of upload_routes
+	uploadType        string
+	duringMaintenance bool
 }
 
 const (
@@ -51,6 +73,8 @@ const (
 	snippetUploadPattern = `^/uploads/personal_snippet`
 	userUploadPattern    = `^/uploads/user`
 	importPattern        = `^/import/`
+
+	dependencyProxyPattern = `^/v2/.+/dependency_proxy/containers/.+/(blobs|manifests)/`
 )
 
 func compileRegexp(regexpStr string) *regexp.Regexp {
@@ -73,40 +97,66 @@ func withoutTracing() func(*routeOptions) {
 	}
 }
 
+func withUploadType(uploadType string) func(*routeOptions) {
+	return func(options *routeOptions) {
+		options.uploadType = uploadType
+	}
+}
+
 func route(method, regexpStr string, handler http.Handler, opts ...func(*routeOptions)) routeEntry {
 	// Instantiate a route with the defaults
 	options := routeOptions{
 		tracing: true,
+		class:   routeClassDefault,
 	}
 
 	for _, f := range opts {
 		f(&options)
 	}
+	if options.traffic == "" {
+		options.traffic = defaultTraffic(options.class)
+	}
 
+	if options.uploadType != "" {
+		handler = uploadTypeHandler(handler, options.uploadType)
+	}
+	handler = compression.Handler(handler)
 	handler = denyWebsocket(handler)                      // Disallow websockets
 	handler = instrumentRoute(handler, method, regexpStr) // Add prometheus metrics
+	handler = instrumentTraffic(handler, options.traffic)
 	if options.tracing {
 		// Add distributed tracing
 		handler = tracing.Handler(handler)
 	}
 
 	return routeEntry{
-		method:   method,
-		regex:    compileRegexp(regexpStr),
-		handler:  handler,
-		matchers: options.matchers,
+		method:            method,
+		regex:             compileRegexp(regexpStr),
+		handler:           handler,
+		matchers:          options.matchers,
+		class:             options.class,
+		highPriority:      options.highPriority,
+		duringMaintenance: options.duringMaintenance,
 	}
 }
 
 func wsRoute(regexpStr string, handler http.Handler, matchers ...matcherFunc) routeEntry {
 	return routeEntry{
-		method:   "GET",
-		regex:    compileRegexp(regexpStr),
-		handler:  instrumentRoute(handler, "GET", regexpStr),
-		matchers: append(matchers, websocket.IsWebSocketUpgrade),
+		method:       "GET",
+		regex:        compileRegexp(regexpStr),
+		handler:      instrumentRoute(handler, "GET", regexpStr),
+		matchers:     append(matchers, websocket.IsWebSocketUpgrade),
+		class:        routeClassWebsocket,
+		highPriority: true,
 	}
 }
 
+func uploadTypeHandler(next http.Handler, uploadType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(filestore.WithUploadType(r.Context(), uploadType)))
+	})
+}
+
 // Creates matcherFuncs for a particular content type.
 func isContentType(contentType string) func(*http.Request) bool {
 	return func(r *http.Request) bool {
@@ -134,19 +184,31 @@ func (ro *routeEntry) isMatch(cleanedPath string, req *http.Request) bool {
 	return ok
 }
 
-func buildProxy(backend *url.URL, version string, rt http.RoundTripper) http.Handler {
+func buildProxy(backend *url.URL, version string, rt http.RoundTripper, cfg config.Config, dependencyProxyInjector *dependencyproxy.Injector) http.Handler {
 	proxier := proxypkg.NewProxy(backend, version, rt)
 
-	return senddata.SendData(
+	return downloadpolicy.Filter(crossorigin.Filter(senddata.SendData(
 		sendfile.SendFile(apipkg.Block(proxier)),
-		git.SendArchive,
+		git.NewSendArchive(cfg.Archive),
 		git.SendBlob,
 		git.SendDiff,
 		git.SendPatch,
 		git.SendSnapshot,
 		artifacts.SendEntry,
+		artifacts.SendEntries,
+		artifacts.SendSite,
 		sendurl.SendURL,
-	)
+		lfs.SendBatch,
+		dependencyProxyInjector,
+	)))
+}
+
+// keyWatcher returns the pubsub backend for CI long polling
+func (u *upstream) keyWatcher() builds.KeyWatcher {
+	if u.NATS != nil {
+		return nats.KeyWatcher{}
+	}
+	return redis.KeyWatcher{}
 }
 
 // Routing table
@@ -159,79 +221,123 @@ func (u *upstream) configureRoutes() {
 		u.Version,
 		u.RoundTripper,
 	)
+	api.Retry = apipkg.NewRetryPolicy(u.PreAuthorizeRetry)
 
-	static := &staticpages.Static{DocumentRoot: u.DocumentRoot}
-	proxy := buildProxy(u.Backend, u.Version, u.RoundTripper)
+	static := &staticpages.Static{DocumentRoot: u.DocumentRoot, ErrorPagesDir: u.ErrorPagesDir, AssetCache: u.AssetCache}
+	dependencyProxyInjector := dependencyproxy.NewInjector()
+	proxy := buildProxy(u.Backend, u.Version, u.RoundTripper, u.Config, dependencyProxyInjector)
 	cableProxy := proxypkg.NewProxy(u.CableBackend, u.Version, u.CableRoundTripper)
 
 	signingTripper := secret.NewRoundTripper(u.RoundTripper, u.Version)
-	signingProxy := buildProxy(u.Backend, u.Version, signingTripper)
+	signingProxy := buildProxy(u.Backend, u.Version, signingTripper, u.Config, dependencyProxyInjector)
+	dependencyProxyInjector.SetUploadHandler(filestore.BodyUploader(api, signingProxy, nil))
 
 	uploadPath := path.Join(u.DocumentRoot, "uploads/tmp")
 	uploadAccelerateProxy := upload.Accelerate(&upload.SkipRailsAuthorizer{TempPath: uploadPath}, proxy)
 	ciAPIProxyQueue := queueing.QueueRequests("ci_api_job_requests", uploadAccelerateProxy, u.APILimit, u.APIQueueLimit, u.APIQueueTimeout)
-	ciAPILongPolling := builds.RegisterHandler(ciAPIProxyQueue, redis.WatchKey, u.APICILongPollingDuration)
+	ciAPILongPolling := builds.RegisterHandler(ciAPIProxyQueue, u.keyWatcher(), u.APICILongPollingDuration)
+	gitLimiter := limiter.New("git")
 
 	// Serve static files or forward the requests
 	defaultUpstream := static.ServeExisting(
 		u.URLPrefix,
 		staticpages.CacheDisabled,
-		static.DeployPage(static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatHTML, uploadAccelerateProxy)),
+		static.DeployPage(static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatNegotiate, uploadAccelerateProxy)),
 	)
+	apiProxy := static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatAPI, proxy)
+	gitErrorPages := func(h http.Handler) http.Handler {
+		return static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatAPI, h)
+	}
 	probeUpstream := static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatJSON, proxy)
 	healthUpstream := static.ErrorPagesUnless(u.DevelopmentMode, staticpages.ErrorFormatText, proxy)
 
 	u.Routes = []routeEntry{
 		// Git Clone
-		route("GET", gitProjectPattern+`info/refs\z`, git.GetInfoRefsHandler(api)),
-		route("POST", gitProjectPattern+`git-upload-pack\z`, contentEncodingHandler(git.UploadPack(api)), withMatcher(isContentType("application/x-git-upload-pack-request"))),
-		route("POST", gitProjectPattern+`git-receive-pack\z`, contentEncodingHandler(git.ReceivePack(api)), withMatcher(isContentType("application/x-git-receive-pack-request"))),
-		route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, lfs.PutStore(api, signingProxy), withMatcher(isContentType("application/octet-stream"))),
+		route("GET", gitProjectPattern+`info/refs\z`, gitErrorPages(git.GetInfoRefsHandler(api, u.Git)), withClass(routeClassGit), withHighPriority()),
+		route("POST", gitProjectPattern+`git-upload-pack\z`, gitErrorPages(contentEncodingHandler(git.UploadPack(api, u.Git, gitLimiter))), withMatcher(isContentType("application/x-git-upload-pack-request")), withClass(routeClassGit), withHighPriority()),
+		route("POST", gitProjectPattern+`git-receive-pack\z`, gitErrorPages(contentEncodingHandler(git.ReceivePack(api, u.Git, gitLimiter))), withMatcher(isContentType("application/x-git-receive-pack-request")), withClass(routeClassGit)),
+		route("POST", gitProjectPattern+`git-upload-archive\z`, gitErrorPages(contentEncodingHandler(git.UploadArchive(api, u.Git))), withMatcher(isContentType("application/x-git-upload-archive-request")), withClass(routeClassGit), withHighPriority()),
+		route("PUT", gitProjectPattern+`gitlab-lfs/objects/([0-9a-f]{64})/([0-9]+)\z`, gitErrorPages(lfs.PutStore(api, signingProxy)), withMatcher(isContentType("application/octet-stream")), withClass(routeClassGit), withUploadType(filestore.UploadTypeLFS)),
 
 		// CI Artifacts
-		route("POST", apiPattern+`v4/jobs/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, signingProxy))),
-		route("POST", ciAPIPattern+`v1/builds/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, signingProxy))),
+		route("POST", apiPattern+`v4/jobs/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, signingProxy)), withClass(routeClassUploads), withTraffic(trafficArtifacts), withUploadType(filestore.UploadTypeArtifacts)),
+		route("POST", ciAPIPattern+`v1/builds/[0-9]+/artifacts\z`, contentEncodingHandler(artifacts.UploadArtifacts(api, signingProxy)), withClass(routeClassUploads), withTraffic(trafficArtifacts), withUploadType(filestore.UploadTypeArtifacts)),
+
+		// Static site previews of artifacts
+		route("GET", projectPattern+`-/jobs/[0-9]+/artifacts/preview/`, artifacts.SiteHandler(proxy)),
 
 		// ActionCable websocket
-		wsRoute(`^/-/cable\z`, cableProxy),
+		wsRoute(`^/-/cable\z`, cable.Handler(cableProxy, u.Cable)),
 
 		// Terminal websocket
-		wsRoute(projectPattern+`-/environments/[0-9]+/terminal.ws\z`, channel.Handler(api)),
-		wsRoute(projectPattern+`-/jobs/[0-9]+/terminal.ws\z`, channel.Handler(api)),
+		wsRoute(projectPattern+`-/environments/[0-9]+/terminal.ws\z`, channel.Handler(api, u.Channel)),
+		wsRoute(projectPattern+`-/jobs/[0-9]+/terminal.ws\z`, channel.Handler(api, u.Channel)),
+
+		// Live trace of running jobs
+		route("GET", projectPattern+`-/jobs/[0-9]+/trace/stream\z`, builds.TraceStreamHandler(proxy, u.keyWatcher())),
 
 		// Proxy Job Services
-		wsRoute(projectPattern+`-/jobs/[0-9]+/proxy.ws\z`, channel.Handler(api)),
+		wsRoute(projectPattern+`-/jobs/[0-9]+/proxy.ws\z`, channel.Handler(api, u.Channel)),
 
 		// Long poll and limit capacity given to jobs/request and builds/register.json
-		route("", apiPattern+`v4/jobs/request\z`, ciAPILongPolling),
-		route("", ciAPIPattern+`v1/builds/register.json\z`, ciAPILongPolling),
+		route("", apiPattern+`v4/jobs/request\z`, ciAPILongPolling, withClass(routeClassAPI)),
+		route("", ciAPIPattern+`v1/builds/register.json\z`, ciAPILongPolling, withClass(routeClassAPI)),
+
+		// Collect the trace appends of running jobs into larger batches
+		route("PATCH", apiPattern+`v4/jobs/[0-9]+/trace\z`, builds.TraceHandler(apiProxy), withClass(routeClassAPI)),
+		route("PUT", apiPattern+`v4/jobs/[0-9]+\z`, builds.JobUpdateHandler(apiProxy), withClass(routeClassAPI)),
 
 		// Maven Artifact Repository
-		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/maven/`, filestore.BodyUploader(api, signingProxy, nil)),
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/maven/`, filestore.BodyUploader(api, signingProxy, nil), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
 
 		// Conan Artifact Repository
-		route("PUT", apiPattern+`v4/packages/conan/`, filestore.BodyUploader(api, signingProxy, nil)),
+		route("PUT", apiPattern+`v4/packages/conan/`, filestore.BodyUploader(api, signingProxy, nil), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
 
 		// NuGet Artifact Repository
-		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/nuget/`, upload.Accelerate(api, signingProxy)),
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/nuget/`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
 
 		// PyPI Artifact Repository
-		route("POST", apiPattern+`v4/projects/[0-9]+/packages/pypi`, upload.Accelerate(api, signingProxy)),
+		route("POST", apiPattern+`v4/projects/[0-9]+/packages/pypi`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
+
+		// Generic Packages Repository
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/generic/`, filestore.BodyUploader(api, signingProxy, nil), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
+
+		// Debian Artifact Repository
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/debian/`, filestore.BodyUploader(api, signingProxy, nil), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
+
+		// RubyGems Artifact Repository
+		route("POST", apiPattern+`v4/projects/[0-9]+/packages/rubygems/api/v1/gems\z`, filestore.BodyUploader(api, signingProxy, nil), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
+
+		// Terraform states and their locks
+		route("", apiPattern+`v4/projects/[^/]+/terraform/state/[^/]+(/lock)?\z`, terraform.Handler(api, apiProxy), withClass(routeClassAPI)),
+
+		// Terraform Module Registry
+		route("PUT", apiPattern+`v4/projects/[0-9]+/packages/terraform/modules/`, filestore.BodyUploader(api, signingProxy, nil), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
+
+		// Helm Chart Repository
+		route("POST", apiPattern+`v4/projects/[0-9]+/packages/helm/api/[^/]+/charts\z`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypePackages)),
 
 		// We are porting API to disk acceleration
 		// we need to declare each routes until we have fixed all the routes on the rails codebase.
 		// Overall status can be seen at https://gitlab.com/groups/gitlab-org/-/epics/1802#current-status
-		route("POST", apiPattern+`v4/projects/[0-9]+/wikis/attachments\z`, uploadAccelerateProxy),
-		route("POST", apiPattern+`graphql\z`, uploadAccelerateProxy),
-		route("POST", apiPattern+`v4/groups/import`, upload.Accelerate(api, signingProxy)),
-		route("POST", apiPattern+`v4/projects/import`, upload.Accelerate(api, signingProxy)),
+		route("POST", apiPattern+`v4/projects/[0-9]+/wikis/attachments\z`, uploadAccelerateProxy, withClass(routeClassUploads)),
+		route("POST", apiPattern+`graphql\z`, graphqlcache.Handler(uploadAccelerateProxy), withClass(routeClassAPI)),
+		route("POST", apiPattern+`v4/groups/import`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypeImports)),
+		route("POST", apiPattern+`v4/projects/import`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypeImports)),
 
 		// Project Import via UI upload acceleration
-		route("POST", importPattern+`gitlab_project`, upload.Accelerate(api, signingProxy)),
+		route("POST", importPattern+`gitlab_project`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypeImports)),
+
+		// Persisted GraphQL queries may also be sent as GET requests
+		route("GET", apiPattern+`graphql\z`, graphqlcache.Handler(apiProxy), withClass(routeClassAPI)),
 
 		// Explicitly proxy API requests
-		route("", apiPattern, proxy),
-		route("", ciAPIPattern, proxy),
+		route("", apiPattern, apiProxy, withClass(routeClassAPI)),
+		route("", ciAPIPattern, apiProxy, withClass(routeClassAPI)),
+
+		// Dependency proxy for container images. Rails sends the blobs and
+		// manifests it hasn't cached yet through Workhorse.
+		route("GET", dependencyProxyPattern, proxy),
 
 		// Serve assets
 		route(
@@ -242,12 +348,15 @@ func (u *upstream) configureRoutes() {
 				NotFoundUnless(u.DevelopmentMode, proxy),
 			),
 			withoutTracing(), // Tracing on assets is very noisy
+			withHighPriority(),
+			withTraffic(trafficStatic),
+			duringMaintenance(),
 		),
 
 		// Uploads
-		route("POST", projectPattern+`uploads\z`, upload.Accelerate(api, signingProxy)),
-		route("POST", snippetUploadPattern, upload.Accelerate(api, signingProxy)),
-		route("POST", userUploadPattern, upload.Accelerate(api, signingProxy)),
+		route("POST", projectPattern+`uploads\z`, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypeUploads)),
+		route("POST", snippetUploadPattern, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypeUploads)),
+		route("POST", userUploadPattern, upload.Accelerate(api, signingProxy), withClass(routeClassUploads), withUploadType(filestore.UploadTypeUploads)),
 
 		// For legacy reasons, user uploads are stored under the document root.
 		// To prevent anybody who knows/guesses the URL of a user-uploaded file
@@ -258,8 +367,10 @@ func (u *upstream) configureRoutes() {
 		// health checks don't intercept errors and go straight to rails
 		// TODO: We should probably not return a HTML deploy page?
 		//       https://gitlab.com/gitlab-org/gitlab-workhorse/issues/230
-		route("", "^/-/(readiness|liveness)$", static.DeployPage(probeUpstream)),
-		route("", "^/-/health$", static.DeployPage(healthUpstream)),
+		route("", "^/-/(readiness|liveness)$", static.DeployPage(probeUpstream), withHighPriority(), duringMaintenance()),
+		route("", "^/-/health$", static.DeployPage(healthUpstream), withHighPriority(), duringMaintenance()),
+
+		route("", `^/-/status\z`, status.Handler(), withoutTracing(), withHighPriority(), duringMaintenance()),
 
 		// This route lets us filter out health checks from our metrics.
 		route("", "^/-/", defaultUpstream),
@@ -0,0 +1,183 @@
+/*
+In this file we log the requests that are still in flight after a
+threshold, optionally with the stack of the goroutine handling them, to
+find out which Gitaly or object storage call they hang on.
+*/
+
+package upstream
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+const (
+	slowRequestsCheckInterval = time.Second
+	// The stacks of all goroutines are captured to find one of them, so
+	// bound the memory it can take
+	maxStackDumpSize = 64 << 20
+)
+
+type slowRequestsConfig struct {
+	threshold    time.Duration
+	captureStack bool
+}
+
+var (
+	slowRequests      slowRequestsConfig
+	slowRequestsMutex sync.RWMutex
+
+	slowRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: httpSubsystem,
+			Name:      "slow_requests",
+			Help:      "How many requests were still in flight after the slow request threshold, by route class",
+		},
+		[]string{"class"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(slowRequestsTotal)
+}
+
+// ConfigureSlowRequests sets when requests in flight are logged. Requests
+// started before keep their goroutine unknown until they finish.
+func ConfigureSlowRequests(cfg config.SlowRequestsConfig) error {
+	var s slowRequestsConfig
+	if cfg.Threshold != nil {
+		if cfg.Threshold.Duration <= 0 {
+			return fmt.Errorf("Threshold must be positive")
+		}
+		s.threshold = cfg.Threshold.Duration
+		s.captureStack = cfg.CaptureStack
+	}
+
+	slowRequestsMutex.Lock()
+	defer slowRequestsMutex.Unlock()
+	slowRequests = s
+
+	return nil
+}
+
+func slowRequestSettings() slowRequestsConfig {
+	slowRequestsMutex.RLock()
+	defer slowRequestsMutex.RUnlock()
+	return slowRequests
+}
+
+// WatchSlowRequests logs the requests in flight for longer than the
+// threshold, once each
+func WatchSlowRequests() {
+	for {
+		s := slowRequestSettings()
+
+		interval := slowRequestsCheckInterval
+		if s.threshold > 0 {
+			if s.threshold/2 < interval {
+				interval = s.threshold / 2
+			}
+			logSlowRequests(s)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+func logSlowRequests(s slowRequestsConfig) {
+	slow := takeSlowRequests(s.threshold)
+	if len(slow) == 0 {
+		return
+	}
+
+	var stacks []byte
+	if s.captureStack {
+		stacks = allStacks()
+	}
+
+	for _, req := range slow {
+		slowRequestsTotal.WithLabelValues(req.Class).Inc()
+
+		fields := log.Fields{
+			"method":         req.Method,
+			"uri":            req.Path,
+			"route_class":    req.Class,
+			"remote_addr":    req.RemoteAddr,
+			"correlation_id": req.CorrelationID,
+			"gl_id":          req.GLID,
+			"duration_s":     req.Duration.Seconds(),
+		}
+		if stack := goroutineStack(stacks, req.goroutine); stack != "" {
+			fields["stack"] = stack
+		}
+
+		log.WithFields(fields).Warn("slow request still in flight")
+	}
+}
+
+// takeSlowRequests returns the requests in flight for at least threshold
+// that were not logged yet, and marks them as logged
+func takeSlowRequests(threshold time.Duration) []InFlightRequest {
+	now := time.Now()
+
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+
+	var slow []InFlightRequest
+	for _, req := range inFlight {
+		if d := now.Sub(req.Started); !req.logged && d >= threshold {
+			req.logged = true
+			slow = append(slow, req.snapshot(d))
+		}
+	}
+
+	return slow
+}
+
+// currentGoroutine returns the ID of the calling goroutine, from the
+// header of its stack: "goroutine 42 [running]:"
+func currentGoroutine() string {
+	var buf [64]byte
+	stack := buf[:runtime.Stack(buf[:], false)]
+
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i > 0 {
+		return string(stack[:i])
+	}
+	return ""
+}
+
+func allStacks() []byte {
+	for size := 1 << 20; ; size *= 2 {
+		buf := make([]byte, size)
+		n := runtime.Stack(buf, true)
+		if n < size || size >= maxStackDumpSize {
+			return buf[:n]
+		}
+	}
+}
+
+// goroutineStack finds the stack of the goroutine with ID id in stacks,
+// the output of runtime.Stack for all goroutines
+func goroutineStack(stacks []byte, id string) string {
+	if id == "" {
+		return ""
+	}
+
+	header := []byte("goroutine " + id + " [")
+	for _, stack := range bytes.Split(stacks, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return string(stack)
+		}
+	}
+	return ""
+}
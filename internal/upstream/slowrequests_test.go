@@ -0,0 +1,69 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+func TestSlowRequests(t *testing.T) {
+	require.NoError(t, ConfigureSlowRequests(config.SlowRequestsConfig{
+		Threshold:    &config.TomlDuration{Duration: time.Millisecond},
+		CaptureStack: true,
+	}))
+	defer ConfigureSlowRequests(config.SlowRequestsConfig{})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer backend.Close()
+
+	ws := httptest.NewServer(NewUpstream(config.Config{Backend: helper.URLMustParse(backend.URL)}, logrus.StandardLogger()))
+	defer ws.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(ws.URL + "/api/v4/projects")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	time.Sleep(5 * time.Millisecond)
+
+	slow := takeSlowRequests(time.Millisecond)
+	require.Len(t, slow, 1)
+	require.Equal(t, "/api/v4/projects", slow[0].Path)
+	require.NotEmpty(t, slow[0].goroutine)
+
+	stack := goroutineStack(allStacks(), slow[0].goroutine)
+	require.Contains(t, stack, "upstream.(*upstream).ServeHTTP", "the stack of the goroutine handling the request")
+
+	require.Empty(t, takeSlowRequests(time.Millisecond), "slow requests are logged once")
+
+	close(release)
+	<-done
+}
+
+func TestConfigureSlowRequestsInvalid(t *testing.T) {
+	require.Error(t, ConfigureSlowRequests(config.SlowRequestsConfig{Threshold: &config.TomlDuration{}}))
+}
+
+func TestGoroutineStack(t *testing.T) {
+	stacks := []byte("goroutine 1 [running]:\nmain.main()\n\ngoroutine 12 [select]:\nfoo.bar()\n\ngoroutine 123 [IO wait]:\nbaz.qux()\n")
+
+	require.Equal(t, "goroutine 12 [select]:\nfoo.bar()", goroutineStack(stacks, "12"))
+	require.Empty(t, goroutineStack(stacks, "2"))
+	require.Empty(t, goroutineStack(stacks, ""))
+}
@@ -0,0 +1,141 @@
+/*
+In this file we measure the latency of each class of traffic, so that
+every class can get its own SLO instead of sharing one latency metric.
+*/
+
+package upstream
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type trafficClass string
+
+const (
+	trafficGit       trafficClass = "git"
+	trafficArtifacts trafficClass = "artifacts"
+	trafficUploads   trafficClass = "uploads"
+	trafficAPI       trafficClass = "api"
+	trafficStatic    trafficClass = "static"
+	trafficWeb       trafficClass = "web"
+)
+
+var (
+	trafficTimeToFirstByteSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: httpSubsystem,
+			Name:      "traffic_time_to_first_byte_seconds",
+			Help:      "A histogram of request durations until the response starts, by traffic class.",
+			Buckets:   secondsDurationBuckets(),
+		},
+		[]string{"class"},
+	)
+
+	trafficDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: httpSubsystem,
+			Name:      "traffic_duration_seconds",
+			Help:      "A histogram of request durations, by traffic class.",
+			Buckets:   secondsDurationBuckets(),
+		},
+		[]string{"class"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(trafficTimeToFirstByteSeconds)
+	prometheus.MustRegister(trafficDurationSeconds)
+}
+
+func withTraffic(traffic trafficClass) func(*routeOptions) {
+	return func(options *routeOptions) {
+		options.traffic = traffic
+	}
+}
+
+// defaultTraffic is the traffic class of routes that don't set one
+func defaultTraffic(class routeClass) trafficClass {
+	switch class {
+	case routeClassGit:
+		return trafficGit
+	case routeClassUploads:
+		return trafficUploads
+	case routeClassAPI:
+		return trafficAPI
+	}
+
+	return trafficWeb
+}
+
+// instrumentTraffic observes the time to first byte and the duration of
+// the requests of a traffic class
+func instrumentTraffic(next http.Handler, traffic trafficClass) http.Handler {
+	ttfb := trafficTimeToFirstByteSeconds.WithLabelValues(string(traffic))
+	duration := trafficDurationSeconds.WithLabelValues(string(traffic))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		tw := &ttfbResponseWriter{rw: w, observe: func() {
+			ttfb.Observe(time.Since(start).Seconds())
+		}}
+
+		if _, ok := w.(http.Hijacker); ok {
+			next.ServeHTTP(&hijackingTTFBResponseWriter{tw}, r)
+		} else {
+			next.ServeHTTP(tw, r)
+		}
+
+		duration.Observe(time.Since(start).Seconds())
+	})
+}
+
+// ttfbResponseWriter calls observe when the response starts
+type ttfbResponseWriter struct {
+	rw      http.ResponseWriter
+	observe func()
+	once    sync.Once
+}
+
+func (t *ttfbResponseWriter) Header() http.Header {
+	return t.rw.Header()
+}
+
+func (t *ttfbResponseWriter) Write(data []byte) (int, error) {
+	t.once.Do(t.observe)
+	return t.rw.Write(data)
+}
+
+func (t *ttfbResponseWriter) WriteHeader(status int) {
+	t.once.Do(t.observe)
+	t.rw.WriteHeader(status)
+}
+
+func (t *ttfbResponseWriter) Flush() {
+	t.once.Do(t.observe)
+	if f, ok := t.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap keeps flushes of the proxy and hijacks of ActionCable working
+// through the TTFB writer
+func (t *ttfbResponseWriter) Unwrap() http.ResponseWriter {
+	return t.rw
+}
+
+type hijackingTTFBResponseWriter struct {
+	*ttfbResponseWriter
+}
+
+func (h *hijackingTTFBResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.rw.(http.Hijacker).Hijack()
+}
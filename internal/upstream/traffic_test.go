@@ -0,0 +1,42 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func histogramSum(t *testing.T, vec *prometheus.HistogramVec, class trafficClass) (uint64, float64) {
+	var m dto.Metric
+	require.NoError(t, vec.WithLabelValues(string(class)).(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestInstrumentTraffic(t *testing.T) {
+	ttfbCount, ttfbSum := histogramSum(t, trafficTimeToFirstByteSeconds, trafficArtifacts)
+	durationCount, durationSum := histogramSum(t, trafficDurationSeconds, trafficArtifacts)
+
+	handler := instrumentTraffic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("body"))
+	}), trafficArtifacts)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	require.True(t, w.Flushed, "flushes must reach the underlying writer")
+
+	count, sum := histogramSum(t, trafficTimeToFirstByteSeconds, trafficArtifacts)
+	require.Equal(t, ttfbCount+1, count)
+	ttfb := sum - ttfbSum
+
+	count, sum = histogramSum(t, trafficDurationSeconds, trafficArtifacts)
+	require.Equal(t, durationCount+1, count)
+	require.True(t, sum-durationSum >= ttfb+0.05, "TTFB must not include the time spent on the body")
+}
@@ -8,16 +8,20 @@ package upstream
 
 import (
 	"fmt"
-
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/sirupsen/logrus"
-	"gitlab.com/gitlab-org/labkit/correlation"
 	"gitlab.com/gitlab-org/labkit/log"
 
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/correlationid"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upload"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream/roundtripper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/urlprefix"
@@ -36,6 +40,8 @@ type upstream struct {
 	Routes            []routeEntry
 	RoundTripper      http.RoundTripper
 	CableRoundTripper http.RoundTripper
+	breaker           *breaker
+	queues            map[routeClass]*queueing.Queue
 }
 
 func NewUpstream(cfg config.Config, accessLogger *logrus.Logger) http.Handler {
@@ -51,13 +57,24 @@ func NewUpstream(cfg config.Config, accessLogger *logrus.Logger) http.Handler {
 	if up.CableSocket == "" {
 		up.CableSocket = up.Socket
 	}
-	up.RoundTripper = roundtripper.NewBackendRoundTripper(up.Backend, up.Socket, up.ProxyHeadersTimeout, cfg.DevelopmentMode)
-	up.CableRoundTripper = roundtripper.NewBackendRoundTripper(up.CableBackend, up.CableSocket, up.ProxyHeadersTimeout, cfg.DevelopmentMode)
+	if len(up.BackendTargets) > 1 {
+		up.RoundTripper = roundtripper.NewBalancedRoundTripper(up.BackendTargets, up.ProxyHeadersTimeout, cfg.DevelopmentMode, cfg.BackendH2C, cfg.BackendHealthCheck)
+	} else {
+		up.RoundTripper = roundtripper.NewBackendRoundTripper(up.Backend, up.Socket, up.ProxyHeadersTimeout, cfg.DevelopmentMode, cfg.BackendH2C)
+	}
+	if up.breaker = newBreaker(cfg.BackendBreaker); up.breaker != nil {
+		up.RoundTripper = up.breaker.roundTripper(up.RoundTripper)
+		status.Register("backend_breaker", up.breaker.status)
+	}
+	// ActionCable needs websockets, which don't work over HTTP/2
+	up.CableRoundTripper = roundtripper.NewBackendRoundTripper(up.CableBackend, up.CableSocket, up.ProxyHeadersTimeout, cfg.DevelopmentMode, false)
 	up.configureURLPrefix()
+	up.configureQueues()
 	up.configureRoutes()
 
-	handler := log.AccessLogger(&up, log.WithAccessLogger(accessLogger))
-	handler = correlation.InjectCorrelationID(handler)
+	handler := log.AccessLogger(recoverPanics(&up), log.WithAccessLogger(accessLogger), log.WithExtraFields(countryLogFields))
+	handler = withResponseController(handler)
+	handler = correlationid.Inject(handler)
 	return handler
 }
 
@@ -94,6 +111,23 @@ func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w = headers.ApplyPolicy(w, r, prefix.Strip(URIPath))
+
+	if rule, retryAfter, ok := queueing.AllowRateLimit(r, prefix.Strip(URIPath)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, fmt.Sprintf("Rate limit %q exceeded", rule), http.StatusTooManyRequests)
+		return
+	}
+
+	if retryAfter, challenge, ok := queueing.AllowClone(r, prefix.Strip(URIPath)); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		if challenge != "" {
+			w.Header().Set(queueing.ChallengeHeader, challenge)
+		}
+		http.Error(w, "Too many clones from your network", http.StatusTooManyRequests)
+		return
+	}
+
 	// Look for a matching route
 	var route *routeEntry
 	for _, ro := range u.Routes {
@@ -110,9 +144,47 @@ func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	r = helper.WithRouteClass(r, string(route.class))
+	countCountry(r, route.class)
+
+	if rule, ok := allowIP(r, route.class, prefix.Strip(URIPath)); !ok {
+		helper.HTTPError(w, r, fmt.Sprintf("Forbidden by IP rule %q", rule), http.StatusForbidden)
+		return
+	}
+
+	if InMaintenance() && !route.duringMaintenance {
+		refuseDuringMaintenance(w)
+		return
+	}
+
+	if !route.highPriority {
+		retryAfter, probe, ok := u.breaker.allow()
+		if !ok {
+			shedRequest(w, route.class, retryAfter)
+			return
+		}
+		if probe {
+			r = withBreakerProbe(r)
+		}
+	}
+
+	if limits, ok := u.routeLimits(route.class); ok {
+		release, ok := limitRequest(w, r, route.class, limits)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
 	for _, h := range requestHeaderBlacklist {
 		r.Header.Del(h)
 	}
 
+	r = helper.WithGLID(r)
+	defer trackRequest(r, route.class)()
+	if queue := u.queues[route.class]; queue != nil {
+		queue.Handle(w, r, route.handler)
+		return
+	}
 	route.handler.ServeHTTP(w, r)
 }
@@ -1,6 +1,7 @@
 package zipartifacts
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
 	"encoding/binary"
@@ -9,6 +10,7 @@ import (
 	"path"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 type metadata struct {
@@ -48,19 +50,54 @@ func (m metadata) writeEncoded(output io.Writer) error {
 	return writeBytes(output, j)
 }
 
-func writeZipEntryMetadata(output io.Writer, path string, entry *zip.File) error {
-	if err := writeString(output, path); err != nil {
-		return err
+func newTarMetadata(header *tar.Header) metadata {
+	return metadata{
+		Modified: header.ModTime.Unix(),
+		Mode:     strconv.FormatUint(uint64(header.FileInfo().Mode().Perm()), 8),
+		Size:     uint64(header.Size),
 	}
+}
 
-	if err := newMetadata(entry).writeEncoded(output); err != nil {
-		return err
+func GenerateZipMetadata(w io.Writer, archive *zip.Reader) error {
+	entries := make(map[string]*metadata, len(archive.File))
+	for _, entry := range archive.File {
+		m := newMetadata(entry)
+		entries[entry.Name] = &m
 	}
 
-	return nil
+	return writeMetadata(w, entries)
 }
 
-func GenerateZipMetadata(w io.Writer, archive *zip.Reader) error {
+// GenerateTarMetadata writes the metadata of a tar archive, like the ones
+// of zstd compressed artifacts, in the format of GenerateZipMetadata.
+// Entries have no CRC and no compressed size. If archive is not a tar
+// archive the error will be ErrNotAZip, and nothing is written.
+func GenerateTarMetadata(w io.Writer, archive *tar.Reader) error {
+	entries := make(map[string]*metadata)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == tar.ErrHeader && len(entries) == 0 {
+			return ErrNotAZip
+		}
+		if err != nil {
+			return err
+		}
+
+		name := header.Name
+		if header.Typeflag == tar.TypeDir && !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+		m := newTarMetadata(header)
+		entries[name] = &m
+	}
+
+	return writeMetadata(w, entries)
+}
+
+func writeMetadata(w io.Writer, entries map[string]*metadata) error {
 	output := gzip.NewWriter(w)
 	defer output.Close()
 
@@ -73,37 +110,47 @@ func GenerateZipMetadata(w io.Writer, archive *zip.Reader) error {
 		return err
 	}
 
-	// Create map of files in zip archive
-	zipMap := make(map[string]*zip.File, len(archive.File))
-
 	// Add missing entries
-	for _, entry := range archive.File {
-		zipMap[entry.Name] = entry
-
-		for d := path.Dir(entry.Name); d != "." && d != "/"; d = path.Dir(d) {
+	for name := range entries {
+		for d := path.Dir(name); d != "." && d != "/"; d = path.Dir(d) {
 			entryDir := d + "/"
-			if _, ok := zipMap[entryDir]; !ok {
-				zipMap[entryDir] = nil
+			if _, ok := entries[entryDir]; !ok {
+				entries[entryDir] = nil
 			}
 		}
 	}
 
 	// Sort paths
-	sortedPaths := make([]string, 0, len(zipMap))
-	for path := range zipMap {
+	sortedPaths := make([]string, 0, len(entries))
+	for path := range entries {
 		sortedPaths = append(sortedPaths, path)
 	}
 	sort.Strings(sortedPaths)
 
 	// Write all files
 	for _, path := range sortedPaths {
-		if err := writeZipEntryMetadata(output, path, zipMap[path]); err != nil {
+		if err := writeEntryMetadata(output, path, entries[path]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func writeEntryMetadata(output io.Writer, path string, entry *metadata) error {
+	if err := writeString(output, path); err != nil {
+		return err
+	}
+
+	if entry == nil {
+		entry = &metadata{}
+	}
+	if err := entry.writeEncoded(output); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func writeBytes(output io.Writer, data []byte) error {
 	err := binary.Write(output, binary.BigEndian, uint32(len(data)))
 	if err == nil {
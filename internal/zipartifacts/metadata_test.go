@@ -1,6 +1,7 @@
 package zipartifacts_test
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
@@ -102,3 +103,37 @@ func TestErrNotAZip(t *testing.T) {
 	_, err = zipartifacts.OpenArchive(ctx, f.Name())
 	assert.Equal(t, zipartifacts.ErrNotAZip, err, "OpenArchive requires a zip file")
 }
+
+func generateTestTarArchive(w io.Writer) error {
+	archive := tar.NewWriter(w)
+
+	// Directories of tar archives may come without a trailing slash
+	if err := archive.WriteHeader(&tar.Header{Name: "some/file/dir", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		return err
+	}
+
+	for _, file := range []string{"file1", "some/file/dir/file2"} {
+		if err := archive.WriteHeader(&tar.Header{Name: file, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file))}); err != nil {
+			return err
+		}
+		fmt.Fprint(archive, file)
+	}
+
+	return archive.Close()
+}
+
+func TestGenerateTarMetadata(t *testing.T) {
+	var archive, metaBuffer bytes.Buffer
+	require.NoError(t, generateTestTarArchive(&archive))
+
+	require.NoError(t, zipartifacts.GenerateTarMetadata(&metaBuffer, tar.NewReader(&archive)))
+	require.NoError(t, validateMetadata(&metaBuffer))
+}
+
+func TestGenerateTarMetadataNotATar(t *testing.T) {
+	var metaBuffer bytes.Buffer
+	err := zipartifacts.GenerateTarMetadata(&metaBuffer, tar.NewReader(bytes.NewReader(bytes.Repeat([]byte("not a tar"), 100))))
+
+	require.Equal(t, zipartifacts.ErrNotAZip, err)
+	require.Zero(t, metaBuffer.Len())
+}
@@ -0,0 +1,100 @@
+package zipartifacts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+
+	"gitlab.com/gitlab-org/labkit/mask"
+)
+
+// zstdMagic starts every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdCommand decompresses the archives. Go has no zstd decoder in its
+// standard library.
+const zstdCommand = "zstd"
+
+type zstdArchive struct {
+	io.ReadCloser
+	source io.Closer
+	cmd    *exec.Cmd
+}
+
+// Close waits for the decompression to end, and fails if it went wrong.
+// Closing the output first stops zstd if the archive wasn't read to the
+// end.
+func (a *zstdArchive) Close() error {
+	a.ReadCloser.Close()
+	err := a.cmd.Wait()
+	a.source.Close()
+	return err
+}
+
+// OpenZstdArchive opens a zstd compressed tar archive from a local path or
+// a remote object store URL, and returns the tar stream. If the path does
+// not exist the error will be ErrArchiveNotFound, if the file isn't
+// compressed with zstd the error will be ErrNotAZip.
+func OpenZstdArchive(ctx context.Context, archivePath string) (io.ReadCloser, error) {
+	source, err := openStream(ctx, archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := bufio.NewReader(source)
+	if magic, err := compressed.Peek(len(zstdMagic)); err != nil || !bytes.Equal(magic, zstdMagic) {
+		source.Close()
+		return nil, ErrNotAZip
+	}
+
+	cmd := exec.CommandContext(ctx, zstdCommand, "--decompress", "--stdout", "--quiet")
+	cmd.Stdin = compressed
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		source.Close()
+		return nil, fmt.Errorf("start %s: %v", zstdCommand, err)
+	}
+
+	return &zstdArchive{ReadCloser: stdout, source: source, cmd: cmd}, nil
+}
+
+// openStream opens archivePath to be read once from start to end
+func openStream(ctx context.Context, archivePath string) (io.ReadCloser, error) {
+	if !isURL(archivePath) {
+		file, err := os.Open(archivePath)
+		if os.IsNotExist(err) {
+			return nil, ErrArchiveNotFound
+		}
+		return file, err
+	}
+
+	scrubbedArchivePath := mask.URL(archivePath)
+	req, err := http.NewRequest(http.MethodGet, archivePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET %q: %v", scrubbedArchivePath, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ErrArchiveNotFound
+		}
+		return nil, fmt.Errorf("HTTP GET %q: %d: %v", scrubbedArchivePath, resp.StatusCode, resp.Status)
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,75 @@
+package zipartifacts_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/zipartifacts"
+)
+
+func requireZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd is not installed")
+	}
+}
+
+func createZstdArchive(t *testing.T) string {
+	var archive bytes.Buffer
+	require.NoError(t, generateTestTarArchive(&archive))
+
+	cmd := exec.Command("zstd", "--stdout", "--quiet")
+	cmd.Stdin = &archive
+	compressed, err := cmd.Output()
+	require.NoError(t, err)
+
+	f, err := ioutil.TempFile("", "workhorse-metadata.tar.zst-")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.Write(compressed)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestOpenZstdArchive(t *testing.T) {
+	requireZstd(t)
+
+	archivePath := createZstdArchive(t)
+	defer os.Remove(archivePath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	archive, err := zipartifacts.OpenZstdArchive(ctx, archivePath)
+	require.NoError(t, err)
+
+	var metaBuffer bytes.Buffer
+	require.NoError(t, zipartifacts.GenerateTarMetadata(&metaBuffer, tar.NewReader(archive)))
+	require.NoError(t, archive.Close())
+	require.NoError(t, validateMetadata(&metaBuffer))
+}
+
+func TestOpenZstdArchiveErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err := zipartifacts.OpenZstdArchive(ctx, "/path/to/nowhere.tar.zst")
+	require.Equal(t, zipartifacts.ErrArchiveNotFound, err)
+
+	f, err := ioutil.TempFile("", "workhorse-metadata.tar.zst-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.WriteString("Not compressed with zstd")
+	require.NoError(t, err)
+
+	_, err = zipartifacts.OpenZstdArchive(ctx, f.Name())
+	require.Equal(t, zipartifacts.ErrNotAZip, err)
+}
@@ -9,6 +9,9 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	logkit "gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/accesslog"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 )
 
 const (
@@ -77,3 +80,28 @@ func getAccessLogger(config logConfiguration) (*log.Logger, io.Closer, error) {
 
 	return accessLogger, closer, err
 }
+
+// filterAccessLogger applies the [access_log] sampling rules. Other logs
+// may share the standard logger, so access logs get their own copy of it.
+func filterAccessLogger(accessLogger *log.Logger, cfg config.AccessLogConfig) (*log.Logger, error) {
+	if len(cfg.Rules) == 0 && cfg.SampleRate == nil {
+		return accessLogger, nil
+	}
+
+	if accessLogger == log.StandardLogger() {
+		std := accessLogger
+		accessLogger = log.New()
+		accessLogger.Out = std.Out
+		accessLogger.Formatter = std.Formatter
+		accessLogger.Hooks = std.Hooks
+		accessLogger.SetLevel(std.GetLevel())
+	}
+
+	formatter, err := accesslog.NewFilter(cfg, accessLogger.Formatter)
+	if err != nil {
+		return nil, err
+	}
+	accessLogger.Formatter = formatter
+
+	return accessLogger, nil
+}
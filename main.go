@@ -14,24 +14,44 @@ In this file we start the web server and hand off to the upstream type.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gitlab.com/gitlab-org/labkit/log"
 	"gitlab.com/gitlab-org/labkit/monitoring"
 	"gitlab.com/gitlab-org/labkit/tracing"
 
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/admin"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/builds"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/correlationid"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/featureflags"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/geoip"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/listener"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/nats"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/otlp"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/profiling"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/terraform"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream/roundtripper"
 )
 
 // Version is the current version of GitLab Workhorse
@@ -41,15 +61,20 @@ var BuildTime = "19700101.000000" // Set at build time in the Makefile
 
 var printVersion = flag.Bool("version", false, "Print version and exit")
 var configFile = flag.String("config", "", "TOML file to load config from")
+var validateConfigFlag = flag.Bool("validate-config", false, "Check the config file and exit, non-zero if it is invalid")
+var validateOnline = flag.Bool("online", false, "With -validate-config, also check that Redis and NATS can be reached")
 var listenAddr = flag.String("listenAddr", "localhost:8181", "Listen address for HTTP server")
-var listenNetwork = flag.String("listenNetwork", "tcp", "Listen 'network' (tcp, tcp4, tcp6, unix)")
+var listenNetwork = flag.String("listenNetwork", "tcp", "Listen 'network' (tcp, tcp4, tcp6, unix, systemd)")
 var listenUmask = flag.Int("listenUmask", 0, "Umask for Unix socket")
-var authBackend = flag.String("authBackend", upstream.DefaultBackend.String(), "Authentication/authorization backend")
+var listenProxyProtocol = flag.Bool("listenProxyProtocol", false, "Expect a PROXY protocol header on every connection to the listener")
+var authBackend = flag.String("authBackend", upstream.DefaultBackend.String(), "Authentication/authorization backend. Several backends can be given as a comma separated list of URL[=weight].")
 var authSocket = flag.String("authSocket", "", "Optional: Unix domain socket to dial authBackend at")
+var authBackendH2C = flag.Bool("authBackendH2C", false, "Talk HTTP/2 without TLS (h2c) to authBackend")
 var cableBackend = flag.String("cableBackend", upstream.DefaultBackend.String(), "ActionCable backend")
 var cableSocket = flag.String("cableSocket", "", "Optional: Unix domain socket to dial cableBackend at")
 var pprofListenAddr = flag.String("pprofListenAddr", "", "pprof listening address, e.g. 'localhost:6060'")
 var documentRoot = flag.String("documentRoot", "public", "Path to static files content")
+var errorPagesDir = flag.String("errorPagesDir", "", "Path to custom error pages (default documentRoot)")
 var proxyHeadersTimeout = flag.Duration("proxyHeadersTimeout", 5*time.Minute, "How long to wait for response headers when proxying the request")
 var developmentMode = flag.Bool("developmentMode", false, "Allow the assets to be served from Rails app")
 var secretPath = flag.String("secretPath", "./.gitlab_workhorse_secret", "File with secret key to authenticate with authBackend")
@@ -58,6 +83,9 @@ var apiQueueLimit = flag.Uint("apiQueueLimit", 0, "Number of API requests allowe
 var apiQueueTimeout = flag.Duration("apiQueueDuration", queueing.DefaultTimeout, "Maximum queueing duration of requests")
 var apiCiLongPollingDuration = flag.Duration("apiCiLongPollingDuration", 50, "Long polling duration for job requesting for runners (default 50s - enabled)")
 
+var upgradeTimeout = flag.Duration("upgradeTimeout", time.Minute, "How long to wait for the new process to start on a graceful upgrade (SIGUSR2)")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 10*time.Minute, "How long to wait for requests in flight after handing over to a new process")
+
 var prometheusListenAddr = flag.String("prometheusListenAddr", "", "Prometheus listening address, e.g. 'localhost:9229'")
 
 var logConfig = logConfiguration{}
@@ -80,18 +108,32 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *validateConfigFlag {
+		os.Exit(runValidateConfig(os.Stderr, *configFile, *apiLimit, *validateOnline))
+	}
+
 	closer, err := startLogging(logConfig)
 	if err != nil {
 		log.WithError(err).Fatal("Unable to configure logger")
 	}
 	defer closer.Close()
 
-	tracing.Initialize(tracing.WithServiceName("gitlab-workhorse"))
+	tracingCloser, otlpSelected, err := otlp.Initialize(os.Getenv("GITLAB_TRACING"), "gitlab-workhorse")
+	if err != nil {
+		log.WithError(err).Fatal("Invalid OTLP tracing configuration")
+	}
+	if !otlpSelected {
+		tracingCloser = tracing.Initialize(tracing.WithServiceName("gitlab-workhorse"))
+	}
+	defer tracingCloser.Close()
 
-	backendURL, err := parseAuthBackend(*authBackend)
+	backendTargets, err := parseAuthBackends(*authBackend)
 	if err != nil {
 		log.WithError(err).Fatal("Invalid authBackend")
 	}
+	if len(backendTargets) > 1 && *authSocket != "" {
+		log.WithField("authSocket", *authSocket).Fatal("authSocket can't be used with several authBackend URLs")
+	}
 
 	cableBackendURL, err := parseAuthBackend(*cableBackend)
 	if err != nil {
@@ -100,42 +142,37 @@ func main() {
 
 	log.WithField("version", Version).WithField("build_time", BuildTime).Print("Starting")
 
-	// Good housekeeping for Unix sockets: unlink before binding
-	if *listenNetwork == "unix" {
-		if err := os.Remove(*listenAddr); err != nil && !os.IsNotExist(err) {
-			log.WithError(err).Fatal("Failed to remove socket")
-		}
-	}
-
-	// Change the umask only around net.Listen()
-	oldUmask := syscall.Umask(*listenUmask)
-	listener, err := net.Listen(*listenNetwork, *listenAddr)
-	syscall.Umask(oldUmask)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to listen")
-	}
-
 	// The profiler will only be activated by HTTP requests. HTTP
 	// requests can only reach the profiler if we start a listener. So by
 	// having no profiler HTTP listener by default, the profiler is
 	// effectively disabled by default.
+	//
+	// The pprof and Prometheus listeners are opened through the listener
+	// package so they are handed over on a graceful upgrade too.
 	if *pprofListenAddr != "" {
 		go func() {
-			err := http.ListenAndServe(*pprofListenAddr, nil)
+			l, err := listener.New(config.ListenerConfig{Addr: *pprofListenAddr})
+			if err == nil {
+				err = http.Serve(l, nil)
+			}
 			if err != nil {
 				log.WithError(err).Error("Failed to start pprof listener")
 			}
 		}()
 	}
 
-	monitoringOpts := []monitoring.Option{monitoring.WithBuildInformation(Version, BuildTime)}
-
+	// The Prometheus listener is served once the profiling configuration
+	// is known, labkit would serve pprof on it without authentication
+	var prometheusListener net.Listener
 	if *prometheusListenAddr != "" {
-		monitoringOpts = append(monitoringOpts, monitoring.WithListenerAddress(*prometheusListenAddr))
+		prometheusListener, err = listener.New(config.ListenerConfig{Addr: *prometheusListenAddr})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to start Prometheus listener")
+		}
 	}
 
 	go func() {
-		err := monitoring.Start(monitoringOpts...)
+		err := monitoring.Start(monitoring.WithBuildInformation(Version, BuildTime))
 		if err != nil {
 			log.WithError(err).Error("Failed to start monitoring")
 		}
@@ -143,12 +180,15 @@ func main() {
 
 	secret.SetPath(*secretPath)
 	cfg := config.Config{
-		Backend:                  backendURL,
+		Backend:                  backendTargets[0].URL,
+		BackendTargets:           backendTargets,
 		CableBackend:             cableBackendURL,
 		Socket:                   *authSocket,
+		BackendH2C:               *authBackendH2C,
 		CableSocket:              *cableSocket,
 		Version:                  Version,
 		DocumentRoot:             *documentRoot,
+		ErrorPagesDir:            *errorPagesDir,
 		DevelopmentMode:          *developmentMode,
 		ProxyHeadersTimeout:      *proxyHeadersTimeout,
 		APILimit:                 *apiLimit,
@@ -164,11 +204,170 @@ func main() {
 		}
 
 		cfg.Redis = cfgFromFile.Redis
+		cfg.NATS = cfgFromFile.NATS
+		cfg.CIPollInterval = cfgFromFile.CIPollInterval
+		cfg.CIJobRequestCache = cfgFromFile.CIJobRequestCache
+		cfg.CITraceBuffer = cfgFromFile.CITraceBuffer
+		cfg.CITraceStream = cfgFromFile.CITraceStream
+		cfg.Archive = cfgFromFile.Archive
+		cfg.Git = cfgFromFile.Git
+		cfg.Gitaly = cfgFromFile.Gitaly
+		cfg.BackendTLS = cfgFromFile.BackendTLS
+		cfg.BackendTransport = cfgFromFile.BackendTransport
+		cfg.BackendHealthCheck = cfgFromFile.BackendHealthCheck
+		cfg.BackendAffinity = cfgFromFile.BackendAffinity
+		cfg.PreAuthorizeRetry = cfgFromFile.PreAuthorizeRetry
+		cfg.BackendBreaker = cfgFromFile.BackendBreaker
+		cfg.Correlation = cfgFromFile.Correlation
+		cfg.Profiling = cfgFromFile.Profiling
+		cfg.Status = cfgFromFile.Status
+		cfg.ErrorReporting = cfgFromFile.ErrorReporting
+		cfg.Signing = cfgFromFile.Signing
+		cfg.Secrets = cfgFromFile.Secrets
+		cfg.RateLimits = cfgFromFile.RateLimits
+		cfg.TrustedCIDRsForXForwardedFor = cfgFromFile.TrustedCIDRsForXForwardedFor
+		cfg.LogLevel = cfgFromFile.LogLevel
+		cfg.ObjectStorage = cfgFromFile.ObjectStorage
+		cfg.UploadRoutes = cfgFromFile.UploadRoutes
+		cfg.Listeners = cfgFromFile.Listeners
+		cfg.AccessLog = cfgFromFile.AccessLog
+		cfg.Headers = cfgFromFile.Headers
+		cfg.RouteLimits = cfgFromFile.RouteLimits
+		cfg.AssetCache = cfgFromFile.AssetCache
+		cfg.Channel = cfgFromFile.Channel
+		cfg.Cable = cfgFromFile.Cable
+		cfg.Timeouts = cfgFromFile.Timeouts
+		cfg.FeatureFlags = cfgFromFile.FeatureFlags
+		cfg.Admin = cfgFromFile.Admin
+		cfg.Queues = cfgFromFile.Queues
+		cfg.SlowRequests = cfgFromFile.SlowRequests
+		cfg.UploadJanitor = cfgFromFile.UploadJanitor
+		cfg.GraphQLCache = cfgFromFile.GraphQLCache
+		cfg.Compression = cfgFromFile.Compression
+		cfg.CloneFlood = cfgFromFile.CloneFlood
+		cfg.IPRules = cfgFromFile.IPRules
+		cfg.GeoIP = cfgFromFile.GeoIP
+		cfg.CrossOrigin = cfgFromFile.CrossOrigin
+		cfg.TerraformState = cfgFromFile.TerraformState
+
+		applyTimeouts(&cfg, cfg.Timeouts)
+	}
+
+	if err := config.ConfigureSecrets(cfg.Secrets); err != nil {
+		log.WithError(err).Fatal("Invalid secrets configuration")
+	}
+	if err := config.ResolveSecrets(cfg, *secretPath); err != nil {
+		log.WithError(err).Fatal("Unable to fetch secrets")
+	}
+	go config.RefreshSecrets()
+
+	if cfg.Redis != nil {
+		redis.Configure(cfg.Redis, redis.DefaultDialFunc)
+		go redis.Process()
+	}
+
+	if cfg.NATS != nil {
+		if err := nats.Configure(cfg.NATS); err != nil {
+			log.WithError(err).Fatal("Invalid NATS configuration")
+		}
+		go nats.Process()
+	}
+
+	if err := builds.ConfigurePollIntervals(cfg.CIPollInterval, cfg.APILimit); err != nil {
+		log.WithError(err).Fatal("Invalid CI poll interval configuration")
+	}
+
+	if err := builds.ConfigureJobRequestCache(cfg.CIJobRequestCache); err != nil {
+		log.WithError(err).Fatal("Invalid CI job request cache configuration")
+	}
+
+	if err := builds.ConfigureTraceBuffer(cfg.CITraceBuffer, cfg.Redis); err != nil {
+		log.WithError(err).Fatal("Invalid CI trace buffer configuration")
+	}
+
+	if err := builds.ConfigureTraceStream(cfg.CITraceStream); err != nil {
+		log.WithError(err).Fatal("Invalid CI trace stream configuration")
+	}
+
+	if err := terraform.Configure(cfg.TerraformState, cfg.Redis); err != nil {
+		log.WithError(err).Fatal("Invalid Terraform state configuration")
+	}
+
+	if err := roundtripper.ConfigureTLS(cfg.BackendTLS); err != nil {
+		log.WithError(err).Fatal("Invalid backend TLS configuration")
+	}
+
+	if err := roundtripper.ConfigureTransport(cfg.BackendTransport); err != nil {
+		log.WithError(err).Fatal("Invalid backend transport configuration")
+	}
+
+	if err := roundtripper.ConfigureAffinity(cfg.BackendAffinity); err != nil {
+		log.WithError(err).Fatal("Invalid backend affinity configuration")
+	}
+
+	if err := correlationid.Configure(cfg.Correlation); err != nil {
+		log.WithError(err).Fatal("Invalid correlation configuration")
+	}
+
+	if err := gitaly.Configure(cfg.Gitaly); err != nil {
+		log.WithError(err).Fatal("Invalid Gitaly configuration")
+	}
+
+	if err := git.ValidateConfig(cfg.Git); err != nil {
+		log.WithError(err).Fatal("Invalid Git configuration")
+	}
+
+	if err := geoip.Configure(cfg.GeoIP); err != nil {
+		log.WithError(err).Fatal("Invalid GeoIP configuration")
+	}
+
+	if err := queueing.ValidateQueues(cfg.Queues); err != nil {
+		log.WithError(err).Fatal("Invalid queues configuration")
+	}
+
+	if err := filestore.ConfigureJanitor(cfg.UploadJanitor, uploadTempPath(cfg)); err != nil {
+		log.WithError(err).Fatal("Invalid upload janitor configuration")
+	}
+	go filestore.RunJanitor()
+
+	if err := applyReloadableConfig(cfg); err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	}
+	setEffectiveConfig(cfg)
+	go reloadOnSIGHUP(*configFile, cfg)
+	go dumpConfigOnSIGUSR1()
+	go featureflags.Process()
+	go upstream.WatchSlowRequests()
 
-		if cfg.Redis != nil {
-			redis.Configure(cfg.Redis, redis.DefaultDialFunc)
-			go redis.Process()
+	if prometheusListener != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		if err := profiling.Register(mux, cfg.Profiling); err != nil {
+			log.WithError(err).Fatal("Invalid profiling configuration")
 		}
+
+		go func() {
+			if err := http.Serve(prometheusListener, mux); err != nil {
+				log.WithError(err).Error("Failed to serve Prometheus listener")
+			}
+		}()
+	}
+
+	if admin.Enabled(cfg.Admin) {
+		adminHandler, err := admin.NewHandler(cfg.Admin)
+		if err != nil {
+			log.WithError(err).Fatal("Invalid admin configuration")
+		}
+		adminListener, err := admin.Listen(cfg.Admin)
+		if err != nil {
+			log.WithError(err).Fatal("Unable to start the admin API")
+		}
+
+		go func() {
+			if err := http.Serve(adminListener, adminHandler); err != nil {
+				log.WithError(err).Error("Failed to serve the admin API")
+			}
+		}()
 	}
 
 	accessLogger, accessCloser, err := getAccessLogger(logConfig)
@@ -179,10 +378,141 @@ func main() {
 		defer accessCloser.Close()
 	}
 
-	up := wrapRaven(upstream.NewUpstream(cfg, accessLogger))
+	accessLogger, err = filterAccessLogger(accessLogger, cfg.AccessLog)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid access log configuration")
+	}
 
-	err = http.Serve(listener, up)
+	up := wrapSentry(upstream.NewUpstream(cfg, accessLogger))
+
+	servers, err := startListeners(listenerConfigs(cfg.Listeners), up)
 	if err != nil {
+		log.WithError(err).Fatal("Failed to listen")
+	}
+
+	serveErrors := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(serve func() error) {
+			if err := serve(); err != http.ErrServerClosed {
+				serveErrors <- err
+			}
+		}(s.Serve)
+	}
+
+	// Tell the parent process of a graceful upgrade that we have taken over
+	listener.Ready()
+
+	upgraded := make(chan struct{})
+	go waitForUpgrade(servers, upgraded)
+
+	select {
+	case err = <-serveErrors:
 		log.WithError(err).Fatal("Unable to serve")
+	case <-upgraded:
+		log.Info("Handed over to the new process, exiting")
 	}
 }
+
+// waitForUpgrade starts a new gitlab-workhorse process on SIGUSR2 and
+// hands the listeners over to it. Once the new process is ready we stop
+// accepting connections, wait for the requests in flight and close
+// upgraded.
+func waitForUpgrade(servers []*listener.Server, upgraded chan<- struct{}) {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+
+	for range usr2 {
+		log.Info("Received SIGUSR2, starting graceful upgrade")
+		if err := listener.Upgrade(*upgradeTimeout); err != nil {
+			log.WithError(err).Error("Graceful upgrade failed, continuing to serve")
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		var wg sync.WaitGroup
+		for _, s := range servers {
+			wg.Add(1)
+			go func(s *listener.Server) {
+				defer wg.Done()
+				if err := s.Shutdown(ctx); err != nil {
+					log.WithError(err).Error("Requests still in flight after shutdownTimeout")
+				}
+			}(s)
+		}
+		wg.Wait()
+		cancel()
+
+		close(upgraded)
+		return
+	}
+}
+
+// applyTimeouts sets the timeouts of the [timeouts] section, unless their
+// flags are given explicitly
+func applyTimeouts(cfg *config.Config, timeouts config.TimeoutsConfig) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	set := func(flagName string, d *config.TomlDuration, timeout *time.Duration) {
+		if d != nil && !explicit[flagName] {
+			*timeout = d.Duration
+		}
+	}
+
+	set("proxyHeadersTimeout", timeouts.ProxyHeaders, &cfg.ProxyHeadersTimeout)
+	set("apiQueueDuration", timeouts.APIQueue, &cfg.APIQueueTimeout)
+	set("apiCiLongPollingDuration", timeouts.APICILongPolling, &cfg.APICILongPollingDuration)
+	set("upgradeTimeout", timeouts.Upgrade, upgradeTimeout)
+	set("shutdownTimeout", timeouts.Shutdown, shutdownTimeout)
+}
+
+// uploadTempPath is where uploads are saved that Rails doesn't give a
+// LocalTempPath for
+func uploadTempPath(cfg config.Config) string {
+	dir := filepath.Join(cfg.DocumentRoot, "uploads/tmp")
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
+
+// listenerConfigs returns the [[listeners]] from the config file. The
+// listener given by the -listen* flags is only added if there are none,
+// or if the flags are given explicitly.
+func listenerConfigs(configured []config.ListenerConfig) []config.ListenerConfig {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "listen") {
+			explicit = true
+		}
+	})
+
+	if len(configured) > 0 && !explicit {
+		return configured
+	}
+
+	fromFlags := config.ListenerConfig{
+		Network:       *listenNetwork,
+		Addr:          *listenAddr,
+		Umask:         *listenUmask,
+		ProxyProtocol: *listenProxyProtocol,
+	}
+	return append([]config.ListenerConfig{fromFlags}, configured...)
+}
+
+func startListeners(cfgs []config.ListenerConfig, handler http.Handler) ([]*listener.Server, error) {
+	var servers []*listener.Server
+	for _, cfg := range cfgs {
+		s, err := listener.NewServer(cfg, handler)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", cfg.Addr, err)
+		}
+
+		log.WithField("addr", cfg.Addr).WithField("tls", len(cfg.Certificates) > 0).Print("Listening")
+		servers = append(servers, s)
+	}
+
+	return servers, nil
+}
@@ -27,6 +27,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/testhelper"
 	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
@@ -547,6 +548,54 @@ func newUpstreamConfig(authBackend string) *config.Config {
 	}
 }
 
+func TestRateLimitRule(t *testing.T) {
+	require.NoError(t, queueing.ConfigureRateLimits([]config.RateLimitRule{
+		{Name: "search", Path: `^/api/v4/search\z`, Rate: 0.1, Burst: 1},
+	}))
+	defer queueing.ConfigureRateLimits(nil)
+
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	defer ts.Close()
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	resp, _ := httpGet(t, ws.URL+"/api/v4/search", nil)
+	require.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = httpGet(t, ws.URL+"/api/v4/search", nil)
+	require.Equal(t, 429, resp.StatusCode)
+	require.Equal(t, "10", resp.Header.Get("Retry-After"))
+
+	resp, _ = httpGet(t, ws.URL+"/api/v4/projects", nil)
+	require.Equal(t, 200, resp.StatusCode, "other paths are not limited")
+}
+
+func TestCloneFlood(t *testing.T) {
+	require.NoError(t, queueing.ConfigureCloneFlood(config.CloneFloodConfig{Enabled: true, Rate: 0.1, Burst: 1, Challenge: true}))
+	defer queueing.ConfigureCloneFlood(config.CloneFloodConfig{})
+
+	ts := testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+	})
+	defer ts.Close()
+	ws := startWorkhorseServer(ts.URL)
+	defer ws.Close()
+
+	infoRefs := ws.URL + "/group/project.git/info/refs?service=git-upload-pack"
+	resp, _ := httpGet(t, infoRefs, nil)
+	require.Equal(t, 403, resp.StatusCode, "the first clone reaches Rails")
+
+	resp, _ = httpGet(t, infoRefs, nil)
+	require.Equal(t, 429, resp.StatusCode)
+	require.Equal(t, "10", resp.Header.Get("Retry-After"))
+	require.Regexp(t, `\Asha256 20 \d+\.[0-9a-f]{64}\z`, resp.Header.Get(queueing.ChallengeHeader))
+
+	resp, _ = httpGet(t, infoRefs, map[string]string{"Authorization": "Basic dXNlcjp0b2tlbg=="})
+	require.Equal(t, 429, resp.StatusCode, "unchecked credentials don't lift the limit")
+}
+
 func startWorkhorseServer(authBackend string) *httptest.Server {
 	return startWorkhorseServerWithConfig(newUpstreamConfig(authBackend))
 }
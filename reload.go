@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/compression"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/crossorigin"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/featureflags"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/graphqlcache"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/headers"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/secret"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/status"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream"
+)
+
+// configSection applies a section of the config, or fails if it is
+// invalid
+type configSection struct {
+	name  string
+	apply func(config.Config) error
+}
+
+// reloadableSections can change while requests are in flight
+var reloadableSections = []configSection{
+	{"log_level", applyLogLevel},
+	{"trusted_cidrs_for_x_forwarded_for", func(cfg config.Config) error {
+		return helper.ConfigureTrustedProxies(cfg.TrustedCIDRsForXForwardedFor)
+	}},
+	{"signing", func(cfg config.Config) error { return secret.ConfigureSigning(cfg.Signing) }},
+	{"error_reporting", func(cfg config.Config) error { return helper.ConfigureErrorReporting(cfg.ErrorReporting) }},
+	{"headers", func(cfg config.Config) error { return headers.ConfigurePolicy(cfg.Headers) }},
+	{"rate_limit", func(cfg config.Config) error { return queueing.ConfigureRateLimits(cfg.RateLimits) }},
+	{"clone_flood", func(cfg config.Config) error { return queueing.ConfigureCloneFlood(cfg.CloneFlood) }},
+	{"ip_rule", func(cfg config.Config) error { return upstream.ConfigureIPRules(cfg.IPRules) }},
+	{"object_storage", func(cfg config.Config) error {
+		return filestore.ConfigureObjectStorage(cfg.ObjectStorage, cfg.UploadRoutes)
+	}},
+	{"feature_flags", func(cfg config.Config) error { return featureflags.Configure(cfg.FeatureFlags) }},
+	{"slow_requests", func(cfg config.Config) error { return upstream.ConfigureSlowRequests(cfg.SlowRequests) }},
+	{"graphql_cache", func(cfg config.Config) error { return graphqlcache.Configure(cfg.GraphQLCache) }},
+	{"compression", func(cfg config.Config) error { return compression.Configure(cfg.Compression) }},
+	{"cross_origin", func(cfg config.Config) error { return crossorigin.Configure(cfg.CrossOrigin) }},
+	{"status", applyStatus},
+}
+
+// applyReloadableConfig applies the parts of cfg that can change while
+// requests are in flight. It runs at startup and on SIGHUP.
+func applyReloadableConfig(cfg config.Config) error {
+	for _, section := range reloadableSections {
+		if err := section.apply(cfg); err != nil {
+			return fmt.Errorf("%s: %v", section.name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyLogLevel(cfg config.Config) error {
+	level := logrus.InfoLevel
+	if cfg.LogLevel != "" {
+		var err error
+		if level, err = logrus.ParseLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	logrus.SetLevel(level)
+
+	return nil
+}
+
+func applyStatus(cfg config.Config) error {
+	configHash, err := status.ConfigHash(cfg)
+	if err != nil {
+		return err
+	}
+	return status.Configure(cfg.Status, status.Info{Version: Version, BuildTime: BuildTime, ConfigHash: configHash})
+}
+
+// reloadConfig reads the reloadable parts of the config file over cfg and
+// applies them. If they are invalid, cfg stays in effect.
+func reloadConfig(configFile string, cfg config.Config) (config.Config, error) {
+	cfgFromFile, err := config.LoadConfig(configFile)
+	if err != nil {
+		return cfg, err
+	}
+
+	next := cfg
+	next.LogLevel = cfgFromFile.LogLevel
+	next.TrustedCIDRsForXForwardedFor = cfgFromFile.TrustedCIDRsForXForwardedFor
+	next.Signing = cfgFromFile.Signing
+	next.ErrorReporting = cfgFromFile.ErrorReporting
+	next.Headers = cfgFromFile.Headers
+	next.RateLimits = cfgFromFile.RateLimits
+	next.ObjectStorage = cfgFromFile.ObjectStorage
+	next.UploadRoutes = cfgFromFile.UploadRoutes
+	next.Status = cfgFromFile.Status
+	next.FeatureFlags = cfgFromFile.FeatureFlags
+	next.SlowRequests = cfgFromFile.SlowRequests
+	next.GraphQLCache = cfgFromFile.GraphQLCache
+	next.Compression = cfgFromFile.Compression
+	next.CloneFlood = cfgFromFile.CloneFlood
+	next.IPRules = cfgFromFile.IPRules
+	next.CrossOrigin = cfgFromFile.CrossOrigin
+
+	if err := applyReloadableConfig(next); err != nil {
+		// The sections before the invalid one are applied already. cfg
+		// was applied before, so it can't fail.
+		applyReloadableConfig(cfg)
+		return cfg, err
+	}
+
+	return next, nil
+}
+
+// reloadOnSIGHUP re-reads the config file on SIGHUP. Only the sections
+// of applyReloadableConfig change, the others need a restart or a
+// graceful upgrade.
+func reloadOnSIGHUP(configFile string, cfg config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		if configFile == "" {
+			log.Info("Received SIGHUP, but there is no config file to reload")
+			continue
+		}
+
+		next, err := reloadConfig(configFile, cfg)
+		if err != nil {
+			log.WithError(err).WithField("configFile", configFile).Error("Received SIGHUP, config reload failed, keeping the current config")
+			continue
+		}
+
+		cfg = next
+		log.WithField("configFile", configFile).Info("Received SIGHUP, reloaded config")
+		setEffectiveConfig(cfg)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "workhorse-config")
+	require.NoError(t, err)
+	defer f.Close()
+
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer applyReloadableConfig(config.Config{})
+
+	cfg := config.Config{Version: "test"}
+	require.NoError(t, applyReloadableConfig(cfg))
+
+	configFile := writeConfigFile(t, `
+log_level = "debug"
+trusted_cidrs_for_x_forwarded_for = ["10.0.0.0/8"]
+
+[[rate_limit]]
+Name = "api"
+Path = "^/api/"
+Rate = 10.0
+`)
+	defer os.Remove(configFile)
+
+	next, err := reloadConfig(configFile, cfg)
+	require.NoError(t, err)
+	require.Equal(t, logrus.DebugLevel, logrus.GetLevel())
+	require.Equal(t, []string{"10.0.0.0/8"}, next.TrustedCIDRsForXForwardedFor)
+	require.Len(t, next.RateLimits, 1)
+	require.Equal(t, "test", next.Version, "sections that can't be reloaded must be kept")
+}
+
+func TestReloadInvalidConfigKeepsCurrent(t *testing.T) {
+	defer applyReloadableConfig(config.Config{})
+
+	cfg := config.Config{LogLevel: "warning"}
+	require.NoError(t, applyReloadableConfig(cfg))
+
+	configFile := writeConfigFile(t, `
+log_level = "debug"
+
+[[rate_limit]]
+Name = "invalid"
+Path = "^/api/("
+Rate = 10.0
+`)
+	defer os.Remove(configFile)
+
+	next, err := reloadConfig(configFile, cfg)
+	require.Error(t, err)
+	require.Equal(t, cfg, next)
+	require.Equal(t, logrus.WarnLevel, logrus.GetLevel(), "sections applied before the error must be rolled back")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/getsentry/sentry-go"
+	"gitlab.com/gitlab-org/labkit/log"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/helper"
+)
+
+// wrapSentry configures error reporting to Sentry. Panics of handlers are
+// recovered and reported by the upstream handler.
+func wrapSentry(h http.Handler) http.Handler {
+	// Use a custom environment variable (not SENTRY_DSN) to prevent
+	// clashes with gitlab-rails.
+	sentryDSN := os.Getenv("GITLAB_WORKHORSE_SENTRY_DSN")
+	if sentryDSN == "" {
+		return h
+	}
+
+	err := sentry.Init(sentry.ClientOptions{
+		Dsn:         sentryDSN,
+		Environment: os.Getenv("GITLAB_WORKHORSE_SENTRY_ENVIRONMENT"),
+		Release:     Version,
+	})
+	if err != nil {
+		log.WithError(err).Error("Invalid Sentry configuration")
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, helper.WithBreadcrumbs(r))
+	})
+}
@@ -125,6 +125,7 @@ func TestAcceleratedUpload(t *testing.T) {
 		{"POST", `/api/v4/projects/import`, true},
 		{"POST", `/import/gitlab_project`, true},
 		{"POST", `/api/v4/projects/9001/packages/pypi`, true},
+		{"POST", `/api/v4/projects/9001/packages/helm/api/stable/charts`, true},
 	}
 
 	for _, tt := range tests {
@@ -289,9 +290,9 @@ func TestLfsUpload(t *testing.T) {
 	require.Equal(t, rspBody, string(rspData))
 }
 
-func packageUploadTestServer(t *testing.T, resource string, reqBody string, rspBody string) *httptest.Server {
+func packageUploadTestServer(t *testing.T, method string, resource string, reqBody string, rspBody string) *httptest.Server {
 	return testhelper.TestServerWithHandler(regexp.MustCompile(`.`), func(w http.ResponseWriter, r *http.Request) {
-		require.Equal(t, r.Method, "PUT")
+		require.Equal(t, r.Method, method)
 		apiResponse := fmt.Sprintf(
 			`{"TempPath":%q, "Size": %d}`, scratchDir, len(reqBody),
 		)
@@ -327,17 +328,17 @@ func packageUploadTestServer(t *testing.T, resource string, reqBody string, rspB
 	})
 }
 
-func testPackageFileUpload(t *testing.T, resource string) {
+func testPackageFileUpload(t *testing.T, method string, resource string) {
 	reqBody := "test data"
 	rspBody := "test success"
 
-	ts := packageUploadTestServer(t, resource, reqBody, rspBody)
+	ts := packageUploadTestServer(t, method, resource, reqBody, rspBody)
 	defer ts.Close()
 
 	ws := startWorkhorseServer(ts.URL)
 	defer ws.Close()
 
-	req, err := http.NewRequest("PUT", ws.URL+resource, strings.NewReader(reqBody))
+	req, err := http.NewRequest(method, ws.URL+resource, strings.NewReader(reqBody))
 	require.NoError(t, err)
 
 	resp, err := http.DefaultClient.Do(req)
@@ -352,12 +353,19 @@ func testPackageFileUpload(t *testing.T, resource string) {
 }
 
 func TestPackageFilesUpload(t *testing.T) {
-	routes := []string{
-		"/api/v4/packages/conan/v1/files",
-		"/api/v4/projects/2412/packages/maven/v1/files",
+	routes := []struct {
+		method   string
+		resource string
+	}{
+		{"PUT", "/api/v4/packages/conan/v1/files"},
+		{"PUT", "/api/v4/projects/2412/packages/maven/v1/files"},
+		{"PUT", "/api/v4/projects/2412/packages/generic/mypackage/0.0.1/file.tar.gz"},
+		{"PUT", "/api/v4/projects/2412/packages/debian/libsample0_1.2.3~alpha2_amd64.deb"},
+		{"POST", "/api/v4/projects/2412/packages/rubygems/api/v1/gems"},
+		{"PUT", "/api/v4/projects/2412/packages/terraform/modules/mymodule/mysystem/1.0.0/file"},
 	}
 
 	for _, r := range routes {
-		testPackageFileUpload(t, r)
+		testPackageFileUpload(t, r.method, r.resource)
 	}
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/accesslog"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/admin"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/builds"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/correlationid"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/filestore"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/geoip"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/git"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/gitaly"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/listener"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/nats"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/profiling"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/queueing"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/redis"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/terraform"
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/upstream/roundtripper"
+)
+
+const probeTimeout = 5 * time.Second
+
+// startupSections are only applied at startup. Together with
+// reloadableSections they are all sections that can be invalid.
+var startupSections = []configSection{
+	{"secrets", func(cfg config.Config) error { return config.ConfigureSecrets(cfg.Secrets) }},
+	{"ci_poll_interval", func(cfg config.Config) error {
+		return builds.ConfigurePollIntervals(cfg.CIPollInterval, cfg.APILimit)
+	}},
+	{"ci_job_request_cache", func(cfg config.Config) error { return builds.ConfigureJobRequestCache(cfg.CIJobRequestCache) }},
+	{"ci_trace_buffer", func(cfg config.Config) error { return builds.ConfigureTraceBuffer(cfg.CITraceBuffer, cfg.Redis) }},
+	{"ci_trace_stream", func(cfg config.Config) error { return builds.ConfigureTraceStream(cfg.CITraceStream) }},
+	{"backend_tls", func(cfg config.Config) error { return roundtripper.ConfigureTLS(cfg.BackendTLS) }},
+	{"backend_transport", func(cfg config.Config) error { return roundtripper.ConfigureTransport(cfg.BackendTransport) }},
+	{"backend_affinity", func(cfg config.Config) error { return roundtripper.ConfigureAffinity(cfg.BackendAffinity) }},
+	{"correlation", func(cfg config.Config) error { return correlationid.Configure(cfg.Correlation) }},
+	{"gitaly", func(cfg config.Config) error { return gitaly.Configure(cfg.Gitaly) }},
+	{"git", func(cfg config.Config) error { return git.ValidateConfig(cfg.Git) }},
+	{"geoip", func(cfg config.Config) error { return geoip.Configure(cfg.GeoIP) }},
+	{"terraform_state", func(cfg config.Config) error { return terraform.Configure(cfg.TerraformState, cfg.Redis) }},
+	{"nats", func(cfg config.Config) error {
+		if cfg.NATS == nil {
+			return nil
+		}
+		return nats.Configure(cfg.NATS)
+	}},
+	{"profiling", func(cfg config.Config) error { return profiling.Register(http.NewServeMux(), cfg.Profiling) }},
+	{"access_log", func(cfg config.Config) error {
+		_, err := accesslog.NewFilter(cfg.AccessLog, &logrus.TextFormatter{})
+		return err
+	}},
+	{"upload_janitor", func(cfg config.Config) error { return filestore.ConfigureJanitor(cfg.UploadJanitor) }},
+	{"queues", func(cfg config.Config) error { return queueing.ValidateQueues(cfg.Queues) }},
+	{"admin", func(cfg config.Config) error {
+		if !admin.Enabled(cfg.Admin) {
+			return nil
+		}
+		return admin.Validate(cfg.Admin)
+	}},
+	{"listeners", func(cfg config.Config) error {
+		for _, l := range cfg.Listeners {
+			if err := listener.Validate(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// runValidateConfig prints the problems of the config file, and returns
+// the exit code of -validate-config
+func runValidateConfig(w io.Writer, configFile string, apiLimit uint, online bool) int {
+	errs := validateConfig(configFile, apiLimit, online)
+	for _, err := range errs {
+		fmt.Fprintf(w, "%s: %v\n", configFile, err)
+	}
+
+	if len(errs) > 0 {
+		return 1
+	}
+
+	fmt.Fprintf(w, "%s: OK\n", configFile)
+	return 0
+}
+
+// validateConfig loads the config file like Workhorse does at startup.
+// With online, it also checks that secrets can be fetched, and that Redis
+// and NATS can be reached.
+func validateConfig(configFile string, apiLimit uint, online bool) []error {
+	if configFile == "" {
+		return []error{errors.New("-validate-config needs -config")}
+	}
+
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		return []error{err}
+	}
+	cfg.APILimit = apiLimit
+
+	var errs []error
+
+	unknown, err := config.UnknownKeys(configFile)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, key := range unknown {
+		errs = append(errs, fmt.Errorf("unknown setting %q", key))
+	}
+
+	sections := append(append([]configSection{}, startupSections...), reloadableSections...)
+	for _, section := range sections {
+		if err := section.apply(*cfg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", section.name, err))
+		}
+	}
+
+	if online {
+		errs = append(errs, probeServices(*cfg)...)
+	}
+
+	return errs
+}
+
+// probeServices connects to the services of cfg. The addresses of Gitaly
+// and object storage come from Rails with each request, so they can't be
+// checked here.
+func probeServices(cfg config.Config) []error {
+	var errs []error
+
+	if err := config.ResolveSecrets(cfg); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cfg.Redis != nil {
+		if err := probeRedis(cfg.Redis); err != nil {
+			errs = append(errs, fmt.Errorf("redis: %v", err))
+		}
+	}
+
+	if cfg.NATS != nil {
+		conn, err := net.DialTimeout("tcp", cfg.NATS.URL.Host, probeTimeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("nats: %v", err))
+		} else {
+			conn.Close()
+		}
+	}
+
+	return errs
+}
+
+// probeRedis pings Redis. The Redis dialer has no connect timeout, so the
+// probe gives up on its own.
+func probeRedis(cfg *config.RedisConfig) error {
+	redis.Configure(cfg, redis.DefaultDialFunc)
+
+	result := make(chan error, 1)
+	go func() {
+		conn := redis.Get()
+		defer conn.Close()
+
+		_, err := conn.Do("PING")
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(probeTimeout):
+		return fmt.Errorf("no answer within %v", probeTimeout)
+	}
+}
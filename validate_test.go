@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-workhorse/internal/config"
+)
+
+func resetSections(t *testing.T) {
+	for _, section := range append(append([]configSection{}, startupSections...), reloadableSections...) {
+		require.NoError(t, section.apply(config.Config{}), section.name)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	defer resetSections(t)
+
+	configFile := writeConfigFile(t, `
+trusted_cidrs_for_x_forwarded_for = ["10.0.0.0/8"]
+
+[[rate_limit]]
+Name = "api"
+Path = "^/api/"
+Rate = 10.0
+`)
+	defer os.Remove(configFile)
+
+	var out bytes.Buffer
+	require.Equal(t, 0, runValidateConfig(&out, configFile, 0, false))
+	require.Contains(t, out.String(), "OK")
+}
+
+func TestValidateConfigErrors(t *testing.T) {
+	defer resetSections(t)
+
+	configFile := writeConfigFile(t, `
+log_levle = "debug"
+trusted_cidrs_for_x_forwarded_for = ["10.0.0.0/33"]
+
+[[rate_limit]]
+Name = "api"
+Path = "^/api/("
+Rate = 10.0
+
+[git]
+ProtocolV2 = "always"
+
+[[listeners]]
+Network = "udp"
+Addr = "localhost:8181"
+`)
+	defer os.Remove(configFile)
+
+	var out bytes.Buffer
+	require.Equal(t, 1, runValidateConfig(&out, configFile, 0, false))
+
+	for _, problem := range []string{
+		`unknown setting "log_levle"`,
+		"trusted_cidrs_for_x_forwarded_for: trusted proxy",
+		"rate_limit: rate limit rule 0",
+		`git: unknown ProtocolV2 "always"`,
+		`listeners: listener localhost:8181: unknown Network "udp"`,
+	} {
+		require.Contains(t, out.String(), problem)
+	}
+}
+
+func TestValidateConfigOnline(t *testing.T) {
+	defer resetSections(t)
+
+	// Nothing listens on the address of a closed listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	configFile := writeConfigFile(t, `
+[redis]
+URL = "tcp://`+addr+`"
+`)
+	defer os.Remove(configFile)
+
+	require.Empty(t, validateConfig(configFile, 0, false), "Redis is only probed online")
+
+	errs := validateConfig(configFile, 0, true)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Error(), "redis:")
+}
+
+func TestValidateConfigNeedsConfigFile(t *testing.T) {
+	require.Len(t, validateConfig("", 0, false), 1)
+}